@@ -5,11 +5,15 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/codegangsta/cli"
 	gconfig "github.com/litl/galaxy/config"
 	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/registry"
 	"github.com/litl/galaxy/utils"
 )
 
@@ -20,10 +24,20 @@ type backupData struct {
 
 // Serialized backup format
 type appCfg struct {
-	Name    string
-	Version string
-	Env     map[string]string
-	Ports   map[string]string
+	Name      string
+	Version   string
+	VersionID string `json:",omitempty"`
+	Env       map[string]string
+	Ports     map[string]string
+	// Runtime is keyed by pool
+	Runtime  map[string]*runtimeCfg           `json:",omitempty"`
+	Sidecars map[string]gconfig.SidecarConfig `json:",omitempty"`
+}
+
+type runtimeCfg struct {
+	Processes int    `json:",omitempty"`
+	Memory    string `json:",omitempty"`
+	CPUShares string `json:",omitempty"`
 }
 
 // Backup app config to a file or STDOUT
@@ -96,10 +110,28 @@ func getAppBackup(app, env string) (*appCfg, error) {
 	}
 
 	backup := &appCfg{
-		Name:    app,
-		Version: svcCfg.Version(),
-		Env:     svcCfg.Env(),
-		Ports:   svcCfg.Ports(),
+		Name:      app,
+		Version:   svcCfg.Version(),
+		VersionID: svcCfg.VersionID(),
+		Env:       svcCfg.Env(),
+		Ports:     svcCfg.Ports(),
+		Runtime:   make(map[string]*runtimeCfg),
+		Sidecars:  make(map[string]gconfig.SidecarConfig),
+	}
+
+	for _, pool := range svcCfg.RuntimePools() {
+		rt := &runtimeCfg{
+			Memory:    svcCfg.GetMemory(pool),
+			CPUShares: svcCfg.GetCPUShares(pool),
+		}
+		if ps := svcCfg.GetProcesses(pool); ps >= 0 {
+			rt.Processes = ps
+		}
+		backup.Runtime[pool] = rt
+	}
+
+	for _, sidecar := range svcCfg.Sidecars() {
+		backup.Sidecars[sidecar.Name] = sidecar
 	}
 	return backup, nil
 }
@@ -189,15 +221,31 @@ func appRestore(c *cli.Context) {
 func restoreApp(bkup *appCfg, env string) error {
 	fmt.Println("restoring", bkup.Name)
 
-	svcCfg, err := configStore.GetApp(bkup.Name, env)
+	exists, err := configStore.AppExists(bkup.Name, env)
 	if err != nil {
 		return err
 	}
 
+	var svcCfg *gconfig.AppConfig
+	if exists {
+		svcCfg, err = configStore.GetApp(bkup.Name, env)
+		if err != nil {
+			return err
+		}
+	}
+
 	if svcCfg == nil {
 		svcCfg = gconfig.NewAppConfig(bkup.Name, bkup.Version)
 	}
 
+	if bkup.Version != "" && svcCfg.Version() != bkup.Version {
+		svcCfg.SetVersion(bkup.Version)
+	}
+
+	if bkup.VersionID != "" && svcCfg.VersionID() != bkup.VersionID {
+		svcCfg.SetVersionID(bkup.VersionID)
+	}
+
 	for port, net := range bkup.Ports {
 		svcCfg.AddPort(port, net)
 	}
@@ -206,6 +254,279 @@ func restoreApp(bkup *appCfg, env string) error {
 		svcCfg.EnvSet(k, v)
 	}
 
+	for pool, rt := range bkup.Runtime {
+		if rt.Processes > 0 {
+			svcCfg.SetProcesses(pool, rt.Processes)
+		}
+		if rt.Memory != "" {
+			svcCfg.SetMemory(pool, rt.Memory)
+		}
+		if rt.CPUShares != "" {
+			svcCfg.SetCPUShares(pool, rt.CPUShares)
+		}
+	}
+
+	for name, sidecar := range bkup.Sidecars {
+		sidecar.Name = name
+		if err := svcCfg.SetSidecar(sidecar); err != nil {
+			return err
+		}
+	}
+
 	_, err = configStore.UpdateApp(svcCfg, env)
 	return err
 }
+
+// registryBackupVersion is the version of the registryBackup format written
+// by backup.  restore refuses files from a newer version.
+const registryBackupVersion = 1
+
+// registryBackup is everything needed to rebuild a registry: every env with
+// its pools, assignments, app configs and registrations.
+type registryBackup struct {
+	Version int
+	Time    time.Time
+	Envs    []*envBackup
+}
+
+type envBackup struct {
+	Name string
+	// Pools maps each pool to the apps assigned to it
+	Pools map[string][]string
+	Apps  []*appCfg
+	// Registrations are keyed by their registry path
+	Registrations map[string]registry.ServiceRegistration `json:",omitempty"`
+}
+
+// Backup all envs, or the one given with --env, to a file or STDOUT
+func registryBackupCmd(c *cli.Context) {
+	initRegistry(c)
+
+	envs := []string{utils.GalaxyEnv(c)}
+	if envs[0] == "" {
+		var err error
+		envs, err = configStore.ListEnvs()
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+	}
+
+	backup := &registryBackup{
+		Version: registryBackupVersion,
+		Time:    time.Now(),
+	}
+
+	errCount := 0
+	for _, env := range envs {
+		envBkup, errs := getEnvBackup(env)
+		for _, err := range errs {
+			log.Errorf("ERROR: %s [%s]", err, env)
+		}
+		errCount += len(errs)
+		if envBkup != nil {
+			backup.Envs = append(backup.Envs, envBkup)
+		}
+	}
+
+	if errCount > 0 {
+		fmt.Printf("WARNING: backup completed with %d errors\n", errCount)
+		defer os.Exit(errCount)
+	}
+
+	j, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fileName := c.String("file")
+	if fileName != "" {
+		if err := ioutil.WriteFile(fileName, j, 0666); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	os.Stdout.Write(j)
+}
+
+func getEnvBackup(env string) (*envBackup, []error) {
+	errs := []error{}
+	bkup := &envBackup{
+		Name:          env,
+		Pools:         make(map[string][]string),
+		Registrations: make(map[string]registry.ServiceRegistration),
+	}
+
+	pools, err := configStore.ListPools(env)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	for _, pool := range pools {
+		apps, err := configStore.ListAssignments(env, pool)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		bkup.Pools[pool] = apps
+	}
+
+	appList, err := configStore.ListApps(env)
+	if err != nil {
+		return nil, append(errs, err)
+	}
+
+	for _, app := range appList {
+		data, err := getAppBackup(app.Name, env)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", app.Name, err))
+			continue
+		}
+		bkup.Apps = append(bkup.Apps, data)
+	}
+
+	regs, err := serviceRegistry.ListRegistrations(env)
+	if err != nil {
+		return bkup, append(errs, err)
+	}
+
+	for _, reg := range regs {
+		bkup.Registrations[reg.Path] = reg
+	}
+	return bkup, errs
+}
+
+// Restore envs from a registry backup
+func registryRestoreCmd(c *cli.Context) {
+	initRegistry(c)
+
+	var err error
+	var rawBackup []byte
+
+	fileName := c.String("file")
+	if fileName != "" {
+		rawBackup, err = ioutil.ReadFile(fileName)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		log.Println("Reading backup from STDIN")
+		rawBackup, err = ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	backup := &registryBackup{}
+	if err := json.Unmarshal(rawBackup, backup); err != nil {
+		log.Fatal(err)
+	}
+
+	if backup.Version == 0 || backup.Version > registryBackupVersion {
+		log.Fatalf("ERROR: unsupported backup version %d", backup.Version)
+	}
+
+	fmt.Println("Found backup from ", backup.Time)
+
+	toRestore := backup.Envs
+	if env := utils.GalaxyEnv(c); env != "" {
+		toRestore = nil
+		for _, envBkup := range backup.Envs {
+			if envBkup.Name == env {
+				toRestore = append(toRestore, envBkup)
+			}
+		}
+		if len(toRestore) == 0 {
+			log.Fatalf("no backup found for env '%s'\n", env)
+		}
+	}
+
+	// --as restores a single env under a new name, e.g. to seed staging
+	// from a prod backup
+	target := c.String("as")
+	if target != "" && len(toRestore) != 1 {
+		log.Fatal("ERROR: --as requires a backup with one env or --env")
+	}
+
+	if !c.Bool("force") {
+		needForce := false
+		for _, envBkup := range toRestore {
+			env := envBkup.Name
+			if target != "" {
+				env = target
+			}
+			for _, bkup := range envBkup.Apps {
+				exists, err := configStore.AppExists(bkup.Name, env)
+				if err != nil {
+					log.Fatal(err)
+				}
+				if exists {
+					log.Warnf("Cannot restore over existing app '%s' in %s", bkup.Name, env)
+					needForce = true
+				}
+			}
+		}
+		if needForce {
+			log.Fatal("Use -force to overwrite")
+		}
+	}
+
+	loggedErr := false
+	for _, envBkup := range toRestore {
+		env := envBkup.Name
+		if target != "" {
+			env = target
+		}
+
+		for _, err := range restoreEnv(envBkup, env, c.Bool("registrations")) {
+			log.Errorf("%s", err)
+			loggedErr = true
+		}
+	}
+
+	if loggedErr {
+		log.Fatal("Error occured during restore")
+	}
+}
+
+func restoreEnv(bkup *envBackup, env string, registrations bool) []error {
+	fmt.Println("restoring env", env)
+	errs := []error{}
+
+	for _, app := range bkup.Apps {
+		if err := restoreApp(app, env); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	pools := []string{}
+	for pool := range bkup.Pools {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+
+	for _, pool := range pools {
+		if _, err := configStore.CreatePool(pool, env); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, app := range bkup.Pools[pool] {
+			if _, err := configStore.AssignApp(app, env, pool); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if !registrations {
+		return errs
+	}
+
+	for regPath, reg := range bkup.Registrations {
+		reg.Path = path.Join(env, strings.TrimPrefix(regPath, bkup.Name+"/"))
+		if err := serviceRegistry.RestoreRegistration(&reg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	golog "log"
+	"net"
 	"os"
 	"os/signal"
 	"strings"
@@ -18,18 +20,30 @@ import (
 	"github.com/litl/galaxy/commander"
 	"github.com/litl/galaxy/config"
 	"github.com/litl/galaxy/discovery"
+	"github.com/litl/galaxy/events"
 	"github.com/litl/galaxy/log"
 	"github.com/litl/galaxy/registry"
 	"github.com/litl/galaxy/runtime"
 	"github.com/litl/galaxy/utils"
 )
 
+// restartSlotTTL is how long a rolling restart slot outlives its delay in
+// case a commander dies while holding it.
+const restartSlotTTL = 2 * time.Minute
+
+// pullBatchWait is how long the agent waits for more config changes after
+// one arrives, so the images of apps deployed together are pulled at once.
+const pullBatchWait = 200 * time.Millisecond
+
 var (
 	stopCutoff      int64
+	cutoverTimeout  time.Duration
 	apps            []string
 	env             string
 	pool            string
 	registryURL     string
+	mirrorURL       string
+	replicaURL      string
 	loop            bool
 	hostIP          string
 	dns             string
@@ -41,9 +55,33 @@ var (
 	serviceRegistry *registry.ServiceRegistry
 	configStore     *config.Store
 	serviceRuntime  *runtime.ServiceRuntime
-	workerChans     map[string]chan string
+	workerChans     map[string]chan workerCmd
 	wg              sync.WaitGroup
 	signalsChan     chan os.Signal
+	eventSinks      utils.SliceVar
+	registryAuths   utils.SliceVar
+	imageMirrors    utils.SliceVar
+	credHelper      string
+	reportFile      string
+	blacklistFile   string
+	gcInterval      time.Duration
+	gcAge           time.Duration
+	pullTimeout     time.Duration
+	memoryReserve   string
+	bindIP          string
+	hostLabels      string
+	weight          int
+	rollbackAfter   int
+	jsonProgress    bool
+	outputFormat    string
+	listFilters     utils.SliceVar
+	listSort        string
+	parallelPulls   int
+	pullSlots       chan struct{}
+	dockerConfig    = runtime.DefaultDockerConfig()
+	workerLock      sync.Mutex
+	startFailures   = make(map[string]int)
+	failuresLock    sync.Mutex
 )
 
 func initOrDie() {
@@ -55,29 +93,89 @@ func initOrDie() {
 	serviceRegistry = registry.NewServiceRegistry(
 		registry.DefaultTTL,
 	)
+	serviceRegistry.Weight = weight
 	serviceRegistry.Connect(registryURL)
+	if mirrorURL != "" {
+		serviceRegistry.Mirror(mirrorURL)
+	}
+	if replicaURL != "" {
+		serviceRegistry.ReadReplica(replicaURL)
+	}
 
 	configStore = config.NewStore(
 		registry.DefaultTTL,
 	)
 
 	configStore.Connect(registryURL)
+	if mirrorURL != "" {
+		configStore.Mirror(mirrorURL)
+	}
+	if replicaURL != "" {
+		configStore.ReadReplica(replicaURL)
+	}
+
+	serviceRuntime = runtime.NewServiceRuntime(serviceRegistry, dns, hostIP, dockerConfig)
+	serviceRuntime.BlacklistFile = blacklistFile
+	serviceRuntime.ConfigStore = configStore
+	if bindIP != "" && net.ParseIP(bindIP) == nil {
+		log.Fatalf("ERROR: Bad bind address %s", bindIP)
+	}
+	serviceRuntime.BindIP = bindIP
+	if _, err := utils.ParseLabels(hostLabels); err != nil {
+		log.Fatalf("ERROR: Bad host labels %s: %s", hostLabels, err)
+	}
+	serviceRuntime.HostLabels = hostLabels
+	if parallelPulls < 1 {
+		log.Fatalf("ERROR: Bad parallel pulls %d, it must be at least 1", parallelPulls)
+	}
+	pullSlots = make(chan struct{}, parallelPulls)
+	serviceRuntime.PullTimeout = pullTimeout
+	if jsonProgress {
+		serviceRuntime.Progress = printProgress()
+	}
+	reserve, err := utils.ParseMemory(memoryReserve)
+	if err != nil {
+		log.Fatalf("ERROR: Bad memory reserve %s: %s", memoryReserve, err)
+	}
+	serviceRuntime.MemoryReserve = reserve
+	serviceRuntime.CredentialHelper = credHelper
+	serviceRuntime.RegistryAuths = make(map[string]runtime.RegistryAuth)
+	for _, login := range registryAuths {
+		registry, auth, err := runtime.ParseRegistryAuth(login)
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		serviceRuntime.RegistryAuths[registry] = auth
+	}
+	serviceRuntime.ImageMirrors = make(map[string]string)
+	for _, m := range imageMirrors {
+		registry, mirror, err := runtime.ParseImageMirror(m)
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		serviceRuntime.ImageMirrors[registry] = mirror
+	}
 
-	serviceRuntime = runtime.NewServiceRuntime(serviceRegistry, dns, hostIP)
+	for _, sink := range eventSinks {
+		err := events.AddSinkURL(sink)
+		if err != nil {
+			log.Fatalf("ERROR: Invalid event sink %s: %s", sink, err)
+		}
+	}
 
 	apps, err := configStore.ListAssignments(env, pool)
 	if err != nil {
 		log.Fatalf("ERROR: Could not retrieve service configs for /%s/%s: %s", env, pool, err)
 	}
 
-	workerChans = make(map[string]chan string)
+	workerChans = make(map[string]chan workerCmd)
 	for _, app := range apps {
 		appCfg, err := configStore.GetApp(app, env)
 		if err != nil {
 			log.Fatalf("ERROR: Could not retrieve service config for /%s/%s: %s", env, pool, err)
 		}
 
-		workerChans[appCfg.Name] = make(chan string)
+		workerChans[appCfg.Name] = make(chan workerCmd)
 	}
 
 	signalsChan = make(chan os.Signal, 1)
@@ -125,6 +223,9 @@ func pullImage(appCfg *config.AppConfig) (*docker.Image, error) {
 		return image, nil
 	}
 
+	pullSlots <- struct{}{}
+	defer func() { <-pullSlots }()
+
 	log.Printf("Pulling %s version %s\n", appCfg.Name, appCfg.Version())
 	image, err = serviceRuntime.PullImage(appCfg.Version(),
 		appCfg.VersionID())
@@ -145,53 +246,366 @@ func pullImage(appCfg *config.AppConfig) (*docker.Image, error) {
 	return image, nil
 }
 
-func startService(appCfg *config.AppConfig, logStatus bool) {
+// prePull pulls the images this host runs for those of appCfgs assigned to
+// its pool, green versions included, parallelPulls at a time, so none of
+// their containers wait on another app's pull.  Failures are logged and
+// left for the workers to retry.
+func prePull(appCfgs []*config.AppConfig) {
+	pulls := []*config.AppConfig{}
+	for _, appCfg := range appCfgs {
+		if appCfg.Version() == "" {
+			continue
+		}
+		assigned, err := appAssigned(appCfg.Name)
+		if err != nil || !assigned {
+			continue
+		}
+		cfg, err := hostConfig(appCfg)
+		if err != nil {
+			log.Errorf("ERROR: Could not determine canary host for %s: %s", appCfg.Name, err)
+			continue
+		}
+		pulls = append(pulls, cfg)
+		if appCfg.GreenVersion() != "" {
+			pulls = append(pulls, appCfg.Green())
+		}
+	}
+	if len(pulls) < 2 {
+		return
+	}
+
+	var done sync.WaitGroup
+	for _, cfg := range pulls {
+		done.Add(1)
+		go func(cfg *config.AppConfig) {
+			defer done.Done()
+			// err logged via pullImage
+			pullImage(cfg)
+		}(cfg)
+	}
+	done.Wait()
+}
+
+// printProgress returns a Progress callback that writes each step to
+// stdout as a line of JSON, apart from the log on stderr.
+func printProgress() func(*runtime.Progress) {
+	var mu sync.Mutex
+	enc := json.NewEncoder(os.Stdout)
+	return func(p *runtime.Progress) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := enc.Encode(p); err != nil {
+			log.Errorf("ERROR: Unable to write progress: %s", err)
+		}
+	}
+}
+
+func publishEvent(eventType, app, msg string) {
+	events.Publish(events.Event{
+		Type:    eventType,
+		Env:     env,
+		Pool:    pool,
+		App:     app,
+		Host:    hostIP,
+		Message: msg,
+	})
+}
+
+// stoppedOnStart counts a container of appCfg's version that exited right
+// after starting, and rolls the app back to its previous version once that
+// has happened rollbackAfter times in a row.
+func stoppedOnStart(appCfg *config.AppConfig) {
+	if rollbackAfter <= 0 {
+		return
+	}
+
+	key := appCfg.Name + "/" + appCfg.Version()
+	failuresLock.Lock()
+	startFailures[key]++
+	failures := startFailures[key]
+	failuresLock.Unlock()
+
+	if failures < rollbackAfter {
+		return
+	}
+
+	prev, err := commander.Rollback(configStore, serviceRuntime, appCfg.Name, env, appCfg.Version())
+	if err != nil {
+		log.Errorf("ERROR: Could not roll back %s: %s", appCfg.Name, err)
+		publishEvent("app.error", appCfg.Name,
+			fmt.Sprintf("version %s stopped %d times and could not be rolled back: %s", appCfg.Version(), failures, err))
+		return
+	}
+
+	failuresLock.Lock()
+	delete(startFailures, key)
+	failuresLock.Unlock()
+
+	if prev != "" {
+		publishEvent("app.rollback", appCfg.Name,
+			fmt.Sprintf("version %s stopped %d times, rolled back to %s", appCfg.Version(), failures, prev))
+	}
+}
+
+func startService(appCfg *config.AppConfig, report *commander.ReconcileReport) {
 
 	desired, err := commander.Balanced(configStore, hostIP, appCfg.Name, env, pool)
 	if err != nil {
 		log.Errorf("ERROR: Could not determine instance count: %s", err)
+		report.Error(appCfg.Name, err)
 		return
 	}
 
-	running, err := serviceRuntime.InstanceCount(appCfg.Name, strconv.FormatInt(appCfg.ID(), 10))
+	running, err := serviceRuntime.InstanceCount(appCfg)
 	if err != nil {
 		log.Errorf("ERROR: Could not determine running instance count: %s", err)
+		report.Error(appCfg.Name, err)
 		return
 	}
+	report.Check(appCfg.Name, appCfg.Version(), desired, running)
+
+	if desired > running {
+		err := serviceRuntime.WaitForDepends(env, appCfg)
+		if err != nil {
+			log.Errorf("ERROR: Not starting %s: %s", appCfg.Name, err)
+			report.Error(appCfg.Name, err)
+			return
+		}
+	}
 
 	for i := 0; i < desired-running; i++ {
+		old, err := serviceRuntime.OldVersions(appCfg)
+		if err != nil {
+			log.Errorf("ERROR: Could not list old containers: %s", err)
+			report.Error(appCfg.Name, err)
+			return
+		}
+
 		container, err := serviceRuntime.Start(env, pool, appCfg)
 		if err != nil {
 			log.Errorf("ERROR: Could not start containers: %s", err)
+			report.Error(appCfg.Name, err)
+
+			eventType := "container.error"
+			if _, ok := err.(*runtime.InsufficientMemoryError); ok {
+				eventType = "host.full"
+			}
+			publishEvent(eventType, appCfg.Name,
+				fmt.Sprintf("could not start version %s: %s", appCfg.Version(), err))
+
+			if err == runtime.ErrContainerStopped {
+				stoppedOnStart(appCfg)
+			}
 			return
 		}
 
+		failuresLock.Lock()
+		delete(startFailures, appCfg.Name+"/"+appCfg.Version())
+		failuresLock.Unlock()
+
 		log.Printf("Started %s version %s as %s\n", appCfg.Name, appCfg.Version(), container.ID[0:12])
+		report.ContainerStarted(appCfg.Name, container.ID[0:12])
+		publishEvent("container.start", appCfg.Name,
+			fmt.Sprintf("started version %s as %s", appCfg.Version(), container.ID[0:12]))
+
+		// an old container holding the app's host ports was replaced by
+		// the new one rather than running alongside it
+		replaced, err := replacedOld(appCfg, old)
+		if err != nil {
+			log.Errorf("ERROR: Could not list old containers: %s", err)
+			report.Error(appCfg.Name, err)
+		}
+		reportOldStopped(report, appCfg, replaced)
 
-		err = serviceRuntime.StopOldVersion(appCfg, 1)
+		// keep the old version running until the new one can take over
+		err = waitRegistered(container.ID)
+		if err != nil {
+			log.Errorf("ERROR: %s version %s is not healthy, not stopping old containers: %s",
+				appCfg.Name, appCfg.Version(), err)
+			report.Error(appCfg.Name, err)
+			publishEvent("container.error", appCfg.Name,
+				fmt.Sprintf("version %s as %s is not healthy: %s", appCfg.Version(), container.ID[0:12], err))
+			return
+		}
+
+		if len(replaced) > 0 {
+			continue
+		}
+
+		stopped, err := serviceRuntime.StopOldVersion(appCfg, 1)
+		reportOldStopped(report, appCfg, stopped)
 		if err != nil {
 			log.Errorf("ERROR: Could not stop containers: %s", err)
+			report.Error(appCfg.Name, err)
 		}
 	}
 
-	running, err = serviceRuntime.InstanceCount(appCfg.Name, strconv.FormatInt(appCfg.ID(), 10))
+	running, err = serviceRuntime.InstanceCount(appCfg)
 	if err != nil {
 		log.Errorf("ERROR: Could not determine running instance count: %s", err)
+		report.Error(appCfg.Name, err)
 		return
 	}
 
 	for i := 0; i < running-desired; i++ {
-		err := serviceRuntime.Stop(appCfg)
+		id, err := serviceRuntime.Stop(appCfg)
 		if err != nil {
 			log.Errorf("ERROR: Could not stop container: %s", err)
+			report.Error(appCfg.Name, err)
+			continue
+		}
+		if id == "" {
+			break
+		}
+		report.ContainerStopped(appCfg.Name, id)
+		publishEvent("container.stop", appCfg.Name,
+			fmt.Sprintf("stopped version %s as %s", appCfg.Version(), id))
+	}
+
+	registered, err := currentRegistered(appCfg)
+	if err != nil {
+		log.Errorf("ERROR: Could not check registrations: %s", err)
+		report.Error(appCfg.Name, err)
+	} else if !registered {
+		log.Printf("Waiting for %s version %s to register before stopping old containers", appCfg.Name, appCfg.Version())
+	} else {
+		stopped, err := serviceRuntime.StopAllButCurrentVersion(appCfg)
+		reportOldStopped(report, appCfg, stopped)
+		if err != nil {
+			log.Errorf("ERROR: Could not stop old containers: %s", err)
+			report.Error(appCfg.Name, err)
+		}
+	}
+
+	err = serviceRuntime.ReconcileSidecars(appCfg)
+	if err != nil {
+		log.Errorf("ERROR: Could not reconcile sidecars: %s", err)
+		report.Error(appCfg.Name, err)
+	}
+
+}
+
+// reportOldStopped records the containers of appCfg's old versions that
+// were stopped.
+func reportOldStopped(report *commander.ReconcileReport, appCfg *config.AppConfig, ids []string) {
+	for _, id := range ids {
+		report.ContainerStopped(appCfg.Name, id)
+		publishEvent("container.stop", appCfg.Name,
+			fmt.Sprintf("stopped %s, replaced by version %s", id, appCfg.Version()))
+	}
+}
+
+// replacedOld returns the IDs in old of appCfg's old containers that are no
+// longer running.
+func replacedOld(appCfg *config.AppConfig, old []string) ([]string, error) {
+	running, err := serviceRuntime.OldVersions(appCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	replaced := []string{}
+	for _, id := range old {
+		if !utils.StringInSlice(id, running) {
+			replaced = append(replaced, id)
+		}
+	}
+	return replaced, nil
+}
+
+// registerTimeout returns how long new containers have to register before
+// old ones are stopped.  Only the agent runs discovery, so otherwise there's
+// nothing that would register them.
+func registerTimeout() time.Duration {
+	if !loop {
+		return 0
+	}
+	return cutoverTimeout
+}
+
+// waitRegistered waits up to registerTimeout for the container to be
+// registered, which discovery only does once its health check passes.
+func waitRegistered(id string) error {
+	timeout := registerTimeout()
+	if timeout == 0 {
+		return nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		container, err := serviceRuntime.InspectContainer(id)
+		if err != nil {
+			return err
+		}
+		if !container.State.Running {
+			return errors.New("container stopped")
+		}
+
+		registered, err := serviceRegistry.IsRegistered(env, pool, hostIP, container)
+		if err != nil {
+			return err
+		}
+		if registered {
+			return nil
 		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("not registered after %s", timeout)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// currentRegistered returns true if all of the running containers for the
+// app's current version are registered.
+func currentRegistered(appCfg *config.AppConfig) (bool, error) {
+	if registerTimeout() == 0 {
+		return true, nil
 	}
 
-	err = serviceRuntime.StopAllButCurrentVersion(appCfg)
+	containers, err := serviceRuntime.ManagedContainers()
 	if err != nil {
-		log.Errorf("ERROR: Could not stop old containers: %s", err)
+		return false, err
+	}
+
+	for _, container := range containers {
+		cenv := serviceRuntime.EnvFor(container)
+		if cenv["GALAXY_APP"] != appCfg.Name || cenv["GALAXY_VERSION"] != strconv.FormatInt(appCfg.ID(), 10) {
+			continue
+		}
+
+		registered, err := serviceRegistry.IsRegistered(env, pool, hostIP, container)
+		if err != nil || !registered {
+			return false, err
+		}
 	}
+	return true, nil
+}
+
+// publishReport sends a finished report to the event stream and, if
+// configured, the local report file.
+func publishReport(report *commander.ReconcileReport) {
+	report.Finish()
+
+	eventType := "reconcile.report"
+	if report.Errors > 0 {
+		eventType = "reconcile.error"
+	}
+
+	events.Publish(events.Event{
+		Type:    eventType,
+		Env:     env,
+		Pool:    pool,
+		Host:    hostIP,
+		Message: report.String(),
+		Detail:  report,
+	})
 
+	if reportFile != "" {
+		err := report.WriteFile(reportFile)
+		if err != nil {
+			log.Errorf("ERROR: Unable to write reconcile report: %s", err)
+		}
+	}
 }
 
 func heartbeatHost() {
@@ -204,9 +618,10 @@ func heartbeatHost() {
 
 	defer wg.Done()
 	for {
-		configStore.UpdateHost(env, pool, config.HostInfo{
-			HostIP: hostIP,
-		})
+		err := configStore.UpdateHost(env, pool, hostInfo())
+		if err != nil {
+			log.Errorf("ERROR: Unable to update host %s: %s", hostIP, err)
+		}
 
 		if !loop {
 			return
@@ -215,6 +630,66 @@ func heartbeatHost() {
 	}
 }
 
+// gcLoop removes exited containers and images left over from old deploys
+// every gcInterval so the host doesn't run out of disk.
+func gcLoop() {
+	for {
+		time.Sleep(gcInterval)
+
+		err := commander.HostGC(configStore, serviceRuntime, env, gcAge, true)
+		if err != nil {
+			log.Errorf("ERROR: Unable to clean up docker: %s", err)
+		}
+	}
+}
+
+// jobsLoop starts the scheduled jobs of the apps assigned to the pool at
+// the start of every minute.
+func jobsLoop() {
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(next.Sub(now))
+
+		err := commander.RunJobs(configStore, serviceRegistry, serviceRuntime, env, pool, hostIP, next)
+		if err != nil {
+			log.Errorf("ERROR: Unable to run jobs: %s", err)
+		}
+	}
+}
+
+// hostInfo describes this host for its heartbeat.  Anything docker can't
+// tell us is left empty rather than holding up the heartbeat.
+func hostInfo() config.HostInfo {
+	info := config.HostInfo{
+		HostIP:    hostIP,
+		Version:   buildVersion,
+		Conflicts: int(serviceRegistry.ConflictCount()),
+		Labels:    hostLabels,
+	}
+
+	memory, cpus, err := serviceRuntime.HostResources()
+	if err != nil {
+		log.Warnf("WARN: Unable to get host resources: %s", err)
+	} else {
+		info.Memory = memory
+		info.CPUs = cpus
+	}
+
+	info.DockerVersion, info.DockerAPIVersion, err = serviceRuntime.DockerVersion()
+	if err != nil {
+		log.Warnf("WARN: Unable to get the docker version: %s", err)
+	}
+
+	containers, err := serviceRuntime.ManagedContainers()
+	if err != nil {
+		log.Warnf("WARN: Unable to list containers: %s", err)
+	} else {
+		info.Containers = len(containers)
+	}
+	return info
+}
+
 func deregisterHost(signals chan os.Signal) {
 	<-signals
 	configStore.DeleteHost(env, pool, config.HostInfo{
@@ -236,118 +711,316 @@ func appAssigned(app string) (bool, error) {
 	return true, nil
 }
 
-func restartContainers(app string, cmdChan chan string) {
+// workerCmd is sent to an app's worker.  reconcile commands carry the report
+// for the pass and done is signalled once the worker is finished with it.
+type workerCmd struct {
+	cmd    string
+	report *commander.ReconcileReport
+	done   *sync.WaitGroup
+}
+
+func restartContainers(app string, cmdChan chan workerCmd) {
 	defer wg.Done()
-	logOnce := true
 
-	ticker := time.NewTicker(10 * time.Second)
+	for wc := range cmdChan {
+		exit := handleWorkerCmd(app, wc)
+		if wc.done != nil {
+			wc.done.Done()
+		}
 
-	for {
+		if exit || !loop {
+			return
+		}
+	}
+}
 
-		select {
+// handleWorkerCmd brings the containers for app in line with its config.  It
+// returns true when the app is no longer assigned and the worker should exit.
+func handleWorkerCmd(app string, wc workerCmd) bool {
+	report := wc.report
+
+	if wc.cmd == "reconcile" {
+		appCfg, err := configStore.GetApp(app, env)
+		if err != nil {
+			log.Errorf("ERROR: Error retrieving service config for %s: %s", app, err)
+			report.Error(app, err)
+			return false
+		}
 
-		case cmd := <-cmdChan:
+		assigned, err := appAssigned(app)
+		if err != nil {
+			log.Errorf("ERROR: Error retrieving service config for %s: %s", app, err)
+			report.Error(app, err)
+			return false
+		}
 
-			assigned, err := appAssigned(app)
-			if err != nil {
-				log.Errorf("ERROR: Error retrieving assignments for %s: %s", app, err)
-				if !loop {
-					return
-				}
-				continue
-			}
+		if appCfg == nil || !assigned {
+			log.Errorf("%s no longer exists.  Stopping worker.", app)
+			serviceRuntime.StopAllMatching(app)
+			workerLock.Lock()
+			delete(workerChans, app)
+			workerLock.Unlock()
+			return true
+		}
 
-			if !assigned {
-				continue
-			}
+		if appCfg.Version() == "" {
+			return false
+		}
+		defer startGreen(appCfg, report)
 
-			appCfg, err := configStore.GetApp(app, env)
-			if err != nil {
-				log.Errorf("ERROR: Error retrieving service config for %s: %s", app, err)
-				if !loop {
-					return
-				}
-				continue
-			}
+		appCfg, err = hostConfig(appCfg)
+		if err != nil {
+			log.Errorf("ERROR: Could not determine canary host for %s: %s", app, err)
+			report.Error(app, err)
+			return false
+		}
 
-			if appCfg.Version() == "" {
-				if !loop {
-					return
-				}
-				continue
-			}
+		_, err = pullImage(appCfg)
+		if err != nil {
+			log.Errorf("ERROR: Could not pull images: %s", err)
+			report.Error(app, err)
+			return false
+		}
+		startService(appCfg, report)
+		return false
+	}
 
-			if cmd == "deploy" {
-				_, err = pullImage(appCfg)
-				if err != nil {
-					log.Errorf("ERROR: Error pulling image for %s: %s", app, err)
-					if !loop {
-						return
-					}
-					continue
-				}
-				startService(appCfg, logOnce)
-			}
+	assigned, err := appAssigned(app)
+	if err != nil {
+		log.Errorf("ERROR: Error retrieving assignments for %s: %s", app, err)
+		report.Error(app, err)
+		return false
+	}
+
+	if !assigned {
+		return false
+	}
+
+	appCfg, err := configStore.GetApp(app, env)
+	if err != nil {
+		log.Errorf("ERROR: Error retrieving service config for %s: %s", app, err)
+		report.Error(app, err)
+		return false
+	}
+
+	if appCfg.Version() == "" {
+		return false
+	}
+	if wc.cmd == "deploy" {
+		defer startGreen(appCfg, report)
+	}
+
+	appCfg, err = hostConfig(appCfg)
+	if err != nil {
+		log.Errorf("ERROR: Could not determine canary host for %s: %s", app, err)
+		report.Error(app, err)
+		return false
+	}
 
-			if cmd == "restart" {
-				err := serviceRuntime.Stop(appCfg)
-				if err != nil {
-					log.Errorf("ERROR: Could not stop %s: %s",
-						appCfg.Version(), err)
-					if !loop {
-						return
-					}
-
-					startService(appCfg, logOnce)
-					continue
-				}
+	if wc.cmd == "deploy" {
+		_, err = pullImage(appCfg)
+		if err != nil {
+			log.Errorf("ERROR: Error pulling image for %s: %s", app, err)
+			report.Error(app, err)
+			return false
+		}
+		startService(appCfg, report)
+	}
+
+	if wc.cmd == "restart" {
+		id, err := serviceRuntime.Stop(appCfg)
+		if err == nil && id != "" {
+			report.ContainerStopped(app, id)
+		}
+		if err != nil {
+			log.Errorf("ERROR: Could not stop %s: %s",
+				appCfg.Version(), err)
+			report.Error(app, err)
+			if !loop {
+				return false
 			}
 
-			logOnce = false
-		case <-ticker.C:
+			startService(appCfg, report)
+		}
+	}
+	return false
+}
+
+// startGreen runs the green version of a blue/green deploy alongside the
+// app's other containers.
+func startGreen(appCfg *config.AppConfig, report *commander.ReconcileReport) {
+	if appCfg.GreenVersion() == "" {
+		return
+	}
 
-			appCfg, err := configStore.GetApp(app, env)
+	green := appCfg.Green()
+	_, err := pullImage(green)
+	if err != nil {
+		log.Errorf("ERROR: Could not pull images: %s", err)
+		report.Error(appCfg.Name, err)
+		return
+	}
+	startService(green, report)
+}
+
+// hostConfig returns the config this host runs for an app: its canary on
+// the pool's canary host and its stable config everywhere else.
+func hostConfig(appCfg *config.AppConfig) (*config.AppConfig, error) {
+	if appCfg.CanaryVersion() == "" {
+		return appCfg.Stable(), nil
+	}
+
+	canaryHost, err := commander.CanaryHost(configStore, hostIP, appCfg, env, pool)
+	if err != nil {
+		return nil, err
+	}
+	if canaryHost {
+		return appCfg.Canary(), nil
+	}
+	return appCfg.Stable(), nil
+}
+
+// sendWorkerCmd runs cmd on the worker for app and publishes a report for it.
+func sendWorkerCmd(app string, ch chan workerCmd, cmd string) {
+	wg.Add(1)
+	defer wg.Done()
+
+	report := commander.NewReconcileReport(env, pool, hostIP, cmd)
+	var done sync.WaitGroup
+	done.Add(1)
+	ch <- workerCmd{cmd: cmd, report: report, done: &done}
+	done.Wait()
+	publishReport(report)
+}
+
+// rollingRestart restarts app's containers on this host one at a time,
+// holding one of batch restart slots shared by the env's hosts until the
+// replacement is registered and has been up for delay.
+func rollingRestart(app string, ch chan workerCmd, batch int, delay time.Duration) {
+	wg.Add(1)
+	defer wg.Done()
+
+	containers, err := serviceRuntime.ManagedContainers()
+	if err != nil {
+		log.Errorf("ERROR: Could not restart %s: %s", app, err)
+		return
+	}
+
+	known := make(map[string]bool)
+	for _, container := range containers {
+		known[container.ID] = true
+	}
+
+	ttl := uint64((delay + registerTimeout() + restartSlotTTL) / time.Second)
+	for _, container := range containers {
+		if serviceRuntime.EnvFor(container)["GALAXY_APP"] != app {
+			continue
+		}
+
+		owner := hostIP + "/" + container.ID[0:12]
+		for {
+			claimed, err := serviceRegistry.AcquireRestartSlot(env, app, owner, batch, ttl)
 			if err != nil {
-				log.Errorf("ERROR: Error retrieving service config for %s: %s", app, err)
-				continue
+				log.Errorf("ERROR: Could not claim a restart slot for %s: %s", app, err)
 			}
+			if claimed {
+				break
+			}
+			time.Sleep(time.Second)
+		}
 
-			assigned, err := appAssigned(app)
-			if err != nil {
-				log.Errorf("ERROR: Error retrieving service config for %s: %s", app, err)
-				if !loop {
-					return
-				}
+		workerLock.Lock()
+		current := workerChans[app]
+		workerLock.Unlock()
+		if current != ch {
+			// the app was unassigned
+			serviceRegistry.ReleaseRestartSlot(env, app, owner, batch)
+			return
+		}
 
-				continue
-			}
+		log.Printf("Restarting %s container %s", app, container.ID[0:12])
+		err = serviceRuntime.StopContainer(container.ID)
+		if err != nil {
+			log.Errorf("ERROR: Could not stop %s: %s", container.ID[0:12], err)
+		}
 
-			if appCfg == nil || !assigned {
-				log.Errorf("%s no longer exists.  Stopping worker.", app)
-				serviceRuntime.StopAllMatching(app)
-				delete(workerChans, app)
-				return
-			}
+		// the worker starts the replacement
+		sendWorkerCmd(app, ch, "reconcile")
+
+		err = waitReplaced(app, known)
+		if err != nil {
+			// keep the slot until it expires so the other hosts don't take
+			// down more of the app
+			log.Errorf("ERROR: Stopping the restart of %s: %s", app, err)
+			return
+		}
+		time.Sleep(delay)
+
+		err = serviceRegistry.ReleaseRestartSlot(env, app, owner, batch)
+		if err != nil {
+			log.Errorf("ERROR: Could not release the restart slot for %s: %s", app, err)
+		}
+	}
+}
+
+// waitReplaced waits for the containers of app that aren't in known, the
+// ones a reconcile started, to be registered and adds them to known.
+func waitReplaced(app string, known map[string]bool) error {
+	started, err := serviceRuntime.NewContainers(app, known)
+	if err != nil {
+		return err
+	}
+	if len(started) == 0 {
+		return errors.New("no replacement was started")
+	}
+
+	for _, container := range started {
+		known[container.ID] = true
+		err := waitRegistered(container.ID)
+		if err != nil {
+			return fmt.Errorf("replacement %s: %s", container.ID[0:12], err)
+		}
+	}
+	return nil
+}
 
-			if appCfg.Version() == "" {
-				continue
-			}
+// reconcileLoop periodically asks every worker to reconcile its app and
+// publishes a report for each pass.
+func reconcileLoop() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
 
-			_, err = pullImage(appCfg)
-			if err != nil {
-				if !loop {
-					return
-				}
-				log.Errorf("ERROR: Could not pull images: %s", err)
-				continue
-			}
-			startService(appCfg, logOnce)
+	for range ticker.C {
+		report := commander.NewReconcileReport(env, pool, hostIP, "interval")
+		var done sync.WaitGroup
+
+		workerLock.Lock()
+		chans := make(map[string]chan workerCmd)
+		for app, ch := range workerChans {
+			chans[app] = ch
 		}
+		workerLock.Unlock()
 
-		if !loop {
-			return
+		for _, ch := range chans {
+			done.Add(1)
+			ch <- workerCmd{cmd: "reconcile", report: report, done: &done}
 		}
+		done.Wait()
+		publishReport(report)
+	}
+}
 
+// pendingChanges returns first and any other config changes that arrive
+// within pullBatchWait of the last one.
+func pendingChanges(first *config.ConfigChange, changedConfigs chan *config.ConfigChange) []*config.ConfigChange {
+	changes := []*config.ConfigChange{first}
+	for {
+		select {
+		case change := <-changedConfigs:
+			changes = append(changes, change)
+		case <-time.After(pullBatchWait):
+			return changes
+		}
 	}
 }
 
@@ -355,67 +1028,120 @@ func monitorService(changedConfigs chan *config.ConfigChange) {
 
 	for {
 
-		var changedConfig *config.ConfigChange
-		select {
-
-		case changedConfig = <-changedConfigs:
+		changes := pendingChanges(<-changedConfigs, changedConfigs)
 
-			if changedConfig.Error != nil {
-				log.Errorf("ERROR: Error watching changes: %s", changedConfig.Error)
-				continue
+		// pull the images of everything being deployed before any of
+		// them start
+		deploys := []*config.AppConfig{}
+		for _, changedConfig := range changes {
+			if changedConfig.Error == nil && changedConfig.AppConfig != nil && !changedConfig.Restart {
+				deploys = append(deploys, changedConfig.AppConfig)
 			}
+		}
+		prePull(deploys)
 
-			if changedConfig.AppConfig == nil {
-				continue
+		for _, changedConfig := range changes {
+			if !handleChange(changedConfig) {
+				return
 			}
+		}
+	}
 
-			assigned, err := appAssigned(changedConfig.AppConfig.Name)
-			if err != nil {
-				log.Errorf("ERROR: Error retrieving service config for %s: %s", changedConfig.AppConfig.Name, err)
-				if !loop {
-					return
-				}
-				continue
-			}
+}
 
-			if !assigned {
-				continue
-			}
+// handleChange hands a config change to its app's worker, starting one if
+// the app is newly assigned.  It returns false if the agent should stop
+// watching.
+func handleChange(changedConfig *config.ConfigChange) bool {
+	if changedConfig.Error != nil {
+		log.Errorf("ERROR: Error watching changes: %s", changedConfig.Error)
+		return true
+	}
 
-			ch, ok := workerChans[changedConfig.AppConfig.Name]
-			if !ok {
-				name := changedConfig.AppConfig.Name
-				ch := make(chan string)
-				workerChans[name] = ch
-				wg.Add(1)
-				go restartContainers(name, ch)
-				ch <- "deploy"
+	if changedConfig.AppConfig == nil {
+		return true
+	}
 
-				log.Printf("Started new worker for %s\n", name)
-				continue
-			}
+	assigned, err := appAssigned(changedConfig.AppConfig.Name)
+	if err != nil {
+		log.Errorf("ERROR: Error retrieving service config for %s: %s", changedConfig.AppConfig.Name, err)
+		return loop
+	}
 
-			if changedConfig.Restart {
-				log.Printf("Restarting %s", changedConfig.AppConfig.Name)
-				ch <- "restart"
-			} else {
-				ch <- "deploy"
-			}
-		}
+	if !assigned {
+		return true
+	}
+
+	name := changedConfig.AppConfig.Name
+	workerLock.Lock()
+	ch, ok := workerChans[name]
+	if !ok {
+		ch = make(chan workerCmd)
+		workerChans[name] = ch
+	}
+	workerLock.Unlock()
+
+	if !ok {
+		wg.Add(1)
+		go restartContainers(name, ch)
+		go sendWorkerCmd(name, ch, "deploy")
+
+		log.Printf("Started new worker for %s\n", name)
+		return true
 	}
 
+	if changedConfig.Restart && changedConfig.RestartBatch > 0 {
+		log.Printf("Restarting %s, %d at a time", name, changedConfig.RestartBatch)
+		publishEvent("app.restart", name, fmt.Sprintf("%d at a time", changedConfig.RestartBatch))
+		go rollingRestart(name, ch, changedConfig.RestartBatch, changedConfig.RestartDelay)
+	} else if changedConfig.Restart {
+		log.Printf("Restarting %s", name)
+		publishEvent("app.restart", name, "")
+		go sendWorkerCmd(name, ch, "restart")
+	} else {
+		publishEvent("app.deploy", name,
+			fmt.Sprintf("config v%d version %s", changedConfig.AppConfig.ID(), changedConfig.AppConfig.Version()))
+		go sendWorkerCmd(name, ch, "deploy")
+	}
+	return true
 }
 
 func main() {
 	flag.Int64Var(&stopCutoff, "cutoff", 10, "Seconds to wait before stopping old containers")
+	flag.DurationVar(&cutoverTimeout, "cutover-timeout", 5*time.Minute, "How long agent deploys wait for new containers to pass their health checks and register before old ones are stopped, 0 to not wait")
 	flag.StringVar(&registryURL, "registry", utils.GetEnv("GALAXY_REGISTRY_URL", "redis://127.0.0.1:6379"), "registry URL")
+	flag.StringVar(&mirrorURL, "registry-mirror", utils.GetEnv("GALAXY_REGISTRY_MIRROR_URL", ""), "Also write to this registry URL, e.g. while migrating backends")
+	flag.StringVar(&replicaURL, "registry-replica", utils.GetEnv("GALAXY_REGISTRY_REPLICA_URL", ""), "Read app and registration listings from this read-only registry URL")
 	flag.StringVar(&env, "env", utils.GetEnv("GALAXY_ENV", ""), "Environment namespace")
 	flag.StringVar(&pool, "pool", utils.GetEnv("GALAXY_POOL", ""), "Pool namespace")
 	flag.StringVar(&hostIP, "host-ip", "127.0.0.1", "Host IP")
 	flag.StringVar(&shuttleAddr, "shuttle-addr", "", "Shuttle API addr (127.0.0.1:9090)")
 	flag.StringVar(&dns, "dns", "", "DNS addr to use for containers")
+	flag.StringVar(&dockerConfig.Host, "docker-host", dockerConfig.Host, "Docker daemon address, defaults to DOCKER_HOST")
+	flag.StringVar(&dockerConfig.CertPath, "docker-cert-path", dockerConfig.CertPath, "Directory with cert.pem, key.pem and ca.pem for docker TLS, defaults to DOCKER_CERT_PATH")
+	flag.BoolVar(&dockerConfig.TLS, "docker-tls", dockerConfig.TLS, "Connect to docker with TLS")
+	flag.BoolVar(&dockerConfig.TLSVerify, "docker-tls-verify", dockerConfig.TLSVerify, "Connect to docker with TLS and verify its certificate, defaults to DOCKER_TLS_VERIFY")
+	flag.IntVar(&weight, "weight", 0, "Load balancing weight for this host's containers, unless their app sets GALAXY_WEIGHT")
+	flag.IntVar(&rollbackAfter, "rollback-after", 3, "Roll an app back to its previous version after a new one stops this many times on start, 0 to never")
 	flag.BoolVar(&debug, "debug", false, "verbose logging")
 	flag.BoolVar(&version, "v", false, "display version info")
+	flag.IntVar(&parallelPulls, "parallel-pulls", 4, "How many images the agent pulls at once when several apps are deployed")
+	flag.BoolVar(&jsonProgress, "json-progress", false, "Write each pull, start and stop step to stdout as a line of JSON")
+	flag.StringVar(&outputFormat, "output", "table", "Format of listings: "+strings.Join(commander.OutputFormats, ", "))
+	flag.Var(&listFilters, "filter", "Only list rows whose column matches a glob, e.g. name=web* or pool=prod-web (can be repeated)")
+	flag.StringVar(&listSort, "sort", "", "Sort listings by a column, e.g. mem, name or ps, or -mem for descending")
+	flag.StringVar(&reportFile, "report-file", "", "Write the latest reconcile report as JSON to this file")
+	flag.StringVar(&memoryReserve, "memory-reserve", utils.GetEnv("GALAXY_MEMORY_RESERVE", ""), "Memory to keep free for the host, e.g. 512m, when checking that a container fits")
+	flag.StringVar(&hostLabels, "labels", utils.GetEnv("GALAXY_HOST_LABELS", ""), "Comma separated host labels apps can be constrained to, e.g. ssd,az=us-east-1a")
+	flag.StringVar(&bindIP, "bind-ip", utils.GetEnv("GALAXY_BIND_IP", ""), "Host address to publish container ports on, e.g. the private interface's (default every interface)")
+	flag.DurationVar(&pullTimeout, "pull-timeout", runtime.DefaultPullTimeout, "How long an image pull can take before it's retried, 0 for no limit")
+	flag.DurationVar(&gcInterval, "gc-interval", 0, "How often the agent removes exited containers and unused images, 0 to never")
+	flag.DurationVar(&gcAge, "gc-age", 24*time.Hour, "How long containers have to have exited to be removed")
+	flag.StringVar(&blacklistFile, "blacklist-file", utils.GetEnv("GALAXY_BLACKLIST_FILE", "/var/lib/galaxy/blacklist.json"), "Remember containers that won't stop in this file, \"\" to only keep them in memory")
+	flag.Var(&registryAuths, "registry-auth", "Docker registry login as <username>:<password>@<registry>. May be repeated")
+	flag.Var(&imageMirrors, "image-mirror", "Pull images through this cache first, as [<registry>=]<mirror> where registry defaults to docker.io. May be repeated")
+	flag.StringVar(&credHelper, "credential-helper", utils.GetEnv("GALAXY_CREDENTIAL_HELPER", ""), "Docker credential helper for registry logins, e.g. ecr-login")
+	flag.Var(&eventSinks, "event-sink", "Event sink URL (slack://, http(s)://, statsd://, file://, sns:). May be repeated")
 
 	flag.Usage = func() {
 		println("Usage: commander [options] <command> [<args>]\n")
@@ -427,24 +1153,54 @@ func main() {
 		println("   app:deploy      Deploy an app")
 		println("   app:delete      Delete an app")
 		println("   app:restart     Restart an app")
+		println("   app:rollback    Roll an app back to an earlier deploy")
 		println("   app:run         Run a command within an app on this host")
 		println("   app:shell       Run a bash shell within an app on this host")
 		println("   app:start       Starts one or more apps")
 		println("   app:stop        Stops one or more apps")
 		println("   app:unassign    Unassign an app from a pool")
+		println("   blacklist       List containers on this host that won't stop")
+		println("   blacklist:clear Try stopping blacklisted containers again")
 		println("   config          List config for an app")
 		println("   config:get      Get config values for an app")
 		println("   config:set      Set config values for an app")
 		println("   config:unset    Unset config values for an app")
 		println("   runtime         List container runtime policies")
 		println("   runtime:set     Set container runtime policies")
+		println("   sidecar         List sidecars for an app")
+		println("   sidecar:set     Add or update a sidecar for an app")
+		println("   sidecar:unset   Remove a sidecar from an app")
 		println("   hosts           List hosts in an env and pool")
+		println("   mirror:verify   Compare the registry with its mirror")
+		println("   registry:prune  Remove registrations for containers that aren't running")
+		println("   service:register    Register a container or endpoint")
+		println("   service:unregister  Unregister a container or endpoint")
 		println("\nOptions:\n")
 		flag.PrintDefaults()
 	}
 
 	flag.Parse()
 
+	if err := commander.SetOutput(outputFormat); err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+	if err := commander.SetFilters(listFilters); err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+	commander.SetSort(listSort)
+
+	if len(registryAuths) == 0 && os.Getenv("GALAXY_REGISTRY_AUTH") != "" {
+		registryAuths = strings.Split(os.Getenv("GALAXY_REGISTRY_AUTH"), ",")
+	}
+
+	if len(imageMirrors) == 0 && os.Getenv("GALAXY_IMAGE_MIRRORS") != "" {
+		imageMirrors = strings.Split(os.Getenv("GALAXY_IMAGE_MIRRORS"), ",")
+	}
+
+	if len(eventSinks) == 0 && os.Getenv("GALAXY_EVENT_SINKS") != "" {
+		eventSinks = strings.Split(os.Getenv("GALAXY_EVENT_SINKS"), ",")
+	}
+
 	if version {
 		fmt.Println(buildVersion)
 		return
@@ -570,16 +1326,20 @@ func main() {
 			os.Exit(1)
 		}
 
-		err := commander.AppDelete(configStore, appFs.Args()[0], env)
+		err := commander.AppDelete(configStore, serviceRegistry, appFs.Args()[0], env)
 		if err != nil {
 			log.Fatalf("ERROR: %s", err)
 		}
 		return
 
 	case "app:deploy":
+		var wait bool
+		var waitTimeout time.Duration
 		appFs := flag.NewFlagSet("app:delete", flag.ExitOnError)
+		appFs.BoolVar(&wait, "wait", false, "Wait for every container to run the new version, exiting non-zero if it doesn't")
+		appFs.DurationVar(&waitTimeout, "timeout", 5*time.Minute, "How long -wait waits")
 		appFs.Usage = func() {
-			println("Usage: commander app:deploy [-force] <app> <version>\n")
+			println("Usage: commander app:deploy [-force] [-wait] [-timeout 5m] <app> <version>\n")
 			println("    Deploy an app in an environment\n")
 			println("Options:\n")
 			appFs.PrintDefaults()
@@ -593,16 +1353,63 @@ func main() {
 			os.Exit(1)
 		}
 
-		err := commander.AppDeploy(configStore, serviceRuntime, appFs.Args()[0], env, appFs.Args()[1])
+		deployID, err := commander.AppDeploy(configStore, serviceRuntime, appFs.Args()[0], env, appFs.Args()[1])
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+
+		if wait {
+			err = commander.WaitForDeploy(configStore, serviceRegistry, appFs.Args()[0], env, deployID, waitTimeout)
+			if err != nil {
+				log.Fatalf("ERROR: %s", err)
+			}
+		}
+		return
+
+	case "app:rollback":
+		var to string
+		var wait bool
+		var waitTimeout time.Duration
+		appFs := flag.NewFlagSet("app:rollback", flag.ExitOnError)
+		appFs.StringVar(&to, "to", "", "Deploy ID to roll back to, from history (default the one before the current)")
+		appFs.BoolVar(&wait, "wait", false, "Wait for every container to run the restored version, exiting non-zero if it doesn't")
+		appFs.DurationVar(&waitTimeout, "timeout", 5*time.Minute, "How long -wait waits")
+		appFs.Usage = func() {
+			println("Usage: commander app:rollback [-to <deploy>] [-wait] [-timeout 5m] <app>\n")
+			println("    Restore an app's image and env to an earlier deploy\n")
+			println("Options:\n")
+			appFs.PrintDefaults()
+		}
+		appFs.Parse(flag.Args()[1:])
+
+		ensureEnv()
+
+		if appFs.NArg() != 1 {
+			appFs.Usage()
+			os.Exit(1)
+		}
+
+		deployID, err := commander.AppRollback(configStore, appFs.Args()[0], env, to)
 		if err != nil {
 			log.Fatalf("ERROR: %s", err)
 		}
+
+		if wait {
+			err = commander.WaitForDeploy(configStore, serviceRegistry, appFs.Args()[0], env, deployID, waitTimeout)
+			if err != nil {
+				log.Fatalf("ERROR: %s", err)
+			}
+		}
 		return
 
 	case "app:restart":
+		var batch int
+		var delay time.Duration
 		appFs := flag.NewFlagSet("app:restart", flag.ExitOnError)
+		appFs.IntVar(&batch, "batch", 0, "Restart this many containers at a time across all hosts, 0 for all at once")
+		appFs.DurationVar(&delay, "delay", 0, "Wait after each container restarts before restarting another")
 		appFs.Usage = func() {
-			println("Usage: commander app:restart <app>\n")
+			println("Usage: commander app:restart [-batch 2] [-delay 30s] <app>\n")
 			println("    Restart an app in an environment\n")
 			println("Options:\n")
 			appFs.PrintDefaults()
@@ -616,17 +1423,19 @@ func main() {
 			os.Exit(1)
 		}
 
-		err := commander.AppRestart(configStore, appFs.Args()[0], env)
+		err := commander.AppRestart(configStore, appFs.Args()[0], env, batch, delay)
 		if err != nil {
 			log.Fatalf("ERROR: %s", err)
 		}
 		return
 
 	case "app:run":
+		var execRun bool
 		appFs := flag.NewFlagSet("app:run", flag.ExitOnError)
+		appFs.BoolVar(&execRun, "exec", false, "Run the command in one of the app's running containers")
 		appFs.Usage = func() {
-			println("Usage: commander app:run <app> <cmd>\n")
-			println("    Restart an app in an environment\n")
+			println("Usage: commander app:run [-exec] <app> <cmd>\n")
+			println("    Run a command within an app\n")
 			println("Options:\n")
 			appFs.PrintDefaults()
 		}
@@ -639,6 +1448,14 @@ func main() {
 			os.Exit(1)
 		}
 
+		if execRun {
+			err := commander.AppExec(configStore, serviceRuntime, appFs.Args()[0], env, pool, appFs.Args()[1:])
+			if err != nil {
+				log.Fatalf("ERROR: %s", err)
+			}
+			return
+		}
+
 		err := commander.AppRun(configStore, serviceRuntime, appFs.Args()[0], env, appFs.Args()[1:])
 		if err != nil {
 			log.Fatalf("ERROR: %s", err)
@@ -763,6 +1580,152 @@ func main() {
 		}
 		return
 
+	case "sidecar":
+		sidecarFs := flag.NewFlagSet("sidecar", flag.ExitOnError)
+		sidecarFs.Usage = func() {
+			println("Usage: commander sidecar <app>\n")
+			println("    List sidecars for an app\n")
+			println("Options:\n")
+			sidecarFs.PrintDefaults()
+		}
+		sidecarFs.Parse(flag.Args()[1:])
+
+		ensureEnv()
+
+		if sidecarFs.NArg() != 1 {
+			sidecarFs.Usage()
+			os.Exit(1)
+		}
+
+		err := commander.SidecarList(configStore, sidecarFs.Args()[0], env)
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		return
+
+	case "sidecar:set":
+		var m, c string
+		var envs utils.SliceVar
+		sidecarFs := flag.NewFlagSet("sidecar:set", flag.ExitOnError)
+		sidecarFs.StringVar(&m, "m", "", "Memory limit, taken out of the app's limit")
+		sidecarFs.StringVar(&c, "c", "", "CPU shares, taken out of the app's shares")
+		sidecarFs.Var(&envs, "e", "Env var for the sidecar (KEY=VALUE). May be repeated")
+		sidecarFs.Usage = func() {
+			println("Usage: commander sidecar:set [-m 64m] [-c 128] [-e K=V] <app> <name> <image> [<cmd>...]\n")
+			println("    Add or update a sidecar started alongside each app container\n")
+			println("Options:\n")
+			sidecarFs.PrintDefaults()
+		}
+		sidecarFs.Parse(flag.Args()[1:])
+
+		ensureEnv()
+
+		if sidecarFs.NArg() < 3 {
+			sidecarFs.Usage()
+			os.Exit(1)
+		}
+
+		sidecar := config.SidecarConfig{
+			Name:      sidecarFs.Args()[1],
+			Image:     sidecarFs.Args()[2],
+			Cmd:       sidecarFs.Args()[3:],
+			Memory:    m,
+			CPUShares: c,
+			Env:       map[string]string{},
+		}
+
+		for _, e := range envs {
+			parts := strings.SplitN(e, "=", 2)
+			if len(parts) != 2 {
+				log.Fatalf("ERROR: Bad env var %s. Use KEY=VALUE", e)
+			}
+			sidecar.Env[parts[0]] = parts[1]
+		}
+
+		app := sidecarFs.Args()[0]
+		updated, err := commander.SidecarSet(configStore, app, env, sidecar)
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+
+		if !updated {
+			log.Fatalf("ERROR: Failed to set sidecar %s.", sidecar.Name)
+		}
+		log.Printf("Sidecar %s updated for %s in %s", sidecar.Name, app, env)
+		return
+
+	case "sidecar:unset":
+		sidecarFs := flag.NewFlagSet("sidecar:unset", flag.ExitOnError)
+		sidecarFs.Usage = func() {
+			println("Usage: commander sidecar:unset <app> <name>\n")
+			println("    Remove a sidecar from an app\n")
+			println("Options:\n")
+			sidecarFs.PrintDefaults()
+		}
+		sidecarFs.Parse(flag.Args()[1:])
+
+		ensureEnv()
+
+		if sidecarFs.NArg() != 2 {
+			sidecarFs.Usage()
+			os.Exit(1)
+		}
+
+		app, name := sidecarFs.Args()[0], sidecarFs.Args()[1]
+		updated, err := commander.SidecarUnset(configStore, app, env, name)
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+
+		if !updated {
+			log.Fatalf("ERROR: Failed to remove sidecar %s.", name)
+		}
+		log.Printf("Sidecar %s removed from %s in %s", name, app, env)
+		return
+
+	case "blacklist":
+		blacklistFs := flag.NewFlagSet("blacklist", flag.ExitOnError)
+		blacklistFs.Usage = func() {
+			println("Usage: commander blacklist\n")
+			println("    List containers on this host that have failed to stop\n")
+			println("Options:\n")
+			blacklistFs.PrintDefaults()
+		}
+		err := blacklistFs.Parse(flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("ERROR: Bad command line options: %s", err)
+		}
+
+		err = commander.BlacklistList(serviceRuntime)
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		return
+
+	case "blacklist:clear":
+		blacklistFs := flag.NewFlagSet("blacklist:clear", flag.ExitOnError)
+		blacklistFs.Usage = func() {
+			println("Usage: commander blacklist:clear [<container id>]\n")
+			println("    Forget failed stops of a container, or all of them, so they're tried again\n")
+			println("Options:\n")
+			blacklistFs.PrintDefaults()
+		}
+		err := blacklistFs.Parse(flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("ERROR: Bad command line options: %s", err)
+		}
+
+		if blacklistFs.NArg() > 1 {
+			blacklistFs.Usage()
+			os.Exit(1)
+		}
+
+		err = commander.BlacklistClear(serviceRuntime, blacklistFs.Arg(0))
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		return
+
 	case "hosts":
 		hostFs := flag.NewFlagSet("hosts", flag.ExitOnError)
 		hostFs.Usage = func() {
@@ -784,9 +1747,89 @@ func main() {
 			log.Fatalf("ERROR: %s", err)
 		}
 		return
+	case "mirror:verify":
+		mirrorFs := flag.NewFlagSet("mirror:verify", flag.ExitOnError)
+		mirrorFs.Usage = func() {
+			println("Usage: commander -registry-mirror <url> mirror:verify\n")
+			println("    Compare the apps, pools and registrations in the registry and its mirror\n")
+			println("Options:\n")
+			mirrorFs.PrintDefaults()
+		}
+		err := mirrorFs.Parse(flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("ERROR: Bad command line options: %s", err)
+		}
+
+		ensureEnv()
+
+		err = commander.MirrorVerify(configStore, serviceRegistry, env)
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		return
+	case "registry:prune":
+		pruneFs := flag.NewFlagSet("registry:prune", flag.ExitOnError)
+		pruneFs.Usage = func() {
+			println("Usage: commander registry:prune\n")
+			println("    Remove the registrations on this host whose containers aren't running")
+			println("    without waiting for them to expire\n")
+			println("Options:\n")
+			pruneFs.PrintDefaults()
+		}
+		err := pruneFs.Parse(flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("ERROR: Bad command line options: %s", err)
+		}
+
+		ensureEnv()
+		ensurePool()
+
+		err = commander.RegistryPrune(serviceRuntime, serviceRegistry, env, pool, hostIP)
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		return
+	case "service:register", "service:unregister":
+		command := flag.Args()[0]
+		serviceFs := flag.NewFlagSet(command, flag.ExitOnError)
+		serviceFs.Usage = func() {
+			println("Usage: commander " + command + " <container>")
+			println("       commander " + command + " <name> <host:port>\n")
+			println("    Registers or unregisters a container on this host, or an endpoint")
+			println("    galaxy doesn't run, without waiting for the agent\n")
+			println("Options:\n")
+			serviceFs.PrintDefaults()
+		}
+		err := serviceFs.Parse(flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("ERROR: Bad command line options: %s", err)
+		}
+
+		ensureEnv()
+		ensurePool()
+
+		switch {
+		case serviceFs.NArg() == 1 && command == "service:register":
+			err = commander.ServiceRegister(serviceRuntime, serviceRegistry, env, pool, hostIP, serviceFs.Arg(0))
+		case serviceFs.NArg() == 1:
+			err = commander.ServiceUnregister(serviceRuntime, serviceRegistry, env, pool, hostIP, serviceFs.Arg(0))
+		case serviceFs.NArg() == 2 && command == "service:register":
+			err = commander.RegisterExternal(serviceRegistry, env, pool, serviceFs.Arg(0), serviceFs.Arg(1))
+		case serviceFs.NArg() == 2:
+			err = commander.UnRegisterExternal(serviceRegistry, env, pool, serviceFs.Arg(0), serviceFs.Arg(1))
+		default:
+			serviceFs.Usage()
+			os.Exit(1)
+		}
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		return
 	case "config":
 		configFs := flag.NewFlagSet("config", flag.ExitOnError)
-		usage := "Usage: commander config <app>"
+		var format string
+		configFs.StringVar(&format, "format", "text", "output format: "+strings.Join(commander.ConfigFormats, ", "))
+		usage := "Usage: commander config [-format text|json|dotenv|yaml] <app>"
 		configFs.Usage = func() {
 			println(usage)
 			println("    List config values for an app\n")
@@ -807,15 +1850,17 @@ func main() {
 		}
 		app := configFs.Args()[0]
 
-		err = commander.ConfigList(configStore, app, env)
+		err = commander.ConfigList(configStore, app, env, format)
 		if err != nil {
 			log.Fatalf("ERROR: %s", err)
 		}
 		return
 	case "config:get":
 		configFs := flag.NewFlagSet("config:get", flag.ExitOnError)
+		var format string
+		configFs.StringVar(&format, "format", "text", "output format: "+strings.Join(commander.ConfigFormats, ", "))
 		configFs.Usage = func() {
-			println("Usage: commander config <app> KEY [KEY]*\n")
+			println("Usage: commander config:get [-format text|json|dotenv|yaml] <app> KEY [KEY]*\n")
 			println("    Get config values for an app\n")
 			println("Options:\n")
 			configFs.PrintDefaults()
@@ -834,7 +1879,7 @@ func main() {
 		}
 		app := configFs.Args()[0]
 
-		err = commander.ConfigGet(configStore, app, env, configFs.Args()[1:])
+		err = commander.ConfigGet(configStore, app, env, format, configFs.Args()[1:])
 		if err != nil {
 			log.Fatalf("ERROR: %s", err)
 		}
@@ -842,8 +1887,9 @@ func main() {
 	case "config:set":
 		configFs := flag.NewFlagSet("config:set", flag.ExitOnError)
 		configFs.Usage = func() {
-			println("Usage: commander config <app> KEY=VALUE [KEY=VALUE]*\n")
-			println("    Set config values for an app\n")
+			println("Usage: commander config:set <app> KEY=VALUE [KEY=VALUE]*\n")
+			println("    Set config values for an app.  With no values they're read from")
+			println("    stdin as a .env file, and KEY=- reads KEY's value from stdin.\n")
 			println("Options:\n")
 			configFs.PrintDefaults()
 		}
@@ -869,7 +1915,7 @@ func main() {
 	case "config:unset":
 		configFs := flag.NewFlagSet("config:unset", flag.ExitOnError)
 		configFs.Usage = func() {
-			println("Usage: commander config <app> KEY [KEY]*\n")
+			println("Usage: commander config:unset <app> KEY [KEY]*\n")
 			println("    Unset config values for an app\n")
 			println("Options:\n")
 			configFs.PrintDefaults()
@@ -923,16 +1969,44 @@ func main() {
 		var m string
 		var c string
 		var vhost string
+		var removeVhost string
 		var port string
+		var clearPort bool
+		var restart string
+		var network string
+		var logDriver string
+		var logOpts string
+		var stopSignal string
+		var stopTimeout string
+		var ulimits string
+		var capAdd string
+		var capDrop string
+		var readOnly bool
+		var privileged bool
+		var constraints string
 		runtimeFs := flag.NewFlagSet("runtime:set", flag.ExitOnError)
 		runtimeFs.IntVar(&ps, "ps", 0, "Number of instances to run across all hosts")
-		runtimeFs.StringVar(&m, "m", "", "Memory limit (format: <number><optional unit>, where unit = b, k, m or g)")
+		runtimeFs.StringVar(&m, "m", "", "Memory limit (format: <number><optional unit>, where unit = b, k, m or g, e.g. 512m or 2g)")
 		runtimeFs.StringVar(&c, "c", "", "CPU shares (relative weight)")
 		runtimeFs.StringVar(&vhost, "vhost", "", "Virtual host for HTTP routing")
-		runtimeFs.StringVar(&port, "port", "", "Service port for service discovery")
+		runtimeFs.StringVar(&removeVhost, "remove-vhost", "", "Virtual host to take out of HTTP routing")
+		runtimeFs.StringVar(&port, "port", "", "Service port for service discovery, or auto to assign the next free one")
+		runtimeFs.BoolVar(&clearPort, "clear-port", false, "Remove the service port, taking the app out of service discovery")
+		runtimeFs.StringVar(&restart, "restart", "", "Restart policy when containers exit (no, always, on-failure or on-failure:<max retries>)")
+		runtimeFs.StringVar(&network, "net", "", "Docker network mode (bridge, host, none, container:<name> or a network name)")
+		runtimeFs.StringVar(&logDriver, "log-driver", "", "Docker log driver (e.g. json-file or syslog)")
+		runtimeFs.StringVar(&logOpts, "log-opts", "", "Log driver options (format: key=value,..., e.g. max-size=10m,max-file=3)")
+		runtimeFs.StringVar(&stopSignal, "stop-signal", "", "Signal sent to stop containers (e.g. SIGINT, default SIGTERM)")
+		runtimeFs.StringVar(&stopTimeout, "stop-timeout", "", "Time containers have to exit after the stop signal before they're killed (e.g. 60s, default 10s)")
+		runtimeFs.StringVar(&ulimits, "ulimit", "", "Resource limits (format: name=soft[:hard],..., e.g. nofile=1024:65536)")
+		runtimeFs.StringVar(&capAdd, "cap-add", "", "Linux capabilities to add (format: cap,..., e.g. NET_ADMIN)")
+		runtimeFs.StringVar(&capDrop, "cap-drop", "", "Linux capabilities to drop (format: cap,..., e.g. MKNOD)")
+		runtimeFs.BoolVar(&readOnly, "read-only", false, "Mount the container's root filesystem read only")
+		runtimeFs.BoolVar(&privileged, "privileged", false, "Run privileged containers, if the env's policy allows the app to")
+		runtimeFs.StringVar(&constraints, "constraints", "", "Host labels the app's hosts need (format: label,!label,label=value,label!=value)")
 
 		runtimeFs.Usage = func() {
-			println("Usage: commander runtime:set [-ps 1] [-m 100m] [-c 512] [-vhost x.y.z] [-port 8000] <app>\n")
+			println("Usage: commander runtime:set [-ps 1] [-m 100m] [-c 512] [-vhost x.y.z] [-remove-vhost x.y.z] [-port 8000] [-clear-port] [-restart always] [-net host] [-log-driver syslog] [-log-opts k=v,...] [-stop-signal SIGINT] [-stop-timeout 60s] [-ulimit nofile=65536] [-cap-add cap,...] [-cap-drop cap,...] [-read-only] [-privileged] [-constraints ssd,az=us-east-1a] <app>\n")
 			println("    Set container runtime policies\n")
 			println("Options:\n")
 			runtimeFs.PrintDefaults()
@@ -961,12 +2035,73 @@ func main() {
 			log.Fatalf("ERROR: Bad memory option %s: %s", m, err)
 		}
 
+		_, err = utils.ParseCPUShares(c)
+		if err != nil {
+			log.Fatalf("ERROR: Bad CPU shares option %s: %s", c, err)
+		}
+
+		_, _, err = utils.ParseRestartPolicy(restart)
+		if err != nil {
+			log.Fatalf("ERROR: Bad restart option %s: %s", restart, err)
+		}
+
+		_, err = utils.ParseLogOptions(logOpts)
+		if err != nil {
+			log.Fatalf("ERROR: Bad log options %s: %s", logOpts, err)
+		}
+
+		_, err = utils.ParseStopSignal(stopSignal)
+		if err != nil {
+			log.Fatalf("ERROR: Bad stop signal %s: %s", stopSignal, err)
+		}
+
+		if stopTimeout != "" {
+			_, err = time.ParseDuration(stopTimeout)
+			if err != nil {
+				log.Fatalf("ERROR: Bad stop timeout %s: %s", stopTimeout, err)
+			}
+		}
+
+		_, err = utils.ParseUlimits(ulimits)
+		if err != nil {
+			log.Fatalf("ERROR: Bad ulimit option %s: %s", ulimits, err)
+		}
+
+		_, err = utils.MatchConstraints(constraints, nil)
+		if err != nil {
+			log.Fatalf("ERROR: Bad constraints %s: %s", constraints, err)
+		}
+
+		// only set the booleans that were passed
+		readOnlyOpt, privilegedOpt := "", ""
+		if readOnly {
+			readOnlyOpt = "true"
+		}
+		if privileged {
+			privilegedOpt = "true"
+		}
+
 		updated, err := commander.RuntimeSet(configStore, app, env, pool, commander.RuntimeOptions{
 			Ps:          ps,
 			Memory:      m,
 			CPUShares:   c,
 			VirtualHost: vhost,
 			Port:        port,
+			Restart:     restart,
+			Network:     network,
+			LogDriver:   logDriver,
+			LogOpts:     logOpts,
+			StopSignal:  stopSignal,
+			StopTimeout: stopTimeout,
+			Ulimits:     ulimits,
+			CapAdd:      capAdd,
+			CapDrop:     capDrop,
+			ReadOnly:    readOnlyOpt,
+			Privileged:  privilegedOpt,
+			Constraints: constraints,
+
+			RemoveVirtualHost: removeVhost,
+			ClearPort:         clearPort,
 		})
 		if err != nil {
 			log.Fatalf("ERROR: %s", err)
@@ -984,7 +2119,8 @@ func main() {
 		return
 
 	case "runtime:unset":
-		var ps, m, c, port bool
+		var ps, m, c, port, restart, network, logDriver, logOpts, stopSignal, stopTimeout bool
+		var ulimits, capAdd, capDrop, readOnly, privileged, constraints bool
 		var vhost string
 		runtimeFs := flag.NewFlagSet("runtime:unset", flag.ExitOnError)
 		runtimeFs.BoolVar(&ps, "ps", false, "Number of instances to run across all hosts")
@@ -992,9 +2128,21 @@ func main() {
 		runtimeFs.BoolVar(&c, "c", false, "CPU shares (relative weight)")
 		runtimeFs.StringVar(&vhost, "vhost", "", "Virtual host for HTTP routing")
 		runtimeFs.BoolVar(&port, "port", false, "Service port for service discovery")
+		runtimeFs.BoolVar(&restart, "restart", false, "Restart policy when containers exit")
+		runtimeFs.BoolVar(&network, "net", false, "Docker network mode")
+		runtimeFs.BoolVar(&logDriver, "log-driver", false, "Docker log driver")
+		runtimeFs.BoolVar(&logOpts, "log-opts", false, "Log driver options")
+		runtimeFs.BoolVar(&stopSignal, "stop-signal", false, "Signal sent to stop containers")
+		runtimeFs.BoolVar(&stopTimeout, "stop-timeout", false, "Time containers have to exit before they're killed")
+		runtimeFs.BoolVar(&ulimits, "ulimit", false, "Resource limits")
+		runtimeFs.BoolVar(&capAdd, "cap-add", false, "Linux capabilities to add")
+		runtimeFs.BoolVar(&capDrop, "cap-drop", false, "Linux capabilities to drop")
+		runtimeFs.BoolVar(&readOnly, "read-only", false, "Read only root filesystem")
+		runtimeFs.BoolVar(&privileged, "privileged", false, "Privileged containers")
+		runtimeFs.BoolVar(&constraints, "constraints", false, "Host label constraints")
 
 		runtimeFs.Usage = func() {
-			println("Usage: commander runtime:unset [-ps] [-m] [-c] [-vhost x.y.z] [-port] <app>\n")
+			println("Usage: commander runtime:unset [-ps] [-m] [-c] [-vhost x.y.z] [-port] [-restart] [-net] [-log-driver] [-log-opts] [-stop-signal] [-stop-timeout] [-ulimit] [-cap-add] [-cap-drop] [-read-only] [-privileged] [-constraints] <app>\n")
 			println("    Reset and removes container runtime policies to defaults\n")
 			println("Options:\n")
 			runtimeFs.PrintDefaults()
@@ -1037,6 +2185,54 @@ func main() {
 			options.Port = "-"
 		}
 
+		if restart {
+			options.Restart = "-"
+		}
+
+		if network {
+			options.Network = "-"
+		}
+
+		if logDriver {
+			options.LogDriver = "-"
+		}
+
+		if logOpts {
+			options.LogOpts = "-"
+		}
+
+		if stopSignal {
+			options.StopSignal = "-"
+		}
+
+		if stopTimeout {
+			options.StopTimeout = "-"
+		}
+
+		if ulimits {
+			options.Ulimits = "-"
+		}
+
+		if capAdd {
+			options.CapAdd = "-"
+		}
+
+		if capDrop {
+			options.CapDrop = "-"
+		}
+
+		if readOnly {
+			options.ReadOnly = "-"
+		}
+
+		if privileged {
+			options.Privileged = "-"
+		}
+
+		if constraints {
+			options.Constraints = "-"
+		}
+
 		updated, err := commander.RuntimeUnset(configStore, app, env, pool, options)
 		if err != nil {
 			log.Fatalf("ERROR: %s", err)
@@ -1074,15 +2270,34 @@ func main() {
 		})
 	}()
 
+	starting := []*config.AppConfig{}
+	for app := range workerChans {
+		if len(apps) == 0 || utils.StringInSlice(app, apps) {
+			appCfg, err := configStore.GetApp(app, env)
+			if err != nil || appCfg == nil {
+				// the worker reports it
+				continue
+			}
+			starting = append(starting, appCfg)
+		}
+	}
+	prePull(starting)
+
 	for app, ch := range workerChans {
 		if len(apps) == 0 || utils.StringInSlice(app, apps) {
 			wg.Add(1)
 			go restartContainers(app, ch)
-			ch <- "deploy"
+			go sendWorkerCmd(app, ch, "deploy")
 		}
 	}
 
 	if loop {
+		go reconcileLoop()
+
+		if gcInterval > 0 {
+			go gcLoop()
+		}
+		go jobsLoop()
 
 		go discovery.Register(serviceRuntime, serviceRegistry, configStore, env, pool, hostIP, shuttleAddr)
 		cancelChan := make(chan struct{})
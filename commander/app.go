@@ -2,14 +2,16 @@ package commander
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/litl/galaxy/config"
 	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/registry"
 	"github.com/litl/galaxy/runtime"
 	"github.com/litl/galaxy/utils"
-	"github.com/ryanuber/columnize"
 )
 
 func AppList(configStore *config.Store, env string) error {
@@ -24,7 +26,7 @@ func AppList(configStore *config.Store, env string) error {
 		}
 	}
 
-	columns := []string{"NAME | ENV | VERSION | IMAGE ID | CONFIG | POOLS "}
+	columns := [][]string{{"NAME", "ENV", "VERSION", "IMAGE ID", "CONFIG", "POOLS"}}
 
 	for _, env := range envs {
 
@@ -57,19 +59,17 @@ func AppList(configStore *config.Store, env string) error {
 				}
 			}
 
-			columns = append(columns, strings.Join([]string{
+			columns = append(columns, []string{
 				name,
 				env,
 				versionDeployed,
 				versionID,
 				strconv.FormatInt(app.ID(), 10),
 				strings.Join(assignments, ","),
-			}, " | "))
+			})
 		}
 	}
-	output, _ := columnize.SimpleFormat(columns)
-	log.Println(output)
-	return nil
+	return PrintColumns(columns)
 }
 
 func AppCreate(configStore *config.Store, app, env string) error {
@@ -92,7 +92,7 @@ func AppCreate(configStore *config.Store, app, env string) error {
 	return nil
 }
 
-func AppDelete(configStore *config.Store, app, env string) error {
+func AppDelete(configStore *config.Store, serviceRegistry *registry.ServiceRegistry, app, env string) error {
 
 	// Don't allow deleting runtime hosts entries
 	if app == "hosts" || app == "pools" {
@@ -106,26 +106,38 @@ func AppDelete(configStore *config.Store, app, env string) error {
 
 	if deleted {
 		log.Printf("Deleted %s from env %s.\n", app, env)
+
+		_, err = serviceRegistry.ReleasePorts(env, app)
+		if err != nil {
+			return fmt.Errorf("could not release %s's host ports: %s", app, err)
+		}
 	} else {
 		log.Printf("%s does not exists in env %s.\n", app, env)
 	}
 	return nil
 }
 
-func AppDeploy(configStore *config.Store, serviceRuntime *runtime.ServiceRuntime, app, env, version string) error {
+// AppDeploy sets app's version in env and returns the deploy ID of the new
+// config, which the containers that run it are registered with.
+func AppDeploy(configStore *config.Store, serviceRuntime *runtime.ServiceRuntime, app, env, version string) (string, error) {
 
 	image, err := serviceRuntime.PullImage(version, "")
 	if image == nil || err != nil {
-		return fmt.Errorf("unable to pull %s. Has it been released yet?", version)
+		return "", fmt.Errorf("unable to pull %s. Has it been released yet?", version)
+	}
+
+	err = serviceRuntime.CheckImagePolicy(env, version, image.ID)
+	if err != nil {
+		return "", err
 	}
 
 	svcCfg, err := configStore.GetApp(app, env)
 	if err != nil {
-		return fmt.Errorf("unable to deploy app: %s.", err)
+		return "", fmt.Errorf("unable to deploy app: %s.", err)
 	}
 
 	if svcCfg == nil {
-		return fmt.Errorf("app %s does not exist. Create it first.", app)
+		return "", fmt.Errorf("app %s does not exist. Create it first.", app)
 	}
 
 	svcCfg.SetVersion(version)
@@ -136,19 +148,85 @@ func AppDeploy(configStore *config.Store, serviceRuntime *runtime.ServiceRuntime
 		svcCfg.AddPort(k.Port(), k.Proto())
 	}
 
+	err = deployHook(serviceRuntime, env, svcCfg, "GALAXY_PRE_DEPLOY")
+	if err != nil {
+		return "", fmt.Errorf("pre-deploy hook failed, %s NOT deployed: %s", version, err)
+	}
+
 	updated, err := configStore.UpdateApp(svcCfg, env)
 	if err != nil {
-		return fmt.Errorf("could not store version: %s", err)
+		return "", fmt.Errorf("could not store version: %s", err)
 	}
 	if !updated {
-		return fmt.Errorf("%s NOT deployed.", version)
+		return "", fmt.Errorf("%s NOT deployed.", version)
 	}
 	log.Printf("Deployed %s.\n", version)
-	return nil
+
+	err = deployHook(serviceRuntime, env, svcCfg, "GALAXY_POST_DEPLOY")
+	if err != nil {
+		return svcCfg.DeployID(), fmt.Errorf("post-deploy hook failed: %s", err)
+	}
+	return svcCfg.DeployID(), nil
 }
 
-func AppRestart(Store *config.Store, app, env string) error {
-	err := Store.NotifyRestart(app, env)
+// AppRollback restores app's image, env and ports in env to those of the
+// release with deployID, or of the release before the current one if
+// deployID is "", and returns the deploy ID of the restored config.
+func AppRollback(configStore *config.Store, app, env, deployID string) (string, error) {
+	svcCfg, err := configStore.GetApp(app, env)
+	if err != nil {
+		return "", fmt.Errorf("unable to roll back app: %s.", err)
+	}
+
+	if svcCfg == nil {
+		return "", fmt.Errorf("app %s does not exist.", app)
+	}
+
+	var target *config.Release
+	ids := []string{}
+	for _, release := range svcCfg.Releases() {
+		ids = append(ids, release.DeployID)
+		if target != nil {
+			continue
+		}
+		if deployID == "" && release.DeployID != svcCfg.DeployID() ||
+			deployID != "" && release.DeployID == deployID {
+			target = release
+		}
+	}
+	if target == nil && deployID != "" {
+		return "", fmt.Errorf("%s has no release %s. Recent ones are: %s.", app, deployID, strings.Join(ids, ","))
+	}
+	if target == nil {
+		return "", fmt.Errorf("%s has no earlier release to roll back to.", app)
+	}
+
+	svcCfg.Restore(target)
+
+	updated, err := configStore.UpdateApp(svcCfg, env)
+	if err != nil {
+		return "", fmt.Errorf("could not store version: %s", err)
+	}
+	if !updated {
+		return "", fmt.Errorf("%s NOT rolled back.", app)
+	}
+	log.Printf("Rolled back %s to %s from deploy %s.\n", app, target.Version, target.DeployID)
+	return svcCfg.DeployID(), nil
+}
+
+// AppRestart restarts app's containers, batch at a time across the env
+// waiting delay after each, or all at once if batch is 0.
+func AppRestart(Store *config.Store, app, env string, batch int, delay time.Duration) error {
+	if batch < 0 {
+		return fmt.Errorf("invalid batch size %d", batch)
+	}
+
+	var err error
+	if batch == 0 {
+		err = Store.NotifyRestart(app, env)
+	} else {
+		err = Store.NotifyRollingRestart(app, env, batch, delay)
+	}
 	if err != nil {
 		return fmt.Errorf("could not restart %s: %s", app, err)
 	}
@@ -163,12 +241,89 @@ func AppRun(configStore *config.Store, serviceRuntime *runtime.ServiceRuntime, a
 	}
 
 	_, err = serviceRuntime.RunCommand(env, appCfg, args)
+	if _, ok := err.(*runtime.ExitError); ok {
+		return err
+	}
 	if err != nil {
 		return fmt.Errorf("could not start container: %s", err)
 	}
 	return nil
 }
 
+// RunHost picks the host in pool to run a one-off container of app on:
+// the one with the fewest galaxy containers among those whose labels
+// satisfy the app's constraints.  If pool is "", the first pool the app is
+// assigned to is used.
+func RunHost(configStore *config.Store, app, env, pool string) (string, error) {
+	appCfg, err := configStore.GetApp(app, env)
+	if err != nil {
+		return "", err
+	}
+	if appCfg == nil {
+		return "", fmt.Errorf("app %s does not exist.", app)
+	}
+
+	if pool == "" {
+		pools, err := configStore.ListPools(env)
+		if err != nil {
+			return "", err
+		}
+		sort.Strings(pools)
+		for _, p := range pools {
+			assignments, err := configStore.ListAssignments(env, p)
+			if err != nil {
+				return "", err
+			}
+			if utils.StringInSlice(app, assignments) {
+				pool = p
+				break
+			}
+		}
+		if pool == "" {
+			return "", fmt.Errorf("%s isn't assigned to a pool in %s.", app, env)
+		}
+	}
+
+	hosts, err := configStore.ListHosts(env, pool)
+	if err != nil {
+		return "", err
+	}
+
+	var best *config.HostInfo
+	for i, h := range hosts {
+		ok, err := hostSatisfies(h, appCfg)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			continue
+		}
+		if best == nil || h.Containers < best.Containers ||
+			h.Containers == best.Containers && h.HostIP < best.HostIP {
+			best = &hosts[i]
+		}
+	}
+	if best == nil {
+		return "", fmt.Errorf("no hosts in %s/%s can run %s.", env, pool, app)
+	}
+	return best.HostIP, nil
+}
+
+// AppExec runs a command inside one of app's running containers, in pool
+// unless it's "", rather than a new container.
+func AppExec(configStore *config.Store, serviceRuntime *runtime.ServiceRuntime, app, env, pool string, args []string) error {
+	appCfg, err := configStore.GetApp(app, env)
+	if err != nil {
+		return fmt.Errorf("unable to run command: %s.", err)
+	}
+
+	if appCfg == nil {
+		return fmt.Errorf("app %s does not exist.", app)
+	}
+
+	return serviceRuntime.ExecCommand(env, pool, appCfg, args)
+}
+
 func AppShell(configStore *config.Store, serviceRuntime *runtime.ServiceRuntime, app, env, pool string) error {
 	appCfg, err := configStore.GetApp(app, env)
 	if err != nil {
@@ -0,0 +1,39 @@
+package commander
+
+import (
+	"testing"
+
+	"github.com/litl/galaxy/config"
+)
+
+func TestRunHost(t *testing.T) {
+	s := setupLabels(t, 1, []string{"10.0.0.3", "10.0.0.1", "10.0.0.2"},
+		map[string]string{"10.0.0.1": "disk=hdd", "10.0.0.2": "disk=ssd", "10.0.0.3": "disk=ssd"},
+		"disk=ssd")
+	b := s.Backend.(*config.MemoryBackend)
+	hosts, _ := b.ListHostsFunc("dev", "web")
+	for i := range hosts {
+		hosts[i].Containers = 2
+	}
+	b.ListHostsFunc = func(env, pool string) ([]config.HostInfo, error) {
+		return hosts, nil
+	}
+
+	host, err := RunHost(s, "app", "dev", "web")
+	if err != nil {
+		t.Fatalf("RunHost() error: %s", err)
+	}
+	// 10.0.0.1 is the first but doesn't satisfy the constraints
+	if host != "10.0.0.2" {
+		t.Errorf("RunHost() = %s, want 10.0.0.2", host)
+	}
+
+	hosts[0].Containers = 1
+	host, err = RunHost(s, "app", "dev", "web")
+	if err != nil {
+		t.Fatalf("RunHost() error: %s", err)
+	}
+	if host != "10.0.0.3" {
+		t.Errorf("RunHost() = %s, want the least busy host 10.0.0.3", host)
+	}
+}
@@ -0,0 +1,43 @@
+package commander
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/runtime"
+	"github.com/litl/galaxy/utils"
+)
+
+// BlacklistList lists the containers on this host that have failed to
+// stop.
+func BlacklistList(serviceRuntime *runtime.ServiceRuntime) error {
+	zombies, err := serviceRuntime.Zombies()
+	if err != nil {
+		return err
+	}
+
+	columns := [][]string{{"CONTAINER", "NAME", "ATTEMPTS", "BLACKLISTED", "SINCE", "ERROR"}}
+	for _, z := range zombies {
+		columns = append(columns, []string{
+			z.ID[0:12],
+			z.Name,
+			strconv.Itoa(z.Attempts),
+			strconv.FormatBool(z.Blacklisted),
+			utils.HumanDuration(time.Since(z.Since)) + " ago",
+			z.Error,
+		})
+	}
+	return PrintColumns(columns)
+}
+
+// BlacklistClear forgets the failed stops of the containers matching id,
+// or all of them if it's "", so they're tried again.
+func BlacklistClear(serviceRuntime *runtime.ServiceRuntime, id string) error {
+	cleared, err := serviceRuntime.ClearZombies(id)
+	if err != nil {
+		return err
+	}
+	log.Printf("Cleared %d containers.\n", cleared)
+	return nil
+}
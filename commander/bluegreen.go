@@ -0,0 +1,101 @@
+package commander
+
+import (
+	"fmt"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/runtime"
+)
+
+// BlueGreenDeploy runs version everywhere alongside the deployed version,
+// as whichever color isn't receiving traffic.  Cutover sends traffic to it.
+func BlueGreenDeploy(configStore *config.Store, serviceRuntime *runtime.ServiceRuntime, app, env, version string) error {
+	image, err := serviceRuntime.PullImage(version, "")
+	if image == nil || err != nil {
+		return fmt.Errorf("unable to pull %s. Has it been released yet?", version)
+	}
+
+	err = serviceRuntime.CheckImagePolicy(env, version, image.ID)
+	if err != nil {
+		return err
+	}
+
+	svcCfg, err := configStore.GetApp(app, env)
+	if err != nil {
+		return fmt.Errorf("unable to deploy app: %s.", err)
+	}
+
+	if svcCfg == nil {
+		return fmt.Errorf("app %s does not exist. Create it first.", app)
+	}
+
+	color, deployed := "green", svcCfg.Green
+	if svcCfg.LiveColor() == "green" {
+		color, deployed = "blue", svcCfg.Stable
+		svcCfg.SetVersion(version)
+		svcCfg.SetVersionID(image.ID)
+
+		svcCfg.ClearPorts()
+		for k, _ := range image.Config.ExposedPorts {
+			svcCfg.AddPort(k.Port(), k.Proto())
+		}
+	} else {
+		svcCfg.SetGreen(version, image.ID)
+	}
+
+	err = deployHook(serviceRuntime, env, deployed(), "GALAXY_PRE_DEPLOY")
+	if err != nil {
+		return fmt.Errorf("pre-deploy hook failed, %s NOT deployed: %s", version, err)
+	}
+
+	updated, err := configStore.UpdateApp(svcCfg, env)
+	if err != nil {
+		return fmt.Errorf("could not store version: %s", err)
+	}
+	if !updated {
+		return fmt.Errorf("%s NOT deployed.", version)
+	}
+	log.Printf("Deployed %s as %s.\n", version, color)
+
+	err = deployHook(serviceRuntime, env, deployed(), "GALAXY_POST_DEPLOY")
+	if err != nil {
+		return fmt.Errorf("post-deploy hook failed: %s", err)
+	}
+	return nil
+}
+
+// Cutover sends app's traffic to the color it isn't going to now.  Running
+// it again rolls back.
+func Cutover(configStore *config.Store, app, env string) error {
+	svcCfg, err := configStore.GetApp(app, env)
+	if err != nil {
+		return fmt.Errorf("unable to cutover: %s.", err)
+	}
+
+	if svcCfg == nil {
+		return fmt.Errorf("app %s does not exist.", app)
+	}
+
+	version := ""
+	switch svcCfg.LiveColor() {
+	case "":
+		return fmt.Errorf("%s is not deployed blue/green.", app)
+	case "green":
+		svcCfg.SetLiveColor("blue")
+		version = svcCfg.Version()
+	default:
+		svcCfg.SetLiveColor("green")
+		version = svcCfg.GreenVersion()
+	}
+
+	updated, err := configStore.UpdateApp(svcCfg, env)
+	if err != nil {
+		return fmt.Errorf("could not store cutover: %s", err)
+	}
+	if !updated {
+		return fmt.Errorf("%s NOT cutover.", app)
+	}
+	log.Printf("Sending %s traffic to %s (%s).\n", app, version, svcCfg.LiveColor())
+	return nil
+}
@@ -0,0 +1,130 @@
+package commander
+
+import (
+	"fmt"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/runtime"
+)
+
+// CanaryDeploy runs version on the first host of each pool the app is
+// assigned to, flagged as a canary with percent of the app's traffic.  The
+// other hosts keep running the deployed version.
+func CanaryDeploy(configStore *config.Store, serviceRuntime *runtime.ServiceRuntime, app, env, version string, percent int) error {
+	if percent < 0 || percent >= 100 {
+		return fmt.Errorf("canary percent must be between 0 and 99")
+	}
+
+	image, err := serviceRuntime.PullImage(version, "")
+	if image == nil || err != nil {
+		return fmt.Errorf("unable to pull %s. Has it been released yet?", version)
+	}
+
+	err = serviceRuntime.CheckImagePolicy(env, version, image.ID)
+	if err != nil {
+		return err
+	}
+
+	svcCfg, err := configStore.GetApp(app, env)
+	if err != nil {
+		return fmt.Errorf("unable to deploy canary: %s.", err)
+	}
+
+	if svcCfg == nil {
+		return fmt.Errorf("app %s does not exist. Create it first.", app)
+	}
+
+	svcCfg.SetCanary(version, image.ID, percent)
+
+	err = deployHook(serviceRuntime, env, svcCfg.Canary(), "GALAXY_PRE_DEPLOY")
+	if err != nil {
+		return fmt.Errorf("pre-deploy hook failed, %s NOT deployed: %s", version, err)
+	}
+
+	updated, err := configStore.UpdateApp(svcCfg, env)
+	if err != nil {
+		return fmt.Errorf("could not store canary: %s", err)
+	}
+	if !updated {
+		return fmt.Errorf("%s NOT deployed.", version)
+	}
+	log.Printf("Deployed %s as a canary.\n", version)
+
+	err = deployHook(serviceRuntime, env, svcCfg.Canary(), "GALAXY_POST_DEPLOY")
+	if err != nil {
+		return fmt.Errorf("post-deploy hook failed: %s", err)
+	}
+	return nil
+}
+
+// CanaryPromote deploys the app's canary version everywhere.
+func CanaryPromote(configStore *config.Store, serviceRuntime *runtime.ServiceRuntime, app, env string) error {
+	svcCfg, err := configStore.GetApp(app, env)
+	if err != nil {
+		return fmt.Errorf("unable to promote canary: %s.", err)
+	}
+
+	if svcCfg == nil {
+		return fmt.Errorf("app %s does not exist.", app)
+	}
+
+	version := svcCfg.CanaryVersion()
+	if version == "" {
+		return fmt.Errorf("%s has no canary.", app)
+	}
+
+	image, err := serviceRuntime.PullImage(version, svcCfg.CanaryVersionID())
+	if image == nil || err != nil {
+		return fmt.Errorf("unable to pull %s: %s", version, err)
+	}
+
+	svcCfg.SetVersion(version)
+	svcCfg.SetVersionID(image.ID)
+	svcCfg.ClearCanary()
+
+	svcCfg.ClearPorts()
+	for k, _ := range image.Config.ExposedPorts {
+		svcCfg.AddPort(k.Port(), k.Proto())
+	}
+
+	updated, err := configStore.UpdateApp(svcCfg, env)
+	if err != nil {
+		return fmt.Errorf("could not store version: %s", err)
+	}
+	if !updated {
+		return fmt.Errorf("%s NOT promoted.", version)
+	}
+	log.Printf("Promoted %s.\n", version)
+	return nil
+}
+
+// CanaryAbort stops the app's canary and puts its hosts back on the
+// deployed version.
+func CanaryAbort(configStore *config.Store, app, env string) error {
+	svcCfg, err := configStore.GetApp(app, env)
+	if err != nil {
+		return fmt.Errorf("unable to abort canary: %s.", err)
+	}
+
+	if svcCfg == nil {
+		return fmt.Errorf("app %s does not exist.", app)
+	}
+
+	version := svcCfg.CanaryVersion()
+	if version == "" {
+		return fmt.Errorf("%s has no canary.", app)
+	}
+
+	svcCfg.ClearCanary()
+
+	updated, err := configStore.UpdateApp(svcCfg, env)
+	if err != nil {
+		return fmt.Errorf("could not store canary: %s", err)
+	}
+	if !updated {
+		return fmt.Errorf("%s canary NOT aborted.", version)
+	}
+	log.Printf("Aborted canary %s, %s is deployed.\n", version, svcCfg.Version())
+	return nil
+}
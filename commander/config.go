@@ -1,17 +1,103 @@
 package commander
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/litl/galaxy/config"
 	"github.com/litl/galaxy/log"
 )
 
-func ConfigList(configStore *config.Store, app, env string) error {
+// maxConflictRetries is how many times a config write is retried after
+// losing a race with another writer.
+const maxConflictRetries = 3
+
+// ConfigFormats are the formats config values can be printed in: KEY=VALUE
+// lines, a JSON object, a .env file that config:set can read back, or a
+// YAML mapping.
+var ConfigFormats = []string{"text", "json", "dotenv", "yaml"}
+
+// writeConfig writes values to w in format, in the order of keys.
+func writeConfig(w io.Writer, format string, keys []string, values map[string]string) error {
+	switch format {
+	case "", "text":
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s=%s\n", k, values[k])
+		}
+	case "json":
+		out := make(map[string]string)
+		for _, k := range keys {
+			out[k] = values[k]
+		}
+		enc := json.NewEncoder(w)
+		return enc.Encode(out)
+	case "dotenv":
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s=%s\n", k, dotenvQuote(values[k]))
+		}
+	case "yaml":
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s: %s\n", k, yamlQuote(values[k]))
+		}
+	default:
+		return fmt.Errorf("unknown format %s, use one of %s", format, strings.Join(ConfigFormats, ", "))
+	}
+	return nil
+}
+
+// dotenvQuote double quotes value if it needs it to be read back from a
+// .env file.
+func dotenvQuote(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t\r\n\"'\\#$`") {
+		return value
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "`", "\\`", "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + r.Replace(value) + `"`
+}
+
+// parseDotenv returns the KEY=VALUE pairs of a .env file, skipping blank
+// lines and comments.  Lines can start with export and values can be
+// single or double quoted.
+func parseDotenv(data string) ([]string, error) {
+	envVars := []string{}
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		sep := strings.Index(line, "=")
+		if sep < 0 {
+			return nil, fmt.Errorf("bad config variable format on line %d: %s", i+1, line)
+		}
+		k := strings.TrimSpace(line[:sep])
+		v := strings.TrimSpace(line[sep+1:])
+
+		switch {
+		case len(v) >= 2 && v[0] == '\'' && v[len(v)-1] == '\'':
+			v = v[1 : len(v)-1]
+		case len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"':
+			var err error
+			v, err = strconv.Unquote(strings.NewReplacer(`\$`, `$`, "\\`", "`").Replace(v))
+			if err != nil {
+				return nil, fmt.Errorf("bad quoted value on line %d: %s", i+1, line)
+			}
+		}
+		envVars = append(envVars, k+"="+v)
+	}
+	return envVars, nil
+}
+
+// ConfigList prints all of app's config values in format.
+func ConfigList(configStore *config.Store, app, env, format string) error {
 
 	cfg, err := configStore.GetApp(app, env)
 	if err != nil {
@@ -22,48 +108,117 @@ func ConfigList(configStore *config.Store, app, env string) error {
 		return fmt.Errorf("unable to list config for %s.", app)
 	}
 
+	values := map[string]string{"ENV": env}
 	keys := sort.StringSlice{"ENV"}
-	for k, _ := range cfg.Env() {
-		keys = append(keys, k)
-	}
-
-	keys.Sort()
-
-	for _, k := range keys {
+	for k, v := range cfg.Env() {
 		if k == "ENV" {
-			log.Printf("%s=%s\n", k, env)
 			continue
 		}
-		log.Printf("%s=%s\n", k, cfg.Env()[k])
+		keys = append(keys, k)
+		values[k] = v
 	}
 
-	return nil
+	keys.Sort()
+
+	return writeConfig(os.Stdout, format, keys, values)
 }
 
+// ConfigSet sets app's KEY=VALUE envVars.  With no envVars they're read
+// from stdin as a .env file, and a KEY=- takes its value from stdin, e.g.
+// for a certificate.
 func ConfigSet(configStore *config.Store, app, env string, envVars []string) error {
 
-	if len(envVars) == 0 {
+	stdin := func() (string, error) {
 		bytes, err := ioutil.ReadAll(os.Stdin)
+		return string(bytes), err
+	}
+	envVars, err := readEnvVars(envVars, stdin)
+	if err != nil {
+		return err
+	}
+
+	if len(envVars) == 0 {
+		return fmt.Errorf("no config values specified.")
+	}
+	return updateEnvVars(configStore, app, env, envVars, true)
+}
+
+// updateEnvVars sets app's KEY=VALUE envVars in a single update, retrying
+// if it conflicts with another, and prints them if verbose.
+func updateEnvVars(configStore *config.Store, app, env string, envVars []string, verbose bool) error {
+	var svcCfg *config.AppConfig
+	updated := false
+	for attempt := 0; ; attempt++ {
+		var err error
+		svcCfg, err = configStore.GetApp(app, env)
+		if err != nil {
+			return fmt.Errorf("unable to set config: %s.", err)
+		}
+
+		if svcCfg == nil {
+			svcCfg = config.NewAppConfig(app, "")
+		}
+
+		changed, err := setEnvVars(svcCfg, envVars, verbose && attempt == 0)
 		if err != nil {
 			return err
+		}
 
+		if !changed {
+			return fmt.Errorf("configuration NOT changed for %s", app)
 		}
-		envVars = strings.Split(string(bytes), "\n")
+
+		updated, err = configStore.UpdateApp(svcCfg, env)
+		if err == config.ErrConflict && attempt < maxConflictRetries {
+			log.Warnf("Configuration for %s changed concurrently, retrying", app)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to set config: %s.", err)
+		}
+		break
 	}
 
-	if len(envVars) == 0 {
-		return fmt.Errorf("no config values specified.")
+	if !updated {
+		return fmt.Errorf("configuration NOT changed for %s", app)
 	}
+	log.Printf("Configuration changed for %s. v%d\n", app, svcCfg.ID())
+	return nil
+}
 
-	svcCfg, err := configStore.GetApp(app, env)
-	if err != nil {
-		return fmt.Errorf("unable to set config: %s.", err)
+// readEnvVars returns envVars with the values of KEY=- read from stdin, or
+// the .env file on stdin if there are no envVars.
+func readEnvVars(envVars []string, stdin func() (string, error)) ([]string, error) {
+	if len(envVars) == 0 {
+		data, err := stdin()
+		if err != nil {
+			return nil, err
+		}
+		return parseDotenv(data)
 	}
 
-	if svcCfg == nil {
-		svcCfg = config.NewAppConfig(app, "")
+	read := false
+	values := make([]string, len(envVars))
+	for i, arg := range envVars {
+		values[i] = arg
+		if !strings.HasSuffix(arg, "=-") {
+			continue
+		}
+		if read {
+			return nil, fmt.Errorf("only one value can be read from stdin")
+		}
+		data, err := stdin()
+		if err != nil {
+			return nil, err
+		}
+		values[i] = strings.TrimSuffix(arg, "-") + strings.TrimRight(data, "\r\n")
+		read = true
 	}
+	return values, nil
+}
 
+// setEnvVars applies KEY=VALUE pairs to svcCfg, printing them if verbose.
+func setEnvVars(svcCfg *config.AppConfig, envVars []string, verbose bool) (bool, error) {
 	updated := false
 	for _, arg := range envVars {
 
@@ -72,49 +227,51 @@ func ConfigSet(configStore *config.Store, app, env string, envVars []string) err
 		}
 
 		if !strings.Contains(arg, "=") {
-			return fmt.Errorf("bad config variable format: %s", arg)
+			return false, fmt.Errorf("bad config variable format: %s", arg)
 		}
 
 		sep := strings.Index(arg, "=")
 		k := strings.ToUpper(strings.TrimSpace(arg[0:sep]))
 		v := strings.TrimSpace(arg[sep+1:])
 		if k == "ENV" {
-			log.Warnf("%s cannot be updated.", k)
+			if verbose {
+				log.Warnf("%s cannot be updated.", k)
+			}
 			continue
 		}
 
-		log.Printf("%s=%s\n", k, v)
+		if verbose {
+			log.Printf("%s=%s\n", k, v)
+		}
 		svcCfg.EnvSet(k, v)
 		updated = true
 	}
-
-	if !updated {
-		return fmt.Errorf("configuration NOT changed for %s", app)
-	}
-
-	updated, err = configStore.UpdateApp(svcCfg, env)
-	if err != nil {
-		return fmt.Errorf("unable to set config: %s.", err)
-	}
-
-	if !updated {
-		return fmt.Errorf("configuration NOT changed for %s", app)
-	}
-	log.Printf("Configuration changed for %s. v%d\n", app, svcCfg.ID())
-	return nil
+	return updated, nil
 }
 
-func ConfigGet(configStore *config.Store, app, env string, envVars []string) error {
+// ConfigGet prints app's envVars in format.
+func ConfigGet(configStore *config.Store, app, env, format string, envVars []string) error {
 
 	cfg, err := configStore.GetApp(app, env)
 	if err != nil {
 		return err
 	}
 
+	if cfg == nil {
+		return fmt.Errorf("unable to get config for %s.", app)
+	}
+
+	keys := []string{}
+	values := make(map[string]string)
 	for _, arg := range envVars {
-		fmt.Printf("%s=%s\n", strings.ToUpper(arg), cfg.Env()[strings.ToUpper(arg)])
+		k := strings.ToUpper(arg)
+		keys = append(keys, k)
+		values[k] = cfg.Env()[k]
+		if k == "ENV" {
+			values[k] = env
+		}
 	}
-	return nil
+	return writeConfig(os.Stdout, format, keys, values)
 }
 
 func ConfigUnset(configStore *config.Store, app, env string, envVars []string) error {
@@ -123,38 +280,152 @@ func ConfigUnset(configStore *config.Store, app, env string, envVars []string) e
 		return fmt.Errorf("no config values specified.")
 	}
 
-	svcCfg, err := configStore.GetApp(app, env)
-	if err != nil {
-		return fmt.Errorf("unable to unset config: %s.", err)
-	}
-
+	var svcCfg *config.AppConfig
 	updated := false
-	for _, arg := range envVars {
-		k := strings.ToUpper(strings.TrimSpace(arg))
-		if k == "ENV" || svcCfg.EnvGet(k) == "" {
-			log.Warnf("%s cannot be unset.", k)
-			continue
+	for attempt := 0; ; attempt++ {
+		var err error
+		svcCfg, err = configStore.GetApp(app, env)
+		if err != nil {
+			return fmt.Errorf("unable to unset config: %s.", err)
 		}
 
-		log.Printf("%s\n", k)
-		svcCfg.EnvSet(strings.ToUpper(arg), "")
-		updated = true
+		changed := false
+		for _, arg := range envVars {
+			k := strings.ToUpper(strings.TrimSpace(arg))
+			if k == "ENV" || svcCfg.EnvGet(k) == "" {
+				if attempt == 0 {
+					log.Warnf("%s cannot be unset.", k)
+				}
+				continue
+			}
+
+			if attempt == 0 {
+				log.Printf("%s\n", k)
+			}
+			svcCfg.EnvSet(strings.ToUpper(arg), "")
+			changed = true
+		}
+
+		if !changed {
+			return fmt.Errorf("Configuration NOT changed for %s", app)
+		}
+
+		updated, err = configStore.UpdateApp(svcCfg, env)
+		if err == config.ErrConflict && attempt < maxConflictRetries {
+			log.Warnf("Configuration for %s changed concurrently, retrying", app)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("ERROR: Unable to unset config: %s.", err)
+		}
+		break
 	}
 
 	if !updated {
 		return fmt.Errorf("Configuration NOT changed for %s", app)
+
 	}
+	log.Printf("Configuration changed for %s. v%d.\n", app, svcCfg.ID())
+	return nil
+}
 
-	updated, err = configStore.UpdateApp(svcCfg, env)
+// DefaultSecretPattern matches the config keys whose values ConfigDiff
+// doesn't print.
+const DefaultSecretPattern = `(?i)(secret|passw(or)?d|token|credential|private|key)`
+
+// configDiff returns a row of key, from and to values for each config
+// value that differs between from and to, sorted by key, with the values of
+// keys matching secret redacted.
+func configDiff(from, to map[string]string, secret *regexp.Regexp) [][]string {
+	keys := []string{}
+	for k, v := range from {
+		if to[k] != v && k != "ENV" {
+			keys = append(keys, k)
+		}
+	}
+	for k, v := range to {
+		if _, ok := from[k]; !ok && v != "" && k != "ENV" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	show := func(k, v string) string {
+		switch {
+		case v == "":
+			return "-"
+		case secret != nil && secret.MatchString(k):
+			return "<redacted>"
+		}
+		return v
+	}
+
+	rows := [][]string{}
+	for _, k := range keys {
+		op := "changed"
+		switch {
+		case from[k] == "":
+			op = "added"
+		case to[k] == "":
+			op = "removed"
+		}
+		rows = append(rows, []string{op, k, show(k, from[k]), show(k, to[k])})
+	}
+	return rows
+}
+
+// ConfigDiff prints the config values of app that are added, removed or
+// changed in env to compared to env from, and returns true if there are
+// any.  Keys matching the secretPattern regexp, DefaultSecretPattern if
+// it's empty, have their values redacted.
+func ConfigDiff(configStore *config.Store, app, from, to, secretPattern string) (bool, error) {
+	if secretPattern == "" {
+		secretPattern = DefaultSecretPattern
+	}
+	secret, err := regexp.Compile(secretPattern)
 	if err != nil {
-		return fmt.Errorf("ERROR: Unable to unset config: %s.", err)
+		return false, fmt.Errorf("invalid secret pattern: %s", err)
+	}
 
+	env := func(env string) (map[string]string, string, error) {
+		cfg, err := configStore.GetApp(app, env)
+		if err != nil {
+			return nil, "", err
+		}
+		if cfg == nil {
+			return nil, "", fmt.Errorf("%s does not exist in %s.", app, env)
+		}
+		return cfg.Env(), cfg.Version(), nil
 	}
 
-	if !updated {
-		return fmt.Errorf("Configuration NOT changed for %s", app)
+	fromEnv, fromVersion, err := env(from)
+	if err != nil {
+		return false, err
+	}
+	toEnv, toVersion, err := env(to)
+	if err != nil {
+		return false, err
+	}
 
+	rows := configDiff(fromEnv, toEnv, secret)
+	if fromVersion != toVersion {
+		version := func(v string) string {
+			if v == "" {
+				return "-"
+			}
+			return v
+		}
+		rows = append([][]string{{"changed", "version", version(fromVersion), version(toVersion)}}, rows...)
 	}
-	log.Printf("Configuration changed for %s. v%d.\n", app, svcCfg.ID())
-	return nil
+	if len(rows) == 0 {
+		log.Printf("%s config is the same in %s and %s", app, from, to)
+		return false, nil
+	}
+
+	columns := [][]string{{"CHANGE", "KEY", strings.ToUpper(from), strings.ToUpper(to)}}
+	err = PrintColumns(append(columns, rows...))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
 }
@@ -0,0 +1,141 @@
+package commander
+
+import (
+	"bytes"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestWriteConfig(t *testing.T) {
+	keys := []string{"A", "B"}
+	values := map[string]string{"A": "1", "B": "two words"}
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"text", "A=1\nB=two words\n"},
+		{"json", `{"A":"1","B":"two words"}` + "\n"},
+		{"dotenv", "A=1\nB=\"two words\"\n"},
+		{"yaml", "A: \"1\"\nB: \"two words\"\n"},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		err := writeConfig(&out, test.format, keys, values)
+		if err != nil {
+			t.Errorf("writeConfig(%s) error: %s", test.format, err)
+			continue
+		}
+		if out.String() != test.want {
+			t.Errorf("writeConfig(%s) = %q, want %q", test.format, out.String(), test.want)
+		}
+	}
+
+	err := writeConfig(&bytes.Buffer{}, "xml", keys, values)
+	if err == nil {
+		t.Errorf("writeConfig(xml) = nil, want an error")
+	}
+}
+
+func TestDotenvRoundTrip(t *testing.T) {
+	values := map[string]string{
+		"PLAIN":  "value",
+		"EMPTY":  "",
+		"QUOTES": `say "hi" it's`,
+		"SHELL":  "$HOME `id` \\n",
+		"CERT":   "-----BEGIN-----\nabc\n-----END-----",
+	}
+	keys := []string{"CERT", "EMPTY", "PLAIN", "QUOTES", "SHELL"}
+
+	var out bytes.Buffer
+	err := writeConfig(&out, "dotenv", keys, values)
+	if err != nil {
+		t.Fatalf("writeConfig() error: %s", err)
+	}
+
+	envVars, err := parseDotenv(out.String())
+	if err != nil {
+		t.Fatalf("parseDotenv(%q) error: %s", out.String(), err)
+	}
+	for i, envVar := range envVars {
+		want := keys[i] + "=" + values[keys[i]]
+		if envVar != want {
+			t.Errorf("parseDotenv() = %q, want %q", envVar, want)
+		}
+	}
+}
+
+func TestParseDotenv(t *testing.T) {
+	envVars, err := parseDotenv("# comment\n\nexport A=1\nB='$raw'\n  C = spaced \n")
+	if err != nil {
+		t.Fatalf("parseDotenv() error: %s", err)
+	}
+	want := []string{"A=1", "B=$raw", "C=spaced"}
+	if !reflect.DeepEqual(envVars, want) {
+		t.Errorf("parseDotenv() = %v, want %v", envVars, want)
+	}
+
+	_, err = parseDotenv("A=1\nnot a variable\n")
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("parseDotenv() error = %v, want a line 2 error", err)
+	}
+}
+
+func TestReadEnvVars(t *testing.T) {
+	stdin := func() (string, error) { return "line one\nline two\n", nil }
+
+	envVars, err := readEnvVars([]string{"A=1", "CERT=-"}, stdin)
+	if err != nil {
+		t.Fatalf("readEnvVars() error: %s", err)
+	}
+	want := []string{"A=1", "CERT=line one\nline two"}
+	if !reflect.DeepEqual(envVars, want) {
+		t.Errorf("readEnvVars() = %q, want %q", envVars, want)
+	}
+
+	_, err = readEnvVars([]string{"A=-", "B=-"}, stdin)
+	if err == nil {
+		t.Errorf("readEnvVars() with two stdin values = nil, want an error")
+	}
+}
+
+func TestConfigDiff(t *testing.T) {
+	from := map[string]string{
+		"ENV":          "staging",
+		"SAME":         "1",
+		"CHANGED":      "old",
+		"REMOVED":      "gone",
+		"UNSET":        "",
+		"DB_PASSWORD":  "hunter2",
+		"API_KEY":      "abc",
+		"GALAXY_CMD":   "bin/web",
+		"STRIPE_TOKEN": "same",
+	}
+	to := map[string]string{
+		"ENV":          "prod",
+		"SAME":         "1",
+		"CHANGED":      "new",
+		"ADDED":        "here",
+		"DB_PASSWORD":  "correct horse",
+		"GALAXY_CMD":   "bin/web",
+		"STRIPE_TOKEN": "same",
+	}
+
+	rows := configDiff(from, to, regexp.MustCompile(DefaultSecretPattern))
+	want := [][]string{
+		{"added", "ADDED", "-", "here"},
+		{"removed", "API_KEY", "<redacted>", "-"},
+		{"changed", "CHANGED", "old", "new"},
+		{"changed", "DB_PASSWORD", "<redacted>", "<redacted>"},
+		{"removed", "REMOVED", "gone", "-"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("configDiff() = %v, want %v", rows, want)
+	}
+
+	if rows := configDiff(to, to, nil); len(rows) != 0 {
+		t.Errorf("configDiff() of the same config = %v, want none", rows)
+	}
+}
@@ -0,0 +1,161 @@
+package commander
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+)
+
+// ImportFormats are the formats config:import reads.
+var ImportFormats = []string{"dotenv", "yaml", "json"}
+
+// yamlQuote returns value as a YAML double quoted string.  Go's escapes
+// are a subset of YAML's.
+func yamlQuote(value string) string {
+	return strconv.Quote(value)
+}
+
+// parseYAML returns the KEY=VALUE pairs of a YAML mapping of strings,
+// e.g. what config -format yaml writes.  Nested values and block scalars
+// aren't supported.
+func parseYAML(data string) ([]string, error) {
+	envVars := []string{}
+	for i, line := range strings.Split(data, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' || strings.HasPrefix(trimmed, "- ") {
+			return nil, fmt.Errorf("unsupported YAML on line %d, only KEY: value is", i+1)
+		}
+
+		sep := strings.Index(trimmed, ":")
+		if sep < 0 {
+			return nil, fmt.Errorf("bad config variable format on line %d: %s", i+1, trimmed)
+		}
+		k := strings.TrimSpace(trimmed[:sep])
+		v := strings.TrimSpace(trimmed[sep+1:])
+
+		switch {
+		case strings.HasPrefix(v, `"`):
+			end := closingQuote(v)
+			if end < 0 {
+				return nil, fmt.Errorf("bad quoted value on line %d: %s", i+1, trimmed)
+			}
+			var err error
+			v, err = strconv.Unquote(v[:end+1])
+			if err != nil {
+				return nil, fmt.Errorf("bad quoted value on line %d: %s", i+1, trimmed)
+			}
+		case strings.HasPrefix(v, "'"):
+			end := strings.LastIndex(v, "'")
+			if end == 0 {
+				return nil, fmt.Errorf("bad quoted value on line %d: %s", i+1, trimmed)
+			}
+			v = strings.Replace(v[1:end], "''", "'", -1)
+		case v == "|" || v == ">" || strings.HasPrefix(v, "|") || strings.HasPrefix(v, ">"):
+			return nil, fmt.Errorf("unsupported block value on line %d, use a quoted string", i+1)
+		default:
+			if n := strings.Index(v, " #"); n >= 0 {
+				v = strings.TrimSpace(v[:n])
+			}
+			if v == "~" || v == "null" {
+				v = ""
+			}
+		}
+		envVars = append(envVars, k+"="+v)
+	}
+	return envVars, nil
+}
+
+// closingQuote returns the index of the " ending the double quoted string
+// at the start of v, or -1.
+func closingQuote(v string) int {
+	for i := 1; i < len(v); i++ {
+		switch v[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// parseConfig returns the KEY=VALUE pairs of data in one of ImportFormats.
+func parseConfig(format, data string) ([]string, error) {
+	switch format {
+	case "", "dotenv":
+		return parseDotenv(data)
+	case "yaml":
+		return parseYAML(data)
+	case "json":
+		values := make(map[string]string)
+		err := json.Unmarshal([]byte(data), &values)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON config: %s", err)
+		}
+		envVars := []string{}
+		for k, v := range values {
+			envVars = append(envVars, k+"="+v)
+		}
+		sort.Strings(envVars)
+		return envVars, nil
+	}
+	return nil, fmt.Errorf("unknown format %s, use one of %s", format, strings.Join(ImportFormats, ", "))
+}
+
+// ConfigImport sets all of the config values in r, in format, on app in a
+// single update.
+func ConfigImport(configStore *config.Store, app, env, format string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	envVars, err := parseConfig(format, string(data))
+	if err != nil {
+		return err
+	}
+	if len(envVars) == 0 {
+		return fmt.Errorf("no config values to import.")
+	}
+
+	log.Printf("Importing %d config values for %s", len(envVars), app)
+	return updateEnvVars(configStore, app, env, envVars, false)
+}
+
+// ConfigExport writes app's config values to w in format, sorted by key
+// and without ENV, so they can be imported into another app or env.
+func ConfigExport(configStore *config.Store, app, env, format string, w io.Writer) error {
+	cfg, err := configStore.GetApp(app, env)
+	if err != nil {
+		return err
+	}
+	if cfg == nil {
+		return fmt.Errorf("unable to export config for %s.", app)
+	}
+
+	keys := []string{}
+	values := make(map[string]string)
+	for k, v := range cfg.Env() {
+		if k == "ENV" || v == "" {
+			continue
+		}
+		keys = append(keys, k)
+		values[k] = v
+	}
+	sort.Strings(keys)
+
+	if format == "dotenv" || format == "yaml" {
+		fmt.Fprintf(w, "# %s config in %s, v%d\n", app, env, cfg.ID())
+	}
+	return writeConfig(w, format, keys, values)
+}
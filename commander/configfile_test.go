@@ -0,0 +1,71 @@
+package commander
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	data := `---
+# web config
+A: plain value # comment
+B: "quoted \"value\"\nwith a newline"
+C: 'it''s'
+D: ~
+`
+	envVars, err := parseYAML(data)
+	if err != nil {
+		t.Fatalf("parseYAML() error: %s", err)
+	}
+	want := []string{"A=plain value", "B=quoted \"value\"\nwith a newline", "C=it's", "D="}
+	if !reflect.DeepEqual(envVars, want) {
+		t.Errorf("parseYAML() = %q, want %q", envVars, want)
+	}
+
+	for _, bad := range []string{"A:\n  B: nested\n", "A: |\n  block\n", "A: \"unterminated\n", "- item\n"} {
+		_, err := parseYAML(bad)
+		if err == nil {
+			t.Errorf("parseYAML(%q) = nil, want an error", bad)
+		}
+	}
+}
+
+func TestConfigImportExport(t *testing.T) {
+	s, _ := NewTestStore()
+	s.CreateApp("app", "dev")
+	cfg, _ := s.GetApp("app", "dev")
+	cfg.EnvSet("PLAIN", "value")
+	cfg.EnvSet("CERT", "-----BEGIN-----\nabc\n-----END-----")
+	cfg.EnvSet("QUOTES", `say "hi" it's $HOME`)
+
+	for _, format := range ImportFormats {
+		var out bytes.Buffer
+		err := ConfigExport(s, "app", "dev", format, &out)
+		if err != nil {
+			t.Fatalf("ConfigExport(%s) error: %s", format, err)
+		}
+		if strings.Contains(out.String(), "ENV") {
+			t.Errorf("ConfigExport(%s) = %q, want no ENV", format, out.String())
+		}
+
+		envVars, err := parseConfig(format, out.String())
+		if err != nil {
+			t.Fatalf("parseConfig(%s, %q) error: %s", format, out.String(), err)
+		}
+		want := []string{
+			"CERT=-----BEGIN-----\nabc\n-----END-----",
+			"PLAIN=value",
+			`QUOTES=say "hi" it's $HOME`,
+		}
+		if !reflect.DeepEqual(envVars, want) {
+			t.Errorf("parseConfig(%s) = %q, want %q", format, envVars, want)
+		}
+	}
+
+	_, err := parseConfig("xml", "")
+	if err == nil {
+		t.Errorf("parseConfig(xml) = nil, want an error")
+	}
+}
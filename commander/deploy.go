@@ -0,0 +1,132 @@
+package commander
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/registry"
+	"github.com/litl/galaxy/utils"
+)
+
+// deployPollInterval is how often WaitForDeploy checks the registrations.
+const deployPollInterval = 2 * time.Second
+
+// expectedInstances returns how many containers of app the hosts of the
+// pools it's assigned to in env should be running.
+func expectedInstances(configStore *config.Store, app, env string) (int, error) {
+	pools, err := configStore.ListPools(env)
+	if err != nil {
+		return 0, err
+	}
+
+	expected := 0
+	for _, pool := range pools {
+		assignments, err := configStore.ListAssignments(env, pool)
+		if err != nil {
+			return 0, err
+		}
+		if !utils.StringInSlice(app, assignments) {
+			continue
+		}
+
+		count, err := poolInstances(configStore, app, env, pool)
+		if err != nil {
+			return 0, err
+		}
+		expected += count
+	}
+	return expected, nil
+}
+
+// poolInstances returns how many containers of app pool's hosts should be
+// running.
+func poolInstances(configStore *config.Store, app, env, pool string) (int, error) {
+	hosts, err := configStore.ListHosts(env, pool)
+	if err != nil {
+		return 0, err
+	}
+
+	expected := 0
+	for _, h := range hosts {
+		count, err := Balanced(configStore, h.HostIP, app, env, pool)
+		if err != nil {
+			return 0, err
+		}
+		expected += count
+	}
+	return expected, nil
+}
+
+// deployCounts returns how many of app's registrations in env are running
+// deployID and how many are running anything else.  Draining ones are on
+// their way out and aren't counted, nor are canary and green ones, which
+// run alongside the deploy rather than being replaced by it.
+func deployCounts(registrations []registry.ServiceRegistration, app, deployID string) (int, int) {
+	current, old := 0, 0
+	for _, reg := range registrations {
+		if reg.Name != app || reg.External || reg.IsDraining() {
+			continue
+		}
+		if reg.Canary || reg.Color == "green" {
+			continue
+		}
+		if reg.DeployID == deployID {
+			current++
+		} else {
+			old++
+		}
+	}
+	return current, old
+}
+
+// WaitForDeploy waits for the agents to replace app's containers in env
+// with ones started by deployID, printing their progress.  It returns an
+// error if that hasn't happened within timeout, or if app's config moves
+// on to another deploy first, e.g. because an agent rolled it back.
+func WaitForDeploy(configStore *config.Store, serviceRegistry *registry.ServiceRegistry, app, env, deployID string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	status := ""
+	for {
+		svcCfg, err := configStore.GetApp(app, env)
+		if err != nil {
+			return err
+		}
+		if svcCfg == nil {
+			return fmt.Errorf("app %s was deleted.", app)
+		}
+		if svcCfg.DeployID() != deployID {
+			return fmt.Errorf("%s moved on to deploy %s, version %s, before %s was healthy.",
+				app, svcCfg.DeployID(), svcCfg.Version(), deployID)
+		}
+
+		expected, err := expectedInstances(configStore, app, env)
+		if err != nil {
+			return err
+		}
+
+		registrations, err := serviceRegistry.ListRegistrations(env)
+		if err != nil {
+			return err
+		}
+		current, old := deployCounts(registrations, app, deployID)
+
+		latest := fmt.Sprintf("%s: %d of %d containers running deploy %s, %d old", app, current, expected, deployID, old)
+		if latest != status {
+			log.Println(latest)
+			status = latest
+		}
+
+		if current >= expected && old == 0 {
+			log.Printf("Deploy %s of %s is healthy.\n", deployID, app)
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("deploy %s of %s not healthy after %s: %d of %d containers running it, %d old",
+				deployID, app, timeout, current, expected, old)
+		}
+		time.Sleep(deployPollInterval)
+	}
+}
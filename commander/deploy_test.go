@@ -0,0 +1,25 @@
+package commander
+
+import (
+	"testing"
+
+	"github.com/litl/galaxy/registry"
+)
+
+func TestDeployCounts(t *testing.T) {
+	registrations := []registry.ServiceRegistration{
+		{Name: "web", DeployID: "new"},
+		{Name: "web", DeployID: "new"},
+		{Name: "web", DeployID: "old"},
+		{Name: "web", DeployID: "old", State: registry.RegistrationDraining},
+		{Name: "web", External: true},
+		{Name: "web", DeployID: "canary", Canary: true},
+		{Name: "web", DeployID: "green", Color: "green"},
+		{Name: "api", DeployID: "new"},
+	}
+
+	current, old := deployCounts(registrations, "web", "new")
+	if current != 2 || old != 1 {
+		t.Fatalf("deployCounts() = %d, %d, want 2, 1", current, old)
+	}
+}
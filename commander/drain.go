@@ -0,0 +1,32 @@
+package commander
+
+import (
+	"time"
+
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/registry"
+)
+
+// Drain takes app's containers on hostIP out of service, giving their
+// connections grace to finish.
+func Drain(serviceRegistry *registry.ServiceRegistry, env, app, hostIP string, grace time.Duration) error {
+	drained, err := serviceRegistry.Drain(env, app, hostIP, grace)
+	if err != nil {
+		return err
+	}
+
+	if len(drained) == 0 {
+		log.Printf("No registrations for %s on %s\n", app, hostIP)
+		return nil
+	}
+
+	columns := [][]string{{"CONTAINER ID", "EXTERNAL", "GRACE ENDS"}}
+	for _, reg := range drained {
+		columns = append(columns, []string{
+			reg.ContainerID[0:12],
+			reg.ExternalAddr(),
+			reg.DrainUntil.Local().Format(time.RFC3339),
+		})
+	}
+	return PrintColumns(columns)
+}
@@ -0,0 +1,31 @@
+package commander
+
+import (
+	"fmt"
+
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/registry"
+)
+
+// RegisterExternal registers a service galaxy doesn't run, at addr, so it
+// can be discovered like an app.
+func RegisterExternal(serviceRegistry *registry.ServiceRegistry, env, pool, name, addr string) error {
+	reg, err := serviceRegistry.RegisterExternal(env, pool, name, addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Registered external service %s at %s in %s/%s\n", reg.Name, reg.ExternalAddr(), env, pool)
+	return nil
+}
+
+func UnRegisterExternal(serviceRegistry *registry.ServiceRegistry, env, pool, name, addr string) error {
+	deleted, err := serviceRegistry.UnRegisterExternal(env, pool, name, addr)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return fmt.Errorf("%s at %s is not registered in %s/%s", name, addr, env, pool)
+	}
+	log.Printf("Unregistered external service %s at %s in %s/%s\n", name, addr, env, pool)
+	return nil
+}
@@ -0,0 +1,123 @@
+package commander
+
+import (
+	"strings"
+	"time"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/registry"
+	"github.com/litl/galaxy/runtime"
+)
+
+// RegistryGC prints the orphaned keys in env and deletes them if force is
+// set.  Apps are listed from the primary so ones a replica hasn't caught up
+// on don't look deleted.
+func RegistryGC(configStore *config.Store, serviceRegistry *registry.ServiceRegistry, env string, force bool) error {
+	appCfgs, err := configStore.ListPrimaryApps(env)
+	if err != nil {
+		return err
+	}
+
+	apps := []string{}
+	for _, cfg := range appCfgs {
+		apps = append(apps, cfg.Name)
+	}
+
+	orphans, err := serviceRegistry.FindOrphans(env, apps)
+	if err != nil {
+		return err
+	}
+
+	if len(orphans) == 0 {
+		log.Printf("No orphaned keys in %s\n", env)
+		return nil
+	}
+
+	columns := [][]string{{"KEY", "REASON"}}
+	for _, orphan := range orphans {
+		columns = append(columns, []string{orphan.Key, orphan.Reason})
+	}
+	err = PrintColumns(columns)
+	if err != nil {
+		return err
+	}
+
+	if !force {
+		log.Printf("Found %d orphaned keys.  Run with --force to delete them.\n", len(orphans))
+		return nil
+	}
+
+	deleted, err := serviceRegistry.DeleteOrphans(orphans)
+	if err != nil {
+		return err
+	}
+	log.Printf("Deleted %d orphaned keys\n", deleted)
+	return nil
+}
+
+// deployedImages returns the image names and IDs the apps in env are
+// deployed with, including canaries and blue/green versions, from the
+// primary like RegistryGC.
+func deployedImages(configStore *config.Store, env string) ([]string, error) {
+	appCfgs, err := configStore.ListPrimaryApps(env)
+	if err != nil {
+		return nil, err
+	}
+
+	images := []string{}
+	for _, cfg := range appCfgs {
+		for _, img := range []string{
+			cfg.Version(), cfg.VersionID(),
+			cfg.CanaryVersion(), cfg.CanaryVersionID(),
+			cfg.GreenVersion(), cfg.GreenVersionID(),
+		} {
+			if img != "" {
+				images = append(images, img)
+			}
+		}
+	}
+	return images, nil
+}
+
+// HostGC prints the galaxy containers on this host that exited more than
+// age ago and the images no app in env is deployed with, and removes them
+// if force is set.
+func HostGC(configStore *config.Store, serviceRuntime *runtime.ServiceRuntime, env string, age time.Duration, force bool) error {
+	images, err := deployedImages(configStore, env)
+	if err != nil {
+		return err
+	}
+
+	garbage, err := serviceRuntime.FindGarbage(images, age)
+	if err != nil {
+		return err
+	}
+
+	if len(garbage.Containers) == 0 && len(garbage.Images) == 0 {
+		log.Println("Nothing to remove")
+		return nil
+	}
+
+	columns := [][]string{{"TYPE", "ID", "NAME"}}
+	for _, container := range garbage.Containers {
+		columns = append(columns, []string{"container", container.ID[0:12], strings.TrimPrefix(container.Name, "/")})
+	}
+	for _, image := range garbage.Images {
+		columns = append(columns, []string{"image", image.ID[0:12], strings.Join(image.RepoTags, ",")})
+	}
+	err = PrintColumns(columns)
+	if err != nil {
+		return err
+	}
+
+	if !force {
+		log.Printf("Found %d containers and %d images.  Run with --force to remove them.\n",
+			len(garbage.Containers), len(garbage.Images))
+		return nil
+	}
+
+	containers, removed := serviceRuntime.RemoveGarbage(garbage)
+	log.Printf("Removed %d containers and %d images\n", containers, removed)
+	return nil
+}
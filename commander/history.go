@@ -0,0 +1,99 @@
+package commander
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/litl/galaxy/config"
+)
+
+// History prints the most recent config changes to app, or to every app in
+// env if app is "".
+func History(configStore *config.Store, app, env string, limit int) error {
+	changes, err := configStore.History(env, app, limit)
+	if err != nil {
+		return err
+	}
+
+	columns := [][]string{{"TIME", "APP", "OP", "VERSION", "DEPLOY", "ACTOR", "CHANGES"}}
+	for _, change := range changes {
+		columns = append(columns, []string{
+			change.Time.Local().Format(time.RFC3339),
+			change.App,
+			change.Op,
+			fmt.Sprintf("%d -> %d", change.OldID, change.NewID),
+			change.DeployID,
+			change.Actor,
+			strings.Join(change.Changes, ", "),
+		})
+	}
+
+	return PrintColumns(columns)
+}
+
+// auditMatches returns true if change was made by someone whose actor
+// contains actor, touched a key containing key and was made after cutoff.
+// Empty filters match everything.
+func auditMatches(change *config.Change, actor, key string, cutoff time.Time) bool {
+	if actor != "" && !strings.Contains(change.Actor, actor) {
+		return false
+	}
+	if !cutoff.IsZero() && change.Time.Before(cutoff) {
+		return false
+	}
+	if key == "" {
+		return true
+	}
+	for _, c := range change.Changes {
+		// "env GALAXY_PORT: changed"
+		if strings.Contains(strings.SplitN(c, ":", 2)[0], key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Audit prints up to limit of the config changes recorded in env, one line
+// per value changed, filtered by who made them, the key they touched and
+// how long ago, see auditMatches.  since is 0 for no limit.
+func Audit(configStore *config.Store, env, actor, key string, since time.Duration, limit int) error {
+	changes, err := configStore.History(env, "", config.MaxChanges)
+	if err != nil {
+		return err
+	}
+
+	var cutoff time.Time
+	if since > 0 {
+		cutoff = time.Now().Add(-since)
+	}
+
+	columns := [][]string{{"TIME", "APP", "OP", "DEPLOY", "ACTOR", "CHANGE"}}
+	shown := 0
+	for _, change := range changes {
+		if limit > 0 && shown == limit {
+			break
+		}
+		if !auditMatches(change, actor, key, cutoff) {
+			continue
+		}
+		shown++
+
+		details := change.Changes
+		if len(details) == 0 {
+			details = []string{""}
+		}
+		for _, detail := range details {
+			columns = append(columns, []string{
+				change.Time.Local().Format(time.RFC3339),
+				change.App,
+				change.Op,
+				change.DeployID,
+				change.Actor,
+				detail,
+			})
+		}
+	}
+
+	return PrintColumns(columns)
+}
@@ -0,0 +1,38 @@
+package commander
+
+import (
+	"testing"
+	"time"
+
+	"github.com/litl/galaxy/config"
+)
+
+func TestAuditMatches(t *testing.T) {
+	now := time.Now()
+	change := &config.Change{
+		Time:    now.Add(-time.Hour),
+		Actor:   "alice@deploy1",
+		Changes: []string{"version: web:1 -> web:2", "env GALAXY_PORT: changed"},
+	}
+
+	for _, test := range []struct {
+		actor, key string
+		cutoff     time.Time
+		want       bool
+	}{
+		{"", "", time.Time{}, true},
+		{"alice", "", time.Time{}, true},
+		{"bob", "", time.Time{}, false},
+		{"", "GALAXY_PORT", time.Time{}, true},
+		{"", "version", time.Time{}, true},
+		{"", "changed", time.Time{}, false},
+		{"", "", now.Add(-2 * time.Hour), true},
+		{"", "", now, false},
+		{"alice", "GALAXY_PORT", now.Add(-2 * time.Hour), true},
+	} {
+		got := auditMatches(change, test.actor, test.key, test.cutoff)
+		if got != test.want {
+			t.Errorf("auditMatches(%q, %q, %s) = %t, want %t", test.actor, test.key, test.cutoff, got, test.want)
+		}
+	}
+}
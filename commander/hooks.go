@@ -0,0 +1,22 @@
+package commander
+
+import (
+	"os"
+	"strings"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/runtime"
+)
+
+// deployHook runs appCfg's hook in the env var key, GALAXY_PRE_DEPLOY or
+// GALAXY_POST_DEPLOY, if it has one.
+func deployHook(serviceRuntime *runtime.ServiceRuntime, env string, appCfg *config.AppConfig, key string) error {
+	hook := strings.TrimSpace(appCfg.Env()[key])
+	if hook == "" {
+		return nil
+	}
+
+	log.Printf("Running %s for %s: %s\n", key, appCfg.Version(), hook)
+	return serviceRuntime.RunHook(env, appCfg, hook, os.Stdout, os.Stderr)
+}
@@ -1,11 +1,10 @@
 package commander
 
 import (
-	"strings"
+	"fmt"
+	"strconv"
 
 	"github.com/litl/galaxy/config"
-	"github.com/litl/galaxy/log"
-	"github.com/ryanuber/columnize"
 )
 
 func HostsList(configStore *config.Store, env, pool string) error {
@@ -20,7 +19,7 @@ func HostsList(configStore *config.Store, env, pool string) error {
 		}
 	}
 
-	columns := []string{"ENV | POOL | HOST IP "}
+	columns := [][]string{{"ENV", "POOL", "HOST IP", "CPUS", "MEMORY", "CONTAINERS", "VERSION", "DOCKER", "CONFLICTS", "LABELS"}}
 
 	for _, env := range envs {
 
@@ -41,24 +40,47 @@ func HostsList(configStore *config.Store, env, pool string) error {
 			}
 
 			if len(hosts) == 0 {
-				columns = append(columns, strings.Join([]string{
+				columns = append(columns, []string{
 					env,
 					pool,
-					"",
-				}, " | "))
+					"", "", "", "", "", "", "", "",
+				})
 				continue
 			}
 			for _, p := range hosts {
-				columns = append(columns, strings.Join([]string{
+				columns = append(columns, []string{
 					env,
 					pool,
 					p.HostIP,
-				}, " | "))
+					strconv.Itoa(p.CPUs),
+					memoryString(p.Memory),
+					strconv.Itoa(p.Containers),
+					p.Version,
+					dockerString(p.DockerVersion, p.DockerAPIVersion),
+					strconv.Itoa(p.Conflicts),
+					p.Labels,
+				})
 			}
 		}
 	}
-	output, _ := columnize.SimpleFormat(columns)
-	log.Println(output)
-	return nil
+	return PrintColumns(columns)
 
 }
+
+// memoryString formats bytes in GB, or "" for hosts that didn't report
+// their memory.
+func memoryString(bytes int64) string {
+	if bytes <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%.1fG", float64(bytes)/(1<<30))
+}
+
+// dockerString formats a host's docker and API versions, e.g.
+// "1.9.1 (API 1.21)", or "" for hosts that didn't report them.
+func dockerString(version, apiVersion string) string {
+	if apiVersion == "" {
+		return version
+	}
+	return fmt.Sprintf("%s (API %s)", version, apiVersion)
+}
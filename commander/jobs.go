@@ -0,0 +1,249 @@
+package commander
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/registry"
+	"github.com/litl/galaxy/runtime"
+	"github.com/litl/galaxy/utils"
+)
+
+// JobLockTTL is how long a running job's lock lasts without being
+// refreshed.  Another host can run the job once it's expired.
+const JobLockTTL = 2 * time.Minute
+
+// JobsList lists the jobs of app, or every app in env if it's "", and how
+// their last runs went.
+func JobsList(configStore *config.Store, serviceRegistry *registry.ServiceRegistry, env, app string) error {
+	appCfgs, err := configStore.ListApps(env)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	columns := [][]string{{"APP", "JOB", "SCHEDULE", "COMMAND", "LAST RUN", "HOST", "STATUS", "NEXT RUN"}}
+	for _, appCfg := range appCfgs {
+		if app != "" && appCfg.Name != app {
+			continue
+		}
+
+		for _, job := range appCfg.Jobs() {
+			run, err := serviceRegistry.GetJobRun(env, appCfg.Name, job.Name)
+			if err != nil {
+				return err
+			}
+
+			lastRun, status := "", ""
+			switch {
+			case run.Started.IsZero():
+			case run.Finished.IsZero():
+				lastRun = utils.HumanDuration(now.Sub(run.Started)) + " ago"
+				status = "running"
+			default:
+				lastRun = utils.HumanDuration(now.Sub(run.Started)) + " ago"
+				status = "ok"
+				if run.Error != "" {
+					status = "failed: " + run.Error
+				}
+			}
+
+			nextRun := ""
+			schedule, err := utils.ParseSchedule(job.Schedule)
+			if err == nil {
+				if next := schedule.Next(now); !next.IsZero() {
+					nextRun = "in " + utils.HumanDuration(next.Sub(now))
+				}
+			}
+
+			columns = append(columns, []string{
+				appCfg.Name,
+				job.Name,
+				job.Schedule,
+				job.Command,
+				lastRun,
+				run.Host,
+				status,
+				nextRun,
+			})
+		}
+	}
+	return PrintColumns(columns)
+}
+
+// JobSet adds or replaces one of app's jobs.
+func JobSet(configStore *config.Store, app, env string, job config.JobConfig) error {
+	appCfg, err := configStore.GetApp(app, env)
+	if err != nil {
+		return err
+	}
+
+	if appCfg == nil {
+		return fmt.Errorf("app %s does not exist. Create it first.", app)
+	}
+
+	err = appCfg.SetJob(job)
+	if err != nil {
+		return err
+	}
+
+	updated, err := configStore.UpdateApp(appCfg, env)
+	if err != nil {
+		return err
+	}
+	if updated {
+		log.Printf("Set job %s for %s.\n", job.Name, app)
+	}
+	return nil
+}
+
+// JobUnset removes one of app's jobs and its run history.
+func JobUnset(configStore *config.Store, serviceRegistry *registry.ServiceRegistry, app, env, name string) error {
+	appCfg, err := configStore.GetApp(app, env)
+	if err != nil {
+		return err
+	}
+
+	if appCfg == nil {
+		return fmt.Errorf("app %s does not exist.", app)
+	}
+
+	found := false
+	for _, job := range appCfg.Jobs() {
+		found = found || job.Name == name
+	}
+	if !found {
+		return fmt.Errorf("%s has no job %s", app, name)
+	}
+
+	appCfg.RemoveJob(name)
+	_, err = configStore.UpdateApp(appCfg, env)
+	if err != nil {
+		return err
+	}
+
+	err = serviceRegistry.DeleteJob(env, app, name)
+	if err != nil {
+		return err
+	}
+	log.Printf("Removed job %s from %s.\n", name, app)
+	return nil
+}
+
+// RunJobs starts the jobs of the apps assigned to pool that are scheduled
+// for the minute at.  Each scheduled run is claimed in the registry so
+// only one host runs it, and a job that's still running from an earlier
+// run is skipped.
+func RunJobs(configStore *config.Store, serviceRegistry *registry.ServiceRegistry, serviceRuntime *runtime.ServiceRuntime,
+	env, pool, hostIP string, at time.Time) error {
+
+	apps, err := configStore.ListAssignments(env, pool)
+	if err != nil {
+		return err
+	}
+
+	for _, app := range apps {
+		appCfg, err := configStore.GetApp(app, env)
+		if err != nil {
+			return err
+		}
+		if appCfg == nil || appCfg.Version() == "" {
+			continue
+		}
+
+		for _, job := range appCfg.Jobs() {
+			schedule, err := utils.ParseSchedule(job.Schedule)
+			if err != nil {
+				log.Errorf("ERROR: Invalid schedule for %s job %s: %s", app, job.Name, err)
+				continue
+			}
+			if !schedule.Matches(at) {
+				continue
+			}
+
+			claimed, err := serviceRegistry.ClaimJobRun(env, app, job.Name, at)
+			if err != nil {
+				log.Errorf("ERROR: Unable to claim %s job %s: %s", app, job.Name, err)
+				continue
+			}
+			if !claimed {
+				continue
+			}
+
+			go runJob(serviceRegistry, serviceRuntime, env, hostIP, appCfg, job, at)
+		}
+	}
+	return nil
+}
+
+func runJob(serviceRegistry *registry.ServiceRegistry, serviceRuntime *runtime.ServiceRuntime,
+	env, hostIP string, appCfg *config.AppConfig, job config.JobConfig, at time.Time) {
+
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s:%s:%d", hostIP, hostname, time.Now().UnixNano())
+	ttl := uint64(JobLockTTL / time.Second)
+
+	holder, err := serviceRegistry.LockJob(env, appCfg.Name, job.Name, owner, ttl)
+	if err != nil {
+		log.Errorf("ERROR: Unable to lock %s job %s: %s", appCfg.Name, job.Name, err)
+		return
+	}
+	if holder != "" {
+		log.Warnf("WARN: Skipping %s job %s, it's still running (%s)", appCfg.Name, job.Name, holder)
+		return
+	}
+	defer serviceRegistry.UnlockJob(env, appCfg.Name, job.Name, owner)
+
+	// keep the lock for as long as it runs
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(JobLockTTL / 3):
+				_, err := serviceRegistry.LockJob(env, appCfg.Name, job.Name, owner, ttl)
+				if err != nil {
+					log.Errorf("ERROR: Unable to refresh the lock on %s job %s: %s", appCfg.Name, job.Name, err)
+				}
+			}
+		}
+	}()
+
+	run := registry.JobRun{
+		Scheduled: at,
+		Started:   time.Now(),
+		Host:      hostIP,
+	}
+	err = serviceRegistry.SetJobRun(env, appCfg.Name, job.Name, run)
+	if err != nil {
+		log.Errorf("ERROR: Unable to record %s job %s: %s", appCfg.Name, job.Name, err)
+	}
+
+	log.Printf("Running %s job %s: %s", appCfg.Name, job.Name, job.Command)
+	var out bytes.Buffer
+	_, err = serviceRuntime.PullImage(appCfg.Version(), appCfg.VersionID())
+	if err == nil {
+		err = serviceRuntime.RunHook(env, appCfg, job.Command, &out, &out)
+	}
+
+	run.Finished = time.Now()
+	if err != nil {
+		run.Error = err.Error()
+		log.Errorf("ERROR: %s job %s failed after %s: %s\n%s", appCfg.Name, job.Name,
+			run.Finished.Sub(run.Started), err, strings.TrimSpace(out.String()))
+	} else {
+		log.Printf("Finished %s job %s in %s", appCfg.Name, job.Name, run.Finished.Sub(run.Started))
+	}
+
+	err = serviceRegistry.SetJobRun(env, appCfg.Name, job.Name, run)
+	if err != nil {
+		log.Errorf("ERROR: Unable to record %s job %s: %s", appCfg.Name, job.Name, err)
+	}
+}
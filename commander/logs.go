@@ -0,0 +1,114 @@
+package commander
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/registry"
+	"github.com/litl/galaxy/runtime"
+)
+
+// prefixWriter writes each line written to it to w with prefix, holding
+// back partial lines until they're finished so lines from several
+// containers don't get mixed up.  mu is shared by the writers of the same
+// output.
+type prefixWriter struct {
+	w      io.Writer
+	prefix []byte
+	mu     *sync.Mutex
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		if err := p.writeLine(p.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[i+1:]
+	}
+}
+
+// Flush writes what's left of an unfinished line.
+func (p *prefixWriter) Flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	err := p.writeLine(append(p.buf, '\n'))
+	p.buf = nil
+	return err
+}
+
+func (p *prefixWriter) writeLine(line []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := p.w.Write(append(append([]byte{}, p.prefix...), line...))
+	return err
+}
+
+// AppLogs writes the logs of each of app's registered containers in env,
+// prefixed by host and container, read from the docker daemon listening on
+// dockerPort on each host with dockerConfig's TLS settings.  tail and
+// follow are as for docker logs.
+func AppLogs(serviceRegistry *registry.ServiceRegistry, dockerConfig runtime.DockerConfig, dockerPort, env, app, tail string, follow bool) error {
+	registrations, err := serviceRegistry.ListRegistrations(env)
+	if err != nil {
+		return err
+	}
+
+	var outMu, errMu sync.Mutex
+	var wg sync.WaitGroup
+	var failedMu sync.Mutex
+	failed, total := 0, 0
+	for _, reg := range registrations {
+		if reg.Name != app || reg.External || reg.ContainerID == "" {
+			continue
+		}
+		total++
+
+		_, host := regLocation(reg)
+		container := reg.ContainerID
+		if len(container) > 12 {
+			container = container[0:12]
+		}
+		prefix := []byte(fmt.Sprintf("%s %s | ", host, container))
+
+		cfg := dockerConfig
+		cfg.Host = "tcp://" + net.JoinHostPort(host, dockerPort)
+
+		wg.Add(1)
+		go func(id, container string) {
+			defer wg.Done()
+			stdout := &prefixWriter{w: os.Stdout, prefix: prefix, mu: &outMu}
+			stderr := &prefixWriter{w: os.Stderr, prefix: prefix, mu: &errMu}
+
+			err := cfg.ContainerLogs(id, tail, follow, stdout, stderr)
+			stdout.Flush()
+			stderr.Flush()
+			if err != nil {
+				log.Errorf("ERROR: Unable to read logs of %s on %s: %s", container, host, err)
+				failedMu.Lock()
+				failed++
+				failedMu.Unlock()
+			}
+		}(reg.ContainerID, container)
+	}
+	wg.Wait()
+
+	if total == 0 {
+		return fmt.Errorf("%s has no registered containers in %s.", app, env)
+	}
+	if failed > 0 {
+		return fmt.Errorf("unable to read the logs of %d of %d containers", failed, total)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package commander
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	var out bytes.Buffer
+	var mu sync.Mutex
+	w := &prefixWriter{w: &out, prefix: []byte("10.0.1.5 3f4e2a1b9c0d | "), mu: &mu}
+
+	w.Write([]byte("first line\nsec"))
+	w.Write([]byte("ond line\nunfinished"))
+	if want := "10.0.1.5 3f4e2a1b9c0d | first line\n10.0.1.5 3f4e2a1b9c0d | second line\n"; out.String() != want {
+		t.Fatalf("got %q, want %q", out.String(), want)
+	}
+
+	w.Flush()
+	if want := "10.0.1.5 3f4e2a1b9c0d | unfinished\n"; !bytes.HasSuffix(out.Bytes(), []byte(want)) {
+		t.Fatalf("got %q after Flush, want it to end with %q", out.String(), want)
+	}
+}
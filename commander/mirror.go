@@ -0,0 +1,34 @@
+package commander
+
+import (
+	"fmt"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/registry"
+)
+
+// MirrorVerify prints the differences between the primary and mirror
+// backends for env and fails if there are any.
+func MirrorVerify(configStore *config.Store, serviceRegistry *registry.ServiceRegistry, env string) error {
+	diffs, err := configStore.VerifyMirror(env)
+	if err != nil {
+		return err
+	}
+
+	regDiffs, err := serviceRegistry.VerifyMirror(env)
+	if err != nil {
+		return err
+	}
+	diffs = append(diffs, regDiffs...)
+
+	for _, diff := range diffs {
+		log.Println(diff)
+	}
+
+	if len(diffs) > 0 {
+		return fmt.Errorf("mirror has %d differences", len(diffs))
+	}
+	log.Printf("Mirror is consistent for %s\n", env)
+	return nil
+}
@@ -0,0 +1,307 @@
+package commander
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/utils"
+	"github.com/ryanuber/columnize"
+)
+
+// OutputFormats are the formats listings can be printed in: columnized
+// text, a JSON array of objects keyed by the column names, e.g. host_ip, or
+// CSV with a header row.
+var OutputFormats = []string{"table", "json", "csv"}
+
+// output is the format listings are printed in.
+var output = "table"
+
+// filter is the row of a listing whose column matches a glob pattern.
+type filter struct {
+	column, pattern string
+}
+
+// filters are the rows listings are limited to and sortBy the column
+// they're sorted by, descending if it starts with a -.
+var (
+	filters []filter
+	sortBy  string
+)
+
+// columnName returns a listing's column name as it's given to the
+// filters, sort and JSON output: lower case with underscores, e.g. host_ip.
+func columnName(header string) string {
+	return strings.Replace(strings.ToLower(strings.TrimSpace(header)), " ", "_", -1)
+}
+
+// SetFilters limits listings to the rows matching every one of
+// column=pattern, where pattern is a glob, e.g. name=web* or pool=prod-web.
+func SetFilters(specs []string) error {
+	filters = nil
+	for _, spec := range specs {
+		sep := strings.Index(spec, "=")
+		if sep <= 0 {
+			return fmt.Errorf("bad filter %s, use column=pattern", spec)
+		}
+		f := filter{column: columnName(spec[:sep]), pattern: spec[sep+1:]}
+		if _, err := path.Match(f.pattern, ""); err != nil {
+			return fmt.Errorf("bad filter pattern %s: %s", f.pattern, err)
+		}
+		filters = append(filters, f)
+	}
+	return nil
+}
+
+// SetSort sorts listings by column, e.g. mem, name or ps, descending if it
+// starts with a -.  Sizes and numbers are sorted by value.
+func SetSort(column string) {
+	sortBy = column
+}
+
+// SetOutput sets the format listings are printed in to one of
+// OutputFormats.
+func SetOutput(format string) error {
+	for _, f := range OutputFormats {
+		if f == format {
+			output = format
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown output format %s, use one of %s", format, strings.Join(OutputFormats, ", "))
+}
+
+// sortRows sorts rows by their cells, in order.
+func sortRows(rows [][]string) {
+	sort.Sort(rowsByCells(rows))
+}
+
+type rowsByCells [][]string
+
+func (r rowsByCells) Len() int      { return len(r) }
+func (r rowsByCells) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r rowsByCells) Less(i, j int) bool {
+	for k := 0; k < len(r[i]) && k < len(r[j]); k++ {
+		if r[i][k] != r[j][k] {
+			return r[i][k] < r[j][k]
+		}
+	}
+	return len(r[i]) < len(r[j])
+}
+
+// rowsBy sorts a listing's rows by the cells of a column.
+type rowsBy struct {
+	rows   [][]string
+	column int
+	desc   bool
+}
+
+func (r rowsBy) Len() int      { return len(r.rows) }
+func (r rowsBy) Swap(i, j int) { r.rows[i], r.rows[j] = r.rows[j], r.rows[i] }
+func (r rowsBy) Less(i, j int) bool {
+	a, b := r.rows[i][r.column], r.rows[j][r.column]
+	if r.desc {
+		a, b = b, a
+	}
+
+	// sizes like 512m and plain numbers by value
+	x, errA := utils.ParseMemory(a)
+	y, errB := utils.ParseMemory(b)
+	if errA == nil && errB == nil && x != y {
+		return x < y
+	}
+	return a < b
+}
+
+// columnIndex returns the index of each of the column names in columns'
+// header row.
+func columnIndex(columns [][]string) map[string]int {
+	index := make(map[string]int)
+	if len(columns) > 0 {
+		for i, name := range columns[0] {
+			index[columnName(name)] = i
+		}
+	}
+	return index
+}
+
+// checkColumns returns an error if none of listings have a column the
+// filters or sort name.
+func checkColumns(listings ...[][]string) error {
+	has := func(column string) bool {
+		for _, columns := range listings {
+			if _, ok := columnIndex(columns)[column]; ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, f := range filters {
+		if !has(f.column) {
+			return fmt.Errorf("can't filter on %s, the listing has no such column", f.column)
+		}
+	}
+	if sortBy != "" {
+		column := columnName(strings.TrimPrefix(sortBy, "-"))
+		if !has(column) {
+			return fmt.Errorf("can't sort by %s, the listing has no such column", column)
+		}
+	}
+	return nil
+}
+
+// filterRows returns the rows of columns after its header row matching
+// the filters, sorted by sortBy.  Filters and sorts on columns it doesn't
+// have are ignored.
+func filterRows(columns [][]string) [][]string {
+	if len(columns) == 0 || len(filters) == 0 && sortBy == "" {
+		return columns
+	}
+
+	index := columnIndex(columns)
+	cell := func(row []string, column int) string {
+		if column < len(row) {
+			return row[column]
+		}
+		return ""
+	}
+
+	rows := [][]string{}
+	for _, row := range columns[1:] {
+		matched := true
+		for _, f := range filters {
+			i, ok := index[f.column]
+			if !ok {
+				continue
+			}
+			if ok, _ := path.Match(f.pattern, cell(row, i)); !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			rows = append(rows, row)
+		}
+	}
+
+	column, desc := columnName(strings.TrimPrefix(sortBy, "-")), strings.HasPrefix(sortBy, "-")
+	if i, ok := index[column]; sortBy != "" && ok {
+		for j := range rows {
+			if len(rows[j]) <= i {
+				padded := make([]string, i+1)
+				copy(padded, rows[j])
+				rows[j] = padded
+			}
+		}
+		sort.Stable(rowsBy{rows: rows, column: i, desc: desc})
+	}
+
+	return append([][]string{columns[0]}, rows...)
+}
+
+// selectRows returns the rows of columns after its header row matching
+// the filters, sorted by sortBy.  It's an error if the listing doesn't
+// have a column they name.
+func selectRows(columns [][]string) ([][]string, error) {
+	err := checkColumns(columns)
+	if err != nil {
+		return nil, err
+	}
+	return filterRows(columns), nil
+}
+
+// selectListings is selectRows for commands that print more than one
+// listing.  The filters and sort only apply to the listings with their
+// column, and it's an error if none of them have it.
+func selectListings(listings ...[][]string) ([][][]string, error) {
+	err := checkColumns(listings...)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := [][][]string{}
+	for _, columns := range listings {
+		selected = append(selected, filterRows(columns))
+	}
+	return selected, nil
+}
+
+// tableRows returns a map of column name to value for each of the rows
+// after columns' header row.
+func tableRows(columns [][]string) []map[string]string {
+	rows := []map[string]string{}
+	if len(columns) == 0 {
+		return rows
+	}
+
+	header := columns[0]
+	for _, row := range columns[1:] {
+		values := make(map[string]string)
+		for i, cell := range row {
+			if i < len(header) && header[i] != "" {
+				values[columnName(header[i])] = cell
+			}
+		}
+		rows = append(rows, values)
+	}
+	return rows
+}
+
+// cellDelim separates the cells of a row given to columnize.  Unlike its
+// default |, it won't turn up in a cell.
+const cellDelim = "\x1f"
+
+// formatTable returns columns aligned in a text table.
+func formatTable(columns [][]string) string {
+	lines := []string{}
+	for _, row := range columns {
+		lines = append(lines, strings.Join(row, cellDelim))
+	}
+	out, _ := columnize.Format(lines, &columnize.Config{Delim: cellDelim, Glue: "  "})
+	return out
+}
+
+// writeColumns writes columns, a header row and rows of cells, to w as
+// JSON or CSV.
+func writeColumns(w io.Writer, format string, columns [][]string) error {
+	switch format {
+	case "json":
+		return json.NewEncoder(w).Encode(tableRows(columns))
+	case "csv":
+		cw := csv.NewWriter(w)
+		err := cw.WriteAll(columns)
+		if err != nil {
+			return err
+		}
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown output format %s", format)
+}
+
+// PrintColumns prints a listing, a header row and rows of cells, in the
+// output format, limited to the filters and sorted.  Tables go to the log
+// like the rest of the output, JSON and CSV to stdout.
+func PrintColumns(columns [][]string) error {
+	columns, err := selectRows(columns)
+	if err != nil {
+		return err
+	}
+	return printRows(columns)
+}
+
+// printRows prints a listing that's already been limited to the filters
+// and sorted.
+func printRows(columns [][]string) error {
+	if output == "table" {
+		log.Println(formatTable(columns))
+		return nil
+	}
+	return writeColumns(os.Stdout, output, columns)
+}
@@ -0,0 +1,151 @@
+package commander
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestWriteColumns(t *testing.T) {
+	columns := [][]string{
+		{"NAME", "HOST IP", "POOLS", "CMD"},
+		{"web", "10.0.0.1", "web,worker", "sort | uniq"},
+		{"api", "10.0.0.2", "", ""},
+	}
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"json", `[{"cmd":"sort | uniq","host_ip":"10.0.0.1","name":"web","pools":"web,worker"},{"cmd":"","host_ip":"10.0.0.2","name":"api","pools":""}]` + "\n"},
+		{"csv", "NAME,HOST IP,POOLS,CMD\nweb,10.0.0.1,\"web,worker\",sort | uniq\napi,10.0.0.2,,\n"},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		err := writeColumns(&out, test.format, columns)
+		if err != nil {
+			t.Errorf("writeColumns(%s) error: %s", test.format, err)
+			continue
+		}
+		if out.String() != test.want {
+			t.Errorf("writeColumns(%s) = %q, want %q", test.format, out.String(), test.want)
+		}
+	}
+}
+
+func TestFormatTable(t *testing.T) {
+	out := formatTable([][]string{
+		{"NAME", "CMD"},
+		{"web", "sort | uniq"},
+		{"api", ""},
+	})
+
+	want := "NAME  CMD\nweb   sort | uniq\napi"
+	if out != want {
+		t.Errorf("formatTable() = %q, want %q", out, want)
+	}
+}
+
+func TestSetOutput(t *testing.T) {
+	defer SetOutput("table")
+
+	if err := SetOutput("json"); err != nil || output != "json" {
+		t.Errorf("SetOutput(json) = %v, output %s", err, output)
+	}
+	if err := SetOutput("xml"); err == nil || output != "json" {
+		t.Errorf("SetOutput(xml) = %v, output %s, want an error and no change", err, output)
+	}
+}
+
+func TestSelectRows(t *testing.T) {
+	defer SetFilters(nil)
+	defer SetSort("")
+
+	columns := [][]string{
+		{"ENV", "NAME", "POOL", "PS", "MEM"},
+		{"prod", "web", "prod-web", "2", "1g"},
+		{"prod", "web-admin", "prod-web", "1", "512m"},
+		{"prod", "worker", "prod-worker", "4", "2g"},
+		{"prod", "api", "prod-web", "10", ""},
+	}
+
+	tests := []struct {
+		filters []string
+		sort    string
+		want    [][]string
+	}{
+		{nil, "", columns},
+		{[]string{"name=web*"}, "", [][]string{columns[0], columns[1], columns[2]}},
+		{[]string{"name=web*", "pool=prod-web"}, "mem", [][]string{columns[0], columns[2], columns[1]}},
+		{[]string{"pool=prod-web"}, "-ps", [][]string{columns[0], columns[4], columns[1], columns[2]}},
+		{nil, "mem", [][]string{columns[0], columns[4], columns[2], columns[1], columns[3]}},
+		{nil, "name", [][]string{columns[0], columns[4], columns[1], columns[2], columns[3]}},
+	}
+	for _, test := range tests {
+		if err := SetFilters(test.filters); err != nil {
+			t.Fatalf("SetFilters(%v) error: %s", test.filters, err)
+		}
+		SetSort(test.sort)
+
+		rows, err := selectRows(columns)
+		if err != nil {
+			t.Errorf("selectRows(%v, %s) error: %s", test.filters, test.sort, err)
+			continue
+		}
+		if !reflect.DeepEqual(rows, test.want) {
+			t.Errorf("selectRows(%v, %s) = %q, want %q", test.filters, test.sort, rows, test.want)
+		}
+	}
+
+	SetFilters([]string{"host=10.*"})
+	SetSort("")
+	if _, err := selectRows(columns); err == nil {
+		t.Errorf("selectRows() with a filter on a missing column = nil, want an error")
+	}
+	if err := SetFilters([]string{"web*"}); err == nil {
+		t.Errorf("SetFilters(web*) = nil, want an error")
+	}
+}
+
+func TestSelectListings(t *testing.T) {
+	defer SetFilters(nil)
+	defer SetSort("")
+
+	apps := [][]string{
+		{"NAME", "POOL", "DESIRED"},
+		{"web", "web", "2"},
+		{"api", "web", "1"},
+	}
+	containers := [][]string{
+		{"NAME", "POOL", "CONTAINER", "STATE"},
+		{"web", "web", "aaa", ""},
+		{"web", "web", "bbb", "draining"},
+		{"api", "web", "ccc", ""},
+	}
+
+	// state is only in the containers listing
+	SetFilters([]string{"state=draining"})
+	SetSort("-name")
+	listings, err := selectListings(apps, containers)
+	if err != nil {
+		t.Fatalf("selectListings() error: %s", err)
+	}
+	want := [][][]string{
+		{apps[0], apps[1], apps[2]},
+		{containers[0], containers[2]},
+	}
+	if !reflect.DeepEqual(listings, want) {
+		t.Errorf("selectListings() = %q, want %q", listings, want)
+	}
+
+	// but one of the listings has to have the column
+	SetFilters([]string{"host=10.*"})
+	if _, err := selectListings(apps, containers); err == nil {
+		t.Errorf("selectListings() with a filter on a missing column = nil, want an error")
+	}
+	SetFilters(nil)
+	SetSort("mem")
+	if _, err := selectListings(apps, containers); err == nil {
+		t.Errorf("selectListings() sorted by a missing column = nil, want an error")
+	}
+}
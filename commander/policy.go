@@ -0,0 +1,90 @@
+package commander
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/registry"
+)
+
+// PolicyShow prints the policy hosts in env enforce.
+func PolicyShow(serviceRegistry *registry.ServiceRegistry, env string) error {
+	policy, err := serviceRegistry.GetImagePolicy(env)
+	if err != nil {
+		return err
+	}
+
+	registries := "any"
+	if len(policy.Registries) > 0 {
+		registries = strings.Join(policy.Registries, ", ")
+	}
+	verify := "none"
+	if policy.Verify != "" {
+		verify = policy.Verify
+	}
+
+	log.Printf("Registries: %s\n", registries)
+	log.Printf("Signatures: %s\n", verify)
+	if policy.Key != "" {
+		log.Printf("Key: %s\n", policy.Key)
+	}
+
+	privileged := "none"
+	if len(policy.Privileged) > 0 {
+		privileged = strings.Join(policy.Privileged, ", ")
+	}
+	log.Printf("Privileged apps: %s\n", privileged)
+	return nil
+}
+
+// PolicySet updates env's image policy with the fields set in update.
+// Empty fields keep their current value, so setting the privileged apps
+// doesn't drop the registries and the other way around.
+func PolicySet(serviceRegistry *registry.ServiceRegistry, env string, update registry.ImagePolicy) error {
+	policy, err := serviceRegistry.GetImagePolicy(env)
+	if err != nil {
+		return err
+	}
+
+	if len(update.Registries) > 0 {
+		policy.Registries = update.Registries
+	}
+	if update.Verify != "" {
+		policy.Verify = update.Verify
+	}
+	if update.Key != "" {
+		policy.Key = update.Key
+	}
+	if len(update.Privileged) > 0 {
+		policy.Privileged = update.Privileged
+	}
+
+	switch policy.Verify {
+	case "", "cosign", "notary":
+	default:
+		return fmt.Errorf("unknown signature verification %q, use cosign or notary", policy.Verify)
+	}
+
+	if policy.Verify == "" && policy.Key != "" {
+		return fmt.Errorf("a key needs a signature verification")
+	}
+
+	err = serviceRegistry.SetImagePolicy(env, policy)
+	if err != nil {
+		return err
+	}
+	log.Printf("Set the image policy for %s.\n", env)
+	return nil
+}
+
+// PolicyClear lets hosts in env run any image, and no privileged
+// containers.
+func PolicyClear(serviceRegistry *registry.ServiceRegistry, env string) error {
+	err := serviceRegistry.SetImagePolicy(env, registry.ImagePolicy{})
+	if err != nil {
+		return err
+	}
+	log.Printf("Cleared the image policy for %s.\n", env)
+	return nil
+}
@@ -0,0 +1,170 @@
+package commander
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReconcileReport records what a single reconcile pass of the agent did.
+// All methods are safe to call on a nil report, which records nothing.
+type ReconcileReport struct {
+	Env        string        `json:"env"`
+	Pool       string        `json:"pool"`
+	Host       string        `json:"host"`
+	Trigger    string        `json:"trigger"`
+	StartedAt  time.Time     `json:"started_at"`
+	DurationMs int64         `json:"duration_ms"`
+	Checked    int           `json:"apps_checked"`
+	Started    int           `json:"containers_started"`
+	Stopped    int           `json:"containers_stopped"`
+	Errors     int           `json:"errors"`
+	Apps       AppReportList `json:"apps"`
+
+	mu   sync.Mutex
+	apps map[string]*AppReport
+}
+
+// AppReport is the part of a ReconcileReport for a single app.
+type AppReport struct {
+	Name    string   `json:"name"`
+	Version string   `json:"version,omitempty"`
+	Desired int      `json:"desired"`
+	Running int      `json:"running"`
+	Started []string `json:"started,omitempty"`
+	Stopped []string `json:"stopped,omitempty"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+type AppReportList []*AppReport
+
+func (l AppReportList) Len() int           { return len(l) }
+func (l AppReportList) Less(i, j int) bool { return l[i].Name < l[j].Name }
+func (l AppReportList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+func NewReconcileReport(env, pool, host, trigger string) *ReconcileReport {
+	return &ReconcileReport{
+		Env:       env,
+		Pool:      pool,
+		Host:      host,
+		Trigger:   trigger,
+		StartedAt: time.Now().UTC(),
+		Apps:      AppReportList{},
+		apps:      make(map[string]*AppReport),
+	}
+}
+
+func (r *ReconcileReport) app(name string) *AppReport {
+	a, ok := r.apps[name]
+	if !ok {
+		a = &AppReport{Name: name}
+		r.apps[name] = a
+	}
+	return a
+}
+
+// Check records that app was reconciled with the desired and running
+// instance counts.
+func (r *ReconcileReport) Check(app, version string, desired, running int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	a := r.app(app)
+	a.Version = version
+	a.Desired = desired
+	a.Running = running
+}
+
+func (r *ReconcileReport) ContainerStarted(app, id string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	a := r.app(app)
+	a.Started = append(a.Started, id)
+}
+
+func (r *ReconcileReport) ContainerStopped(app, id string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	a := r.app(app)
+	a.Stopped = append(a.Stopped, id)
+}
+
+func (r *ReconcileReport) Error(app string, err error) {
+	if r == nil || err == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	a := r.app(app)
+	a.Errors = append(a.Errors, err.Error())
+}
+
+// Finish stops the clock and computes the totals.
+func (r *ReconcileReport) Finish() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.DurationMs = int64(time.Since(r.StartedAt) / time.Millisecond)
+	r.Apps = AppReportList{}
+	r.Checked, r.Started, r.Stopped, r.Errors = 0, 0, 0, 0
+	for _, a := range r.apps {
+		r.Apps = append(r.Apps, a)
+		r.Checked += 1
+		r.Started += len(a.Started)
+		r.Stopped += len(a.Stopped)
+		r.Errors += len(a.Errors)
+	}
+	sort.Sort(r.Apps)
+}
+
+func (r *ReconcileReport) String() string {
+	return fmt.Sprintf("%s reconcile of %d apps in %dms: %d started, %d stopped, %d errors",
+		r.Trigger, r.Checked, r.DurationMs, r.Started, r.Stopped, r.Errors)
+}
+
+// WriteFile atomically replaces path with the JSON encoded report.
+func (r *ReconcileReport) WriteFile(path string) error {
+	r.mu.Lock()
+	data, err := json.MarshalIndent(r, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(append(data, '\n'))
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,70 @@
+package commander
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReconcileReport(t *testing.T) {
+	r := NewReconcileReport("dev", "web", "10.0.0.1", "interval")
+	r.Check("b", "b:1", 2, 1)
+	r.ContainerStarted("b", "123456789012")
+	r.Check("a", "a:1", 1, 1)
+	r.Error("a", errors.New("pull failed"))
+	r.Error("a", nil)
+	r.Finish()
+
+	if r.Checked != 2 || r.Started != 1 || r.Stopped != 0 || r.Errors != 1 {
+		t.Fatalf("report totals = %d checked, %d started, %d stopped, %d errors, want 2, 1, 0, 1",
+			r.Checked, r.Started, r.Stopped, r.Errors)
+	}
+
+	if r.Apps[0].Name != "a" || r.Apps[1].Name != "b" {
+		t.Fatalf("Expected apps sorted by name. Got %s, %s", r.Apps[0].Name, r.Apps[1].Name)
+	}
+
+	if r.Apps[1].Desired != 2 || r.Apps[1].Running != 1 {
+		t.Fatalf("Expected b desired 2, running 1. Got %d, %d", r.Apps[1].Desired, r.Apps[1].Running)
+	}
+
+	// a nil report records nothing
+	var nilReport *ReconcileReport
+	nilReport.Check("a", "a:1", 1, 1)
+	nilReport.Error("a", errors.New("ignored"))
+	nilReport.Finish()
+}
+
+func TestReconcileReportWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galaxy-report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := NewReconcileReport("dev", "web", "10.0.0.1", "deploy")
+	r.ContainerStopped("app", "app:1")
+	r.Finish()
+
+	path := filepath.Join(dir, "report.json")
+	if err := r.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded["trigger"] != "deploy" || decoded["containers_stopped"] != float64(1) {
+		t.Fatalf("Unexpected report %s", data)
+	}
+}
@@ -0,0 +1,88 @@
+package commander
+
+import (
+	"fmt"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/runtime"
+)
+
+// previousVersion returns the newest change in app's history that deployed
+// a version other than failed, or nil if there isn't one.  Versions that
+// were rolled back from since are skipped too, so two bad versions aren't
+// rolled back to each other.
+func previousVersion(configStore *config.Store, app, env, failed string) (*config.Change, error) {
+	changes, err := configStore.History(env, app, config.MaxChanges)
+	if err != nil {
+		return nil, err
+	}
+
+	skip := map[string]bool{failed: true}
+	for _, change := range changes {
+		if change.Op == "delete" {
+			// anything older belonged to an app that was deleted
+			return nil, nil
+		}
+		if change.Version != "" && !skip[change.Version] {
+			return change, nil
+		}
+		if change.RolledBack != "" {
+			skip[change.RolledBack] = true
+		}
+	}
+	return nil, nil
+}
+
+// Rollback deploys the version app ran before failed, found in its config
+// history, and returns it.  It returns "" if failed is no longer app's
+// version, e.g. because another host already rolled it back.
+func Rollback(configStore *config.Store, serviceRuntime *runtime.ServiceRuntime, app, env, failed string) (string, error) {
+	svcCfg, err := configStore.GetApp(app, env)
+	if err != nil {
+		return "", fmt.Errorf("unable to roll back: %s.", err)
+	}
+
+	if svcCfg == nil {
+		return "", fmt.Errorf("app %s does not exist.", app)
+	}
+
+	if svcCfg.Version() != failed {
+		return "", nil
+	}
+
+	prev, err := previousVersion(configStore, app, env, failed)
+	if err != nil {
+		return "", fmt.Errorf("unable to read %s's history: %s", app, err)
+	}
+	if prev == nil {
+		return "", fmt.Errorf("%s has no version to roll back to.", app)
+	}
+
+	image, err := serviceRuntime.PullImage(prev.Version, prev.VersionID)
+	if image == nil || err != nil {
+		return "", fmt.Errorf("unable to pull %s: %s", prev.Version, err)
+	}
+
+	svcCfg.SetVersion(prev.Version)
+	svcCfg.SetVersionID(image.ID)
+
+	svcCfg.ClearPorts()
+	for k, _ := range image.Config.ExposedPorts {
+		svcCfg.AddPort(k.Port(), k.Proto())
+	}
+
+	updated, err := configStore.RollbackApp(svcCfg, env, failed)
+	if err == config.ErrConflict {
+		// someone else changed it first, most likely rolling it back too
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not store version: %s", err)
+	}
+	if !updated {
+		return "", fmt.Errorf("%s NOT rolled back.", app)
+	}
+	log.Printf("Rolled back %s from %s to %s.\n", app, failed, prev.Version)
+	return prev.Version, nil
+}
@@ -0,0 +1,96 @@
+package commander
+
+import (
+	"testing"
+	"time"
+
+	"github.com/litl/galaxy/config"
+)
+
+func TestPreviousVersion(t *testing.T) {
+	s, b := NewTestStore()
+
+	now := time.Now()
+	logChange := func(change *config.Change) error {
+		now = now.Add(time.Second)
+		change.Time = now
+		return b.LogChange("dev", change)
+	}
+
+	for _, change := range []*config.Change{
+		{App: "app", Op: "create"},
+		{App: "app", Op: "update", Version: "app:1"},
+		{App: "other", Op: "update", Version: "other:1"},
+		{App: "app", Op: "update", Version: "app:2"},
+		{App: "app", Op: "update", Version: "app:3"},
+		{App: "app", Op: "update", Version: "app:3"},
+	} {
+		if err := logChange(change); err != nil {
+			t.Fatalf("LogChange() error: %s", err)
+		}
+	}
+
+	for failed, want := range map[string]string{
+		"app:3": "app:2",
+		"app:1": "app:3",
+	} {
+		prev, err := previousVersion(s, "app", "dev", failed)
+		if err != nil {
+			t.Fatalf("previousVersion(%s) error: %s", failed, err)
+		}
+		if prev == nil || prev.Version != want {
+			t.Fatalf("previousVersion(%s) = %v, want %s", failed, prev, want)
+		}
+	}
+
+	logChange(&config.Change{App: "app", Op: "delete"})
+	logChange(&config.Change{App: "app", Op: "create"})
+	logChange(&config.Change{App: "app", Op: "update", Version: "app:4"})
+
+	prev, err := previousVersion(s, "app", "dev", "app:4")
+	if err != nil {
+		t.Fatalf("previousVersion() error: %s", err)
+	}
+	if prev != nil {
+		t.Fatalf("previousVersion() = %v, want nil for a recreated app", prev)
+	}
+}
+
+func TestPreviousVersionSkipsRolledBack(t *testing.T) {
+	s, b := NewTestStore()
+
+	now := time.Now()
+	for _, change := range []*config.Change{
+		{App: "app", Op: "create"},
+		{App: "app", Op: "update", Version: "app:1"},
+		{App: "app", Op: "update", Version: "app:2"},
+		{App: "app", Op: "update", Version: "app:3"},
+		// app:3 kept failing and app:2 does too
+		{App: "app", Op: "update", Version: "app:2", RolledBack: "app:3"},
+	} {
+		now = now.Add(time.Second)
+		change.Time = now
+		if err := b.LogChange("dev", change); err != nil {
+			t.Fatalf("LogChange() error: %s", err)
+		}
+	}
+
+	prev, err := previousVersion(s, "app", "dev", "app:2")
+	if err != nil {
+		t.Fatalf("previousVersion() error: %s", err)
+	}
+	if prev == nil || prev.Version != "app:1" {
+		t.Fatalf("previousVersion(app:2) = %v, want app:1", prev)
+	}
+
+	// after another deploy, the version rolled back to is the previous one
+	now = now.Add(time.Second)
+	b.LogChange("dev", &config.Change{App: "app", Op: "update", Version: "app:4", Time: now})
+	prev, err = previousVersion(s, "app", "dev", "app:4")
+	if err != nil {
+		t.Fatalf("previousVersion() error: %s", err)
+	}
+	if prev == nil || prev.Version != "app:2" {
+		t.Fatalf("previousVersion(app:4) = %v, want app:2", prev)
+	}
+}
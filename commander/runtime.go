@@ -1,13 +1,12 @@
 package commander
 
 import (
+	"fmt"
 	"strconv"
 	"strings"
 
 	"github.com/litl/galaxy/config"
-	"github.com/litl/galaxy/log"
 	"github.com/litl/galaxy/utils"
-	"github.com/ryanuber/columnize"
 )
 
 type RuntimeOptions struct {
@@ -16,6 +15,23 @@ type RuntimeOptions struct {
 	CPUShares   string
 	VirtualHost string
 	Port        string
+	Restart     string
+	Network     string
+	LogDriver   string
+	LogOpts     string
+	StopSignal  string
+	StopTimeout string
+	Ulimits     string
+	CapAdd      string
+	CapDrop     string
+	ReadOnly    string
+	Privileged  string
+	Constraints string
+
+	// RemoveVirtualHost and ClearPort take a vhost and the service port
+	// out of rotation on set.
+	RemoveVirtualHost string
+	ClearPort         bool
 }
 
 func RuntimeList(configStore *config.Store, app, env, pool string) error {
@@ -30,7 +46,7 @@ func RuntimeList(configStore *config.Store, app, env, pool string) error {
 		}
 	}
 
-	columns := []string{"ENV | NAME | POOL | PS | MEM | VHOSTS | PORT"}
+	columns := [][]string{{"ENV", "NAME", "POOL", "PS", "MEM", "CPU", "VHOSTS", "PORT", "RESTART", "NETWORK", "LOG"}}
 
 	for _, env := range envs {
 
@@ -55,30 +71,54 @@ func RuntimeList(configStore *config.Store, app, env, pool string) error {
 				ps := appCfg.GetProcesses(p)
 				mem := appCfg.GetMemory(p)
 
-				columns = append(columns, strings.Join([]string{
+				columns = append(columns, []string{
 					env,
 					name,
 					p,
 					strconv.FormatInt(int64(ps), 10),
 					mem,
+					appCfg.GetCPUShares(p),
 					appCfg.Env()["VIRTUAL_HOST"],
 					appCfg.Env()["GALAXY_PORT"],
-				}, " | "))
+					appCfg.Env()["GALAXY_RESTART"],
+					appCfg.Env()["GALAXY_NETWORK"],
+					appCfg.Env()["GALAXY_LOG_DRIVER"],
+				})
 			}
 		}
 	}
-	output, _ := columnize.SimpleFormat(columns)
-	log.Println(output)
-	return nil
+	return PrintColumns(columns)
+
+}
 
+// vhostList returns the virtual hosts in a VIRTUAL_HOST value.
+func vhostList(value string) []string {
+	vhosts := []string{}
+	for _, vhost := range strings.Split(value, ",") {
+		vhost = strings.TrimSpace(vhost)
+		if vhost != "" {
+			vhosts = append(vhosts, vhost)
+		}
+	}
+	return vhosts
 }
 
 func RuntimeSet(configStore *config.Store, app, env, pool string, options RuntimeOptions) (bool, error) {
 
+	if options.ClearPort && options.Port != "" {
+		return false, fmt.Errorf("a port can't be set and cleared at once")
+	}
+	if options.RemoveVirtualHost != "" && options.RemoveVirtualHost == options.VirtualHost {
+		return false, fmt.Errorf("%s can't be added and removed at once", options.VirtualHost)
+	}
+
 	cfg, err := configStore.GetApp(app, env)
 	if err != nil {
 		return false, err
 	}
+	if cfg == nil {
+		return false, fmt.Errorf("app %s does not exist.", app)
+	}
 
 	if options.Ps != 0 && options.Ps != cfg.GetProcesses(pool) {
 		cfg.SetProcesses(pool, options.Ps)
@@ -88,16 +128,86 @@ func RuntimeSet(configStore *config.Store, app, env, pool string, options Runtim
 		cfg.SetMemory(pool, options.Memory)
 	}
 
-	vhosts := strings.Split(cfg.Env()["VIRTUAL_HOST"], ",")
+	if options.CPUShares != "" && options.CPUShares != cfg.GetCPUShares(pool) {
+		cfg.SetCPUShares(pool, options.CPUShares)
+	}
+
+	vhosts := vhostList(cfg.Env()["VIRTUAL_HOST"])
 	if options.VirtualHost != "" && !utils.StringInSlice(options.VirtualHost, vhosts) {
 		vhosts = append(vhosts, options.VirtualHost)
 		cfg.EnvSet("VIRTUAL_HOST", strings.Join(vhosts, ","))
 	}
 
-	if options.Port != "" {
+	if options.RemoveVirtualHost != "" {
+		if !utils.StringInSlice(options.RemoveVirtualHost, vhosts) {
+			return false, fmt.Errorf("%s isn't a virtual host of %s", options.RemoveVirtualHost, app)
+		}
+		vhosts = utils.RemoveStringInSlice(options.RemoveVirtualHost, vhosts)
+		cfg.EnvSet("VIRTUAL_HOST", strings.Join(vhosts, ","))
+	}
+
+	if options.ClearPort {
+		cfg.EnvSet("GALAXY_PORT", "")
+	}
+
+	if options.Port == "auto" {
+		port, err := configStore.ServicePort(cfg, env)
+		if err != nil {
+			return false, err
+		}
+		cfg.EnvSet("GALAXY_PORT", port)
+	} else if options.Port != "" {
 		cfg.EnvSet("GALAXY_PORT", options.Port)
 	}
 
+	if options.Restart != "" {
+		cfg.EnvSet("GALAXY_RESTART", options.Restart)
+	}
+
+	if options.Network != "" {
+		cfg.EnvSet("GALAXY_NETWORK", options.Network)
+	}
+
+	if options.LogDriver != "" {
+		cfg.EnvSet("GALAXY_LOG_DRIVER", options.LogDriver)
+	}
+
+	if options.LogOpts != "" {
+		cfg.EnvSet("GALAXY_LOG_OPTS", options.LogOpts)
+	}
+
+	if options.StopSignal != "" {
+		cfg.EnvSet("GALAXY_STOP_SIGNAL", options.StopSignal)
+	}
+
+	if options.StopTimeout != "" {
+		cfg.EnvSet("GALAXY_STOP_TIMEOUT", options.StopTimeout)
+	}
+
+	if options.Ulimits != "" {
+		cfg.EnvSet("GALAXY_ULIMITS", options.Ulimits)
+	}
+
+	if options.CapAdd != "" {
+		cfg.EnvSet("GALAXY_CAP_ADD", options.CapAdd)
+	}
+
+	if options.CapDrop != "" {
+		cfg.EnvSet("GALAXY_CAP_DROP", options.CapDrop)
+	}
+
+	if options.ReadOnly != "" {
+		cfg.EnvSet("GALAXY_READ_ONLY", options.ReadOnly)
+	}
+
+	if options.Privileged != "" {
+		cfg.EnvSet("GALAXY_PRIVILEGED", options.Privileged)
+	}
+
+	if options.Constraints != "" {
+		cfg.EnvSet("GALAXY_CONSTRAINTS", options.Constraints)
+	}
+
 	return configStore.UpdateApp(cfg, env)
 }
 
@@ -116,7 +226,11 @@ func RuntimeUnset(configStore *config.Store, app, env, pool string, options Runt
 		cfg.SetMemory(pool, "")
 	}
 
-	vhosts := strings.Split(cfg.Env()["VIRTUAL_HOST"], ",")
+	if options.CPUShares != "" {
+		cfg.SetCPUShares(pool, "")
+	}
+
+	vhosts := vhostList(cfg.Env()["VIRTUAL_HOST"])
 	if options.VirtualHost != "" && utils.StringInSlice(options.VirtualHost, vhosts) {
 		vhosts = utils.RemoveStringInSlice(options.VirtualHost, vhosts)
 		cfg.EnvSet("VIRTUAL_HOST", strings.Join(vhosts, ","))
@@ -126,5 +240,53 @@ func RuntimeUnset(configStore *config.Store, app, env, pool string, options Runt
 		cfg.EnvSet("GALAXY_PORT", "")
 	}
 
+	if options.Restart != "" {
+		cfg.EnvSet("GALAXY_RESTART", "")
+	}
+
+	if options.Network != "" {
+		cfg.EnvSet("GALAXY_NETWORK", "")
+	}
+
+	if options.LogDriver != "" {
+		cfg.EnvSet("GALAXY_LOG_DRIVER", "")
+	}
+
+	if options.LogOpts != "" {
+		cfg.EnvSet("GALAXY_LOG_OPTS", "")
+	}
+
+	if options.StopSignal != "" {
+		cfg.EnvSet("GALAXY_STOP_SIGNAL", "")
+	}
+
+	if options.StopTimeout != "" {
+		cfg.EnvSet("GALAXY_STOP_TIMEOUT", "")
+	}
+
+	if options.Ulimits != "" {
+		cfg.EnvSet("GALAXY_ULIMITS", "")
+	}
+
+	if options.CapAdd != "" {
+		cfg.EnvSet("GALAXY_CAP_ADD", "")
+	}
+
+	if options.CapDrop != "" {
+		cfg.EnvSet("GALAXY_CAP_DROP", "")
+	}
+
+	if options.ReadOnly != "" {
+		cfg.EnvSet("GALAXY_READ_ONLY", "")
+	}
+
+	if options.Privileged != "" {
+		cfg.EnvSet("GALAXY_PRIVILEGED", "")
+	}
+
+	if options.Constraints != "" {
+		cfg.EnvSet("GALAXY_CONSTRAINTS", "")
+	}
+
 	return configStore.UpdateApp(cfg, env)
 }
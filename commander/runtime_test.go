@@ -0,0 +1,45 @@
+package commander
+
+import (
+	"testing"
+
+	"github.com/litl/galaxy/config"
+)
+
+func TestRuntimeSetRemove(t *testing.T) {
+	s, b := NewTestStore()
+	b.UpdateAppFunc = func(svcCfg *config.AppConfig, env string) (bool, error) {
+		return true, nil
+	}
+	s.CreateApp("app", "dev")
+	cfg, _ := s.GetApp("app", "dev")
+
+	_, err := RuntimeSet(s, "app", "dev", "web", RuntimeOptions{VirtualHost: "a.example.com", Port: "8000"})
+	if err != nil {
+		t.Fatalf("RuntimeSet() error: %s", err)
+	}
+	_, err = RuntimeSet(s, "app", "dev", "web", RuntimeOptions{VirtualHost: "b.example.com"})
+	if err != nil {
+		t.Fatalf("RuntimeSet() error: %s", err)
+	}
+	if cfg.Env()["VIRTUAL_HOST"] != "a.example.com,b.example.com" {
+		t.Fatalf("Expected a.example.com,b.example.com. Got %s", cfg.Env()["VIRTUAL_HOST"])
+	}
+
+	_, err = RuntimeSet(s, "app", "dev", "web", RuntimeOptions{RemoveVirtualHost: "a.example.com", ClearPort: true})
+	if err != nil {
+		t.Fatalf("RuntimeSet() error: %s", err)
+	}
+	if cfg.Env()["VIRTUAL_HOST"] != "b.example.com" || cfg.Env()["GALAXY_PORT"] != "" {
+		t.Fatalf("Expected b.example.com and no port. Got %s %s", cfg.Env()["VIRTUAL_HOST"], cfg.Env()["GALAXY_PORT"])
+	}
+
+	_, err = RuntimeSet(s, "app", "dev", "web", RuntimeOptions{RemoveVirtualHost: "c.example.com"})
+	if err == nil {
+		t.Errorf("Expected an error removing a vhost the app doesn't have")
+	}
+	_, err = RuntimeSet(s, "app", "dev", "web", RuntimeOptions{Port: "8000", ClearPort: true})
+	if err == nil {
+		t.Errorf("Expected an error setting and clearing the port")
+	}
+}
@@ -4,12 +4,13 @@ import (
 	"sort"
 
 	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/utils"
 )
 
 // Balanced returns the number of instances that should be run on the host
 // according to the desired state for the app in the given env and pool. The
 // number returned for the host represent an approximately equal distribution
-// across all hosts.
+// across all hosts whose labels satisfy the app's GALAXY_CONSTRAINTS.
 func Balanced(configStore *config.Store, hostId, app, env, pool string) (int, error) {
 	hosts, err := configStore.ListHosts(env, pool)
 	if err != nil {
@@ -26,13 +27,15 @@ func Balanced(configStore *config.Store, hostId, app, env, pool string) (int, er
 		return 0, nil
 	}
 
-	if desired == -1 {
-		return 1, nil
-	}
-
 	hostIds := []string{}
 	for _, h := range hosts {
-		hostIds = append(hostIds, h.HostIP)
+		ok, err := hostSatisfies(h, cfg)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			hostIds = append(hostIds, h.HostIP)
+		}
 	}
 	sort.Strings(hostIds)
 
@@ -44,16 +47,66 @@ func Balanced(configStore *config.Store, hostId, app, env, pool string) (int, er
 		}
 	}
 
+	if desired == -1 {
+		// one on every host, unless its labels rule it out
+		for _, h := range hosts {
+			if h.HostIP == hostId && hostIdx < 0 {
+				return 0, nil
+			}
+		}
+		return 1, nil
+	}
+
 	if hostIdx < 0 {
 		return 0, nil
 	}
 
 	count := 0
 	for i := 0; i < desired; i++ {
-		if i%len(hosts) == hostIdx {
+		if i%len(hostIds) == hostIdx {
 			count = count + 1
 		}
 	}
 
 	return count, nil
 }
+
+// hostSatisfies returns true if host's labels satisfy cfg's
+// GALAXY_CONSTRAINTS.
+func hostSatisfies(host config.HostInfo, cfg *config.AppConfig) (bool, error) {
+	constraints := cfg.Env()["GALAXY_CONSTRAINTS"]
+	if constraints == "" {
+		return true, nil
+	}
+
+	labels, err := utils.ParseLabels(host.Labels)
+	if err != nil {
+		return false, err
+	}
+	return utils.MatchConstraints(constraints, labels)
+}
+
+// CanaryHost returns true if the host runs the canaries for appCfg in the
+// given env and pool: the first by IP of the pool's hosts whose labels
+// satisfy its GALAXY_CONSTRAINTS, which always gets an instance from
+// Balanced.
+func CanaryHost(configStore *config.Store, hostId string, appCfg *config.AppConfig, env, pool string) (bool, error) {
+	hosts, err := configStore.ListHosts(env, pool)
+	if err != nil {
+		return false, err
+	}
+
+	hostIds := []string{}
+	for _, h := range hosts {
+		ok, err := hostSatisfies(h, appCfg)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			hostIds = append(hostIds, h.HostIP)
+		}
+	}
+	sort.Strings(hostIds)
+
+	return len(hostIds) > 0 && hostIds[0] == hostId, nil
+}
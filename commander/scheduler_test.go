@@ -14,6 +14,12 @@ func NewTestStore() (*config.Store, *config.MemoryBackend) {
 }
 
 func setup(t *testing.T, desired int, hosts []string) *config.Store {
+	return setupLabels(t, desired, hosts, nil, "")
+}
+
+// setupLabels is setup with hosts labelled by labels and the app
+// constrained by constraints.
+func setupLabels(t *testing.T, desired int, hosts []string, labels map[string]string, constraints string) *config.Store {
 	s, b := NewTestStore()
 
 	created, err := s.CreateApp("app", "dev")
@@ -27,12 +33,14 @@ func setup(t *testing.T, desired int, hosts []string) *config.Store {
 	}
 
 	ac.SetProcesses("web", desired)
+	ac.EnvSet("GALAXY_CONSTRAINTS", constraints)
 
 	b.ListHostsFunc = func(env, pool string) ([]config.HostInfo, error) {
 		ret := []config.HostInfo{}
 		for _, h := range hosts {
 			ret = append(ret, config.HostInfo{
 				HostIP: h,
+				Labels: labels[h],
 			})
 		}
 		return ret, nil
@@ -179,3 +187,88 @@ func TestScheduleOneDefault(t *testing.T) {
 		t.Errorf("Expected %d. Got %d", 1, count)
 	}
 }
+
+func TestCanaryHost(t *testing.T) {
+
+	s := setup(t, 3, []string{"127.0.0.2", "127.0.0.1", "127.0.0.3"})
+
+	for host, expected := range map[string]bool{
+		"127.0.0.1": true,
+		"127.0.0.2": false,
+		"127.0.0.4": false,
+	} {
+		canary, err := CanaryHost(s, host, config.NewAppConfig("app", ""), "dev", "web")
+		if err != nil {
+			t.Errorf("Expected %t. Got %s", expected, err)
+		}
+
+		if canary != expected {
+			t.Errorf("Expected %s canary %t. Got %t", host, expected, canary)
+		}
+	}
+}
+
+func TestCanaryHostConstraints(t *testing.T) {
+	hosts := []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"}
+	labels := map[string]string{
+		"127.0.0.2": "ssd",
+		"127.0.0.3": "ssd",
+	}
+	s := setupLabels(t, 2, hosts, labels, "ssd")
+
+	appCfg, err := s.GetApp("app", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for host, expected := range map[string]bool{
+		// the lowest IP can't run the app at all
+		"127.0.0.1": false,
+		"127.0.0.2": true,
+		"127.0.0.3": false,
+	} {
+		canary, err := CanaryHost(s, host, appCfg, "dev", "web")
+		if err != nil {
+			t.Fatalf("Expected %t for %s. Got %s", expected, host, err)
+		}
+		if canary != expected {
+			t.Fatalf("Expected %s canary %t. Got %t", host, expected, canary)
+		}
+
+		// the canary host is always given an instance
+		if count, _ := Balanced(s, host, "app", "dev", "web"); canary && count == 0 {
+			t.Fatalf("Expected an instance on canary host %s", host)
+		}
+	}
+}
+
+func TestScheduleConstraints(t *testing.T) {
+	hosts := []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"}
+	labels := map[string]string{
+		"127.0.0.1": "ssd,az=us-east-1a",
+		"127.0.0.2": "az=us-east-1b",
+		"127.0.0.3": "ssd,az=us-east-1b",
+	}
+
+	for _, tt := range []struct {
+		desired     int
+		constraints string
+		counts      []int
+	}{
+		{4, "ssd", []int{2, 0, 2}},
+		{3, "az=us-east-1b", []int{0, 2, 1}},
+		{-1, "!ssd", []int{0, 1, 0}},
+		{2, "gpu", []int{0, 0, 0}},
+	} {
+		s := setupLabels(t, tt.desired, hosts, labels, tt.constraints)
+		for i, h := range hosts {
+			count, err := Balanced(s, h, "app", "dev", "web")
+			if err != nil {
+				t.Fatalf("Expected %d for %s with %q. Got %s", tt.counts[i], h, tt.constraints, err)
+			}
+			if count != tt.counts[i] {
+				t.Fatalf("Expected %d for %s with %q. Got %d", tt.counts[i], h, tt.constraints, count)
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package commander
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/registry"
+	"github.com/litl/galaxy/runtime"
+)
+
+// ServiceRegister registers a container on this host by ID or name,
+// whether or not its health check is passing.  A running agent keeps
+// refreshing it from then on.
+func ServiceRegister(serviceRuntime *runtime.ServiceRuntime, serviceRegistry *registry.ServiceRegistry, env, pool, hostIP, container string) error {
+	c, err := serviceRuntime.InspectContainer(container)
+	if err != nil {
+		return err
+	}
+
+	reg, err := serviceRegistry.RegisterService(env, pool, hostIP, c)
+	if err != nil {
+		return err
+	}
+
+	location := reg.ExternalAddr()
+	if location == "" {
+		location = "no published port"
+	}
+	log.Printf("Registered %s running as %s for %s at %s\n", strings.TrimPrefix(reg.ContainerName, "/"),
+		reg.ContainerID[0:12], reg.Name, location)
+	return nil
+}
+
+// ServiceUnregister removes the registration for a container on this
+// host.  A running agent registers it again on its next pass if the
+// container is still running and healthy; drain it to keep it out.
+func ServiceUnregister(serviceRuntime *runtime.ServiceRuntime, serviceRegistry *registry.ServiceRegistry, env, pool, hostIP, container string) error {
+	c, err := serviceRuntime.InspectContainer(container)
+	if err != nil {
+		return err
+	}
+
+	reg, err := serviceRegistry.UnRegisterService(env, pool, hostIP, c)
+	if err != nil {
+		return err
+	}
+	if reg == nil {
+		return fmt.Errorf("%s is not registered", container)
+	}
+
+	log.Printf("Unregistered %s running as %s for %s\n", strings.TrimPrefix(reg.ContainerName, "/"),
+		reg.ContainerID[0:12], reg.Name)
+	return nil
+}
+
+// RegistryPrune removes the registrations on this host whose containers
+// aren't running, rather than waiting for them to expire.
+func RegistryPrune(serviceRuntime *runtime.ServiceRuntime, serviceRegistry *registry.ServiceRegistry, env, pool, hostIP string) error {
+	containers, err := serviceRuntime.ManagedContainers()
+	if err != nil {
+		return err
+	}
+
+	stale, err := serviceRegistry.UnRegisterStale(env, pool, hostIP, containers)
+	if err != nil {
+		return err
+	}
+
+	for _, regPath := range stale {
+		log.Printf("Unregistered stale registration %s\n", regPath)
+	}
+	log.Printf("Pruned %d registrations\n", len(stale))
+	return nil
+}
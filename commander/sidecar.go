@@ -0,0 +1,85 @@
+package commander
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/utils"
+)
+
+func SidecarList(configStore *config.Store, app, env string) error {
+	cfg, err := configStore.GetApp(app, env)
+	if err != nil {
+		return err
+	}
+
+	if cfg == nil {
+		return fmt.Errorf("app %s does not exist.", app)
+	}
+
+	columns := [][]string{{"NAME", "IMAGE", "MEM", "CPU", "CMD"}}
+	for _, sidecar := range cfg.Sidecars() {
+		columns = append(columns, []string{
+			sidecar.Name,
+			sidecar.Image,
+			sidecar.Memory,
+			sidecar.CPUShares,
+			strings.Join(sidecar.Cmd, " "),
+		})
+	}
+	return PrintColumns(columns)
+}
+
+func SidecarSet(configStore *config.Store, app, env string, sidecar config.SidecarConfig) (bool, error) {
+	cfg, err := configStore.GetApp(app, env)
+	if err != nil {
+		return false, err
+	}
+
+	if cfg == nil {
+		return false, fmt.Errorf("app %s does not exist.", app)
+	}
+
+	if sidecar.Memory != "" {
+		if _, err := utils.ParseMemory(sidecar.Memory); err != nil {
+			return false, fmt.Errorf("bad memory option %s: %s", sidecar.Memory, err)
+		}
+	}
+
+	if _, err := utils.ParseCPUShares(sidecar.CPUShares); err != nil {
+		return false, fmt.Errorf("bad CPU shares option %s: %s", sidecar.CPUShares, err)
+	}
+
+	err = cfg.SetSidecar(sidecar)
+	if err != nil {
+		return false, err
+	}
+	return configStore.UpdateApp(cfg, env)
+}
+
+func SidecarUnset(configStore *config.Store, app, env, name string) (bool, error) {
+	cfg, err := configStore.GetApp(app, env)
+	if err != nil {
+		return false, err
+	}
+
+	if cfg == nil {
+		return false, fmt.Errorf("app %s does not exist.", app)
+	}
+
+	found := false
+	for _, sidecar := range cfg.Sidecars() {
+		if sidecar.Name == name {
+			found = true
+		}
+	}
+
+	if !found {
+		return false, errors.New("sidecar " + name + " does not exist")
+	}
+
+	cfg.RemoveSidecar(name)
+	return configStore.UpdateApp(cfg, env)
+}
@@ -0,0 +1,323 @@
+package commander
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/registry"
+	"github.com/litl/galaxy/utils"
+)
+
+// appStatus is the health of an app's containers in an env.
+type appStatus struct {
+	Desired    int
+	Registered int
+	// Healthy registrations aren't draining or stale
+	Healthy int
+	// Skewed containers run another image than the app's version, not
+	// counting canaries and green ones
+	Skewed int
+	// Outdated containers were started by an older deploy
+	Outdated int
+	// Stale registrations haven't been refreshed for over half their TTL,
+	// so the agent registering them is probably down
+	Stale int
+	// Missing are dependencies with no healthy registrations
+	Missing []string
+}
+
+// problems returns what's wrong with the app, or nothing if it's ok.
+func (a appStatus) problems() []string {
+	problems := []string{}
+	switch {
+	case a.Desired > 0 && a.Healthy == 0:
+		problems = append(problems, "down")
+	case a.Healthy < a.Desired:
+		problems = append(problems, "degraded")
+	}
+	if a.Skewed > 0 {
+		problems = append(problems, "skew")
+	}
+	if a.Outdated > 0 {
+		problems = append(problems, "outdated")
+	}
+	if a.Stale > 0 {
+		problems = append(problems, "stale")
+	}
+	if len(a.Missing) > 0 {
+		problems = append(problems, "missing deps")
+	}
+	return problems
+}
+
+// regStale returns true if reg should have been refreshed by now.  Static
+// registrations and ones without a known expiry never are.
+func regStale(reg registry.ServiceRegistration, now time.Time) bool {
+	if reg.Static || reg.Expires.IsZero() {
+		return false
+	}
+	ttl := reg.TTL
+	if ttl == 0 {
+		ttl = registry.DefaultTTL
+	}
+	return reg.Expires.Sub(now) < time.Duration(ttl)*time.Second/2
+}
+
+// appRollup returns the status of appCfg's registrations, desired of which
+// should be running.
+func appRollup(appCfg *config.AppConfig, desired int, registrations []registry.ServiceRegistration, now time.Time) appStatus {
+	status := appStatus{Desired: desired}
+	for _, reg := range registrations {
+		if reg.Name != appCfg.Name || reg.External {
+			continue
+		}
+		status.Registered++
+
+		stale := regStale(reg, now)
+		if stale {
+			status.Stale++
+		}
+		if !stale && !reg.IsDraining() {
+			status.Healthy++
+		}
+		if reg.Image != appCfg.Version() && !reg.Canary && reg.Color != "green" {
+			status.Skewed++
+		}
+		if reg.DeployID != "" && appCfg.DeployID() != "" && reg.DeployID != appCfg.DeployID() {
+			status.Outdated++
+		}
+	}
+	return status
+}
+
+// Status rolls up the health of each app in env: how many containers
+// should be running, how many are registered and healthy, how many run
+// another version or an older deploy, how many registrations have gone
+// stale, and which dependencies have no healthy registrations.
+// Containers are only registered while their health checks pass.  It
+// returns true if every app is ok.
+func Status(configStore *config.Store, serviceRegistry *registry.ServiceRegistry, env string) (bool, error) {
+	appList, err := configStore.ListApps(env)
+	if err != nil {
+		return false, err
+	}
+
+	registrations, err := serviceRegistry.ListRegistrations(env)
+	if err != nil {
+		return false, err
+	}
+	err = serviceRegistry.LoadExpires(registrations)
+	if err != nil {
+		return false, err
+	}
+
+	pools, err := configStore.ListPools(env)
+	if err != nil {
+		return false, err
+	}
+	desired := make(map[string]int)
+	for _, pool := range pools {
+		assignments, err := configStore.ListAssignments(env, pool)
+		if err != nil {
+			return false, err
+		}
+		for _, name := range assignments {
+			count, err := poolInstances(configStore, name, env, pool)
+			if err != nil {
+				return false, err
+			}
+			desired[name] += count
+		}
+	}
+
+	now := time.Now()
+	healthy := make(map[string]int)
+	for _, reg := range registrations {
+		if !reg.IsDraining() && !regStale(reg, now) {
+			healthy[reg.Name] += 1
+		}
+	}
+
+	columns := [][]string{{"NAME", "VERSION", "DESIRED", "REGISTERED", "HEALTHY", "SKEW", "OUTDATED", "STALE", "MISSING", "STATUS"}}
+	unhealthyApps := 0
+	for _, app := range appList {
+		status := appRollup(app, desired[app.Name], registrations, now)
+		for _, dep := range app.Depends() {
+			if healthy[dep] == 0 {
+				status.Missing = append(status.Missing, dep)
+			}
+		}
+
+		state := "ok"
+		if problems := status.problems(); len(problems) > 0 {
+			unhealthyApps += 1
+			state = strings.Join(problems, ",")
+		}
+
+		columns = append(columns, []string{
+			app.Name,
+			app.Version(),
+			strconv.Itoa(status.Desired),
+			strconv.Itoa(status.Registered),
+			strconv.Itoa(status.Healthy),
+			strconv.Itoa(status.Skewed),
+			strconv.Itoa(status.Outdated),
+			strconv.Itoa(status.Stale),
+			strings.Join(status.Missing, ","),
+			state,
+		})
+	}
+	err = PrintColumns(columns)
+	if err != nil {
+		return false, err
+	}
+
+	if unhealthyApps > 0 {
+		log.Printf("%d of %d apps in %s are not ok\n", unhealthyApps, len(appList), env)
+		return false, nil
+	}
+	log.Printf("All %d apps in %s are ok\n", len(appList), env)
+	return true, nil
+}
+
+// regLocation returns the pool and host a registration is under,
+// env/pool/hosts/<ip>/app/container.
+func regLocation(reg registry.ServiceRegistration) (string, string) {
+	parts := strings.Split(reg.Path, "/")
+	if len(parts) >= 4 {
+		return parts[1], parts[3]
+	}
+	return "", reg.ExternalIP
+}
+
+// Processes lists how many containers app, or every app if app is "",
+// should be running in each pool it's assigned to in env against how many
+// are registered, and then each registered container with the deploy that
+// started it and when its registration expires unless it's refreshed.
+func Processes(configStore *config.Store, serviceRegistry *registry.ServiceRegistry, env, app string) error {
+	registrations, err := serviceRegistry.ListRegistrations(env)
+	if err != nil {
+		return err
+	}
+	err = serviceRegistry.LoadExpires(registrations)
+	if err != nil {
+		return err
+	}
+
+	pools, err := configStore.ListPools(env)
+	if err != nil {
+		return err
+	}
+
+	type appPool struct{ app, pool string }
+	desired := make(map[appPool]int)
+	running := make(map[appPool]int)
+	images := make(map[appPool][]string)
+
+	for _, pool := range pools {
+		assignments, err := configStore.ListAssignments(env, pool)
+		if err != nil {
+			return err
+		}
+		for _, name := range assignments {
+			if app != "" && name != app {
+				continue
+			}
+			count, err := poolInstances(configStore, name, env, pool)
+			if err != nil {
+				return err
+			}
+			desired[appPool{name, pool}] = count
+		}
+	}
+
+	columns := [][]string{{"NAME", "POOL", "HOST", "CONTAINER", "IMAGE", "DEPLOY", "STARTED", "EXPIRES", "STATE"}}
+	for _, reg := range registrations {
+		if reg.External || (app != "" && reg.Name != app) {
+			continue
+		}
+
+		pool, host := regLocation(reg)
+		key := appPool{reg.Name, pool}
+		running[key]++
+		if !utils.StringInSlice(reg.Image, images[key]) {
+			images[key] = append(images[key], reg.Image)
+		}
+
+		container := reg.ContainerID
+		if len(container) > 12 {
+			container = container[0:12]
+		}
+
+		expires := ""
+		if !reg.Expires.IsZero() {
+			expires = reg.Expires.Local().Format(time.RFC3339)
+		}
+
+		columns = append(columns, []string{
+			reg.Name,
+			pool,
+			host,
+			container,
+			reg.Image,
+			reg.DeployID,
+			reg.StartedAt.Local().Format(time.RFC3339),
+			expires,
+			reg.State,
+		})
+	}
+	sortRows(columns[1:])
+
+	// registered containers in pools the app isn't assigned to any more
+	// are listed with 0 desired
+	counts := [][]string{{"NAME", "POOL", "DESIRED", "RUNNING", "IMAGES"}}
+	for key := range running {
+		if _, ok := desired[key]; !ok {
+			desired[key] = 0
+		}
+	}
+	for key, count := range desired {
+		sort.Strings(images[key])
+		counts = append(counts, []string{
+			key.app,
+			key.pool,
+			strconv.Itoa(count),
+			strconv.Itoa(running[key]),
+			strings.Join(images[key], ","),
+		})
+	}
+	sortRows(counts[1:])
+
+	// a filter or sort may only apply to one of the listings
+	listings, err := selectListings(counts, columns)
+	if err != nil {
+		return err
+	}
+	counts, columns = listings[0], listings[1]
+
+	if output == "json" {
+		// one document for both listings
+		return json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+			"apps":       tableRows(counts),
+			"containers": tableRows(columns),
+		})
+	}
+
+	err = printRows(counts)
+	if err != nil {
+		return err
+	}
+	if output == "table" {
+		log.Println("")
+	} else {
+		fmt.Println()
+	}
+	return printRows(columns)
+}
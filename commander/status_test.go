@@ -0,0 +1,57 @@
+package commander
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/registry"
+)
+
+func TestAppRollup(t *testing.T) {
+	s, _ := NewTestStore()
+	cfg := config.NewAppConfig("web", "web:2")
+	s.UpdateApp(cfg, "dev")
+	deployID := cfg.DeployID()
+
+	now := time.Now()
+	fresh := now.Add(55 * time.Second)
+	reg := func(image, deploy string, expires time.Time) registry.ServiceRegistration {
+		return registry.ServiceRegistration{Name: "web", Image: image, DeployID: deploy, Expires: expires}
+	}
+
+	draining := reg("web:2", deployID, fresh)
+	draining.State = registry.RegistrationDraining
+	canary := reg("web:3", deployID, fresh)
+	canary.Canary = true
+	static := reg("web:2", deployID, time.Time{})
+	static.Static = true
+
+	registrations := []registry.ServiceRegistration{
+		reg("web:2", deployID, fresh),
+		reg("web:1", "old", fresh),
+		reg("web:2", deployID, now.Add(10*time.Second)),
+		draining,
+		canary,
+		static,
+		{Name: "web", External: true},
+		{Name: "api", Image: "api:1"},
+	}
+
+	status := appRollup(cfg, 6, registrations, now)
+	want := appStatus{Desired: 6, Registered: 6, Healthy: 4, Skewed: 1, Outdated: 1, Stale: 1}
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("appRollup() = %+v, want %+v", status, want)
+	}
+	if problems := status.problems(); !reflect.DeepEqual(problems, []string{"degraded", "skew", "outdated", "stale"}) {
+		t.Errorf("problems() = %v", problems)
+	}
+
+	if problems := (appStatus{Desired: 2, Registered: 2}).problems(); !reflect.DeepEqual(problems, []string{"down"}) {
+		t.Errorf("problems() of no healthy containers = %v, want [down]", problems)
+	}
+	if problems := (appStatus{Desired: 2, Registered: 2, Healthy: 2}).problems(); len(problems) != 0 {
+		t.Errorf("problems() of a healthy app = %v, want none", problems)
+	}
+}
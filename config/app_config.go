@@ -1,7 +1,9 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -16,6 +18,42 @@ type AppConfig struct {
 	environmentVMap *utils.VersionedMap
 	portsVMap       *utils.VersionedMap
 	runtimeVMap     *utils.VersionedMap
+	sidecarsVMap    *utils.VersionedMap
+	// dependsVMap holds the apps from GALAXY_DEPENDS as keys
+	dependsVMap *utils.VersionedMap
+	// canaryVMap holds the version being canaried, see SetCanary
+	canaryVMap *utils.VersionedMap
+	// colorsVMap holds the green version of a blue/green deploy and the
+	// color receiving traffic, see SetGreen
+	colorsVMap *utils.VersionedMap
+	// jobsVMap holds the app's scheduled jobs, see SetJob
+	jobsVMap *utils.VersionedMap
+	// releasesVMap holds the app's recent deploys, see Releases
+	releasesVMap *utils.VersionedMap
+	// loadedID is the revision the config had when it was read from the
+	// backend.  Saves fail with ErrConflict if the stored one has moved on.
+	loadedID int64
+}
+
+// SidecarConfig describes a container started alongside each instance of an
+// app, e.g. a log shipper or local cache.  Sidecars join the app container's
+// network namespace and their Memory and CPUShares are carved out of the
+// app's limits.
+type SidecarConfig struct {
+	Name      string            `json:"-"`
+	Image     string            `json:"image"`
+	Cmd       []string          `json:"cmd,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	Memory    string            `json:"memory,omitempty"`
+	CPUShares string            `json:"cpu,omitempty"`
+}
+
+// JobConfig is a command run on a cron schedule in a one-off container of
+// the app's version, on one host of a pool the app is assigned to.
+type JobConfig struct {
+	Name     string `json:"-"`
+	Schedule string `json:"schedule"`
+	Command  string `json:"command"`
 }
 
 func NewAppConfig(app, version string) *AppConfig {
@@ -25,6 +63,12 @@ func NewAppConfig(app, version string) *AppConfig {
 		environmentVMap: utils.NewVersionedMap(),
 		portsVMap:       utils.NewVersionedMap(),
 		runtimeVMap:     utils.NewVersionedMap(),
+		sidecarsVMap:    utils.NewVersionedMap(),
+		dependsVMap:     utils.NewVersionedMap(),
+		canaryVMap:      utils.NewVersionedMap(),
+		colorsVMap:      utils.NewVersionedMap(),
+		jobsVMap:        utils.NewVersionedMap(),
+		releasesVMap:    utils.NewVersionedMap(),
 	}
 	svcCfg.SetVersion(version)
 
@@ -54,8 +98,13 @@ func (s *AppConfig) Env() map[string]string {
 	return env
 }
 
+// EnvSet sets an environment variable.  Setting GALAXY_DEPENDS also
+// updates the app's dependencies.
 func (s *AppConfig) EnvSet(key, value string) {
 	s.environmentVMap.SetVersion(key, value, s.nextID())
+	if key == "GALAXY_DEPENDS" {
+		s.setDepends(value)
+	}
 }
 
 func (s *AppConfig) EnvGet(key string) string {
@@ -78,6 +127,18 @@ func (s *AppConfig) SetVersionID(versionID string) {
 	s.versionVMap.SetVersion("versionID", versionID, s.nextID())
 }
 
+// DeployID identifies the config change that produced the app's config,
+// so containers and registrations can be traced back to it.  A new one is
+// generated each time the config is saved with changes.  It's "" for
+// configs last saved before deploy IDs.
+func (s *AppConfig) DeployID() string {
+	return s.versionVMap.Get("deployID")
+}
+
+func (s *AppConfig) setDeployID(deployID string) {
+	s.versionVMap.SetVersion("deployID", deployID, s.nextID())
+}
+
 func (s *AppConfig) Ports() map[string]string {
 	ports := map[string]string{}
 	for _, k := range s.portsVMap.Keys() {
@@ -96,9 +157,30 @@ func (s *AppConfig) ClearPorts() {
 }
 
 func (s *AppConfig) AddPort(port, portType string) {
-	s.portsVMap.Set(port, portType)
+	s.portsVMap.SetVersion(port, portType, s.nextID())
+}
+
+// vmaps returns the versioned maps that make up the config keyed by the
+// name they are stored under.
+func (s *AppConfig) vmaps() map[string]*utils.VersionedMap {
+	return map[string]*utils.VersionedMap{
+		"environment": s.environmentVMap,
+		"version":     s.versionVMap,
+		"ports":       s.portsVMap,
+		"runtime":     s.runtimeVMap,
+		"sidecars":    s.sidecarsVMap,
+		"depends":     s.dependsVMap,
+		"canary":      s.canaryVMap,
+		"colors":      s.colorsVMap,
+		"jobs":        s.jobsVMap,
+		"releases":    s.releasesVMap,
+	}
 }
 
+// ID is the latest version of the parts of the config an app's containers
+// run with.  It names them and is their GALAXY_VERSION, so changing it
+// restarts them.  Jobs aren't part of it since they run in containers of
+// their own.
 func (s *AppConfig) ID() int64 {
 	id := int64(0)
 	for _, vmap := range []*utils.VersionedMap{
@@ -106,6 +188,11 @@ func (s *AppConfig) ID() int64 {
 		s.versionVMap,
 		s.portsVMap,
 		s.runtimeVMap,
+		s.sidecarsVMap,
+		s.dependsVMap,
+		s.canaryVMap,
+		s.colorsVMap,
+		s.releasesVMap,
 	} {
 		if vmap.LatestVersion() > id {
 			id = vmap.LatestVersion()
@@ -115,11 +202,28 @@ func (s *AppConfig) ID() int64 {
 }
 
 func (s *AppConfig) ContainerName() string {
-	return s.Name + "_" + strconv.FormatInt(s.ID(), 10)
+	name := s.Name
+	if color := s.Env()["GALAXY_COLOR"]; color != "" {
+		name += "-" + color
+	}
+	name += "_" + strconv.FormatInt(s.ID(), 10)
+	if deployID := s.DeployID(); deployID != "" {
+		name += "_" + deployID
+	}
+	return name
+}
+
+// revision is the latest version of any part of the config, jobs
+// included.  Updates are checked against it to detect conflicting writes.
+func (s *AppConfig) revision() int64 {
+	if v := s.jobsVMap.LatestVersion(); v > s.ID() {
+		return v
+	}
+	return s.ID()
 }
 
 func (s *AppConfig) nextID() int64 {
-	return s.ID() + 1
+	return s.revision() + 1
 }
 
 func (s *AppConfig) SetProcesses(pool string, count int) {
@@ -168,3 +272,233 @@ func (s *AppConfig) GetCPUShares(pool string) string {
 	key := fmt.Sprintf("%s-cpu", pool)
 	return s.runtimeVMap.Get(key)
 }
+
+// Sidecars returns the app's sidecars sorted by name.  Entries that can't be
+// decoded are skipped.
+func (s *AppConfig) Sidecars() []SidecarConfig {
+	names := s.sidecarsVMap.Keys()
+	sort.Strings(names)
+
+	sidecars := []SidecarConfig{}
+	for _, name := range names {
+		val := s.sidecarsVMap.Get(name)
+		if val == "" {
+			continue
+		}
+
+		var sidecar SidecarConfig
+		if err := json.Unmarshal([]byte(val), &sidecar); err != nil {
+			continue
+		}
+		sidecar.Name = name
+		sidecars = append(sidecars, sidecar)
+	}
+	return sidecars
+}
+
+func (s *AppConfig) SetSidecar(sidecar SidecarConfig) error {
+	if sidecar.Name == "" || sidecar.Image == "" {
+		return fmt.Errorf("sidecar needs a name and image")
+	}
+
+	val, err := json.Marshal(sidecar)
+	if err != nil {
+		return err
+	}
+	s.sidecarsVMap.SetVersion(sidecar.Name, string(val), s.nextID())
+	return nil
+}
+
+func (s *AppConfig) RemoveSidecar(name string) {
+	s.sidecarsVMap.SetVersion(name, "", s.nextID())
+}
+
+// Jobs returns the app's scheduled jobs sorted by name.  Entries that
+// can't be decoded are skipped.
+func (s *AppConfig) Jobs() []JobConfig {
+	names := s.jobsVMap.Keys()
+	sort.Strings(names)
+
+	jobs := []JobConfig{}
+	for _, name := range names {
+		val := s.jobsVMap.Get(name)
+		if val == "" {
+			continue
+		}
+
+		var job JobConfig
+		if err := json.Unmarshal([]byte(val), &job); err != nil {
+			continue
+		}
+		job.Name = name
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// SetJob adds or replaces a job.  Its schedule is a cron schedule, see
+// utils.ParseSchedule.
+func (s *AppConfig) SetJob(job JobConfig) error {
+	if job.Name == "" || job.Command == "" {
+		return fmt.Errorf("job needs a name and command")
+	}
+	if strings.Contains(job.Name, "/") {
+		return fmt.Errorf("invalid job name %q", job.Name)
+	}
+
+	_, err := utils.ParseSchedule(job.Schedule)
+	if err != nil {
+		return err
+	}
+
+	val, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	s.jobsVMap.SetVersion(job.Name, string(val), s.nextID())
+	return nil
+}
+
+func (s *AppConfig) RemoveJob(name string) {
+	s.jobsVMap.SetVersion(name, "", s.nextID())
+}
+
+// Depends returns the apps this app depends on, from GALAXY_DEPENDS,
+// sorted by name.
+func (s *AppConfig) Depends() []string {
+	depends := []string{}
+	for _, name := range s.dependsVMap.Keys() {
+		if s.dependsVMap.Get(name) != "" {
+			depends = append(depends, name)
+		}
+	}
+	sort.Strings(depends)
+	return depends
+}
+
+// setDepends replaces the app's dependencies with the comma separated apps
+// in value.
+func (s *AppConfig) setDepends(value string) {
+	depends := []string{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			depends = append(depends, name)
+		}
+	}
+
+	for _, name := range s.Depends() {
+		if !utils.StringInSlice(name, depends) {
+			s.dependsVMap.SetVersion(name, "", s.nextID())
+		}
+	}
+	for _, name := range depends {
+		if s.dependsVMap.Get(name) == "" {
+			s.dependsVMap.SetVersion(name, "true", s.nextID())
+		}
+	}
+}
+
+// CanaryVersion returns the version being canaried, or "" if there is
+// none.
+func (s *AppConfig) CanaryVersion() string {
+	return s.canaryVMap.Get("version")
+}
+
+func (s *AppConfig) CanaryVersionID() string {
+	return s.canaryVMap.Get("versionID")
+}
+
+// CanaryPercent returns the share of the app's traffic meant for its
+// canary, or 0 if the canary is weighted like any other container.
+func (s *AppConfig) CanaryPercent() int {
+	percent, _ := strconv.Atoi(s.canaryVMap.Get("percent"))
+	return percent
+}
+
+// SetCanary runs version on the app's canary hosts, with percent of its
+// traffic, until it's promoted or cleared.
+func (s *AppConfig) SetCanary(version, versionID string, percent int) {
+	s.canaryVMap.SetVersion("version", version, s.nextID())
+	s.canaryVMap.SetVersion("versionID", versionID, s.nextID())
+	s.canaryVMap.SetVersion("percent", strconv.Itoa(percent), s.nextID())
+}
+
+func (s *AppConfig) ClearCanary() {
+	for _, k := range s.canaryVMap.Keys() {
+		s.canaryVMap.SetVersion(k, "", s.nextID())
+	}
+}
+
+// Stable returns a copy of the config without its canary or green version.
+// Its ID doesn't change when those are set or cleared, so hosts that aren't
+// running them don't restart their containers.  It isn't meant to be saved.
+func (s *AppConfig) Stable() *AppConfig {
+	stable := copyAppConfig(s)
+	stable.canaryVMap = utils.NewVersionedMap()
+	stable.colorsVMap = utils.NewVersionedMap()
+	return stable
+}
+
+// withVersion returns the stable config running version and versionID
+// instead, keeping the versions they were set at so its ID changes with
+// them.
+func (s *AppConfig) withVersion(vmap *utils.VersionedMap, versionKey, versionIDKey string) *AppConfig {
+	cfg := s.Stable()
+	cfg.versionVMap = utils.NewVersionedMap()
+	cfg.versionVMap.SetVersion("version", vmap.Get(versionKey), vmap.Version(versionKey))
+	cfg.versionVMap.SetVersion("versionID", vmap.Get(versionIDKey), vmap.Version(versionIDKey))
+	return cfg
+}
+
+// Canary returns the config canary hosts run: the stable config with the
+// canary's version and GALAXY_CANARY set to its traffic percent.  It isn't
+// meant to be saved.
+func (s *AppConfig) Canary() *AppConfig {
+	canary := s.withVersion(s.canaryVMap, "version", "versionID")
+	canary.EnvSet("GALAXY_CANARY", strconv.Itoa(s.CanaryPercent()))
+	return canary
+}
+
+// GreenVersion returns the version running alongside the app's version
+// during a blue/green deploy, or "" if there isn't one.
+func (s *AppConfig) GreenVersion() string {
+	return s.colorsVMap.Get("green")
+}
+
+func (s *AppConfig) GreenVersionID() string {
+	return s.colorsVMap.Get("greenID")
+}
+
+// SetGreen runs version alongside the app's version, its blue one, on
+// every host.  Which of them gets the app's traffic is set with
+// SetLiveColor.
+func (s *AppConfig) SetGreen(version, versionID string) {
+	s.colorsVMap.SetVersion("green", version, s.nextID())
+	s.colorsVMap.SetVersion("greenID", versionID, s.nextID())
+}
+
+// LiveColor returns "blue" or "green", whichever version gets the app's
+// traffic, or "" if it isn't being deployed blue/green.
+func (s *AppConfig) LiveColor() string {
+	if s.GreenVersion() == "" {
+		return ""
+	}
+	if live := s.colorsVMap.Get("live"); live != "" {
+		return live
+	}
+	return "blue"
+}
+
+func (s *AppConfig) SetLiveColor(color string) {
+	s.colorsVMap.SetVersion("live", color, s.nextID())
+}
+
+// Green returns the config the green version runs with: the stable config
+// with the green version and GALAXY_COLOR=green.  Its ID doesn't change
+// with the blue version or live color.  It isn't meant to be saved.
+func (s *AppConfig) Green() *AppConfig {
+	green := s.withVersion(s.colorsVMap, "green", "greenID")
+	green.EnvSet("GALAXY_COLOR", "green")
+	return green
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"reflect"
 	"strconv"
 	"testing"
 )
@@ -27,6 +28,31 @@ func TestSetVersion(t *testing.T) {
 	}
 }
 
+func TestSetCPUShares(t *testing.T) {
+	sc := NewAppConfig("foo", "")
+	if sc.GetCPUShares("web") != "" {
+		t.Fail()
+	}
+
+	id := sc.ID()
+	sc.SetCPUShares("web", "512")
+	sc.SetMemory("web", "256m")
+	if sc.GetCPUShares("web") != "512" || sc.GetCPUShares("worker") != "" {
+		t.Fatalf("Expected 512 for web only. Got %s %s", sc.GetCPUShares("web"), sc.GetCPUShares("worker"))
+	}
+	if sc.ID() <= id {
+		t.Fatalf("Expected the ID to change. Got %d", sc.ID())
+	}
+	if !reflect.DeepEqual(sc.RuntimePools(), []string{"web"}) {
+		t.Fatalf("Expected pools [web]. Got %v", sc.RuntimePools())
+	}
+
+	sc.SetCPUShares("web", "")
+	if sc.GetCPUShares("web") != "" || sc.GetMemory("web") != "256m" {
+		t.Fatalf("Expected only the CPU shares unset. Got %s %s", sc.GetCPUShares("web"), sc.GetMemory("web"))
+	}
+}
+
 func TestSetEnv(t *testing.T) {
 	sc := NewAppConfig("foo", "")
 	if len(sc.Env()) != 0 {
@@ -156,3 +182,192 @@ func TestIDAlwaysIncrements(t *testing.T) {
 	}
 	id = sc.ID()
 }
+
+func TestSidecars(t *testing.T) {
+
+	sc := NewAppConfig("foo", "")
+
+	err := sc.SetSidecar(SidecarConfig{Name: "logs", Image: "logship:1", Memory: "64m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sc.SetSidecar(SidecarConfig{Name: "cache", Image: "memcached"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sc.SetSidecar(SidecarConfig{Name: "bad"}); err == nil {
+		t.Fatalf("Expected error for sidecar without an image")
+	}
+
+	sidecars := sc.Sidecars()
+	if len(sidecars) != 2 {
+		t.Fatalf("Expected %d sidecars. Got %d", 2, len(sidecars))
+	}
+
+	if sidecars[0].Name != "cache" || sidecars[1].Name != "logs" {
+		t.Fatalf("Expected sidecars sorted by name. Got %s, %s", sidecars[0].Name, sidecars[1].Name)
+	}
+
+	if sidecars[1].Image != "logship:1" || sidecars[1].Memory != "64m" {
+		t.Fatalf("Expected logship:1 64m. Got %s %s", sidecars[1].Image, sidecars[1].Memory)
+	}
+
+	id := sc.ID()
+	sc.RemoveSidecar("cache")
+	if sc.ID() <= id {
+		t.Fatalf("Expected version to increment")
+	}
+
+	sidecars = sc.Sidecars()
+	if len(sidecars) != 1 || sidecars[0].Name != "logs" {
+		t.Fatalf("Expected only logs sidecar. Got %v", sidecars)
+	}
+}
+
+func TestJobs(t *testing.T) {
+
+	sc := NewAppConfig("foo", "")
+
+	err := sc.SetJob(JobConfig{Name: "report", Schedule: "0 6 * * *", Command: "bin/report"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sc.SetJob(JobConfig{Name: "cleanup", Schedule: "@hourly", Command: "bin/rake cleanup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sc.SetJob(JobConfig{Name: "bad", Schedule: "* * *", Command: "true"}); err == nil {
+		t.Fatalf("Expected error for job with an invalid schedule")
+	}
+
+	if err := sc.SetJob(JobConfig{Name: "bad", Schedule: "@daily"}); err == nil {
+		t.Fatalf("Expected error for job without a command")
+	}
+
+	jobs := sc.Jobs()
+	if len(jobs) != 2 {
+		t.Fatalf("Expected %d jobs. Got %d", 2, len(jobs))
+	}
+
+	if jobs[0].Name != "cleanup" || jobs[1].Name != "report" {
+		t.Fatalf("Expected jobs sorted by name. Got %s, %s", jobs[0].Name, jobs[1].Name)
+	}
+
+	if jobs[1].Schedule != "0 6 * * *" || jobs[1].Command != "bin/report" {
+		t.Fatalf("Expected 0 6 * * * bin/report. Got %s %s", jobs[1].Schedule, jobs[1].Command)
+	}
+
+	// jobs don't change what the app's containers run with
+	id, rev := sc.ID(), sc.revision()
+	sc.RemoveJob("cleanup")
+	if sc.revision() <= rev {
+		t.Fatalf("Expected the revision to increment")
+	}
+	if sc.ID() != id {
+		t.Fatalf("Expected ID %d to stay the same. Got %d", id, sc.ID())
+	}
+
+	jobs = sc.Jobs()
+	if len(jobs) != 1 || jobs[0].Name != "report" {
+		t.Fatalf("Expected only report job. Got %v", jobs)
+	}
+}
+
+func TestDepends(t *testing.T) {
+
+	sc := NewAppConfig("foo", "")
+	sc.EnvSet("GALAXY_DEPENDS", "worker, redis")
+
+	depends := sc.Depends()
+	if !reflect.DeepEqual(depends, []string{"redis", "worker"}) {
+		t.Fatalf("Expected [redis worker]. Got %v", depends)
+	}
+
+	sc.EnvSet("GALAXY_DEPENDS", "redis,search")
+	depends = sc.Depends()
+	if !reflect.DeepEqual(depends, []string{"redis", "search"}) {
+		t.Fatalf("Expected [redis search]. Got %v", depends)
+	}
+
+	sc.EnvSet("GALAXY_DEPENDS", "")
+	if depends := sc.Depends(); len(depends) != 0 {
+		t.Fatalf("Expected no dependencies. Got %v", depends)
+	}
+}
+
+func TestCanary(t *testing.T) {
+
+	sc := NewAppConfig("foo", "foo:1")
+	sc.SetVersionID("abc")
+	stableID := sc.Stable().ID()
+
+	sc.SetCanary("foo:2", "def", 10)
+	if sc.CanaryVersion() != "foo:2" || sc.CanaryVersionID() != "def" || sc.CanaryPercent() != 10 {
+		t.Fatalf("Expected canary foo:2 def 10. Got %s %s %d", sc.CanaryVersion(), sc.CanaryVersionID(), sc.CanaryPercent())
+	}
+
+	stable := sc.Stable()
+	if stable.ID() != stableID || stable.Version() != "foo:1" || stable.CanaryVersion() != "" {
+		t.Fatalf("Expected stable v%d foo:1. Got v%d %s", stableID, stable.ID(), stable.Version())
+	}
+
+	canary := sc.Canary()
+	if canary.Version() != "foo:2" || canary.VersionID() != "def" || canary.EnvGet("GALAXY_CANARY") != "10" {
+		t.Fatalf("Expected canary foo:2 def with GALAXY_CANARY=10. Got %s %s %q",
+			canary.Version(), canary.VersionID(), canary.EnvGet("GALAXY_CANARY"))
+	}
+	if canary.ID() == stableID {
+		t.Fatalf("Expected canary version to differ from stable v%d", stableID)
+	}
+	if sc.Version() != "foo:1" || sc.EnvGet("GALAXY_CANARY") != "" {
+		t.Fatalf("Expected Canary() to leave the config alone. Got %s %q", sc.Version(), sc.EnvGet("GALAXY_CANARY"))
+	}
+
+	sc.ClearCanary()
+	if sc.CanaryVersion() != "" || sc.CanaryPercent() != 0 {
+		t.Fatalf("Expected no canary. Got %s %d", sc.CanaryVersion(), sc.CanaryPercent())
+	}
+	if sc.Stable().ID() != stableID {
+		t.Fatalf("Expected stable v%d. Got v%d", stableID, sc.Stable().ID())
+	}
+}
+
+func TestGreen(t *testing.T) {
+
+	sc := NewAppConfig("foo", "foo:1")
+	sc.SetVersionID("abc")
+	blueID := sc.Stable().ID()
+	if sc.LiveColor() != "" {
+		t.Fatalf("Expected no live color. Got %s", sc.LiveColor())
+	}
+
+	sc.SetGreen("foo:2", "def")
+	if sc.LiveColor() != "blue" || sc.Stable().ID() != blueID {
+		t.Fatalf("Expected blue live at v%d. Got %s at v%d", blueID, sc.LiveColor(), sc.Stable().ID())
+	}
+
+	green := sc.Green()
+	if green.Version() != "foo:2" || green.VersionID() != "def" || green.EnvGet("GALAXY_COLOR") != "green" {
+		t.Fatalf("Expected green foo:2 def with GALAXY_COLOR=green. Got %s %s %q",
+			green.Version(), green.VersionID(), green.EnvGet("GALAXY_COLOR"))
+	}
+	if green.ContainerName() != "foo-green_"+strconv.FormatInt(green.ID(), 10) {
+		t.Fatalf("Expected foo-green_%d. Got %s", green.ID(), green.ContainerName())
+	}
+	greenID := green.ID()
+
+	sc.SetLiveColor("green")
+	if sc.LiveColor() != "green" || sc.Green().ID() != greenID || sc.Stable().ID() != blueID {
+		t.Fatalf("Expected cutover to keep v%d and v%d. Got %s, v%d and v%d",
+			blueID, greenID, sc.LiveColor(), sc.Stable().ID(), sc.Green().ID())
+	}
+
+	sc.SetGreen("foo:3", "ghi")
+	if sc.Green().ID() == greenID || sc.Stable().ID() != blueID {
+		t.Fatalf("Expected a new green version to only change green. Got v%d and v%d", sc.Stable().ID(), sc.Green().ID())
+	}
+}
@@ -1,5 +1,15 @@
 package config
 
+import (
+	"errors"
+
+	"github.com/litl/galaxy/utils"
+)
+
+// ErrConflict is returned by UpdateApp when the app's config was changed
+// by someone else since it was loaded.  Reload the app and retry.
+var ErrConflict = errors.New("config was changed concurrently")
+
 type Backend interface {
 	// Apps
 	AppExists(app, env string) (bool, error)
@@ -32,3 +42,16 @@ type Backend interface {
 	Connect()
 	Reconnect()
 }
+
+// statusReporter is implemented by backends that track their connection
+// health.
+type statusReporter interface {
+	Status() utils.BackendStatus
+}
+
+// keyWatcher is implemented by backends that can report writes to keys
+// made outside of galaxy.  An empty key is sent when writes may have been
+// missed, e.g. after reconnecting.
+type keyWatcher interface {
+	WatchKeys(pattern string) chan string
+}
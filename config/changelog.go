@@ -0,0 +1,181 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/utils"
+)
+
+// MaxChanges is the number of entries kept in each env's change log.
+const MaxChanges = 1000
+
+var ErrNoChangeLog = errors.New("backend does not keep a change log")
+
+// Change is an entry in an env's config change log.  OldID is 0 for a
+// newly created app and NewID is 0 for a deleted one.  DeployID, Version
+// and VersionID are the config's deploy ID and image after the change, and
+// Changes describes what the change did, see changedSince.  RolledBack is
+// the version a rollback replaced because it kept failing.
+type Change struct {
+	Time       time.Time `json:"time"`
+	Actor      string    `json:"actor"`
+	App        string    `json:"app"`
+	Op         string    `json:"op"`
+	OldID      int64     `json:"old_id"`
+	NewID      int64     `json:"new_id"`
+	DeployID   string    `json:"deploy_id,omitempty"`
+	Version    string    `json:"version,omitempty"`
+	VersionID  string    `json:"version_id,omitempty"`
+	Changes    []string  `json:"changes,omitempty"`
+	RolledBack string    `json:"rolled_back,omitempty"`
+}
+
+// changeLogger is implemented by backends that keep a change log.
+type changeLogger interface {
+	LogChange(env string, change *Change) error
+	// ListChanges returns up to limit changes to app, or all apps if app
+	// is "", newest first.
+	ListChanges(env, app string, limit int) ([]*Change, error)
+}
+
+// DefaultActor identifies the current user and host, e.g. "alice@ops1".
+func DefaultActor() string {
+	user := os.Getenv("USER")
+	if user == "" {
+		user = "unknown"
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return user
+	}
+	return user + "@" + host
+}
+
+func (r *Store) logChange(env, op, app string, oldID int64, svcCfg *AppConfig, rolledBack string) {
+	logger, ok := r.Backend.(changeLogger)
+	if !ok {
+		return
+	}
+
+	change := &Change{
+		Time:       time.Now().UTC(),
+		Actor:      r.Actor,
+		App:        app,
+		Op:         op,
+		OldID:      oldID,
+		RolledBack: rolledBack,
+	}
+	// deleted apps have no config left
+	if svcCfg != nil {
+		change.NewID = svcCfg.revision()
+		change.DeployID = svcCfg.DeployID()
+		change.Version = svcCfg.Version()
+		change.VersionID = svcCfg.VersionID()
+		change.Changes = svcCfg.changedSince(oldID)
+	}
+
+	err := logger.LogChange(env, change)
+	if err != nil {
+		log.Warnf("WARN: Unable to log %s of %s: %s", op, app, err)
+	}
+}
+
+// changedSince describes each value in s set after version id, e.g.
+// "version: web:1 -> web:2" or "env GALAXY_PORT: changed".  Env, sidecar and
+// job values are left out since they can hold secrets.
+func (s *AppConfig) changedSince(id int64) []string {
+	changes := []string{}
+	for _, m := range []struct {
+		name   string
+		vmap   *utils.VersionedMap
+		values bool
+	}{
+		{"", s.versionVMap, true},
+		{"env", s.environmentVMap, false},
+		{"ports", s.portsVMap, true},
+		{"runtime", s.runtimeVMap, true},
+		{"sidecar", s.sidecarsVMap, false},
+		{"canary", s.canaryVMap, true},
+		{"colors", s.colorsVMap, true},
+		{"job", s.jobsVMap, false},
+		// the values are only "true", so set and unset say more
+		{"depends", s.dependsVMap, false},
+	} {
+		keys := m.vmap.Keys()
+		sort.Strings(keys)
+		for _, k := range keys {
+			if m.vmap.Version(k) <= id || k == "deployID" && m.vmap == s.versionVMap {
+				continue
+			}
+			old, current := m.vmap.GetAt(k, id), m.vmap.Get(k)
+			if old == current {
+				continue
+			}
+
+			label := strings.TrimSpace(m.name + " " + k)
+			switch {
+			case m.values:
+				changes = append(changes, fmt.Sprintf("%s: %s -> %s", label, orNone(old), orNone(current)))
+			case old == "":
+				changes = append(changes, label+": set")
+			case current == "":
+				changes = append(changes, label+": unset")
+			default:
+				changes = append(changes, label+": changed")
+			}
+		}
+	}
+	return changes
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return "none"
+	}
+	return value
+}
+
+// History returns up to limit changes made to app, or every app if app is
+// "", newest first.
+func (r *Store) History(env, app string, limit int) ([]*Change, error) {
+	logger, ok := r.Backend.(changeLogger)
+	if !ok {
+		return nil, ErrNoChangeLog
+	}
+	return logger.ListChanges(env, app, limit)
+}
+
+// filterChanges decodes the JSON encoded changes and returns up to limit
+// of them for app, newest first.
+func filterChanges(encoded []string, app string, limit int) ([]*Change, error) {
+	changes := []*Change{}
+	for _, e := range encoded {
+		change := &Change{}
+		if err := json.Unmarshal([]byte(e), change); err != nil {
+			return nil, err
+		}
+		if app == "" || change.App == app {
+			changes = append(changes, change)
+		}
+	}
+
+	sort.Sort(sort.Reverse(changesByTime(changes)))
+	if limit > 0 && len(changes) > limit {
+		changes = changes[:limit]
+	}
+	return changes, nil
+}
+
+type changesByTime []*Change
+
+func (l changesByTime) Len() int           { return len(l) }
+func (l changesByTime) Less(i, j int) bool { return l[i].Time.Before(l[j].Time) }
+func (l changesByTime) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
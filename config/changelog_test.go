@@ -0,0 +1,86 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChangedSince(t *testing.T) {
+	sc := NewAppConfig("foo", "foo:1")
+	sc.EnvSet("GALAXY_PORT", "10000")
+	sc.EnvSet("SECRET", "hunter2")
+	sc.SetProcesses("web", 1)
+	sc.EnvSet("GALAXY_DEPENDS", "db")
+	since := sc.ID()
+
+	sc.SetVersion("foo:2")
+	sc.setDeployID("1a2b3c4d")
+	sc.EnvSet("GALAXY_PORT", "10001")
+	sc.EnvSet("SECRET", "")
+	sc.EnvSet("NEW", "value")
+	sc.SetProcesses("web", 2)
+	sc.EnvSet("GALAXY_DEPENDS", "redis")
+
+	want := []string{
+		"version: foo:1 -> foo:2",
+		"env GALAXY_DEPENDS: changed",
+		"env GALAXY_PORT: changed",
+		"env NEW: set",
+		"env SECRET: unset",
+		"runtime web-ps: 1 -> 2",
+		"depends db: unset",
+		"depends redis: set",
+	}
+	if got := sc.changedSince(since); !reflect.DeepEqual(got, want) {
+		t.Fatalf("changedSince() = %#v, want %#v", got, want)
+	}
+
+	if got := sc.changedSince(sc.ID()); len(got) != 0 {
+		t.Fatalf("changedSince(ID()) = %#v, want none", got)
+	}
+}
+
+func TestChangedSincePorts(t *testing.T) {
+	sc := NewAppConfig("foo", "foo:1")
+	sc.AddPort("8000", "tcp")
+	sc.AddPort("9000", "udp")
+	since := sc.ID()
+
+	// what a rollback to an image exposing other ports does
+	sc.ClearPorts()
+	sc.AddPort("8000", "tcp")
+	sc.AddPort("8080", "tcp")
+
+	want := []string{
+		"ports 8080: none -> tcp",
+		"ports 9000: udp -> none",
+	}
+	if got := sc.changedSince(since); !reflect.DeepEqual(got, want) {
+		t.Fatalf("changedSince() = %#v, want %#v", got, want)
+	}
+}
+
+func TestRollbackAppLogsFailed(t *testing.T) {
+	r, cleanup := NewTestFileStore(t)
+	defer cleanup()
+
+	if _, err := r.CreateApp("web", "dev"); err != nil {
+		t.Fatal(err)
+	}
+	svcCfg, err := r.GetApp("web", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svcCfg.SetVersion("web:1")
+	if _, err := r.RollbackApp(svcCfg, "dev", "web:2"); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := r.History("dev", "web", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Version != "web:1" || changes[0].RolledBack != "web:2" {
+		t.Fatalf("History() = %v, want the rollback from web:2", changes)
+	}
+}
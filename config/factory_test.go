@@ -0,0 +1,34 @@
+package config
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestRegisterBackend(t *testing.T) {
+	var connected *url.URL
+	backend := NewMemoryBackend()
+	RegisterBackend("Test", func(u url.URL) Backend {
+		connected = &u
+		return backend
+	})
+
+	r := NewStore(DefaultTTL)
+	r.Connect("test://example.com/galaxy")
+
+	if connected == nil || connected.Host != "example.com" || connected.Path != "/galaxy" {
+		t.Fatalf("factory called with %v, want %s", connected, "test://example.com/galaxy")
+	}
+
+	if r.Backend != backend {
+		t.Fatalf("Backend = %T, want the registered backend", r.Backend)
+	}
+}
+
+func TestBuiltinBackends(t *testing.T) {
+	for _, scheme := range []string{"redis", "rediss", "redis+sentinel", "redis+cluster", "file", "postgres"} {
+		if _, ok := lookupBackend(scheme); !ok {
+			t.Errorf("no backend registered for %s", scheme)
+		}
+	}
+}
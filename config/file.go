@@ -0,0 +1,336 @@
+package config
+
+import (
+	"encoding/json"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/litl/galaxy/utils"
+)
+
+// FileBackend stores config in a JSON file on disk.  It's meant for running
+// galaxy on a single host without redis.
+type FileBackend struct {
+	Path  string
+	store *utils.FileStore
+}
+
+func (f *FileBackend) Connect() {
+	f.store = utils.NewFileStore(f.Path)
+}
+
+func (f *FileBackend) Reconnect() {
+	if f.store != nil {
+		// ends subscriptions so they resubscribe to the new store
+		f.store.Close()
+	}
+	f.Connect()
+}
+
+func (f *FileBackend) AppExists(app, env string) (bool, error) {
+	matches, err := f.store.Keys(path.Join(env, app, "*"))
+	if err != nil {
+		return false, err
+	}
+	return len(matches) > 0, nil
+}
+
+func (f *FileBackend) CreateApp(app, env string) (bool, error) {
+	emptyConfig := NewAppConfig(app, "")
+	return f.UpdateApp(emptyConfig, env)
+}
+
+func (f *FileBackend) ListApps(env string) ([]*AppConfig, error) {
+	apps, err := f.store.Keys(path.Join(env, "*", "version"))
+	if err != nil {
+		return nil, err
+	}
+
+	var appList []*AppConfig
+	for _, app := range apps {
+		parts := strings.Split(app, "/")
+
+		// app entries should be 3 parts, /env/pool/app
+		if len(parts) != 3 {
+			continue
+		}
+
+		// we don't want host keys
+		if parts[1] == "hosts" {
+			continue
+		}
+
+		cfg, err := f.GetApp(parts[1], env)
+		if err != nil {
+			return nil, err
+		}
+
+		appList = append(appList, cfg)
+	}
+
+	return appList, nil
+}
+
+func (f *FileBackend) GetApp(app, env string) (*AppConfig, error) {
+	svcCfg := NewAppConfig(path.Base(app), "")
+
+	for k, vmap := range svcCfg.vmaps() {
+		err := f.loadVMap(path.Join(env, app, k), vmap)
+		if err != nil {
+			return nil, err
+		}
+	}
+	svcCfg.loadedID = svcCfg.revision()
+	return svcCfg, nil
+}
+
+func (f *FileBackend) UpdateApp(svcCfg *AppConfig, env string) (bool, error) {
+	values := make(map[string]map[string]string)
+	for k, vmap := range svcCfg.vmaps() {
+		values[path.Join(env, svcCfg.Name, k)] = vmap.MarshalMap()
+	}
+
+	saved, err := f.store.SetMultiIf(values, func(current map[string]map[string]string) bool {
+		id := int64(0)
+		for _, hash := range current {
+			if v := utils.SerializedVersion(hash); v > id {
+				id = v
+			}
+		}
+		return id == svcCfg.loadedID
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if !saved {
+		return false, ErrConflict
+	}
+	svcCfg.loadedID = svcCfg.revision()
+
+	for k, vmap := range svcCfg.vmaps() {
+		err := f.gcVMap(path.Join(env, svcCfg.Name, k), vmap)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (f *FileBackend) DeleteApp(svcCfg *AppConfig, env string) (bool, error) {
+	deletedOne := false
+	for k := range svcCfg.vmaps() {
+		deleted, err := f.store.Delete(path.Join(env, svcCfg.Name, k))
+		if err != nil {
+			return false, err
+		}
+		deletedOne = deletedOne || deleted == 1
+	}
+	return deletedOne, nil
+}
+
+func (f *FileBackend) AssignApp(app, env, pool string) (bool, error) {
+	added, err := f.store.AddMember(path.Join(env, "pools", pool), app)
+	return added == 1, err
+}
+
+func (f *FileBackend) UnassignApp(app, env, pool string) (bool, error) {
+	removed, err := f.store.RemoveMember(path.Join(env, "pools", pool), app)
+	return removed == 1, err
+}
+
+func (f *FileBackend) ListAssignments(env, pool string) ([]string, error) {
+	return f.store.Members(path.Join(env, "pools", pool))
+}
+
+func (f *FileBackend) CreatePool(env, pool string) (bool, error) {
+	added, err := f.store.AddMember(path.Join(env, "pools", "*"), pool)
+	return added == 1, err
+}
+
+func (f *FileBackend) DeletePool(env, pool string) (bool, error) {
+	removed, err := f.store.RemoveMember(path.Join(env, "pools", "*"), pool)
+	return removed == 1, err
+}
+
+func (f *FileBackend) ListPools(env string) ([]string, error) {
+	pools := []string{}
+
+	keys, err := f.store.Keys(path.Join(env, "*", "hosts", "*", "info"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, k := range keys {
+		pool := strings.Split(k, "/")[1]
+		if !utils.StringInSlice(pool, pools) {
+			pools = append(pools, pool)
+		}
+	}
+
+	keys, err = f.store.Keys(path.Join(env, "pools", "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, k := range keys {
+		pool := strings.Split(k, "/")[2]
+		if pool == "*" {
+			continue
+		}
+		if !utils.StringInSlice(pool, pools) {
+			pools = append(pools, pool)
+		}
+	}
+
+	return pools, nil
+}
+
+func (f *FileBackend) ListEnvs() ([]string, error) {
+	envs := []string{}
+	apps, err := f.store.Keys(path.Join("*", "*", "environment"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, app := range apps {
+		env := strings.Split(app, "/")[0]
+		if !utils.StringInSlice(env, envs) {
+			envs = append(envs, env)
+		}
+	}
+	return envs, nil
+}
+
+func (f *FileBackend) UpdateHost(env, pool string, host HostInfo) error {
+	key := path.Join(env, pool, "hosts", host.HostIP, "info")
+	existing := utils.NewVersionedMap()
+
+	err := f.loadVMap(key, existing)
+	if err != nil {
+		return err
+	}
+
+	if updateHostFields(existing, host) {
+		err = f.saveVMap(key, existing)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = f.store.Expire(key, DefaultTTL)
+	return err
+}
+
+func (f *FileBackend) ListHosts(env, pool string) ([]HostInfo, error) {
+	keys, err := f.store.Keys(path.Join(env, pool, "hosts", "*", "info"))
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := []HostInfo{}
+	for _, k := range keys {
+		existing := utils.NewVersionedMap()
+		err := f.loadVMap(k, existing)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, hostInfoFrom(existing))
+	}
+	return hosts, nil
+}
+
+func (f *FileBackend) DeleteHost(env, pool string, host HostInfo) error {
+	_, err := f.store.Delete(path.Join(env, pool, "hosts", host.HostIP, "info"))
+	return err
+}
+
+func (f *FileBackend) Subscribe(key string) chan string {
+	msgs := make(chan string)
+	err := f.store.Subscribe(key, msgs)
+	if err != nil {
+		log.Printf("ERROR: Unable to watch %s: %s\n", f.Path, err)
+		return msgs
+	}
+	log.Printf("Monitoring for config changes in %s on channel: %s\n", f.Path, key)
+	return msgs
+}
+
+func (f *FileBackend) Notify(key, value string) (int, error) {
+	return f.store.Publish(key, value)
+}
+
+// LogChange adds change to the env's change log.  The store has no sorted
+// sets, so entries are kept in a set and ordered by time when read.
+func (f *FileBackend) LogChange(env string, change *Change) error {
+	entry, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	key := path.Join(env, "changelog")
+	if _, err := f.store.AddMember(key, string(entry)); err != nil {
+		return err
+	}
+
+	entries, err := f.store.Members(key)
+	if err != nil || len(entries) <= MaxChanges {
+		return err
+	}
+
+	changes, err := filterChanges(entries, "", 0)
+	if err != nil {
+		return err
+	}
+	for _, old := range changes[MaxChanges:] {
+		oldEntry, err := json.Marshal(old)
+		if err != nil {
+			return err
+		}
+		f.store.RemoveMember(key, string(oldEntry))
+	}
+	return nil
+}
+
+func (f *FileBackend) ListChanges(env, app string, limit int) ([]*Change, error) {
+	entries, err := f.store.Members(path.Join(env, "changelog"))
+	if err != nil {
+		return nil, err
+	}
+	return filterChanges(entries, app, limit)
+}
+
+func (f *FileBackend) loadVMap(key string, dest *utils.VersionedMap) error {
+	serialized, err := f.store.GetAll(key)
+	if err != nil {
+		return err
+	}
+	return dest.UnmarshalMap(serialized)
+}
+
+func (f *FileBackend) saveVMap(key string, vmap *utils.VersionedMap) error {
+	serialized := vmap.MarshalMap()
+	if len(serialized) == 0 {
+		return nil
+	}
+
+	_, err := f.store.SetMulti(key, serialized)
+	if err != nil {
+		return err
+	}
+	return f.gcVMap(key, vmap)
+}
+
+func (f *FileBackend) gcVMap(key string, vmap *utils.VersionedMap) error {
+	var err error
+	expired := vmap.MarshalExpiredMap(5)
+	if len(expired) > 0 {
+		fields := []string{}
+		for k := range expired {
+			fields = append(fields, k)
+		}
+		_, err = f.store.DeleteMulti(key, fields...)
+	}
+	return err
+}
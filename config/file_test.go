@@ -0,0 +1,182 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func NewTestFileStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "galaxy-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewStore(DefaultTTL)
+	r.Connect("file://" + filepath.Join(dir, "galaxy.json"))
+	return r, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFileBackendApps(t *testing.T) {
+	r, cleanup := NewTestFileStore(t)
+	defer cleanup()
+
+	assertAppCreated(t, r, "app")
+	assertAppExists(t, r, "app")
+
+	cfg, err := r.GetApp("app", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.SetVersion("registry/app:1")
+	cfg.EnvSet("FOO", "bar")
+	if updated, err := r.UpdateApp(cfg, "dev"); !updated || err != nil {
+		t.Fatalf("UpdateApp() = %t, %v, want %t, %v", updated, err, true, nil)
+	}
+
+	apps, err := r.ListApps("dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(apps) != 1 {
+		t.Fatalf("ListApps() = %d, want %d", len(apps), 1)
+	}
+
+	if apps[0].Version() != "registry/app:1" || apps[0].EnvGet("FOO") != "bar" {
+		t.Fatalf("ListApps()[0] = %s %v, want %s %v", apps[0].Version(), apps[0].Env(),
+			"registry/app:1", map[string]string{"FOO": "bar"})
+	}
+
+	if apps[0].ID() != cfg.ID() {
+		t.Fatalf("ID() = %d, want %d", apps[0].ID(), cfg.ID())
+	}
+
+	envs, err := r.ListEnvs()
+	if err != nil || len(envs) != 1 || envs[0] != "dev" {
+		t.Fatalf("ListEnvs() = %v, %v, want %v, %v", envs, err, []string{"dev"}, nil)
+	}
+}
+
+func TestFileBackendDependencies(t *testing.T) {
+	r, cleanup := NewTestFileStore(t)
+	defer cleanup()
+
+	assertAppCreated(t, r, "app")
+	cfg, err := r.GetApp("app", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.EnvSet("GALAXY_DEPENDS", "redis,worker")
+	if updated, err := r.UpdateApp(cfg, "dev"); !updated || err != nil {
+		t.Fatalf("UpdateApp() = %t, %v, want %t, %v", updated, err, true, nil)
+	}
+
+	depends, err := r.Dependencies("app", "dev")
+	if err != nil || len(depends) != 2 || depends[0] != "redis" || depends[1] != "worker" {
+		t.Fatalf("Dependencies() = %v, %v, want %v, %v", depends, err, []string{"redis", "worker"}, nil)
+	}
+}
+
+func TestFileBackendCanary(t *testing.T) {
+	r, cleanup := NewTestFileStore(t)
+	defer cleanup()
+
+	assertAppCreated(t, r, "app")
+	cfg, err := r.GetApp("app", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.SetCanary("app:2", "abc", 10)
+	if updated, err := r.UpdateApp(cfg, "dev"); !updated || err != nil {
+		t.Fatalf("UpdateApp() = %t, %v, want %t, %v", updated, err, true, nil)
+	}
+
+	cfg, err = r.GetApp("app", "dev")
+	if err != nil || cfg.CanaryVersion() != "app:2" || cfg.CanaryPercent() != 10 {
+		t.Fatalf("GetApp() canary = %v, %v, want %v, %v", cfg.CanaryVersion(), err, "app:2", nil)
+	}
+}
+
+func TestFileBackendPools(t *testing.T) {
+	r, cleanup := NewTestFileStore(t)
+	defer cleanup()
+
+	assertAppCreated(t, r, "app")
+	assertPoolCreated(t, r, "web")
+
+	if assigned, err := r.AssignApp("app", "dev", "web"); !assigned || err != nil {
+		t.Fatalf("AssignApp() = %t, %v, want %t, %v", assigned, err, true, nil)
+	}
+
+	pools, err := r.ListAssignedPools("dev", "app")
+	if err != nil || len(pools) != 1 || pools[0] != "web" {
+		t.Fatalf("ListAssignedPools() = %v, %v, want %v, %v", pools, err, []string{"web"}, nil)
+	}
+
+	if err := r.UpdateHost("dev", "web", HostInfo{HostIP: "10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	hosts, err := r.ListHosts("dev", "web")
+	if err != nil || len(hosts) != 1 || hosts[0].HostIP != "10.0.0.1" {
+		t.Fatalf("ListHosts() = %v, %v, want %v, %v", hosts, err, "10.0.0.1", nil)
+	}
+
+	host := HostInfo{HostIP: "10.0.0.1", Memory: 8 << 30, CPUs: 4, Containers: 2, Version: "1.0", Conflicts: 1,
+		DockerVersion: "1.9.1", DockerAPIVersion: "1.21"}
+	if err := r.UpdateHost("dev", "web", host); err != nil {
+		t.Fatal(err)
+	}
+
+	hosts, err = r.ListHosts("dev", "web")
+	if err != nil || len(hosts) != 1 || hosts[0] != host {
+		t.Fatalf("ListHosts() = %v, %v, want %v, %v", hosts, err, []HostInfo{host}, nil)
+	}
+}
+
+func TestFileBackendHistory(t *testing.T) {
+	r, cleanup := NewTestFileStore(t)
+	defer cleanup()
+	r.Actor = "tester"
+
+	assertAppCreated(t, r, "app")
+	cfg, err := r.GetApp("app", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldID := cfg.ID()
+	cfg.EnvSet("FOO", "bar")
+	if updated, err := r.UpdateApp(cfg, "dev"); !updated || err != nil {
+		t.Fatalf("UpdateApp() = %t, %v, want %t, %v", updated, err, true, nil)
+	}
+
+	changes, err := r.History("dev", "app", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(changes) != 2 {
+		t.Fatalf("History() returned %d changes, want 2", len(changes))
+	}
+
+	update := changes[0]
+	if update.Op != "update" || update.OldID != oldID || update.NewID != cfg.ID() || update.Actor != "tester" {
+		t.Errorf("unexpected update change: %+v", update)
+	}
+
+	if changes[1].Op != "create" || changes[1].OldID != 0 {
+		t.Errorf("unexpected create change: %+v", changes[1])
+	}
+
+	if changes, _ := r.History("dev", "other", 0); len(changes) != 0 {
+		t.Errorf("History() for another app returned %d changes, want 0", len(changes))
+	}
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"encoding/json"
 	"regexp"
 	"strings"
 
@@ -16,6 +17,7 @@ type MemoryBackend struct {
 	maps        map[string]map[string]string
 	apps        map[string][]*AppConfig // env -> []app
 	assignments map[string][]string
+	changes     map[string][]string
 
 	AppExistsFunc       func(app, env string) (bool, error)
 	CreateAppFunc       func(app, env string) (bool, error)
@@ -199,6 +201,26 @@ func (r *MemoryBackend) ListEnvs() ([]string, error) {
 	return p, nil
 }
 
+func (r *MemoryBackend) LogChange(env string, change *Change) error {
+	entry, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	if r.changes == nil {
+		r.changes = make(map[string][]string)
+	}
+	r.changes[env] = append(r.changes[env], string(entry))
+	if len(r.changes[env]) > MaxChanges {
+		r.changes[env] = r.changes[env][1:]
+	}
+	return nil
+}
+
+func (r *MemoryBackend) ListChanges(env, app string, limit int) ([]*Change, error) {
+	return filterChanges(r.changes[env], app, limit)
+}
+
 func (r *MemoryBackend) Connect() {
 }
 
@@ -0,0 +1,334 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/utils"
+)
+
+// MirrorBackend writes to both Primary and Secondary and reads only from
+// Primary.  It's used to migrate between backends: run with the new backend
+// as the Secondary until Verify reports no differences, then cut over.
+// Failed writes to the Secondary are logged but never fail the operation.
+type MirrorBackend struct {
+	Primary   Backend
+	Secondary Backend
+}
+
+func (m *MirrorBackend) mirrorErr(op string, err error) {
+	if err != nil {
+		log.Warnf("WARN: Unable to mirror %s: %s", op, err)
+	}
+}
+
+func (m *MirrorBackend) AppExists(app, env string) (bool, error) {
+	return m.Primary.AppExists(app, env)
+}
+
+func (m *MirrorBackend) CreateApp(app, env string) (bool, error) {
+	created, err := m.Primary.CreateApp(app, env)
+	if err != nil {
+		return created, err
+	}
+
+	_, serr := m.Secondary.CreateApp(app, env)
+	m.mirrorErr("create of "+app, serr)
+	return created, err
+}
+
+func (m *MirrorBackend) ListApps(env string) ([]*AppConfig, error) {
+	return m.Primary.ListApps(env)
+}
+
+func (m *MirrorBackend) GetApp(app, env string) (*AppConfig, error) {
+	return m.Primary.GetApp(app, env)
+}
+
+func (m *MirrorBackend) UpdateApp(svcCfg *AppConfig, env string) (bool, error) {
+	updated, err := m.Primary.UpdateApp(svcCfg, env)
+	if !updated || err != nil {
+		return updated, err
+	}
+
+	// svcCfg was loaded from the primary so its ID won't match the
+	// secondary's.  Save a copy based on what the secondary has.
+	mirrored := copyAppConfig(svcCfg)
+	current, serr := m.Secondary.GetApp(svcCfg.Name, env)
+	if serr == nil && current != nil {
+		mirrored.loadedID = current.revision()
+	}
+
+	if serr == nil {
+		_, serr = m.Secondary.UpdateApp(mirrored, env)
+	}
+	m.mirrorErr("update of "+svcCfg.Name, serr)
+	return updated, err
+}
+
+func (m *MirrorBackend) DeleteApp(svcCfg *AppConfig, env string) (bool, error) {
+	deleted, err := m.Primary.DeleteApp(svcCfg, env)
+	if err != nil {
+		return deleted, err
+	}
+
+	_, serr := m.Secondary.DeleteApp(svcCfg, env)
+	m.mirrorErr("delete of "+svcCfg.Name, serr)
+	return deleted, err
+}
+
+func (m *MirrorBackend) AssignApp(app, env, pool string) (bool, error) {
+	assigned, err := m.Primary.AssignApp(app, env, pool)
+	if err != nil {
+		return assigned, err
+	}
+
+	_, serr := m.Secondary.AssignApp(app, env, pool)
+	m.mirrorErr("assignment of "+app, serr)
+	return assigned, err
+}
+
+func (m *MirrorBackend) UnassignApp(app, env, pool string) (bool, error) {
+	unassigned, err := m.Primary.UnassignApp(app, env, pool)
+	if err != nil {
+		return unassigned, err
+	}
+
+	_, serr := m.Secondary.UnassignApp(app, env, pool)
+	m.mirrorErr("unassignment of "+app, serr)
+	return unassigned, err
+}
+
+func (m *MirrorBackend) ListAssignments(env, pool string) ([]string, error) {
+	return m.Primary.ListAssignments(env, pool)
+}
+
+func (m *MirrorBackend) CreatePool(env, pool string) (bool, error) {
+	created, err := m.Primary.CreatePool(env, pool)
+	if err != nil {
+		return created, err
+	}
+
+	_, serr := m.Secondary.CreatePool(env, pool)
+	m.mirrorErr("create of pool "+pool, serr)
+	return created, err
+}
+
+func (m *MirrorBackend) DeletePool(env, pool string) (bool, error) {
+	deleted, err := m.Primary.DeletePool(env, pool)
+	if err != nil {
+		return deleted, err
+	}
+
+	_, serr := m.Secondary.DeletePool(env, pool)
+	m.mirrorErr("delete of pool "+pool, serr)
+	return deleted, err
+}
+
+func (m *MirrorBackend) ListPools(env string) ([]string, error) {
+	return m.Primary.ListPools(env)
+}
+
+func (m *MirrorBackend) ListEnvs() ([]string, error) {
+	return m.Primary.ListEnvs()
+}
+
+func (m *MirrorBackend) UpdateHost(env, pool string, host HostInfo) error {
+	err := m.Primary.UpdateHost(env, pool, host)
+	if err != nil {
+		return err
+	}
+
+	m.mirrorErr("host "+host.HostIP, m.Secondary.UpdateHost(env, pool, host))
+	return nil
+}
+
+func (m *MirrorBackend) ListHosts(env, pool string) ([]HostInfo, error) {
+	return m.Primary.ListHosts(env, pool)
+}
+
+func (m *MirrorBackend) DeleteHost(env, pool string, host HostInfo) error {
+	err := m.Primary.DeleteHost(env, pool, host)
+	if err != nil {
+		return err
+	}
+
+	m.mirrorErr("delete of host "+host.HostIP, m.Secondary.DeleteHost(env, pool, host))
+	return nil
+}
+
+func (m *MirrorBackend) Subscribe(key string) chan string {
+	return m.Primary.Subscribe(key)
+}
+
+func (m *MirrorBackend) WatchKeys(pattern string) chan string {
+	if backend, ok := m.Primary.(keyWatcher); ok {
+		return backend.WatchKeys(pattern)
+	}
+	return nil
+}
+
+func (m *MirrorBackend) LogChange(env string, change *Change) error {
+	logger, ok := m.Primary.(changeLogger)
+	if !ok {
+		return ErrNoChangeLog
+	}
+
+	err := logger.LogChange(env, change)
+	if err != nil {
+		return err
+	}
+
+	if secondary, ok := m.Secondary.(changeLogger); ok {
+		m.mirrorErr("change log", secondary.LogChange(env, change))
+	}
+	return nil
+}
+
+func (m *MirrorBackend) ListChanges(env, app string, limit int) ([]*Change, error) {
+	logger, ok := m.Primary.(changeLogger)
+	if !ok {
+		return nil, ErrNoChangeLog
+	}
+	return logger.ListChanges(env, app, limit)
+}
+
+// Notify only publishes on the primary, which is where subscribers listen.
+func (m *MirrorBackend) Notify(key, value string) (int, error) {
+	return m.Primary.Notify(key, value)
+}
+
+func (m *MirrorBackend) Connect() {
+	m.Primary.Connect()
+	m.Secondary.Connect()
+}
+
+func (m *MirrorBackend) Reconnect() {
+	m.Primary.Reconnect()
+	m.Secondary.Reconnect()
+}
+
+// Verify compares the apps, pools and assignments of env in both backends
+// and returns a description of each difference.
+func (m *MirrorBackend) Verify(env string) ([]string, error) {
+	diffs := []string{}
+
+	primaryApps, err := appIDs(m.Primary, env)
+	if err != nil {
+		return nil, err
+	}
+
+	secondaryApps, err := appIDs(m.Secondary, env)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, app := range sortedKeys(primaryApps, secondaryApps) {
+		p, inPrimary := primaryApps[app]
+		s, inSecondary := secondaryApps[app]
+		switch {
+		case !inSecondary:
+			diffs = append(diffs, fmt.Sprintf("app %s is missing from the mirror", app))
+		case !inPrimary:
+			diffs = append(diffs, fmt.Sprintf("app %s only exists in the mirror", app))
+		case p != s:
+			diffs = append(diffs, fmt.Sprintf("app %s is v%d, mirror has v%d", app, p, s))
+		}
+	}
+
+	pools, err := m.Primary.ListPools(env)
+	if err != nil {
+		return nil, err
+	}
+
+	secondaryPools, err := m.Secondary.ListPools(env)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pool := range secondaryPools {
+		if !utils.StringInSlice(pool, pools) {
+			diffs = append(diffs, fmt.Sprintf("pool %s only exists in the mirror", pool))
+		}
+	}
+
+	sort.Strings(pools)
+	for _, pool := range pools {
+		p, err := m.Primary.ListAssignments(env, pool)
+		if err != nil {
+			return nil, err
+		}
+
+		s, err := m.Secondary.ListAssignments(env, pool)
+		if err != nil {
+			return nil, err
+		}
+
+		sort.Strings(p)
+		sort.Strings(s)
+		if strings.Join(p, ",") != strings.Join(s, ",") {
+			diffs = append(diffs, fmt.Sprintf("pool %s has apps [%s], mirror has [%s]",
+				pool, strings.Join(p, ","), strings.Join(s, ",")))
+		}
+	}
+	return diffs, nil
+}
+
+func appIDs(backend Backend, env string) (map[string]int64, error) {
+	apps, err := backend.ListApps(env)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]int64)
+	for _, app := range apps {
+		ids[app.Name] = app.revision()
+	}
+	return ids, nil
+}
+
+func sortedKeys(maps ...map[string]int64) []string {
+	keys := []string{}
+	for _, m := range maps {
+		for k := range m {
+			if !utils.StringInSlice(k, keys) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// copyAppConfig returns a config holding the same versioned values as
+// svcCfg.
+func copyAppConfig(svcCfg *AppConfig) *AppConfig {
+	dup := &AppConfig{
+		Name:            svcCfg.Name,
+		versionVMap:     utils.NewVersionedMap(),
+		environmentVMap: utils.NewVersionedMap(),
+		portsVMap:       utils.NewVersionedMap(),
+		runtimeVMap:     utils.NewVersionedMap(),
+		sidecarsVMap:    utils.NewVersionedMap(),
+		dependsVMap:     utils.NewVersionedMap(),
+		canaryVMap:      utils.NewVersionedMap(),
+		colorsVMap:      utils.NewVersionedMap(),
+		jobsVMap:        utils.NewVersionedMap(),
+		releasesVMap:    utils.NewVersionedMap(),
+	}
+	dupVMaps := dup.vmaps()
+	for k, vmap := range svcCfg.vmaps() {
+		dupVMaps[k].UnmarshalMap(vmap.MarshalMap())
+	}
+	return dup
+}
+
+// Status reports the health of the primary since that's what reads use.
+func (m *MirrorBackend) Status() utils.BackendStatus {
+	if backend, ok := m.Primary.(statusReporter); ok {
+		return backend.Status()
+	}
+	return utils.BackendStatus{Healthy: true}
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMirrorBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galaxy-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := NewStore(DefaultTTL)
+	r.Connect("file://" + filepath.Join(dir, "primary.json"))
+	r.Mirror("file://" + filepath.Join(dir, "secondary.json"))
+
+	assertAppCreated(t, r, "app")
+	assertPoolCreated(t, r, "web")
+
+	cfg, err := r.GetApp("app", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.EnvSet("FOO", "bar")
+	if updated, err := r.UpdateApp(cfg, "dev"); !updated || err != nil {
+		t.Fatalf("UpdateApp() = %t, %v, want %t, %v", updated, err, true, nil)
+	}
+
+	if assigned, err := r.AssignApp("app", "dev", "web"); !assigned || err != nil {
+		t.Fatalf("AssignApp() = %t, %v, want %t, %v", assigned, err, true, nil)
+	}
+
+	diffs, err := r.VerifyMirror("dev")
+	if err != nil || len(diffs) != 0 {
+		t.Fatalf("VerifyMirror() = %v, %v, want %v, %v", diffs, err, []string{}, nil)
+	}
+
+	mirror := r.Backend.(*MirrorBackend)
+	secondary, err := mirror.Secondary.GetApp("app", "dev")
+	if err != nil || secondary.EnvGet("FOO") != "bar" {
+		t.Fatalf("mirrored FOO = %s, %v, want %s, %v", secondary.EnvGet("FOO"), err, "bar", nil)
+	}
+
+	// a write that only made it to the secondary
+	secondary.EnvSet("FOO", "baz")
+	if _, err := mirror.Secondary.UpdateApp(secondary, "dev"); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err = r.VerifyMirror("dev")
+	if err != nil || len(diffs) != 1 {
+		t.Fatalf("VerifyMirror() = %v, %v, want 1 difference", diffs, err)
+	}
+}
+
+func TestReadReplica(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galaxy-replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	replica := NewStore(DefaultTTL)
+	replica.Connect("file://" + filepath.Join(dir, "replica.json"))
+	assertAppCreated(t, replica, "replicated")
+
+	r := NewStore(DefaultTTL)
+	r.Connect("file://" + filepath.Join(dir, "primary.json"))
+	r.ReadReplica("file://" + filepath.Join(dir, "replica.json"))
+	assertAppCreated(t, r, "app")
+
+	apps, err := r.ListApps("dev")
+	if err != nil || len(apps) != 1 || apps[0].Name != "replicated" {
+		t.Fatalf("ListApps() = %v, %v, want only %q from the replica", apps, err, "replicated")
+	}
+
+	// everything else reads from the primary
+	assertAppExists(t, r, "app")
+
+	apps, err = r.ListPrimaryApps("dev")
+	if err != nil || len(apps) != 1 || apps[0].Name != "app" {
+		t.Fatalf("ListPrimaryApps() = %v, %v, want only %q from the primary", apps, err, "app")
+	}
+}
@@ -1,20 +1,38 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"path"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/litl/galaxy/utils"
 )
 
 type ConfigChange struct {
 	AppConfig *AppConfig
 	Restart   bool
-	Error     error
+	// RestartBatch is how many of the app's containers across the env can
+	// be restarting at once, waiting RestartDelay after each before
+	// starting another.  0 restarts them all at once.
+	RestartBatch int
+	RestartDelay time.Duration
+	Error        error
 }
 
 var restartChan chan *ConfigChange
 
+// keyspaceSettleTime is how long checkOnWrite waits after a write before
+// checking for changes.
+const keyspaceSettleTime = 500 * time.Millisecond
+
+// pollInterval is how often apps are checked for changes when the backend
+// can't report writes.
+var pollInterval = 10 * time.Second
+
 func (r *Store) CheckForChangesNow() {
 	r.pollCh <- true
 }
@@ -62,8 +80,7 @@ func (r *Store) checkForChanges(env string) {
 }
 
 func (r *Store) checkForChangePeriodically(stop chan struct{}) {
-	// TODO: default polling interval
-	ticker := time.NewTicker(10 * time.Second)
+	ticker := time.NewTicker(pollInterval)
 	for {
 		select {
 		case <-stop:
@@ -75,7 +92,7 @@ func (r *Store) checkForChangePeriodically(stop chan struct{}) {
 	}
 }
 
-func (r *Store) restartApp(app, env string) {
+func (r *Store) restartApp(app, env string, batch int, delay time.Duration) {
 	appCfg, err := r.GetApp(app, env)
 	if err != nil {
 		restartChan <- &ConfigChange{
@@ -85,8 +102,10 @@ func (r *Store) restartApp(app, env string) {
 	}
 
 	restartChan <- &ConfigChange{
-		Restart:   true,
-		AppConfig: appCfg,
+		Restart:      true,
+		RestartBatch: batch,
+		RestartDelay: delay,
+		AppConfig:    appCfg,
 	}
 }
 
@@ -99,6 +118,34 @@ func (r *Store) NotifyRestart(app, env string) error {
 	return nil
 }
 
+// NotifyRollingRestart restarts app's containers batch at a time across the
+// env, waiting delay after each container is restarted.
+func (r *Store) NotifyRollingRestart(app, env string, batch int, delay time.Duration) error {
+	_, err := r.Backend.Notify(fmt.Sprintf("galaxy-%s", env), fmt.Sprintf("restart %s %d %s", app, batch, delay))
+	return err
+}
+
+// parseRestart parses a restart notification, "restart <app>" or
+// "restart <app> <batch> <delay>" for rolling restarts.
+func parseRestart(msg string) (string, int, time.Duration, error) {
+	parts := strings.Split(msg, " ")
+	switch len(parts) {
+	case 2:
+		return parts[1], 0, 0, nil
+	case 4:
+		batch, err := strconv.Atoi(parts[2])
+		if err != nil || batch < 0 {
+			return "", 0, 0, fmt.Errorf("invalid restart batch %s", parts[2])
+		}
+		delay, err := time.ParseDuration(parts[3])
+		if err != nil {
+			return "", 0, 0, fmt.Errorf("invalid restart delay %s", parts[3])
+		}
+		return parts[1], batch, delay, nil
+	}
+	return "", 0, 0, fmt.Errorf("invalid restart notification %q", msg)
+}
+
 func (r *Store) NotifyEnvChanged(env string) error {
 	// TODO: received count ignored, use it somehow?
 	_, err := r.Backend.Notify(fmt.Sprintf("galaxy-%s", env), "config")
@@ -109,27 +156,82 @@ func (r *Store) NotifyEnvChanged(env string) error {
 }
 
 func (r *Store) subscribeChanges(env string) {
-
-	msgs := r.Backend.Subscribe(fmt.Sprintf("galaxy-%s", env))
+	var health utils.BackendHealth
 	for {
+		msgs := r.Backend.Subscribe(fmt.Sprintf("galaxy-%s", env))
+		for msg := range msgs {
+			health.OK()
+			if msg == "config" {
+				r.CheckForChangesNow()
+			} else if strings.HasPrefix(msg, "restart") {
+				app, batch, delay, err := parseRestart(msg)
+				if err != nil {
+					log.Printf("Ignoring notification: %s\n", err)
+					continue
+				}
+				r.restartApp(app, env, batch, delay)
+			} else {
+				log.Printf("Ignoring notification: %s\n", msg)
+			}
+		}
 
-		msg := <-msgs
-		if msg == "config" {
+		// the backend gave up on the subscription.  Resubscribe and check
+		// for anything we missed in the meantime.
+		health.Failed(errors.New("subscription closed"))
+		time.Sleep(health.Backoff())
+		r.CheckForChangesNow()
+	}
+}
+
+// watchKeys returns the keys written in env, even by something other than
+// galaxy, or nil if the backend can't watch them.  NotifyEnvChanged is
+// still used since not all backends can watch keys.
+func (r *Store) watchKeys(env string) chan string {
+	watcher, ok := r.Backend.(keyWatcher)
+	if !ok {
+		return nil
+	}
+	return watcher.WatchKeys(path.Join(env, "*"))
+}
+
+// checkOnWrite checks for changes whenever an app's config is written.
+func (r *Store) checkOnWrite(keys chan string, stop chan struct{}) {
+	// an update writes several keys, so wait for the burst to end
+	var pending <-chan time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case key := <-keys:
+			if key == "" {
+				// writes may have been missed
+				pending = nil
+				r.CheckForChangesNow()
+				continue
+			}
+			if pending == nil && utils.StringInSlice(path.Base(key), appVMapNames) {
+				pending = time.After(keyspaceSettleTime)
+			}
+		case <-pending:
+			pending = nil
 			r.CheckForChangesNow()
-		} else if strings.HasPrefix(msg, "restart") {
-			parts := strings.Split(msg, " ")
-			app := parts[1]
-			r.restartApp(app, env)
-		} else {
-			log.Printf("Ignoring notification: %s\n", msg)
 		}
 	}
 }
 
+// Watch sends the apps in env whose config changed and the restarts
+// requested for them.  Changes are found by polling unless the backend
+// reports writes to their keys.
 func (r *Store) Watch(env string, stop chan struct{}) chan *ConfigChange {
 	restartChan = make(chan *ConfigChange, 10)
 	go r.checkForChanges(env)
-	go r.checkForChangePeriodically(stop)
 	go r.subscribeChanges(env)
+
+	keys := r.watchKeys(env)
+	if keys == nil {
+		go r.checkForChangePeriodically(stop)
+	} else {
+		go r.checkOnWrite(keys, stop)
+	}
 	return restartChan
 }
@@ -0,0 +1,134 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRestart(t *testing.T) {
+	app, batch, delay, err := parseRestart("restart web")
+	if err != nil || app != "web" || batch != 0 || delay != 0 {
+		t.Fatalf("parseRestart(%q) = %s, %d, %s, %v, want web, 0, 0s, nil",
+			"restart web", app, batch, delay, err)
+	}
+
+	app, batch, delay, err = parseRestart("restart web 2 30s")
+	if err != nil || app != "web" || batch != 2 || delay != 30*time.Second {
+		t.Fatalf("parseRestart(%q) = %s, %d, %s, %v, want web, 2, 30s, nil",
+			"restart web 2 30s", app, batch, delay, err)
+	}
+
+	for _, msg := range []string{"restart", "restart web x 30s", "restart web 2 x", "restart web -1 30s"} {
+		if _, _, _, err := parseRestart(msg); err == nil {
+			t.Fatalf("parseRestart(%q) did not fail", msg)
+		}
+	}
+}
+
+// watchingBackend reports writes to keys itself, as a backend with native
+// watches would, and doesn't publish notifications.
+type watchingBackend struct {
+	Backend
+	keys chan string
+}
+
+func (w *watchingBackend) WatchKeys(pattern string) chan string {
+	return w.keys
+}
+
+func (w *watchingBackend) Notify(key, value string) (int, error) {
+	return 0, nil
+}
+
+// nextChange returns the next app change sent within timeout, or nil.
+func nextChange(changes chan *ConfigChange, timeout time.Duration) *ConfigChange {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case change := <-changes:
+			if change.AppConfig != nil {
+				return change
+			}
+		case <-deadline:
+			return nil
+		}
+	}
+}
+
+func updateTestApp(t *testing.T, r *Store, value string) {
+	cfg, err := r.GetApp("app", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.EnvSet("FOO", value)
+	if _, err := r.UpdateApp(cfg, "dev"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchPolls(t *testing.T) {
+	r, cleanup := NewTestFileStore(t)
+	defer cleanup()
+	// no keys to watch
+	r.Backend = &watchingBackend{Backend: r.Backend}
+	assertAppCreated(t, r, "app")
+
+	interval := pollInterval
+	pollInterval = 10 * time.Millisecond
+	defer func() { pollInterval = interval }()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	changes := r.Watch("dev", stop)
+	r.CheckForChangesNow()
+
+	// without a key watch, the change is found by polling
+	updateTestApp(t, r, "bar")
+	change := nextChange(changes, 5*time.Second)
+	if change == nil || change.AppConfig.EnvGet("FOO") != "bar" {
+		t.Fatalf("expected the change to be polled for. Got %v", change)
+	}
+}
+
+func TestWatchKeys(t *testing.T) {
+	r, cleanup := NewTestFileStore(t)
+	defer cleanup()
+	keys := make(chan string)
+	r.Backend = &watchingBackend{Backend: r.Backend, keys: keys}
+	assertAppCreated(t, r, "app")
+
+	interval := pollInterval
+	pollInterval = 10 * time.Millisecond
+	defer func() { pollInterval = interval }()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	changes := r.Watch("dev", stop)
+	r.CheckForChangesNow()
+
+	// nothing polls while keys are watched
+	updateTestApp(t, r, "bar")
+	if change := nextChange(changes, 200*time.Millisecond); change != nil {
+		t.Fatalf("expected no change until a key is written. Got %v", change)
+	}
+
+	// writes to other keys are ignored
+	keys <- "dev/app/other"
+	if change := nextChange(changes, keyspaceSettleTime+200*time.Millisecond); change != nil {
+		t.Fatalf("expected no change for another key. Got %v", change)
+	}
+
+	keys <- "dev/app/environment"
+	change := nextChange(changes, 5*time.Second)
+	if change == nil || change.AppConfig.EnvGet("FOO") != "bar" {
+		t.Fatalf("expected the change after its key was written. Got %v", change)
+	}
+
+	// missed writes are checked for right away
+	updateTestApp(t, r, "baz")
+	keys <- ""
+	change = nextChange(changes, keyspaceSettleTime/2)
+	if change == nil || change.AppConfig.EnvGet("FOO") != "baz" {
+		t.Fatalf("expected the change after writes were missed. Got %v", change)
+	}
+}
@@ -0,0 +1,499 @@
+package config
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/utils"
+)
+
+// postgresSweepInterval is how often expired hosts are deleted by
+// default.
+const postgresSweepInterval = 30 * time.Second
+
+var postgresSchema = []string{
+	// each row is one versioned field of one of an app's vmaps
+	`CREATE TABLE IF NOT EXISTS galaxy_config (
+		env   text NOT NULL,
+		app   text NOT NULL,
+		vmap  text NOT NULL,
+		field text NOT NULL,
+		value text NOT NULL,
+		PRIMARY KEY (env, app, vmap, field)
+	)`,
+	// a snapshot of the app's config after every update
+	`CREATE TABLE IF NOT EXISTS galaxy_config_history (
+		id         bigserial PRIMARY KEY,
+		env        text NOT NULL,
+		app        text NOT NULL,
+		config_id  bigint NOT NULL,
+		changed_at timestamptz NOT NULL DEFAULT now(),
+		config     text NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS galaxy_config_history_app
+		ON galaxy_config_history (env, app, changed_at)`,
+	`CREATE TABLE IF NOT EXISTS galaxy_changelog (
+		id         bigserial PRIMARY KEY,
+		env        text NOT NULL,
+		app        text NOT NULL,
+		op         text NOT NULL,
+		actor      text NOT NULL,
+		old_id     bigint NOT NULL,
+		new_id     bigint NOT NULL,
+		changed_at timestamptz NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS galaxy_changelog_env
+		ON galaxy_changelog (env, changed_at)`,
+	// the whole change as JSON, as the other backends keep it
+	`ALTER TABLE galaxy_changelog ADD COLUMN IF NOT EXISTS change text NOT NULL DEFAULT '{}'`,
+	`CREATE TABLE IF NOT EXISTS galaxy_pools (
+		env  text NOT NULL,
+		pool text NOT NULL,
+		PRIMARY KEY (env, pool)
+	)`,
+	`CREATE TABLE IF NOT EXISTS galaxy_assignments (
+		env  text NOT NULL,
+		pool text NOT NULL,
+		app  text NOT NULL,
+		PRIMARY KEY (env, pool, app)
+	)`,
+	`CREATE TABLE IF NOT EXISTS galaxy_hosts (
+		env        text NOT NULL,
+		pool       text NOT NULL,
+		host_ip    text NOT NULL,
+		expires_at timestamptz NOT NULL,
+		PRIMARY KEY (env, pool, host_ip)
+	)`,
+	`ALTER TABLE galaxy_hosts ADD COLUMN IF NOT EXISTS info text NOT NULL DEFAULT '{}'`,
+}
+
+// PostgresBackend stores config in tables.  Updates are made in a
+// transaction that checks the app's ID, every update is recorded in
+// galaxy_config_history and changes are announced with NOTIFY.
+type PostgresBackend struct {
+	URL string
+	// sweepInterval is how often expired hosts are deleted,
+	// postgresSweepInterval if it's 0
+	sweepInterval time.Duration
+
+	db   *sql.DB
+	stop chan struct{}
+}
+
+func (p *PostgresBackend) Connect() {
+	db, err := utils.OpenPostgres(p.URL)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to connect to postgres: %s", err)
+	}
+
+	err = utils.ExecAll(db, postgresSchema...)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to create config tables: %s", err)
+	}
+
+	p.db = db
+	interval := p.sweepInterval
+	if interval == 0 {
+		interval = postgresSweepInterval
+	}
+	p.stop = make(chan struct{})
+	go p.sweep(db, interval, p.stop)
+}
+
+func (p *PostgresBackend) Reconnect() {
+	if p.db != nil {
+		close(p.stop)
+		p.db.Close()
+	}
+	p.Connect()
+}
+
+// sweep deletes expired hosts every interval until stop is closed.  A
+// sweep that fails is tried again at the next interval.
+func (p *PostgresBackend) sweep(db *sql.DB, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		_, err := db.Exec(`DELETE FROM galaxy_hosts WHERE expires_at < now()`)
+		if err != nil {
+			log.Warnf("WARN: Unable to delete expired hosts: %s", err)
+		}
+	}
+}
+
+func (p *PostgresBackend) queryStrings(query string, args ...interface{}) ([]string, error) {
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+func (p *PostgresBackend) AppExists(app, env string) (bool, error) {
+	exists := false
+	err := p.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM galaxy_config WHERE env = $1 AND app = $2)`,
+		env, app).Scan(&exists)
+	return exists, err
+}
+
+func (p *PostgresBackend) CreateApp(app, env string) (bool, error) {
+	emptyConfig := NewAppConfig(app, "")
+	return p.UpdateApp(emptyConfig, env)
+}
+
+func (p *PostgresBackend) ListApps(env string) ([]*AppConfig, error) {
+	return p.loadApps(`SELECT app, vmap, field, value FROM galaxy_config
+		WHERE env = $1 ORDER BY app`, env)
+}
+
+func (p *PostgresBackend) GetApp(app, env string) (*AppConfig, error) {
+	apps, err := p.loadApps(`SELECT app, vmap, field, value FROM galaxy_config
+		WHERE env = $1 AND app = $2`, env, app)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(apps) == 0 {
+		svcCfg := NewAppConfig(app, "")
+		return svcCfg, nil
+	}
+	return apps[0], nil
+}
+
+// loadApps builds configs from (app, vmap, field, value) rows.
+func (p *PostgresBackend) loadApps(query string, args ...interface{}) ([]*AppConfig, error) {
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+	serialized := make(map[string]map[string]map[string]string)
+	for rows.Next() {
+		var app, vmap, field, value string
+		if err := rows.Scan(&app, &vmap, &field, &value); err != nil {
+			return nil, err
+		}
+
+		if _, ok := serialized[app]; !ok {
+			names = append(names, app)
+			serialized[app] = make(map[string]map[string]string)
+		}
+		if _, ok := serialized[app][vmap]; !ok {
+			serialized[app][vmap] = make(map[string]string)
+		}
+		serialized[app][vmap][field] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	apps := []*AppConfig{}
+	for _, app := range names {
+		svcCfg := NewAppConfig(app, "")
+		// start from empty maps so only stored fields count towards the ID
+		svcCfg.versionVMap = utils.NewVersionedMap()
+		for name, vmap := range svcCfg.vmaps() {
+			vmap.UnmarshalMap(serialized[app][name])
+		}
+		svcCfg.loadedID = svcCfg.revision()
+		apps = append(apps, svcCfg)
+	}
+	return apps, nil
+}
+
+func (p *PostgresBackend) UpdateApp(svcCfg *AppConfig, env string) (bool, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// serialize writers of this app, even before it has any rows to lock
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, env+"/"+svcCfg.Name)
+	if err != nil {
+		return false, err
+	}
+
+	current := int64(0)
+	rows, err := tx.Query(`SELECT vmap, field, value FROM galaxy_config WHERE env = $1 AND app = $2`,
+		env, svcCfg.Name)
+	if err != nil {
+		return false, err
+	}
+
+	stored := make(map[string]map[string]string)
+	for rows.Next() {
+		var vmap, field, value string
+		if err := rows.Scan(&vmap, &field, &value); err != nil {
+			rows.Close()
+			return false, err
+		}
+		if _, ok := stored[vmap]; !ok {
+			stored[vmap] = make(map[string]string)
+		}
+		stored[vmap][field] = value
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	for _, serialized := range stored {
+		if v := utils.SerializedVersion(serialized); v > current {
+			current = v
+		}
+	}
+
+	if current != svcCfg.loadedID {
+		return false, ErrConflict
+	}
+
+	snapshot := make(map[string]map[string]string)
+	for name, vmap := range svcCfg.vmaps() {
+		serialized := vmap.MarshalMap()
+		snapshot[name] = serialized
+		for field, value := range serialized {
+			_, err = tx.Exec(`INSERT INTO galaxy_config (env, app, vmap, field, value)
+				VALUES ($1, $2, $3, $4, $5)
+				ON CONFLICT (env, app, vmap, field) DO UPDATE SET value = EXCLUDED.value`,
+				env, svcCfg.Name, name, field, value)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		for field := range vmap.MarshalExpiredMap(5) {
+			_, err = tx.Exec(`DELETE FROM galaxy_config
+				WHERE env = $1 AND app = $2 AND vmap = $3 AND field = $4`,
+				env, svcCfg.Name, name, field)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	config, err := json.Marshal(snapshot)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(`INSERT INTO galaxy_config_history (env, app, config_id, config)
+		VALUES ($1, $2, $3, $4)`, env, svcCfg.Name, svcCfg.revision(), string(config))
+	if err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	svcCfg.loadedID = svcCfg.revision()
+	return true, nil
+}
+
+func (p *PostgresBackend) DeleteApp(svcCfg *AppConfig, env string) (bool, error) {
+	res, err := p.db.Exec(`DELETE FROM galaxy_config WHERE env = $1 AND app = $2`, env, svcCfg.Name)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (p *PostgresBackend) LogChange(env string, change *Change) error {
+	entry, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.db.Exec(`INSERT INTO galaxy_changelog (env, app, op, actor, old_id, new_id, changed_at, change)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		env, change.App, change.Op, change.Actor, change.OldID, change.NewID, change.Time, string(entry))
+	if err != nil {
+		return err
+	}
+
+	_, err = p.db.Exec(`DELETE FROM galaxy_changelog WHERE env = $1 AND id <= (
+		SELECT id FROM galaxy_changelog WHERE env = $1 ORDER BY id DESC OFFSET $2 LIMIT 1)`,
+		env, MaxChanges)
+	return err
+}
+
+func (p *PostgresBackend) ListChanges(env, app string, limit int) ([]*Change, error) {
+	if limit <= 0 {
+		limit = MaxChanges
+	}
+
+	rows, err := p.db.Query(`SELECT app, op, actor, old_id, new_id, changed_at, change FROM galaxy_changelog
+		WHERE env = $1 AND ($2 = '' OR app = $2) ORDER BY changed_at DESC LIMIT $3`, env, app, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []*Change{}
+	for rows.Next() {
+		var app, op, actor, entry string
+		var oldID, newID int64
+		var changedAt time.Time
+		err := rows.Scan(&app, &op, &actor, &oldID, &newID, &changedAt, &entry)
+		if err != nil {
+			return nil, err
+		}
+
+		// changes logged before the change column was added are '{}'
+		change := &Change{}
+		if err := json.Unmarshal([]byte(entry), change); err != nil {
+			return nil, err
+		}
+		change.App, change.Op, change.Actor = app, op, actor
+		change.OldID, change.NewID, change.Time = oldID, newID, changedAt
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+func (p *PostgresBackend) AssignApp(app, env, pool string) (bool, error) {
+	res, err := p.db.Exec(`INSERT INTO galaxy_assignments (env, pool, app) VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`, env, pool, app)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (p *PostgresBackend) UnassignApp(app, env, pool string) (bool, error) {
+	res, err := p.db.Exec(`DELETE FROM galaxy_assignments WHERE env = $1 AND pool = $2 AND app = $3`,
+		env, pool, app)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (p *PostgresBackend) ListAssignments(env, pool string) ([]string, error) {
+	return p.queryStrings(`SELECT app FROM galaxy_assignments WHERE env = $1 AND pool = $2 ORDER BY app`,
+		env, pool)
+}
+
+func (p *PostgresBackend) CreatePool(env, pool string) (bool, error) {
+	res, err := p.db.Exec(`INSERT INTO galaxy_pools (env, pool) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+		env, pool)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (p *PostgresBackend) DeletePool(env, pool string) (bool, error) {
+	res, err := p.db.Exec(`DELETE FROM galaxy_pools WHERE env = $1 AND pool = $2`, env, pool)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// ListPools returns the pools with running hosts as well as those created
+// explicitly.
+func (p *PostgresBackend) ListPools(env string) ([]string, error) {
+	return p.queryStrings(`SELECT pool FROM galaxy_hosts WHERE env = $1 AND expires_at > now()
+		UNION SELECT pool FROM galaxy_pools WHERE env = $1`, env)
+}
+
+func (p *PostgresBackend) ListEnvs() ([]string, error) {
+	return p.queryStrings(`SELECT DISTINCT env FROM galaxy_config ORDER BY env`)
+}
+
+func (p *PostgresBackend) UpdateHost(env, pool string, host HostInfo) error {
+	info, err := json.Marshal(host)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.db.Exec(`INSERT INTO galaxy_hosts (env, pool, host_ip, info, expires_at)
+		VALUES ($1, $2, $3, $4, now() + $5 * interval '1 second')
+		ON CONFLICT (env, pool, host_ip) DO UPDATE
+		SET info = EXCLUDED.info, expires_at = EXCLUDED.expires_at`,
+		env, pool, host.HostIP, string(info), DefaultTTL)
+	return err
+}
+
+func (p *PostgresBackend) ListHosts(env, pool string) ([]HostInfo, error) {
+	rows, err := p.db.Query(`SELECT host_ip, info FROM galaxy_hosts
+		WHERE env = $1 AND pool = $2 AND expires_at > now() ORDER BY host_ip`, env, pool)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hosts := []HostInfo{}
+	for rows.Next() {
+		var ip, info string
+		if err := rows.Scan(&ip, &info); err != nil {
+			return nil, err
+		}
+
+		host := HostInfo{}
+		if err := json.Unmarshal([]byte(info), &host); err != nil {
+			return nil, err
+		}
+		host.HostIP = ip
+		hosts = append(hosts, host)
+	}
+	return hosts, rows.Err()
+}
+
+func (p *PostgresBackend) DeleteHost(env, pool string, host HostInfo) error {
+	_, err := p.db.Exec(`DELETE FROM galaxy_hosts WHERE env = $1 AND pool = $2 AND host_ip = $3`,
+		env, pool, host.HostIP)
+	return err
+}
+
+// Subscribe uses LISTEN.  If that fails, changes are only noticed by the
+// Store's periodic check.
+func (p *PostgresBackend) Subscribe(key string) chan string {
+	msgs := make(chan string)
+	err := utils.ListenPostgres(p.URL, key, msgs)
+	if err != nil {
+		log.Warnf("WARN: Unable to LISTEN on %s: %s", key, err)
+		return msgs
+	}
+	log.Printf("Monitoring for config changes on channel: %s\n", key)
+	return msgs
+}
+
+func (p *PostgresBackend) Notify(key, value string) (int, error) {
+	_, err := p.db.Exec(`SELECT pg_notify($1, $2)`, key, value)
+	if err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
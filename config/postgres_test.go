@@ -0,0 +1,267 @@
+package config
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/litl/galaxy/utils"
+)
+
+// testPostgres is a database/sql driver that records the statements run
+// and fails the next fail of them.
+type testPostgres struct {
+	mu    sync.Mutex
+	execs []string
+	// args has the arguments of each of execs
+	args [][]driver.Value
+	fail int
+	// rows is returned by every query
+	columns []string
+	rows    [][]driver.Value
+}
+
+var testDriver = &testPostgres{}
+
+func init() {
+	sql.Register("galaxy-test", testDriver)
+}
+
+func (d *testPostgres) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.execs, d.args, d.fail, d.columns, d.rows = nil, nil, 0, nil, nil
+}
+
+func (d *testPostgres) record(query string, args []driver.Value) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stmt := strings.Join(strings.Fields(query), " ")
+	for _, arg := range args {
+		stmt += fmt.Sprintf(" %v", arg)
+	}
+	d.execs = append(d.execs, stmt)
+	d.args = append(d.args, args)
+	if d.fail > 0 {
+		d.fail--
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+// count returns how many of the statements run start with prefix.
+func (d *testPostgres) count(prefix string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := 0
+	for _, stmt := range d.execs {
+		if strings.HasPrefix(stmt, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func (d *testPostgres) Open(name string) (driver.Conn, error) { return testPostgresConn{d}, nil }
+
+type testPostgresConn struct{ d *testPostgres }
+
+func (c testPostgresConn) Prepare(query string) (driver.Stmt, error) {
+	return testPostgresStmt{c.d, query}, nil
+}
+func (c testPostgresConn) Close() error              { return nil }
+func (c testPostgresConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+type testPostgresStmt struct {
+	d     *testPostgres
+	query string
+}
+
+func (s testPostgresStmt) Close() error  { return nil }
+func (s testPostgresStmt) NumInput() int { return -1 }
+
+func (s testPostgresStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if err := s.d.record(s.query, args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s testPostgresStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if err := s.d.record(s.query, args); err != nil {
+		return nil, err
+	}
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	return &testPostgresRows{columns: s.d.columns, rows: s.d.rows}, nil
+}
+
+type testPostgresRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *testPostgresRows) Columns() []string { return r.columns }
+func (r *testPostgresRows) Close() error      { return nil }
+
+func (r *testPostgresRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// newTestPostgresBackend connects a backend to the test driver, sweeping
+// every sweepInterval, and returns a func to stop its sweeps.
+func newTestPostgresBackend(t *testing.T, sweepInterval time.Duration) (*PostgresBackend, func()) {
+	driverName := utils.PostgresDriver
+	utils.PostgresDriver = "galaxy-test"
+	defer func() { utils.PostgresDriver = driverName }()
+
+	testDriver.reset()
+	p := &PostgresBackend{URL: "postgres://galaxy@localhost/galaxy", sweepInterval: sweepInterval}
+	p.Connect()
+	return p, func() { close(p.stop) }
+}
+
+func TestPostgresConnect(t *testing.T) {
+	_, cleanup := newTestPostgresBackend(t, 0)
+	defer cleanup()
+
+	if n := testDriver.count("CREATE TABLE IF NOT EXISTS"); n != 6 {
+		t.Fatalf("expected 6 tables created. Got %d", n)
+	}
+	if n := testDriver.count(""); n != len(postgresSchema) {
+		t.Fatalf("expected the %d schema statements. Got %d", len(postgresSchema), n)
+	}
+}
+
+func TestPostgresSweep(t *testing.T) {
+	_, cleanup := newTestPostgresBackend(t, 10*time.Millisecond)
+
+	// the database going away doesn't stop the sweeps
+	testDriver.mu.Lock()
+	testDriver.fail = 3
+	testDriver.mu.Unlock()
+
+	sweep := "DELETE FROM galaxy_hosts WHERE expires_at < now()"
+	deadline := time.Now().Add(5 * time.Second)
+	for testDriver.count(sweep) < 5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected sweeps to continue after failing. Got %d", testDriver.count(sweep))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cleanup()
+	time.Sleep(50 * time.Millisecond)
+	stopped := testDriver.count(sweep)
+	time.Sleep(50 * time.Millisecond)
+	if n := testDriver.count(sweep); n != stopped {
+		t.Fatalf("expected sweeps to stop once closed. Got %d more", n-stopped)
+	}
+}
+
+func TestPostgresNotify(t *testing.T) {
+	p, cleanup := newTestPostgresBackend(t, 0)
+	defer cleanup()
+
+	n, err := p.Notify("galaxy-dev", "config")
+	if err != nil || n != 1 {
+		t.Fatalf("expected the notification to be sent. Got %d, %v", n, err)
+	}
+	if testDriver.count("SELECT pg_notify($1, $2) galaxy-dev config") != 1 {
+		t.Fatal("expected pg_notify to be called with the channel and payload")
+	}
+
+	testDriver.mu.Lock()
+	testDriver.fail = 1
+	testDriver.mu.Unlock()
+	n, err = p.Notify("galaxy-dev", "config")
+	if err == nil || n != 0 {
+		t.Fatalf("expected the failure to be returned. Got %d, %v", n, err)
+	}
+}
+
+func TestPostgresAppExists(t *testing.T) {
+	p, cleanup := newTestPostgresBackend(t, 0)
+	defer cleanup()
+
+	testDriver.mu.Lock()
+	testDriver.columns = []string{"exists"}
+	testDriver.rows = [][]driver.Value{{true}}
+	testDriver.mu.Unlock()
+
+	exists, err := p.AppExists("web", "dev")
+	if err != nil || !exists {
+		t.Fatalf("expected web to exist. Got %t, %v", exists, err)
+	}
+	if testDriver.count("SELECT EXISTS (SELECT 1 FROM galaxy_config WHERE env = $1 AND app = $2) dev web") != 1 {
+		t.Fatalf("expected the app to be looked up in its env. Got %v", testDriver.execs)
+	}
+}
+
+func TestPostgresChangeLog(t *testing.T) {
+	p, cleanup := newTestPostgresBackend(t, 0)
+	defer cleanup()
+	testDriver.reset()
+
+	logged := &Change{
+		Time:      time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC),
+		Actor:     "deployer",
+		App:       "web",
+		Op:        "update",
+		OldID:     3,
+		NewID:     4,
+		DeployID:  "d1",
+		Version:   "web:v2",
+		VersionID: "web:v2@sha256:2",
+		Changes:   []string{"version", "env.FOO"},
+	}
+	if err := p.LogChange("dev", logged); err != nil {
+		t.Fatalf("expected the change to be logged. Got %v", err)
+	}
+
+	// the insert is the first statement and its columns after env are
+	// the ones ListChanges selects
+	testDriver.mu.Lock()
+	if len(testDriver.args) == 0 || !strings.HasPrefix(testDriver.execs[0], "INSERT INTO galaxy_changelog") {
+		testDriver.mu.Unlock()
+		t.Fatalf("expected the change to be inserted. Got %v", testDriver.execs)
+	}
+	testDriver.columns = []string{"app", "op", "actor", "old_id", "new_id", "changed_at", "change"}
+	testDriver.rows = [][]driver.Value{testDriver.args[0][1:]}
+	testDriver.mu.Unlock()
+
+	changes, err := p.ListChanges("dev", "web", 10)
+	if err != nil || len(changes) != 1 {
+		t.Fatalf("expected 1 change. Got %v, %v", changes, err)
+	}
+	if !reflect.DeepEqual(changes[0], logged) {
+		t.Fatalf("expected %+v. Got %+v", logged, changes[0])
+	}
+
+	// rows logged before the change column existed keep their columns
+	testDriver.mu.Lock()
+	testDriver.rows = [][]driver.Value{{"web", "update", "deployer", int64(1), int64(2), logged.Time, "{}"}}
+	testDriver.mu.Unlock()
+
+	changes, err = p.ListChanges("dev", "web", 10)
+	if err != nil || len(changes) != 1 {
+		t.Fatalf("expected 1 change. Got %v, %v", changes, err)
+	}
+	if changes[0].App != "web" || changes[0].NewID != 2 || changes[0].Version != "" {
+		t.Fatalf("expected the legacy columns. Got %+v", changes[0])
+	}
+}
@@ -1,7 +1,9 @@
 package config
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"path"
 	"strings"
@@ -15,6 +17,42 @@ import (
 type RedisBackend struct {
 	redisPool redis.Pool
 	RedisHost string
+	// Options holds the AUTH, db and TLS settings for RedisHost
+	Options *utils.RedisOptions
+	// Sentinel, if set, is used to locate the master instead of RedisHost
+	Sentinel *utils.RedisSentinel
+	// Cluster, if set, routes commands across a Redis Cluster
+	Cluster *utils.RedisCluster
+	// ScanCount is the page size used when listing keys.  Zero uses
+	// utils.DefaultScanCount.
+	ScanCount int
+	// Namespace, if set, prefixes every key and channel with
+	// "<Namespace>:" so several galaxy installations can share a redis.
+	Namespace string
+	// PoolOptions size the connection pool
+	PoolOptions utils.PoolOptions
+
+	health utils.BackendHealth
+	pool   utils.PoolMonitor
+}
+
+func (r *RedisBackend) key(key string) string {
+	if r.Namespace == "" {
+		return key
+	}
+	return r.Namespace + ":" + key
+}
+
+func (r *RedisBackend) keys(keys []string) []string {
+	if r.Namespace == "" {
+		return keys
+	}
+
+	namespaced := make([]string, len(keys))
+	for i, key := range keys {
+		namespaced[i] = r.key(key)
+	}
+	return namespaced
 }
 
 func (r *RedisBackend) AppExists(app, env string) (bool, error) {
@@ -31,14 +69,12 @@ func (r *RedisBackend) CreateApp(app, env string) (bool, error) {
 }
 
 func (r *RedisBackend) ListApps(env string) ([]*AppConfig, error) {
-	// TODO: convert to scan
 	apps, err := r.Keys(path.Join(env, "*", "version"))
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: is it OK to error out early?
-	var appList []*AppConfig
+	names := []string{}
 	for _, app := range apps {
 		parts := strings.Split(app, "/")
 
@@ -52,17 +88,91 @@ func (r *RedisBackend) ListApps(env string) ([]*AppConfig, error) {
 			continue
 		}
 
-		cfg, err := r.GetApp(parts[1], env)
-		if err != nil {
-			return nil, err
+		names = append(names, parts[1])
+	}
+
+	return r.getApps(names, env)
+}
+
+// appVMapNames are the hashes that make up an app's config.
+var appVMapNames = []string{"environment", "version", "ports", "runtime", "sidecars", "depends", "canary", "colors", "jobs", "releases"}
+
+// getApps loads the configs for each app in a single pipeline.
+func (r *RedisBackend) getApps(apps []string, env string) ([]*AppConfig, error) {
+	appList := []*AppConfig{}
+	keys := []string{}
+	dests := []*utils.VersionedMap{}
+	for _, app := range apps {
+		svcCfg := NewAppConfig(path.Base(app), "")
+		vmaps := svcCfg.vmaps()
+		for _, name := range appVMapNames {
+			keys = append(keys, path.Join(env, app, name))
+			dests = append(dests, vmaps[name])
 		}
+		appList = append(appList, svcCfg)
+	}
 
-		appList = append(appList, cfg)
+	serialized, err := r.GetAllMulti(keys)
+	if err != nil {
+		return nil, err
 	}
 
+	for i, dest := range dests {
+		err = dest.UnmarshalMap(serialized[i])
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %s", keys[i], err)
+		}
+	}
+
+	for _, svcCfg := range appList {
+		svcCfg.loadedID = svcCfg.revision()
+	}
 	return appList, nil
 }
 
+// updateAppScript writes an app's vmaps only if the latest version stored
+// across them still matches the ID the caller loaded.  KEYS are the vmap
+// hashes.  ARGV[1] is the loaded ID followed, for each key, by a field count
+// and that many field/value pairs.
+var updateAppScript = redis.NewScript(-1, `
+local current = 0
+for _, key in ipairs(KEYS) do
+	for _, field in ipairs(redis.call('HKEYS', key)) do
+		local version = tonumber(string.match(field, ':(%d+)$'))
+		if version and version > current then
+			current = version
+		end
+	end
+end
+
+if current ~= tonumber(ARGV[1]) then
+	return 0
+end
+
+local i = 2
+for _, key in ipairs(KEYS) do
+	local n = tonumber(ARGV[i])
+	i = i + 1
+	if n > 0 then
+		redis.call('HMSET', key, unpack(ARGV, i, i + 2 * n - 1))
+	end
+	i = i + 2 * n
+end
+return 1
+`)
+
+func (r *RedisBackend) vmapKeys(svcCfg *AppConfig, env string) ([]string, []*utils.VersionedMap) {
+	vmaps := svcCfg.vmaps()
+
+	keys := []string{}
+	maps := []*utils.VersionedMap{}
+	for _, name := range appVMapNames {
+		keys = append(keys, path.Join(env, svcCfg.Name, name))
+		maps = append(maps, vmaps[name])
+	}
+	return keys, maps
+}
+
 func (r *RedisBackend) UpdateApp(svcCfg *AppConfig, env string) (bool, error) {
 
 	for k, v := range svcCfg.Env() {
@@ -77,59 +187,90 @@ func (r *RedisBackend) UpdateApp(svcCfg *AppConfig, env string) (bool, error) {
 		}
 	}
 
-	//TODO: user MULTI/EXEC
-	err := r.SaveVMap(path.Join(env, svcCfg.Name, "environment"),
-		svcCfg.environmentVMap)
+	keys, vmaps := r.vmapKeys(svcCfg, env)
 
-	if err != nil {
-		return false, err
+	var saved bool
+	var err error
+	if r.Cluster != nil {
+		// an app's keys hash to different slots so the script can't run
+		// against a cluster.  Fall back to checking the ID first.
+		saved, err = r.checkAndSaveApp(svcCfg, keys, vmaps)
+	} else {
+		saved, err = r.casSaveApp(svcCfg, keys, vmaps)
 	}
 
-	err = r.SaveVMap(path.Join(env, svcCfg.Name, "version"),
-		svcCfg.versionVMap)
-
 	if err != nil {
 		return false, err
 	}
 
-	err = r.SaveVMap(path.Join(env, svcCfg.Name, "ports"),
-		svcCfg.portsVMap)
-
-	if err != nil {
-		return false, err
+	if !saved {
+		return false, ErrConflict
 	}
+	svcCfg.loadedID = svcCfg.revision()
 
-	err = r.SaveVMap(path.Join(env, svcCfg.Name, "runtime"),
-		svcCfg.runtimeVMap)
+	for i, key := range keys {
+		r.GcVMap(key, vmaps[i])
+	}
+	return true, nil
+}
 
+func (r *RedisBackend) casSaveApp(svcCfg *AppConfig, keys []string, vmaps []*utils.VersionedMap) (bool, error) {
+	conn, err := r.getConn()
 	if err != nil {
 		return false, err
 	}
-	return true, nil
-}
+	defer conn.Close()
 
-func (r *RedisBackend) GetApp(app, env string) (*AppConfig, error) {
-	svcCfg := NewAppConfig(path.Base(app), "")
+	args := redis.Args{}.Add(len(keys)).AddFlat(r.keys(keys)).Add(svcCfg.loadedID)
+	for _, vmap := range vmaps {
+		serialized := vmap.MarshalMap()
+		args = args.Add(len(serialized)).AddFlat(serialized)
+	}
 
-	err := r.LoadVMap(path.Join(env, app, "environment"), svcCfg.environmentVMap)
-	if err != nil {
-		return nil, err
+	saved, err := redis.Int(updateAppScript.Do(conn, args...))
+	return saved == 1, err
+}
+
+func (r *RedisBackend) checkAndSaveApp(svcCfg *AppConfig, keys []string, vmaps []*utils.VersionedMap) (bool, error) {
+	current := int64(0)
+	for _, key := range keys {
+		serialized, err := r.GetAll(key)
+		if err != nil {
+			return false, err
+		}
+		if v := utils.SerializedVersion(serialized); v > current {
+			current = v
+		}
 	}
-	err = r.LoadVMap(path.Join(env, app, "version"), svcCfg.versionVMap)
-	if err != nil {
-		return nil, err
+
+	if current != svcCfg.loadedID {
+		return false, nil
 	}
 
-	err = r.LoadVMap(path.Join(env, app, "ports"), svcCfg.portsVMap)
-	if err != nil {
-		return nil, err
+	for i, key := range keys {
+		serialized := vmaps[i].MarshalMap()
+		if len(serialized) == 0 {
+			continue
+		}
+
+		created, err := r.SetMulti(key, serialized)
+		if err != nil {
+			return false, err
+		}
+
+		if created != "OK" {
+			return false, errors.New("not saved")
+		}
 	}
+	return true, nil
+}
 
-	err = r.LoadVMap(path.Join(env, app, "runtime"), svcCfg.runtimeVMap)
+func (r *RedisBackend) GetApp(app, env string) (*AppConfig, error) {
+	appList, err := r.getApps([]string{app}, env)
 	if err != nil {
 		return nil, err
 	}
-	return svcCfg, nil
+	return appList[0], nil
 }
 
 func (r *RedisBackend) DeleteApp(svcCfg *AppConfig, env string) (bool, error) {
@@ -141,7 +282,7 @@ func (r *RedisBackend) DeleteApp(svcCfg *AppConfig, env string) (bool, error) {
 
 	deletedOne = deletedOne || deleted == 1
 
-	for _, k := range []string{"environment", "version", "ports", "runtime"} {
+	for _, k := range appVMapNames {
 		deleted, err = r.Delete(path.Join(env, svcCfg.Name, k))
 		if err != nil {
 			return false, err
@@ -252,8 +393,7 @@ func (r *RedisBackend) LoadVMap(key string, dest *utils.VersionedMap) error {
 		return err
 	}
 
-	dest.UnmarshalMap(serialized)
-	return nil
+	return dest.UnmarshalMap(serialized)
 }
 
 func (r *RedisBackend) SaveVMap(key string, vmap *utils.VersionedMap) error {
@@ -298,136 +438,216 @@ func (r *RedisBackend) GcVMap(key string, vmap *utils.VersionedMap) error {
 	return nil
 }
 
+func (r *RedisBackend) dial(connectTimeout, readTimeout, writeTimeout time.Duration) (redis.Conn, error) {
+	if r.Sentinel != nil {
+		return r.Sentinel.DialTimeout(connectTimeout, readTimeout, writeTimeout)
+	}
+	if r.Cluster != nil {
+		return r.Cluster.DialTimeout(connectTimeout, readTimeout, writeTimeout)
+	}
+	if r.Options != nil {
+		return r.Options.DialTimeout("tcp", r.RedisHost, connectTimeout, readTimeout, writeTimeout)
+	}
+	return redis.DialTimeout("tcp", r.RedisHost, connectTimeout, readTimeout, writeTimeout)
+}
+
+func (r *RedisBackend) testConn(c redis.Conn, t time.Time) error {
+	var err error
+	if r.Sentinel != nil {
+		// a failover leaves pooled connections pointing at a replica
+		err = r.Sentinel.TestRole(c)
+	} else {
+		_, err = c.Do("PING")
+	}
+	if err != nil {
+		defer c.Close()
+	}
+	return err
+}
+
 func (r *RedisBackend) Connect() {
 	rwTimeout := 5 * time.Second
 
 	r.redisPool = redis.Pool{
-		MaxIdle:     1,
-		IdleTimeout: 120 * time.Second,
 		Dial: func() (redis.Conn, error) {
-			return redis.DialTimeout("tcp", r.RedisHost, rwTimeout, rwTimeout, rwTimeout)
+			return r.dial(rwTimeout, rwTimeout, rwTimeout)
 		},
 		// test every connection for now
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			_, err := c.Do("PING")
-			if err != nil {
-				defer c.Close()
-			}
-			return err
-		},
+		TestOnBorrow: r.testConn,
 	}
+	r.PoolOptions.Apply(&r.redisPool)
 }
 
 func (r *RedisBackend) Reconnect() {
+	r.health.Reconnected()
 	r.redisPool.Close()
 	r.Connect()
 }
 
-func (r *RedisBackend) Keys(key string) ([]string, error) {
-	conn := r.redisPool.Get()
-	defer conn.Close()
+// getConn returns a pooled connection.  If redis can't be reached it
+// reconnects with exponential backoff, up to utils.DefaultConnRetries
+// times, before giving up.
+func (r *RedisBackend) getConn() (redis.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		conn := r.pool.Get(&r.redisPool)
+		err := conn.Err()
+		if err == nil {
+			r.health.OK()
+			return conn, nil
+		}
 
-	if conn.Err() != nil {
 		conn.Close()
+		// redis is fine, we're just out of connections
+		if err == redis.ErrPoolExhausted {
+			return nil, err
+		}
+		r.health.Failed(err)
+		if attempt == utils.DefaultConnRetries {
+			return nil, err
+		}
+		time.Sleep(r.health.Backoff())
 		r.Reconnect()
-		return nil, conn.Err()
 	}
+}
 
-	return redis.Strings(conn.Do("KEYS", key))
+// Status reports whether redis was reachable on the last attempt and the
+// connection pool's usage.
+func (r *RedisBackend) Status() utils.BackendStatus {
+	status := r.health.Status()
+	stats := r.pool.Stats(&r.redisPool)
+	status.Pool = &stats
+	return status
 }
 
-func (r *RedisBackend) Expire(key string, ttl uint64) (int, error) {
-	conn := r.redisPool.Get()
+func (r *RedisBackend) Keys(key string) ([]string, error) {
+	conn, err := r.getConn()
+	if err != nil {
+		return nil, err
+	}
 	defer conn.Close()
 
-	if conn.Err() != nil {
-		conn.Close()
-		r.Reconnect()
-		return 0, conn.Err()
+	keys, err := utils.ScanKeys(conn, r.key(key), r.ScanCount)
+	if err != nil || r.Namespace == "" {
+		return keys, err
 	}
 
-	return redis.Int(conn.Do("EXPIRE", key, ttl))
+	for i, k := range keys {
+		keys[i] = strings.TrimPrefix(k, r.Namespace+":")
+	}
+	return keys, nil
 }
 
-func (r *RedisBackend) Ttl(key string) (int, error) {
-	conn := r.redisPool.Get()
+func (r *RedisBackend) Expire(key string, ttl uint64) (int, error) {
+	conn, err := r.getConn()
+	if err != nil {
+		return 0, err
+	}
 	defer conn.Close()
 
-	if conn.Err() != nil {
-		conn.Close()
-		r.Reconnect()
-		return 0, conn.Err()
+	return redis.Int(conn.Do("EXPIRE", r.key(key), ttl))
+}
+
+func (r *RedisBackend) Ttl(key string) (int, error) {
+	conn, err := r.getConn()
+	if err != nil {
+		return 0, err
 	}
+	defer conn.Close()
 
-	return redis.Int(conn.Do("TTL", key))
+	return redis.Int(conn.Do("TTL", r.key(key)))
 }
 
 func (r *RedisBackend) Delete(key string) (int, error) {
-	conn := r.redisPool.Get()
-	defer conn.Close()
-
-	if conn.Err() != nil {
-		conn.Close()
-		r.Reconnect()
-		return 0, conn.Err()
+	conn, err := r.getConn()
+	if err != nil {
+		return 0, err
 	}
+	defer conn.Close()
 
-	return redis.Int(conn.Do("DEL", key))
+	return redis.Int(conn.Do("DEL", r.key(key)))
 }
 
 func (r *RedisBackend) AddMember(key, value string) (int, error) {
-	conn := r.redisPool.Get()
-	defer conn.Close()
-
-	if conn.Err() != nil {
-		conn.Close()
-		r.Reconnect()
-		return 0, conn.Err()
+	conn, err := r.getConn()
+	if err != nil {
+		return 0, err
 	}
+	defer conn.Close()
 
-	return redis.Int(conn.Do("SADD", key, value))
+	return redis.Int(conn.Do("SADD", r.key(key), value))
 }
 
 func (r *RedisBackend) RemoveMember(key, value string) (int, error) {
-	conn := r.redisPool.Get()
+	conn, err := r.getConn()
+	if err != nil {
+		return 0, err
+	}
 	defer conn.Close()
 
-	if conn.Err() != nil {
-		conn.Close()
-		r.Reconnect()
-		return 0, conn.Err()
+	return redis.Int(conn.Do("SREM", r.key(key), value))
+}
+
+// LogChange adds change to the env's change log, a sorted set scored by
+// time, and trims it to MaxChanges entries.
+func (r *RedisBackend) LogChange(env string, change *Change) error {
+	entry, err := json.Marshal(change)
+	if err != nil {
+		return err
 	}
 
-	return redis.Int(conn.Do("SREM", key, value))
+	conn, err := r.getConn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	key := r.key(path.Join(env, "changelog"))
+	score := change.Time.UnixNano() / int64(time.Millisecond)
+	if _, err := conn.Do("ZADD", key, score, entry); err != nil {
+		return err
+	}
+	_, err = conn.Do("ZREMRANGEBYRANK", key, 0, -(MaxChanges + 1))
+	return err
 }
 
-func (r *RedisBackend) Members(key string) ([]string, error) {
-	conn := r.redisPool.Get()
+func (r *RedisBackend) ListChanges(env, app string, limit int) ([]*Change, error) {
+	conn, err := r.getConn()
+	if err != nil {
+		return nil, err
+	}
 	defer conn.Close()
 
-	if conn.Err() != nil {
-		conn.Close()
-		r.Reconnect()
-		return nil, conn.Err()
+	entries, err := redis.Strings(conn.Do("ZREVRANGE", r.key(path.Join(env, "changelog")), 0, -1))
+	if err != nil {
+		return nil, err
 	}
-
-	return redis.Strings(conn.Do("SMEMBERS", key))
+	return filterChanges(entries, app, limit)
 }
 
-func (r *RedisBackend) Notify(key, value string) (int, error) {
-	conn := r.redisPool.Get()
+func (r *RedisBackend) Members(key string) ([]string, error) {
+	conn, err := r.getConn()
+	if err != nil {
+		return nil, err
+	}
 	defer conn.Close()
 
-	if conn.Err() != nil {
-		conn.Close()
-		r.Reconnect()
-		return 0, conn.Err()
+	return redis.Strings(conn.Do("SMEMBERS", r.key(key)))
+}
+
+func (r *RedisBackend) Notify(key, value string) (int, error) {
+	conn, err := r.getConn()
+	if err != nil {
+		return 0, err
 	}
+	defer conn.Close()
 
-	return redis.Int(conn.Do("PUBLISH", key, value))
+	return redis.Int(conn.Do("PUBLISH", r.key(key), value))
 }
 
-func (r *RedisBackend) subscribeChannel(key string, msgs chan string) {
+// subscribe sends every message published to channel to msgs, or with
+// pattern set, the name of every channel matching it that's published to.
+// It resubscribes with backoff whenever the connection is lost.
+func (r *RedisBackend) subscribe(channel string, pattern bool, msgs chan string) {
 	var wg sync.WaitGroup
 
 	newPubSubPool := func() redis.Pool {
@@ -435,39 +655,38 @@ func (r *RedisBackend) subscribeChannel(key string, msgs chan string) {
 			MaxIdle:     1,
 			IdleTimeout: 0,
 			Dial: func() (redis.Conn, error) {
-				c, err := redis.Dial("tcp", r.RedisHost)
+				c, err := r.dial(5*time.Second, 0, 0)
 				if err != nil {
 					return nil, err
 				}
 				return c, err
 			},
 			// test every connection for now
-			TestOnBorrow: func(c redis.Conn, t time.Time) error {
-				_, err := c.Do("PING")
-				if err != nil {
-					defer c.Close()
-				}
-				return err
-			},
+			TestOnBorrow: r.testConn,
 		}
 	}
 
 	redisPool := newPubSubPool()
+	reconnected := false
 	for {
-
 		conn := redisPool.Get()
-		defer conn.Close()
-		if conn.Err() != nil {
+		if err := conn.Err(); err != nil {
+			r.health.Failed(err)
 			conn.Close()
 			redisPool.Close()
-			log.Printf("ERROR: %v\n", conn.Err())
-			time.Sleep(5 * time.Second)
+			log.Printf("ERROR: %v\n", err)
+			time.Sleep(r.health.Backoff())
 			redisPool = newPubSubPool()
+			reconnected = true
 			continue
 		}
 
 		wg.Add(2)
 		psc := redis.PubSubConn{Conn: conn}
+		done := make(chan struct{})
+		if r.Sentinel != nil {
+			go r.watchMaster(psc, done)
+		}
 		go func() {
 			defer wg.Done()
 			for {
@@ -475,7 +694,19 @@ func (r *RedisBackend) subscribeChannel(key string, msgs chan string) {
 				case redis.Message:
 					msg := string(n.Data)
 					msgs <- msg
+				case redis.PMessage:
+					msgs <- n.Channel
+				case redis.Subscription:
+					r.health.OK()
+					// anything published while we were disconnected was
+					// missed, so have the store check for changes
+					if reconnected && pattern {
+						msgs <- ""
+					} else if reconnected {
+						msgs <- "config"
+					}
 				case error:
+					r.health.Failed(n)
 					psc.Close()
 					redisPool.Close()
 					log.Printf("ERROR: %v\n", n)
@@ -486,43 +717,129 @@ func (r *RedisBackend) subscribeChannel(key string, msgs chan string) {
 
 		go func() {
 			defer wg.Done()
-			psc.Subscribe(key)
-			log.Printf("Monitoring for config changes on channel: %s\n", key)
+			if pattern {
+				psc.PSubscribe(channel)
+				log.Printf("Monitoring for config changes matching: %s\n", channel)
+				return
+			}
+			psc.Subscribe(r.key(channel))
+			log.Printf("Monitoring for config changes on channel: %s\n", channel)
 		}()
 		wg.Wait()
+		close(done)
+
+		reconnected = true
+		time.Sleep(r.health.Backoff())
+		redisPool = newPubSubPool()
+	}
+}
+
+// watchMaster closes psc when the sentinels report a new master so that
+// subscribeChannel resubscribes against it.
+func (r *RedisBackend) watchMaster(psc redis.PubSubConn, done chan struct{}) {
+	master, err := r.Sentinel.MasterAddr(5 * time.Second)
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+	}
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			current, err := r.Sentinel.MasterAddr(5 * time.Second)
+			if err != nil {
+				log.Printf("ERROR: %v\n", err)
+				continue
+			}
+			if master != "" && current != master {
+				log.Printf("Redis master changed from %s to %s\n", master, current)
+				psc.Close()
+				return
+			}
+			master = current
+		}
 	}
 }
 
 func (r *RedisBackend) Subscribe(key string) chan string {
 	msgs := make(chan string)
-	go r.subscribeChannel(key, msgs)
+	go r.subscribe(key, false, msgs)
 	return msgs
 }
 
-func (r *RedisBackend) Set(key, field string, value string) (string, error) {
-	conn := r.redisPool.Get()
-	defer conn.Close()
+// WatchKeys sends the name of every key matching pattern that's written,
+// by galaxy or anything else, using keyspace notifications.  Redis must
+// have notify-keyspace-events enabled for hashes, e.g. "Kh" or "KA".
+// Returns nil if notifications are unavailable.
+func (r *RedisBackend) WatchKeys(pattern string) chan string {
+	if r.Cluster != nil {
+		// notifications are only delivered to clients of the node that
+		// owns the key
+		log.Printf("Keyspace notifications are not supported with redis cluster\n")
+		return nil
+	}
 
-	if conn.Err() != nil {
-		conn.Close()
-		r.Reconnect()
-		return "", conn.Err()
+	conn, err := r.getConn()
+	if err != nil {
+		log.Printf("ERROR: %v\n", err)
+		return nil
+	}
+	reply, err := redis.Strings(conn.Do("CONFIG", "GET", "notify-keyspace-events"))
+	conn.Close()
+	// CONFIG is often disabled by managed redis so only trust a reply
+	if err == nil && len(reply) == 2 && !utils.KeyspaceEventsEnabled(reply[1], "h") {
+		log.Printf("WARN: notify-keyspace-events is %q, external config changes won't be seen until the next poll\n", reply[1])
+		return nil
 	}
 
-	return redis.String(conn.Do("HMSET", key, field, value))
+	prefix := fmt.Sprintf("__keyspace@%d__:", r.db())
+	events := make(chan string)
+	go r.subscribe(prefix+r.key(pattern), true, events)
+
+	keys := make(chan string)
+	go func() {
+		for channel := range events {
+			key := strings.TrimPrefix(channel, prefix)
+			if r.Namespace != "" {
+				key = strings.TrimPrefix(key, r.Namespace+":")
+			}
+			keys <- key
+		}
+	}()
+	return keys
 }
 
-func (r *RedisBackend) Get(key, field string) (string, error) {
-	conn := r.redisPool.Get()
+func (r *RedisBackend) db() int {
+	switch {
+	case r.Sentinel != nil && r.Sentinel.Options != nil:
+		return r.Sentinel.Options.DB
+	case r.Options != nil:
+		return r.Options.DB
+	}
+	return 0
+}
+
+func (r *RedisBackend) Set(key, field string, value string) (string, error) {
+	conn, err := r.getConn()
+	if err != nil {
+		return "", err
+	}
 	defer conn.Close()
 
-	if conn.Err() != nil {
-		conn.Close()
-		r.Reconnect()
-		return "", conn.Err()
+	return redis.String(conn.Do("HMSET", r.key(key), field, value))
+}
+
+func (r *RedisBackend) Get(key, field string) (string, error) {
+	conn, err := r.getConn()
+	if err != nil {
+		return "", err
 	}
+	defer conn.Close()
 
-	ret, err := redis.String(conn.Do("HGET", key, field))
+	ret, err := redis.String(conn.Do("HGET", r.key(key), field))
 	if err != nil && err == redis.ErrNil {
 		return "", nil
 	}
@@ -531,16 +848,13 @@ func (r *RedisBackend) Get(key, field string) (string, error) {
 }
 
 func (r *RedisBackend) GetAll(key string) (map[string]string, error) {
-	conn := r.redisPool.Get()
-	defer conn.Close()
-
-	if conn.Err() != nil {
-		conn.Close()
-		r.Reconnect()
-		return nil, conn.Err()
+	conn, err := r.getConn()
+	if err != nil {
+		return nil, err
 	}
+	defer conn.Close()
 
-	matches, err := redis.Values(conn.Do("HGETALL", key))
+	matches, err := redis.Values(conn.Do("HGETALL", r.key(key)))
 	if err != nil {
 		return nil, err
 	}
@@ -555,35 +869,41 @@ func (r *RedisBackend) GetAll(key string) (map[string]string, error) {
 
 }
 
-func (r *RedisBackend) SetMulti(key string, values map[string]string) (string, error) {
-	conn := r.redisPool.Get()
+// GetAllMulti returns the hash stored at each of keys, in order, using a
+// single pipeline.
+func (r *RedisBackend) GetAllMulti(keys []string) ([]map[string]string, error) {
+	conn, err := r.getConn()
+	if err != nil {
+		return nil, err
+	}
 	defer conn.Close()
 
-	if conn.Err() != nil {
-		conn.Close()
-		r.Reconnect()
-		return "", conn.Err()
+	return utils.HGetAllMulti(conn, r.keys(keys))
+}
+
+func (r *RedisBackend) SetMulti(key string, values map[string]string) (string, error) {
+	conn, err := r.getConn()
+	if err != nil {
+		return "", err
 	}
+	defer conn.Close()
 
-	redisArgs := redis.Args{}.Add(key).AddFlat(values)
+	redisArgs := redis.Args{}.Add(r.key(key)).AddFlat(values)
 	return redis.String(conn.Do("HMSET", redisArgs...))
 }
 
 func (r *RedisBackend) DeleteMulti(key string, fields ...string) (int, error) {
-	conn := r.redisPool.Get()
-	defer conn.Close()
-
-	if conn.Err() != nil {
-		conn.Close()
-		r.Reconnect()
-		return 0, conn.Err()
+	conn, err := r.getConn()
+	if err != nil {
+		return 0, err
 	}
+	defer conn.Close()
 
 	args := []string{}
 	for _, field := range fields {
 		args = append(args, field)
 	}
-	redisArgs := redis.Args{}.Add(key).AddFlat(args)
+	redisArgs := redis.Args{}.Add(r.key(key)).AddFlat(args)
 	return redis.Int(conn.Do("HDEL", redisArgs...))
 
 }
@@ -603,13 +923,7 @@ func (r *RedisBackend) UpdateHost(env, pool string, host HostInfo) error {
 		return err
 	}
 
-	save := false
-	if existing.Get("HostIP") != host.HostIP {
-		existing.Set("HostIP", host.HostIP)
-		save = true
-	}
-
-	if save {
+	if updateHostFields(existing, host) {
 		err = r.SaveVMap(key, existing)
 		if err != nil {
 			return err
@@ -627,18 +941,17 @@ func (r *RedisBackend) ListHosts(env, pool string) ([]HostInfo, error) {
 		return nil, err
 	}
 
+	serialized, err := r.GetAllMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+
 	hosts := []HostInfo{}
 
-	for _, k := range keys {
+	for i := range keys {
 		existing := utils.NewVersionedMap()
-
-		err := r.LoadVMap(k, existing)
-		if err != nil {
-			return nil, err
-		}
-		hosts = append(hosts, HostInfo{
-			HostIP: existing.Get("HostIP"),
-		})
+		existing.UnmarshalMap(serialized[i])
+		hosts = append(hosts, hostInfoFrom(existing))
 	}
 	return hosts, nil
 }
@@ -24,7 +24,7 @@ func (t *TestConn) Record(cmd string, args ...interface{}) {
 		if v == nil {
 			continue
 		}
-		sa = append(sa, v.(string))
+		sa = append(sa, fmt.Sprint(v))
 	}
 	t.History = append(t.History, fmt.Sprintf("%s %s", cmd, strings.Join(sa, " ")))
 }
@@ -95,7 +95,7 @@ func TestAppExistsKeyFormat(t *testing.T) {
 
 	r, c := NewTestRedisBackend()
 	r.AppExists("foo", "dev")
-	assertInHistory(t, c.History, "KEYS dev/foo/*")
+	assertInHistory(t, c.History, "SCAN 0 MATCH dev/foo/* COUNT 1000")
 }
 
 func assertInHistory(t *testing.T, history []string, cmd string) {
@@ -109,3 +109,68 @@ func assertInHistory(t *testing.T, history []string, cmd string) {
 		t.Fatalf("Expected %s in [%s]", cmd, strings.Join(history, ","))
 	}
 }
+
+func TestUpdateAppConflict(t *testing.T) {
+	r, c := NewTestRedisBackend()
+	c.DoFn = func(cmd string, args ...interface{}) (interface{}, error) {
+		if cmd == "EVALSHA" {
+			// the config ID didn't match
+			return int64(0), nil
+		}
+		return nil, nil
+	}
+
+	cfg := NewAppConfig("foo", "")
+	cfg.EnvSet("FOO", "bar")
+	_, err := r.UpdateApp(cfg, "dev")
+	if err != ErrConflict {
+		t.Fatalf("UpdateApp() = %v, want %v", err, ErrConflict)
+	}
+
+	found := false
+	for _, cmd := range c.History {
+		if strings.HasPrefix(cmd, "EVALSHA ") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("Expected EVALSHA in [%s]", strings.Join(c.History, ","))
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	r, c := NewTestRedisBackend()
+	r.Namespace = "galaxy:prod1"
+	c.DoFn = func(cmd string, args ...interface{}) (interface{}, error) {
+		if cmd == "SCAN" {
+			return []interface{}{[]byte("0"), []interface{}{[]byte("galaxy:prod1:dev/foo/version")}}, nil
+		}
+		return nil, nil
+	}
+
+	keys, err := r.Keys("dev/foo/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertInHistory(t, c.History, "SCAN 0 MATCH galaxy:prod1:dev/foo/* COUNT 1000")
+
+	if len(keys) != 1 || keys[0] != "dev/foo/version" {
+		t.Fatalf("Keys() = %v, want %v", keys, []string{"dev/foo/version"})
+	}
+
+	r.Expire("dev/foo/version", 10)
+	assertInHistory(t, c.History, "EXPIRE galaxy:prod1:dev/foo/version 10")
+}
+
+func TestGetAppsInvalidVMap(t *testing.T) {
+	r, c := NewTestRedisBackend()
+	c.ReceiveFn = func() (interface{}, error) {
+		// a field without the :op:version suffix
+		return []interface{}{[]byte("FOO"), []byte("bar")}, nil
+	}
+
+	apps, err := r.getApps([]string{"foo"}, "dev")
+	if err == nil {
+		t.Fatalf("getApps() = %v, want an error for the invalid field", apps)
+	}
+}
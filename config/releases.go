@@ -0,0 +1,109 @@
+package config
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// MaxReleases is how many of an app's recent deploys are kept to roll back
+// to.
+const MaxReleases = 10
+
+// Release is the image and env an app's config had after a saved change,
+// identified by the change's deploy ID.
+type Release struct {
+	DeployID  string            `json:"deploy_id"`
+	Time      time.Time         `json:"time"`
+	Version   string            `json:"version"`
+	VersionID string            `json:"version_id,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	Ports     map[string]string `json:"ports,omitempty"`
+}
+
+// Releases returns the app's last MaxReleases deploys, newest first.
+// Entries that can't be decoded are skipped.
+func (s *AppConfig) Releases() []*Release {
+	releases := []*Release{}
+	for _, slot := range s.releasesVMap.Keys() {
+		val := s.releasesVMap.Get(slot)
+		if val == "" {
+			continue
+		}
+
+		release := &Release{}
+		if err := json.Unmarshal([]byte(val), release); err != nil {
+			continue
+		}
+		releases = append(releases, release)
+	}
+	sort.Sort(sort.Reverse(releasesByTime(releases)))
+	return releases
+}
+
+// addRelease records the config's current image and env as a release made
+// at now, replacing the oldest once there are MaxReleases.  Releases are
+// kept in a fixed set of slots so old ones don't pile up in the config.
+func (s *AppConfig) addRelease(now time.Time) {
+	val, err := json.Marshal(&Release{
+		DeployID:  s.DeployID(),
+		Time:      now,
+		Version:   s.Version(),
+		VersionID: s.VersionID(),
+		Env:       s.Env(),
+		Ports:     s.Ports(),
+	})
+	if err != nil {
+		return
+	}
+
+	slot := ""
+	var oldest time.Time
+	for i := 0; i < MaxReleases; i++ {
+		key := strconv.Itoa(i)
+		existing := s.releasesVMap.Get(key)
+		if existing == "" {
+			slot = key
+			break
+		}
+
+		release := &Release{}
+		if err := json.Unmarshal([]byte(existing), release); err != nil {
+			slot = key
+			break
+		}
+		if slot == "" || release.Time.Before(oldest) {
+			slot, oldest = key, release.Time
+		}
+	}
+	s.releasesVMap.SetVersion(slot, string(val), s.nextID())
+}
+
+// Restore sets the config's image, env and ports back to release's.
+func (s *AppConfig) Restore(release *Release) {
+	s.SetVersion(release.Version)
+	s.SetVersionID(release.VersionID)
+
+	for k, v := range s.Env() {
+		if _, ok := release.Env[k]; !ok && v != "" {
+			s.EnvSet(k, "")
+		}
+	}
+	for k, v := range release.Env {
+		if s.EnvGet(k) != v {
+			s.EnvSet(k, v)
+		}
+	}
+
+	s.ClearPorts()
+	for port, portType := range release.Ports {
+		s.AddPort(port, portType)
+	}
+}
+
+type releasesByTime []*Release
+
+func (l releasesByTime) Len() int           { return len(l) }
+func (l releasesByTime) Less(i, j int) bool { return l[i].Time.Before(l[j].Time) }
+func (l releasesByTime) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
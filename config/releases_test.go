@@ -0,0 +1,60 @@
+package config
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReleases(t *testing.T) {
+	sc := NewAppConfig("foo", "")
+	start := time.Now().UTC()
+
+	for i := 0; i < MaxReleases+2; i++ {
+		sc.SetVersion("foo:" + strconv.Itoa(i))
+		sc.setDeployID(strconv.Itoa(i))
+		sc.addRelease(start.Add(time.Duration(i) * time.Second))
+	}
+
+	releases := sc.Releases()
+	if len(releases) != MaxReleases {
+		t.Fatalf("len(Releases()) = %d, want %d", len(releases), MaxReleases)
+	}
+	if releases[0].Version != "foo:11" {
+		t.Fatalf("newest release = %s, want foo:11", releases[0].Version)
+	}
+	if oldest := releases[len(releases)-1]; oldest.Version != "foo:2" {
+		t.Fatalf("oldest release = %s, want foo:2", oldest.Version)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	sc := NewAppConfig("foo", "foo:1")
+	sc.SetVersionID("abc")
+	sc.EnvSet("A", "1")
+	sc.EnvSet("B", "2")
+	sc.AddPort("8080", "tcp")
+	sc.setDeployID("1")
+	sc.addRelease(time.Now().UTC())
+
+	sc.SetVersion("foo:2")
+	sc.SetVersionID("def")
+	sc.EnvSet("A", "changed")
+	sc.EnvSet("B", "")
+	sc.EnvSet("C", "3")
+	sc.ClearPorts()
+	sc.AddPort("9090", "tcp")
+
+	sc.Restore(sc.Releases()[0])
+
+	if sc.Version() != "foo:1" || sc.VersionID() != "abc" {
+		t.Fatalf("version = %s %s, want foo:1 abc", sc.Version(), sc.VersionID())
+	}
+	if want := map[string]string{"A": "1", "B": "2"}; !reflect.DeepEqual(sc.Env(), want) {
+		t.Fatalf("Env() = %v, want %v", sc.Env(), want)
+	}
+	if want := map[string]string{"8080": "tcp"}; !reflect.DeepEqual(sc.Ports(), want) {
+		t.Fatalf("Ports() = %v, want %v", sc.Ports(), want)
+	}
+}
@@ -1,10 +1,14 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/litl/galaxy/log"
 	"github.com/litl/galaxy/utils"
@@ -15,16 +19,90 @@ All config opbects in redis will be stored in a hash with an id key.
 Services will have id, version and environment keys; while Hosts will have id
 and location keys.
 
-TODO: IMPORTANT: make an atomic compare-and-swap script to save configs, or
-      switch to ORDERED SETS and log changes
+Config and registration writes are made with compare-and-swap scripts so
+concurrent writers get ErrConflict rather than overwriting each other.
+
+Every create, update and delete of an app is recorded in the env's change
+log, a sorted set in redis, which Store.History reads back.
 */
 
 const (
 	DefaultTTL = 60
+
+	// ServicePortStart and ServicePortEnd bound the shuttle ports handed
+	// out to apps.  They're below the host ports containers publish on.
+	ServicePortStart = 10000
+	ServicePortEnd   = 19999
 )
 
+// HostInfo is what each host reports about itself in its heartbeat.
 type HostInfo struct {
 	HostIP string
+	// Memory is the host's total memory in bytes
+	Memory int64
+	CPUs   int
+	// Containers is the number of galaxy containers running on the host
+	Containers int
+	// Version is the version of commander running on the host
+	Version string
+	// Conflicts is the number of registrations the host refused to
+	// overwrite because they belonged to another container
+	Conflicts int
+	// DockerVersion and DockerAPIVersion are the version of docker on the
+	// host and the API version commander uses with it
+	DockerVersion    string
+	DockerAPIVersion string
+	// Labels are the host's comma separated labels, e.g.
+	// "ssd,az=us-east-1a", matched against apps' GALAXY_CONSTRAINTS
+	Labels string
+}
+
+// fields returns the host info as it's stored in a VersionedMap.
+func (h HostInfo) fields() map[string]string {
+	return map[string]string{
+		"HostIP":           h.HostIP,
+		"Memory":           strconv.FormatInt(h.Memory, 10),
+		"CPUs":             strconv.Itoa(h.CPUs),
+		"Conflicts":        strconv.Itoa(h.Conflicts),
+		"Containers":       strconv.Itoa(h.Containers),
+		"Version":          h.Version,
+		"DockerVersion":    h.DockerVersion,
+		"DockerAPIVersion": h.DockerAPIVersion,
+		"Labels":           h.Labels,
+	}
+}
+
+// hostInfoFrom reads host info saved by fields.  Hosts running an older
+// commander only report their IP.
+func hostInfoFrom(m *utils.VersionedMap) HostInfo {
+	memory, _ := strconv.ParseInt(m.Get("Memory"), 10, 64)
+	cpus, _ := strconv.Atoi(m.Get("CPUs"))
+	containers, _ := strconv.Atoi(m.Get("Containers"))
+	conflicts, _ := strconv.Atoi(m.Get("Conflicts"))
+	return HostInfo{
+		HostIP:           m.Get("HostIP"),
+		Memory:           memory,
+		CPUs:             cpus,
+		Containers:       containers,
+		Version:          m.Get("Version"),
+		Conflicts:        conflicts,
+		DockerVersion:    m.Get("DockerVersion"),
+		DockerAPIVersion: m.Get("DockerAPIVersion"),
+		Labels:           m.Get("Labels"),
+	}
+}
+
+// updateHostFields sets the fields of m that differ from host and returns
+// true if any changed.
+func updateHostFields(m *utils.VersionedMap, host HostInfo) bool {
+	changed := false
+	for k, v := range host.fields() {
+		if m.Get(k) != v {
+			m.Set(k, v)
+			changed = true
+		}
+	}
+	return changed
 }
 
 type Store struct {
@@ -32,35 +110,80 @@ type Store struct {
 	Hostname     string
 	TTL          uint64
 	OutputBuffer *utils.OutputBuffer
-	pollCh       chan bool
-	registryURL  string
+	// Actor is recorded in the change log as the author of each change
+	Actor       string
+	pollCh      chan bool
+	registryURL string
+	// replica, if set, serves ListApps
+	replica Backend
 }
 
 func NewStore(ttl uint64) *Store {
 	return &Store{
 		TTL:    ttl,
+		Actor:  DefaultActor(),
 		pollCh: make(chan bool),
 	}
 
 }
 
-// Build the Redis Pool
+// Connect builds the backend for the scheme of registryURL
 func (r *Store) Connect(registryURL string) {
 
 	r.registryURL = registryURL
+	r.Backend = newBackend(registryURL)
+	r.Backend.Connect()
+}
+
+// Mirror copies all writes to the backend for mirrorURL as well.  Reads
+// still come from the backend given to Connect.
+func (r *Store) Mirror(mirrorURL string) {
+	secondary := newBackend(mirrorURL)
+	secondary.Connect()
+	r.Backend = &MirrorBackend{
+		Primary:   r.Backend,
+		Secondary: secondary,
+	}
+}
+
+// ReadReplica reads app listings from the backend for replicaURL, e.g. a
+// redis replica, to take load off the primary.  Everything else, including
+// reads that are about to be written back, still uses the primary.
+func (r *Store) ReadReplica(replicaURL string) {
+	r.replica = newBackend(replicaURL)
+	r.replica.Connect()
+}
+
+// VerifyMirror returns the differences between the primary and mirror
+// backends for env.  It fails if Mirror was not called.
+func (r *Store) VerifyMirror(env string) ([]string, error) {
+	mirror, ok := r.Backend.(*MirrorBackend)
+	if !ok {
+		return nil, fmt.Errorf("no mirror configured")
+	}
+	return mirror.Verify(env)
+}
+
+// BackendStatus reports the connection health of the backend.  Backends
+// that don't track their connection are always reported as healthy.
+func (r *Store) BackendStatus() utils.BackendStatus {
+	if backend, ok := r.Backend.(statusReporter); ok {
+		return backend.Status()
+	}
+	return utils.BackendStatus{Healthy: true}
+}
+
+func newBackend(registryURL string) Backend {
 	u, err := url.Parse(registryURL)
 	if err != nil {
 		log.Fatalf("ERROR: Unable to parse %s", err)
 	}
 
-	if strings.ToLower(u.Scheme) == "redis" {
-		r.Backend = &RedisBackend{
-			RedisHost: u.Host,
-		}
-		r.Backend.Connect()
-	} else {
+	factory, ok := lookupBackend(u.Scheme)
+	if !ok {
 		log.Fatalf("ERROR: Unsupported registry backend: %s", u)
 	}
+	return factory(*u)
 }
 
 func (r *Store) PoolExists(env, pool string) (bool, error) {
@@ -158,8 +281,16 @@ func (r *Store) CreateApp(app, env string) (bool, error) {
 		return false, err
 	}
 
-	return r.Backend.CreateApp(app, env)
+	created, err := r.Backend.CreateApp(app, env)
+	if !created || err != nil {
+		return created, err
+	}
 
+	svcCfg, err := r.Backend.GetApp(app, env)
+	if err == nil && svcCfg != nil {
+		r.logChange(env, "create", app, 0, svcCfg, "")
+	}
+	return true, nil
 }
 
 func (r *Store) DeleteApp(app, env string) (bool, error) {
@@ -192,6 +323,7 @@ func (r *Store) DeleteApp(app, env string) (bool, error) {
 	if !deleted || err != nil {
 		return deleted, err
 	}
+	r.logChange(env, "delete", app, svcCfg.revision(), nil, "")
 
 	err = r.NotifyEnvChanged(env)
 	if err != nil {
@@ -202,6 +334,16 @@ func (r *Store) DeleteApp(app, env string) (bool, error) {
 }
 
 func (r *Store) ListApps(env string) ([]*AppConfig, error) {
+	if r.replica != nil {
+		return r.replica.ListApps(env)
+	}
+	return r.Backend.ListApps(env)
+}
+
+// ListPrimaryApps lists env's apps from the primary even if there's a read
+// replica, for callers that delete whatever isn't listed and can't trust a
+// replica that's behind.
+func (r *Store) ListPrimaryApps(env string) ([]*AppConfig, error) {
 	return r.Backend.ListApps(env)
 }
 
@@ -222,11 +364,38 @@ func (r *Store) GetApp(app, env string) (*AppConfig, error) {
 	return r.Backend.GetApp(app, env)
 }
 
+// Dependencies returns the apps that app declares in GALAXY_DEPENDS.
+func (r *Store) Dependencies(app, env string) ([]string, error) {
+	svcCfg, err := r.GetApp(app, env)
+	if err != nil {
+		return nil, err
+	}
+	return svcCfg.Depends(), nil
+}
+
 func (r *Store) UpdateApp(svcCfg *AppConfig, env string) (bool, error) {
+	return r.updateApp(svcCfg, env, "")
+}
+
+// RollbackApp saves svcCfg like UpdateApp, recording in the change log
+// that it rolled back from failed.
+func (r *Store) RollbackApp(svcCfg *AppConfig, env, failed string) (bool, error) {
+	return r.updateApp(svcCfg, env, failed)
+}
+
+func (r *Store) updateApp(svcCfg *AppConfig, env, rolledBack string) (bool, error) {
+	oldID := svcCfg.loadedID
+	// only changes containers run with start a deploy
+	if svcCfg.ID() > oldID {
+		svcCfg.setDeployID(newDeployID())
+		svcCfg.addRelease(time.Now().UTC())
+	}
+
 	updated, err := r.Backend.UpdateApp(svcCfg, env)
 	if !updated || err != nil {
 		return updated, err
 	}
+	r.logChange(env, "update", svcCfg.Name, oldID, svcCfg, rolledBack)
 
 	err = r.NotifyEnvChanged(env)
 	if err != nil {
@@ -235,6 +404,49 @@ func (r *Store) UpdateApp(svcCfg *AppConfig, env string) (bool, error) {
 	return true, nil
 }
 
+// ServicePort returns svcCfg's shuttle port, GALAXY_PORT, or if it doesn't
+// have one the lowest port in env that no app's GALAXY_PORT or
+// GALAXY_PORT_<port> is using.  Once it's saved as GALAXY_PORT it's kept
+// across deploys, so the <APP>_ADDR of apps that depend on it stays the
+// same.
+func (r *Store) ServicePort(svcCfg *AppConfig, env string) (string, error) {
+	if port := svcCfg.Env()["GALAXY_PORT"]; port != "" {
+		return port, nil
+	}
+
+	apps, err := r.Backend.ListApps(env)
+	if err != nil {
+		return "", err
+	}
+
+	used := make(map[string]bool)
+	for _, cfg := range apps {
+		for k, v := range cfg.Env() {
+			if k == "GALAXY_PORT" || strings.HasPrefix(k, "GALAXY_PORT_") {
+				used[v] = true
+			}
+		}
+	}
+
+	for n := ServicePortStart; n <= ServicePortEnd; n++ {
+		if port := strconv.Itoa(n); !used[port] {
+			return port, nil
+		}
+	}
+	return "", fmt.Errorf("no free service ports in %s", env)
+}
+
+// newDeployID returns a short random ID for a config change.
+func newDeployID() string {
+	b := make([]byte, 4)
+	_, err := rand.Read(b)
+	if err != nil {
+		// fall back to the time, which is unique enough
+		return strconv.FormatInt(time.Now().UnixNano()&0xffffffff, 16)
+	}
+	return hex.EncodeToString(b)
+}
+
 func (r *Store) UpdateHost(env, pool string, host HostInfo) error {
 	return r.Backend.UpdateHost(env, pool, host)
 }
@@ -2,6 +2,7 @@ package config
 
 import (
 	"errors"
+	"strings"
 	"testing"
 )
 
@@ -399,3 +400,78 @@ func assertPoolCreated(t *testing.T, r *Store, pool string) {
 		t.Errorf("CreatePool(%q) = %t, %v, want %t, %v", pool, created, err, true, nil)
 	}
 }
+
+func TestServicePort(t *testing.T) {
+	r, _ := NewTestStore()
+
+	for _, app := range []string{"a", "b", "c"} {
+		assertAppCreated(t, r, app)
+	}
+	aCfg, _ := r.GetApp("a", "dev")
+	aCfg.EnvSet("GALAXY_PORT", "10000")
+	bCfg, _ := r.GetApp("b", "dev")
+	bCfg.EnvSet("GALAXY_PORT_9000", "10001")
+	cCfg, _ := r.GetApp("c", "dev")
+
+	for _, tt := range []struct {
+		cfg  *AppConfig
+		port string
+	}{
+		{aCfg, "10000"},
+		{bCfg, "10002"},
+		{cCfg, "10002"},
+	} {
+		port, err := r.ServicePort(tt.cfg, "dev")
+		if port != tt.port || err != nil {
+			t.Fatalf("ServicePort(%q) = %s, %v, want %s, %v", tt.cfg.Name, port, err, tt.port, nil)
+		}
+	}
+
+	cCfg.EnvSet("GALAXY_PORT", "10002")
+	if port, err := r.ServicePort(bCfg, "dev"); port != "10003" || err != nil {
+		t.Fatalf("ServicePort(%q) = %s, %v, want %s, %v", "b", port, err, "10003", nil)
+	}
+}
+
+func TestUpdateAppDeployID(t *testing.T) {
+	r, b := NewTestStore()
+	b.UpdateAppFunc = func(svcCfg *AppConfig, env string) (bool, error) {
+		svcCfg.loadedID = svcCfg.revision()
+		return true, nil
+	}
+
+	assertAppCreated(t, r, "app")
+	svcCfg, _ := r.GetApp("app", "dev")
+
+	svcCfg.SetVersion("app:1")
+	if updated, err := r.UpdateApp(svcCfg, "dev"); !updated || err != nil {
+		t.Fatalf("UpdateApp() = %t, %v, want %t, %v", updated, err, true, nil)
+	}
+	first := svcCfg.DeployID()
+	if len(first) != 8 {
+		t.Fatalf("DeployID() = %q, want 8 hex digits", first)
+	}
+	if !strings.HasSuffix(svcCfg.ContainerName(), "_"+first) {
+		t.Fatalf("ContainerName() = %q, want it to end in _%s", svcCfg.ContainerName(), first)
+	}
+
+	// saving without changes keeps the deploy
+	r.UpdateApp(svcCfg, "dev")
+	if svcCfg.DeployID() != first {
+		t.Fatalf("DeployID() = %q, want %q", svcCfg.DeployID(), first)
+	}
+
+	// jobs run in containers of their own
+	name := svcCfg.ContainerName()
+	svcCfg.SetJob(JobConfig{Name: "report", Schedule: "@daily", Command: "bin/report"})
+	r.UpdateApp(svcCfg, "dev")
+	if svcCfg.DeployID() != first || svcCfg.ContainerName() != name {
+		t.Fatalf("DeployID(), ContainerName() = %q, %q, want %q, %q", svcCfg.DeployID(), svcCfg.ContainerName(), first, name)
+	}
+
+	svcCfg.EnvSet("FOO", "bar")
+	r.UpdateApp(svcCfg, "dev")
+	if svcCfg.DeployID() == first {
+		t.Fatalf("DeployID() = %q, want a new one", svcCfg.DeployID())
+	}
+}
@@ -0,0 +1,249 @@
+package discovery
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/registry"
+)
+
+const (
+	// DefaultAPIWait is how long a watch request waits for a change.
+	DefaultAPIWait = 30 * time.Second
+	// MaxAPIWait is the longest wait a watch request can ask for.
+	MaxAPIWait = 5 * time.Minute
+)
+
+// watchLinger is how long an env's watch is kept after its last request so
+// a client polling with ?index= finds it again.
+var watchLinger = time.Minute
+
+// validName matches the env and app names requests can ask for.  Anything
+// else, like a glob, would widen the watch.
+var validName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// APIServer serves the registry over HTTP so tools without registry
+// credentials can read it:
+//
+//	GET /v1/registrations/<env>
+//	GET /v1/registrations/<env>/<app>
+//
+// return the JSON registrations for an env or one of its apps, and the
+// X-Galaxy-Index header identifies the version returned.  Passing that
+// back as ?index= waits until the registrations change, or for ?wait=
+// (default 30s), before responding.
+type APIServer struct {
+	serviceRegistry *registry.ServiceRegistry
+
+	mu sync.Mutex
+	// index counts changes across every watch, so an index from a watch
+	// that's since stopped never matches a new one
+	index   uint64
+	watches map[string]*envWatch
+}
+
+// envWatch tracks changes to an env's registrations.
+type envWatch struct {
+	// start is the index when the watch started, and of the apps that
+	// haven't changed since
+	start uint64
+	index uint64
+	// apps holds the index of each app's last change
+	apps map[string]uint64
+	// changed is closed and replaced on every change
+	changed chan struct{}
+
+	// requests counts the requests using the watch.  It's stopped once
+	// there have been none for watchLinger.
+	requests int
+	idle     *time.Timer
+	stop     chan struct{}
+}
+
+func NewAPIServer(serviceRegistry *registry.ServiceRegistry) *APIServer {
+	return &APIServer{
+		serviceRegistry: serviceRegistry,
+		watches:         make(map[string]*envWatch),
+	}
+}
+
+// ListenAndServe serves the API on addr until it fails.
+func (s *APIServer) ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/registrations/", s.registrations)
+	return http.ListenAndServe(addr, mux)
+}
+
+// watch returns the changes for env, starting to watch it on first use.
+// Callers release it when they're done.
+func (s *APIServer) watch(env string) (*envWatch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if w, ok := s.watches[env]; ok {
+		w.requests += 1
+		if w.idle != nil {
+			w.idle.Stop()
+			w.idle = nil
+		}
+		return w, nil
+	}
+
+	stop := make(chan struct{})
+	events, err := s.serviceRegistry.WatchRegistrations(env, stop)
+	if err != nil {
+		return nil, err
+	}
+
+	s.index += 1
+	w := &envWatch{
+		start:    s.index,
+		index:    s.index,
+		apps:     make(map[string]uint64),
+		changed:  make(chan struct{}),
+		requests: 1,
+		stop:     stop,
+	}
+	s.watches[env] = w
+
+	go func() {
+		for event := range events {
+			s.mu.Lock()
+			s.index += 1
+			w.index = s.index
+			w.apps[path.Base(path.Dir(event.Path))] = w.index
+			close(w.changed)
+			w.changed = make(chan struct{})
+			s.mu.Unlock()
+		}
+	}()
+	return w, nil
+}
+
+// release is called when a request is done with env's watch.  The watch is
+// stopped if it isn't used again within watchLinger.
+func (s *APIServer) release(env string, w *envWatch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.requests -= 1
+	if w.requests > 0 {
+		return
+	}
+
+	var idle *time.Timer
+	idle = time.AfterFunc(watchLinger, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// the watch was picked up again while this was waiting for the lock
+		if w.idle != idle {
+			return
+		}
+		close(w.stop)
+		delete(s.watches, env)
+	})
+	w.idle = idle
+}
+
+// current returns the index of app's registrations, or the env's if app is
+// "", and a channel that's closed on the next change.
+func (s *APIServer) current(w *envWatch, app string) (uint64, chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if app == "" {
+		return w.index, w.changed
+	}
+	if index, ok := w.apps[app]; ok {
+		return index, w.changed
+	}
+	return w.start, w.changed
+}
+
+func (s *APIServer) registrations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/registrations/"), "/"), "/")
+	if parts[0] == "" || len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+	env, app := parts[0], ""
+	if len(parts) == 2 {
+		app = parts[1]
+	}
+	if !validName.MatchString(env) || (app != "" && !validName.MatchString(app)) {
+		http.Error(w, "invalid env or app", http.StatusBadRequest)
+		return
+	}
+
+	wait := DefaultAPIWait
+	if v := r.URL.Query().Get("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, "invalid wait "+v, http.StatusBadRequest)
+			return
+		}
+		wait = d
+	}
+	if wait > MaxAPIWait {
+		wait = MaxAPIWait
+	}
+
+	watch, err := s.watch(env)
+	if err != nil {
+		log.Errorf("ERROR: Unable to watch %s: %s", env, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer s.release(env, watch)
+
+	index, changed := s.current(watch, app)
+	if v := r.URL.Query().Get("index"); v != "" {
+		since, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid index "+v, http.StatusBadRequest)
+			return
+		}
+
+		timeout := time.After(wait)
+		for index == since {
+			select {
+			case <-changed:
+				index, changed = s.current(watch, app)
+				continue
+			case <-timeout:
+			case <-r.Context().Done():
+				return
+			}
+			break
+		}
+	}
+
+	registrations, err := s.serviceRegistry.ListRegistrations(env)
+	if err != nil {
+		log.Errorf("ERROR: Unable to list registrations: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	matching := []registry.ServiceRegistration{}
+	for _, reg := range registrations {
+		if app == "" || reg.Name == app {
+			matching = append(matching, reg)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Galaxy-Index", strconv.FormatUint(index, 10))
+	json.NewEncoder(w).Encode(matching)
+}
@@ -0,0 +1,152 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/litl/galaxy/registry"
+)
+
+func newTestAPIServer(t *testing.T) (*APIServer, *httptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "galaxy-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serviceRegistry := registry.NewServiceRegistry(registry.DefaultTTL)
+	serviceRegistry.Connect("file://" + filepath.Join(dir, "registry.json"))
+
+	s := NewAPIServer(serviceRegistry)
+	server := httptest.NewServer(http.HandlerFunc(s.registrations))
+	return s, server, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func fetchRegistrations(url string) (string, []registry.ServiceRegistration, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("expected 200 for %s. Got %d", url, resp.StatusCode)
+	}
+
+	registrations := []registry.ServiceRegistration{}
+	err = json.NewDecoder(resp.Body).Decode(&registrations)
+	return resp.Header.Get("X-Galaxy-Index"), registrations, err
+}
+
+func getRegistrations(t *testing.T, url string) (string, []registry.ServiceRegistration) {
+	index, registrations, err := fetchRegistrations(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return index, registrations
+}
+
+func TestAPIInvalidRequests(t *testing.T) {
+	_, server, cleanup := newTestAPIServer(t)
+	defer cleanup()
+
+	for path, status := range map[string]int{
+		"/v1/registrations/":              http.StatusNotFound,
+		"/v1/registrations/dev/web/extra": http.StatusNotFound,
+		"/v1/registrations/*":             http.StatusBadRequest,
+		"/v1/registrations/dev/w[eb":      http.StatusBadRequest,
+		"/v1/registrations/dev?wait=soon": http.StatusBadRequest,
+		"/v1/registrations/dev?index=one": http.StatusBadRequest,
+	} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("expected %d for %s. Got %d", status, path, resp.StatusCode)
+		}
+	}
+}
+
+func TestAPIWatch(t *testing.T) {
+	s, server, cleanup := newTestAPIServer(t)
+	defer cleanup()
+
+	index, registrations := getRegistrations(t, server.URL+"/v1/registrations/dev")
+	if len(registrations) != 0 {
+		t.Fatalf("expected no registrations. Got %v", registrations)
+	}
+
+	// nothing changes before the wait is up
+	same, _ := getRegistrations(t, server.URL+"/v1/registrations/dev?wait=10ms&index="+index)
+	if same != index {
+		t.Fatalf("expected index %s after the wait. Got %s", index, same)
+	}
+
+	type response struct {
+		index         string
+		registrations []registry.ServiceRegistration
+		err           error
+	}
+	done := make(chan response)
+	go func() {
+		index, registrations, err := fetchRegistrations(server.URL + "/v1/registrations/dev/db?wait=30s&index=" + index)
+		done <- response{index, registrations, err}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	_, err := s.serviceRegistry.RegisterExternal("dev", "web", "db", "10.0.0.1:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if r.index == index {
+			t.Fatalf("expected a new index after the change. Got %s", r.index)
+		}
+		if len(r.registrations) != 1 || r.registrations[0].Name != "db" {
+			t.Fatalf("expected the db registration. Got %v", r.registrations)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("expected the watch to return after the change")
+	}
+}
+
+func TestAPIWatchStops(t *testing.T) {
+	s, server, cleanup := newTestAPIServer(t)
+	defer cleanup()
+
+	linger := watchLinger
+	watchLinger = 10 * time.Millisecond
+	defer func() { watchLinger = linger }()
+
+	first, _ := getRegistrations(t, server.URL+"/v1/registrations/dev")
+	time.Sleep(100 * time.Millisecond)
+
+	s.mu.Lock()
+	watches := len(s.watches)
+	s.mu.Unlock()
+	if watches != 0 {
+		t.Fatalf("expected the unused watch to stop. Got %d watches", watches)
+	}
+
+	// an index from the stopped watch is never current
+	second, _ := getRegistrations(t, server.URL+"/v1/registrations/dev/web?wait=30s&index="+first)
+	if second == first {
+		t.Fatalf("expected a new index from a new watch. Got %s", second)
+	}
+}
@@ -3,8 +3,10 @@ package discovery
 import (
 	"os"
 	"strings"
+	"sync"
 	"time"
 
+	docker "github.com/fsouza/go-dockerclient"
 	"github.com/litl/galaxy/config"
 	"github.com/litl/galaxy/log"
 	"github.com/litl/galaxy/registry"
@@ -15,6 +17,15 @@ import (
 	shuttle "github.com/litl/shuttle/client"
 )
 
+var (
+	// stopRegistering is closed by Unregister so that Register's loop
+	// doesn't register anything again while the host is being drained
+	stopRegistering = make(chan struct{})
+	registerMu      sync.Mutex
+	// registerStopped is closed once Register's loop has exited
+	registerStopped chan struct{}
+)
+
 func Status(serviceRuntime *runtime.ServiceRuntime, serviceRegistry *registry.ServiceRegistry, env, pool, hostIP string) error {
 
 	containers, err := serviceRuntime.ManagedContainers()
@@ -39,11 +50,11 @@ func Status(serviceRuntime *runtime.ServiceRuntime, serviceRegistry *registry.Se
 					registered.Name,
 					registered.ContainerID[0:12],
 					registered.Image,
-					registered.ExternalAddr(),
+					externalAddr(registered),
 					registered.InternalAddr(),
 					registered.Port,
 					utils.HumanDuration(time.Now().UTC().Sub(registered.StartedAt)) + " ago",
-					"In " + utils.HumanDuration(registered.Expires.Sub(time.Now().UTC())),
+					expiresIn(registered),
 				}, " | "))
 
 		} else {
@@ -67,21 +78,84 @@ func Status(serviceRuntime *runtime.ServiceRuntime, serviceRegistry *registry.Se
 	return nil
 }
 
+// Unregister removes every registration on the host and exits so the host
+// stops receiving traffic immediately rather than when the TTLs expire.
 func Unregister(serviceRuntime *runtime.ServiceRuntime, serviceRegistry *registry.ServiceRegistry,
 	env, pool, hostIP, shuttleAddr string) {
+
+	close(stopRegistering)
+	registerMu.Lock()
+	stopped := registerStopped
+	held := agentLock
+	registerMu.Unlock()
+	if stopped != nil {
+		<-stopped
+	}
+
+	// the registrations belong to another agent
+	if !held.holding() {
+		log.Printf("Leaving registrations on %s to the discovery agent that has the lock", hostIP)
+		os.Exit(0)
+	}
+
 	unregisterShuttle(serviceRegistry, env, hostIP, shuttleAddr)
-	serviceRuntime.UnRegisterAll(env, pool, hostIP)
+	_, err := serviceRuntime.UnRegisterAll(env, pool, hostIP)
+	if err != nil {
+		log.Errorf("ERROR: Unable to unregister containers: %s", err)
+	}
+
+	// anything left doesn't have a running container
+	stale, err := serviceRegistry.UnRegisterStale(env, pool, hostIP, nil)
+	if err != nil {
+		log.Errorf("ERROR: Unable to unregister stale containers: %s", err)
+	}
+	for _, regPath := range stale {
+		log.Printf("Unregistered stale registration %s", regPath)
+	}
+	held.release()
 	os.Exit(0)
 }
 
 func RegisterAll(serviceRuntime *runtime.ServiceRuntime, serviceRegistry *registry.ServiceRegistry, env, pool, hostIP, shuttleAddr string, loggedOnce bool) {
 	columns := []string{"CONTAINER ID | IMAGE | EXTERNAL | INTERNAL | CREATED | EXPIRES"}
 
-	registrations, err := serviceRuntime.RegisterAll(env, pool, hostIP)
+	containers, err := serviceRuntime.ManagedContainers()
 	if err != nil {
 		log.Errorf("ERROR: Unable to register containers: %s", err)
 		return
 	}
+	checks.prune(containers)
+	beats.prune(containers)
+
+	registrations := []*registry.ServiceRegistration{}
+	for _, container := range containers {
+		// its heartbeat keeps it registered
+		if beats.running(container.ID) {
+			continue
+		}
+
+		// wait for the container's health check to pass
+		if !checks.ready(serviceRegistry.EnvFor(container), container) {
+			continue
+		}
+
+		registration, err := serviceRegistry.RegisterService(env, pool, hostIP, container)
+		if err != nil {
+			log.Errorf("ERROR: Could not register %s: %s", serviceRegistry.EnvFor(container)["GALAXY_APP"], err)
+			continue
+		}
+		beats.start(container, registration.TTL)
+		registrations = append(registrations, registration)
+	}
+
+	// catch any containers that died without us seeing the event
+	stale, err := serviceRegistry.UnRegisterStale(env, pool, hostIP, containers)
+	if err != nil {
+		log.Errorf("ERROR: Unable to unregister stale containers: %s", err)
+	}
+	for _, regPath := range stale {
+		log.Printf("Unregistered stale registration %s", regPath)
+	}
 
 	fn := log.Debugf
 	if !loggedOnce {
@@ -97,10 +171,10 @@ func RegisterAll(serviceRuntime *runtime.ServiceRuntime, serviceRegistry *regist
 		columns = append(columns, strings.Join([]string{
 			registration.ContainerID[0:12],
 			registration.Image,
-			registration.ExternalAddr(),
+			externalAddr(registration),
 			registration.InternalAddr(),
 			utils.HumanDuration(time.Now().Sub(registration.StartedAt)) + " ago",
-			"In " + utils.HumanDuration(registration.Expires.Sub(time.Now().UTC())),
+			expiresIn(registration),
 		}, " | "))
 
 	}
@@ -113,6 +187,23 @@ func Register(serviceRuntime *runtime.ServiceRuntime, serviceRegistry *registry.
 
 	if shuttleAddr != "" {
 		client = shuttle.NewClient(shuttleAddr)
+		appConfigs = configStore
+	}
+	checks = newHealthChecks(serviceRuntime, hostIP)
+	beats = newHeartbeats(serviceRegistry.TTL, func(container *docker.Container) error {
+		_, err := serviceRegistry.RegisterService(env, pool, hostIP, container)
+		return err
+	})
+
+	registerMu.Lock()
+	stopped := make(chan struct{})
+	registerStopped = stopped
+	agentLock = newHostLock(serviceRegistry, env, pool, hostIP)
+	registerMu.Unlock()
+	defer close(stopped)
+
+	if !agentLock.acquire(stopRegistering) {
+		return
 	}
 
 	RegisterAll(serviceRuntime, serviceRegistry, env, pool, hostIP, shuttleAddr, false)
@@ -123,22 +214,45 @@ func Register(serviceRuntime *runtime.ServiceRuntime, serviceRegistry *registry.
 		log.Printf("ERROR: Unable to register docker event listener: %s", err)
 	}
 
+	// container events and heartbeats keep registrations current, this
+	// catches anything the events missed
+	reconcile := time.NewTicker(10 * time.Second)
+	defer reconcile.Stop()
+
 	for {
 
 		select {
+		case <-stopRegistering:
+			beats.stopAll()
+			return
+
 		case ce := <-containerEvents:
+			// the container was removed before it could be inspected
+			if ce.Container == nil {
+				RegisterAll(serviceRuntime, serviceRegistry, env, pool, hostIP, shuttleAddr, true)
+				pruneShuttleBackends(configStore, serviceRegistry, env, shuttleAddr)
+				continue
+			}
+
 			switch ce.Status {
 			case "start":
+				if !checks.ready(serviceRegistry.EnvFor(ce.Container), ce.Container) {
+					continue
+				}
+
 				reg, err := serviceRegistry.RegisterService(env, pool, hostIP, ce.Container)
 				if err != nil {
 					log.Errorf("ERROR: Unable to register container: %s", err)
 					continue
 				}
+				beats.start(ce.Container, reg.TTL)
 
 				log.Printf("Registered %s running as %s for %s%s", strings.TrimPrefix(reg.ContainerName, "/"),
 					reg.ContainerID[0:12], reg.Name, locationAt(reg))
 				registerShuttle(serviceRegistry, env, shuttleAddr)
 			case "die", "stop":
+				checks.remove(ce.Container.ID)
+				beats.stop(ce.Container.ID)
 				reg, err := serviceRegistry.UnRegisterService(env, pool, hostIP, ce.Container)
 				if err != nil {
 					log.Errorf("ERROR: Unable to unregister container: %s", err)
@@ -153,7 +267,41 @@ func Register(serviceRuntime *runtime.ServiceRuntime, serviceRegistry *registry.
 				pruneShuttleBackends(configStore, serviceRegistry, env, shuttleAddr)
 			}
 
-		case <-time.After(10 * time.Second):
+		case change := <-checks.changes:
+			if change.passing {
+				reg, err := serviceRegistry.RegisterService(env, pool, hostIP, change.container)
+				if err != nil {
+					log.Errorf("ERROR: Unable to register container: %s", err)
+					continue
+				}
+				beats.start(change.container, reg.TTL)
+
+				log.Printf("Health check passed, registered %s running as %s for %s%s", strings.TrimPrefix(reg.ContainerName, "/"),
+					reg.ContainerID[0:12], reg.Name, locationAt(reg))
+				registerShuttle(serviceRegistry, env, shuttleAddr)
+				continue
+			}
+
+			beats.stop(change.container.ID)
+			reg, err := serviceRegistry.UnRegisterService(env, pool, hostIP, change.container)
+			if err != nil {
+				log.Errorf("ERROR: Unable to unregister container: %s", err)
+				continue
+			}
+			if reg != nil {
+				log.Printf("Health check failed, unregistered %s running as %s for %s%s", strings.TrimPrefix(reg.ContainerName, "/"),
+					reg.ContainerID[0:12], reg.Name, locationAt(reg))
+			}
+			pruneShuttleBackends(configStore, serviceRegistry, env, shuttleAddr)
+
+		case <-reconcile.C:
+			if !agentLock.refresh() {
+				// leave the registrations to the agent that has the lock
+				beats.stopAll()
+				if !agentLock.acquire(stopRegistering) {
+					return
+				}
+			}
 			RegisterAll(serviceRuntime, serviceRegistry, env, pool, hostIP, shuttleAddr, true)
 			pruneShuttleBackends(configStore, serviceRegistry, env, shuttleAddr)
 		}
@@ -161,9 +309,26 @@ func Register(serviceRuntime *runtime.ServiceRuntime, serviceRegistry *registry.
 }
 
 func locationAt(reg *registry.ServiceRegistration) string {
-	location := reg.ExternalAddr()
+	location := externalAddr(reg)
 	if location != "" {
 		location = " at " + location
 	}
 	return location
 }
+
+// externalAddr returns the registration's address, marking udp ones since
+// they can't be reached with tcp tools.
+func externalAddr(reg *registry.ServiceRegistration) string {
+	addr := reg.ExternalAddr()
+	if addr != "" && reg.IsUDP() {
+		addr += "/udp"
+	}
+	return addr
+}
+
+func expiresIn(reg *registry.ServiceRegistration) string {
+	if reg.Static {
+		return "Never"
+	}
+	return "In " + utils.HumanDuration(reg.Expires.Sub(time.Now().UTC()))
+}
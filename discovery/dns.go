@@ -0,0 +1,385 @@
+package discovery
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/registry"
+)
+
+const (
+	// DefaultDNSDomain is the domain galaxy names are served under, e.g.
+	// web.pool.env.galaxy.
+	DefaultDNSDomain = "galaxy"
+	// DefaultDNSCacheTTL is how long registrations are cached between
+	// lookups, and the TTL of the records served.
+	DefaultDNSCacheTTL = 5 * time.Second
+
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+	dnsTypeANY  = 255
+	dnsClassIN  = 1
+
+	dnsRcodeFormErr  = 1
+	dnsRcodeNXDomain = 3
+	dnsRcodeRefused  = 5
+
+	// dnsMaxUDPSize is the largest response sent without EDNS
+	dnsMaxUDPSize = 512
+	// dnsMaxTCPSize is the most a TCP response's length prefix can hold
+	dnsMaxTCPSize = 65535
+	// dnsTCPTimeout is how long an idle TCP connection is kept open
+	dnsTCPTimeout = 10 * time.Second
+)
+
+var errMalformedQuery = errors.New("malformed DNS query")
+
+// DNSServer answers A, AAAA and SRV queries for the apps registered in an
+// env.  <app>.<pool>.<env>.galaxy has an address record for each host the
+// app is registered on and an SRV record for each container pointing at
+// <container id>.<app>.<pool>.<env>.galaxy.  Draining containers are left
+// out.
+type DNSServer struct {
+	Domain   string
+	CacheTTL time.Duration
+
+	serviceRegistry *registry.ServiceRegistry
+	env             string
+
+	mu            sync.Mutex
+	registrations []registry.ServiceRegistration
+	fetched       time.Time
+}
+
+func NewDNSServer(serviceRegistry *registry.ServiceRegistry, env string) *DNSServer {
+	return &DNSServer{
+		Domain:          DefaultDNSDomain,
+		CacheTTL:        DefaultDNSCacheTTL,
+		serviceRegistry: serviceRegistry,
+		env:             env,
+	}
+}
+
+// ListenAndServe answers queries on addr over UDP and TCP until either
+// fails.
+func (s *DNSServer) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	errs := make(chan error, 2)
+	go func() { errs <- s.serveUDP(conn) }()
+	go func() { errs <- s.serveTCP(ln) }()
+	return <-errs
+}
+
+func (s *DNSServer) serveUDP(conn net.PacketConn) error {
+	buf := make([]byte, dnsMaxUDPSize)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		resp, err := s.answer(buf[:n], dnsMaxUDPSize)
+		if err != nil {
+			log.Debugf("Ignoring DNS query from %s: %s", from, err)
+			continue
+		}
+
+		_, err = conn.WriteTo(resp, from)
+		if err != nil {
+			log.Warnf("WARN: Unable to answer DNS query from %s: %s", from, err)
+		}
+	}
+}
+
+func (s *DNSServer) serveTCP(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn answers the length prefixed queries sent on a TCP connection
+// until the client closes it or goes quiet.
+func (s *DNSServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		conn.SetDeadline(time.Now().Add(dnsTCPTimeout))
+
+		var size uint16
+		err := binary.Read(conn, binary.BigEndian, &size)
+		if err != nil {
+			return
+		}
+
+		query := make([]byte, size)
+		_, err = io.ReadFull(conn, query)
+		if err != nil {
+			return
+		}
+
+		resp, err := s.answer(query, dnsMaxTCPSize)
+		if err != nil {
+			log.Debugf("Ignoring DNS query from %s: %s", conn.RemoteAddr(), err)
+			return
+		}
+
+		msg := make([]byte, 2, 2+len(resp))
+		binary.BigEndian.PutUint16(msg, uint16(len(resp)))
+		_, err = conn.Write(append(msg, resp...))
+		if err != nil {
+			log.Warnf("WARN: Unable to answer DNS query from %s: %s", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// cached returns the env's registrations, listing them again once they're
+// older than CacheTTL.  If the registry can't be read, the last listing is
+// used rather than failing every lookup.
+func (s *DNSServer) cached() []registry.ServiceRegistration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.fetched) < s.CacheTTL {
+		return s.registrations
+	}
+
+	registrations, err := s.serviceRegistry.ListRegistrations(s.env)
+	if err != nil {
+		log.Errorf("ERROR: Unable to list registrations: %s", err)
+		return s.registrations
+	}
+	s.registrations = registrations
+	s.fetched = time.Now()
+	return s.registrations
+}
+
+// dnsRecord is an answer to a query.
+type dnsRecord struct {
+	name  string
+	rtype uint16
+	// ip is set for A and AAAA records
+	ip net.IP
+	// the rest are set for SRV records
+	weight uint16
+	port   uint16
+	target string
+}
+
+// lookup returns the records for name, a fully qualified lower case name,
+// and false if name doesn't exist.
+func (s *DNSServer) lookup(name string, qtype uint16) ([]dnsRecord, bool) {
+	suffix := s.suffix()
+	labels := strings.Split(strings.TrimSuffix(name, suffix), ".")
+
+	var container, app, pool string
+	switch len(labels) {
+	case 2:
+		app, pool = labels[0], labels[1]
+	case 3:
+		container, app, pool = labels[0], labels[1], labels[2]
+	default:
+		return nil, false
+	}
+
+	records := []dnsRecord{}
+	found := false
+	seen := make(map[string]bool)
+	for _, reg := range s.cached() {
+		if !strings.EqualFold(reg.Name, app) || !strings.EqualFold(registryPool(reg), pool) || reg.IsDraining() {
+			continue
+		}
+		if container != "" && !strings.HasPrefix(reg.ContainerID, container) {
+			continue
+		}
+		found = true
+
+		ip := net.ParseIP(reg.ExternalIP)
+		if ip != nil && !seen[ip.String()] && (qtype == dnsTypeA || qtype == dnsTypeAAAA || qtype == dnsTypeANY) {
+			rtype := uint16(dnsTypeA)
+			if ip.To4() == nil {
+				rtype = dnsTypeAAAA
+			}
+			if qtype == rtype || qtype == dnsTypeANY {
+				seen[ip.String()] = true
+				records = append(records, dnsRecord{name: name, rtype: rtype, ip: ip})
+			}
+		}
+
+		port, err := strconv.Atoi(reg.ExternalPort)
+		if qtype == dnsTypeSRV && container == "" && ip != nil && err == nil {
+			weight := reg.Weight
+			if weight <= 0 {
+				weight = 1
+			}
+			records = append(records, dnsRecord{
+				name:   name,
+				rtype:  dnsTypeSRV,
+				weight: uint16(weight),
+				port:   uint16(port),
+				target: reg.ContainerID[0:12] + "." + name,
+			})
+		}
+	}
+	return records, found
+}
+
+// suffix returns the lower case name every query must end with.
+func (s *DNSServer) suffix() string {
+	return strings.ToLower("." + s.env + "." + s.Domain + ".")
+}
+
+// registryPool returns the pool from a registration's path,
+// env/pool/hosts/ip/app/container.
+func registryPool(reg registry.ServiceRegistration) string {
+	parts := strings.Split(reg.Path, "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// answer builds the response to a query, up to maxSize bytes.  It returns
+// an error for messages that shouldn't be answered at all.
+func (s *DNSServer) answer(query []byte, maxSize int) ([]byte, error) {
+	if len(query) < 12 {
+		return nil, errMalformedQuery
+	}
+
+	flags := binary.BigEndian.Uint16(query[2:4])
+	if flags&0x8000 != 0 {
+		// a response, not a query
+		return nil, errMalformedQuery
+	}
+
+	// echo the ID, opcode and RD bit with QR and AA set
+	resp := make([]byte, 12, dnsMaxUDPSize)
+	copy(resp[0:2], query[0:2])
+	respFlags := flags&0x7900 | 0x8400
+
+	qdcount := binary.BigEndian.Uint16(query[4:6])
+	name, qtype, qclass, end, err := parseQuestion(query)
+	if err != nil || qdcount != 1 {
+		binary.BigEndian.PutUint16(resp[2:4], respFlags|dnsRcodeFormErr)
+		return resp, nil
+	}
+	resp = append(resp, query[12:end]...)
+	binary.BigEndian.PutUint16(resp[4:6], 1)
+
+	if qclass != dnsClassIN || !strings.HasSuffix(name, s.suffix()) {
+		binary.BigEndian.PutUint16(resp[2:4], respFlags|dnsRcodeRefused)
+		return resp, nil
+	}
+
+	records, found := s.lookup(name, qtype)
+	if !found {
+		binary.BigEndian.PutUint16(resp[2:4], respFlags|dnsRcodeNXDomain)
+		return resp, nil
+	}
+
+	ttl := uint32(s.CacheTTL / time.Second)
+	answers := []byte{}
+	for _, r := range records {
+		answers = appendRecord(answers, r, ttl)
+	}
+
+	// too big for udp, so ask the client to retry over tcp
+	if len(resp)+len(answers) > maxSize {
+		binary.BigEndian.PutUint16(resp[2:4], respFlags|0x0200)
+		return resp, nil
+	}
+
+	binary.BigEndian.PutUint16(resp[2:4], respFlags)
+	binary.BigEndian.PutUint16(resp[6:8], uint16(len(records)))
+	return append(resp, answers...), nil
+}
+
+// parseQuestion reads the first question of a query and returns its name,
+// lower cased and fully qualified, type, class and where it ends.
+func parseQuestion(msg []byte) (string, uint16, uint16, int, error) {
+	labels := []string{}
+	i := 12
+	for {
+		if i >= len(msg) {
+			return "", 0, 0, 0, errMalformedQuery
+		}
+		n := int(msg[i])
+		i++
+		if n == 0 {
+			break
+		}
+		// queries don't need compression pointers
+		if n > 63 || i+n > len(msg) {
+			return "", 0, 0, 0, errMalformedQuery
+		}
+		labels = append(labels, strings.ToLower(string(msg[i:i+n])))
+		i += n
+	}
+
+	if i+4 > len(msg) {
+		return "", 0, 0, 0, errMalformedQuery
+	}
+	qtype := binary.BigEndian.Uint16(msg[i : i+2])
+	qclass := binary.BigEndian.Uint16(msg[i+2 : i+4])
+	return strings.Join(labels, ".") + ".", qtype, qclass, i + 4, nil
+}
+
+// appendName appends name in DNS label format.
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func appendRecord(b []byte, r dnsRecord, ttl uint32) []byte {
+	rdata := []byte{}
+	switch r.rtype {
+	case dnsTypeA:
+		rdata = append(rdata, r.ip.To4()...)
+	case dnsTypeAAAA:
+		rdata = append(rdata, r.ip.To16()...)
+	case dnsTypeSRV:
+		rdata = make([]byte, 6)
+		// priority is always 0
+		binary.BigEndian.PutUint16(rdata[2:4], r.weight)
+		binary.BigEndian.PutUint16(rdata[4:6], r.port)
+		rdata = appendName(rdata, r.target)
+	}
+
+	b = appendName(b, r.name)
+	fixed := make([]byte, 10)
+	binary.BigEndian.PutUint16(fixed[0:2], r.rtype)
+	binary.BigEndian.PutUint16(fixed[2:4], dnsClassIN)
+	binary.BigEndian.PutUint32(fixed[4:8], ttl)
+	binary.BigEndian.PutUint16(fixed[8:10], uint16(len(rdata)))
+	b = append(b, fixed...)
+	return append(b, rdata...)
+}
@@ -0,0 +1,302 @@
+package discovery
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/litl/galaxy/registry"
+)
+
+func newTestDNSServer(env string, registrations []registry.ServiceRegistration) *DNSServer {
+	s := NewDNSServer(nil, env)
+	s.CacheTTL = time.Hour
+	s.registrations = registrations
+	s.fetched = time.Now()
+	return s
+}
+
+func testRegistration(app, pool, ip, port, id string) registry.ServiceRegistration {
+	return registry.ServiceRegistration{
+		Name:         app,
+		ExternalIP:   ip,
+		ExternalPort: port,
+		ContainerID:  id,
+		Path:         "dev/" + pool + "/hosts/" + ip + "/" + app + "/" + id[0:12],
+	}
+}
+
+func dnsQuery(id uint16, name string, qtype uint16) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	// RD
+	binary.BigEndian.PutUint16(msg[2:4], 0x0100)
+	binary.BigEndian.PutUint16(msg[4:6], 1)
+	msg = appendName(msg, name)
+	question := make([]byte, 4)
+	binary.BigEndian.PutUint16(question[0:2], qtype)
+	binary.BigEndian.PutUint16(question[2:4], dnsClassIN)
+	return append(msg, question...)
+}
+
+// dnsResponse is a decoded answer.
+type dnsResponse struct {
+	id      uint16
+	flags   uint16
+	answers []dnsRecord
+}
+
+func (r dnsResponse) rcode() uint16   { return r.flags & 0x000f }
+func (r dnsResponse) truncated() bool { return r.flags&0x0200 != 0 }
+
+// readName reads an uncompressed name, which is all the server writes.
+func readName(msg []byte, i int) (string, int, error) {
+	name := ""
+	for {
+		if i >= len(msg) {
+			return "", 0, fmt.Errorf("name runs past the end")
+		}
+		n := int(msg[i])
+		i++
+		if n == 0 {
+			return name + ".", i, nil
+		}
+		if n > 63 || i+n > len(msg) {
+			return "", 0, fmt.Errorf("invalid label length %d", n)
+		}
+		if name != "" {
+			name += "."
+		}
+		name += string(msg[i : i+n])
+		i += n
+	}
+}
+
+func parseResponse(msg []byte) (dnsResponse, error) {
+	if len(msg) < 12 {
+		return dnsResponse{}, fmt.Errorf("short response")
+	}
+	resp := dnsResponse{
+		id:    binary.BigEndian.Uint16(msg[0:2]),
+		flags: binary.BigEndian.Uint16(msg[2:4]),
+	}
+
+	i := 12
+	for q := 0; q < int(binary.BigEndian.Uint16(msg[4:6])); q++ {
+		_, end, err := readName(msg, i)
+		if err != nil {
+			return resp, err
+		}
+		i = end + 4
+	}
+
+	for a := 0; a < int(binary.BigEndian.Uint16(msg[6:8])); a++ {
+		name, end, err := readName(msg, i)
+		if err != nil {
+			return resp, err
+		}
+		if end+10 > len(msg) {
+			return resp, fmt.Errorf("short record")
+		}
+		r := dnsRecord{name: name, rtype: binary.BigEndian.Uint16(msg[end : end+2])}
+		rdlen := int(binary.BigEndian.Uint16(msg[end+8 : end+10]))
+		rdata := msg[end+10 : end+10+rdlen]
+		switch r.rtype {
+		case dnsTypeA, dnsTypeAAAA:
+			r.ip = net.IP(rdata)
+		case dnsTypeSRV:
+			r.weight = binary.BigEndian.Uint16(rdata[2:4])
+			r.port = binary.BigEndian.Uint16(rdata[4:6])
+			r.target, _, err = readName(rdata, 6)
+			if err != nil {
+				return resp, err
+			}
+		}
+		resp.answers = append(resp.answers, r)
+		i = end + 10 + rdlen
+	}
+	return resp, nil
+}
+
+func TestDNSAnswer(t *testing.T) {
+	s := newTestDNSServer("Dev", []registry.ServiceRegistration{
+		testRegistration("web", "web", "10.0.0.1", "8000", "aaaaaaaaaaaa1"),
+		testRegistration("web", "web", "10.0.0.1", "8001", "bbbbbbbbbbbb1"),
+		testRegistration("web", "web", "fd00::2", "8000", "cccccccccccc1"),
+		testRegistration("web", "worker", "10.0.0.3", "8000", "dddddddddddd1"),
+	})
+
+	for _, test := range []struct {
+		name    string
+		qtype   uint16
+		rcode   uint16
+		answers []string
+	}{
+		{"web.web.dev.galaxy.", dnsTypeA, 0, []string{"10.0.0.1"}},
+		{"WEB.Web.DEV.galaxy.", dnsTypeA, 0, []string{"10.0.0.1"}},
+		{"web.web.dev.galaxy.", dnsTypeAAAA, 0, []string{"fd00::2"}},
+		{"web.web.dev.galaxy.", dnsTypeANY, 0, []string{"10.0.0.1", "fd00::2"}},
+		{"web.web.dev.galaxy.", dnsTypeSRV, 0, []string{
+			"8000 aaaaaaaaaaaa.web.web.dev.galaxy.",
+			"8001 bbbbbbbbbbbb.web.web.dev.galaxy.",
+			"8000 cccccccccccc.web.web.dev.galaxy.",
+		}},
+		{"bbbbbbbbbbbb.web.web.dev.galaxy.", dnsTypeA, 0, []string{"10.0.0.1"}},
+		{"web.worker.dev.galaxy.", dnsTypeA, 0, []string{"10.0.0.3"}},
+		// registered, but no records of that type
+		{"dddddddddddd.web.worker.dev.galaxy.", dnsTypeSRV, 0, []string{}},
+		{"api.web.dev.galaxy.", dnsTypeA, dnsRcodeNXDomain, []string{}},
+		{"web.dev.galaxy.", dnsTypeA, dnsRcodeNXDomain, []string{}},
+		{"web.web.prod.galaxy.", dnsTypeA, dnsRcodeRefused, []string{}},
+		{"example.com.", dnsTypeA, dnsRcodeRefused, []string{}},
+	} {
+		msg, err := s.answer(dnsQuery(42, test.name, test.qtype), dnsMaxUDPSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := parseResponse(msg)
+		if err != nil {
+			t.Fatalf("unable to parse the response for %s: %s", test.name, err)
+		}
+
+		if resp.id != 42 || resp.flags&0x8000 == 0 || resp.flags&0x0100 == 0 {
+			t.Fatalf("expected the ID and RD bit echoed in a response. Got %d %x", resp.id, resp.flags)
+		}
+		if resp.rcode() != test.rcode {
+			t.Fatalf("expected rcode %d for %s. Got %d", test.rcode, test.name, resp.rcode())
+		}
+
+		answers := []string{}
+		for _, r := range resp.answers {
+			if r.rtype == dnsTypeSRV {
+				answers = append(answers, fmt.Sprintf("%d %s", r.port, r.target))
+				continue
+			}
+			answers = append(answers, r.ip.String())
+		}
+		if fmt.Sprint(answers) != fmt.Sprint(test.answers) {
+			t.Fatalf("expected %v for %s %d. Got %v", test.answers, test.name, test.qtype, answers)
+		}
+	}
+}
+
+func TestDNSMalformed(t *testing.T) {
+	s := newTestDNSServer("dev", nil)
+
+	query := dnsQuery(1, "web.web.dev.galaxy.", dnsTypeA)
+	response := append([]byte{}, query...)
+	response[2] |= 0x80
+
+	badLabel := append([]byte{}, query[:12]...)
+	badLabel = append(badLabel, 64, 'w')
+
+	for name, msg := range map[string][]byte{
+		"short":    query[:11],
+		"response": response,
+	} {
+		if _, err := s.answer(msg, dnsMaxUDPSize); err == nil {
+			t.Fatalf("expected a %s message to be ignored", name)
+		}
+	}
+
+	for name, msg := range map[string][]byte{
+		"truncated question": query[:len(query)-2],
+		"bad label":          badLabel,
+	} {
+		resp, err := s.answer(msg, dnsMaxUDPSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rcode := binary.BigEndian.Uint16(resp[2:4]) & 0x000f; rcode != dnsRcodeFormErr {
+			t.Fatalf("expected FORMERR for a %s. Got %d", name, rcode)
+		}
+	}
+}
+
+func TestDNSTruncated(t *testing.T) {
+	registrations := []registry.ServiceRegistration{}
+	for i := 0; i < 20; i++ {
+		registrations = append(registrations, testRegistration("web", "web",
+			fmt.Sprintf("10.0.0.%d", i+1), "8000", fmt.Sprintf("%012d1", i)))
+	}
+	s := newTestDNSServer("dev", registrations)
+	query := dnsQuery(1, "web.web.dev.galaxy.", dnsTypeSRV)
+
+	msg, err := s.answer(query, dnsMaxUDPSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := parseResponse(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.truncated() || len(resp.answers) != 0 {
+		t.Fatalf("expected a truncated response over UDP. Got %d answers", len(resp.answers))
+	}
+
+	msg, err = s.answer(query, dnsMaxTCPSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = parseResponse(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.truncated() || len(resp.answers) != len(registrations) {
+		t.Fatalf("expected all %d answers over TCP. Got %d", len(registrations), len(resp.answers))
+	}
+}
+
+func TestDNSServeTCP(t *testing.T) {
+	s := newTestDNSServer("dev", []registry.ServiceRegistration{
+		testRegistration("web", "web", "10.0.0.1", "8000", "aaaaaaaaaaaa1"),
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go s.serveTCP(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// more than one query can be sent on a connection
+	for id := uint16(1); id <= 2; id++ {
+		query := dnsQuery(id, "web.web.dev.galaxy.", dnsTypeA)
+		err = binary.Write(conn, binary.BigEndian, uint16(len(query)))
+		if err == nil {
+			_, err = conn.Write(query)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var size uint16
+		err = binary.Read(conn, binary.BigEndian, &size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := make([]byte, size)
+		_, err = io.ReadFull(conn, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := parseResponse(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.id != id || len(resp.answers) != 1 || resp.answers[0].ip.String() != "10.0.0.1" {
+			t.Fatalf("expected 10.0.0.1 for query %d. Got %d %v", id, resp.id, resp.answers)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/registry"
+	"github.com/litl/galaxy/runtime"
+)
+
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+	// DefaultHealthCheckFailures is how many checks in a row must fail
+	// before a container is unregistered
+	DefaultHealthCheckFailures = 3
+)
+
+var checks *healthChecks
+
+// healthCheck checks one container.  Containers with a health check aren't
+// registered until it passes and are unregistered once it fails Failures
+// times in a row.
+type healthCheck struct {
+	container *docker.Container
+	interval  time.Duration
+	failures  int
+	check     func() error
+
+	// passing is guarded by healthChecks.mu
+	passing bool
+	stop    chan struct{}
+}
+
+// healthChange is sent when a container's check starts passing or failing.
+type healthChange struct {
+	container *docker.Container
+	passing   bool
+}
+
+type healthChecks struct {
+	runtime *runtime.ServiceRuntime
+	hostIP  string
+	changes chan healthChange
+
+	mu sync.Mutex
+	// checks holds nil for containers without a health check
+	checks map[string]*healthCheck
+}
+
+func newHealthChecks(serviceRuntime *runtime.ServiceRuntime, hostIP string) *healthChecks {
+	return &healthChecks{
+		runtime: serviceRuntime,
+		hostIP:  hostIP,
+		changes: make(chan healthChange),
+		checks:  make(map[string]*healthCheck),
+	}
+}
+
+// newHealthCheck reads the check from the container's environment.  It
+// returns nil if the app has no health check.
+//
+// With GALAXY_HEALTH_CHECK_PATH set, the path is requested from the port
+// and must return a 2xx.  With GALAXY_HEALTH_CHECK=tcp:// the port's
+// internal address must accept connections.  GALAXY_HEALTH_CHECK_PORT
+// chooses the container port, or tcp://:<port> for tcp checks, and
+// defaults to the primary port.  With GALAXY_HEALTH_CHECK_CMD set, the
+// command is run inside the container by sh and must exit 0.
+func (h *healthChecks) newHealthCheck(env map[string]string, container *docker.Container) (*healthCheck, error) {
+	checkPath := env["GALAXY_HEALTH_CHECK_PATH"]
+	checkURL := env["GALAXY_HEALTH_CHECK"]
+	checkCmd := env["GALAXY_HEALTH_CHECK_CMD"]
+	if checkPath == "" && checkURL == "" && checkCmd == "" {
+		return nil, nil
+	}
+
+	c := &healthCheck{
+		container: container,
+		interval:  DefaultHealthCheckInterval,
+		failures:  DefaultHealthCheckFailures,
+		stop:      make(chan struct{}),
+	}
+	timeout := DefaultHealthCheckTimeout
+
+	for name, dest := range map[string]*time.Duration{
+		"GALAXY_HEALTH_CHECK_INTERVAL": &c.interval,
+		"GALAXY_HEALTH_CHECK_TIMEOUT":  &timeout,
+	} {
+		if v := env[name]; v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid %s %s", name, v)
+			}
+			*dest = d
+		}
+	}
+
+	if v := env["GALAXY_HEALTH_CHECK_FAILURES"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid GALAXY_HEALTH_CHECK_FAILURES %s", v)
+		}
+		c.failures = n
+	}
+
+	// commands don't need a published port
+	if checkCmd != "" {
+		c.check = h.execCheck(container.ID, checkCmd, timeout)
+		return c, nil
+	}
+
+	portName := env["GALAXY_HEALTH_CHECK_PORT"]
+	scheme := "http"
+	if checkURL != "" {
+		u, err := url.Parse(checkURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GALAXY_HEALTH_CHECK %s", checkURL)
+		}
+		scheme = u.Scheme
+		if u.Port() != "" {
+			portName = u.Port()
+		}
+	}
+
+	ports := registry.PublishedPorts(container)
+	port := registry.PrimaryPort(ports)
+	if portName != "" {
+		port = ports[portName+"/tcp"]
+	}
+	if port.ExternalPort == "" {
+		return nil, fmt.Errorf("health check port is not published")
+	}
+
+	switch scheme {
+	case "http":
+		c.check = httpCheck("http://"+net.JoinHostPort(h.hostIP, port.ExternalPort)+checkPath, timeout)
+	case "tcp":
+		c.check = tcpCheck(net.JoinHostPort(container.NetworkSettings.IPAddress, port.InternalPort), timeout)
+	default:
+		return nil, fmt.Errorf("unsupported health check %s", checkURL)
+	}
+	return c, nil
+}
+
+func httpCheck(checkURL string, timeout time.Duration) func() error {
+	client := &http.Client{Timeout: timeout}
+	return func() error {
+		resp, err := client.Get(checkURL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("GET %s: %s", checkURL, resp.Status)
+		}
+		return nil
+	}
+}
+
+func tcpCheck(addr string, timeout time.Duration) func() error {
+	return func() error {
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// execCheck runs cmd in the container.  A command that hangs past the
+// timeout fails the check but is left running since exec instances can't
+// be killed.
+func (h *healthChecks) execCheck(containerID, cmd string, timeout time.Duration) func() error {
+	return func() error {
+		type result struct {
+			status int
+			output string
+			err    error
+		}
+
+		done := make(chan result, 1)
+		go func() {
+			status, output, err := h.runtime.Exec(containerID, cmd)
+			done <- result{status, output, err}
+		}()
+
+		select {
+		case r := <-done:
+			if r.err != nil {
+				return r.err
+			}
+			if r.status != 0 {
+				return fmt.Errorf("%q exited with %d: %s", cmd, r.status, strings.TrimSpace(r.output))
+			}
+			return nil
+		case <-time.After(timeout):
+			return fmt.Errorf("%q timed out after %s", cmd, timeout)
+		}
+	}
+}
+
+// ready starts the container's health check the first time it's seen and
+// returns true if the container can be registered: it has no check or its
+// check is passing.
+func (h *healthChecks) ready(env map[string]string, container *docker.Container) bool {
+	if h == nil {
+		return true
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c, ok := h.checks[container.ID]
+	if !ok {
+		var err error
+		c, err = h.newHealthCheck(env, container)
+		if err != nil {
+			// registering without a check is no worse than before checks
+			log.Errorf("ERROR: Invalid health check for %s: %s", container.ID[0:12], err)
+		}
+		h.checks[container.ID] = c
+		if c != nil {
+			go h.run(c)
+		}
+	}
+	return c == nil || c.passing
+}
+
+// remove stops the check for a container that's gone.
+func (h *healthChecks) remove(containerID string) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if c := h.checks[containerID]; c != nil {
+		close(c.stop)
+	}
+	delete(h.checks, containerID)
+}
+
+// prune stops the checks for any container not in containers.
+func (h *healthChecks) prune(containers []*docker.Container) {
+	if h == nil {
+		return
+	}
+
+	running := make(map[string]bool)
+	for _, container := range containers {
+		running[container.ID] = true
+	}
+
+	h.mu.Lock()
+	ids := []string{}
+	for id := range h.checks {
+		if !running[id] {
+			ids = append(ids, id)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, id := range ids {
+		h.remove(id)
+	}
+}
+
+func (h *healthChecks) run(c *healthCheck) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		err := c.check()
+
+		h.mu.Lock()
+		wasPassing := c.passing
+		if err == nil {
+			failures = 0
+			c.passing = true
+		} else {
+			failures += 1
+			if failures >= c.failures {
+				c.passing = false
+			}
+		}
+		passing := c.passing
+		h.mu.Unlock()
+
+		if err != nil {
+			log.Debugf("Health check failed for %s: %s", c.container.ID[0:12], err)
+		}
+
+		if passing != wasPassing {
+			select {
+			case h.changes <- healthChange{container: c.container, passing: passing}:
+			case <-c.stop:
+				return
+			}
+		}
+
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
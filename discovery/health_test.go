@@ -0,0 +1,146 @@
+package discovery
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func healthContainer() *docker.Container {
+	return &docker.Container{
+		ID: "aaaaaaaaaaaa1",
+		NetworkSettings: &docker.NetworkSettings{
+			IPAddress: "172.17.0.2",
+			Ports: map[docker.Port][]docker.PortBinding{
+				"8080/tcp": {{HostPort: "20000"}},
+				"9000/tcp": {{HostPort: "20001"}},
+			},
+		},
+	}
+}
+
+func TestNewHealthCheck(t *testing.T) {
+	h := newHealthChecks(nil, "10.0.0.1")
+
+	for _, test := range []struct {
+		env      map[string]string
+		valid    bool
+		check    bool
+		interval time.Duration
+		failures int
+	}{
+		{map[string]string{}, true, false, 0, 0},
+		{map[string]string{"GALAXY_HEALTH_CHECK_PATH": "/health"}, true, true,
+			DefaultHealthCheckInterval, DefaultHealthCheckFailures},
+		{map[string]string{"GALAXY_HEALTH_CHECK_PATH": "/health", "GALAXY_HEALTH_CHECK_PORT": "9000",
+			"GALAXY_HEALTH_CHECK_INTERVAL": "1s", "GALAXY_HEALTH_CHECK_FAILURES": "5"}, true, true, time.Second, 5},
+		{map[string]string{"GALAXY_HEALTH_CHECK": "tcp://:9000"}, true, true,
+			DefaultHealthCheckInterval, DefaultHealthCheckFailures},
+		{map[string]string{"GALAXY_HEALTH_CHECK_CMD": "true", "GALAXY_HEALTH_CHECK_PORT": "1234"}, true, true,
+			DefaultHealthCheckInterval, DefaultHealthCheckFailures},
+		// the port has to be published
+		{map[string]string{"GALAXY_HEALTH_CHECK_PATH": "/health", "GALAXY_HEALTH_CHECK_PORT": "1234"}, false, false, 0, 0},
+		{map[string]string{"GALAXY_HEALTH_CHECK": "udp://:9000"}, false, false, 0, 0},
+		{map[string]string{"GALAXY_HEALTH_CHECK_PATH": "/", "GALAXY_HEALTH_CHECK_INTERVAL": "soon"}, false, false, 0, 0},
+		{map[string]string{"GALAXY_HEALTH_CHECK_PATH": "/", "GALAXY_HEALTH_CHECK_TIMEOUT": "-1s"}, false, false, 0, 0},
+		{map[string]string{"GALAXY_HEALTH_CHECK_PATH": "/", "GALAXY_HEALTH_CHECK_FAILURES": "0"}, false, false, 0, 0},
+	} {
+		c, err := h.newHealthCheck(test.env, healthContainer())
+		if !test.valid {
+			if err == nil {
+				t.Fatalf("expected an error for %v", test.env)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for %v: %s", test.env, err)
+		}
+		if !test.check {
+			if c != nil {
+				t.Fatalf("expected no check for %v. Got %v", test.env, c)
+			}
+			continue
+		}
+		if c == nil || c.check == nil {
+			t.Fatalf("expected a check for %v", test.env)
+		}
+		if c.interval != test.interval || c.failures != test.failures {
+			t.Fatalf("expected every %s failing after %d for %v. Got every %s after %d",
+				test.interval, test.failures, test.env, c.interval, c.failures)
+		}
+	}
+}
+
+func TestHTTPCheck(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	check := httpCheck(server.URL+"/health", time.Second)
+	for _, test := range []struct {
+		status int
+		passes bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusNoContent, true},
+		{http.StatusMovedPermanently, false},
+		{http.StatusServiceUnavailable, false},
+	} {
+		status = test.status
+		err := check()
+		if test.passes && err != nil {
+			t.Fatalf("expected %d to pass. Got %s", test.status, err)
+		}
+		if !test.passes && err == nil {
+			t.Fatalf("expected %d to fail", test.status)
+		}
+	}
+
+	if err := httpCheck(server.URL+"/other", time.Second)(); err == nil {
+		t.Fatal("expected a 404 to fail")
+	}
+}
+
+func TestHealthCheckRun(t *testing.T) {
+	h := newHealthChecks(nil, "10.0.0.1")
+
+	// passes, fails once, then fails twice in a row and passes again
+	results := []error{nil, fmt.Errorf("500"), nil, fmt.Errorf("500"), fmt.Errorf("500")}
+	c := &healthCheck{
+		container: healthContainer(),
+		interval:  time.Millisecond,
+		failures:  2,
+		check: func() error {
+			if len(results) == 0 {
+				return nil
+			}
+			err := results[0]
+			results = results[1:]
+			return err
+		},
+		stop: make(chan struct{}),
+	}
+	go h.run(c)
+	defer close(c.stop)
+
+	for _, expected := range []bool{true, false, true} {
+		select {
+		case change := <-h.changes:
+			if change.passing != expected {
+				t.Fatalf("expected the check to change to passing=%t. Got %t", expected, change.passing)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the check to change to passing=%t", expected)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package discovery
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/utils"
+)
+
+var beats *heartbeats
+
+// heartbeats refresh each registered container's TTL from its own
+// goroutine so one slow container doesn't hold up the rest, and spread the
+// refreshes out so the keys don't all expire at once.
+type heartbeats struct {
+	// ttl is used for registrations that don't set their own
+	ttl      uint64
+	register func(container *docker.Container) error
+
+	mu    sync.Mutex
+	beats map[string]*heartbeat
+}
+
+type heartbeat struct {
+	// interval is the average time between refreshes
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// newHeartbeats refreshes registrations about three times per TTL by
+// calling register.
+func newHeartbeats(ttl uint64, register func(container *docker.Container) error) *heartbeats {
+	return &heartbeats{
+		ttl:      ttl,
+		register: register,
+		beats:    make(map[string]*heartbeat),
+	}
+}
+
+// jitter returns a random duration within 25% of d.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	return d*3/4 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// running returns true if container already has a heartbeat.
+func (h *heartbeats) running(containerID string) bool {
+	if h == nil {
+		return false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, ok := h.beats[containerID]
+	return ok
+}
+
+// start refreshes the registration for a container that was just
+// registered with ttl, or the default if ttl is 0.
+func (h *heartbeats) start(container *docker.Container, ttl uint64) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.beats[container.ID]; ok {
+		return
+	}
+
+	if ttl == 0 {
+		ttl = h.ttl
+	}
+	b := &heartbeat{
+		interval: time.Duration(ttl) * time.Second / 3,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	h.beats[container.ID] = b
+	go h.run(b, container)
+}
+
+// stop stops the container's heartbeat and waits for any refresh in
+// progress so the registration can be removed without it reappearing.
+func (h *heartbeats) stop(containerID string) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	b, ok := h.beats[containerID]
+	delete(h.beats, containerID)
+	h.mu.Unlock()
+
+	if ok {
+		close(b.stop)
+		<-b.done
+	}
+}
+
+// prune stops the heartbeats for any container not in containers.
+func (h *heartbeats) prune(containers []*docker.Container) {
+	if h == nil {
+		return
+	}
+
+	running := make(map[string]bool)
+	for _, container := range containers {
+		running[container.ID] = true
+	}
+
+	h.mu.Lock()
+	ids := []string{}
+	for id := range h.beats {
+		if !running[id] {
+			ids = append(ids, id)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, id := range ids {
+		h.stop(id)
+	}
+}
+
+// stopAll stops every heartbeat.
+func (h *heartbeats) stopAll() {
+	h.prune(nil)
+}
+
+func (h *heartbeats) run(b *heartbeat, container *docker.Container) {
+	defer close(b.done)
+
+	var health utils.BackendHealth
+	health.MaxBackoff = b.interval
+
+	delay := jitter(b.interval)
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-time.After(delay):
+		}
+
+		err := h.register(container)
+		if err != nil {
+			// retry sooner than usual so the registration doesn't expire
+			health.Failed(err)
+			log.Errorf("ERROR: Unable to refresh registration for %s: %s", container.ID[0:12], err)
+			delay = health.Backoff()
+			continue
+		}
+		health.OK()
+		delay = jitter(b.interval)
+	}
+}
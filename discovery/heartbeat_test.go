@@ -0,0 +1,79 @@
+package discovery
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestJitter(t *testing.T) {
+	if d := jitter(0); d != 0 {
+		t.Fatalf("expected no jitter for 0. Got %s", d)
+	}
+
+	d := 10 * time.Second
+	for i := 0; i < 1000; i++ {
+		j := jitter(d)
+		if j < d*3/4 || j > d*5/4 {
+			t.Fatalf("expected %s within 25%% of %s", j, d)
+		}
+	}
+}
+
+func TestHeartbeats(t *testing.T) {
+	var mu sync.Mutex
+	refreshes := make(map[string]int)
+	h := newHeartbeats(1, func(container *docker.Container) error {
+		mu.Lock()
+		defer mu.Unlock()
+		refreshes[container.ID]++
+		// a failed refresh doesn't stop the heartbeat
+		if container.ID == "bbbbbbbbbbbb" && refreshes[container.ID] == 1 {
+			return fmt.Errorf("connection refused")
+		}
+		return nil
+	})
+	count := func(id string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return refreshes[id]
+	}
+
+	a := &docker.Container{ID: "aaaaaaaaaaaa"}
+	b := &docker.Container{ID: "bbbbbbbbbbbb"}
+	h.start(a, 0)
+	h.start(a, 0)
+	h.start(b, 0)
+	if !h.running(a.ID) || !h.running(b.ID) || h.running("cccccccccccc") {
+		t.Fatal("expected only a and b to have heartbeats")
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	// about every 333ms with jitter, and one heartbeat per container
+	if n := count(a.ID); n < 2 || n > 6 {
+		t.Fatalf("expected a to be refreshed 2 to 6 times. Got %d", n)
+	}
+	if n := count(b.ID); n < 2 {
+		t.Fatalf("expected b to be refreshed after its failure. Got %d", n)
+	}
+
+	h.prune([]*docker.Container{b})
+	if h.running(a.ID) || !h.running(b.ID) {
+		t.Fatal("expected only b's heartbeat to be left")
+	}
+	stopped := count(a.ID)
+
+	h.stopAll()
+	if h.running(b.ID) {
+		t.Fatal("expected every heartbeat to be stopped")
+	}
+	stoppedB := count(b.ID)
+
+	time.Sleep(500 * time.Millisecond)
+	if count(a.ID) != stopped || count(b.ID) != stoppedB {
+		t.Fatal("expected no refreshes after the heartbeats stopped")
+	}
+}
@@ -0,0 +1,109 @@
+package discovery
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/registry"
+)
+
+// HostLockTTL is how long an agent's claim on its host lasts without being
+// refreshed.  Another agent can take over the host once it's expired.
+const HostLockTTL = 30 * time.Second
+
+var agentLock *hostLock
+
+// hostLock keeps a second agent on the same host, e.g. one started during
+// an upgrade, from fighting the first over the host's registrations.
+type hostLock struct {
+	serviceRegistry *registry.ServiceRegistry
+	env             string
+	pool            string
+	hostIP          string
+	owner           string
+
+	mu   sync.Mutex
+	held bool
+}
+
+func newHostLock(serviceRegistry *registry.ServiceRegistry, env, pool, hostIP string) *hostLock {
+	hostname, _ := os.Hostname()
+	return &hostLock{
+		serviceRegistry: serviceRegistry,
+		env:             env,
+		pool:            pool,
+		hostIP:          hostIP,
+		// agents in containers can share a hostname and pid
+		owner: fmt.Sprintf("%s:%d:%d", hostname, os.Getpid(), time.Now().UnixNano()),
+	}
+}
+
+// refresh claims or keeps the lock and returns true if it's held.  The lock
+// is kept if the registry can't be reached since the other agents can't
+// take it either.
+func (l *hostLock) refresh() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	holder, err := l.serviceRegistry.LockHost(l.env, l.pool, l.hostIP, l.owner, uint64(HostLockTTL/time.Second))
+	if err != nil {
+		log.Errorf("ERROR: Unable to lock host %s: %s", l.hostIP, err)
+		return l.held
+	}
+
+	if holder != "" {
+		if l.held {
+			log.Errorf("ERROR: Lost the lock on %s to another discovery agent (%s), no longer registering containers",
+				l.hostIP, holder)
+		} else {
+			log.Errorf("ERROR: Another discovery agent (%s) is registering containers on %s, waiting for it to stop",
+				holder, l.hostIP)
+		}
+	}
+	l.held = holder == ""
+	return l.held
+}
+
+// acquire waits until the lock is held and returns true, or returns false
+// if stop is closed first.
+func (l *hostLock) acquire(stop chan struct{}) bool {
+	for !l.refresh() {
+		select {
+		case <-stop:
+			return false
+		case <-time.After(HostLockTTL / 3):
+		}
+	}
+	return true
+}
+
+// holding returns true unless another agent has the lock.
+func (l *hostLock) holding() bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.held
+}
+
+func (l *hostLock) release() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.held {
+		return
+	}
+	err := l.serviceRegistry.UnlockHost(l.env, l.pool, l.hostIP, l.owner)
+	if err != nil {
+		log.Errorf("ERROR: Unable to unlock host %s: %s", l.hostIP, err)
+	}
+	l.held = false
+}
@@ -0,0 +1,66 @@
+package discovery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/litl/galaxy/registry"
+)
+
+func TestHostLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galaxy-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	serviceRegistry := registry.NewServiceRegistry(registry.DefaultTTL)
+	serviceRegistry.Connect("file://" + filepath.Join(dir, "registry.json"))
+
+	first := newHostLock(serviceRegistry, "dev", "web", "10.0.0.1")
+	second := newHostLock(serviceRegistry, "dev", "web", "10.0.0.1")
+	if first.owner == second.owner {
+		t.Fatalf("expected each agent to have its own owner. Got %s", first.owner)
+	}
+
+	var none *hostLock
+	if !none.holding() {
+		t.Fatal("expected no lock to always be holding")
+	}
+
+	for i, step := range []struct {
+		lock    *hostLock
+		release bool
+		held    bool
+	}{
+		{first, false, true},
+		{second, false, false},
+		{first, false, true},
+		// releasing a lock that isn't held leaves the other agent's
+		{second, true, false},
+		{first, false, true},
+		{first, true, false},
+		{second, false, true},
+		{first, false, false},
+	} {
+		if step.release {
+			step.lock.release()
+		} else if held := step.lock.refresh(); held != step.held {
+			t.Fatalf("step %d: expected refresh to return %t. Got %t", i, step.held, held)
+		}
+		if step.lock.holding() != step.held {
+			t.Fatalf("step %d: expected holding to be %t", i, step.held)
+		}
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	if first.acquire(stop) {
+		t.Fatal("expected acquire to give up once stopped")
+	}
+	if !second.acquire(stop) {
+		t.Fatal("expected the holder to acquire the lock right away")
+	}
+}
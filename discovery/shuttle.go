@@ -12,6 +12,8 @@ import (
 
 var (
 	client *shuttle.Client
+	// appConfigs is read for the live color of blue/green apps
+	appConfigs *config.Store
 )
 
 func registerShuttle(serviceRegistry *registry.ServiceRegistry, env, shuttleAddr string) {
@@ -26,51 +28,66 @@ func registerShuttle(serviceRegistry *registry.ServiceRegistry, env, shuttleAddr
 		return
 	}
 
+	live := liveColors(appConfigs, env, registrations)
 	backends := make(map[string]*shuttle.ServiceConfig)
+	// canaries holds each service's canary backends and canaryPercent
+	// their share of its traffic
+	canaries := make(map[string]map[string]bool)
+	canaryPercent := make(map[string]int)
 
 	for _, r := range registrations {
-
-		// No service ports exposed on the host, skip it.
-		if r.ExternalAddr() == "" || r.Port == "" {
+		if !routed(r, live) {
 			continue
 		}
 
-		service := backends[r.Name]
-		if service == nil {
-			service = &shuttle.ServiceConfig{
-				Name:         r.Name,
-				VirtualHosts: r.VirtualHosts,
+		for _, target := range shuttleTargets(r) {
+			service := backends[target.service]
+			if service == nil {
+				service = &shuttle.ServiceConfig{
+					Name: target.service,
+					Addr: "0.0.0.0:" + target.port,
+				}
+				backends[target.service] = service
+				canaries[target.service] = make(map[string]bool)
 			}
-			if r.Port != "" {
-				service.Addr = "0.0.0.0:" + r.Port
+			b := shuttle.BackendConfig{
+				Name:      r.ContainerID[0:12],
+				Addr:      target.addr,
+				CheckAddr: target.addr,
+				Weight:    r.Weight,
+			}
+			service.Backends = append(service.Backends, b)
+			if r.Canary {
+				canaries[target.service][b.Name] = true
+				canaryPercent[target.service] = r.CanaryPercent
 			}
-			backends[r.Name] = service
-		}
-		b := shuttle.BackendConfig{
-			Name:      r.ContainerID[0:12],
-			Addr:      r.ExternalAddr(),
-			CheckAddr: r.ExternalAddr(),
-		}
-		service.Backends = append(service.Backends, b)
 
-		// lookup the VIRTUAL_HOST_%d environment variables and load them into the ServiceConfig
-		errorPages := make(map[string][]int)
-		for vhostCode, url := range r.ErrorPages {
-			code := 0
-			n, err := fmt.Sscanf(vhostCode, "VIRTUAL_HOST_%d", &code)
-			if err != nil || n == 0 {
+			// virtual hosts route to the primary port
+			if target.service != r.Name {
 				continue
 			}
+			service.VirtualHosts = r.VirtualHosts
+
+			// lookup the VIRTUAL_HOST_%d environment variables and load them into the ServiceConfig
+			errorPages := make(map[string][]int)
+			for vhostCode, url := range r.ErrorPages {
+				code := 0
+				n, err := fmt.Sscanf(vhostCode, "VIRTUAL_HOST_%d", &code)
+				if err != nil || n == 0 {
+					continue
+				}
 
-			errorPages[url] = append(errorPages[url], code)
-		}
+				errorPages[url] = append(errorPages[url], code)
+			}
 
-		if len(errorPages) > 0 {
-			service.ErrorPages = errorPages
+			if len(errorPages) > 0 {
+				service.ErrorPages = errorPages
+			}
 		}
 	}
 
-	for _, service := range backends {
+	for name, service := range backends {
+		weighCanaries(service, canaries[name], canaryPercent[name])
 		err := client.UpdateService(service)
 		if err != nil {
 			log.Errorf("ERROR: Unable to register shuttle service: %s", err)
@@ -79,6 +96,109 @@ func registerShuttle(serviceRegistry *registry.ServiceRegistry, env, shuttleAddr
 
 }
 
+// liveColors returns the color getting the traffic of each app with green
+// registrations.  Apps whose live color has no registrations are left out
+// so they keep routing to the other one.
+func liveColors(configStore *config.Store, env string, registrations []registry.ServiceRegistration) map[string]string {
+	live := make(map[string]string)
+	if configStore == nil {
+		return live
+	}
+
+	for _, r := range registrations {
+		if r.Color == "" {
+			continue
+		}
+		if _, ok := live[r.Name]; ok {
+			continue
+		}
+
+		app, err := configStore.GetApp(r.Name, env)
+		if err != nil || app == nil {
+			log.Errorf("ERROR: Unable to load app %s: %s", r.Name, err)
+			continue
+		}
+		live[r.Name] = app.LiveColor()
+	}
+
+	registered := make(map[string]bool)
+	for _, r := range registrations {
+		if live[r.Name] == registrationColor(r) {
+			registered[r.Name] = true
+		}
+	}
+	for app := range live {
+		if !registered[app] {
+			delete(live, app)
+		}
+	}
+	return live
+}
+
+func registrationColor(r registry.ServiceRegistration) string {
+	if r.Color == "" {
+		return "blue"
+	}
+	return r.Color
+}
+
+// routed returns true if r gets traffic: it's the live color of a
+// blue/green app, or its app isn't being deployed blue/green.
+func routed(r registry.ServiceRegistration, live map[string]string) bool {
+	l := live[r.Name]
+	return l == "" || l == registrationColor(r)
+}
+
+// weighCanaries sets the weights of a service's backends so the canaries
+// get percent of its traffic between them.  The other backends keep their
+// relative weights.  Nothing changes if percent is 0 or there are only
+// canaries.
+func weighCanaries(service *shuttle.ServiceConfig, canaries map[string]bool, percent int) {
+	if percent <= 0 || percent >= 100 || len(canaries) == 0 || len(canaries) == len(service.Backends) {
+		return
+	}
+
+	stable := 0
+	for _, b := range service.Backends {
+		if !canaries[b.Name] {
+			stable += backendWeight(b)
+		}
+	}
+
+	// with the stable weights scaled by (100 - percent) * canaries, a
+	// canary weight of percent * stable gives the canaries percent of the
+	// total
+	scale := (100 - percent) * len(canaries)
+	divisor := 0
+	for i, b := range service.Backends {
+		weight := percent * stable
+		if !canaries[b.Name] {
+			weight = backendWeight(b) * scale
+		}
+		service.Backends[i].Weight = weight
+		divisor = gcd(divisor, weight)
+	}
+
+	for i := range service.Backends {
+		service.Backends[i].Weight /= divisor
+	}
+}
+
+// backendWeight returns the weight shuttle gives b.
+func backendWeight(b shuttle.BackendConfig) int {
+	if b.Weight <= 0 {
+		return 1
+	}
+	return b.Weight
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
 func unregisterShuttle(serviceRegistry *registry.ServiceRegistry, env, hostIP, shuttleAddr string) {
 
 	if client == nil {
@@ -100,27 +220,22 @@ func unregisterShuttle(serviceRegistry *registry.ServiceRegistry, env, hostIP, s
 			continue
 		}
 
-		// No service ports exposed on the host, skip it.
-		if r.ExternalAddr() == "" || r.Port == "" {
-			continue
-		}
-
-		service := backends[r.Name]
-		if service == nil {
-			service = &shuttle.ServiceConfig{
-				Name:         r.Name,
-				VirtualHosts: r.VirtualHosts,
+		for _, target := range shuttleTargets(r) {
+			service := backends[target.service]
+			if service == nil {
+				service = &shuttle.ServiceConfig{
+					Name:         target.service,
+					VirtualHosts: r.VirtualHosts,
+					Addr:         "0.0.0.0:" + target.port,
+				}
+				backends[target.service] = service
 			}
-			if r.Port != "" {
-				service.Addr = "0.0.0.0:" + r.Port
+			b := shuttle.BackendConfig{
+				Name: r.ContainerID[0:12],
+				Addr: target.addr,
 			}
-			backends[r.Name] = service
-		}
-		b := shuttle.BackendConfig{
-			Name: r.ContainerID[0:12],
-			Addr: r.ExternalAddr(),
+			service.Backends = append(service.Backends, b)
 		}
-		service.Backends = append(service.Backends, b)
 	}
 
 	for _, service := range backends {
@@ -157,17 +272,32 @@ func pruneShuttleBackends(configStore *config.Store, serviceRegistry *registry.S
 		return
 	}
 
+	live := liveColors(configStore, env, registrations)
+
+	// services for additional ports are named after the port
+	serviceApps := make(map[string]string)
+	for _, r := range registrations {
+		for _, target := range shuttleTargets(r) {
+			serviceApps[target.service] = r.Name
+		}
+	}
+
 	for _, service := range config.Services {
 
-		app, err := configStore.GetApp(service.Name, env)
+		appName := service.Name
+		if name, ok := serviceApps[service.Name]; ok {
+			appName = name
+		}
+
+		app, err := configStore.GetApp(appName, env)
 		if err != nil {
-			log.Errorf("ERROR: Unable to load app %s: %s", app, err)
+			log.Errorf("ERROR: Unable to load app %s: %s", appName, err)
 			continue
 		}
 
-		pools, err := configStore.ListAssignedPools(env, service.Name)
+		pools, err := configStore.ListAssignedPools(env, appName)
 		if err != nil {
-			log.Errorf("ERROR: Unable to list pool assignments for %s: %s", service.Name, err)
+			log.Errorf("ERROR: Unable to list pool assignments for %s: %s", appName, err)
 			continue
 		}
 
@@ -183,7 +313,7 @@ func pruneShuttleBackends(configStore *config.Store, serviceRegistry *registry.S
 		for _, backend := range service.Backends {
 			backendExists := false
 			for _, r := range registrations {
-				if backend.Name == r.ContainerID[0:12] {
+				if backend.Name == r.ContainerID[0:12] && !r.IsDraining() && routed(r, live) {
 					backendExists = true
 					break
 				}
@@ -199,3 +329,44 @@ func pruneShuttleBackends(configStore *config.Store, serviceRegistry *registry.S
 		}
 	}
 }
+
+// shuttleTarget is a shuttle service that a registration is a backend of.
+type shuttleTarget struct {
+	service string
+	// port is where shuttle listens for the service
+	port string
+	addr string
+}
+
+// shuttleTargets returns a target for each tcp port of r with a shuttle
+// port, or none if r is draining.  The primary port's service is named after the app and every other
+// port's after the app and the container port, e.g. "web-9000".
+func shuttleTargets(r registry.ServiceRegistration) []shuttleTarget {
+	// shuttle keeps proxying existing connections to removed backends
+	if r.IsDraining() {
+		return nil
+	}
+
+	// registered by a version of galaxy that only knew the primary port
+	if len(r.Ports) == 0 {
+		if r.ExternalAddr() == "" || r.Port == "" || r.IsUDP() {
+			return nil
+		}
+		return []shuttleTarget{{service: r.Name, port: r.Port, addr: r.ExternalAddr()}}
+	}
+
+	targets := []shuttleTarget{}
+	for key, p := range r.Ports {
+		// shuttle only proxies tcp
+		if p.Protocol != "tcp" || p.Port == "" {
+			continue
+		}
+
+		service := r.Name
+		if !r.IsPrimary(p) {
+			service = r.Name + "-" + p.InternalPort
+		}
+		targets = append(targets, shuttleTarget{service: service, port: p.Port, addr: r.ExternalAddrFor(key)})
+	}
+	return targets
+}
@@ -0,0 +1,63 @@
+package discovery
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/litl/galaxy/registry"
+)
+
+func TestShuttleTargets(t *testing.T) {
+	multi := registry.ServiceRegistration{
+		Name:         "web",
+		ExternalIP:   "10.0.0.1",
+		ExternalPort: "20000",
+		InternalPort: "8080",
+		Port:         "10000",
+		Ports: map[string]registry.PortMapping{
+			"8080/tcp": {InternalPort: "8080", ExternalPort: "20000", Protocol: "tcp", Port: "10000"},
+			"9000/tcp": {InternalPort: "9000", ExternalPort: "20001", Protocol: "tcp", Port: "10001"},
+			"9100/tcp": {InternalPort: "9100", ExternalPort: "20002", Protocol: "tcp"},
+			"8125/udp": {InternalPort: "8125", ExternalPort: "20003", Protocol: "udp", Port: "10002"},
+		},
+	}
+	draining := multi
+	draining.State = registry.RegistrationDraining
+
+	for _, test := range []struct {
+		name    string
+		reg     registry.ServiceRegistration
+		targets []shuttleTarget
+	}{
+		{"every tcp port with a shuttle port", multi, []shuttleTarget{
+			{service: "web", port: "10000", addr: "10.0.0.1:20000"},
+			{service: "web-9000", port: "10001", addr: "10.0.0.1:20001"},
+		}},
+		{"draining", draining, nil},
+		{"only the primary port", registry.ServiceRegistration{
+			Name: "api", ExternalIP: "10.0.0.1", ExternalPort: "20010", Port: "10010",
+		}, []shuttleTarget{{service: "api", port: "10010", addr: "10.0.0.1:20010"}}},
+		{"only the primary port, udp", registry.ServiceRegistration{
+			Name: "statsd", ExternalIP: "10.0.0.1", ExternalPort: "20020", Port: "10020", Protocol: "udp",
+		}, nil},
+		{"no shuttle port", registry.ServiceRegistration{
+			Name: "worker", ExternalIP: "10.0.0.1", ExternalPort: "20030",
+		}, nil},
+	} {
+		targets := shuttleTargets(test.reg)
+		sort.Sort(targetsByService(targets))
+		if len(targets) == 0 && len(test.targets) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(targets, test.targets) {
+			t.Fatalf("%s: expected %v. Got %v", test.name, test.targets, targets)
+		}
+	}
+}
+
+type targetsByService []shuttleTarget
+
+func (l targetsByService) Len() int           { return len(l) }
+func (l targetsByService) Less(i, j int) bool { return l[i].service < l[j].service }
+func (l targetsByService) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
@@ -0,0 +1,202 @@
+package events
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/utils"
+)
+
+const (
+	// events queued per sink before new events are dropped
+	sinkQueueSize = 100
+)
+
+// Event is a notable change in the cluster, e.g. a deploy or a container
+// being started.
+type Event struct {
+	Type    string            `json:"type"`
+	Env     string            `json:"env,omitempty"`
+	Pool    string            `json:"pool,omitempty"`
+	App     string            `json:"app,omitempty"`
+	Host    string            `json:"host,omitempty"`
+	Message string            `json:"message,omitempty"`
+	Data    map[string]string `json:"data,omitempty"`
+	// Detail is structured data, e.g. a reconcile report, that sinks
+	// sending JSON include as is
+	Detail interface{} `json:"detail,omitempty"`
+	Time   time.Time   `json:"time"`
+}
+
+func (e *Event) String() string {
+	parts := []string{}
+	for _, s := range []string{e.Env, e.Pool, e.App, e.Host} {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+
+	msg := fmt.Sprintf("[%s] %s", strings.Join(parts, "/"), e.Type)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// EventSink delivers events to an external destination.
+type EventSink interface {
+	Send(e *Event) error
+}
+
+// Filter restricts the events sent to a sink.  An empty list matches
+// everything.  Types ending in "*" match as a prefix.
+type Filter struct {
+	Types []string
+	Envs  []string
+	Pools []string
+	Apps  []string
+}
+
+func (f Filter) Match(e *Event) bool {
+	if len(f.Types) > 0 && !matchType(e.Type, f.Types) {
+		return false
+	}
+
+	for _, check := range []struct {
+		value   string
+		allowed []string
+	}{
+		{e.Env, f.Envs},
+		{e.Pool, f.Pools},
+		{e.App, f.Apps},
+	} {
+		if len(check.allowed) > 0 && !utils.StringInSlice(check.value, check.allowed) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchType(t string, types []string) bool {
+	for _, pattern := range types {
+		if strings.HasSuffix(pattern, "*") && strings.HasPrefix(t, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+		if pattern == t {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseFilter reads the types, envs, pools and apps query parameters of a
+// sink URL.
+func ParseFilter(query url.Values) Filter {
+	split := func(key string) []string {
+		values := []string{}
+		for _, v := range strings.Split(query.Get(key), ",") {
+			if strings.TrimSpace(v) != "" {
+				values = append(values, strings.TrimSpace(v))
+			}
+		}
+		return values
+	}
+
+	return Filter{
+		Types: split("types"),
+		Envs:  split("envs"),
+		Pools: split("pools"),
+		Apps:  split("apps"),
+	}
+}
+
+type sinkWorker struct {
+	name   string
+	sink   EventSink
+	filter Filter
+	queue  chan *Event
+}
+
+func (w *sinkWorker) run() {
+	for e := range w.queue {
+		err := w.sink.Send(e)
+		if err != nil {
+			log.Errorf("ERROR: Unable to send event to %s: %s", w.name, err)
+		}
+	}
+}
+
+// Dispatcher fans events out to each configured sink.  Sinks are sent events
+// asynchronously so a slow destination never blocks the caller.
+type Dispatcher struct {
+	sync.RWMutex
+	workers []*sinkWorker
+}
+
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{}
+}
+
+// AddSink registers sink with the dispatcher.  name is only used for logging.
+func (d *Dispatcher) AddSink(name string, sink EventSink, filter Filter) {
+	w := &sinkWorker{
+		name:   name,
+		sink:   sink,
+		filter: filter,
+		queue:  make(chan *Event, sinkQueueSize),
+	}
+	go w.run()
+
+	d.Lock()
+	d.workers = append(d.workers, w)
+	d.Unlock()
+}
+
+// AddSinkURL creates a sink from its URL and registers it.
+func (d *Dispatcher) AddSinkURL(sinkURL string) error {
+	sink, filter, err := NewSink(sinkURL)
+	if err != nil {
+		return err
+	}
+
+	name := sinkURL
+	if u, err := url.Parse(sinkURL); err == nil {
+		name = u.Scheme
+	}
+	d.AddSink(name, sink, filter)
+	return nil
+}
+
+func (d *Dispatcher) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	d.RLock()
+	defer d.RUnlock()
+	for _, w := range d.workers {
+		if !w.filter.Match(&e) {
+			continue
+		}
+
+		ev := e
+		select {
+		case w.queue <- &ev:
+		default:
+			log.Warnf("WARN: Event queue for %s is full. Dropping %s event.", w.name, e.Type)
+		}
+	}
+}
+
+var DefaultDispatcher = NewDispatcher()
+
+func AddSink(name string, sink EventSink, filter Filter) {
+	DefaultDispatcher.AddSink(name, sink, filter)
+}
+
+func AddSinkURL(sinkURL string) error { return DefaultDispatcher.AddSinkURL(sinkURL) }
+func Publish(e Event)                 { DefaultDispatcher.Publish(e) }
@@ -0,0 +1,115 @@
+package events
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+type testSink struct {
+	events chan *Event
+}
+
+func (s *testSink) Send(e *Event) error {
+	s.events <- e
+	return nil
+}
+
+func TestFilterMatch(t *testing.T) {
+	e := &Event{Type: "container.start", Env: "dev", Pool: "web", App: "app"}
+
+	for _, tt := range []struct {
+		filter Filter
+		want   bool
+	}{
+		{Filter{}, true},
+		{Filter{Types: []string{"container.start"}}, true},
+		{Filter{Types: []string{"container.*"}}, true},
+		{Filter{Types: []string{"app.*"}}, false},
+		{Filter{Envs: []string{"dev", "prod"}}, true},
+		{Filter{Envs: []string{"prod"}}, false},
+		{Filter{Pools: []string{"web"}, Apps: []string{"other"}}, false},
+	} {
+		if got := tt.filter.Match(e); got != tt.want {
+			t.Errorf("%+v.Match() = %t, want %t", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	query, _ := url.ParseQuery("types=app.*,container.stop&envs=prod&channel=deploys")
+	f := ParseFilter(query)
+
+	if len(f.Types) != 2 || f.Types[0] != "app.*" || f.Types[1] != "container.stop" {
+		t.Fatalf("Types = %v, want %v", f.Types, []string{"app.*", "container.stop"})
+	}
+
+	if len(f.Envs) != 1 || f.Envs[0] != "prod" {
+		t.Fatalf("Envs = %v, want %v", f.Envs, []string{"prod"})
+	}
+
+	if len(f.Pools) != 0 || len(f.Apps) != 0 {
+		t.Fatalf("Pools, Apps = %v, %v, want empty", f.Pools, f.Apps)
+	}
+}
+
+func TestNewSink(t *testing.T) {
+	sink, filter, err := NewSink("slack://hooks.slack.com/services/T/B/X?channel=%23deploys&envs=prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slack, ok := sink.(*SlackSink)
+	if !ok {
+		t.Fatalf("NewSink() = %T, want %T", sink, &SlackSink{})
+	}
+
+	if slack.WebhookURL != "https://hooks.slack.com/services/T/B/X" || slack.Channel != "#deploys" {
+		t.Fatalf("SlackSink = %+v", slack)
+	}
+
+	if len(filter.Envs) != 1 || filter.Envs[0] != "prod" {
+		t.Fatalf("Envs = %v, want %v", filter.Envs, []string{"prod"})
+	}
+
+	if _, _, err := NewSink("bogus://foo"); err == nil {
+		t.Fatal("NewSink() with unknown scheme should fail")
+	}
+}
+
+func TestDispatcherPublish(t *testing.T) {
+	d := NewDispatcher()
+	all := &testSink{events: make(chan *Event, 10)}
+	prod := &testSink{events: make(chan *Event, 10)}
+	d.AddSink("all", all, Filter{})
+	d.AddSink("prod", prod, Filter{Envs: []string{"prod"}})
+
+	d.Publish(Event{Type: "app.deploy", Env: "dev", App: "app"})
+	d.Publish(Event{Type: "app.deploy", Env: "prod", App: "app"})
+
+	for i, env := range []string{"dev", "prod"} {
+		select {
+		case e := <-all.events:
+			if e.Env != env || e.Time.IsZero() {
+				t.Fatalf("event %d = %+v, want env %s", i, e, env)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for event %d", i)
+		}
+	}
+
+	select {
+	case e := <-prod.events:
+		if e.Env != "prod" {
+			t.Fatalf("event = %+v, want env prod", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for prod event")
+	}
+
+	select {
+	case e := <-prod.events:
+		t.Fatalf("unexpected event %+v", e)
+	default:
+	}
+}
@@ -0,0 +1,246 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goamz/goamz/aws"
+)
+
+var httpClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// NewSink creates a sink from a URL.  Supported schemes are:
+//
+//	slack://hooks.slack.com/services/...[?channel=#deploys]
+//	http(s)://example.com/hook     (POSTs the event as JSON)
+//	statsd://127.0.0.1:8125[?prefix=galaxy]
+//	file:///var/log/galaxy/events.log
+//	sns:arn:aws:sns:us-east-1:123456789012:deploys
+//
+// The types, envs, pools and apps query parameters are used to build
+// the sink's Filter and are not passed on to the destination.
+func NewSink(sinkURL string) (EventSink, Filter, error) {
+	u, err := url.Parse(sinkURL)
+	if err != nil {
+		return nil, Filter{}, err
+	}
+
+	query := u.Query()
+	filter := ParseFilter(query)
+	for _, k := range []string{"types", "envs", "pools", "apps"} {
+		query.Del(k)
+	}
+	u.RawQuery = query.Encode()
+
+	var sink EventSink
+	switch strings.ToLower(u.Scheme) {
+	case "slack":
+		channel := query.Get("channel")
+		query.Del("channel")
+		u.RawQuery = query.Encode()
+		u.Scheme = "https"
+		sink = &SlackSink{
+			WebhookURL: u.String(),
+			Channel:    channel,
+		}
+	case "http", "https":
+		sink = &WebhookSink{
+			URL: u.String(),
+		}
+	case "statsd":
+		prefix := query.Get("prefix")
+		if prefix == "" {
+			prefix = "galaxy"
+		}
+		sink = &StatsdSink{
+			Addr:   u.Host,
+			Prefix: prefix,
+		}
+	case "file":
+		sink = &FileSink{
+			Path: u.Path,
+		}
+	case "sns":
+		sink, err = NewSNSSink(u.Opaque)
+		if err != nil {
+			return nil, filter, err
+		}
+	default:
+		return nil, filter, fmt.Errorf("unsupported event sink: %s", u.Scheme)
+	}
+	return sink, filter, nil
+}
+
+func postJSON(url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	resp, err := httpClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// SlackSink posts a one line summary of each event to a Slack incoming
+// webhook.
+type SlackSink struct {
+	WebhookURL string
+	Channel    string
+}
+
+func (s *SlackSink) Send(e *Event) error {
+	msg := map[string]string{
+		"text": e.String(),
+	}
+	if s.Channel != "" {
+		msg["channel"] = s.Channel
+	}
+	return postJSON(s.WebhookURL, msg)
+}
+
+// WebhookSink POSTs the JSON encoded event to a URL.
+type WebhookSink struct {
+	URL string
+}
+
+func (w *WebhookSink) Send(e *Event) error {
+	return postJSON(w.URL, e)
+}
+
+// StatsdSink increments a counter for each event named
+// <prefix>.<env>.<app>.<type>.
+type StatsdSink struct {
+	Addr   string
+	Prefix string
+}
+
+func (s *StatsdSink) Send(e *Event) error {
+	parts := []string{s.Prefix}
+	for _, p := range []string{e.Env, e.App, e.Type} {
+		if p != "" {
+			parts = append(parts, strings.Replace(p, ".", "_", -1))
+		}
+	}
+
+	conn, err := net.DialTimeout("udp", s.Addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = fmt.Fprintf(conn, "%s:1|c", strings.Join(parts, "."))
+	return err
+}
+
+// FileSink appends each event as a line of JSON to a file.
+type FileSink struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (f *FileSink) Send(e *Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// SNSSink publishes events to an SNS topic.  AWS credentials are taken
+// from the environment.
+type SNSSink struct {
+	TopicArn string
+	service  *aws.Service
+}
+
+func NewSNSSink(topicArn string) (*SNSSink, error) {
+	// arn:aws:sns:<region>:<account>:<topic>
+	parts := strings.Split(topicArn, ":")
+	if len(parts) != 6 || parts[2] != "sns" {
+		return nil, fmt.Errorf("invalid SNS topic ARN: %s", topicArn)
+	}
+
+	region, ok := aws.Regions[parts[3]]
+	if !ok {
+		return nil, fmt.Errorf("region %s not found", parts[3])
+	}
+
+	auth, err := aws.GetAuth("", "", "", time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	svc, err := aws.NewService(auth, aws.ServiceInfo{
+		Endpoint: region.SNSEndpoint,
+		Signer:   aws.V2Signature,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &SNSSink{
+		TopicArn: topicArn,
+		service:  svc,
+	}, nil
+}
+
+func (s *SNSSink) Send(e *Event) error {
+	msg, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	subject := e.String()
+	// SNS subjects are limited to 100 characters
+	if len(subject) > 100 {
+		subject = subject[:100]
+	}
+
+	resp, err := s.service.Query("POST", "/", map[string]string{
+		"Action":   "Publish",
+		"TopicArn": s.TopicArn,
+		"Subject":  subject,
+		"Message":  string(msg),
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s.service.BuildError(resp)
+	}
+	return nil
+}
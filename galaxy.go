@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -13,11 +14,11 @@ import (
 	"github.com/BurntSushi/toml"
 	"github.com/codegangsta/cli"
 	gconfig "github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/discovery"
 	"github.com/litl/galaxy/log"
 	"github.com/litl/galaxy/registry"
 	"github.com/litl/galaxy/runtime"
 	"github.com/litl/galaxy/utils"
-	"github.com/ryanuber/columnize"
 
 	"github.com/dotcloud/docker/pkg/term"
 	"github.com/litl/galaxy/commander"
@@ -37,6 +38,8 @@ var (
 
 var config struct {
 	Host string `toml:"host"`
+	// RegistryAuth has docker registry logins by registry hostname
+	RegistryAuth map[string]runtime.RegistryAuth `toml:"registry_auth"`
 }
 
 func init() {
@@ -51,6 +54,12 @@ func initRegistry(c *cli.Context) {
 	)
 
 	serviceRegistry.Connect(utils.GalaxyRedisHost(c))
+	if mirror := utils.GalaxyRegistryMirror(c); mirror != "" {
+		serviceRegistry.Mirror(mirror)
+	}
+	if replica := utils.GalaxyRegistryReplica(c); replica != "" {
+		serviceRegistry.ReadReplica(replica)
+	}
 	initStore(c)
 }
 
@@ -62,15 +71,71 @@ func initStore(c *cli.Context) {
 	)
 
 	configStore.Connect(utils.GalaxyRedisHost(c))
+	if mirror := utils.GalaxyRegistryMirror(c); mirror != "" {
+		configStore.Mirror(mirror)
+	}
+	if replica := utils.GalaxyRegistryReplica(c); replica != "" {
+		configStore.ReadReplica(replica)
+	}
 }
 
 // ensure the registry as a redis host, but only once
-func initRuntime(c *cli.Context) {
-	serviceRuntime = runtime.NewServiceRuntime(
+// dockerConfigFrom returns the docker daemon settings from the environment
+// and the global flags.
+func dockerConfigFrom(c *cli.Context) runtime.DockerConfig {
+	dockerConfig := runtime.DefaultDockerConfig()
+	if c.GlobalIsSet("docker-host") {
+		dockerConfig.Host = c.GlobalString("docker-host")
+	}
+	if c.GlobalIsSet("docker-cert-path") {
+		dockerConfig.CertPath = c.GlobalString("docker-cert-path")
+	}
+	dockerConfig.TLS = dockerConfig.TLS || c.GlobalBool("docker-tls")
+	dockerConfig.TLSVerify = dockerConfig.TLSVerify || c.GlobalBool("docker-tls-verify")
+	return dockerConfig
+}
+
+// dockerPort returns the port the hosts' docker daemons listen on, from
+// --docker-port or the default for dockerConfig's TLS settings.
+func dockerPort(c *cli.Context, dockerConfig runtime.DockerConfig) string {
+	if port := c.String("docker-port"); port != "" {
+		return port
+	}
+	if dockerConfig.TLS || dockerConfig.TLSVerify {
+		return "2376"
+	}
+	return "2375"
+}
+
+// newRuntime returns a runtime for the docker daemon at dockerConfig on
+// the host with hostIP.
+func newRuntime(c *cli.Context, dockerConfig runtime.DockerConfig, hostIP string) *runtime.ServiceRuntime {
+	rt := runtime.NewServiceRuntime(
 		serviceRegistry,
 		"",
-		"127.0.0.1",
+		hostIP,
+		dockerConfig,
 	)
+	rt.PullOutput = os.Stderr
+	rt.CredentialHelper = c.GlobalString("credential-helper")
+	rt.ConfigStore = configStore
+
+	rt.RegistryAuths = make(map[string]runtime.RegistryAuth)
+	for registry, auth := range config.RegistryAuth {
+		rt.RegistryAuths[registry] = auth
+	}
+	for _, login := range c.GlobalStringSlice("registry-auth") {
+		registry, auth, err := runtime.ParseRegistryAuth(login)
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		rt.RegistryAuths[registry] = auth
+	}
+	return rt
+}
+
+func initRuntime(c *cli.Context) {
+	serviceRuntime = newRuntime(c, dockerConfigFrom(c), "127.0.0.1")
 }
 
 func ensureAppParam(c *cli.Context, command string) string {
@@ -138,7 +203,7 @@ func appDelete(c *cli.Context) {
 
 	app := ensureAppParam(c, "app:delete")
 
-	err := commander.AppDelete(configStore, app, utils.GalaxyEnv(c))
+	err := commander.AppDelete(configStore, serviceRegistry, app, utils.GalaxyEnv(c))
 	if err != nil {
 		log.Fatalf("ERROR: %s", err)
 	}
@@ -162,7 +227,118 @@ func appDeploy(c *cli.Context) {
 		return
 	}
 
-	err := commander.AppDeploy(configStore, serviceRuntime, app, utils.GalaxyEnv(c), version)
+	deployID, err := commander.AppDeploy(configStore, serviceRuntime, app, utils.GalaxyEnv(c), version)
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+
+	if c.Bool("wait") {
+		err = commander.WaitForDeploy(configStore, serviceRegistry, app, utils.GalaxyEnv(c), deployID, c.Duration("timeout"))
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+	}
+}
+
+func appRollback(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+
+	app := ensureAppParam(c, "app:rollback")
+
+	deployID, err := commander.AppRollback(configStore, app, utils.GalaxyEnv(c), c.String("to"))
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+
+	if c.Bool("wait") {
+		err = commander.WaitForDeploy(configStore, serviceRegistry, app, utils.GalaxyEnv(c), deployID, c.Duration("timeout"))
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+	}
+}
+
+func canaryDeploy(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+	initRuntime(c)
+
+	app := ensureAppParam(c, "canary:deploy")
+
+	version := ""
+	if len(c.Args().Tail()) == 1 {
+		version = c.Args().Tail()[0]
+	}
+
+	if version == "" {
+		log.Println("ERROR: version missing")
+		cli.ShowCommandHelp(c, "canary:deploy")
+		return
+	}
+
+	err := commander.CanaryDeploy(configStore, serviceRuntime, app, utils.GalaxyEnv(c), version, c.Int("percent"))
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+}
+
+func blueGreenDeploy(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+	initRuntime(c)
+
+	app := ensureAppParam(c, "bluegreen:deploy")
+
+	version := ""
+	if len(c.Args().Tail()) == 1 {
+		version = c.Args().Tail()[0]
+	}
+
+	if version == "" {
+		log.Println("ERROR: version missing")
+		cli.ShowCommandHelp(c, "bluegreen:deploy")
+		return
+	}
+
+	err := commander.BlueGreenDeploy(configStore, serviceRuntime, app, utils.GalaxyEnv(c), version)
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+}
+
+func cutover(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+
+	app := ensureAppParam(c, "cutover")
+
+	err := commander.Cutover(configStore, app, utils.GalaxyEnv(c))
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+}
+
+func canaryPromote(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+	initRuntime(c)
+
+	app := ensureAppParam(c, "canary:promote")
+
+	err := commander.CanaryPromote(configStore, serviceRuntime, app, utils.GalaxyEnv(c))
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+}
+
+func canaryAbort(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+
+	app := ensureAppParam(c, "canary:abort")
+
+	err := commander.CanaryAbort(configStore, app, utils.GalaxyEnv(c))
 	if err != nil {
 		log.Fatalf("ERROR: %s", err)
 	}
@@ -173,7 +349,7 @@ func appRestart(c *cli.Context) {
 
 	app := ensureAppParam(c, "app:restart")
 
-	err := commander.AppRestart(configStore, app, utils.GalaxyEnv(c))
+	err := commander.AppRestart(configStore, app, utils.GalaxyEnv(c), c.Int("batch"), c.Duration("delay"))
 	if err != nil {
 		log.Fatalf("ERROR: %s", err)
 	}
@@ -191,7 +367,56 @@ func appRun(c *cli.Context) {
 		return
 	}
 
+	if c.Bool("exec") {
+		err := commander.AppExec(configStore, serviceRuntime, app, utils.GalaxyEnv(c), utils.GalaxyPool(c), c.Args()[1:])
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		return
+	}
+
 	err := commander.AppRun(configStore, serviceRuntime, app, utils.GalaxyEnv(c), c.Args()[1:])
+	if exitErr, ok := err.(*runtime.ExitError); ok {
+		os.Exit(exitErr.Status)
+	}
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+}
+
+// run runs a one-off command of an app on a host of its pool, exiting
+// with the command's status.
+func run(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+
+	app := ensureAppParam(c, "run")
+
+	args := c.Args()[1:]
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		log.Fatalf("ERROR: Missing command to run.")
+	}
+
+	host := c.String("host")
+	if host == "" {
+		var err error
+		host, err = commander.RunHost(configStore, app, utils.GalaxyEnv(c), utils.GalaxyPool(c))
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+	}
+
+	dockerConfig := dockerConfigFrom(c)
+	dockerConfig.Host = "tcp://" + net.JoinHostPort(host, dockerPort(c, dockerConfig))
+	log.Printf("Running %s on %s", app, host)
+
+	err := commander.AppRun(configStore, newRuntime(c, dockerConfig, host), app, utils.GalaxyEnv(c), args)
+	if exitErr, ok := err.(*runtime.ExitError); ok {
+		os.Exit(exitErr.Status)
+	}
 	if err != nil {
 		log.Fatalf("ERROR: %s", err)
 	}
@@ -211,12 +436,315 @@ func appShell(c *cli.Context) {
 	}
 }
 
+func history(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+
+	err := commander.History(configStore, c.Args().First(), utils.GalaxyEnv(c), c.Int("limit"))
+	if err != nil {
+		log.Fatalf("ERROR: Unable to read history: %s.", err)
+	}
+}
+
+func audit(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+
+	err := commander.Audit(configStore, utils.GalaxyEnv(c), c.String("actor"), c.String("key"), c.Duration("since"), c.Int("limit"))
+	if err != nil {
+		log.Fatalf("ERROR: Unable to read history: %s.", err)
+	}
+}
+
+func status(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+
+	ok, err := commander.Status(configStore, serviceRegistry, utils.GalaxyEnv(c))
+	if err != nil {
+		log.Fatalf("ERROR: Unable to get status: %s.", err)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+func processes(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+
+	err := commander.Processes(configStore, serviceRegistry, utils.GalaxyEnv(c), c.Args().First())
+	if err != nil {
+		log.Fatalf("ERROR: Unable to list containers: %s.", err)
+	}
+}
+
+func appLogs(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+
+	app := ensureAppParam(c, "logs")
+
+	dockerConfig := dockerConfigFrom(c)
+	err := commander.AppLogs(serviceRegistry, dockerConfig, dockerPort(c, dockerConfig), utils.GalaxyEnv(c), app, c.String("tail"), c.Bool("follow"))
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+}
+
+func dnsServe(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+
+	server := discovery.NewDNSServer(serviceRegistry, utils.GalaxyEnv(c))
+	server.Domain = c.String("domain")
+	server.CacheTTL = c.Duration("ttl")
+
+	log.Printf("Serving %s.%s on %s\n", utils.GalaxyEnv(c), server.Domain, c.String("addr"))
+	err := server.ListenAndServe(c.String("addr"))
+	if err != nil {
+		log.Fatalf("ERROR: Unable to serve DNS: %s.", err)
+	}
+}
+
+func apiServe(c *cli.Context) {
+	initRegistry(c)
+
+	log.Printf("Serving the discovery API on %s\n", c.String("addr"))
+	err := discovery.NewAPIServer(serviceRegistry).ListenAndServe(c.String("addr"))
+	if err != nil {
+		log.Fatalf("ERROR: Unable to serve the discovery API: %s.", err)
+	}
+}
+
+func registryGC(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+
+	err := commander.RegistryGC(configStore, serviceRegistry, utils.GalaxyEnv(c), c.Bool("force"))
+	if err != nil {
+		log.Fatalf("ERROR: Unable to clean up registry: %s.", err)
+	}
+}
+
+func hostGC(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+	initRuntime(c)
+
+	err := commander.HostGC(configStore, serviceRuntime, utils.GalaxyEnv(c), c.Duration("age"), c.Bool("force"))
+	if err != nil {
+		log.Fatalf("ERROR: Unable to clean up docker: %s.", err)
+	}
+}
+
+func sidecarList(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+
+	app := ensureAppParam(c, "sidecar")
+
+	err := commander.SidecarList(configStore, app, utils.GalaxyEnv(c))
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+}
+
+func sidecarSet(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+
+	app := ensureAppParam(c, "sidecar:set")
+	if len(c.Args()) < 3 {
+		cli.ShowCommandHelp(c, "sidecar:set")
+		log.Fatal("ERROR: name and image are required")
+	}
+
+	sidecar := gconfig.SidecarConfig{
+		Name:      c.Args().Get(1),
+		Image:     c.Args().Get(2),
+		Cmd:       c.Args()[3:],
+		Memory:    c.String("memory"),
+		CPUShares: c.String("cpu"),
+		Env:       map[string]string{},
+	}
+
+	for _, e := range c.StringSlice("env") {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("ERROR: Bad env var %s. Use KEY=VALUE", e)
+		}
+		sidecar.Env[parts[0]] = parts[1]
+	}
+
+	updated, err := commander.SidecarSet(configStore, app, utils.GalaxyEnv(c), sidecar)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to set sidecar: %s.", err)
+	}
+	if updated {
+		log.Printf("Sidecar %s updated for %s.\n", sidecar.Name, app)
+	}
+}
+
+func sidecarUnset(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+
+	app := ensureAppParam(c, "sidecar:unset")
+	name := c.Args().Get(1)
+	if name == "" {
+		cli.ShowCommandHelp(c, "sidecar:unset")
+		log.Fatal("ERROR: name is required")
+	}
+
+	updated, err := commander.SidecarUnset(configStore, app, utils.GalaxyEnv(c), name)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to remove sidecar: %s.", err)
+	}
+	if updated {
+		log.Printf("Sidecar %s removed from %s.\n", name, app)
+	}
+}
+
+func jobsList(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+
+	err := commander.JobsList(configStore, serviceRegistry, utils.GalaxyEnv(c), c.Args().First())
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+}
+
+func jobSet(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+
+	app := ensureAppParam(c, "job:set")
+	if len(c.Args()) < 4 {
+		cli.ShowCommandHelp(c, "job:set")
+		log.Fatal("ERROR: name, schedule and command are required")
+	}
+
+	err := commander.JobSet(configStore, app, utils.GalaxyEnv(c), gconfig.JobConfig{
+		Name:     c.Args().Get(1),
+		Schedule: c.Args().Get(2),
+		Command:  strings.Join(c.Args()[3:], " "),
+	})
+	if err != nil {
+		log.Fatalf("ERROR: Unable to set job: %s.", err)
+	}
+}
+
+func jobUnset(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+
+	app := ensureAppParam(c, "job:unset")
+	name := c.Args().Get(1)
+	if name == "" {
+		cli.ShowCommandHelp(c, "job:unset")
+		log.Fatal("ERROR: name is required")
+	}
+
+	err := commander.JobUnset(configStore, serviceRegistry, app, utils.GalaxyEnv(c), name)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to remove job: %s.", err)
+	}
+}
+
+func policyShow(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+
+	err := commander.PolicyShow(serviceRegistry, utils.GalaxyEnv(c))
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+}
+
+func policySet(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+
+	err := commander.PolicySet(serviceRegistry, utils.GalaxyEnv(c), registry.ImagePolicy{
+		Registries: c.StringSlice("registry"),
+		Verify:     c.String("verify"),
+		Key:        c.String("key"),
+		Privileged: c.StringSlice("privileged"),
+	})
+	if err != nil {
+		log.Fatalf("ERROR: Unable to set the image policy: %s.", err)
+	}
+}
+
+func policyClear(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+
+	err := commander.PolicyClear(serviceRegistry, utils.GalaxyEnv(c))
+	if err != nil {
+		log.Fatalf("ERROR: Unable to clear the image policy: %s.", err)
+	}
+}
+
+// externalArgs returns the name and address of an external service.
+func externalArgs(c *cli.Context, command string) (string, string) {
+	name, addr := c.Args().Get(0), c.Args().Get(1)
+	if name == "" || addr == "" {
+		cli.ShowCommandHelp(c, command)
+		log.Fatal("ERROR: name and address are required")
+	}
+	return name, addr
+}
+
+func externalRegister(c *cli.Context) {
+	ensureEnvArg(c)
+	ensurePoolArg(c)
+	initRegistry(c)
+	name, addr := externalArgs(c, "external:register")
+
+	err := commander.RegisterExternal(serviceRegistry, utils.GalaxyEnv(c), utils.GalaxyPool(c), name, addr)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to register %s: %s.", name, err)
+	}
+}
+
+func externalUnregister(c *cli.Context) {
+	ensureEnvArg(c)
+	ensurePoolArg(c)
+	initRegistry(c)
+	name, addr := externalArgs(c, "external:unregister")
+
+	err := commander.UnRegisterExternal(serviceRegistry, utils.GalaxyEnv(c), utils.GalaxyPool(c), name, addr)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to unregister %s: %s.", name, err)
+	}
+}
+
+func drain(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+	app := ensureAppParam(c, "drain")
+
+	host := c.Args().Get(1)
+	if host == "" {
+		cli.ShowCommandHelp(c, "drain")
+		log.Fatal("ERROR: host missing")
+	}
+
+	err := commander.Drain(serviceRegistry, utils.GalaxyEnv(c), app, host, c.Duration("grace"))
+	if err != nil {
+		log.Fatalf("ERROR: Unable to drain %s on %s: %s.", app, host, err)
+	}
+}
+
 func configList(c *cli.Context) {
 	ensureEnvArg(c)
 	initRegistry(c)
 	app := ensureAppParam(c, "config")
 
-	err := commander.ConfigList(configStore, app, utils.GalaxyEnv(c))
+	err := commander.ConfigList(configStore, app, utils.GalaxyEnv(c), c.String("format"))
 	if err != nil {
 		log.Fatalf("ERROR: Unable to list config: %s.", err)
 		return
@@ -249,12 +777,76 @@ func configUnset(c *cli.Context) {
 	}
 }
 
+// configImport sets an app's config values from a file or stdin.
+func configImport(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+	app := ensureAppParam(c, "config:import")
+
+	in := os.Stdin
+	if file := c.String("file"); file != "" && file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	err := commander.ConfigImport(configStore, app, utils.GalaxyEnv(c), c.String("format"), in)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to import config: %s.", err)
+	}
+}
+
+// configExport writes an app's config values to a file or stdout.
+func configExport(c *cli.Context) {
+	ensureEnvArg(c)
+	initRegistry(c)
+	app := ensureAppParam(c, "config:export")
+
+	out := os.Stdout
+	if file := c.String("file"); file != "" && file != "-" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	err := commander.ConfigExport(configStore, app, utils.GalaxyEnv(c), c.String("format"), out)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to export config: %s.", err)
+	}
+}
+
+// configDiff prints the config differences of an app between two envs,
+// exiting non-zero if there are any.
+func configDiff(c *cli.Context) {
+	initRegistry(c)
+	app := ensureAppParam(c, "config:diff")
+
+	from, to := c.String("from"), c.String("to")
+	if from == "" || to == "" {
+		log.Fatalf("ERROR: --from and --to envs are required.")
+	}
+
+	differ, err := commander.ConfigDiff(configStore, app, from, to, c.String("secrets"))
+	if err != nil {
+		log.Fatalf("ERROR: Unable to diff config: %s.", err)
+	}
+	if differ {
+		os.Exit(1)
+	}
+}
+
 func configGet(c *cli.Context) {
 	ensureEnvArg(c)
 	initRegistry(c)
 	app := ensureAppParam(c, "config:get")
 
-	err := commander.ConfigGet(configStore, app, utils.GalaxyEnv(c), c.Args().Tail())
+	err := commander.ConfigGet(configStore, app, utils.GalaxyEnv(c), c.String("format"), c.Args().Tail())
 
 	if err != nil {
 		log.Fatalf("ERROR: Unable to get config: %s.", err)
@@ -356,7 +948,7 @@ func poolList(c *cli.Context) {
 		}
 	}
 
-	columns := []string{"ENV | POOL | APPS "}
+	columns := [][]string{{"ENV", "POOL", "APPS"}}
 
 	for _, env := range envs {
 		pools, err := configStore.ListPools(env)
@@ -366,10 +958,10 @@ func poolList(c *cli.Context) {
 		}
 
 		if len(pools) == 0 {
-			columns = append(columns, strings.Join([]string{
+			columns = append(columns, []string{
 				env,
 				"",
-				""}, " | "))
+				""})
 			continue
 		}
 
@@ -380,15 +972,17 @@ func poolList(c *cli.Context) {
 				log.Fatalf("ERROR: cannot list pool assignments: %s", err)
 			}
 
-			columns = append(columns, strings.Join([]string{
+			columns = append(columns, []string{
 				env,
 				pool,
-				strings.Join(assigments, ",")}, " | "))
+				strings.Join(assigments, ",")})
 		}
 
 	}
-	output, _ := columnize.SimpleFormat(columns)
-	log.Println(output)
+	err := commander.PrintColumns(columns)
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
 }
 
 func poolDelete(c *cli.Context) {
@@ -527,8 +1121,30 @@ func main() {
 	app.Version = buildVersion
 	app.Flags = []cli.Flag{
 		cli.StringFlag{Name: "registry", Value: "", Usage: "host:port[,host:port,..]"},
+		cli.StringFlag{Name: "registry-mirror", Value: "", Usage: "registry URL to also write to"},
+		cli.StringFlag{Name: "registry-replica", Value: "", Usage: "read-only registry URL for listings"},
 		cli.StringFlag{Name: "env", Value: "", Usage: "environment (dev, test, prod, etc.)"},
 		cli.StringFlag{Name: "pool", Value: "", Usage: "pool (web, worker, etc.)"},
+		cli.StringFlag{Name: "docker-host", Value: "", Usage: "docker daemon address, defaults to DOCKER_HOST"},
+		cli.StringFlag{Name: "docker-cert-path", Value: "", Usage: "directory with cert.pem, key.pem and ca.pem for docker TLS, defaults to DOCKER_CERT_PATH"},
+		cli.BoolFlag{Name: "docker-tls", Usage: "connect to docker with TLS"},
+		cli.BoolFlag{Name: "docker-tls-verify", Usage: "connect to docker with TLS and verify its certificate, defaults to DOCKER_TLS_VERIFY"},
+		cli.StringSliceFlag{Name: "registry-auth", Value: &cli.StringSlice{}, Usage: "docker registry login as <username>:<password>@<registry>", EnvVar: "GALAXY_REGISTRY_AUTH"},
+		cli.StringFlag{Name: "credential-helper", Value: "", Usage: "docker credential helper for registry logins, e.g. ecr-login", EnvVar: "GALAXY_CREDENTIAL_HELPER"},
+		cli.StringFlag{Name: "output", Value: "table", Usage: "format of listings: " + strings.Join(commander.OutputFormats, ", "), EnvVar: "GALAXY_OUTPUT"},
+		cli.StringSliceFlag{Name: "filter", Value: &cli.StringSlice{}, Usage: "only list rows whose column matches a glob, e.g. name=web* or pool=prod-web"},
+		cli.StringFlag{Name: "sort", Value: "", Usage: "sort listings by a column, e.g. mem, name or ps, or -mem for descending"},
+	}
+
+	app.Before = func(c *cli.Context) error {
+		if err := commander.SetOutput(c.GlobalString("output")); err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		if err := commander.SetFilters(c.GlobalStringSlice("filter")); err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		commander.SetSort(c.GlobalString("sort"))
+		return nil
 	}
 
 	app.Commands = []cli.Command{
@@ -549,6 +1165,27 @@ func main() {
 			Action:      appList,
 			Description: "app",
 		},
+		{
+			Name:        "backup",
+			Usage:       "backup all envs, pools, app configs and registrations",
+			Action:      registryBackupCmd,
+			Description: "backup [--env env]",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "file", Usage: "backup filename"},
+			},
+		},
+		{
+			Name:        "restore",
+			Usage:       "restore envs from a backup",
+			Action:      registryRestoreCmd,
+			Description: "restore [--env env] [--as newenv]",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "file", Usage: "backup filename"},
+				cli.StringFlag{Name: "as", Usage: "restore the env under this name"},
+				cli.BoolFlag{Name: "force", Usage: "force overwrite of existing config"},
+				cli.BoolFlag{Name: "registrations", Usage: "also restore service registrations"},
+			},
+		},
 		{
 			Name:        "app:backup",
 			Usage:       "backup app configs to a file or stdout",
@@ -587,19 +1224,82 @@ func main() {
 			Description: "app:deploy <app> <version>",
 			Flags: []cli.Flag{
 				cli.BoolFlag{Name: "force", Usage: "force pulling the image"},
+				cli.BoolFlag{Name: "wait", Usage: "wait for every container to run the new version, exiting non-zero if it doesn't"},
+				cli.DurationFlag{Name: "timeout", Usage: "how long --wait waits", Value: 5 * time.Minute},
 			},
 		},
+		{
+			Name:        "app:rollback",
+			Usage:       "restore an app's image and env to an earlier deploy",
+			Action:      appRollback,
+			Description: "app:rollback [--to <deploy>] <app>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "to", Usage: "deploy ID to roll back to, from history (default the one before the current)"},
+				cli.BoolFlag{Name: "wait", Usage: "wait for every container to run the restored version, exiting non-zero if it doesn't"},
+				cli.DurationFlag{Name: "timeout", Usage: "how long --wait waits", Value: 5 * time.Minute},
+			},
+		},
+		{
+			Name:        "canary:deploy",
+			Usage:       "deploy a new version of an app to one host per pool",
+			Action:      canaryDeploy,
+			Description: "canary:deploy <app> <version>",
+			Flags: []cli.Flag{
+				cli.IntFlag{Name: "percent", Usage: "share of the app's traffic for the canary, 0 to weigh it like the rest", Value: 10},
+			},
+		},
+		{
+			Name:        "bluegreen:deploy",
+			Usage:       "deploy a new version of an app alongside the current one",
+			Action:      blueGreenDeploy,
+			Description: "bluegreen:deploy <app> <version>",
+		},
+		{
+			Name:        "cutover",
+			Usage:       "send an app's traffic to its other blue/green version",
+			Action:      cutover,
+			Description: "cutover <app>",
+		},
+		{
+			Name:        "canary:promote",
+			Usage:       "deploy an app's canary version everywhere",
+			Action:      canaryPromote,
+			Description: "canary:promote <app>",
+		},
+		{
+			Name:        "canary:abort",
+			Usage:       "stop an app's canary",
+			Action:      canaryAbort,
+			Description: "canary:abort <app>",
+		},
 		{
 			Name:        "app:restart",
 			Usage:       "restart an app",
 			Action:      appRestart,
 			Description: "app:restart <app>",
+			Flags: []cli.Flag{
+				cli.IntFlag{Name: "batch", Usage: "restart this many containers at a time across all hosts, 0 for all at once"},
+				cli.DurationFlag{Name: "delay", Usage: "wait after each container restarts before restarting another"},
+			},
 		},
 		{
 			Name:        "app:run",
 			Usage:       "run a command in a container",
 			Action:      appRun,
-			Description: "app:run <app> <command>",
+			Description: "app:run [--exec] <app> <command>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "exec", Usage: "run the command in one of the app's running containers"},
+			},
+		},
+		{
+			Name:        "run",
+			Usage:       "run a one-off command of an app on one of its hosts",
+			Action:      run,
+			Description: "run [--host <ip>] <app> -- <command>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "host", Usage: "host to run on (default the least busy host of the app's pool)"},
+				cli.StringFlag{Name: "docker-port", Usage: "port docker listens on on the hosts (default 2376 with TLS, 2375 without)"},
+			},
 		},
 		{
 			Name:        "app:shell",
@@ -607,17 +1307,189 @@ func main() {
 			Action:      appShell,
 			Description: "app:shell <app>",
 		},
+		{
+			Name:        "history",
+			Usage:       "list recent config changes",
+			Action:      history,
+			Description: "history [app]",
+			Flags: []cli.Flag{
+				cli.IntFlag{Name: "limit", Usage: "number of changes to show", Value: 20},
+			},
+		},
+		{
+			Name:        "audit",
+			Usage:       "list who changed what in an env's config",
+			Action:      audit,
+			Description: "audit",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "actor", Usage: "only changes by this user or host"},
+				cli.StringFlag{Name: "key", Usage: "only changes touching this key, e.g. GALAXY_PORT"},
+				cli.DurationFlag{Name: "since", Usage: "only changes made this long ago or less, e.g. 168h"},
+				cli.IntFlag{Name: "limit", Usage: "number of changes to show, 0 for all", Value: 100},
+			},
+		},
+		{
+			Name:        "status",
+			Usage:       "show the health of every app: desired, registered and healthy containers, version skew and stale registrations",
+			Action:      status,
+			Description: "status",
+		},
+		{
+			Name:        "logs",
+			Usage:       "show the logs of every registered container of an app",
+			Action:      appLogs,
+			Description: "logs [--tail 100] [--follow] <app>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "tail", Usage: "number of lines to show from the end of each container's logs, or all", Value: "all"},
+				cli.BoolFlag{Name: "follow", Usage: "keep streaming new lines"},
+				cli.StringFlag{Name: "docker-port", Usage: "port docker listens on on the hosts (default 2376 with TLS, 2375 without)"},
+			},
+		},
+		{
+			Name:        "ps",
+			Usage:       "list desired and running containers per app and pool, and each registered container",
+			Action:      processes,
+			Description: "ps [app]",
+		},
+		{
+			Name:        "dns",
+			Usage:       "serve DNS records for registered apps",
+			Action:      dnsServe,
+			Description: "dns",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "addr", Usage: "UDP and TCP address to listen on", Value: ":53"},
+				cli.StringFlag{Name: "domain", Usage: "domain to serve names under", Value: discovery.DefaultDNSDomain},
+				cli.DurationFlag{Name: "ttl", Usage: "how long to cache registrations", Value: discovery.DefaultDNSCacheTTL},
+			},
+		},
+		{
+			Name:        "api",
+			Usage:       "serve registrations over HTTP",
+			Action:      apiServe,
+			Description: "api",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "addr", Usage: "address to listen on", Value: ":8000"},
+			},
+		},
+		{
+			Name:        "registry:gc",
+			Usage:       "find and delete orphaned registry keys",
+			Action:      registryGC,
+			Description: "registry:gc",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "force", Usage: "delete the orphaned keys"},
+			},
+		},
+		{
+			Name:        "gc",
+			Usage:       "find and remove exited containers and unused images from docker",
+			Action:      hostGC,
+			Description: "gc",
+			Flags: []cli.Flag{
+				cli.DurationFlag{Name: "age", Usage: "how long containers have to have exited", Value: 24 * time.Hour},
+				cli.BoolFlag{Name: "force", Usage: "remove the containers and images"},
+			},
+		},
+		{
+			Name:        "sidecar",
+			Usage:       "list the containers started alongside an app's containers",
+			Action:      sidecarList,
+			Description: "sidecar <app>",
+		},
+		{
+			Name:        "sidecar:set",
+			Usage:       "add or update a container started alongside each of an app's containers",
+			Action:      sidecarSet,
+			Description: "sidecar:set [--memory 64m] [--cpu 128] [--env K=V ...] <app> <name> <image> [<cmd> ...]",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "memory, m", Usage: "memory limit, taken out of the app's limit"},
+				cli.StringFlag{Name: "cpu, c", Usage: "CPU shares, taken out of the app's shares"},
+				cli.StringSliceFlag{Name: "env, e", Value: &cli.StringSlice{}, Usage: "env var for the sidecar as KEY=VALUE"},
+			},
+		},
+		{
+			Name:        "sidecar:unset",
+			Usage:       "remove a sidecar from an app",
+			Action:      sidecarUnset,
+			Description: "sidecar:unset <app> <name>",
+		},
+		{
+			Name:        "jobs",
+			Usage:       "list scheduled jobs and their last runs",
+			Action:      jobsList,
+			Description: "jobs [app]",
+		},
+		{
+			Name:        "job:set",
+			Usage:       "run a command in a new container of an app on a cron schedule",
+			Action:      jobSet,
+			Description: "job:set <app> <name> <schedule> <command>",
+		},
+		{
+			Name:        "job:unset",
+			Usage:       "remove a scheduled job",
+			Action:      jobUnset,
+			Description: "job:unset <app> <name>",
+		},
+		{
+			Name:        "policy",
+			Usage:       "show the images an env's hosts will run",
+			Action:      policyShow,
+			Description: "policy",
+		},
+		{
+			Name:        "policy:set",
+			Usage:       "restrict the images and privileged apps an env's hosts will run",
+			Action:      policySet,
+			Description: "policy:set [--registry <registry> ...] [--verify cosign|notary --key <key>] [--privileged <app> ...]",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{Name: "registry", Value: &cli.StringSlice{}, Usage: "only run images from this registry, docker.io for Docker Hub"},
+				cli.StringFlag{Name: "verify", Usage: "verify image signatures with cosign or notary"},
+				cli.StringFlag{Name: "key", Usage: "the cosign public key or notary server"},
+				cli.StringSliceFlag{Name: "privileged", Value: &cli.StringSlice{}, Usage: "let this app run privileged containers"},
+			},
+		},
+		{
+			Name:        "policy:clear",
+			Usage:       "let an env's hosts run any image and no privileged apps",
+			Action:      policyClear,
+			Description: "policy:clear",
+		},
+		{
+			Name:        "external:register",
+			Usage:       "register a service that galaxy doesn't run",
+			Action:      externalRegister,
+			Description: "external:register <name> <host:port>",
+		},
+		{
+			Name:        "external:unregister",
+			Usage:       "unregister an external service",
+			Action:      externalUnregister,
+			Description: "external:unregister <name> <host:port>",
+		},
+		{
+			Name:        "drain",
+			Usage:       "stop sending new traffic to an app's containers on a host",
+			Action:      drain,
+			Description: "drain <app> <host ip>",
+			Flags: []cli.Flag{
+				cli.DurationFlag{Name: "grace", Usage: "time for existing connections to finish", Value: 30 * time.Second},
+			},
+		},
 		{
 			Name:        "config",
 			Usage:       "list the config values for an app",
 			Action:      configList,
-			Description: "config <app>",
+			Description: "config [--format text|json|dotenv|yaml] <app>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "format", Value: "text", Usage: "output format: " + strings.Join(commander.ConfigFormats, ", ")},
+			},
 		},
 		{
 			Name:        "config:set",
 			Usage:       "set one or more configuration variables",
 			Action:      configSet,
-			Description: "config:set <app> KEY=VALUE [KEY=VALUE ...]",
+			Description: "config:set <app> KEY=VALUE [KEY=VALUE ...], a .env file on stdin, or KEY=- to read KEY from stdin",
 		},
 		{
 			Name:        "config:unset",
@@ -629,7 +1501,41 @@ func main() {
 			Name:        "config:get",
 			Usage:       "display the config value for an app",
 			Action:      configGet,
-			Description: "config:get <app> KEY [KEY ...]",
+			Description: "config:get [--format text|json|dotenv|yaml] <app> KEY [KEY ...]",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "format", Value: "text", Usage: "output format: " + strings.Join(commander.ConfigFormats, ", ")},
+			},
+		},
+		{
+			Name:        "config:import",
+			Usage:       "set an app's config values from a file in one update",
+			Action:      configImport,
+			Description: "config:import [--format dotenv|yaml|json] [--file <file>] <app>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "format", Value: "dotenv", Usage: "input format: " + strings.Join(commander.ImportFormats, ", ")},
+				cli.StringFlag{Name: "file, f", Usage: "file to read (default stdin)"},
+			},
+		},
+		{
+			Name:        "config:export",
+			Usage:       "write an app's config values to a file",
+			Action:      configExport,
+			Description: "config:export [-o dotenv|yaml|json] [--file <file>] <app>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "format, o", Value: "dotenv", Usage: "output format: " + strings.Join(commander.ImportFormats, ", ")},
+				cli.StringFlag{Name: "file, f", Usage: "file to write (default stdout)"},
+			},
+		},
+		{
+			Name:        "config:diff",
+			Usage:       "show the config differences of an app between two envs",
+			Action:      configDiff,
+			Description: "config:diff --from <env> --to <env> <app>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "from", Usage: "env to compare from, e.g. staging"},
+				cli.StringFlag{Name: "to", Usage: "env to compare to, e.g. prod"},
+				cli.StringFlag{Name: "secrets", Value: commander.DefaultSecretPattern, Usage: "regexp of the keys whose values aren't shown"},
+			},
 		},
 		{
 			Name:        "pool",
@@ -1,5 +1,15 @@
 package registry
 
+import (
+	"errors"
+
+	"github.com/litl/galaxy/utils"
+)
+
+// ErrConflict is returned when a registration was changed by someone else
+// between reading and writing it.  The caller can retry.
+var ErrConflict = errors.New("registration was changed concurrently")
+
 type RegistryBackend interface {
 
 	// Keys
@@ -14,4 +24,24 @@ type RegistryBackend interface {
 	// Maps
 	Set(key, field string, value string) (string, error)
 	Get(key, field string) (string, error)
+	// GetMulti returns field from each of keys, in order, in as few round
+	// trips as the backend allows.  Missing values are "".
+	GetMulti(keys []string, field string) ([]string, error)
+
+	// CompareAndSet atomically sets field to value and key's ttl only if
+	// field currently holds old.  A missing field holds "".  A ttl of 0
+	// removes any expiration so the key persists until deleted.
+	CompareAndSet(key, field, old, value string, ttl uint64) (bool, error)
+
+	// Watch sends an event for every key matching pattern, a glob like
+	// Keys takes, that's set, deleted or expires after the watch starts,
+	// until stop is closed.  The channel is closed once the watch stops.
+	// Backends without change notifications emulate it by polling.
+	Watch(pattern string, stop chan struct{}) (chan KeyEvent, error)
+}
+
+// statusReporter is implemented by backends that track their connection
+// health.
+type statusReporter interface {
+	Status() utils.BackendStatus
 }
@@ -0,0 +1,84 @@
+package registry
+
+import (
+	"encoding/json"
+	"path"
+	"time"
+)
+
+// RegistrationDraining is the State of a registration that is being taken
+// out of service.  Proxies stop sending it new traffic while its existing
+// connections finish, and once its grace period is over it's no longer
+// listed.
+const RegistrationDraining = "draining"
+
+// IsDraining returns true if the registration was drained.
+func (s *ServiceRegistration) IsDraining() bool {
+	return s.State == RegistrationDraining
+}
+
+// IsDrained returns true if the registration's drain grace period is over.
+func (s *ServiceRegistration) IsDrained() bool {
+	return s.IsDraining() && s.DrainUntil != nil && !time.Now().Before(*s.DrainUntil)
+}
+
+// Drain marks app's registrations on hostIP as draining for grace and
+// returns them.  The agent keeps refreshing drained registrations, so they
+// stay out of service until their containers stop.
+func (r *ServiceRegistry) Drain(env, app, hostIP string, grace time.Duration) ([]*ServiceRegistration, error) {
+	keys, err := r.backend.Keys(path.Join(env, "*", "hosts", hostIP, app, "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	until := time.Now().UTC().Add(grace)
+	drained := []*ServiceRegistration{}
+	for _, key := range keys {
+		existing, err := r.backend.Get(key, "location")
+		if err != nil {
+			return drained, err
+		}
+		if existing == "" {
+			// expired since it was listed
+			continue
+		}
+
+		reg := &ServiceRegistration{}
+		err = json.Unmarshal([]byte(existing), reg)
+		if err != nil {
+			return drained, err
+		}
+		reg.Path = key
+		if reg.IsDraining() {
+			drained = append(drained, reg)
+			continue
+		}
+
+		reg.State = RegistrationDraining
+		reg.DrainUntil = &until
+
+		jsonReg, err := json.Marshal(reg)
+		if err != nil {
+			return drained, err
+		}
+
+		// keep the TTL the agent set, or none for static registrations
+		ttl, err := r.backend.Ttl(key)
+		if err != nil {
+			return drained, err
+		}
+		if ttl < 0 {
+			ttl = 0
+		}
+
+		saved, err := r.backend.CompareAndSet(key, "location", existing, string(jsonReg), uint64(ttl))
+		if err != nil {
+			return drained, err
+		}
+		if !saved {
+			return drained, ErrConflict
+		}
+		drained = append(drained, reg)
+	}
+	return drained, nil
+}
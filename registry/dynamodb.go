@@ -0,0 +1,384 @@
+package registry
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/utils"
+)
+
+const (
+	// dynamoBatchSize is the most keys BatchGetItem accepts per request
+	dynamoBatchSize = 100
+	// dynamoExpires is the table's TTL attribute.  DynamoDB deletes expired
+	// items lazily, so reads also check it.
+	dynamoExpires = "expires"
+)
+
+// DynamoDBBackend stores each registry key as an item whose fields are
+// "f_"-prefixed string attributes.  Writes made with CompareAndSet are
+// conditional so only one host at a time can claim a registration.
+type DynamoDBBackend struct {
+	URL   string
+	db    *utils.DynamoDB
+	table string
+}
+
+func (d *DynamoDBBackend) Connect() {
+	db, table, err := utils.NewDynamoDB(d.URL)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to connect to dynamodb: %s", err)
+	}
+	d.db = db
+	d.table = table
+
+	err = d.createTable()
+	if err != nil {
+		log.Fatalf("ERROR: Unable to create dynamodb table %s: %s", table, err)
+	}
+}
+
+func (d *DynamoDBBackend) Reconnect() {
+	d.Connect()
+}
+
+// createTable creates the table and enables TTL on it if it doesn't exist.
+func (d *DynamoDBBackend) createTable() error {
+	var desc struct {
+		Table struct {
+			TableStatus string
+		}
+	}
+
+	err := d.db.Do("DescribeTable", map[string]interface{}{"TableName": d.table}, &desc)
+	if err == nil {
+		return nil
+	}
+	if !utils.IsDynamoDBError(err, "ResourceNotFoundException") {
+		return err
+	}
+
+	err = d.db.Do("CreateTable", map[string]interface{}{
+		"TableName": d.table,
+		"AttributeDefinitions": []map[string]string{
+			{"AttributeName": "key", "AttributeType": "S"},
+		},
+		"KeySchema": []map[string]string{
+			{"AttributeName": "key", "KeyType": "HASH"},
+		},
+		"BillingMode": "PAY_PER_REQUEST",
+	}, nil)
+	if err != nil && !utils.IsDynamoDBError(err, "ResourceInUseException") {
+		return err
+	}
+
+	for i := 0; desc.Table.TableStatus != "ACTIVE"; i++ {
+		if i == 60 {
+			return fmt.Errorf("table %s is still %s", d.table, desc.Table.TableStatus)
+		}
+		time.Sleep(time.Second)
+		err = d.db.Do("DescribeTable", map[string]interface{}{"TableName": d.table}, &desc)
+		if err != nil {
+			return err
+		}
+	}
+
+	return d.db.Do("UpdateTimeToLive", map[string]interface{}{
+		"TableName": d.table,
+		"TimeToLiveSpecification": map[string]interface{}{
+			"AttributeName": dynamoExpires,
+			"Enabled":       true,
+		},
+	}, nil)
+}
+
+func dynamoKey(key string) utils.DynamoItem {
+	return utils.DynamoItem{"key": utils.DynamoS(key)}
+}
+
+// dynamoLive returns false for items that have expired but haven't yet
+// been deleted by DynamoDB.
+func dynamoLive(item utils.DynamoItem) bool {
+	if len(item) == 0 {
+		return false
+	}
+
+	expires, ok := item[dynamoExpires]
+	if !ok {
+		return true
+	}
+	n, _ := strconv.ParseInt(expires["N"], 10, 64)
+	return n > time.Now().Unix()
+}
+
+func (d *DynamoDBBackend) getItem(key string) (utils.DynamoItem, error) {
+	var resp struct {
+		Item utils.DynamoItem
+	}
+
+	err := d.db.Do("GetItem", map[string]interface{}{
+		"TableName":      d.table,
+		"Key":            dynamoKey(key),
+		"ConsistentRead": true,
+	}, &resp)
+	if err != nil || !dynamoLive(resp.Item) {
+		return nil, err
+	}
+	return resp.Item, nil
+}
+
+func (d *DynamoDBBackend) Keys(key string) ([]string, error) {
+	re, err := utils.GlobToRegexp(key)
+	if err != nil {
+		return nil, err
+	}
+
+	req := map[string]interface{}{
+		"TableName":                d.table,
+		"ProjectionExpression":     "#k, #e",
+		"ExpressionAttributeNames": map[string]string{"#k": "key", "#e": dynamoExpires},
+		"ConsistentRead":           true,
+	}
+
+	// narrow the scan to the literal prefix of the pattern
+	if prefix := key[:strings.IndexAny(key+"*", "*?[")]; prefix != "" {
+		req["FilterExpression"] = "begins_with(#k, :prefix)"
+		req["ExpressionAttributeValues"] = utils.DynamoItem{":prefix": utils.DynamoS(prefix)}
+	}
+
+	keys := []string{}
+	for {
+		var resp struct {
+			Items            []utils.DynamoItem
+			LastEvaluatedKey utils.DynamoItem
+		}
+
+		err := d.db.Do("Scan", req, &resp)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range resp.Items {
+			k := item["key"]["S"]
+			if dynamoLive(item) && re.MatchString(k) {
+				keys = append(keys, k)
+			}
+		}
+
+		if len(resp.LastEvaluatedKey) == 0 {
+			return keys, nil
+		}
+		req["ExclusiveStartKey"] = resp.LastEvaluatedKey
+	}
+}
+
+func (d *DynamoDBBackend) Delete(key string) (int, error) {
+	var resp struct {
+		Attributes utils.DynamoItem
+	}
+
+	err := d.db.Do("DeleteItem", map[string]interface{}{
+		"TableName":    d.table,
+		"Key":          dynamoKey(key),
+		"ReturnValues": "ALL_OLD",
+	}, &resp)
+	if err != nil || !dynamoLive(resp.Attributes) {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func (d *DynamoDBBackend) Expire(key string, ttl uint64) (int, error) {
+	now := time.Now().Unix()
+	err := d.db.Do("UpdateItem", map[string]interface{}{
+		"TableName":                d.table,
+		"Key":                      dynamoKey(key),
+		"UpdateExpression":         "SET #e = :expires",
+		"ConditionExpression":      "attribute_exists(#k) AND (attribute_not_exists(#e) OR #e > :now)",
+		"ExpressionAttributeNames": map[string]string{"#k": "key", "#e": dynamoExpires},
+		"ExpressionAttributeValues": utils.DynamoItem{
+			":expires": utils.DynamoN(now + int64(ttl)),
+			":now":     utils.DynamoN(now),
+		},
+	}, nil)
+	if utils.IsDynamoDBError(err, "ConditionalCheckFailedException") {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func (d *DynamoDBBackend) Ttl(key string) (int, error) {
+	item, err := d.getItem(key)
+	if err != nil {
+		return 0, err
+	}
+
+	// match redis: -1 for no expiration, -2 for a missing key
+	if item == nil {
+		return -2, nil
+	}
+	expires, ok := item[dynamoExpires]
+	if !ok {
+		return -1, nil
+	}
+	n, _ := strconv.ParseInt(expires["N"], 10, 64)
+	return int(n - time.Now().Unix()), nil
+}
+
+// Set writes field of key.  An item that has expired but hasn't been
+// deleted yet is replaced, as if it were missing, so it doesn't come back
+// with its old fields and expiration.
+func (d *DynamoDBBackend) Set(key, field string, value string) (string, error) {
+	for {
+		now := time.Now().Unix()
+		err := d.db.Do("UpdateItem", map[string]interface{}{
+			"TableName":                d.table,
+			"Key":                      dynamoKey(key),
+			"UpdateExpression":         "SET #f = :value",
+			"ConditionExpression":      "attribute_not_exists(#e) OR #e > :now",
+			"ExpressionAttributeNames": map[string]string{"#f": "f_" + field, "#e": dynamoExpires},
+			"ExpressionAttributeValues": utils.DynamoItem{
+				":value": utils.DynamoS(value),
+				":now":   utils.DynamoN(now),
+			},
+		}, nil)
+		if err == nil {
+			return "OK", nil
+		}
+		if !utils.IsDynamoDBError(err, "ConditionalCheckFailedException") {
+			return "", err
+		}
+
+		item := dynamoKey(key)
+		item["f_"+field] = utils.DynamoS(value)
+		err = d.db.Do("PutItem", map[string]interface{}{
+			"TableName":                 d.table,
+			"Item":                      item,
+			"ConditionExpression":       "#e <= :now",
+			"ExpressionAttributeNames":  map[string]string{"#e": dynamoExpires},
+			"ExpressionAttributeValues": utils.DynamoItem{":now": utils.DynamoN(now)},
+		}, nil)
+		if err == nil {
+			return "OK", nil
+		}
+		if !utils.IsDynamoDBError(err, "ConditionalCheckFailedException") {
+			return "", err
+		}
+		// another write replaced it first, so update that one
+	}
+}
+
+func (d *DynamoDBBackend) Get(key, field string) (string, error) {
+	item, err := d.getItem(key)
+	if err != nil || item == nil {
+		return "", err
+	}
+	return item["f_"+field]["S"], nil
+}
+
+func (d *DynamoDBBackend) GetMulti(keys []string, field string) ([]string, error) {
+	values := make([]string, len(keys))
+
+	index := make(map[string][]int)
+	unique := []string{}
+	for i, key := range keys {
+		if _, ok := index[key]; !ok {
+			unique = append(unique, key)
+		}
+		index[key] = append(index[key], i)
+	}
+
+	for start := 0; start < len(unique); start += dynamoBatchSize {
+		end := start + dynamoBatchSize
+		if end > len(unique) {
+			end = len(unique)
+		}
+
+		batch := []utils.DynamoItem{}
+		for _, key := range unique[start:end] {
+			batch = append(batch, dynamoKey(key))
+		}
+
+		requestItems := map[string]interface{}{
+			d.table: map[string]interface{}{
+				"Keys":                     batch,
+				"ProjectionExpression":     "#k, #e, #f",
+				"ExpressionAttributeNames": map[string]string{"#k": "key", "#e": dynamoExpires, "#f": "f_" + field},
+				"ConsistentRead":           true,
+			},
+		}
+
+		for retry := 0; len(requestItems) > 0; retry++ {
+			if retry > 0 {
+				time.Sleep(time.Duration(retry*50) * time.Millisecond)
+			}
+
+			var resp struct {
+				Responses       map[string][]utils.DynamoItem
+				UnprocessedKeys map[string]interface{}
+			}
+
+			err := d.db.Do("BatchGetItem", map[string]interface{}{"RequestItems": requestItems}, &resp)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, item := range resp.Responses[d.table] {
+				if !dynamoLive(item) {
+					continue
+				}
+				for _, i := range index[item["key"]["S"]] {
+					values[i] = item["f_"+field]["S"]
+				}
+			}
+			requestItems = resp.UnprocessedKeys
+		}
+	}
+	return values, nil
+}
+
+func (d *DynamoDBBackend) CompareAndSet(key, field, old, value string, ttl uint64) (bool, error) {
+	now := time.Now().Unix()
+	values := utils.DynamoItem{
+		":value":   utils.DynamoS(value),
+		":expires": utils.DynamoN(now + int64(ttl)),
+		":now":     utils.DynamoN(now),
+	}
+
+	// an expired item counts as missing, like it would in redis
+	condition := "attribute_not_exists(#f) OR #e <= :now"
+	if old != "" {
+		condition = "#f = :old AND (attribute_not_exists(#e) OR #e > :now)"
+		values[":old"] = utils.DynamoS(old)
+	}
+
+	// a ttl of 0 persists the key
+	update := "SET #f = :value, #e = :expires"
+	if ttl == 0 {
+		update = "SET #f = :value REMOVE #e"
+		delete(values, ":expires")
+	}
+
+	err := d.db.Do("UpdateItem", map[string]interface{}{
+		"TableName":                 d.table,
+		"Key":                       dynamoKey(key),
+		"UpdateExpression":          update,
+		"ConditionExpression":       condition,
+		"ExpressionAttributeNames":  map[string]string{"#f": "f_" + field, "#e": dynamoExpires},
+		"ExpressionAttributeValues": values,
+	}, nil)
+	if utils.IsDynamoDBError(err, "ConditionalCheckFailedException") {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d *DynamoDBBackend) Watch(pattern string, stop chan struct{}) (chan KeyEvent, error) {
+	return pollWatch(d, pattern, stop), nil
+}
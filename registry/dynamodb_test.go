@@ -0,0 +1,309 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goamz/goamz/aws"
+	"github.com/litl/galaxy/utils"
+)
+
+// testDynamoDB serves the DynamoDB actions the backend uses from a map.  It
+// understands just enough of the expression syntax for the backend's
+// requests.
+type testDynamoDB struct {
+	mu    sync.Mutex
+	items map[string]utils.DynamoItem
+}
+
+type testDynamoRequest struct {
+	Key                       utils.DynamoItem
+	Item                      utils.DynamoItem
+	UpdateExpression          string
+	ConditionExpression       string
+	ExpressionAttributeNames  map[string]string
+	ExpressionAttributeValues utils.DynamoItem
+	RequestItems              map[string]struct {
+		Keys []utils.DynamoItem
+	}
+}
+
+func (d *testDynamoDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var req testDynamoRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key := req.Key["key"]["S"]
+	if req.Item != nil {
+		key = req.Item["key"]["S"]
+	}
+	item := d.items[key]
+
+	if req.ConditionExpression != "" && !req.eval(req.ConditionExpression, item) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException"}`))
+		return
+	}
+
+	var resp interface{}
+	switch action := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810."); action {
+	case "GetItem":
+		resp = map[string]interface{}{"Item": item}
+	case "PutItem":
+		d.items[key] = req.Item
+	case "UpdateItem":
+		if item == nil {
+			item = utils.DynamoItem{"key": utils.DynamoS(key)}
+		}
+		req.update(item)
+		d.items[key] = item
+	case "DeleteItem":
+		delete(d.items, key)
+		resp = map[string]interface{}{"Attributes": item}
+	case "Scan":
+		items := []utils.DynamoItem{}
+		for _, item := range d.items {
+			items = append(items, item)
+		}
+		resp = map[string]interface{}{"Items": items}
+	case "BatchGetItem":
+		responses := map[string][]utils.DynamoItem{}
+		for table, batch := range req.RequestItems {
+			for _, k := range batch.Keys {
+				if item, ok := d.items[k["key"]["S"]]; ok {
+					responses[table] = append(responses[table], item)
+				}
+			}
+		}
+		resp = map[string]interface{}{"Responses": responses}
+	default:
+		http.Error(w, "unknown action "+action, http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (req *testDynamoRequest) name(s string) string {
+	if n, ok := req.ExpressionAttributeNames[s]; ok {
+		return n
+	}
+	return s
+}
+
+// update applies "SET a = :x, b = :y REMOVE c" to item.
+func (req *testDynamoRequest) update(item utils.DynamoItem) {
+	expr := req.UpdateExpression
+	remove := ""
+	if i := strings.Index(expr, " REMOVE "); i >= 0 {
+		expr, remove = expr[:i], expr[i+len(" REMOVE "):]
+	}
+	for _, assign := range strings.Split(strings.TrimPrefix(expr, "SET "), ",") {
+		parts := strings.Split(assign, "=")
+		item[req.name(strings.TrimSpace(parts[0]))] = req.ExpressionAttributeValues[strings.TrimSpace(parts[1])]
+	}
+	if remove != "" {
+		delete(item, req.name(strings.TrimSpace(remove)))
+	}
+}
+
+// eval evaluates a condition made of attribute_exists, attribute_not_exists
+// and comparisons joined by AND, OR and parentheses.
+func (req *testDynamoRequest) eval(expr string, item utils.DynamoItem) bool {
+	expr = strings.TrimSpace(expr)
+	for _, op := range []string{" OR ", " AND "} {
+		depth := 0
+		for i := 0; i < len(expr); i++ {
+			switch expr[i] {
+			case '(':
+				depth++
+			case ')':
+				depth--
+			}
+			if depth == 0 && strings.HasPrefix(expr[i:], op) {
+				left, right := req.eval(expr[:i], item), req.eval(expr[i+len(op):], item)
+				if op == " OR " {
+					return left || right
+				}
+				return left && right
+			}
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(expr, "attribute_exists("):
+		_, ok := item[req.name(expr[len("attribute_exists("):len(expr)-1])]
+		return ok
+	case strings.HasPrefix(expr, "attribute_not_exists("):
+		_, ok := item[req.name(expr[len("attribute_not_exists("):len(expr)-1])]
+		return !ok
+	case strings.HasPrefix(expr, "("):
+		return req.eval(expr[1:len(expr)-1], item)
+	}
+
+	parts := strings.Fields(expr)
+	attr, ok := item[req.name(parts[0])]
+	if !ok {
+		return false
+	}
+	value := req.ExpressionAttributeValues[parts[2]]
+	if value["S"] != "" || attr["S"] != "" {
+		return parts[1] == "=" && attr["S"] == value["S"]
+	}
+	a, _ := strconv.ParseInt(attr["N"], 10, 64)
+	b, _ := strconv.ParseInt(value["N"], 10, 64)
+	switch parts[1] {
+	case "=":
+		return a == b
+	case ">":
+		return a > b
+	case "<=":
+		return a <= b
+	}
+	panic("unsupported comparison " + expr)
+}
+
+func newTestDynamoDBBackend(t *testing.T) (*DynamoDBBackend, *testDynamoDB, func()) {
+	fake := &testDynamoDB{items: make(map[string]utils.DynamoItem)}
+	server := httptest.NewServer(fake)
+
+	d := &DynamoDBBackend{
+		db: &utils.DynamoDB{
+			Endpoint: server.URL,
+			Region:   aws.USEast,
+			Auth:     aws.Auth{AccessKey: "access", SecretKey: "secret"},
+			Client:   http.DefaultClient,
+		},
+		table: "galaxy",
+	}
+	return d, fake, server.Close
+}
+
+// expiredItem returns an item that expired but hasn't been deleted yet.
+func expiredItem(key string, fields ...string) utils.DynamoItem {
+	item := utils.DynamoItem{
+		"key":         utils.DynamoS(key),
+		dynamoExpires: utils.DynamoN(time.Now().Unix() - 10),
+	}
+	for i := 0; i < len(fields); i += 2 {
+		item["f_"+fields[i]] = utils.DynamoS(fields[i+1])
+	}
+	return item
+}
+
+func TestDynamoDBSetExpire(t *testing.T) {
+	d, fake, cleanup := newTestDynamoDBBackend(t)
+	defer cleanup()
+
+	key := "dev/web/hosts/10.0.0.1/web/aaaaaaaaaaaa"
+	fake.items[key] = expiredItem(key, "location", "old", "other", "stale")
+
+	// a registration refreshed after it expired
+	if _, err := d.Set(key, "location", "new"); err != nil {
+		t.Fatal(err)
+	}
+	n, err := d.Expire(key, 60)
+	if err != nil || n != 1 {
+		t.Fatalf("expected the expiration to be set. Got %d, %v", n, err)
+	}
+
+	ttl, err := d.Ttl(key)
+	if err != nil || ttl < 58 || ttl > 60 {
+		t.Fatalf("expected a ttl of 60. Got %d, %v", ttl, err)
+	}
+	for field, expected := range map[string]string{"location": "new", "other": ""} {
+		value, err := d.Get(key, field)
+		if err != nil || value != expected {
+			t.Fatalf("expected %s to be %q. Got %q, %v", field, expected, value, err)
+		}
+	}
+
+	// setting another field keeps the expiration
+	if _, err := d.Set(key, "other", "fresh"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, _ := d.Ttl(key); ttl < 58 {
+		t.Fatalf("expected the ttl to be kept. Got %d", ttl)
+	}
+}
+
+func TestDynamoDBExpired(t *testing.T) {
+	d, fake, cleanup := newTestDynamoDBBackend(t)
+	defer cleanup()
+
+	fake.items["dev/a"] = expiredItem("dev/a", "owner", "x")
+	if _, err := d.Set("dev/b", "owner", "y"); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := d.Get("dev/a", "owner"); value != "" {
+		t.Fatalf("expected an expired key to read as missing. Got %q", value)
+	}
+	if ttl, _ := d.Ttl("dev/a"); ttl != -2 {
+		t.Fatalf("expected -2 for an expired key. Got %d", ttl)
+	}
+	if ttl, _ := d.Ttl("dev/b"); ttl != -1 {
+		t.Fatalf("expected -1 for a key without an expiration. Got %d", ttl)
+	}
+	if n, _ := d.Expire("dev/a", 60); n != 0 {
+		t.Fatalf("expected an expired key not to be given a new expiration. Got %d", n)
+	}
+
+	keys, err := d.Keys("dev/*")
+	if err != nil || fmt.Sprint(keys) != "[dev/b]" {
+		t.Fatalf("expected only dev/b. Got %v, %v", keys, err)
+	}
+	values, err := d.GetMulti([]string{"dev/a", "dev/b", "dev/a"}, "owner")
+	if err != nil || fmt.Sprint(values) != "[ y ]" {
+		t.Fatalf("expected only dev/b's value. Got %q, %v", values, err)
+	}
+	if n, _ := d.Delete("dev/a"); n != 0 {
+		t.Fatalf("expected deleting an expired key to delete nothing. Got %d", n)
+	}
+}
+
+func TestDynamoDBCompareAndSet(t *testing.T) {
+	d, fake, cleanup := newTestDynamoDBBackend(t)
+	defer cleanup()
+
+	fake.items["dev/ports/20001"] = expiredItem("dev/ports/20001", "owner", "gone/80/tcp/0")
+
+	for _, test := range []struct {
+		key, old, value string
+		ttl             uint64
+		claimed         bool
+	}{
+		{"dev/ports/20000", "", "web/80/tcp/0", 0, true},
+		{"dev/ports/20000", "", "api/80/tcp/0", 0, false},
+		{"dev/ports/20000", "api/80/tcp/0", "api/80/tcp/0", 0, false},
+		{"dev/ports/20000", "web/80/tcp/0", "web/80/tcp/1", 60, true},
+		// an expired key can be claimed as if it were missing
+		{"dev/ports/20001", "", "api/80/tcp/0", 0, true},
+	} {
+		claimed, err := d.CompareAndSet(test.key, "owner", test.old, test.value, test.ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed != test.claimed {
+			t.Fatalf("expected %s %q -> %q claimed %t. Got %t", test.key, test.old, test.value, test.claimed, claimed)
+		}
+	}
+
+	if ttl, _ := d.Ttl("dev/ports/20000"); ttl < 58 {
+		t.Fatalf("expected the ttl to be set. Got %d", ttl)
+	}
+	if ttl, _ := d.Ttl("dev/ports/20001"); ttl != -1 {
+		t.Fatalf("expected a ttl of 0 to persist the key. Got %d", ttl)
+	}
+}
@@ -0,0 +1,68 @@
+package registry
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"path"
+	"time"
+)
+
+// externalContainerName is the ContainerName of external registrations.
+const externalContainerName = "external"
+
+// externalID stands in for the container ID that registrations are keyed
+// by, since external services don't have one.
+func externalID(name, addr string) string {
+	sum := sha1.Sum([]byte(name + "/" + addr))
+	return hex.EncodeToString(sum[:])
+}
+
+// RegisterExternal registers a service that galaxy doesn't run, e.g. a
+// database or a legacy host, as name at addr ("host:port").  It's saved
+// like a static registration under the host in addr and stays until
+// UnRegisterExternal removes it.
+func (r *ServiceRegistry) RegisterExternal(env, pool, name, addr string) (*ServiceRegistration, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("invalid address %s: host and port are required", addr)
+	}
+
+	id := externalID(name, addr)
+	reg := &ServiceRegistration{
+		Name:          name,
+		ExternalIP:    host,
+		ExternalPort:  port,
+		InternalIP:    host,
+		InternalPort:  port,
+		Protocol:      "tcp",
+		ContainerID:   id,
+		ContainerName: externalContainerName,
+		StartedAt:     time.Now().UTC(),
+		Path:          path.Join(env, pool, "hosts", host, name, id[0:12]),
+		Static:        true,
+		External:      true,
+	}
+
+	err = r.saveRegistration(reg.Path, reg)
+	if err != nil {
+		return nil, err
+	}
+	return reg, nil
+}
+
+// UnRegisterExternal removes a registration made by RegisterExternal.  It
+// returns false if there was none.
+func (r *ServiceRegistry) UnRegisterExternal(env, pool, name, addr string) (bool, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := r.backend.Delete(path.Join(env, pool, "hosts", host, name, externalID(name, addr)[0:12]))
+	return deleted > 0, err
+}
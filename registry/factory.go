@@ -0,0 +1,102 @@
+package registry
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/utils"
+)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]func(url.URL) RegistryBackend)
+)
+
+// RegisterBackend makes a backend available to Connect for registry URLs
+// with the given scheme.  It is meant to be called from an init function
+// and replaces any backend already registered for scheme.
+func RegisterBackend(scheme string, factory func(url.URL) RegistryBackend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends[strings.ToLower(scheme)] = factory
+}
+
+func lookupBackend(scheme string) (func(url.URL) RegistryBackend, bool) {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	factory, ok := backends[strings.ToLower(scheme)]
+	return factory, ok
+}
+
+func newRedisBackend(u url.URL) RegistryBackend {
+	opts, err := utils.ParseRedisOptions(&u)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to parse %s", err)
+	}
+	return &RedisBackend{
+		RedisHost:   u.Host,
+		Options:     opts,
+		ScanCount:   opts.ScanCount,
+		Namespace:   opts.Namespace,
+		PoolOptions: opts.Pool,
+	}
+}
+
+func newSentinelBackend(u url.URL) RegistryBackend {
+	sentinel, err := utils.NewRedisSentinel(u.String())
+	if err != nil {
+		log.Fatalf("ERROR: Unable to parse %s", err)
+	}
+	return &RedisBackend{
+		Sentinel:    sentinel,
+		ScanCount:   sentinel.Options.ScanCount,
+		Namespace:   sentinel.Options.Namespace,
+		PoolOptions: sentinel.Options.Pool,
+	}
+}
+
+func newClusterBackend(u url.URL) RegistryBackend {
+	cluster, err := utils.NewRedisCluster(u.String())
+	if err != nil {
+		log.Fatalf("ERROR: Unable to parse %s", err)
+	}
+	return &RedisBackend{
+		Cluster:     cluster,
+		ScanCount:   cluster.Options.ScanCount,
+		Namespace:   cluster.Options.Namespace,
+		PoolOptions: cluster.Options.Pool,
+	}
+}
+
+func newFileBackend(u url.URL) RegistryBackend {
+	return &FileBackend{
+		Path: u.Path,
+	}
+}
+
+func newPostgresBackend(u url.URL) RegistryBackend {
+	return &PostgresBackend{
+		URL: u.String(),
+	}
+}
+
+func newDynamoDBBackend(u url.URL) RegistryBackend {
+	return &DynamoDBBackend{
+		URL: u.String(),
+	}
+}
+
+func init() {
+	RegisterBackend("redis", newRedisBackend)
+	RegisterBackend("rediss", newRedisBackend)
+	RegisterBackend("redis+sentinel", newSentinelBackend)
+	RegisterBackend("rediss+sentinel", newSentinelBackend)
+	RegisterBackend("redis+cluster", newClusterBackend)
+	RegisterBackend("rediss+cluster", newClusterBackend)
+	RegisterBackend("file", newFileBackend)
+	RegisterBackend("postgres", newPostgresBackend)
+	RegisterBackend("postgresql", newPostgresBackend)
+	RegisterBackend("dynamodb", newDynamoDBBackend)
+}
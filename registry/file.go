@@ -0,0 +1,64 @@
+package registry
+
+import (
+	"github.com/litl/galaxy/utils"
+)
+
+// FileBackend stores registrations in a JSON file on disk.  It can share the
+// same file as the config.FileBackend.
+type FileBackend struct {
+	Path  string
+	store *utils.FileStore
+}
+
+func (f *FileBackend) Connect() {
+	f.store = utils.NewFileStore(f.Path)
+}
+
+func (f *FileBackend) Reconnect() {
+	f.Connect()
+}
+
+func (f *FileBackend) Keys(key string) ([]string, error) {
+	return f.store.Keys(key)
+}
+
+func (f *FileBackend) Delete(key string) (int, error) {
+	return f.store.Delete(key)
+}
+
+func (f *FileBackend) Expire(key string, ttl uint64) (int, error) {
+	return f.store.Expire(key, ttl)
+}
+
+func (f *FileBackend) Ttl(key string) (int, error) {
+	return f.store.Ttl(key)
+}
+
+func (f *FileBackend) Set(key, field string, value string) (string, error) {
+	return f.store.Set(key, field, value)
+}
+
+func (f *FileBackend) Get(key, field string) (string, error) {
+	return f.store.Get(key, field)
+}
+
+func (f *FileBackend) GetMulti(keys []string, field string) ([]string, error) {
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		value, err := f.store.Get(key, field)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func (f *FileBackend) CompareAndSet(key, field, old, value string, ttl uint64) (bool, error) {
+	return f.store.CompareAndSet(key, field, old, value, ttl)
+}
+
+func (f *FileBackend) Watch(pattern string, stop chan struct{}) (chan KeyEvent, error) {
+	return pollWatch(f, pattern, stop), nil
+}
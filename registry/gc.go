@@ -0,0 +1,138 @@
+package registry
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/litl/galaxy/utils"
+)
+
+// Orphan is a key left behind by something that didn't clean up after
+// itself, e.g. a host that died before it could unregister.
+type Orphan struct {
+	Key    string
+	Reason string
+}
+
+// FindOrphans scans env for keys that will never be used or removed:
+// registrations, config, host ports and job runs for apps that aren't in
+// apps, and registrations and host entries that lost their expiration.
+// Static registrations are expected to never expire and external ones
+// aren't for apps.
+func (r *ServiceRegistry) FindOrphans(env string, apps []string) ([]Orphan, error) {
+	keys, err := r.backend.Keys(path.Join(env, "*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	orphans := []Orphan{}
+	regKeys := []string{}
+	portKeys := []string{}
+	for _, key := range keys {
+		parts := strings.Split(key, "/")
+		switch {
+		// env/pool/hosts/ip/app/container
+		case len(parts) == 6 && parts[2] == "hosts":
+			regKeys = append(regKeys, key)
+
+		// env/pool/hosts/ip/info
+		case len(parts) == 5 && parts[2] == "hosts" && parts[4] == "info":
+			orphan, err := r.neverExpires(key)
+			if err != nil {
+				return nil, err
+			}
+			if orphan {
+				orphans = append(orphans, Orphan{Key: key, Reason: "host never expires"})
+			}
+
+		// env/ports/port
+		case len(parts) == 3 && parts[1] == "ports":
+			portKeys = append(portKeys, key)
+
+		// env/jobs/app/job/run and lock
+		case len(parts) == 5 && parts[1] == "jobs":
+			if !utils.StringInSlice(parts[2], apps) {
+				orphans = append(orphans, Orphan{Key: key, Reason: "app deleted"})
+			}
+
+		// env/app/environment etc.
+		case len(parts) == 3 && parts[1] != "pools" && parts[1] != "hosts":
+			if !utils.StringInSlice(parts[1], apps) {
+				orphans = append(orphans, Orphan{Key: key, Reason: "app deleted"})
+			}
+		}
+	}
+
+	owners, err := r.backend.GetMulti(portKeys, "owner")
+	if err != nil {
+		return nil, err
+	}
+
+	for i, key := range portKeys {
+		app := strings.Split(owners[i], "/")[0]
+		if !utils.StringInSlice(app, apps) {
+			orphans = append(orphans, Orphan{Key: key, Reason: "app deleted"})
+		}
+	}
+
+	values, err := r.backend.GetMulti(regKeys, "location")
+	if err != nil {
+		return nil, err
+	}
+
+	for i, key := range regKeys {
+		reg := ServiceRegistration{}
+		if values[i] != "" {
+			json.Unmarshal([]byte(values[i]), &reg)
+		}
+
+		// external services aren't apps and are removed by hand
+		if reg.External {
+			continue
+		}
+
+		if !utils.StringInSlice(path.Base(path.Dir(key)), apps) {
+			orphans = append(orphans, Orphan{Key: key, Reason: "app deleted"})
+			continue
+		}
+
+		if reg.Static {
+			continue
+		}
+
+		orphan, err := r.neverExpires(key)
+		if err != nil {
+			return nil, err
+		}
+		if orphan {
+			orphans = append(orphans, Orphan{Key: key, Reason: "registration never expires"})
+		}
+	}
+
+	return orphans, nil
+}
+
+func (r *ServiceRegistry) neverExpires(key string) (bool, error) {
+	ttl, err := r.backend.Ttl(key)
+	if err != nil {
+		return false, err
+	}
+	return ttl == -1, nil
+}
+
+// DeleteOrphans deletes the orphaned keys and returns how many were
+// removed.
+func (r *ServiceRegistry) DeleteOrphans(orphans []Orphan) (int, error) {
+	deleted := 0
+	for _, orphan := range orphans {
+		n, err := r.backend.Delete(orphan.Key)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
@@ -0,0 +1,107 @@
+package registry
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// newTestRegistry returns a registry backed by a file in a temp dir, and a
+// func to remove it.
+func newTestRegistry(t *testing.T) (*ServiceRegistry, func()) {
+	dir, err := ioutil.TempDir("", "galaxy-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewServiceRegistry(DefaultTTL)
+	r.Connect("file://" + filepath.Join(dir, "registry.json"))
+	return r, func() { os.RemoveAll(dir) }
+}
+
+func setTestKey(t *testing.T, r *ServiceRegistry, key, field, value string, ttl uint64) {
+	_, err := r.backend.Set(key, field, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl > 0 {
+		_, err = r.backend.Expire(key, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFindOrphans(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	for _, key := range []struct {
+		key, field, value string
+		ttl               uint64
+	}{
+		{"dev/web/environment", "GALAXY_VERSION", "1", 0},
+		{"dev/gone/environment", "GALAXY_VERSION", "1", 0},
+		{"dev/ports/8000", "owner", "web/80/0", 0},
+		{"dev/ports/8001", "owner", "gone/80/0", 0},
+		{"dev/jobs/web/nightly/run", "started", "now", 0},
+		{"dev/jobs/gone/nightly/run", "started", "now", 0},
+		{"dev/web/hosts/10.0.0.1/info", "hostname", "a", 60},
+		{"dev/web/hosts/10.0.0.2/info", "hostname", "b", 0},
+		{"dev/web/hosts/10.0.0.1/web/aaa", "location", `{}`, 60},
+		{"dev/web/hosts/10.0.0.1/web/bbb", "location", `{}`, 0},
+		{"dev/web/hosts/10.0.0.1/web/ccc", "location", `{"STATIC":true}`, 0},
+		{"dev/web/hosts/10.0.0.1/gone/ddd", "location", `{}`, 60},
+		{"dev/web/hosts/external/db/db", "location", `{"EXTERNAL":true}`, 0},
+		{"prod/gone/environment", "GALAXY_VERSION", "1", 0},
+	} {
+		setTestKey(t, r, key.key, key.field, key.value, key.ttl)
+	}
+
+	orphans, err := r.FindOrphans("dev", []string{"web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"dev/gone/environment":            "app deleted",
+		"dev/ports/8001":                  "app deleted",
+		"dev/jobs/gone/nightly/run":       "app deleted",
+		"dev/web/hosts/10.0.0.2/info":     "host never expires",
+		"dev/web/hosts/10.0.0.1/web/bbb":  "registration never expires",
+		"dev/web/hosts/10.0.0.1/gone/ddd": "app deleted",
+	}
+	if len(orphans) != len(expected) {
+		t.Fatalf("expected %d orphans. Got %v", len(expected), orphans)
+	}
+	for _, orphan := range orphans {
+		if expected[orphan.Key] != orphan.Reason {
+			t.Fatalf("expected %s to be orphaned because %q. Got %q",
+				orphan.Key, expected[orphan.Key], orphan.Reason)
+		}
+	}
+
+	deleted, err := r.DeleteOrphans(orphans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != len(orphans) {
+		t.Fatalf("expected %d keys deleted. Got %d", len(orphans), deleted)
+	}
+
+	keys, err := r.backend.Keys("dev/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, ok := expected[key]; ok {
+			t.Fatalf("expected %s to be deleted", key)
+		}
+	}
+	if len(keys) != 7 {
+		t.Fatalf("expected 7 keys left. Got %v", keys)
+	}
+}
@@ -0,0 +1,129 @@
+package registry
+
+import (
+	"path"
+	"strconv"
+	"time"
+)
+
+// JobRun is the last run of a scheduled job.
+type JobRun struct {
+	// Scheduled is the minute the run was scheduled for
+	Scheduled time.Time
+	Started   time.Time
+	// Finished is zero while the job is running
+	Finished time.Time
+	Host     string
+	// Error is why the run failed, or "" if it succeeded
+	Error string
+}
+
+func jobKey(env, app, job string) string {
+	return path.Join(env, "jobs", app, job, "run")
+}
+
+func jobLockKey(env, app, job string) string {
+	return path.Join(env, "jobs", app, job, "lock")
+}
+
+// ClaimJobRun claims the run of app's job scheduled for at and returns
+// true if no other host has, so each scheduled run happens once.
+func (r *ServiceRegistry) ClaimJobRun(env, app, job string, at time.Time) (bool, error) {
+	key := jobKey(env, app, job)
+	scheduled := strconv.FormatInt(at.Unix(), 10)
+	for {
+		current, err := r.backend.Get(key, "scheduled")
+		if err != nil {
+			return false, err
+		}
+		last, _ := strconv.ParseInt(current, 10, 64)
+		if current != "" && last >= at.Unix() {
+			return false, nil
+		}
+
+		claimed, err := r.backend.CompareAndSet(key, "scheduled", current, scheduled, 0)
+		if err != nil {
+			return false, err
+		}
+		if claimed {
+			return true, nil
+		}
+		// another host claimed a run since it was read
+	}
+}
+
+// LockJob claims app's job for owner while it runs, for ttl seconds, so
+// runs don't overlap.  It returns "" if owner holds the lock, or the owner
+// that does.  The owner keeps it by calling LockJob before the ttl is up.
+func (r *ServiceRegistry) LockJob(env, app, job, owner string, ttl uint64) (string, error) {
+	return r.lock(jobLockKey(env, app, job), owner, ttl)
+}
+
+// UnlockJob releases app's job if owner holds it.
+func (r *ServiceRegistry) UnlockJob(env, app, job, owner string) error {
+	return r.unlock(jobLockKey(env, app, job), owner)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func parseTime(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339, s)
+	return t
+}
+
+// SetJobRun records the last run of app's job.
+func (r *ServiceRegistry) SetJobRun(env, app, job string, run JobRun) error {
+	key := jobKey(env, app, job)
+	for field, value := range map[string]string{
+		"started":  formatTime(run.Started),
+		"finished": formatTime(run.Finished),
+		"host":     run.Host,
+		"error":    run.Error,
+	} {
+		_, err := r.backend.Set(key, field, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetJobRun returns the last run of app's job.  Started is zero if it
+// hasn't run.
+func (r *ServiceRegistry) GetJobRun(env, app, job string) (JobRun, error) {
+	key := jobKey(env, app, job)
+	run := JobRun{}
+	values := map[string]string{}
+	for _, field := range []string{"scheduled", "started", "finished", "host", "error"} {
+		v, err := r.backend.Get(key, field)
+		if err != nil {
+			return run, err
+		}
+		values[field] = v
+	}
+
+	scheduled, _ := strconv.ParseInt(values["scheduled"], 10, 64)
+	if scheduled > 0 {
+		run.Scheduled = time.Unix(scheduled, 0)
+	}
+	run.Started = parseTime(values["started"])
+	run.Finished = parseTime(values["finished"])
+	run.Host = values["host"]
+	run.Error = values["error"]
+	return run, nil
+}
+
+// DeleteJob forgets app's job's runs.
+func (r *ServiceRegistry) DeleteJob(env, app, job string) error {
+	_, err := r.backend.Delete(jobKey(env, app, job))
+	if err != nil {
+		return err
+	}
+	_, err = r.backend.Delete(jobLockKey(env, app, job))
+	return err
+}
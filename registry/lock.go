@@ -0,0 +1,57 @@
+package registry
+
+import (
+	"path"
+)
+
+func hostLockKey(env, pool, hostIP string) string {
+	return path.Join(env, pool, "hosts", hostIP, "lock")
+}
+
+// LockHost claims hostIP's registrations for owner, an id unique to the
+// agent, for ttl seconds.  The owner keeps the lock by calling LockHost
+// again before the ttl is up, and anyone can take it over once it expires.
+// It returns "" if owner holds the lock, or the owner that does.
+func (r *ServiceRegistry) LockHost(env, pool, hostIP, owner string, ttl uint64) (string, error) {
+	return r.lock(hostLockKey(env, pool, hostIP), owner, ttl)
+}
+
+// UnlockHost releases hostIP's lock if owner holds it.
+func (r *ServiceRegistry) UnlockHost(env, pool, hostIP, owner string) error {
+	return r.unlock(hostLockKey(env, pool, hostIP), owner)
+}
+
+// lock claims key for owner for ttl seconds and returns "" if owner holds
+// it, or the owner that does.
+func (r *ServiceRegistry) lock(key, owner string, ttl uint64) (string, error) {
+	for {
+		current, err := r.backend.Get(key, "owner")
+		if err != nil {
+			return "", err
+		}
+		if current != "" && current != owner {
+			return current, nil
+		}
+
+		locked, err := r.backend.CompareAndSet(key, "owner", current, owner, ttl)
+		if err != nil {
+			return "", err
+		}
+		if locked {
+			return "", nil
+		}
+		// someone else changed it since it was read
+	}
+}
+
+func (r *ServiceRegistry) unlock(key, owner string) error {
+	current, err := r.backend.Get(key, "owner")
+	if err != nil {
+		return err
+	}
+	if current != owner {
+		return nil
+	}
+	_, err = r.backend.Delete(key)
+	return err
+}
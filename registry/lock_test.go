@@ -0,0 +1,65 @@
+package registry
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockHost(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	for i, step := range []struct {
+		owner  string
+		unlock bool
+		holder string
+	}{
+		{"a", false, ""},
+		// the owner keeps it
+		{"a", false, ""},
+		{"b", false, "a"},
+		// only the owner can unlock
+		{"b", true, ""},
+		{"b", false, "a"},
+		{"a", true, ""},
+		{"b", false, ""},
+		{"a", false, "b"},
+	} {
+		if step.unlock {
+			if err := r.UnlockHost("dev", "web", "10.0.0.1", step.owner); err != nil {
+				t.Fatalf("step %d: unexpected error unlocking: %s", i, err)
+			}
+			continue
+		}
+
+		holder, err := r.LockHost("dev", "web", "10.0.0.1", step.owner, 60)
+		if err != nil {
+			t.Fatalf("step %d: unexpected error locking: %s", i, err)
+		}
+		if holder != step.holder {
+			t.Fatalf("step %d: expected %s to be told the lock is held by %q. Got %q", i, step.owner, step.holder, holder)
+		}
+	}
+
+	// other hosts have their own locks
+	if holder, err := r.LockHost("dev", "web", "10.0.0.2", "a", 60); holder != "" || err != nil {
+		t.Fatalf("expected a to lock another host. Got %q, %v", holder, err)
+	}
+}
+
+func TestLockHostExpires(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	if holder, err := r.LockHost("dev", "web", "10.0.0.1", "a", 1); holder != "" || err != nil {
+		t.Fatalf("expected a to lock the host. Got %q, %v", holder, err)
+	}
+	if holder, _ := r.LockHost("dev", "web", "10.0.0.1", "b", 1); holder != "a" {
+		t.Fatalf("expected the host to be locked by a. Got %q", holder)
+	}
+
+	time.Sleep(2 * time.Second)
+	if holder, err := r.LockHost("dev", "web", "10.0.0.1", "b", 60); holder != "" || err != nil {
+		t.Fatalf("expected b to take over the expired lock. Got %q, %v", holder, err)
+	}
+}
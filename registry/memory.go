@@ -75,3 +75,21 @@ func (r *MemoryBackend) Set(key, field string, value string) (string, error) {
 func (r *MemoryBackend) Get(key, field string) (string, error) {
 	return "", nil
 }
+
+func (r *MemoryBackend) GetMulti(keys []string, field string) ([]string, error) {
+	return make([]string, len(keys)), nil
+}
+
+// Watch never sends any events since nothing else can change the keys.
+func (r *MemoryBackend) Watch(pattern string, stop chan struct{}) (chan KeyEvent, error) {
+	events := make(chan KeyEvent)
+	go func() {
+		<-stop
+		close(events)
+	}()
+	return events, nil
+}
+
+func (r *MemoryBackend) CompareAndSet(key, field, old, value string, ttl uint64) (bool, error) {
+	return true, nil
+}
@@ -0,0 +1,170 @@
+package registry
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/utils"
+)
+
+// MirrorBackend writes to both Primary and Secondary and reads only from
+// Primary so registrations can be moved to a new backend without downtime.
+// Failed writes to the Secondary are logged but never fail the operation.
+type MirrorBackend struct {
+	Primary   RegistryBackend
+	Secondary RegistryBackend
+}
+
+func (m *MirrorBackend) mirrorErr(key string, err error) {
+	if err != nil {
+		log.Warnf("WARN: Unable to mirror %s: %s", key, err)
+	}
+}
+
+func (m *MirrorBackend) Keys(key string) ([]string, error) {
+	return m.Primary.Keys(key)
+}
+
+func (m *MirrorBackend) Delete(key string) (int, error) {
+	deleted, err := m.Primary.Delete(key)
+	if err != nil {
+		return deleted, err
+	}
+
+	_, serr := m.Secondary.Delete(key)
+	m.mirrorErr(key, serr)
+	return deleted, err
+}
+
+func (m *MirrorBackend) Expire(key string, ttl uint64) (int, error) {
+	set, err := m.Primary.Expire(key, ttl)
+	if err != nil {
+		return set, err
+	}
+
+	_, serr := m.Secondary.Expire(key, ttl)
+	m.mirrorErr(key, serr)
+	return set, err
+}
+
+func (m *MirrorBackend) Ttl(key string) (int, error) {
+	return m.Primary.Ttl(key)
+}
+
+func (m *MirrorBackend) Connect() {
+	m.Primary.Connect()
+	m.Secondary.Connect()
+}
+
+func (m *MirrorBackend) Reconnect() {
+	m.Primary.Reconnect()
+	m.Secondary.Reconnect()
+}
+
+func (m *MirrorBackend) Set(key, field string, value string) (string, error) {
+	reply, err := m.Primary.Set(key, field, value)
+	if err != nil {
+		return reply, err
+	}
+
+	_, serr := m.Secondary.Set(key, field, value)
+	m.mirrorErr(key, serr)
+	return reply, err
+}
+
+func (m *MirrorBackend) Get(key, field string) (string, error) {
+	return m.Primary.Get(key, field)
+}
+
+func (m *MirrorBackend) GetMulti(keys []string, field string) ([]string, error) {
+	return m.Primary.GetMulti(keys, field)
+}
+
+// CompareAndSet compares against the primary only.  The secondary follows
+// whatever the primary accepted.
+func (m *MirrorBackend) CompareAndSet(key, field, old, value string, ttl uint64) (bool, error) {
+	saved, err := m.Primary.CompareAndSet(key, field, old, value, ttl)
+	if !saved || err != nil {
+		return saved, err
+	}
+
+	current, serr := m.Secondary.Get(key, field)
+	if serr == nil {
+		_, serr = m.Secondary.CompareAndSet(key, field, current, value, ttl)
+	}
+	m.mirrorErr(key, serr)
+	return saved, err
+}
+
+// Verify compares the registrations matching pattern in both backends and
+// returns a description of each difference.  Registrations expire
+// independently, so a difference for one about to expire may be transient.
+func (m *MirrorBackend) Verify(pattern string) ([]string, error) {
+	primary, err := locations(m.Primary, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	secondary, err := locations(m.Secondary, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for k := range primary {
+		keys = append(keys, k)
+	}
+	for k := range secondary {
+		if _, ok := primary[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	diffs := []string{}
+	for _, k := range keys {
+		p, inPrimary := primary[k]
+		s, inSecondary := secondary[k]
+		switch {
+		case !inSecondary:
+			diffs = append(diffs, fmt.Sprintf("%s is missing from the mirror", k))
+		case !inPrimary:
+			diffs = append(diffs, fmt.Sprintf("%s only exists in the mirror", k))
+		case p != s:
+			diffs = append(diffs, fmt.Sprintf("%s differs in the mirror", k))
+		}
+	}
+	return diffs, nil
+}
+
+func locations(backend RegistryBackend, pattern string) (map[string]string, error) {
+	keys, err := backend.Keys(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := backend.GetMulti(keys, "location")
+	if err != nil {
+		return nil, err
+	}
+
+	locs := make(map[string]string)
+	for i, k := range keys {
+		locs[k] = values[i]
+	}
+	return locs, nil
+}
+
+// Watch only watches the primary since that's what reads use.
+func (m *MirrorBackend) Watch(pattern string, stop chan struct{}) (chan KeyEvent, error) {
+	return m.Primary.Watch(pattern, stop)
+}
+
+// Status reports the health of the primary since that's what reads use.
+func (m *MirrorBackend) Status() utils.BackendStatus {
+	if backend, ok := m.Primary.(statusReporter); ok {
+		return backend.Status()
+	}
+	return utils.BackendStatus{Healthy: true}
+}
@@ -0,0 +1,89 @@
+package registry
+
+import (
+	"path"
+	"strings"
+)
+
+// ImagePolicy restricts the images an env's hosts will run.  The zero
+// policy allows any image.
+type ImagePolicy struct {
+	// Registries images have to come from, e.g. registry.example.com or
+	// docker.io for Docker Hub.  Any registry is allowed if it's empty.
+	Registries []string
+	// Verify checks images' signatures before they're run with "cosign"
+	// or "notary", or not at all if it's ""
+	Verify string
+	// Key is the cosign public key, a file or KMS URI, or the notary
+	// server URL
+	Key string
+	// Privileged lists the apps allowed to run privileged containers.
+	// None are if it's empty.
+	Privileged []string
+}
+
+func imagePolicyKey(env string) string {
+	return path.Join(env, "policy")
+}
+
+// GetImagePolicy returns env's image policy.
+func (r *ServiceRegistry) GetImagePolicy(env string) (ImagePolicy, error) {
+	key := imagePolicyKey(env)
+	policy := ImagePolicy{}
+
+	registries, err := r.backend.Get(key, "registries")
+	if err != nil {
+		return policy, err
+	}
+	for _, registry := range strings.Split(registries, ",") {
+		if registry != "" {
+			policy.Registries = append(policy.Registries, registry)
+		}
+	}
+
+	policy.Verify, err = r.backend.Get(key, "verify")
+	if err != nil {
+		return policy, err
+	}
+
+	policy.Key, err = r.backend.Get(key, "key")
+	if err != nil {
+		return policy, err
+	}
+
+	privileged, err := r.backend.Get(key, "privileged")
+	if err != nil {
+		return policy, err
+	}
+	for _, app := range strings.Split(privileged, ",") {
+		if app != "" {
+			policy.Privileged = append(policy.Privileged, app)
+		}
+	}
+	return policy, nil
+}
+
+// SetImagePolicy replaces env's image policy.
+func (r *ServiceRegistry) SetImagePolicy(env string, policy ImagePolicy) error {
+	key := imagePolicyKey(env)
+	_, err := r.backend.Delete(key)
+	if err != nil {
+		return err
+	}
+
+	for field, value := range map[string]string{
+		"registries": strings.Join(policy.Registries, ","),
+		"verify":     policy.Verify,
+		"key":        policy.Key,
+		"privileged": strings.Join(policy.Privileged, ","),
+	} {
+		if value == "" {
+			continue
+		}
+		_, err = r.backend.Set(key, field, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package registry
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// HostPortStart and HostPortEnd bound the host ports handed out to
+	// apps.  They're below the range docker picks random ports from.
+	HostPortStart = 20000
+	HostPortEnd   = 29999
+)
+
+func hostPortKey(env string, hostPort int) string {
+	return path.Join(env, "ports", strconv.Itoa(hostPort))
+}
+
+// hostPortOwner identifies what a host port is assigned to: slot of app's
+// container port, e.g. "web/8080/tcp/0".
+func hostPortOwner(app, port string, slot int) string {
+	if !strings.Contains(port, "/") {
+		port = port + "/tcp"
+	}
+	return fmt.Sprintf("%s/%s/%d", app, port, slot)
+}
+
+// hostPorts returns the owner of each host port assigned in env.
+func (r *ServiceRegistry) hostPorts(env string) (map[int]string, error) {
+	keys, err := r.backend.Keys(path.Join(env, "ports", "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	owners, err := r.backend.GetMulti(keys, "owner")
+	if err != nil {
+		return nil, err
+	}
+
+	ports := make(map[int]string)
+	for i, key := range keys {
+		n, err := strconv.Atoi(path.Base(key))
+		if err != nil || owners[i] == "" {
+			continue
+		}
+		ports[n] = owners[i]
+	}
+	return ports, nil
+}
+
+// lowestOwned returns the lowest host port assigned to owner, or 0.
+func lowestOwned(ports map[int]string, owner string) int {
+	lowest := 0
+	for n, o := range ports {
+		if o == owner && (lowest == 0 || n < lowest) {
+			lowest = n
+		}
+	}
+	return lowest
+}
+
+// NoHostPortsError is returned by AllocatePort when every host port in env
+// is assigned.
+type NoHostPortsError struct {
+	Env   string
+	Owner string
+}
+
+func (e *NoHostPortsError) Error() string {
+	return fmt.Sprintf("no free host ports for %s in %s", e.Owner, e.Env)
+}
+
+// AllocatePort returns the host port app's container port, e.g. "8080/tcp",
+// is published on, assigning the next free one in env the first time it's
+// asked for.  The same port is returned on every host and deploy so it can
+// be opened in firewalls.  slot picks between several ports for the same
+// container port, for when more than one container of the app runs on a
+// host at once.
+func (r *ServiceRegistry) AllocatePort(env, app, port string, slot int) (int, error) {
+	owner := hostPortOwner(app, port, slot)
+	for {
+		ports, err := r.hostPorts(env)
+		if err != nil {
+			return 0, err
+		}
+
+		if n := lowestOwned(ports, owner); n != 0 {
+			return n, nil
+		}
+
+		free := 0
+		for n := HostPortStart; n <= HostPortEnd; n++ {
+			if _, ok := ports[n]; !ok {
+				free = n
+				break
+			}
+		}
+		if free == 0 {
+			return 0, &NoHostPortsError{Env: env, Owner: owner}
+		}
+
+		claimed, err := r.backend.CompareAndSet(hostPortKey(env, free), "owner", "", owner, 0)
+		if err != nil {
+			return 0, err
+		}
+		if !claimed {
+			// another app took it since it was read
+			continue
+		}
+
+		// two hosts can assign the same slot at once, so keep the lowest
+		// and give the rest back
+		ports, err = r.hostPorts(env)
+		if err != nil {
+			return 0, err
+		}
+		if n := lowestOwned(ports, owner); n != free {
+			_, err := r.backend.Delete(hostPortKey(env, free))
+			if err != nil {
+				return 0, err
+			}
+			return n, nil
+		}
+		return free, nil
+	}
+}
+
+// ReleasePorts gives back the host ports assigned to app in env, for when
+// it's deleted, and returns how many there were.
+func (r *ServiceRegistry) ReleasePorts(env, app string) (int, error) {
+	ports, err := r.hostPorts(env)
+	if err != nil {
+		return 0, err
+	}
+
+	released := 0
+	for n, owner := range ports {
+		if !strings.HasPrefix(owner, app+"/") {
+			continue
+		}
+		_, err := r.backend.Delete(hostPortKey(env, n))
+		if err != nil {
+			return released, err
+		}
+		released++
+	}
+	return released, nil
+}
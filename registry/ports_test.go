@@ -0,0 +1,99 @@
+package registry
+
+import (
+	"testing"
+)
+
+func TestAllocatePort(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	for _, test := range []struct {
+		app, port string
+		slot      int
+		expected  int
+	}{
+		{"web", "80/tcp", 0, HostPortStart},
+		{"web", "80", 0, HostPortStart},
+		{"web", "80/tcp", 1, HostPortStart + 1},
+		{"web", "53/udp", 0, HostPortStart + 2},
+		{"api", "80/tcp", 0, HostPortStart + 3},
+		{"web", "80/tcp", 0, HostPortStart},
+		{"web", "80/tcp", 1, HostPortStart + 1},
+	} {
+		n, err := r.AllocatePort("dev", test.app, test.port, test.slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != test.expected {
+			t.Fatalf("expected %d for %s %s slot %d. Got %d", test.expected, test.app, test.port, test.slot, n)
+		}
+	}
+
+	// each env assigns its own
+	n, err := r.AllocatePort("prod", "api", "80/tcp", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != HostPortStart {
+		t.Fatalf("expected %d in another env. Got %d", HostPortStart, n)
+	}
+}
+
+func TestAllocatePortKeepsLowest(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	// another host assigned the same slot at the same time
+	setTestKey(t, r, hostPortKey("dev", HostPortStart+5), "owner", "web/80/tcp/0", 0)
+	setTestKey(t, r, hostPortKey("dev", HostPortStart+2), "owner", "web/80/tcp/0", 0)
+
+	n, err := r.AllocatePort("dev", "web", "80/tcp", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != HostPortStart+2 {
+		t.Fatalf("expected the lowest assigned port %d. Got %d", HostPortStart+2, n)
+	}
+}
+
+func TestReleasePorts(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	for _, app := range []string{"web", "webapp", "web", "api"} {
+		_, err := r.AllocatePort("dev", app, "80/tcp", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := r.AllocatePort("dev", "web", "80/tcp", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	released, err := r.ReleasePorts("dev", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released != 2 {
+		t.Fatalf("expected 2 ports released. Got %d", released)
+	}
+
+	ports, err := r.hostPorts("dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 2 || ports[HostPortStart+1] != "webapp/80/tcp/0" || ports[HostPortStart+2] != "api/80/tcp/0" {
+		t.Fatalf("expected only webapp and api's ports to be left. Got %v", ports)
+	}
+
+	// a released port is assigned again
+	n, err := r.AllocatePort("dev", "worker", "80/tcp", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != HostPortStart {
+		t.Fatalf("expected the released port %d. Got %d", HostPortStart, n)
+	}
+}
@@ -0,0 +1,262 @@
+package registry
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/utils"
+)
+
+// postgresSweepInterval is how often expired registrations are deleted by
+// default.
+// Reads ignore expired rows so this only bounds the table size.
+const postgresSweepInterval = 30 * time.Second
+
+var postgresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS galaxy_registrations (
+		key        text NOT NULL,
+		field      text NOT NULL,
+		value      text NOT NULL,
+		expires_at timestamptz,
+		PRIMARY KEY (key, field)
+	)`,
+	`CREATE INDEX IF NOT EXISTS galaxy_registrations_expires_at
+		ON galaxy_registrations (expires_at)`,
+}
+
+// PostgresBackend stores registrations in the galaxy_registrations table.
+// Each row is one field of a key; a key's TTL is kept on all of its rows.
+type PostgresBackend struct {
+	URL string
+	// sweepInterval is how often expired registrations are deleted,
+	// postgresSweepInterval if it's 0
+	sweepInterval time.Duration
+
+	db   *sql.DB
+	stop chan struct{}
+}
+
+func (p *PostgresBackend) Connect() {
+	db, err := utils.OpenPostgres(p.URL)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to connect to postgres: %s", err)
+	}
+
+	err = utils.ExecAll(db, postgresSchema...)
+	if err != nil {
+		log.Fatalf("ERROR: Unable to create registry tables: %s", err)
+	}
+
+	p.db = db
+	interval := p.sweepInterval
+	if interval == 0 {
+		interval = postgresSweepInterval
+	}
+	p.stop = make(chan struct{})
+	go p.sweep(db, interval, p.stop)
+}
+
+func (p *PostgresBackend) Reconnect() {
+	if p.db != nil {
+		close(p.stop)
+		p.db.Close()
+	}
+	p.Connect()
+}
+
+// sweep deletes expired registrations every interval until stop is closed.  A
+// sweep that fails is tried again at the next interval.
+func (p *PostgresBackend) sweep(db *sql.DB, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		_, err := db.Exec(`DELETE FROM galaxy_registrations WHERE expires_at < now()`)
+		if err != nil {
+			log.Warnf("WARN: Unable to delete expired registrations: %s", err)
+		}
+	}
+}
+
+func (p *PostgresBackend) Keys(key string) ([]string, error) {
+	rows, err := p.db.Query(`SELECT DISTINCT key FROM galaxy_registrations
+		WHERE key LIKE $1 ESCAPE '\' AND (expires_at IS NULL OR expires_at > now())`,
+		utils.GlobToLike(key))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (p *PostgresBackend) Delete(key string) (int, error) {
+	res, err := p.db.Exec(`DELETE FROM galaxy_registrations WHERE key = $1`, key)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if n > 0 {
+		return 1, err
+	}
+	return 0, err
+}
+
+func (p *PostgresBackend) Expire(key string, ttl uint64) (int, error) {
+	res, err := p.db.Exec(`UPDATE galaxy_registrations
+		SET expires_at = now() + $2 * interval '1 second' WHERE key = $1`, key, ttl)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if n > 0 {
+		return 1, err
+	}
+	return 0, err
+}
+
+func (p *PostgresBackend) Ttl(key string) (int, error) {
+	var ttl sql.NullFloat64
+	err := p.db.QueryRow(`SELECT extract(epoch FROM max(expires_at) - now())
+		FROM galaxy_registrations WHERE key = $1`, key).Scan(&ttl)
+	if err != nil {
+		return 0, err
+	}
+
+	// match redis: -1 for no expiration, -2 for a missing key
+	if !ttl.Valid {
+		exists := false
+		err = p.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM galaxy_registrations WHERE key = $1)`,
+			key).Scan(&exists)
+		if exists {
+			return -1, err
+		}
+		return -2, err
+	}
+	if ttl.Float64 < 0 {
+		return -2, nil
+	}
+	return int(ttl.Float64), nil
+}
+
+func (p *PostgresBackend) Set(key, field string, value string) (string, error) {
+	_, err := p.db.Exec(`INSERT INTO galaxy_registrations (key, field, value, expires_at)
+		VALUES ($1, $2, $3, (SELECT max(expires_at) FROM galaxy_registrations WHERE key = $1))
+		ON CONFLICT (key, field) DO UPDATE SET value = EXCLUDED.value`, key, field, value)
+	if err != nil {
+		return "", err
+	}
+	return "OK", nil
+}
+
+func (p *PostgresBackend) Get(key, field string) (string, error) {
+	var value string
+	err := p.db.QueryRow(`SELECT value FROM galaxy_registrations
+		WHERE key = $1 AND field = $2 AND (expires_at IS NULL OR expires_at > now())`,
+		key, field).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+func (p *PostgresBackend) GetMulti(keys []string, field string) ([]string, error) {
+	values := make([]string, len(keys))
+	if len(keys) == 0 {
+		return values, nil
+	}
+
+	index := make(map[string][]int)
+	args := []interface{}{field}
+	in := ""
+	for i, key := range keys {
+		if _, ok := index[key]; !ok {
+			args = append(args, key)
+			if in != "" {
+				in += ", "
+			}
+			in += "$" + strconv.Itoa(len(args))
+		}
+		index[key] = append(index[key], i)
+	}
+
+	rows, err := p.db.Query(`SELECT key, value FROM galaxy_registrations
+		WHERE field = $1 AND key IN (`+in+`) AND (expires_at IS NULL OR expires_at > now())`,
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		for _, i := range index[key] {
+			values[i] = value
+		}
+	}
+	return values, rows.Err()
+}
+
+func (p *PostgresBackend) CompareAndSet(key, field, old, value string, ttl uint64) (bool, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var res sql.Result
+	if old == "" {
+		// only replace a row that has already expired
+		res, err = tx.Exec(`INSERT INTO galaxy_registrations (key, field, value)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (key, field) DO UPDATE SET value = EXCLUDED.value
+			WHERE galaxy_registrations.expires_at <= now()`, key, field, value)
+	} else {
+		res, err = tx.Exec(`UPDATE galaxy_registrations SET value = $4
+			WHERE key = $1 AND field = $2 AND value = $3
+			AND (expires_at IS NULL OR expires_at > now())`, key, field, old, value)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	// a ttl of 0 persists the key
+	_, err = tx.Exec(`UPDATE galaxy_registrations
+		SET expires_at = CASE WHEN $2 > 0 THEN now() + $2 * interval '1 second' END
+		WHERE key = $1`, key, ttl)
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Commit()
+	return err == nil, err
+}
+
+func (p *PostgresBackend) Watch(pattern string, stop chan struct{}) (chan KeyEvent, error) {
+	return pollWatch(p, pattern, stop), nil
+}
@@ -0,0 +1,115 @@
+package registry
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/litl/galaxy/utils"
+)
+
+// testPostgres is a database/sql driver that records the statements run
+// and fails the next fail of them.
+type testPostgres struct {
+	mu    sync.Mutex
+	execs []string
+	fail  int
+}
+
+var testDriver = &testPostgres{}
+
+func init() {
+	sql.Register("galaxy-test", testDriver)
+}
+
+// count returns how many of the statements run start with prefix.
+func (d *testPostgres) count(prefix string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := 0
+	for _, stmt := range d.execs {
+		if strings.HasPrefix(stmt, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func (d *testPostgres) Open(name string) (driver.Conn, error) { return testPostgresConn{d}, nil }
+
+type testPostgresConn struct{ d *testPostgres }
+
+func (c testPostgresConn) Prepare(query string) (driver.Stmt, error) {
+	return testPostgresStmt{c.d, query}, nil
+}
+func (c testPostgresConn) Close() error              { return nil }
+func (c testPostgresConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+type testPostgresStmt struct {
+	d     *testPostgres
+	query string
+}
+
+func (s testPostgresStmt) Close() error  { return nil }
+func (s testPostgresStmt) NumInput() int { return -1 }
+
+func (s testPostgresStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	s.d.execs = append(s.d.execs, strings.Join(strings.Fields(s.query), " "))
+	if s.d.fail > 0 {
+		s.d.fail--
+		return nil, errors.New("connection refused")
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s testPostgresStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestPostgresSweep(t *testing.T) {
+	driverName := utils.PostgresDriver
+	utils.PostgresDriver = "galaxy-test"
+	defer func() { utils.PostgresDriver = driverName }()
+
+	testDriver.mu.Lock()
+	testDriver.execs, testDriver.fail = nil, 0
+	testDriver.mu.Unlock()
+
+	p := &PostgresBackend{URL: "postgres://galaxy@localhost/galaxy", sweepInterval: 10 * time.Millisecond}
+	p.Connect()
+	if testDriver.count("CREATE TABLE IF NOT EXISTS galaxy_registrations") != 1 {
+		t.Fatal("expected the registrations table to be created")
+	}
+
+	// the database going away doesn't stop the sweeps
+	testDriver.mu.Lock()
+	testDriver.fail = 3
+	testDriver.mu.Unlock()
+
+	sweep := "DELETE FROM galaxy_registrations WHERE expires_at < now()"
+	deadline := time.Now().Add(5 * time.Second)
+	for testDriver.count(sweep) < 5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected sweeps to continue after failing. Got %d", testDriver.count(sweep))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a reconnect replaces the sweep rather than adding another
+	p.Reconnect()
+	close(p.stop)
+	time.Sleep(50 * time.Millisecond)
+	stopped := testDriver.count(sweep)
+	time.Sleep(50 * time.Millisecond)
+	if n := testDriver.count(sweep); n != stopped {
+		t.Fatalf("expected sweeps to stop once closed. Got %d more", n-stopped)
+	}
+}
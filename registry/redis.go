@@ -1,156 +1,233 @@
 package registry
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/utils"
 )
 
 type RedisBackend struct {
 	redisPool redis.Pool
 	RedisHost string
+	// Options holds the AUTH, db and TLS settings for RedisHost
+	Options *utils.RedisOptions
+	// Sentinel, if set, is used to locate the master instead of RedisHost
+	Sentinel *utils.RedisSentinel
+	// Cluster, if set, routes commands across a Redis Cluster
+	Cluster *utils.RedisCluster
+	// ScanCount is the page size used when listing keys.  Zero uses
+	// utils.DefaultScanCount.
+	ScanCount int
+	// Namespace, if set, prefixes every key and channel with
+	// "<Namespace>:" so several galaxy installations can share a redis.
+	Namespace string
+	// PoolOptions size the connection pool
+	PoolOptions utils.PoolOptions
+
+	health utils.BackendHealth
+	pool   utils.PoolMonitor
+}
+
+func (r *RedisBackend) key(key string) string {
+	if r.Namespace == "" {
+		return key
+	}
+	return r.Namespace + ":" + key
+}
+
+func (r *RedisBackend) keys(keys []string) []string {
+	if r.Namespace == "" {
+		return keys
+	}
+
+	namespaced := make([]string, len(keys))
+	for i, key := range keys {
+		namespaced[i] = r.key(key)
+	}
+	return namespaced
+}
+
+func (r *RedisBackend) dial(connectTimeout, readTimeout, writeTimeout time.Duration) (redis.Conn, error) {
+	if r.Sentinel != nil {
+		return r.Sentinel.DialTimeout(connectTimeout, readTimeout, writeTimeout)
+	}
+	if r.Cluster != nil {
+		return r.Cluster.DialTimeout(connectTimeout, readTimeout, writeTimeout)
+	}
+	if r.Options != nil {
+		return r.Options.DialTimeout("tcp", r.RedisHost, connectTimeout, readTimeout, writeTimeout)
+	}
+	return redis.DialTimeout("tcp", r.RedisHost, connectTimeout, readTimeout, writeTimeout)
+}
+
+func (r *RedisBackend) testConn(c redis.Conn, t time.Time) error {
+	var err error
+	if r.Sentinel != nil {
+		// a failover leaves pooled connections pointing at a replica
+		err = r.Sentinel.TestRole(c)
+	} else {
+		_, err = c.Do("PING")
+	}
+	if err != nil {
+		defer c.Close()
+	}
+	return err
 }
 
 func (r *RedisBackend) Connect() {
 	rwTimeout := 5 * time.Second
 
 	r.redisPool = redis.Pool{
-		MaxIdle:     1,
-		IdleTimeout: 120 * time.Second,
 		Dial: func() (redis.Conn, error) {
-			return redis.DialTimeout("tcp", r.RedisHost, rwTimeout, rwTimeout, rwTimeout)
+			return r.dial(rwTimeout, rwTimeout, rwTimeout)
 		},
 		// test every connection for now
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			_, err := c.Do("PING")
-			if err != nil {
-				defer c.Close()
-			}
-			return err
-		},
+		TestOnBorrow: r.testConn,
 	}
+	r.PoolOptions.Apply(&r.redisPool)
 }
 
 func (r *RedisBackend) Reconnect() {
+	r.health.Reconnected()
 	r.redisPool.Close()
 	r.Connect()
 }
 
-func (r *RedisBackend) Keys(key string) ([]string, error) {
-	conn := r.redisPool.Get()
-	defer conn.Close()
+// getConn returns a pooled connection.  If redis can't be reached it
+// reconnects with exponential backoff, up to utils.DefaultConnRetries
+// times, before giving up.
+func (r *RedisBackend) getConn() (redis.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		conn := r.pool.Get(&r.redisPool)
+		err := conn.Err()
+		if err == nil {
+			r.health.OK()
+			return conn, nil
+		}
 
-	if conn.Err() != nil {
 		conn.Close()
+		// redis is fine, we're just out of connections
+		if err == redis.ErrPoolExhausted {
+			return nil, err
+		}
+		r.health.Failed(err)
+		if attempt == utils.DefaultConnRetries {
+			return nil, err
+		}
+		time.Sleep(r.health.Backoff())
 		r.Reconnect()
-		return nil, conn.Err()
 	}
+}
 
-	return redis.Strings(conn.Do("KEYS", key))
+// Status reports whether redis was reachable on the last attempt and the
+// connection pool's usage.
+func (r *RedisBackend) Status() utils.BackendStatus {
+	status := r.health.Status()
+	stats := r.pool.Stats(&r.redisPool)
+	status.Pool = &stats
+	return status
 }
 
-func (r *RedisBackend) Expire(key string, ttl uint64) (int, error) {
-	conn := r.redisPool.Get()
+func (r *RedisBackend) Keys(key string) ([]string, error) {
+	conn, err := r.getConn()
+	if err != nil {
+		return nil, err
+	}
 	defer conn.Close()
 
-	if conn.Err() != nil {
-		conn.Close()
-		r.Reconnect()
-		return 0, conn.Err()
+	keys, err := utils.ScanKeys(conn, r.key(key), r.ScanCount)
+	if err != nil || r.Namespace == "" {
+		return keys, err
 	}
 
-	return redis.Int(conn.Do("EXPIRE", key, ttl))
+	for i, k := range keys {
+		keys[i] = strings.TrimPrefix(k, r.Namespace+":")
+	}
+	return keys, nil
 }
 
-func (r *RedisBackend) Ttl(key string) (int, error) {
-	conn := r.redisPool.Get()
+func (r *RedisBackend) Expire(key string, ttl uint64) (int, error) {
+	conn, err := r.getConn()
+	if err != nil {
+		return 0, err
+	}
 	defer conn.Close()
 
-	if conn.Err() != nil {
-		conn.Close()
-		r.Reconnect()
-		return 0, conn.Err()
+	return redis.Int(conn.Do("EXPIRE", r.key(key), ttl))
+}
+
+func (r *RedisBackend) Ttl(key string) (int, error) {
+	conn, err := r.getConn()
+	if err != nil {
+		return 0, err
 	}
+	defer conn.Close()
 
-	return redis.Int(conn.Do("TTL", key))
+	return redis.Int(conn.Do("TTL", r.key(key)))
 }
 
 func (r *RedisBackend) Delete(key string) (int, error) {
-	conn := r.redisPool.Get()
-	defer conn.Close()
-
-	if conn.Err() != nil {
-		conn.Close()
-		r.Reconnect()
-		return 0, conn.Err()
+	conn, err := r.getConn()
+	if err != nil {
+		return 0, err
 	}
+	defer conn.Close()
 
-	return redis.Int(conn.Do("DEL", key))
+	return redis.Int(conn.Do("DEL", r.key(key)))
 }
 
 func (r *RedisBackend) AddMember(key, value string) (int, error) {
-	conn := r.redisPool.Get()
-	defer conn.Close()
-
-	if conn.Err() != nil {
-		conn.Close()
-		r.Reconnect()
-		return 0, conn.Err()
+	conn, err := r.getConn()
+	if err != nil {
+		return 0, err
 	}
+	defer conn.Close()
 
-	return redis.Int(conn.Do("SADD", key, value))
+	return redis.Int(conn.Do("SADD", r.key(key), value))
 }
 
 func (r *RedisBackend) RemoveMember(key, value string) (int, error) {
-	conn := r.redisPool.Get()
-	defer conn.Close()
-
-	if conn.Err() != nil {
-		conn.Close()
-		r.Reconnect()
-		return 0, conn.Err()
+	conn, err := r.getConn()
+	if err != nil {
+		return 0, err
 	}
+	defer conn.Close()
 
-	return redis.Int(conn.Do("SREM", key, value))
+	return redis.Int(conn.Do("SREM", r.key(key), value))
 }
 
 func (r *RedisBackend) Members(key string) ([]string, error) {
-	conn := r.redisPool.Get()
-	defer conn.Close()
-
-	if conn.Err() != nil {
-		conn.Close()
-		r.Reconnect()
-		return nil, conn.Err()
+	conn, err := r.getConn()
+	if err != nil {
+		return nil, err
 	}
+	defer conn.Close()
 
-	return redis.Strings(conn.Do("SMEMBERS", key))
+	return redis.Strings(conn.Do("SMEMBERS", r.key(key)))
 }
 
 func (r *RedisBackend) Set(key, field string, value string) (string, error) {
-	conn := r.redisPool.Get()
-	defer conn.Close()
-
-	if conn.Err() != nil {
-		conn.Close()
-		r.Reconnect()
-		return "", conn.Err()
+	conn, err := r.getConn()
+	if err != nil {
+		return "", err
 	}
+	defer conn.Close()
 
-	return redis.String(conn.Do("HMSET", key, field, value))
+	return redis.String(conn.Do("HMSET", r.key(key), field, value))
 }
 
 func (r *RedisBackend) Get(key, field string) (string, error) {
-	conn := r.redisPool.Get()
-	defer conn.Close()
-
-	if conn.Err() != nil {
-		conn.Close()
-		r.Reconnect()
-		return "", conn.Err()
+	conn, err := r.getConn()
+	if err != nil {
+		return "", err
 	}
+	defer conn.Close()
 
-	ret, err := redis.String(conn.Do("HGET", key, field))
+	ret, err := redis.String(conn.Do("HGET", r.key(key), field))
 	if err != nil && err == redis.ErrNil {
 		return "", nil
 	}
@@ -158,17 +235,24 @@ func (r *RedisBackend) Get(key, field string) (string, error) {
 	return ret, err
 }
 
-func (r *RedisBackend) GetAll(key string) (map[string]string, error) {
-	conn := r.redisPool.Get()
+func (r *RedisBackend) GetMulti(keys []string, field string) ([]string, error) {
+	conn, err := r.getConn()
+	if err != nil {
+		return nil, err
+	}
 	defer conn.Close()
 
-	if conn.Err() != nil {
-		conn.Close()
-		r.Reconnect()
-		return nil, conn.Err()
+	return utils.HGetMulti(conn, r.keys(keys), field)
+}
+
+func (r *RedisBackend) GetAll(key string) (map[string]string, error) {
+	conn, err := r.getConn()
+	if err != nil {
+		return nil, err
 	}
+	defer conn.Close()
 
-	matches, err := redis.Values(conn.Do("HGETALL", key))
+	matches, err := redis.Values(conn.Do("HGETALL", r.key(key)))
 	if err != nil {
 		return nil, err
 	}
@@ -184,34 +268,223 @@ func (r *RedisBackend) GetAll(key string) (map[string]string, error) {
 }
 
 func (r *RedisBackend) SetMulti(key string, values map[string]string) (string, error) {
-	conn := r.redisPool.Get()
-	defer conn.Close()
-
-	if conn.Err() != nil {
-		conn.Close()
-		r.Reconnect()
-		return "", conn.Err()
+	conn, err := r.getConn()
+	if err != nil {
+		return "", err
 	}
+	defer conn.Close()
 
-	redisArgs := redis.Args{}.Add(key).AddFlat(values)
+	redisArgs := redis.Args{}.Add(r.key(key)).AddFlat(values)
 	return redis.String(conn.Do("HMSET", redisArgs...))
 }
 
 func (r *RedisBackend) DeleteMulti(key string, fields ...string) (int, error) {
-	conn := r.redisPool.Get()
-	defer conn.Close()
-
-	if conn.Err() != nil {
-		conn.Close()
-		r.Reconnect()
-		return 0, conn.Err()
+	conn, err := r.getConn()
+	if err != nil {
+		return 0, err
 	}
+	defer conn.Close()
 
 	args := []string{}
 	for _, field := range fields {
 		args = append(args, field)
 	}
-	redisArgs := redis.Args{}.Add(key).AddFlat(args)
+	redisArgs := redis.Args{}.Add(r.key(key)).AddFlat(args)
 	return redis.Int(conn.Do("HDEL", redisArgs...))
 
 }
+
+// compareAndSetScript sets a hash field and the key's expiration if the
+// field still holds the expected value.  A ttl of 0 persists the key.
+var compareAndSetScript = redis.NewScript(1, `
+local current = redis.call('HGET', KEYS[1], ARGV[1])
+if current == false then
+	current = ''
+end
+
+if current ~= ARGV[2] then
+	return 0
+end
+
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+if tonumber(ARGV[4]) > 0 then
+	redis.call('EXPIRE', KEYS[1], ARGV[4])
+else
+	redis.call('PERSIST', KEYS[1])
+end
+return 1
+`)
+
+func (r *RedisBackend) CompareAndSet(key, field, old, value string, ttl uint64) (bool, error) {
+	conn, err := r.getConn()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	set, err := redis.Int(compareAndSetScript.Do(conn, r.key(key), field, old, value, ttl))
+	return set == 1, err
+}
+
+func (r *RedisBackend) db() int {
+	switch {
+	case r.Sentinel != nil && r.Sentinel.Options != nil:
+		return r.Sentinel.Options.DB
+	case r.Options != nil:
+		return r.Options.DB
+	}
+	return 0
+}
+
+// Watch uses keyspace notifications when redis has them enabled for hash,
+// generic and expired events, e.g. "Khgx" or "KA", and polls otherwise.
+func (r *RedisBackend) Watch(pattern string, stop chan struct{}) (chan KeyEvent, error) {
+	if r.Cluster != nil {
+		// notifications are only delivered to clients of the node that
+		// owns the key
+		return pollWatch(r, pattern, stop), nil
+	}
+
+	conn, err := r.getConn()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := redis.Strings(conn.Do("CONFIG", "GET", "notify-keyspace-events"))
+	conn.Close()
+	// CONFIG is often disabled by managed redis
+	if err != nil || len(reply) != 2 || !utils.KeyspaceEventsEnabled(reply[1], "hgx") {
+		return pollWatch(r, pattern, stop), nil
+	}
+
+	seen := keyCache{}
+	current, err := locations(r, pattern)
+	if err != nil {
+		return nil, err
+	}
+	seen.sync(current)
+
+	channelPrefix := fmt.Sprintf("__keyspace@%d__:", r.db())
+	notifications := make(chan redis.PMessage)
+	go r.psubscribe(channelPrefix+r.key(pattern), notifications, stop)
+
+	events := make(chan KeyEvent)
+	go func() {
+		defer close(events)
+		for n := range notifications {
+			// resubscribed, so catch up on anything we missed
+			if n.Pattern == "" {
+				current, err := locations(r, pattern)
+				if err != nil {
+					log.Warnf("WARN: Unable to read %s: %s", pattern, err)
+					continue
+				}
+				if !sendEvents(events, stop, seen.sync(current)...) {
+					return
+				}
+				continue
+			}
+
+			key := strings.TrimPrefix(n.Channel, channelPrefix)
+			if r.Namespace != "" {
+				key = strings.TrimPrefix(key, r.Namespace+":")
+			}
+
+			switch string(n.Data) {
+			case "hset", "hmset":
+				value, err := r.Get(key, "location")
+				if err != nil {
+					log.Warnf("WARN: Unable to read %s: %s", key, err)
+					continue
+				}
+				if value != "" && seen.changed(key, value) {
+					if !sendEvents(events, stop, KeyEvent{Key: key, Type: KeySet, Value: value}) {
+						return
+					}
+				}
+			case "del", "expired":
+				if _, ok := seen[key]; !ok {
+					continue
+				}
+				delete(seen, key)
+				event := KeyEvent{Key: key, Type: KeyDeleted}
+				if string(n.Data) == "expired" {
+					event.Type = KeyExpired
+				}
+				if !sendEvents(events, stop, event) {
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// psubscribe sends every message on channels matching pattern to msgs
+// until stop is closed, then closes msgs.  It resubscribes with backoff
+// whenever the connection is lost and then sends a PMessage with an empty
+// Pattern since messages may have been missed.
+func (r *RedisBackend) psubscribe(pattern string, msgs chan redis.PMessage, stop chan struct{}) {
+	defer close(msgs)
+
+	reconnected := false
+	for {
+		conn, err := r.dial(5*time.Second, 0, 0)
+		if err != nil {
+			r.health.Failed(err)
+			log.Errorf("ERROR: Unable to watch %s: %s", pattern, err)
+			if !sleepUnlessStopped(r.health.Backoff(), stop) {
+				return
+			}
+			reconnected = true
+			continue
+		}
+
+		psc := redis.PubSubConn{Conn: conn}
+
+		// closing the connection unblocks Receive
+		received := make(chan struct{})
+		go func() {
+			select {
+			case <-stop:
+				psc.Close()
+			case <-received:
+			}
+		}()
+
+		err = psc.PSubscribe(pattern)
+		for err == nil {
+			switch n := psc.Receive().(type) {
+			case redis.PMessage:
+				select {
+				case msgs <- n:
+				case <-stop:
+				}
+			case redis.Subscription:
+				r.health.OK()
+				if reconnected {
+					select {
+					case msgs <- redis.PMessage{}:
+					case <-stop:
+					}
+				}
+			case error:
+				err = n
+			}
+		}
+		close(received)
+		psc.Close()
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		r.health.Failed(err)
+		log.Errorf("ERROR: Lost watch on %s: %s", pattern, err)
+		reconnected = true
+		if !sleepUnlessStopped(r.health.Backoff(), stop) {
+			return
+		}
+	}
+}
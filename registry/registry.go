@@ -3,9 +3,13 @@ package registry
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/url"
 	"path"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	docker "github.com/fsouza/go-dockerclient"
@@ -18,8 +22,10 @@ All config opbects in redis will be stored in a hash with an id key.
 Services will have id, version and environment keys; while Hosts will have id
 and location keys.
 
-TODO: IMPORTANT: make an atomic compare-and-swap script to save configs, or
-      switch to ORDERED SETS and log changes
+Config and registration writes are made with compare-and-swap scripts so
+concurrent writers get ErrConflict rather than overwriting each other.
+
+TODO: switch to ORDERED SETS and log changes
 */
 
 const (
@@ -27,12 +33,20 @@ const (
 )
 
 type ServiceRegistry struct {
-	backend      RegistryBackend
-	Hostname     string
-	TTL          uint64
+	// conflicts counts the registrations saveRegistration refused.  It's
+	// first so it's 64-bit aligned for atomic updates.
+	conflicts uint64
+
+	backend  RegistryBackend
+	Hostname string
+	TTL      uint64
+	// Weight is used for registrations whose app doesn't set GALAXY_WEIGHT
+	Weight       int
 	OutputBuffer *utils.OutputBuffer
 	pollCh       chan bool
 	registryURL  string
+	// replica, if set, serves ListRegistrations
+	replica RegistryBackend
 }
 
 func NewServiceRegistry(ttl uint64) *ServiceRegistry {
@@ -43,38 +57,66 @@ func NewServiceRegistry(ttl uint64) *ServiceRegistry {
 
 }
 
-// Build the Redis Pool
+// Connect builds the backend for the scheme of registryURL
 func (r *ServiceRegistry) Connect(registryURL string) {
 
 	r.registryURL = registryURL
+	r.backend = newBackend(registryURL)
+	r.backend.Connect()
+}
+
+// Mirror copies all writes to the backend for mirrorURL as well.  Reads
+// still come from the backend given to Connect.
+func (r *ServiceRegistry) Mirror(mirrorURL string) {
+	secondary := newBackend(mirrorURL)
+	secondary.Connect()
+	r.backend = &MirrorBackend{
+		Primary:   r.backend,
+		Secondary: secondary,
+	}
+}
+
+// ReadReplica reads registration listings from the backend for replicaURL,
+// e.g. a redis replica, to take load off the primary.  Registrations are
+// still written to and refreshed against the primary.
+func (r *ServiceRegistry) ReadReplica(replicaURL string) {
+	r.replica = newBackend(replicaURL)
+	r.replica.Connect()
+}
+
+// VerifyMirror returns the differences between the registrations for env
+// in the primary and mirror backends.  It fails if Mirror was not called.
+func (r *ServiceRegistry) VerifyMirror(env string) ([]string, error) {
+	mirror, ok := r.backend.(*MirrorBackend)
+	if !ok {
+		return nil, fmt.Errorf("no mirror configured")
+	}
+	return mirror.Verify(path.Join(env, "*", "hosts", "*", "*", "*"))
+}
+
+// BackendStatus reports the connection health of the backend.  Backends
+// that don't track their connection are always reported as healthy.
+func (r *ServiceRegistry) BackendStatus() utils.BackendStatus {
+	if backend, ok := r.backend.(statusReporter); ok {
+		return backend.Status()
+	}
+	return utils.BackendStatus{Healthy: true}
+}
+
+func newBackend(registryURL string) RegistryBackend {
 	u, err := url.Parse(registryURL)
 	if err != nil {
 		log.Fatalf("ERROR: Unable to parse %s", err)
 	}
 
-	if strings.ToLower(u.Scheme) == "redis" {
-		r.backend = &RedisBackend{
-			RedisHost: u.Host,
-		}
-		r.backend.Connect()
-	} else {
+	factory, ok := lookupBackend(u.Scheme)
+	if !ok {
 		log.Fatalf("ERROR: Unsupported registry backend: %s", u)
 	}
+	return factory(*u)
 }
 
 func (r *ServiceRegistry) newServiceRegistration(container *docker.Container, hostIP string) *ServiceRegistration {
-	//FIXME: We're using the first found port and assuming it's tcp.
-	//How should we handle a service that exposes multiple ports
-	//as well as tcp vs udp ports.
-	var externalPort, internalPort string
-	for k, v := range container.NetworkSettings.Ports {
-		if len(v) > 0 {
-			externalPort = v[0].HostPort
-			internalPort = k.Port()
-			break
-		}
-	}
-
 	serviceRegistration := ServiceRegistration{
 		ContainerName: container.Name,
 		ContainerID:   container.ID,
@@ -82,21 +124,90 @@ func (r *ServiceRegistry) newServiceRegistration(container *docker.Container, ho
 		Image:         container.Config.Image,
 	}
 
-	if externalPort != "" && internalPort != "" {
+	ports := PublishedPorts(container)
+	if len(ports) > 0 {
+		primary := PrimaryPort(ports)
 		serviceRegistration.ExternalIP = hostIP
 		serviceRegistration.InternalIP = container.NetworkSettings.IPAddress
-		serviceRegistration.ExternalPort = externalPort
-		serviceRegistration.InternalPort = internalPort
+		if serviceRegistration.InternalIP == "" {
+			// host networking
+			serviceRegistration.InternalIP = hostIP
+		}
+		serviceRegistration.ExternalPort = primary.ExternalPort
+		serviceRegistration.InternalPort = primary.InternalPort
+		serviceRegistration.Protocol = primary.Protocol
+		serviceRegistration.Ports = ports
 	}
 	return &serviceRegistration
 }
 
+// PublishedPorts returns the container's ports that are published on the
+// host, keyed by the container port and protocol, e.g. "8080/tcp".  With
+// host networking every exposed port is on the host as is.
+func PublishedPorts(container *docker.Container) map[string]PortMapping {
+	ports := make(map[string]PortMapping)
+	if container.HostConfig != nil && container.HostConfig.NetworkMode == "host" && container.Config != nil {
+		for k := range container.Config.ExposedPorts {
+			ports[string(k)] = PortMapping{
+				InternalPort: k.Port(),
+				ExternalPort: k.Port(),
+				Protocol:     k.Proto(),
+			}
+		}
+		return ports
+	}
+
+	for k, v := range container.NetworkSettings.Ports {
+		if len(v) == 0 || v[0].HostPort == "" {
+			continue
+		}
+		ports[string(k)] = PortMapping{
+			InternalPort: k.Port(),
+			ExternalPort: v[0].HostPort,
+			Protocol:     k.Proto(),
+		}
+	}
+	return ports
+}
+
+// PrimaryPort picks the port reported as a registration's ExternalPort
+// and InternalPort: the lowest numbered tcp port, or the lowest numbered
+// port if there are only udp ones.
+func PrimaryPort(ports map[string]PortMapping) PortMapping {
+	var primary PortMapping
+	best := -1
+	for _, p := range ports {
+		n, _ := strconv.Atoi(p.InternalPort)
+		if p.Protocol == "tcp" {
+			// prefer tcp over any udp port
+			n -= 1 << 16
+		}
+		if best == -1 || n < best {
+			primary, best = p, n
+		}
+	}
+	return primary
+}
+
+// PortMapping is a container port published on the host.
+type PortMapping struct {
+	InternalPort string `json:"INTERNAL_PORT"`
+	ExternalPort string `json:"EXTERNAL_PORT"`
+	// Protocol is "tcp" or "udp"
+	Protocol string `json:"PROTOCOL"`
+	// Port is where shuttle listens for the port, from GALAXY_PORT_<port>
+	Port string `json:"PORT,omitempty"`
+}
+
 type ServiceRegistration struct {
-	Name          string            `json:"NAME,omitempty"`
-	ExternalIP    string            `json:"EXTERNAL_IP,omitempty"`
-	ExternalPort  string            `json:"EXTERNAL_PORT,omitempty"`
-	InternalIP    string            `json:"INTERNAL_IP,omitempty"`
-	InternalPort  string            `json:"INTERNAL_PORT,omitempty"`
+	Name         string `json:"NAME,omitempty"`
+	ExternalIP   string `json:"EXTERNAL_IP,omitempty"`
+	ExternalPort string `json:"EXTERNAL_PORT,omitempty"`
+	InternalIP   string `json:"INTERNAL_IP,omitempty"`
+	InternalPort string `json:"INTERNAL_PORT,omitempty"`
+	// Protocol is the primary port's, "tcp" or "udp".  Registrations made
+	// before it was recorded leave it empty and are tcp.
+	Protocol      string            `json:"PROTOCOL,omitempty"`
 	ContainerID   string            `json:"CONTAINER_ID"`
 	ContainerName string            `json:"CONTAINER_NAME"`
 	Image         string            `json:"IMAGE,omitempty"`
@@ -107,18 +218,68 @@ type ServiceRegistration struct {
 	VirtualHosts  []string          `json:"VIRTUAL_HOSTS"`
 	Port          string            `json:"PORT"`
 	ErrorPages    map[string]string `json:"ERROR_PAGES,omitempty"`
+	// Ports holds every published port, keyed by the container port and
+	// protocol, e.g. "8080/tcp".  ExternalPort and InternalPort are the
+	// primary one.
+	Ports map[string]PortMapping `json:"PORTS,omitempty"`
+	// Static registrations have no TTL and persist until removed
+	Static bool `json:"STATIC,omitempty"`
+	// External registrations are for services galaxy doesn't run, made by
+	// RegisterExternal
+	External bool `json:"EXTERNAL,omitempty"`
+	// TTL is the app's GALAXY_TTL in seconds.  Zero uses the registry's.
+	TTL uint64 `json:"TTL,omitempty"`
+	// Tags are from GALAXY_TAGS, e.g. "track=canary,sha=1a2b3c", for
+	// routing layers to select on
+	Tags map[string]string `json:"TAGS,omitempty"`
+	// Weight is the app's GALAXY_WEIGHT or the host's -weight, the share of
+	// traffic the proxy sends this container relative to others.  Zero
+	// means the proxy's default.
+	Weight int `json:"WEIGHT,omitempty"`
+	// Canary is set for containers running an app's canary version, from
+	// GALAXY_CANARY
+	Canary bool `json:"CANARY,omitempty"`
+	// CanaryPercent is the share of the app's traffic proxies should send
+	// its canaries, or 0 to weigh them like the rest
+	CanaryPercent int `json:"CANARY_PERCENT,omitempty"`
+	// Color is "green" for containers running the green version of a
+	// blue/green deploy, from GALAXY_COLOR, and empty for blue ones
+	Color string `json:"COLOR,omitempty"`
+	// DeployID is the config change that started the container, from
+	// GALAXY_DEPLOY
+	DeployID string `json:"DEPLOY_ID,omitempty"`
+	// State is RegistrationDraining for drained registrations and empty
+	// otherwise
+	State string `json:"STATE,omitempty"`
+	// DrainUntil is when a draining registration's grace period ends
+	DrainUntil *time.Time `json:"DRAIN_UNTIL,omitempty"`
+}
+
+// ttl returns how long the registration lives without being refreshed.
+func (s *ServiceRegistration) ttl(defaultTTL uint64) uint64 {
+	if s.TTL > 0 {
+		return s.TTL
+	}
+	return defaultTTL
 }
 
 func (s *ServiceRegistration) Equals(other ServiceRegistration) bool {
 	return s.ExternalIP == other.ExternalIP &&
 		s.ExternalPort == other.ExternalPort &&
 		s.InternalIP == other.InternalIP &&
-		s.InternalPort == other.InternalPort
+		s.InternalPort == other.InternalPort &&
+		s.Protocol == other.Protocol &&
+		s.Weight == other.Weight &&
+		s.Canary == other.Canary &&
+		s.CanaryPercent == other.CanaryPercent &&
+		s.Color == other.Color &&
+		reflect.DeepEqual(s.Ports, other.Ports)
 }
 
+// addr joins ip and port, bracketing IPv6 addresses, e.g. [fd00::1]:8080.
 func (s *ServiceRegistration) addr(ip, port string) string {
 	if ip != "" && port != "" {
-		return fmt.Sprint(ip, ":", port)
+		return net.JoinHostPort(ip, port)
 	}
 	return ""
 
@@ -131,6 +292,35 @@ func (s *ServiceRegistration) InternalAddr() string {
 	return s.addr(s.InternalIP, s.InternalPort)
 }
 
+// IsUDP returns true if the primary port is a udp port.
+func (s *ServiceRegistration) IsUDP() bool {
+	return s.Protocol == "udp"
+}
+
+// IsPrimary returns true if p is the port in ExternalPort and InternalPort.
+func (s *ServiceRegistration) IsPrimary(p PortMapping) bool {
+	return p.InternalPort == s.InternalPort && p.ExternalPort == s.ExternalPort
+}
+
+// ExternalAddrFor returns the host address for a published port, e.g.
+// "8080/tcp", or "" if it isn't published.
+func (s *ServiceRegistration) ExternalAddrFor(port string) string {
+	p, ok := s.Ports[port]
+	if !ok {
+		return ""
+	}
+	return s.addr(s.ExternalIP, p.ExternalPort)
+}
+
+// InternalAddrFor returns the container address for a published port.
+func (s *ServiceRegistration) InternalAddrFor(port string) string {
+	p, ok := s.Ports[port]
+	if !ok {
+		return ""
+	}
+	return s.addr(s.InternalIP, p.InternalPort)
+}
+
 func (r *ServiceRegistry) RegisterService(env, pool, hostIP string, container *docker.Container) (*ServiceRegistration, error) {
 	environment := r.EnvFor(container)
 
@@ -169,25 +359,226 @@ func (r *ServiceRegistry) RegisterService(env, pool, hostIP string, container *d
 	}
 
 	serviceRegistration.Port = environment["GALAXY_PORT"]
+	for k, p := range serviceRegistration.Ports {
+		p.Port = environment["GALAXY_PORT_"+p.InternalPort]
+		if p.Port == "" && serviceRegistration.IsPrimary(p) {
+			p.Port = serviceRegistration.Port
+		}
+		serviceRegistration.Ports[k] = p
+	}
+	serviceRegistration.Static = environment["GALAXY_STATIC"] == "true"
+	serviceRegistration.Tags = parseTags(environment["GALAXY_TAGS"])
+	if v := environment["GALAXY_TTL"]; v != "" {
+		ttl, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || ttl == 0 {
+			log.Warnf("WARN: Ignoring invalid GALAXY_TTL %q for %s", v, name)
+		} else {
+			serviceRegistration.TTL = ttl
+		}
+	}
+
+	serviceRegistration.Weight = r.Weight
+	if v := environment["GALAXY_WEIGHT"]; v != "" {
+		weight, err := strconv.Atoi(v)
+		if err != nil || weight <= 0 {
+			log.Warnf("WARN: Ignoring invalid GALAXY_WEIGHT %q for %s", v, name)
+		} else {
+			serviceRegistration.Weight = weight
+		}
+	}
+
+	if v, ok := environment["GALAXY_CANARY"]; ok {
+		serviceRegistration.Canary = true
+		percent, err := strconv.Atoi(v)
+		if err != nil || percent < 0 || percent >= 100 {
+			log.Warnf("WARN: Ignoring invalid GALAXY_CANARY %q for %s", v, name)
+		} else {
+			serviceRegistration.CanaryPercent = percent
+		}
+	}
+
+	serviceRegistration.Color = environment["GALAXY_COLOR"]
+	serviceRegistration.DeployID = environment["GALAXY_DEPLOY"]
 
-	jsonReg, err := json.Marshal(serviceRegistration)
+	err := r.saveRegistration(registrationPath, serviceRegistration)
 	if err != nil {
 		return nil, err
 	}
+	return serviceRegistration, nil
+}
+
+// parseTags parses comma separated key=value pairs.  A key without a value
+// is set to "".  Returns nil if there are no tags.
+func parseTags(s string) map[string]string {
+	var tags map[string]string
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if key == "" {
+			continue
+		}
+
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[key] = ""
+		if len(parts) == 2 {
+			tags[key] = strings.TrimSpace(parts[1])
+		}
+	}
+	return tags
+}
+
+// saveRegistration writes reg to regPath unless it was changed since we
+// read it, or it's new and another container is registered at one of its
+// addresses.  Static registrations are saved without a TTL.  A drained
+// registration keeps its drain state.
+func (r *ServiceRegistry) saveRegistration(regPath string, reg *ServiceRegistration) error {
+	existing, err := r.backend.Get(regPath, "location")
+	if err != nil {
+		return err
+	}
+
+	if existing == "" {
+		// e.g. two hosts configured with the same IP, or a container that
+		// was never unregistered, so don't let the last one win.  Refreshes
+		// were already checked when they were first saved.
+		conflict, err := r.findConflict(regPath, reg)
+		if err != nil {
+			return err
+		}
+		if conflict != nil {
+			atomic.AddUint64(&r.conflicts, 1)
+			return conflict
+		}
+	} else {
+		old := ServiceRegistration{}
+		if json.Unmarshal([]byte(existing), &old) == nil {
+			// refreshing a drained registration keeps it draining
+			reg.State = old.State
+			reg.DrainUntil = old.DrainUntil
+		}
+	}
+
+	jsonReg, err := json.Marshal(reg)
+	if err != nil {
+		return err
+	}
+
+	ttl := reg.ttl(r.TTL)
+	if reg.Static {
+		ttl = 0
+	}
+
+	saved, err := r.backend.CompareAndSet(regPath, "location", existing, string(jsonReg), ttl)
+	if err != nil {
+		return err
+	}
+
+	if !saved {
+		return ErrConflict
+	}
+
+	reg.Expires = time.Time{}
+	if !reg.Static {
+		reg.Expires = time.Now().UTC().Add(time.Duration(ttl) * time.Second)
+	}
+	return nil
+}
+
+// externalAddrs returns the host addresses reg is reachable at, like
+// 10.0.1.5:8000/tcp.
+func (reg *ServiceRegistration) externalAddrs() []string {
+	if reg.ExternalIP == "" {
+		return nil
+	}
+
+	addr := func(port, protocol string) string {
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		return net.JoinHostPort(reg.ExternalIP, port) + "/" + protocol
+	}
 
-	// TODO: use a compare-and-swap SCRIPT
-	_, err = r.backend.Set(registrationPath, "location", string(jsonReg))
+	addrs := []string{}
+	if reg.ExternalPort != "" {
+		addrs = append(addrs, addr(reg.ExternalPort, reg.Protocol))
+	}
+	for _, mapping := range reg.Ports {
+		if mapping.ExternalPort != "" {
+			addrs = append(addrs, addr(mapping.ExternalPort, mapping.Protocol))
+		}
+	}
+	return addrs
+}
+
+// findConflict returns a ConflictError if another container's registration
+// in regPath's env, one that hasn't expired, has one of reg's addresses.
+func (r *ServiceRegistry) findConflict(regPath string, reg *ServiceRegistration) (*ConflictError, error) {
+	addrs := reg.externalAddrs()
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+
+	// env/pool/hosts/ip/app/container
+	env := strings.Split(regPath, "/")[0]
+	keys, err := r.backend.Keys(path.Join(env, "*", "hosts", "*", "*", "*"))
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = r.backend.Expire(registrationPath, r.TTL)
+	values, err := r.backend.GetMulti(keys, "location")
 	if err != nil {
 		return nil, err
 	}
-	serviceRegistration.Expires = time.Now().UTC().Add(time.Duration(r.TTL) * time.Second)
 
-	return serviceRegistration, nil
+	for i, key := range keys {
+		if key == regPath || values[i] == "" {
+			continue
+		}
+
+		other := ServiceRegistration{}
+		if json.Unmarshal([]byte(values[i]), &other) != nil || other.ContainerID == reg.ContainerID {
+			continue
+		}
+
+		for _, addr := range other.externalAddrs() {
+			if utils.StringInSlice(addr, addrs) {
+				return &ConflictError{
+					Path:           regPath,
+					ContainerID:    reg.ContainerID,
+					Address:        addr,
+					Registered:     other.ContainerID,
+					RegisteredPath: key,
+				}, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// ConflictError is returned when a container is registered at an address
+// that already belongs to another container.
+type ConflictError struct {
+	Path        string
+	ContainerID string
+	// Address is the address both containers claim
+	Address string
+	// Registered is the container the address belongs to, registered at
+	// RegisteredPath
+	Registered     string
+	RegisteredPath string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s is registered by container %s at %s, not %s",
+		e.Address, e.Registered, e.RegisteredPath, e.ContainerID)
+}
+
+// ConflictCount returns how many registrations were refused because their
+// address belonged to another container.
+func (r *ServiceRegistry) ConflictCount() uint64 {
+	return atomic.LoadUint64(&r.conflicts)
 }
 
 func (r *ServiceRegistry) UnRegisterService(env, pool, hostIP string, container *docker.Container) (*ServiceRegistration, error) {
@@ -218,6 +609,51 @@ func (r *ServiceRegistry) UnRegisterService(env, pool, hostIP string, container
 	return registration, nil
 }
 
+// UnRegisterStale removes the registrations on hostIP whose containers
+// aren't in running, e.g. ones that died while nothing was watching, and
+// returns their paths.  External registrations are left alone.
+func (r *ServiceRegistry) UnRegisterStale(env, pool, hostIP string, running []*docker.Container) ([]string, error) {
+	keys, err := r.backend.Keys(path.Join(env, pool, "hosts", hostIP, "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]bool)
+	for _, container := range running {
+		ids[container.ID[0:12]] = true
+	}
+
+	stale := []string{}
+	for _, key := range keys {
+		if len(strings.Split(key, "/")) == 6 && !ids[path.Base(key)] {
+			stale = append(stale, key)
+		}
+	}
+
+	values, err := r.backend.GetMulti(stale, "location")
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []string{}
+	for i, key := range stale {
+		// external services share the host's IP but aren't containers
+		reg := ServiceRegistration{}
+		if values[i] != "" && json.Unmarshal([]byte(values[i]), &reg) == nil && reg.External {
+			continue
+		}
+
+		deleted, err := r.backend.Delete(key)
+		if err != nil {
+			return removed, err
+		}
+		if deleted > 0 {
+			removed = append(removed, key)
+		}
+	}
+	return removed, nil
+}
+
 func (r *ServiceRegistry) GetServiceRegistration(env, pool, hostIP string, container *docker.Container) (*ServiceRegistration, error) {
 
 	environment := r.EnvFor(container)
@@ -245,6 +681,10 @@ func (r *ServiceRegistry) GetServiceRegistration(env, pool, hostIP string, conta
 			return nil, err
 		}
 
+		if existingRegistration.Static {
+			return &existingRegistration, nil
+		}
+
 		expires, err := r.backend.Ttl(regPath)
 		if err != nil {
 			return nil, err
@@ -262,21 +702,47 @@ func (r *ServiceRegistry) IsRegistered(env, pool, hostIP string, container *dock
 	return reg != nil, err
 }
 
+// RestoreRegistration writes reg to reg.Path with the registry's TTL, e.g.
+// from a backup.  It expires like any other registration unless an agent
+// takes it over.  Static registrations are restored without a TTL.
+func (r *ServiceRegistry) RestoreRegistration(reg *ServiceRegistration) error {
+	jsonReg, err := json.Marshal(reg)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.backend.Set(reg.Path, "location", string(jsonReg))
+	if err != nil || reg.Static {
+		return err
+	}
+
+	_, err = r.backend.Expire(reg.Path, reg.ttl(r.TTL))
+	return err
+}
+
 // TODO: get all ServiceRegistrations
 func (r *ServiceRegistry) ListRegistrations(env string) ([]ServiceRegistration, error) {
+	backend := r.backend
+	if r.replica != nil {
+		backend = r.replica
+	}
 
-	// TODO: convert to scan
-	keys, err := r.backend.Keys(path.Join(env, "*", "hosts", "*", "*", "*"))
+	keys, err := backend.Keys(path.Join(env, "*", "hosts", "*", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := backend.GetMulti(keys, "location")
 	if err != nil {
 		return nil, err
 	}
 
 	var regList []ServiceRegistration
-	for _, key := range keys {
+	for i, key := range keys {
 
-		val, err := r.backend.Get(key, "location")
-		if err != nil {
-			log.Warnf("WARN: Unable to get location for %s: %s", key, err)
+		val := values[i]
+		if val == "" {
+			// expired between listing and reading it
 			continue
 		}
 
@@ -291,12 +757,42 @@ func (r *ServiceRegistry) ListRegistrations(env string) ([]ServiceRegistration,
 
 		svcReg.Path = key
 
+		// drained registrations stay behind until their containers stop
+		if svcReg.IsDrained() {
+			continue
+		}
+
 		regList = append(regList, svcReg)
 	}
 
 	return regList, nil
 }
 
+// LoadExpires sets the Expires of each of registrations from its key's TTL.
+// ListRegistrations leaves it unset to save a round trip per key.  Static
+// registrations and ones that have already expired are left unset.
+func (r *ServiceRegistry) LoadExpires(registrations []ServiceRegistration) error {
+	backend := r.backend
+	if r.replica != nil {
+		backend = r.replica
+	}
+
+	now := time.Now().UTC()
+	for i := range registrations {
+		if registrations[i].Static || registrations[i].Path == "" {
+			continue
+		}
+		ttl, err := backend.Ttl(registrations[i].Path)
+		if err != nil {
+			return err
+		}
+		if ttl > 0 {
+			registrations[i].Expires = now.Add(time.Duration(ttl) * time.Second)
+		}
+	}
+	return nil
+}
+
 func (s *ServiceRegistry) EnvFor(container *docker.Container) map[string]string {
 	env := map[string]string{}
 	for _, item := range container.Config.Env {
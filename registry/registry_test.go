@@ -0,0 +1,183 @@
+package registry
+
+import (
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestSaveRegistrationConflicts(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	web := &ServiceRegistration{
+		Name:         "web",
+		ContainerID:  "aaaaaaaaaaaa1",
+		ExternalIP:   "10.0.0.1",
+		ExternalPort: "8000",
+		Ports: map[string]PortMapping{
+			"80/tcp":  {InternalPort: "80", ExternalPort: "8000", Protocol: "tcp"},
+			"53/udp":  {InternalPort: "53", ExternalPort: "8053", Protocol: "udp"},
+			"443/tcp": {InternalPort: "443", ExternalPort: "8443", Protocol: "tcp"},
+		},
+	}
+	webPath := "dev/web/hosts/10.0.0.1/web/aaaaaaaaaaaa"
+	if err := r.saveRegistration(webPath, web); err != nil {
+		t.Fatal(err)
+	}
+
+	// refreshing it isn't a conflict with itself
+	if err := r.saveRegistration(webPath, web); err != nil {
+		t.Fatalf("unexpected error refreshing: %s", err)
+	}
+
+	for _, test := range []struct {
+		path     string
+		reg      *ServiceRegistration
+		conflict string
+	}{
+		// same host port
+		{"dev/web/hosts/10.0.0.1/api/bbbbbbbbbbbb",
+			&ServiceRegistration{ContainerID: "bbbbbbbbbbbb1", ExternalIP: "10.0.0.1", ExternalPort: "8000"},
+			"10.0.0.1:8000/tcp"},
+		// one of its other ports, from a host in another pool with the same IP
+		{"dev/worker/hosts/10.0.0.1/api/cccccccccccc",
+			&ServiceRegistration{ContainerID: "cccccccccccc1", ExternalIP: "10.0.0.1",
+				Ports: map[string]PortMapping{"443/tcp": {ExternalPort: "8443"}}},
+			"10.0.0.1:8443/tcp"},
+		// the same port with another protocol
+		{"dev/web/hosts/10.0.0.1/api/dddddddddddd",
+			&ServiceRegistration{ContainerID: "dddddddddddd1", ExternalIP: "10.0.0.1", ExternalPort: "8053", Protocol: "tcp"},
+			""},
+		// the same port on another host
+		{"dev/web/hosts/10.0.0.2/api/eeeeeeeeeeee",
+			&ServiceRegistration{ContainerID: "eeeeeeeeeeee1", ExternalIP: "10.0.0.2", ExternalPort: "8000"},
+			""},
+		// another env
+		{"prod/web/hosts/10.0.0.1/api/ffffffffffff",
+			&ServiceRegistration{ContainerID: "ffffffffffff1", ExternalIP: "10.0.0.1", ExternalPort: "8000"},
+			""},
+		// no published ports
+		{"dev/web/hosts/10.0.0.1/api/000000000000",
+			&ServiceRegistration{ContainerID: "0000000000001", ExternalIP: "10.0.0.1"},
+			""},
+	} {
+		err := r.saveRegistration(test.path, test.reg)
+		if test.conflict == "" {
+			if err != nil {
+				t.Fatalf("unexpected error saving %s: %s", test.path, err)
+			}
+			continue
+		}
+
+		conflict, ok := err.(*ConflictError)
+		if !ok {
+			t.Fatalf("expected a conflict saving %s. Got %v", test.path, err)
+		}
+		if conflict.Address != test.conflict || conflict.Registered != web.ContainerID || conflict.RegisteredPath != webPath {
+			t.Fatalf("expected %s to conflict with %s at %s. Got %s", test.path, webPath, test.conflict, conflict)
+		}
+	}
+
+	if r.ConflictCount() != 2 {
+		t.Fatalf("expected 2 conflicts. Got %d", r.ConflictCount())
+	}
+
+	// once web is gone its port is free
+	if _, err := r.backend.Delete(webPath); err != nil {
+		t.Fatal(err)
+	}
+	reg := &ServiceRegistration{ContainerID: "bbbbbbbbbbbb1", ExternalIP: "10.0.0.1", ExternalPort: "8000"}
+	if err := r.saveRegistration("dev/web/hosts/10.0.0.1/api/bbbbbbbbbbbb", reg); err != nil {
+		t.Fatalf("unexpected error after the conflict was removed: %s", err)
+	}
+}
+
+func TestPrimaryPort(t *testing.T) {
+	for _, test := range []struct {
+		ports   []PortMapping
+		primary string
+	}{
+		{[]PortMapping{{InternalPort: "8080", Protocol: "tcp"}}, "8080"},
+		{[]PortMapping{
+			{InternalPort: "9000", Protocol: "tcp"},
+			{InternalPort: "443", Protocol: "tcp"},
+			{InternalPort: "8080", Protocol: "tcp"},
+		}, "443"},
+		// tcp wins over a lower udp port
+		{[]PortMapping{
+			{InternalPort: "53", Protocol: "udp"},
+			{InternalPort: "8080", Protocol: "tcp"},
+		}, "8080"},
+		{[]PortMapping{
+			{InternalPort: "8125", Protocol: "udp"},
+			{InternalPort: "53", Protocol: "udp"},
+		}, "53"},
+		{nil, ""},
+	} {
+		ports := make(map[string]PortMapping)
+		for _, p := range test.ports {
+			ports[p.InternalPort+"/"+p.Protocol] = p
+		}
+		for i := 0; i < 10; i++ {
+			if primary := PrimaryPort(ports); primary.InternalPort != test.primary {
+				t.Fatalf("expected %q to be the primary port of %v. Got %q", test.primary, test.ports, primary.InternalPort)
+			}
+		}
+	}
+}
+
+func TestRegisterServicePorts(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	container := &docker.Container{
+		ID:   "aaaaaaaaaaaa1",
+		Name: "/web",
+		Config: &docker.Config{
+			Image: "web:v1",
+			Env:   []string{"GALAXY_APP=web", "GALAXY_PORT=10000", "GALAXY_PORT_9000=10001"},
+		},
+		NetworkSettings: &docker.NetworkSettings{
+			IPAddress: "172.17.0.2",
+			Ports: map[docker.Port][]docker.PortBinding{
+				"8080/tcp": {{HostIP: "0.0.0.0", HostPort: "20000"}},
+				"9000/tcp": {{HostIP: "0.0.0.0", HostPort: "20001"}},
+				"8125/udp": {{HostIP: "0.0.0.0", HostPort: "20002"}},
+				// exposed but not published
+				"7000/tcp": {},
+			},
+		},
+	}
+
+	reg, err := r.RegisterService("dev", "web", "10.0.0.1", container)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reg.ExternalPort != "20000" || reg.InternalPort != "8080" || reg.Protocol != "tcp" {
+		t.Fatalf("expected 8080/tcp on 20000 to be the primary port. Got %s/%s on %s",
+			reg.InternalPort, reg.Protocol, reg.ExternalPort)
+	}
+	if len(reg.Ports) != 3 {
+		t.Fatalf("expected 3 published ports. Got %v", reg.Ports)
+	}
+	for port, shuttle := range map[string]string{
+		"8080/tcp": "10000",
+		"9000/tcp": "10001",
+		"8125/udp": "",
+	} {
+		if reg.Ports[port].Port != shuttle {
+			t.Fatalf("expected %s to have shuttle port %q. Got %q", port, shuttle, reg.Ports[port].Port)
+		}
+	}
+	if addr := reg.ExternalAddrFor("9000/tcp"); addr != "10.0.0.1:20001" {
+		t.Fatalf("expected 9000/tcp at 10.0.0.1:20001. Got %s", addr)
+	}
+	if addr := reg.InternalAddrFor("8125/udp"); addr != "172.17.0.2:8125" {
+		t.Fatalf("expected 8125/udp at 172.17.0.2:8125. Got %s", addr)
+	}
+	if addr := reg.ExternalAddrFor("7000/tcp"); addr != "" {
+		t.Fatalf("expected 7000/tcp not to be published. Got %s", addr)
+	}
+}
@@ -0,0 +1,53 @@
+package registry
+
+import (
+	"path"
+	"strconv"
+)
+
+func restartSlotKey(env, app string, slot int) string {
+	return path.Join(env, "restarts", app, strconv.Itoa(slot))
+}
+
+// AcquireRestartSlot claims one of batch slots for owner to restart one of
+// app's containers, keeping a rolling restart from taking more than batch
+// containers down at once.  The slot expires after ttl seconds in case its
+// owner dies.  It returns false if all of the slots are taken.
+func (r *ServiceRegistry) AcquireRestartSlot(env, app, owner string, batch int, ttl uint64) (bool, error) {
+	for slot := 0; slot < batch; slot++ {
+		key := restartSlotKey(env, app, slot)
+		current, err := r.backend.Get(key, "owner")
+		if err != nil {
+			return false, err
+		}
+		if current != "" && current != owner {
+			continue
+		}
+
+		claimed, err := r.backend.CompareAndSet(key, "owner", current, owner, ttl)
+		if err != nil {
+			return false, err
+		}
+		if claimed {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ReleaseRestartSlot gives back the slot owner claimed with
+// AcquireRestartSlot.
+func (r *ServiceRegistry) ReleaseRestartSlot(env, app, owner string, batch int) error {
+	for slot := 0; slot < batch; slot++ {
+		key := restartSlotKey(env, app, slot)
+		current, err := r.backend.Get(key, "owner")
+		if err != nil {
+			return err
+		}
+		if current == owner {
+			_, err = r.backend.Delete(key)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package registry
+
+import (
+	"testing"
+)
+
+func TestRestartSlots(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	for _, test := range []struct {
+		owner   string
+		claimed bool
+	}{
+		{"10.0.0.1/aaaaaaaaaaaa", true},
+		{"10.0.0.2/bbbbbbbbbbbb", true},
+		// both slots are taken
+		{"10.0.0.3/cccccccccccc", false},
+		// an owner can claim its own slot again
+		{"10.0.0.1/aaaaaaaaaaaa", true},
+	} {
+		claimed, err := r.AcquireRestartSlot("dev", "web", test.owner, 2, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed != test.claimed {
+			t.Fatalf("expected %s claimed %t. Got %t", test.owner, test.claimed, claimed)
+		}
+	}
+
+	// another app has its own slots
+	claimed, err := r.AcquireRestartSlot("dev", "api", "10.0.0.3/cccccccccccc", 2, 60)
+	if err != nil || !claimed {
+		t.Fatalf("expected a slot for another app. Got %t, %v", claimed, err)
+	}
+
+	// releasing a slot that isn't held doesn't free another owner's
+	err = r.ReleaseRestartSlot("dev", "web", "10.0.0.3/cccccccccccc", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimed, _ = r.AcquireRestartSlot("dev", "web", "10.0.0.3/cccccccccccc", 2, 60)
+	if claimed {
+		t.Fatal("expected the slots to still be taken")
+	}
+
+	err = r.ReleaseRestartSlot("dev", "web", "10.0.0.1/aaaaaaaaaaaa", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimed, err = r.AcquireRestartSlot("dev", "web", "10.0.0.3/cccccccccccc", 2, 60)
+	if err != nil || !claimed {
+		t.Fatalf("expected the released slot to be claimed. Got %t, %v", claimed, err)
+	}
+}
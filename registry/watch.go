@@ -0,0 +1,233 @@
+package registry
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/utils"
+)
+
+// watchPollInterval is how often backends without change notifications are
+// polled by Watch.
+var watchPollInterval = 2 * time.Second
+
+type KeyEventType string
+
+const (
+	KeySet     KeyEventType = "set"
+	KeyDeleted KeyEventType = "delete"
+	KeyExpired KeyEventType = "expire"
+)
+
+// KeyEvent is a change to a registry key seen by Watch.  Value is the new
+// location for KeySet events.
+type KeyEvent struct {
+	Key   string
+	Type  KeyEventType
+	Value string
+}
+
+// keyCache remembers the last location seen for each key so that rewrites
+// of the same value, e.g. a registration being refreshed, aren't reported.
+type keyCache map[string]string
+
+// changed records value for key and returns true if it differs from what
+// was last seen.
+func (c keyCache) changed(key, value string) bool {
+	old, ok := c[key]
+	c[key] = value
+	return !ok || old != value
+}
+
+// sync updates the cache from the current locations and returns the
+// differences.
+func (c keyCache) sync(current map[string]string) []KeyEvent {
+	events := []KeyEvent{}
+	for key, value := range current {
+		if value == "" {
+			// expired between listing and reading it
+			delete(current, key)
+			continue
+		}
+		if c.changed(key, value) {
+			events = append(events, KeyEvent{Key: key, Type: KeySet, Value: value})
+		}
+	}
+
+	for key := range c {
+		if _, ok := current[key]; !ok {
+			delete(c, key)
+			events = append(events, KeyEvent{Key: key, Type: KeyDeleted})
+		}
+	}
+	return events
+}
+
+// sendEvents sends each event unless stop is closed first, and returns
+// false if it was.
+func sendEvents(events chan KeyEvent, stop chan struct{}, evs ...KeyEvent) bool {
+	for _, event := range evs {
+		select {
+		case events <- event:
+		case <-stop:
+			return false
+		}
+	}
+	return true
+}
+
+// sleepUnlessStopped waits for d and returns false if stop is closed
+// first.
+func sleepUnlessStopped(d time.Duration, stop chan struct{}) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// pollWatch emulates Watch for backends without change notifications by
+// comparing the locations matching pattern every watchPollInterval.  Since a
+// poll can't tell a delete from an expiration, removed keys are reported
+// as KeyDeleted.
+func pollWatch(backend RegistryBackend, pattern string, stop chan struct{}) chan KeyEvent {
+	events := make(chan KeyEvent)
+	go func() {
+		defer close(events)
+
+		var health utils.BackendHealth
+		seen := keyCache{}
+		first := true
+		for {
+			current, err := locations(backend, pattern)
+			if err != nil {
+				health.Failed(err)
+				log.Warnf("WARN: Unable to poll %s: %s", pattern, err)
+				if !sleepUnlessStopped(health.Backoff(), stop) {
+					return
+				}
+				continue
+			}
+			health.OK()
+
+			changes := seen.sync(current)
+			// keys that exist when the watch starts aren't changes
+			if !first && !sendEvents(events, stop, changes...) {
+				return
+			}
+			first = false
+
+			if !sleepUnlessStopped(watchPollInterval, stop) {
+				return
+			}
+		}
+	}()
+	return events
+}
+
+type RegistrationEventType string
+
+const (
+	RegistrationAdded   RegistrationEventType = "add"
+	RegistrationUpdated RegistrationEventType = "update"
+	RegistrationExpired RegistrationEventType = "expire"
+	RegistrationRemoved RegistrationEventType = "remove"
+)
+
+// RegistrationEvent is a change to a registration seen by
+// WatchRegistrations.  For expire and remove events, Registration is the
+// last one seen, or nil if it was never seen.
+type RegistrationEvent struct {
+	Type         RegistrationEventType
+	Path         string
+	Registration *ServiceRegistration
+}
+
+// isRegistrationKey returns true for env/pool/hosts/ip/app/container keys.
+func isRegistrationKey(key string) bool {
+	parts := strings.Split(key, "/")
+	return len(parts) == 6 && parts[2] == "hosts"
+}
+
+// WatchRegistrations sends an event for every registration in env that's
+// added, updated, expires or is removed until stop is closed.  Refreshes
+// that don't change a registration aren't sent.
+func (r *ServiceRegistry) WatchRegistrations(env string, stop chan struct{}) (chan RegistrationEvent, error) {
+	return r.watchRegistrations(path.Join(env, "*", "hosts", "*", "*", "*"), stop)
+}
+
+// WatchApp is WatchRegistrations for one app's registrations in env and
+// pool, or every pool if pool is "".  Other apps' changes aren't read at
+// all on backends with change notifications.
+func (r *ServiceRegistry) WatchApp(env, pool, app string, stop chan struct{}) (chan RegistrationEvent, error) {
+	if pool == "" {
+		pool = "*"
+	}
+	return r.watchRegistrations(path.Join(env, pool, "hosts", "*", app, "*"), stop)
+}
+
+func (r *ServiceRegistry) watchRegistrations(pattern string, stop chan struct{}) (chan RegistrationEvent, error) {
+	keys, err := r.backend.Keys(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := r.backend.Watch(pattern, stop)
+	if err != nil {
+		return nil, err
+	}
+
+	// registrations that exist now are updated, not added, when they change
+	known := make(map[string]*ServiceRegistration)
+	for _, key := range keys {
+		known[key] = nil
+	}
+
+	events := make(chan RegistrationEvent)
+	go func() {
+		defer close(events)
+		for change := range changes {
+			if !isRegistrationKey(change.Key) {
+				continue
+			}
+
+			event := RegistrationEvent{Path: change.Key}
+			switch change.Type {
+			case KeySet:
+				reg := &ServiceRegistration{Name: path.Base(path.Dir(change.Key))}
+				err := json.Unmarshal([]byte(change.Value), reg)
+				if err != nil {
+					log.Warnf("WARN: Unable to unmarshal JSON for %s: %s", change.Key, err)
+					continue
+				}
+				reg.Path = change.Key
+
+				event.Type = RegistrationAdded
+				if _, ok := known[change.Key]; ok {
+					event.Type = RegistrationUpdated
+				}
+				known[change.Key] = reg
+				event.Registration = reg
+
+			case KeyDeleted, KeyExpired:
+				event.Type = RegistrationRemoved
+				if change.Type == KeyExpired {
+					event.Type = RegistrationExpired
+				}
+				event.Registration = known[change.Key]
+				delete(known, change.Key)
+			}
+
+			select {
+			case events <- event:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return events, nil
+}
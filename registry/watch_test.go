@@ -0,0 +1,114 @@
+package registry
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestKeyCacheSync(t *testing.T) {
+	c := keyCache{}
+	for _, test := range []struct {
+		current map[string]string
+		events  []string
+	}{
+		{map[string]string{"a": "1", "b": "1"}, []string{"set a", "set b"}},
+		// refreshes aren't changes
+		{map[string]string{"a": "1", "b": "1"}, []string{}},
+		{map[string]string{"a": "2", "b": "1", "c": "1"}, []string{"set a", "set c"}},
+		// expired between listing and reading it
+		{map[string]string{"a": "2", "b": "", "c": "1"}, []string{"delete b"}},
+		{map[string]string{}, []string{"delete a", "delete c"}},
+	} {
+		events := []string{}
+		for _, event := range c.sync(test.current) {
+			events = append(events, string(event.Type)+" "+event.Key)
+		}
+		sort.Strings(events)
+		if len(events) != len(test.events) {
+			t.Fatalf("expected %v for %v. Got %v", test.events, test.current, events)
+		}
+		for i := range events {
+			if events[i] != test.events[i] {
+				t.Fatalf("expected %v for %v. Got %v", test.events, test.current, events)
+			}
+		}
+	}
+}
+
+func TestIsRegistrationKey(t *testing.T) {
+	for key, expected := range map[string]bool{
+		"dev/web/hosts/10.0.0.1/web/aaaaaaaaaaaa": true,
+		"dev/web/hosts/10.0.0.1/info":             false,
+		"dev/ports/20000":                         false,
+		"dev/web/pools/10.0.0.1/web/aaaaaaaaaaaa": false,
+	} {
+		if isRegistrationKey(key) != expected {
+			t.Fatalf("expected isRegistrationKey(%s) to be %t", key, expected)
+		}
+	}
+}
+
+func TestWatchRegistrations(t *testing.T) {
+	r, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	interval := watchPollInterval
+	watchPollInterval = 10 * time.Millisecond
+	defer func() { watchPollInterval = interval }()
+
+	existing := "dev/web/hosts/10.0.0.1/web/aaaaaaaaaaaa"
+	added := "dev/web/hosts/10.0.0.2/web/bbbbbbbbbbbb"
+	setTestKey(t, r, existing, "location", `{"EXTERNAL_PORT":"20000"}`, 0)
+
+	stop := make(chan struct{})
+	events, err := r.WatchRegistrations("dev", stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := func() RegistrationEvent {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected a registration event")
+		}
+		return RegistrationEvent{}
+	}
+
+	// give the first poll time to see what's already there
+	time.Sleep(50 * time.Millisecond)
+	setTestKey(t, r, existing, "location", `{"EXTERNAL_PORT":"20001"}`, 0)
+	event := next()
+	if event.Type != RegistrationUpdated || event.Path != existing ||
+		event.Registration.Name != "web" || event.Registration.ExternalPort != "20001" {
+		t.Fatalf("expected %s to be updated. Got %+v", existing, event)
+	}
+
+	setTestKey(t, r, added, "location", `{"EXTERNAL_PORT":"20002"}`, 0)
+	setTestKey(t, r, "dev/web/hosts/10.0.0.2/info", "hostname", "b", 0)
+	event = next()
+	if event.Type != RegistrationAdded || event.Path != added {
+		t.Fatalf("expected %s to be added. Got %+v", added, event)
+	}
+
+	if _, err := r.backend.Delete(added); err != nil {
+		t.Fatal(err)
+	}
+	event = next()
+	if event.Type != RegistrationRemoved || event.Path != added ||
+		event.Registration == nil || event.Registration.ExternalPort != "20002" {
+		t.Fatalf("expected %s to be removed with its last registration. Got %+v", added, event)
+	}
+
+	close(stop)
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("expected no more events after the watch stopped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the events to be closed once stopped")
+	}
+}
@@ -0,0 +1,72 @@
+package runtime
+
+import (
+	"fmt"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/utils"
+)
+
+// InsufficientMemoryError is returned by Start when the host doesn't have
+// the memory left for an app's limit.
+type InsufficientMemoryError struct {
+	App string
+	// Needed is the app's limit, Free is what's left of the host's memory
+	// after the limits of the galaxy containers running on it
+	Needed int64
+	Free   int64
+}
+
+func (e *InsufficientMemoryError) Error() string {
+	return fmt.Sprintf("not enough memory on this host for %s: it needs %dm and %dm is free",
+		e.App, e.Needed>>20, e.Free>>20)
+}
+
+// checkMemory returns an InsufficientMemoryError if starting a container
+// of appCfg would take the memory limits of the galaxy containers on the
+// host past its memory, less MemoryReserve.  Apps without a memory limit
+// are always started.
+func (s *ServiceRuntime) checkMemory(appCfg *config.AppConfig, pool string) error {
+	needed, err := utils.ParseMemory(appCfg.GetMemory(pool))
+	if err != nil || needed == 0 {
+		return err
+	}
+
+	total, _, err := s.HostResources()
+	if err != nil {
+		return fmt.Errorf("unable to get host memory: %s", err)
+	}
+	if total == 0 {
+		return nil
+	}
+
+	// one-off containers use memory too
+	containers, err := s.allContainers()
+	if err != nil {
+		return err
+	}
+	return s.fitMemory(appCfg.Name, needed, total, containers)
+}
+
+// fitMemory returns an InsufficientMemoryError if needed doesn't fit in
+// total less MemoryReserve and the limits of containers.  Other versions
+// of the app count since they keep running until the new one has started,
+// and containers without a limit count as 0.
+func (s *ServiceRuntime) fitMemory(app string, needed, total int64, containers []*docker.Container) error {
+	used := s.MemoryReserve
+	for _, container := range containers {
+		if container.Config != nil && container.Config.Memory > 0 {
+			used += container.Config.Memory
+		}
+	}
+
+	free := total - used
+	if needed > free {
+		if free < 0 {
+			free = 0
+		}
+		return &InsufficientMemoryError{App: app, Needed: needed, Free: free}
+	}
+	return nil
+}
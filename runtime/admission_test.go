@@ -0,0 +1,49 @@
+package runtime
+
+import (
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestFitMemory(t *testing.T) {
+	withMemory := func(container *docker.Container, mem int64) *docker.Container {
+		container.Config.Memory = mem
+		return container
+	}
+	containers := []*docker.Container{
+		withMemory(testContainer("a", "image1", "GALAXY_APP=web", "GALAXY_VERSION=1"), 256<<20),
+		withMemory(testContainer("b", "image2", "GALAXY_APP=web", "GALAXY_VERSION=2"), 256<<20),
+		withMemory(testContainer("c", "image1", "GALAXY_APP=api"), 0),
+		withMemory(testContainer("d", "image1", "GALAXY_APP=worker"), 128<<20),
+		{ID: "e"},
+	}
+
+	for _, test := range []struct {
+		needed, total, reserve int64
+		free                   int64
+	}{
+		{128 << 20, 1 << 30, 0, -1},
+		{384 << 20, 1 << 30, 0, -1},
+		{385 << 20, 1 << 30, 0, 384 << 20},
+		{256 << 20, 1 << 30, 256 << 20, 128 << 20},
+		{1, 512 << 20, 0, 0},
+	} {
+		s := &ServiceRuntime{MemoryReserve: test.reserve}
+		err := s.fitMemory("web", test.needed, test.total, containers)
+		if test.free < 0 {
+			if err != nil {
+				t.Fatalf("expected %d to fit in %d. Got %s", test.needed, test.total, err)
+			}
+			continue
+		}
+
+		full, ok := err.(*InsufficientMemoryError)
+		if !ok {
+			t.Fatalf("expected %d not to fit in %d. Got %v", test.needed, test.total, err)
+		}
+		if full.App != "web" || full.Needed != test.needed || full.Free != test.free {
+			t.Fatalf("expected %d free for %d. Got %+v", test.free, test.needed, full)
+		}
+	}
+}
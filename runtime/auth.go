@@ -0,0 +1,185 @@
+package runtime
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	auth "github.com/dotcloud/docker/registry"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/litl/galaxy/utils"
+)
+
+// RegistryAuth is a login for a docker registry.
+type RegistryAuth struct {
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	Email    string `toml:"email"`
+}
+
+// ParseRegistryAuth parses a registry login given as
+// <username>:<password>@<registry>, e.g. from a flag, and returns the
+// registry and its login.
+func ParseRegistryAuth(s string) (string, RegistryAuth, error) {
+	at := strings.LastIndex(s, "@")
+	colon := strings.Index(s, ":")
+	if at < 0 || colon < 0 || colon > at || at == len(s)-1 {
+		return "", RegistryAuth{}, fmt.Errorf("invalid registry login, expected <username>:<password>@<registry>")
+	}
+	return s[at+1:], RegistryAuth{Username: s[:colon], Password: s[colon+1 : at]}, nil
+}
+
+// isRegistryHost returns true if the first part of an image name is a
+// registry rather than a Docker Hub user, the way docker decides.
+func isRegistryHost(name string) bool {
+	return strings.ContainsAny(name, ".:") || name == "localhost"
+}
+
+// dockerConfigFile is the part of ~/.docker/config.json with logins.
+type dockerConfigFile struct {
+	Auths       map[string]auth.AuthConfig `json:"auths"`
+	CredsStore  string                     `json:"credsStore"`
+	CredHelpers map[string]string          `json:"credHelpers"`
+}
+
+// registryAuth returns the login for registry, "" for Docker Hub.  The
+// first of these with one is used:
+//
+//	RegistryAuths
+//	CredentialHelper
+//	~/.docker/config.json logins and credential helpers
+//	~/.dockercfg
+//
+// No login isn't an error, the image is pulled anonymously.
+func (s *ServiceRuntime) registryAuth(registry string) (docker.AuthConfiguration, error) {
+	if registry == "" {
+		registry = auth.IndexServerAddress()
+	}
+
+	if login, ok := s.RegistryAuths[registry]; ok {
+		return docker.AuthConfiguration{
+			Username: login.Username,
+			Password: login.Password,
+			Email:    login.Email,
+		}, nil
+	}
+
+	if s.CredentialHelper != "" {
+		login, found, err := credentialHelperAuth(s.CredentialHelper, registry)
+		if err != nil || found {
+			return login, err
+		}
+	}
+
+	homeDir := utils.HomeDir()
+	if homeDir == "" {
+		return docker.AuthConfiguration{}, nil
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(homeDir, ".docker", "config.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return docker.AuthConfiguration{}, err
+	}
+	if err == nil {
+		var cfg dockerConfigFile
+		err = json.Unmarshal(data, &cfg)
+		if err != nil {
+			return docker.AuthConfiguration{}, fmt.Errorf("invalid ~/.docker/config.json: %s", err)
+		}
+
+		helper := cfg.CredHelpers[registry]
+		if helper == "" {
+			helper = cfg.CredsStore
+		}
+		if helper != "" {
+			login, found, err := credentialHelperAuth(helper, registry)
+			if err != nil || found {
+				return login, err
+			}
+		}
+
+		for addr, a := range cfg.Auths {
+			if addr != registry && hostname(addr) != registry {
+				continue
+			}
+			return configFileAuth(a)
+		}
+	}
+
+	// the old ~/.dockercfg
+	cfg, err := auth.LoadConfig(homeDir)
+	if err != nil {
+		return docker.AuthConfiguration{}, fmt.Errorf("invalid ~/.dockercfg: %s", err)
+	}
+	a := cfg.ResolveAuthConfig(registry)
+	return docker.AuthConfiguration{
+		Username: a.Username,
+		Password: a.Password,
+		Email:    a.Email,
+	}, nil
+}
+
+// hostname returns the host of a registry address, which can be a URL.
+func hostname(addr string) string {
+	addr = strings.TrimPrefix(strings.TrimPrefix(addr, "https://"), "http://")
+	return strings.SplitN(addr, "/", 2)[0]
+}
+
+// configFileAuth returns a ~/.docker/config.json login, decoding its base64
+// username:password.
+func configFileAuth(a auth.AuthConfig) (docker.AuthConfiguration, error) {
+	login := docker.AuthConfiguration{
+		Username: a.Username,
+		Password: a.Password,
+		Email:    a.Email,
+	}
+	if a.Auth == "" {
+		return login, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+	if err != nil {
+		return login, fmt.Errorf("invalid login for %s: %s", a.ServerAddress, err)
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return login, fmt.Errorf("invalid login for %s", a.ServerAddress)
+	}
+	login.Username, login.Password = parts[0], parts[1]
+	return login, nil
+}
+
+// credentialHelperAuth asks docker-credential-<helper> for registry's
+// login, and returns false if it doesn't have one.
+func credentialHelperAuth(helper, registry string) (docker.AuthConfiguration, bool, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(registry)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		out := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(out, "credentials not found") {
+			return docker.AuthConfiguration{}, false, nil
+		}
+		return docker.AuthConfiguration{}, false, fmt.Errorf("credential helper %s failed: %s %s", helper, err, out)
+	}
+
+	var creds struct {
+		Username string
+		Secret   string
+	}
+	err = json.Unmarshal(stdout.Bytes(), &creds)
+	if err != nil {
+		return docker.AuthConfiguration{}, false, fmt.Errorf("credential helper %s: %s", helper, err)
+	}
+	return docker.AuthConfiguration{Username: creds.Username, Password: creds.Secret}, true, nil
+}
@@ -0,0 +1,75 @@
+package runtime
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+)
+
+// dependsPollInterval is how often registrations are checked while
+// waiting for an app's dependencies.
+const dependsPollInterval = 2 * time.Second
+
+// missingDepends returns the apps appCfg depends on that have no
+// registrations in env that aren't draining.
+func (s *ServiceRuntime) missingDepends(env string, appCfg *config.AppConfig) ([]string, error) {
+	registrations, err := s.serviceRegistry.ListRegistrations(env)
+	if err != nil {
+		return nil, err
+	}
+
+	registered := make(map[string]bool)
+	for _, reg := range registrations {
+		if !reg.IsDraining() {
+			registered[reg.Name] = true
+		}
+	}
+
+	missing := []string{}
+	for _, dep := range appCfg.Depends() {
+		if !registered[dep] {
+			missing = append(missing, dep)
+		}
+	}
+	return missing, nil
+}
+
+// WaitForDepends waits up to the app's GALAXY_DEPENDS_TIMEOUT, e.g. 2m, for
+// every app in its GALAXY_DEPENDS to be registered in env, so it isn't
+// started before the services it needs.  It doesn't wait if the timeout
+// isn't set, and returns an error naming the missing apps if it passes.
+func (s *ServiceRuntime) WaitForDepends(env string, appCfg *config.AppConfig) error {
+	value := appCfg.Env()["GALAXY_DEPENDS_TIMEOUT"]
+	if value == "" || len(appCfg.Depends()) == 0 || s.serviceRegistry == nil {
+		return nil
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid GALAXY_DEPENDS_TIMEOUT %s: %s", value, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	logged := false
+	for {
+		missing, err := s.missingDepends(env, appCfg)
+		if err != nil {
+			return err
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s not registered after %s", strings.Join(missing, ", "), timeout)
+		}
+		if !logged {
+			log.Printf("Waiting up to %s for %s to register before starting %s", timeout, strings.Join(missing, ", "), appCfg.Name)
+			logged = true
+		}
+		time.Sleep(dependsPollInterval)
+	}
+}
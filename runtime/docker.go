@@ -0,0 +1,203 @@
+package runtime
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/litl/galaxy/log"
+)
+
+const (
+	// MinDockerAPIVersion is the oldest docker API galaxy can use.
+	MinDockerAPIVersion = "1.12"
+	// MaxDockerAPIVersion is the newest docker API galaxy speaks.  Newer
+	// daemons are asked for it since they no longer take a HostConfig
+	// when a container is started.
+	MaxDockerAPIVersion = "1.23"
+
+	// the docker APIs that added per container log drivers, ulimits and
+	// read only root filesystems, and user defined networks
+	logDriverAPIVersion = "1.18"
+	ulimitAPIVersion    = "1.18"
+	networkAPIVersion   = "1.21"
+)
+
+// DockerConfig is how to reach the docker daemon.
+type DockerConfig struct {
+	// Host is the daemon's address, e.g. unix:///var/run/docker.sock or
+	// tcp://10.0.1.5:2376
+	Host string
+	// CertPath holds the cert.pem, key.pem and ca.pem used for TLS
+	CertPath string
+	// TLS connects with the client certificate from CertPath
+	TLS bool
+	// TLSVerify also verifies the daemon's certificate against ca.pem,
+	// and implies TLS
+	TLSVerify bool
+}
+
+// DefaultDockerConfig reads DOCKER_HOST, DOCKER_CERT_PATH and
+// DOCKER_TLS_VERIFY the way the docker client does.  As with docker,
+// setting DOCKER_TLS_VERIFY to anything turns verification on.
+func DefaultDockerConfig() DockerConfig {
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+	if certPath == "" {
+		certPath = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+
+	return DockerConfig{
+		Host:      GetEndpoint(),
+		CertPath:  certPath,
+		TLSVerify: os.Getenv("DOCKER_TLS_VERIFY") != "",
+	}
+}
+
+// newClient returns a client for apiVersion, or whatever version the
+// daemon speaks if it's "".
+func (d DockerConfig) newClient(apiVersion string) (*docker.Client, error) {
+	var client *docker.Client
+	var err error
+	if !d.TLS && !d.TLSVerify {
+		client, err = docker.NewVersionedClient(d.Host, apiVersion)
+	} else {
+		client, err = d.newTLSClient(apiVersion)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the version is checked when connecting
+	client.SkipServerVersionCheck = true
+	return client, nil
+}
+
+func (d DockerConfig) newTLSClient(apiVersion string) (*docker.Client, error) {
+
+	// without a CA the daemon's certificate isn't checked
+	ca := ""
+	if d.TLSVerify {
+		ca = filepath.Join(d.CertPath, "ca.pem")
+	}
+
+	// the client only picks https for tcp:// on port 2376
+	endpoint := d.Host
+	if strings.HasPrefix(endpoint, "tcp://") {
+		endpoint = "https://" + strings.TrimPrefix(endpoint, "tcp://")
+	}
+	return docker.NewVersionnedTLSClient(endpoint,
+		filepath.Join(d.CertPath, "cert.pem"),
+		filepath.Join(d.CertPath, "key.pem"),
+		ca, apiVersion)
+}
+
+// negotiateAPIVersion returns the API version to use with a daemon that
+// speaks up to server.
+func negotiateAPIVersion(server string) (docker.APIVersion, error) {
+	version, err := docker.NewAPIVersion(server)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read docker's API version: %s", err)
+	}
+
+	min, _ := docker.NewAPIVersion(MinDockerAPIVersion)
+	if version.LessThan(min) {
+		return nil, fmt.Errorf("docker API %s is too old, galaxy needs %s or newer", version, min)
+	}
+
+	max, _ := docker.NewAPIVersion(MaxDockerAPIVersion)
+	if version.GreaterThan(max) {
+		return max, nil
+	}
+	return version, nil
+}
+
+// connectDocker connects to the daemon at the newest API version both it
+// and galaxy speak.  If the daemon can't be reached, the client is left
+// unversioned and connecting is tried again on the next call.
+func (s *ServiceRuntime) connectDocker() {
+	if s.dockerClient == nil {
+		client, err := s.dockerConfig.newClient("")
+		if err != nil {
+			log.Fatalf("ERROR: Unable to connect to docker: %s: %s", err, s.dockerConfig.Host)
+		}
+		s.dockerClient = client
+	}
+
+	env, err := s.dockerClient.Version()
+	if err != nil {
+		return
+	}
+
+	version, err := negotiateAPIVersion(env.Get("ApiVersion"))
+	if err != nil {
+		log.Fatalf("ERROR: %s: %s", err, s.dockerConfig.Host)
+	}
+
+	client, err := s.dockerConfig.newClient(version.String())
+	if err != nil {
+		log.Fatalf("ERROR: Unable to connect to docker: %s: %s", err, s.dockerConfig.Host)
+	}
+	s.dockerClient = client
+	s.dockerVersion = env.Get("Version")
+	s.dockerAPIVersion = version
+	log.Debugf("Using docker %s with API %s at %s", s.dockerVersion, version, s.dockerConfig.Host)
+}
+
+// DockerVersion returns the version of docker and the API version galaxy
+// uses with it.
+func (s *ServiceRuntime) DockerVersion() (string, string, error) {
+	s.ensureDockerClient()
+
+	s.dockerMu.Lock()
+	defer s.dockerMu.Unlock()
+	if s.dockerAPIVersion == nil {
+		return "", "", fmt.Errorf("unable to reach docker at %s", s.dockerConfig.Host)
+	}
+	return s.dockerVersion, s.dockerAPIVersion.String(), nil
+}
+
+// supportsAPI returns true if the API version in use is at least version.
+// It's assumed to be if docker hasn't been reached yet, so the call fails
+// the way it would have before.
+func (s *ServiceRuntime) supportsAPI(version string) bool {
+	s.ensureDockerClient()
+
+	s.dockerMu.Lock()
+	defer s.dockerMu.Unlock()
+	if s.dockerAPIVersion == nil {
+		return true
+	}
+	v, _ := docker.NewAPIVersion(version)
+	return s.dockerAPIVersion.GreaterThanOrEqualTo(v)
+}
+
+// apiPath returns the path of an API call at the version in use.
+func (s *ServiceRuntime) apiPath(path string) string {
+	s.dockerMu.Lock()
+	defer s.dockerMu.Unlock()
+	if s.dockerAPIVersion == nil {
+		return path
+	}
+	return "/v" + s.dockerAPIVersion.String() + path
+}
+
+// checkFeatures returns an error if the docker API in use can't start a
+// container on network with logCfg, rather than docker ignoring them.
+func (s *ServiceRuntime) checkFeatures(network string, logCfg *logConfig) error {
+	userNetwork := network != "" && network != "bridge" && network != "default" && publishesPorts(network)
+	if userNetwork && !s.supportsAPI(networkAPIVersion) {
+		return fmt.Errorf("docker API %s doesn't support networks like %s, it needs %s", s.apiVersionString(), network, networkAPIVersion)
+	}
+	if logCfg != nil && !s.supportsAPI(logDriverAPIVersion) {
+		return fmt.Errorf("docker API %s doesn't support log drivers, it needs %s", s.apiVersionString(), logDriverAPIVersion)
+	}
+	return nil
+}
+
+func (s *ServiceRuntime) apiVersionString() string {
+	s.dockerMu.Lock()
+	defer s.dockerMu.Unlock()
+	return s.dockerAPIVersion.String()
+}
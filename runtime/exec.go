@@ -0,0 +1,187 @@
+package runtime
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/registry"
+)
+
+// statusWriter copies a command's output to w, leaving out the exit status
+// the shell prints after it.  Anything that could be the start of the
+// marker is held back until it's known not to be.
+type statusWriter struct {
+	w       io.Writer
+	pending []byte
+	status  string
+	found   bool
+}
+
+func (s *statusWriter) Write(p []byte) (int, error) {
+	if s.found {
+		s.status += string(p)
+		return len(p), nil
+	}
+
+	s.pending = append(s.pending, p...)
+	if i := bytes.Index(s.pending, []byte(execStatusMarker)); i >= 0 {
+		s.found = true
+		s.status = string(s.pending[i+len(execStatusMarker):])
+		_, err := s.w.Write(s.pending[:i])
+		s.pending = nil
+		return len(p), err
+	}
+
+	keep := len(execStatusMarker) - 1
+	if len(s.pending) <= keep {
+		return len(p), nil
+	}
+	n := len(s.pending) - keep
+	_, err := s.w.Write(s.pending[:n])
+	s.pending = append([]byte{}, s.pending[n:]...)
+	return len(p), err
+}
+
+// exitStatus flushes anything held back and returns the exit status.
+func (s *statusWriter) exitStatus(cmd string) (int, error) {
+	if !s.found {
+		s.w.Write(s.pending)
+		s.pending = nil
+		return -1, fmt.Errorf("no exit status from %q", cmd)
+	}
+	return strconv.Atoi(strings.TrimSpace(s.status))
+}
+
+// shellSafe are the characters sh doesn't interpret anywhere in a word.
+const shellSafe = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789@%_-+:,./"
+
+// shellQuote quotes arg for sh, leaving it as is if it's only shellSafe
+// characters.
+func shellQuote(arg string) string {
+	if arg != "" && strings.Trim(arg, shellSafe) == "" {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+// shellCommand joins args into a command for sh that runs them as given.
+func shellCommand(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// execIn runs cmd with sh inside the container, copying its output to
+// stdout and stderr, and returns its exit status.
+func execIn(client *docker.Client, containerID, cmd string, stdout, stderr io.Writer) (int, error) {
+	exec, err := client.CreateExec(docker.CreateExecOptions{
+		Container:    containerID,
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          []string{"sh", "-c", "(" + cmd + "); echo " + execStatusMarker + "$?"},
+	})
+	if err != nil {
+		return -1, err
+	}
+
+	out := &statusWriter{w: stdout}
+	err = client.StartExec(exec.ID, docker.StartExecOptions{
+		OutputStream: out,
+		ErrorStream:  stderr,
+	})
+	if err != nil {
+		out.exitStatus(cmd)
+		return -1, err
+	}
+	return out.exitStatus(cmd)
+}
+
+// runningContainer picks a running, undrained container of app in env, and
+// pool unless it's "", preferring one on this host.  It returns the
+// container's registration and the IP of its host.
+func (s *ServiceRuntime) runningContainer(env, pool, app string) (*registry.ServiceRegistration, string, error) {
+	registrations, err := s.serviceRegistry.ListRegistrations(env)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var picked *registry.ServiceRegistration
+	pickedHost := ""
+	for i, reg := range registrations {
+		// env/pool/hosts/ip/app/container
+		parts := strings.Split(reg.Path, "/")
+		if reg.Name != app || reg.ContainerID == "" || reg.IsDraining() || len(parts) < 4 {
+			continue
+		}
+		if pool != "" && parts[1] != pool {
+			continue
+		}
+		if picked == nil || parts[3] == s.hostIP {
+			picked = &registrations[i]
+			pickedHost = parts[3]
+		}
+		if pickedHost == s.hostIP {
+			break
+		}
+	}
+
+	if picked == nil {
+		return nil, "", fmt.Errorf("%s has no running containers in %s", app, env)
+	}
+	return picked, pickedHost, nil
+}
+
+// hostDockerClient returns a client for docker on hostIP.  Other hosts'
+// daemons are reached on the same port and with the same TLS settings as
+// this one's, so they have to listen on tcp.
+func (s *ServiceRuntime) hostDockerClient(hostIP string) (*docker.Client, error) {
+	if hostIP == s.hostIP {
+		return s.ensureDockerClient(), nil
+	}
+
+	if !strings.HasPrefix(s.dockerConfig.Host, "tcp://") {
+		return nil, fmt.Errorf("the container is on %s and docker at %s can't reach it, use a tcp docker host", hostIP, s.dockerConfig.Host)
+	}
+
+	port := "2375"
+	if i := strings.LastIndex(s.dockerConfig.Host, ":"); i > len("tcp://") {
+		port = s.dockerConfig.Host[i+1:]
+	}
+	dockerConfig := s.dockerConfig
+	dockerConfig.Host = "tcp://" + hostIP + ":" + port
+	return dockerConfig.newClient("")
+}
+
+// ExecCommand runs cmd inside a running container of appCfg in env, and
+// pool unless it's "", instead of starting a new one.  A container on
+// this host is used if there is one.  It returns an error if cmd exits
+// non-zero.
+func (s *ServiceRuntime) ExecCommand(env, pool string, appCfg *config.AppConfig, cmd []string) error {
+	reg, hostIP, err := s.runningContainer(env, pool, appCfg.Name)
+	if err != nil {
+		return err
+	}
+
+	client, err := s.hostDockerClient(hostIP)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Running in %s on %s\n", reg.ContainerID[0:12], hostIP)
+	status, err := execIn(client, reg.ContainerID, shellCommand(cmd), os.Stdout, os.Stderr)
+	if err != nil {
+		return err
+	}
+	if status != 0 {
+		return fmt.Errorf("command exited with %d", status)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package runtime
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestStatusWriter(t *testing.T) {
+	for _, test := range []struct {
+		writes []string
+		out    string
+		status int
+	}{
+		{[]string{"hello\n" + execStatusMarker + "0\n"}, "hello\n", 0},
+		// the marker split across writes
+		{[]string{"hello\nGALAXY_EX", "EC_STAT", "US=", "12\n"}, "hello\n", 12},
+		// output that looks like the start of the marker isn't it
+		{[]string{"GALAXY_", "EXIT\n", execStatusMarker + "1\n"}, "GALAXY_EXIT\n", 1},
+		{[]string{"", execStatusMarker, "3", "\n"}, "", 3},
+	} {
+		var buf bytes.Buffer
+		w := &statusWriter{w: &buf}
+		for _, p := range test.writes {
+			if n, err := w.Write([]byte(p)); n != len(p) || err != nil {
+				t.Fatalf("expected %d written. Got %d, %v", len(p), n, err)
+			}
+		}
+
+		status, err := w.exitStatus("cmd")
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", test.writes, err)
+		}
+		if status != test.status {
+			t.Fatalf("expected status %d for %q. Got %d", test.status, test.writes, status)
+		}
+		if buf.String() != test.out {
+			t.Fatalf("expected %q for %q. Got %q", test.out, test.writes, buf.String())
+		}
+	}
+
+	// without the marker everything held back is still written
+	var buf bytes.Buffer
+	w := &statusWriter{w: &buf}
+	w.Write([]byte("killed GALAXY_EXEC"))
+	if _, err := w.exitStatus("cmd"); err == nil {
+		t.Fatal("expected an error without an exit status")
+	}
+	if buf.String() != "killed GALAXY_EXEC" {
+		t.Fatalf("expected the output to be flushed. Got %q", buf.String())
+	}
+}
+
+func TestShellCommand(t *testing.T) {
+	for _, test := range []struct {
+		args []string
+		cmd  string
+	}{
+		{[]string{"bin/rake", "cache:clear"}, "bin/rake cache:clear"},
+		{[]string{"echo", "a b", ""}, "echo 'a b' ''"},
+		{[]string{"echo", "it's", "$HOME", "`id`", "a;b"}, `echo 'it'\''s' '$HOME' '` + "`id`" + `' 'a;b'`},
+		{[]string{"FOO=1", "*"}, "'FOO=1' '*'"},
+	} {
+		if cmd := shellCommand(test.args); cmd != test.cmd {
+			t.Fatalf("expected %s. Got %s", test.cmd, cmd)
+		}
+	}
+
+	// sh gets back the args as given
+	args := []string{"it's", "a b", "$HOME", "", "*", "\\n"}
+	cmd := "printf '[%s]\\n' " + shellCommand(args)
+	out, err := exec.Command("sh", "-c", cmd).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "[" + strings.Join(args, "]\n[") + "]\n"
+	if string(out) != expected {
+		t.Fatalf("expected %q. Got %q", expected, out)
+	}
+}
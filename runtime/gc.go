@@ -0,0 +1,140 @@
+package runtime
+
+import (
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/litl/galaxy/log"
+)
+
+// Garbage is what's using up a host's disk for nothing.
+type Garbage struct {
+	// Containers are galaxy containers that exited a while ago
+	Containers []*docker.Container
+	// Images aren't used by a container or deployed, and are either
+	// untagged or old versions of a deployed image
+	Images []docker.APIImages
+}
+
+// imageRepo returns img without its tag or digest.
+func imageRepo(img string) string {
+	if i := strings.Index(img, "@"); i >= 0 {
+		return img[:i]
+	}
+	if i := strings.LastIndex(img, ":"); i > strings.LastIndex(img, "/") {
+		return img[:i]
+	}
+	return img
+}
+
+// FindGarbage returns the galaxy containers that exited more than age ago
+// and the images left over from old deploys.  inUse lists the image names
+// and IDs apps are deployed with, which are kept.
+func (s *ServiceRuntime) FindGarbage(inUse []string, age time.Duration) (*Garbage, error) {
+	garbage := &Garbage{}
+
+	containers, err := s.ensureDockerClient().ListContainers(docker.ListContainersOptions{
+		All: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// images still used by the containers that are kept
+	used := make(map[string]bool)
+	for _, c := range containers {
+		container, err := s.ensureDockerClient().InspectContainer(c.ID)
+		if err != nil {
+			log.Printf("ERROR: Unable to inspect container: %s\n", c.ID)
+			continue
+		}
+
+		if s.EnvFor(container)["GALAXY_APP"] != "" && !container.State.Running &&
+			!container.State.FinishedAt.IsZero() && time.Since(container.State.FinishedAt) > age {
+			garbage.Containers = append(garbage.Containers, container)
+			continue
+		}
+		used[container.Image] = true
+	}
+
+	repos := make(map[string]bool)
+	for _, img := range inUse {
+		used[img] = true
+		repos[imageRepo(img)] = true
+	}
+
+	images, err := s.ensureDockerClient().ListImages(docker.ListImagesOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, image := range images {
+		if used[image.ID] {
+			continue
+		}
+
+		tags := []string{}
+		for _, tag := range image.RepoTags {
+			if tag != "<none>:<none>" {
+				tags = append(tags, tag)
+			}
+		}
+
+		old := true
+		for _, tag := range tags {
+			if used[tag] || !repos[imageRepo(tag)] {
+				old = false
+			}
+		}
+		if old {
+			garbage.Images = append(garbage.Images, image)
+		}
+	}
+	return garbage, nil
+}
+
+// RemoveGarbage removes garbage's containers and then its images, and
+// returns how many of each it removed.  Ones that can't be removed are
+// logged and skipped.
+func (s *ServiceRuntime) RemoveGarbage(garbage *Garbage) (int, int) {
+	containers := 0
+	for _, container := range garbage.Containers {
+		err := s.ensureDockerClient().RemoveContainer(docker.RemoveContainerOptions{
+			ID:            container.ID,
+			RemoveVolumes: true,
+		})
+		if err != nil {
+			log.Errorf("ERROR: Unable to remove container %s: %s", container.ID[0:12], err)
+			continue
+		}
+		containers += 1
+	}
+
+	images := 0
+	for _, image := range garbage.Images {
+		// an image with several tags can only be removed a tag at a time
+		names := []string{}
+		for _, tag := range image.RepoTags {
+			if tag != "<none>:<none>" {
+				names = append(names, tag)
+			}
+		}
+		if len(names) == 0 {
+			names = []string{image.ID}
+		}
+
+		removed := true
+		for _, name := range names {
+			err := s.ensureDockerClient().RemoveImage(name)
+			if err != nil {
+				log.Errorf("ERROR: Unable to remove image %s: %s", name, err)
+				removed = false
+			}
+		}
+		if removed {
+			images += 1
+		}
+	}
+	return containers, images
+}
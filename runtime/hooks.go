@@ -0,0 +1,69 @@
+package runtime
+
+import (
+	"fmt"
+	"io"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/litl/galaxy/config"
+)
+
+// RunHook runs cmd with /bin/sh in a one-off container of appCfg's version,
+// e.g. to migrate a database before the version is deployed or for a
+// scheduled job.  Its output is copied to stdout and stderr as it runs,
+// and an error is returned if it exits non-zero.
+func (s *ServiceRuntime) RunHook(env string, appCfg *config.AppConfig, cmd string, stdout, stderr io.Writer) error {
+	image, err := s.InspectImage(appCfg.Version())
+	if err != nil {
+		return err
+	}
+
+	err = s.CheckImagePolicy(env, appCfg.Version(), image.ID)
+	if err != nil {
+		return err
+	}
+
+	envVars, err := s.oneOffEnv(env, appCfg)
+	if err != nil {
+		return err
+	}
+
+	container, err := s.ensureDockerClient().CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{
+			Image:        appCfg.Version(),
+			Env:          envVars,
+			AttachStdout: true,
+			AttachStderr: true,
+			Cmd:          []string{"/bin/sh", "-c", cmd},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	defer s.ensureDockerClient().RemoveContainer(docker.RemoveContainerOptions{
+		ID: container.ID,
+	})
+
+	network := appCfg.Env()["GALAXY_NETWORK"]
+	err = s.checkFeatures(network, nil)
+	if err != nil {
+		return err
+	}
+
+	hostConfig := &docker.HostConfig{
+		NetworkMode: network,
+	}
+	if s.dns != "" && publishesPorts(network) {
+		hostConfig.DNS = []string{s.dns}
+	}
+
+	status, err := s.startAttached(container.ID, hostConfig, stdout, stderr)
+	if err != nil {
+		return err
+	}
+	if status != 0 {
+		return fmt.Errorf("%q exited with status %d", cmd, status)
+	}
+	return nil
+}
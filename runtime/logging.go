@@ -0,0 +1,104 @@
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/litl/galaxy/utils"
+)
+
+// logConfig is the docker log driver a container logs with.  The docker
+// client doesn't know about it yet, so it's sent to the daemon directly by
+// startContainer.
+type logConfig struct {
+	Type   string            `json:"Type"`
+	Config map[string]string `json:"Config,omitempty"`
+}
+
+// appLogConfig returns the log driver in GALAXY_LOG_DRIVER, e.g. syslog or
+// json-file, with the options in GALAXY_LOG_OPTS, or nil to use the
+// daemon's default.
+func appLogConfig(env map[string]string) (*logConfig, error) {
+	driver := strings.TrimSpace(env["GALAXY_LOG_DRIVER"])
+	opts, err := utils.ParseLogOptions(env["GALAXY_LOG_OPTS"])
+	if err != nil {
+		return nil, err
+	}
+
+	if driver == "" {
+		if len(opts) > 0 {
+			return nil, fmt.Errorf("GALAXY_LOG_OPTS needs a GALAXY_LOG_DRIVER")
+		}
+		return nil, nil
+	}
+	return &logConfig{Type: driver, Config: opts}, nil
+}
+
+// startContainer starts id with hostConfig plus the extra host config
+// fields, e.g. LogConfig, that the docker client doesn't know about.
+func (s *ServiceRuntime) startContainer(id string, hostConfig *docker.HostConfig, extra map[string]interface{}) error {
+	if len(extra) == 0 {
+		return s.ensureDockerClient().StartContainer(id, hostConfig)
+	}
+
+	// add the extra fields to the host config the client would send
+	b, err := json.Marshal(hostConfig)
+	if err != nil {
+		return err
+	}
+	body := make(map[string]interface{})
+	err = json.Unmarshal(b, &body)
+	if err != nil {
+		return err
+	}
+	for field, value := range extra {
+		body[field] = value
+	}
+	b, err = json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	endpoint, err := url.Parse(s.dockerConfig.Host)
+	if err != nil {
+		return err
+	}
+
+	client := s.ensureDockerClient().HTTPClient
+	base := "http://" + endpoint.Host
+	switch {
+	case endpoint.Scheme == "unix":
+		socket := endpoint.Path
+		client = &http.Client{
+			Transport: &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return net.Dial("unix", socket)
+				},
+			},
+		}
+		base = "http://docker"
+	case s.dockerConfig.TLS || s.dockerConfig.TLSVerify:
+		base = "https://" + endpoint.Host
+	}
+
+	resp, err := client.Post(base+s.apiPath("/containers/"+id+"/start"), "application/json", strings.NewReader(string(b)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusNotModified:
+		return nil
+	case http.StatusNotFound:
+		return &docker.NoSuchContainer{ID: id}
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("unable to start container %s: %s", id, strings.TrimSpace(string(msg)))
+}
@@ -0,0 +1,27 @@
+package runtime
+
+import (
+	"io"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// ContainerLogs writes the last tail lines, or "all", of the stdout and
+// stderr of container id on the daemon at d to stdout and stderr.  With
+// follow it keeps writing new lines until the container stops.
+func (d DockerConfig) ContainerLogs(id, tail string, follow bool, stdout, stderr io.Writer) error {
+	client, err := d.newClient("")
+	if err != nil {
+		return err
+	}
+
+	return client.Logs(docker.LogsOptions{
+		Container:    id,
+		OutputStream: stdout,
+		ErrorStream:  stderr,
+		Stdout:       true,
+		Stderr:       true,
+		Follow:       follow,
+		Tail:         tail,
+	})
+}
@@ -0,0 +1,97 @@
+package runtime
+
+import (
+	"fmt"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/utils"
+)
+
+// ParseImageMirror parses a mirror given as [<registry>=]<mirror>, e.g.
+// from a flag, and returns the registry, docker.io if it's left out, and
+// the mirror's host.
+func ParseImageMirror(s string) (string, string, error) {
+	registry, mirror := "docker.io", s
+	if i := strings.Index(s, "="); i >= 0 {
+		registry, mirror = s[:i], s[i+1:]
+	}
+	mirror = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(mirror, "https://"), "http://"), "/")
+	if registry == "" || mirror == "" {
+		return "", "", fmt.Errorf("invalid image mirror %q, expected [<registry>=]<mirror>", s)
+	}
+	return registry, mirror, nil
+}
+
+// mirrorImage returns the name version is pulled as from its registry's
+// mirror, or "" if it doesn't have one.  Docker Hub's official images are
+// under library/ on a mirror.
+func (s *ServiceRuntime) mirrorImage(version string) string {
+	registry, repository, tag := utils.SplitDockerImage(version)
+	if !isRegistryHost(registry) {
+		if registry != "" {
+			repository = registry + "/" + repository
+		} else {
+			repository = "library/" + repository
+		}
+		registry = "docker.io"
+	}
+
+	mirror := s.ImageMirrors[registry]
+	// images pinned by digest can't be tagged with their original name
+	if mirror == "" || utils.IsImageDigest(tag) {
+		return ""
+	}
+	if tag == "" {
+		tag = "latest"
+	}
+	return mirror + "/" + repository + ":" + tag
+}
+
+// pullFromMirror pulls version from its registry's mirror and tags it with
+// its original name.  It returns false if there's no mirror or the pull
+// failed, and version should be pulled from its registry instead.
+func (s *ServiceRuntime) pullFromMirror(version string, opts docker.PullImageOptions) bool {
+	mirrored := s.mirrorImage(version)
+	if mirrored == "" {
+		return false
+	}
+
+	registry, repository, tag := utils.SplitDockerImage(mirrored)
+	opts.Registry = registry
+	opts.Repository = registry + "/" + repository
+	opts.Tag = tag
+
+	auth, err := s.registryAuth(registry)
+	if err == nil {
+		err = s.pullImage(opts, auth)
+	}
+	if err != nil {
+		log.Errorf("ERROR: Unable to pull %s from %s, pulling from its registry: %s", version, registry, err)
+		return false
+	}
+
+	// tag it the way it's deployed and drop the mirror's name so gc
+	// treats it like any other image
+	_, _, tag = utils.SplitDockerImage(version)
+	name := strings.TrimSuffix(version, ":"+tag)
+	if tag == "" {
+		tag = "latest"
+	}
+	err = s.ensureDockerClient().TagImage(mirrored, docker.TagImageOptions{
+		Repo:  name,
+		Tag:   tag,
+		Force: true,
+	})
+	if err != nil {
+		log.Errorf("ERROR: Unable to tag %s as %s: %s", mirrored, version, err)
+		return false
+	}
+
+	err = s.ensureDockerClient().RemoveImage(mirrored)
+	if err != nil {
+		log.Warnf("WARN: Unable to remove %s: %s", mirrored, err)
+	}
+	return true
+}
@@ -0,0 +1,195 @@
+package runtime
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/registry"
+	"github.com/litl/galaxy/utils"
+)
+
+// imageRegistry returns the registry img is pulled from, docker.io for
+// Docker Hub.
+func imageRegistry(img string) string {
+	registry, _, _ := utils.SplitDockerImage(img)
+	if !isRegistryHost(registry) {
+		return "docker.io"
+	}
+	return registry
+}
+
+// imageAtDigest returns img's repository pinned to digest.
+func imageAtDigest(img, digest string) string {
+	registry, repository, _ := utils.SplitDockerImage(img)
+	if registry != "" {
+		repository = registry + "/" + repository
+	}
+	return repository + "@" + digest
+}
+
+// verifyCommand returns the command that checks img's signature for
+// policy, or nil if policy doesn't verify signatures.
+func verifyCommand(policy registry.ImagePolicy, img string) (*exec.Cmd, error) {
+	switch policy.Verify {
+	case "":
+		return nil, nil
+	case "cosign":
+		args := []string{"verify", "--output", "json"}
+		if policy.Key != "" {
+			args = append(args, "--key", policy.Key)
+		}
+		return exec.Command("cosign", append(args, img)...), nil
+	case "notary":
+		registry, repository, tag := utils.SplitDockerImage(img)
+		gun := repository
+		if registry != "" {
+			gun = registry + "/" + repository
+		}
+		args := []string{}
+		if policy.Key != "" {
+			args = append(args, "-s", policy.Key)
+		}
+		// notary looks up tags, so a pinned image is found in the list
+		// of signed targets instead
+		if utils.IsImageDigest(tag) {
+			return exec.Command("notary", append(args, "list", gun)...), nil
+		}
+		if tag == "" {
+			tag = "latest"
+		}
+		return exec.Command("notary", append(args, "lookup", gun, tag)...), nil
+	}
+	return nil, fmt.Errorf("unknown image verification %q", policy.Verify)
+}
+
+// signedDigest returns the manifest digest that the output of verify's
+// command says is signed for img.
+func signedDigest(verify, img string, out []byte) (string, error) {
+	_, _, tag := utils.SplitDockerImage(img)
+
+	switch verify {
+	case "cosign":
+		var signatures []struct {
+			Critical struct {
+				Image struct {
+					Digest string `json:"docker-manifest-digest"`
+				} `json:"image"`
+			} `json:"critical"`
+		}
+		err := json.Unmarshal(out, &signatures)
+		if err != nil {
+			return "", fmt.Errorf("unable to read the cosign output for %s: %s", img, err)
+		}
+		for _, signature := range signatures {
+			digest := signature.Critical.Image.Digest
+			if !utils.IsImageDigest(digest) {
+				continue
+			}
+			if utils.IsImageDigest(tag) && digest != tag {
+				continue
+			}
+			return digest, nil
+		}
+	case "notary":
+		// lookup prints "<tag> <hex> <size>", list prints a row like
+		// that for each signed tag
+		for _, line := range strings.Split(string(out), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			digest := "sha256:" + fields[1]
+			if !utils.IsImageDigest(digest) {
+				continue
+			}
+			if utils.IsImageDigest(tag) && digest != tag {
+				continue
+			}
+			return digest, nil
+		}
+	}
+	return "", fmt.Errorf("no signature for %s", img)
+}
+
+// VerifyImage returns an error if img isn't allowed by policy: it's not
+// from one of the policy's registries, or its signature can't be
+// verified.  It returns the manifest digest the signature covers, or ""
+// if policy doesn't verify signatures.
+func VerifyImage(policy registry.ImagePolicy, img string) (string, error) {
+	if len(policy.Registries) > 0 && !utils.StringInSlice(imageRegistry(img), policy.Registries) {
+		return "", fmt.Errorf("%s is not from an allowed registry (%s)", img, strings.Join(policy.Registries, ", "))
+	}
+
+	cmd, err := verifyCommand(policy, img)
+	if cmd == nil || err != nil {
+		return "", err
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("unable to verify the signature of %s: %s: %s", img, err, strings.TrimSpace(stderr.String()))
+	}
+
+	digest, err := signedDigest(policy.Verify, img, out)
+	if err != nil {
+		return "", fmt.Errorf("unable to verify the signature of %s: %s", img, err)
+	}
+	return digest, nil
+}
+
+// CheckImagePolicy returns an error if env's image policy doesn't allow
+// img, the image with id.  Images are only verified once per ID while the
+// policy doesn't change.
+func (s *ServiceRuntime) CheckImagePolicy(env, img, id string) error {
+	if s.serviceRegistry == nil {
+		return nil
+	}
+
+	policy, err := s.serviceRegistry.GetImagePolicy(env)
+	if err != nil {
+		return fmt.Errorf("unable to read the image policy for %s: %s", env, err)
+	}
+
+	verified := fmt.Sprintf("%s %s %s %v %s %s", env, img, id, policy.Registries, policy.Verify, policy.Key)
+	s.verifiedMu.Lock()
+	ok := s.verified[verified]
+	s.verifiedMu.Unlock()
+	if ok {
+		return nil
+	}
+
+	digest, err := VerifyImage(policy, img)
+	if err != nil {
+		return err
+	}
+
+	// the signature is for a digest but img may be a tag, so make sure
+	// the image with id is the one at the signed digest
+	if digest != "" {
+		_, _, tag := utils.SplitDockerImage(img)
+		if !utils.IsImageDigest(tag) {
+			signed, err := s.PullImage(imageAtDigest(img, digest), "")
+			if err != nil {
+				return fmt.Errorf("unable to pull the signed image for %s: %s", img, err)
+			}
+			if signed == nil || signed.ID != id {
+				return fmt.Errorf("%s is not the image signed at %s", img, digest)
+			}
+		}
+		log.Printf("Verified the signature of %s\n", img)
+	}
+
+	s.verifiedMu.Lock()
+	if s.verified == nil {
+		s.verified = make(map[string]bool)
+	}
+	s.verified[verified] = true
+	s.verifiedMu.Unlock()
+	return nil
+}
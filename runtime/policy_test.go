@@ -0,0 +1,132 @@
+package runtime
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/litl/galaxy/registry"
+)
+
+const testDigest = "sha256:2a3b8c5e0f1d4c6b7a8e9f0d1c2b3a4e5f6d7c8b9a0e1f2d3c4b5a6e7f8d9c0b"
+
+func TestVerifyImageRegistries(t *testing.T) {
+	policy := registry.ImagePolicy{Registries: []string{"registry.example.com", "docker.io"}}
+
+	for img, allowed := range map[string]bool{
+		"registry.example.com/web:v1": true,
+		"ubuntu:14.04":                true,
+		"litl/web":                    true,
+		"other.example.com/web:v1":    false,
+		"localhost:5000/web":          false,
+	} {
+		digest, err := VerifyImage(policy, img)
+		if allowed && err != nil {
+			t.Fatalf("expected %s to be allowed. Got %s", img, err)
+		}
+		if !allowed && err == nil {
+			t.Fatalf("expected %s to be refused", img)
+		}
+		if digest != "" {
+			t.Fatalf("expected no digest without verification. Got %s", digest)
+		}
+	}
+}
+
+func TestVerifyCommand(t *testing.T) {
+	for _, test := range []struct {
+		policy registry.ImagePolicy
+		img    string
+		args   []string
+	}{
+		{
+			registry.ImagePolicy{Verify: "cosign", Key: "cosign.pub"},
+			"registry.example.com/web:v1",
+			[]string{"cosign", "verify", "--output", "json", "--key", "cosign.pub", "registry.example.com/web:v1"},
+		},
+		{
+			registry.ImagePolicy{Verify: "notary", Key: "https://notary.example.com"},
+			"registry.example.com/web:v1",
+			[]string{"notary", "-s", "https://notary.example.com", "lookup", "registry.example.com/web", "v1"},
+		},
+		{
+			registry.ImagePolicy{Verify: "notary"},
+			"web",
+			[]string{"notary", "lookup", "web", "latest"},
+		},
+		{
+			registry.ImagePolicy{Verify: "notary"},
+			"registry.example.com/web@" + testDigest,
+			[]string{"notary", "list", "registry.example.com/web"},
+		},
+	} {
+		cmd, err := verifyCommand(test.policy, test.img)
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %s", test.img, err)
+		}
+		if !reflect.DeepEqual(cmd.Args, test.args) {
+			t.Fatalf("expected %v. Got %v", test.args, cmd.Args)
+		}
+	}
+
+	cmd, err := verifyCommand(registry.ImagePolicy{}, "web")
+	if cmd != nil || err != nil {
+		t.Fatalf("expected no command without verification. Got %v, %v", cmd, err)
+	}
+
+	_, err = verifyCommand(registry.ImagePolicy{Verify: "gpg"}, "web")
+	if err == nil {
+		t.Fatal("expected an error for an unknown verification")
+	}
+}
+
+func TestSignedDigest(t *testing.T) {
+	other := "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	cosign := `[{"critical":{"identity":{"docker-reference":"registry.example.com/web"},"image":{"docker-manifest-digest":"` + testDigest + `"},"type":"cosign container image signature"},"optional":null}]`
+	list := "NAME    DIGEST                                                              SIZE (BYTES)    ROLE\n" +
+		"----    ------                                                              ------------    ----\n" +
+		"v1      " + other[len("sha256:"):] + "    1234            targets\n" +
+		"v2      " + testDigest[len("sha256:"):] + "    1234            targets\n"
+
+	for _, test := range []struct {
+		verify string
+		img    string
+		out    string
+		digest string
+	}{
+		{"cosign", "registry.example.com/web:v1", cosign, testDigest},
+		{"cosign", "registry.example.com/web@" + testDigest, cosign, testDigest},
+		{"cosign", "registry.example.com/web@" + other, cosign, ""},
+		{"cosign", "registry.example.com/web:v1", "[]", ""},
+		{"cosign", "registry.example.com/web:v1", "Verification for web:v1", ""},
+		{"notary", "web:v2", "v2 " + testDigest[len("sha256:"):] + " 1234\n", testDigest},
+		{"notary", "web@" + testDigest, list, testDigest},
+		{"notary", "web@sha256:ffff", list, ""},
+		{"notary", "web:v1", "* fatal: No valid trust data for v1\n", ""},
+	} {
+		digest, err := signedDigest(test.verify, test.img, []byte(test.out))
+		if test.digest == "" {
+			if err == nil {
+				t.Fatalf("expected no signed digest for %s in %q. Got %s", test.img, test.out, digest)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %s", test.img, err)
+		}
+		if digest != test.digest {
+			t.Fatalf("expected %s for %s. Got %s", test.digest, test.img, digest)
+		}
+	}
+}
+
+func TestImageAtDigest(t *testing.T) {
+	for img, expected := range map[string]string{
+		"registry.example.com/web:v1": "registry.example.com/web@" + testDigest,
+		"ubuntu":                      "ubuntu@" + testDigest,
+		"litl/web:v1":                 "litl/web@" + testDigest,
+	} {
+		if pinned := imageAtDigest(img, testDigest); pinned != expected {
+			t.Fatalf("expected %s. Got %s", expected, pinned)
+		}
+	}
+}
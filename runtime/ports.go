@@ -0,0 +1,215 @@
+package runtime
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/registry"
+)
+
+// portBindings returns the host ports to publish appCfg's ports on, and
+// true if docker should publish every exposed port on a random one
+// instead.  Each container port gets the app's first assigned host port
+// that's free on this host, so the app's containers use the same few ports
+// across deploys.  Containers of old versions are only returned, to be
+// stopped before it starts, if the app's ports run out and one of theirs
+// has to be reused.
+func (s *ServiceRuntime) portBindings(env string, appCfg *config.AppConfig, image *docker.Image) (map[docker.Port][]docker.PortBinding, bool, []*docker.Container, error) {
+	if image.Config == nil || len(image.Config.ExposedPorts) == 0 {
+		return nil, true, nil, nil
+	}
+
+	ports, err := publishedPorts(appCfg.Env(), image.Config.ExposedPorts)
+	if err != nil {
+		return nil, false, nil, err
+	}
+
+	bindIP, err := s.bindIP(appCfg)
+	if err != nil {
+		return nil, false, nil, err
+	}
+
+	bindings := make(map[docker.Port][]docker.PortBinding)
+	if s.serviceRegistry == nil {
+		if bindIP == "" && len(ports) == len(image.Config.ExposedPorts) {
+			return nil, true, nil, nil
+		}
+		for _, port := range ports {
+			bindings[port] = []docker.PortBinding{{HostIP: bindIP}}
+		}
+		return bindings, false, nil, nil
+	}
+
+	held, err := s.heldPorts(appCfg)
+	if err != nil {
+		return nil, false, nil, err
+	}
+
+	hostPorts, replaced, err := assignPorts(ports, held, func(port docker.Port, slot int) (int, error) {
+		return s.serviceRegistry.AllocatePort(env, appCfg.Name, string(port), slot)
+	})
+	if err != nil {
+		return nil, false, nil, err
+	}
+
+	for port, hostPort := range hostPorts {
+		bindings[port] = []docker.PortBinding{{HostIP: bindIP, HostPort: strconv.Itoa(hostPort)}}
+	}
+	return bindings, false, replaced, nil
+}
+
+// heldPorts returns what is running on each host port in use on this host:
+// a container of one of appCfg's old versions, or nil for anything else.
+func (s *ServiceRuntime) heldPorts(appCfg *config.AppConfig) (map[int]*docker.Container, error) {
+	containers, err := s.ensureDockerClient().ListContainers(docker.ListContainersOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	held := make(map[int]*docker.Container)
+	for _, c := range containers {
+		for _, p := range c.Ports {
+			if p.PublicPort != 0 {
+				held[int(p.PublicPort)] = nil
+			}
+		}
+	}
+
+	managed, err := s.ManagedContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, container := range s.oldVersions(managed, appCfg, -1, s.InspectImage) {
+		if container.NetworkSettings == nil {
+			continue
+		}
+		for _, bindings := range container.NetworkSettings.Ports {
+			for _, binding := range bindings {
+				n, err := strconv.Atoi(binding.HostPort)
+				if _, ok := held[n]; ok && err == nil {
+					held[n] = container
+				}
+			}
+		}
+	}
+	return held, nil
+}
+
+// assignPorts picks the host port for each of ports from the ones allocate
+// assigns to its slots: the first one that's free in held, so old versions
+// keep serving on theirs until the new one has registered.  Only once the
+// env has no host ports left is one held by an old version used, and that
+// container is returned to be replaced.
+func assignPorts(ports []docker.Port, held map[int]*docker.Container,
+	allocate func(docker.Port, int) (int, error)) (map[docker.Port]int, []*docker.Container, error) {
+
+	hostPorts := make(map[docker.Port]int)
+	taken := make(map[int]bool)
+	replaced := []*docker.Container{}
+	for _, port := range ports {
+		// the first port an old version holds, in case there are no others
+		reusable := 0
+		for slot := 0; ; slot++ {
+			hostPort, err := allocate(port, slot)
+			if _, full := err.(*registry.NoHostPortsError); full && reusable != 0 {
+				hostPort = reusable
+				if !containerIn(held[reusable], replaced) {
+					replaced = append(replaced, held[reusable])
+				}
+			} else if err != nil {
+				return nil, nil, err
+			} else if container, ok := held[hostPort]; taken[hostPort] || ok {
+				if container != nil && !taken[hostPort] && reusable == 0 {
+					reusable = hostPort
+				}
+				continue
+			}
+
+			taken[hostPort] = true
+			hostPorts[port] = hostPort
+			break
+		}
+	}
+	return hostPorts, replaced, nil
+}
+
+func containerIn(container *docker.Container, containers []*docker.Container) bool {
+	for _, c := range containers {
+		if c.ID == container.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// publishedPorts returns the exposed ports to publish: all of them, or with
+// GALAXY_PUBLISH=declared only the ones in the app's config, the lowest
+// numbered TCP port if it has a GALAXY_PORT and each GALAXY_PORT_<port>.
+func publishedPorts(env map[string]string, exposed map[docker.Port]struct{}) ([]docker.Port, error) {
+	ports := []docker.Port{}
+	for port := range exposed {
+		ports = append(ports, port)
+	}
+	sort.Sort(byPortNumber(ports))
+
+	switch env["GALAXY_PUBLISH"] {
+	case "", "all":
+		return ports, nil
+	case "declared":
+	default:
+		return nil, fmt.Errorf("invalid GALAXY_PUBLISH %s, use all or declared", env["GALAXY_PUBLISH"])
+	}
+
+	declared := []docker.Port{}
+	primary := env["GALAXY_PORT"] != ""
+	for _, port := range ports {
+		if primary && port.Proto() == "tcp" {
+			declared = append(declared, port)
+			primary = false
+			continue
+		}
+		if env["GALAXY_PORT_"+port.Port()] != "" {
+			declared = append(declared, port)
+		}
+	}
+	return declared, nil
+}
+
+type byPortNumber []docker.Port
+
+func (p byPortNumber) Len() int      { return len(p) }
+func (p byPortNumber) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byPortNumber) Less(i, j int) bool {
+	a, _ := strconv.Atoi(p[i].Port())
+	b, _ := strconv.Atoi(p[j].Port())
+	if a != b {
+		return a < b
+	}
+	return p[i].Proto() < p[j].Proto()
+}
+
+// bindIP returns the host address to publish appCfg's ports on, from its
+// GALAXY_BIND_IP, e.g. $HOST_IP for the host's private interface, or the
+// runtime's BindIP.  "" is every interface.
+func (s *ServiceRuntime) bindIP(appCfg *config.AppConfig) (string, error) {
+	ip := s.BindIP
+	if v := appCfg.Env()["GALAXY_BIND_IP"]; v != "" {
+		ip = s.replaceVarEnv(v, s.hostIP)
+	}
+	if ip != "" && net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("invalid bind address %s", ip)
+	}
+	return ip, nil
+}
+
+// publishesPorts returns false for network modes where the container has no
+// network of its own to publish ports from.
+func publishesPorts(network string) bool {
+	return network != "host" && network != "none" && !strings.HasPrefix(network, "container:")
+}
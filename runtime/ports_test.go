@@ -0,0 +1,107 @@
+package runtime
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/litl/galaxy/registry"
+)
+
+func TestAssignPorts(t *testing.T) {
+	old := testContainer("a", "image1")
+	other := testContainer("b", "image1")
+
+	// slot n of each port is 20000 + 100*port + n, and the env has host
+	// ports for slots up to max
+	allocator := func(max int) func(docker.Port, int) (int, error) {
+		return func(port docker.Port, slot int) (int, error) {
+			if slot > max {
+				return 0, &registry.NoHostPortsError{Env: "dev", Owner: string(port)}
+			}
+			var n int
+			fmt.Sscanf(port.Port(), "%d", &n)
+			return 20000 + 100*n + slot, nil
+		}
+	}
+
+	for _, test := range []struct {
+		held     map[int]*docker.Container
+		max      int
+		expected map[docker.Port]int
+		replaced []*docker.Container
+	}{
+		// nothing running
+		{
+			map[int]*docker.Container{},
+			10,
+			map[docker.Port]int{"1/tcp": 20100, "2/tcp": 20200},
+			[]*docker.Container{},
+		},
+		// an old version keeps its ports and the new one takes the next
+		// slot, so both run until the new one registers
+		{
+			map[int]*docker.Container{20100: old, 20200: old},
+			10,
+			map[docker.Port]int{"1/tcp": 20101, "2/tcp": 20201},
+			[]*docker.Container{},
+		},
+		// a current container or anything else moves it to the next slot
+		{
+			map[int]*docker.Container{20100: nil, 20200: nil, 20201: old},
+			10,
+			map[docker.Port]int{"1/tcp": 20101, "2/tcp": 20202},
+			[]*docker.Container{},
+		},
+		// only with no free ports left are the old versions' reused
+		{
+			map[int]*docker.Container{20100: old, 20200: other},
+			0,
+			map[docker.Port]int{"1/tcp": 20100, "2/tcp": 20200},
+			[]*docker.Container{old, other},
+		},
+		{
+			map[int]*docker.Container{20100: nil, 20101: old, 20200: old, 20201: old},
+			1,
+			map[docker.Port]int{"1/tcp": 20101, "2/tcp": 20200},
+			[]*docker.Container{old},
+		},
+	} {
+		hostPorts, replaced, err := assignPorts([]docker.Port{"1/tcp", "2/tcp"}, test.held, allocator(test.max))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(hostPorts, test.expected) {
+			t.Fatalf("expected %v for %v. Got %v", test.expected, test.held, hostPorts)
+		}
+		if !reflect.DeepEqual(replaced, test.replaced) {
+			t.Fatalf("expected %v replaced for %v. Got %v", test.replaced, test.held, replaced)
+		}
+	}
+
+	// a current container's port is never reused
+	_, _, err := assignPorts([]docker.Port{"1/tcp"}, map[int]*docker.Container{20100: nil}, allocator(0))
+	if _, ok := err.(*registry.NoHostPortsError); !ok {
+		t.Fatalf("expected no free host ports. Got %v", err)
+	}
+
+	// two ports can't be given the same host port
+	same := func(port docker.Port, slot int) (int, error) {
+		return 20000 + slot, nil
+	}
+	hostPorts, _, err := assignPorts([]docker.Port{"1/tcp", "2/tcp"}, map[int]*docker.Container{}, same)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hostPorts["1/tcp"] != 20000 || hostPorts["2/tcp"] != 20001 {
+		t.Fatalf("expected 20000 and 20001. Got %v", hostPorts)
+	}
+
+	_, _, err = assignPorts([]docker.Port{"1/tcp"}, map[int]*docker.Container{}, func(docker.Port, int) (int, error) {
+		return 0, fmt.Errorf("no free host ports")
+	})
+	if err == nil {
+		t.Fatal("expected the allocation error")
+	}
+}
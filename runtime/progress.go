@@ -0,0 +1,37 @@
+package runtime
+
+import (
+	"time"
+)
+
+// Progress is a step of a runtime operation, e.g. a pull finishing or a
+// container starting, sent to ServiceRuntime's Progress callback.  Step is
+// one of pull, pulled, pull.retry, create, start, started, stop, stopped,
+// remove or stop.failed.  App and Container are "" when they don't apply,
+// like for pulls.
+type Progress struct {
+	Time      time.Time `json:"time"`
+	Step      string    `json:"step"`
+	App       string    `json:"app,omitempty"`
+	Version   string    `json:"version,omitempty"`
+	Container string    `json:"container,omitempty"`
+	Message   string    `json:"message"`
+}
+
+// progress sends a step to the Progress callback, if there is one.
+func (s *ServiceRuntime) progress(step, app, version, container, message string) {
+	if s.Progress == nil {
+		return
+	}
+	if len(container) > 12 {
+		container = container[0:12]
+	}
+	s.Progress(&Progress{
+		Time:      time.Now().UTC(),
+		Step:      step,
+		App:       app,
+		Version:   version,
+		Container: container,
+		Message:   message,
+	})
+}
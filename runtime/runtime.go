@@ -1,17 +1,21 @@
 package runtime
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
-	"os/exec"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	auth "github.com/dotcloud/docker/registry"
+	"github.com/docker/docker/pkg/term"
 	docker "github.com/fsouza/go-dockerclient"
 	"github.com/litl/galaxy/config"
 	"github.com/litl/galaxy/log"
@@ -19,30 +23,109 @@ import (
 	"github.com/litl/galaxy/utils"
 )
 
-var blacklistedContainerId = make(map[string]bool)
+// MaxParallelStops is how many containers are stopped at once when
+// clearing out old ones.
+const MaxParallelStops = 4
+
+const (
+	// DefaultPullTimeout is how long an image pull can take before it's
+	// retried.
+	DefaultPullTimeout = 10 * time.Minute
+
+	// pullAttempts is how many times a pull is tried, waiting pullBackoff
+	// after the first failure and twice as long after each one after.
+	pullAttempts = 4
+	pullBackoff  = 5 * time.Second
+)
+
+// ExitError is returned by RunCommand when the command exits with a
+// non-zero status.
+type ExitError struct {
+	Status int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("command exited with status %d", e.Status)
+}
+
+// ErrContainerStopped is returned by Start when the new container exits
+// within a few seconds of starting.
+var ErrContainerStopped = errors.New("container stopped unexpectedly")
 
 type ServiceRuntime struct {
-	dockerClient    *docker.Client
-	authConfig      *auth.ConfigFile
-	dns             string
-	serviceRegistry *registry.ServiceRegistry
-	dockerIP        string
-	hostIP          string
+	// BlacklistFile keeps track of containers that won't stop across
+	// restarts.  They're only kept in memory if it's "".
+	BlacklistFile string
+	// PullTimeout limits each attempt to pull an image, 0 for no limit
+	PullTimeout time.Duration
+	// PullOutput gets the progress of image pulls.  Pulls are quiet if
+	// it's nil.
+	PullOutput io.Writer
+	// RegistryAuths are logins for docker registries by hostname, used
+	// before any docker config files
+	RegistryAuths map[string]RegistryAuth
+	// CredentialHelper is a docker credential helper, e.g. "ecr-login"
+	// for docker-credential-ecr-login, to ask for logins
+	CredentialHelper string
+	// MemoryReserve is the memory in bytes kept free for the host when
+	// deciding if a container fits
+	MemoryReserve int64
+	// ImageMirrors are pull-through caches images are pulled from before
+	// their registry, by registry hostname or docker.io for Docker Hub
+	ImageMirrors map[string]string
+	// ConfigStore has the service ports of apps' dependencies for their
+	// <APP>_ADDR variables.  They're left out if it's nil.
+	ConfigStore *config.Store
+	// BindIP is the host address containers' ports are published on,
+	// unless an app sets its own GALAXY_BIND_IP.  "" is every interface.
+	BindIP string
+	// HostLabels are this host's labels, e.g. "ssd,az=us-east-1a".  Apps
+	// whose GALAXY_CONSTRAINTS they don't satisfy aren't started.
+	HostLabels string
+	// Progress is called with each step of pulls, starts and stops, so
+	// they can be shown to users as they happen.  It's called from
+	// several goroutines at once when containers are stopped in parallel.
+	Progress func(*Progress)
+
+	dockerMu         sync.Mutex
+	dockerClient     *docker.Client
+	dockerVersion    string
+	dockerAPIVersion docker.APIVersion
+	dockerConfig     DockerConfig
+	dns              string
+	serviceRegistry  *registry.ServiceRegistry
+	dockerIP         string
+	hostIP           string
+
+	zombieMu sync.Mutex
+	zombies  map[string]*Zombie
+
+	// verified has the images checked against their env's image policy
+	verifiedMu sync.Mutex
+	verified   map[string]bool
+
+	// pulls has the image pulls in progress, by image
+	pullMu sync.Mutex
+	pulls  map[string]*imagePull
 }
 
+// ContainerEvent is sent by RegisterEvents when a container starts or
+// stops.  Container is nil if it was removed before it could be inspected.
 type ContainerEvent struct {
 	Status              string
 	Container           *docker.Container
 	ServiceRegistration *registry.ServiceRegistration
 }
 
-func NewServiceRuntime(serviceRegistry *registry.ServiceRegistry, dns, hostIP string) *ServiceRuntime {
-	dockerZero, err := dockerBridgeIp()
+func NewServiceRuntime(serviceRegistry *registry.ServiceRegistry, dns, hostIP string, dockerConfig DockerConfig) *ServiceRuntime {
+	dockerZero, err := dockerBridgeIp(dockerConfig.Host)
 	if err != nil {
 		log.Fatalf("ERROR: Unable to find docker0 bridge: %s", err)
 	}
 
 	return &ServiceRuntime{
+		PullTimeout:     DefaultPullTimeout,
+		dockerConfig:    dockerConfig,
 		dns:             dns,
 		serviceRegistry: serviceRegistry,
 		hostIP:          hostIP,
@@ -93,17 +176,18 @@ func parseHost(addr string) (string, string, error) {
 	}
 
 	if proto != "unix" && strings.Contains(addr, ":") {
-		hostParts := strings.Split(addr, ":")
-		if len(hostParts) != 2 {
+		// SplitHostPort handles bracketed IPv6 hosts, e.g. [::1]:2375
+		hostPart, portPart, err := net.SplitHostPort(addr)
+		if err != nil {
 			return "", "", fmt.Errorf("Invalid bind address format: %s", addr)
 		}
-		if hostParts[0] != "" {
-			host = hostParts[0]
+		if hostPart != "" {
+			host = hostPart
 		} else {
 			host = "127.0.0.1"
 		}
 
-		if p, err := strconv.Atoi(hostParts[1]); err == nil && p != 0 {
+		if p, err := strconv.Atoi(portPart); err == nil && p != 0 {
 			port = p
 		} else {
 			return "", "", fmt.Errorf("Invalid bind address format: %s", addr)
@@ -118,14 +202,19 @@ func parseHost(addr string) (string, string, error) {
 		return proto, host, nil
 
 	}
-	return proto, fmt.Sprintf("%s:%d", host, port), nil
+	return proto, net.JoinHostPort(host, strconv.Itoa(port)), nil
 }
 
-func dockerBridgeIp() (string, error) {
-	dh := os.Getenv("DOCKER_HOST")
-	if dh != "" && strings.HasPrefix(dh, "tcp") {
+// dockerBridgeIp returns the docker0 address, or the daemon's address if
+// it's remote.
+func dockerBridgeIp(dh string) (string, error) {
+	if strings.HasPrefix(dh, "tcp") {
 		_, hostPort, err := parseHost(dh)
-		return strings.Split(hostPort, ":")[0], err
+		if err != nil {
+			return "", err
+		}
+		host, _, err := net.SplitHostPort(hostPort)
+		return host, err
 	}
 
 	dockerZero, err := net.InterfaceByName("docker0")
@@ -133,27 +222,33 @@ func dockerBridgeIp() (string, error) {
 		return "", err
 	}
 	addrs, _ := dockerZero.Addrs()
+
+	// prefer the IPv4 address, but an IPv6 only bridge will have a global
+	// unicast address instead
+	var ipv6 net.IP
 	for _, addr := range addrs {
 		ip, _, err := net.ParseCIDR(addr.String())
 		if err != nil {
 			return "", err
 		}
-		if ip.DefaultMask() != nil {
+		if ip.To4() != nil {
 			return ip.String(), nil
 		}
+		if ipv6 == nil && ip.IsGlobalUnicast() {
+			ipv6 = ip
+		}
+	}
+	if ipv6 != nil {
+		return ipv6.String(), nil
 	}
 	return "", errors.New("unable to find docker0 interface")
 }
 
 func (s *ServiceRuntime) ensureDockerClient() *docker.Client {
-	if s.dockerClient == nil {
-		endpoint := GetEndpoint()
-		client, err := docker.NewClient(endpoint)
-		if err != nil {
-			log.Fatalf("ERROR: Unable to connect to docker: %s: %s", err, endpoint)
-		}
-		s.dockerClient = client
-
+	s.dockerMu.Lock()
+	defer s.dockerMu.Unlock()
+	if s.dockerClient == nil || s.dockerAPIVersion == nil {
+		s.connectDocker()
 	}
 	return s.dockerClient
 }
@@ -162,6 +257,16 @@ func (s *ServiceRuntime) Ping() error {
 	return s.ensureDockerClient().Ping()
 }
 
+// HostResources returns the total memory in bytes and number of CPUs docker
+// reports for the host.
+func (s *ServiceRuntime) HostResources() (int64, int, error) {
+	info, err := s.ensureDockerClient().Info()
+	if err != nil {
+		return 0, 0, err
+	}
+	return info.GetInt64("MemTotal"), info.GetInt("NCPU"), nil
+}
+
 func (s *ServiceRuntime) InspectImage(image string) (*docker.Image, error) {
 	return s.ensureDockerClient().InspectImage(image)
 }
@@ -170,6 +275,18 @@ func (s *ServiceRuntime) InspectContainer(id string) (*docker.Container, error)
 	return s.ensureDockerClient().InspectContainer(id)
 }
 
+// execStatusMarker precedes the exit status that Exec has the shell print.
+const execStatusMarker = "GALAXY_EXEC_STATUS="
+
+// Exec runs cmd with sh inside the container and returns its exit status
+// and output.  Our docker client can't inspect an exec once it's done, so
+// the shell prints the exit status after the command's output.
+func (s *ServiceRuntime) Exec(containerID, cmd string) (int, string, error) {
+	var out bytes.Buffer
+	status, err := execIn(s.ensureDockerClient(), containerID, cmd, &out, &out)
+	return status, out.String(), err
+}
+
 func (s *ServiceRuntime) StopAllMatching(name string) error {
 	containers, err := s.ManagedContainers()
 	if err != nil {
@@ -190,74 +307,90 @@ func (s *ServiceRuntime) StopAllMatching(name string) error {
 
 }
 
-func (s *ServiceRuntime) Stop(appCfg *config.AppConfig) error {
+// Stop stops one of the containers of appCfg's current version and returns
+// its short ID, or "" if there are none.
+func (s *ServiceRuntime) Stop(appCfg *config.AppConfig) (string, error) {
 	containers, err := s.ManagedContainers()
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	for _, container := range containers {
 		cenv := s.EnvFor(container)
-		if cenv["GALAXY_APP"] == appCfg.Name &&
+		if sameApp(cenv, appCfg) &&
 			cenv["GALAXY_VERSION"] == strconv.FormatInt(appCfg.ID(), 10) &&
 			appCfg.VersionID() == container.Image {
-			return s.stopContainer(container)
+			return container.ID[0:12], s.stopContainer(container)
 		}
 	}
-	return nil
+	return "", nil
+}
+
+// StopContainer stops the container with id and its sidecars.
+func (s *ServiceRuntime) StopContainer(id string) error {
+	container, err := s.ensureDockerClient().InspectContainer(id)
+	if err != nil {
+		return err
+	}
+	return s.stopContainer(container)
 }
 
 func (s *ServiceRuntime) stopContainer(container *docker.Container) error {
-	if _, ok := blacklistedContainerId[container.ID]; ok {
+	if s.blacklisted(container.ID) {
 		log.Printf("Container %s blacklisted. Won't try to stop.\n", container.ID)
 		return nil
 	}
 
-	log.Printf("Stopping %s container %s\n", strings.TrimPrefix(container.Name, "/"), container.ID[0:12])
+	name := strings.TrimPrefix(container.Name, "/")
+	app := s.EnvFor(container)["GALAXY_APP"]
+	log.Printf("Stopping %s container %s\n", name, container.ID[0:12])
+	s.progress("stop", app, container.Config.Image, container.ID,
+		fmt.Sprintf("stopping %s container %s", name, container.ID[0:12]))
 
-	c := make(chan error, 1)
-	go func() { c <- s.ensureDockerClient().StopContainer(container.ID, 10) }()
-	select {
-	case err := <-c:
-		if err != nil {
-			log.Printf("ERROR: Unable to stop container: %s\n", container.ID)
-			return err
+	err := s.forceStop(container)
+	if err != nil {
+		s.progress("stop.failed", app, container.Config.Image, container.ID,
+			fmt.Sprintf("unable to stop container %s: %s", container.ID[0:12], err))
+		if s.stopFailed(container, err) {
+			log.Printf("ERROR: Unable to stop container %s after %d attempts. Zombie? Blacklisting: %s\n",
+				container.ID, MaxStopAttempts, err)
+			return nil
 		}
-	case <-time.After(20 * time.Second):
-		blacklistedContainerId[container.ID] = true
-		log.Printf("ERROR: Timed out trying to stop container. Zombie?. Blacklisting: %s\n", container.ID)
-		return nil
+		log.Printf("ERROR: Unable to stop container %s: %s\n", container.ID, err)
+		return err
 	}
-	log.Printf("Stopped %s container %s\n", strings.TrimPrefix(container.Name, "/"), container.ID[0:12])
+	s.stopped(container.ID)
+	log.Printf("Stopped %s container %s\n", name, container.ID[0:12])
+	s.progress("stopped", app, container.Config.Image, container.ID,
+		fmt.Sprintf("stopped %s container %s", name, container.ID[0:12]))
 
-	return nil
+	return s.stopSidecars(container)
 	/*	return s.ensureDockerClient().RemoveContainer(docker.RemoveContainerOptions{
 		ID:            container.ID,
 		RemoveVolumes: true,
 	})*/
 }
 
-func (s *ServiceRuntime) StopOldVersion(appCfg *config.AppConfig, limit int) error {
-	containers, err := s.ManagedContainers()
-	if err != nil {
-		return err
-	}
-
-	stopped := 0
+// oldVersions returns up to limit of containers that run appCfg with
+// another image or config, or all of them if limit is negative.  inspect
+// looks up a container's image.
+func (s *ServiceRuntime) oldVersions(containers []*docker.Container, appCfg *config.AppConfig, limit int,
+	inspect func(string) (*docker.Image, error)) []*docker.Container {
 
+	var old []*docker.Container
 	for _, container := range containers {
 
-		if stopped == limit {
-			return nil
+		if len(old) == limit {
+			break
 		}
 
 		env := s.EnvFor(container)
 		// Container name does match one that would be started w/ this service config
-		if env["GALAXY_APP"] != appCfg.Name {
+		if !sameApp(env, appCfg) {
 			continue
 		}
 
-		image, err := s.InspectImage(container.Image)
+		image, err := inspect(container.Image)
 		if err != nil {
 			log.Errorf("ERROR: Unable to inspect image: %s", container.Image)
 			continue
@@ -275,49 +408,88 @@ func (s *ServiceRuntime) StopOldVersion(appCfg *config.AppConfig, limit int) err
 		versionDiffers := version != strconv.FormatInt(appCfg.ID(), 10) && version != ""
 
 		if imageDiffers || versionDiffers {
-			s.stopContainer(container)
-			stopped = stopped + 1
+			old = append(old, container)
 		}
 	}
-	return nil
+	return old
 }
 
-func (s *ServiceRuntime) StopAllButCurrentVersion(appCfg *config.AppConfig) error {
+// StopOldVersion stops up to limit containers of appCfg's other versions
+// and returns the short IDs of the ones that stopped.
+func (s *ServiceRuntime) StopOldVersion(appCfg *config.AppConfig, limit int) ([]string, error) {
 	containers, err := s.ManagedContainers()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	for _, container := range containers {
+	return s.stopContainers(s.oldVersions(containers, appCfg, limit, s.InspectImage))
+}
 
-		env := s.EnvFor(container)
-		// Container name does match one that would be started w/ this service config
-		if env["GALAXY_APP"] != appCfg.Name {
-			continue
-		}
+// StopAllButCurrentVersion stops all of the containers of appCfg's other
+// versions and returns the short IDs of the ones that stopped.
+func (s *ServiceRuntime) StopAllButCurrentVersion(appCfg *config.AppConfig) ([]string, error) {
+	containers, err := s.ManagedContainers()
+	if err != nil {
+		return nil, err
+	}
 
-		image, err := s.InspectImage(container.Image)
-		if err != nil {
-			log.Errorf("ERROR: Unable to inspect image: %s", container.Image)
-			continue
-		}
+	return s.stopContainers(s.oldVersions(containers, appCfg, -1, s.InspectImage))
+}
 
-		if image == nil {
-			log.Errorf("ERROR: Image for container %s does not exist!", container.ID[0:12])
-			continue
+// NewContainers returns app's running containers whose IDs aren't in
+// known, e.g. the ones a reconcile started.
+func (s *ServiceRuntime) NewContainers(app string, known map[string]bool) ([]*docker.Container, error) {
+	containers, err := s.ManagedContainers()
+	if err != nil {
+		return nil, err
+	}
+	return s.newContainers(containers, app, known), nil
+}
 
+func (s *ServiceRuntime) newContainers(containers []*docker.Container, app string, known map[string]bool) []*docker.Container {
+	started := []*docker.Container{}
+	for _, container := range containers {
+		if s.EnvFor(container)["GALAXY_APP"] == app && !known[container.ID] {
+			started = append(started, container)
 		}
+	}
+	return started
+}
 
-		version := env["GALAXY_VERSION"]
+// OldVersions returns the short IDs of the running containers of appCfg's
+// other versions.
+func (s *ServiceRuntime) OldVersions(appCfg *config.AppConfig) ([]string, error) {
+	containers, err := s.ManagedContainers()
+	if err != nil {
+		return nil, err
+	}
 
-		imageDiffers := image.ID != appCfg.VersionID() && appCfg.VersionID() != ""
-		versionDiffers := version != strconv.FormatInt(appCfg.ID(), 10) && version != ""
+	ids := []string{}
+	for _, container := range s.oldVersions(containers, appCfg, -1, s.InspectImage) {
+		ids = append(ids, container.ID[0:12])
+	}
+	return ids, nil
+}
 
-		if imageDiffers || versionDiffers {
-			s.stopContainer(container)
+// stopAllButLatest returns the containers to stop in containers: all but
+// the latest of each app that are older than stopCutoff seconds.
+func (s *ServiceRuntime) stopAllButLatest(containers []*docker.Container, stopCutoff int64) []*docker.Container {
+	latest := make(map[string]*docker.Container)
+	for _, container := range containers {
+		name := s.EnvFor(container)["GALAXY_APP"]
+		if latest[name] == nil || container.Created.After(latest[name].Created) {
+			latest[name] = container
 		}
 	}
-	return nil
+
+	var toStop []*docker.Container
+	for _, container := range containers {
+		if container.ID != latest[s.EnvFor(container)["GALAXY_APP"]].ID &&
+			container.Created.Unix() < (time.Now().Unix()-stopCutoff) {
+			toStop = append(toStop, container)
+		}
+	}
+	return toStop
 }
 
 func (s *ServiceRuntime) StopAllButLatestService(name string, stopCutoff int64) error {
@@ -326,24 +498,15 @@ func (s *ServiceRuntime) StopAllButLatestService(name string, stopCutoff int64)
 		return err
 	}
 
-	var toStop []*docker.Container
-	var latestContainer *docker.Container
+	var matching []*docker.Container
 	for _, container := range containers {
 		if s.EnvFor(container)["GALAXY_APP"] == name {
-			if latestContainer == nil || container.Created.After(latestContainer.Created) {
-				latestContainer = container
-			}
-			toStop = append(toStop, container)
+			matching = append(matching, container)
 		}
 	}
 
-	for _, container := range toStop {
-		if container.ID != latestContainer.ID &&
-			container.Created.Unix() < (time.Now().Unix()-stopCutoff) {
-			s.stopContainer(container)
-		}
-	}
-	return nil
+	_, err = s.stopContainers(s.stopAllButLatest(matching, stopCutoff))
+	return err
 }
 
 func (s *ServiceRuntime) StopAllButLatest(env string, stopCutoff int64) error {
@@ -353,11 +516,48 @@ func (s *ServiceRuntime) StopAllButLatest(env string, stopCutoff int64) error {
 		return err
 	}
 
-	for _, c := range containers {
-		s.StopAllButLatestService(s.EnvFor(c)["GALAXY_APP"], stopCutoff)
-	}
+	_, err = s.stopContainers(s.stopAllButLatest(containers, stopCutoff))
+	return err
+}
 
-	return nil
+// stopContainers stops containers, up to MaxParallelStops at a time, and
+// returns the short IDs of the ones that stopped and an error listing the
+// ones that failed.
+func (s *ServiceRuntime) stopContainers(containers []*docker.Container) ([]string, error) {
+	return stopParallel(containers, s.stopContainer)
+}
+
+// stopParallel calls stop for each of containers, up to MaxParallelStops
+// at a time.
+func stopParallel(containers []*docker.Container, stop func(*docker.Container) error) ([]string, error) {
+	errs := make([]error, len(containers))
+	sem := make(chan struct{}, MaxParallelStops)
+	var wg sync.WaitGroup
+	for i, container := range containers {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, container *docker.Container) {
+			defer wg.Done()
+			errs[i] = stop(container)
+			<-sem
+		}(i, container)
+	}
+	wg.Wait()
+
+	stopped := []string{}
+	failed := []string{}
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", containers[i].ID[0:12], err))
+			continue
+		}
+		stopped = append(stopped, containers[i].ID[0:12])
+	}
+	if len(failed) > 0 {
+		return stopped, fmt.Errorf("unable to stop %d of %d containers: %s",
+			len(failed), len(containers), strings.Join(failed, "; "))
+	}
+	return stopped, nil
 }
 
 func (s *ServiceRuntime) StopAll(env string) error {
@@ -389,31 +589,56 @@ func (s *ServiceRuntime) GetImageByName(img string) (*docker.APIImages, error) {
 
 }
 
+// oneOffEnv returns the environment for a one-off container of appCfg,
+// given the next free instance slot.
+func (s *ServiceRuntime) oneOffEnv(env string, appCfg *config.AppConfig) ([]string, error) {
+	instanceId, err := s.NextInstanceSlot(appCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// one-off containers don't run in a pool
+	envVars, err := s.containerEnv(env, "", appCfg)
+	if err != nil {
+		return nil, err
+	}
+	envVars = append(envVars, "GALAXY_APP="+appCfg.Name)
+	envVars = append(envVars, "GALAXY_VERSION="+strconv.FormatInt(appCfg.ID(), 10))
+	envVars = append(envVars, fmt.Sprintf("GALAXY_INSTANCE=%s", strconv.FormatInt(int64(instanceId), 10)))
+	envVars = append(envVars, "GALAXY_ONEOFF=1")
+	if appCfg.DeployID() != "" {
+		envVars = append(envVars, "GALAXY_DEPLOY="+appCfg.DeployID())
+	}
+	return envVars, nil
+}
+
+// isOneOff returns true if a container with env was started by RunCommand,
+// StartInteractive or a hook rather than as an instance of its app.
+func isOneOff(env map[string]string) bool {
+	return env["GALAXY_ONEOFF"] != ""
+}
+
 func (s *ServiceRuntime) RunCommand(env string, appCfg *config.AppConfig, cmd []string) (*docker.Container, error) {
 
 	// see if we have the image locally
 	fmt.Fprintf(os.Stderr, "Pulling latest image for %s\n", appCfg.Version())
-	_, err := s.PullImage(appCfg.Version(), appCfg.VersionID())
+	image, err := s.PullImage(appCfg.Version(), appCfg.VersionID())
 	if err != nil {
 		return nil, err
 	}
+	if image == nil {
+		return nil, fmt.Errorf("unable to pull %s: not found", appCfg.Version())
+	}
 
-	instanceId, err := s.NextInstanceSlot(appCfg.Name, strconv.FormatInt(appCfg.ID(), 10))
+	err = s.CheckImagePolicy(env, appCfg.Version(), image.ID)
 	if err != nil {
 		return nil, err
 	}
 
-	envVars := []string{"ENV=" + env}
-
-	for key, value := range appCfg.Env() {
-		if key == "ENV" {
-			continue
-		}
-		envVars = append(envVars, strings.ToUpper(key)+"="+s.replaceVarEnv(value, s.hostIP))
+	envVars, err := s.oneOffEnv(env, appCfg)
+	if err != nil {
+		return nil, err
 	}
-	envVars = append(envVars, "GALAXY_APP="+appCfg.Name)
-	envVars = append(envVars, "GALAXY_VERSION="+strconv.FormatInt(appCfg.ID(), 10))
-	envVars = append(envVars, fmt.Sprintf("GALAXY_INSTANCE=%s", strconv.FormatInt(int64(instanceId), 10)))
 
 	runCmd := []string{"/bin/bash", "-c", strings.Join(cmd, " ")}
 
@@ -432,12 +657,13 @@ func (s *ServiceRuntime) RunCommand(env string, appCfg *config.AppConfig, cmd []
 		return nil, err
 	}
 
+	stopSignal, timeout := stopSettings(appCfg.Env(), 3*time.Second)
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill)
 	go func(s *ServiceRuntime, containerId string) {
 		<-c
 		log.Println("Stopping container...")
-		err := s.ensureDockerClient().StopContainer(containerId, 3)
+		err := s.gracefulStop(containerId, stopSignal, timeout)
 		if err != nil {
 			log.Printf("ERROR: Unable to stop container: %s", err)
 		}
@@ -457,119 +683,203 @@ func (s *ServiceRuntime) RunCommand(env string, appCfg *config.AppConfig, cmd []
 	if s.dns != "" {
 		config.DNS = []string{s.dns}
 	}
-	err = s.ensureDockerClient().StartContainer(container.ID, config)
-
-	if err != nil {
-		return container, err
+	status, err := s.startAttached(container.ID, config, os.Stdout, os.Stderr)
+	if err == nil && status != 0 {
+		err = &ExitError{Status: status}
 	}
+	return container, err
+}
 
-	// FIXME: Hack to work around the race of attaching to a container before it's
-	// actually running.  Tried polling the container and then attaching but the
-	// output gets lost sometimes if the command executes very quickly. Not sure
-	// what's going on.
-	time.Sleep(1 * time.Second)
-
-	err = s.ensureDockerClient().AttachToContainer(docker.AttachToContainerOptions{
-		Container:    container.ID,
-		OutputStream: os.Stdout,
-		ErrorStream:  os.Stderr,
-		Logs:         true,
-		Stream:       false,
-		Stdout:       true,
-		Stderr:       true,
-	})
+// startAttached starts the created container id, copies its output to
+// stdout and stderr until it exits and returns its exit status.  It
+// attaches before starting so output from commands that exit right away
+// isn't lost.
+func (s *ServiceRuntime) startAttached(id string, hostConfig *docker.HostConfig, stdout, stderr io.Writer) (int, error) {
+	attached := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ensureDockerClient().AttachToContainer(docker.AttachToContainerOptions{
+			Container:    id,
+			OutputStream: stdout,
+			ErrorStream:  stderr,
+			Stream:       true,
+			Stdout:       true,
+			Stderr:       true,
+			Success:      attached,
+		})
+	}()
 
+	select {
+	case <-attached:
+		attached <- struct{}{}
+	case err := <-done:
+		return 0, fmt.Errorf("unable to attach to container: %s", err)
+	}
+
+	err := s.ensureDockerClient().StartContainer(id, hostConfig)
 	if err != nil {
-		log.Printf("ERROR: Unable to attach to running container: %s", err.Error())
+		return 0, err
 	}
 
-	s.ensureDockerClient().WaitContainer(container.ID)
+	status, err := s.ensureDockerClient().WaitContainer(id)
+	if err != nil {
+		return 0, err
+	}
 
-	return container, err
+	// the output can trail the exit
+	err = <-done
+	if err != nil {
+		log.Printf("ERROR: Unable to read container output: %s", err)
+	}
+	return status, nil
 }
 
 func (s *ServiceRuntime) StartInteractive(env, pool string, appCfg *config.AppConfig) error {
 
 	// see if we have the image locally
 	fmt.Fprintf(os.Stderr, "Pulling latest image for %s\n", appCfg.Version())
-	_, err := s.PullImage(appCfg.Version(), appCfg.VersionID())
+	image, err := s.PullImage(appCfg.Version(), appCfg.VersionID())
 	if err != nil {
 		return err
 	}
-
-	args := []string{
-		"run", "--rm", "-i",
+	if image == nil {
+		return fmt.Errorf("unable to pull %s: not found", appCfg.Version())
 	}
-	args = append(args, "-e")
-	args = append(args, "ENV"+"="+env)
 
-	for key, value := range appCfg.Env() {
-		if key == "ENV" {
-			continue
-		}
-
-		args = append(args, "-e")
-		args = append(args, strings.ToUpper(key)+"="+s.replaceVarEnv(value, s.hostIP))
-	}
-
-	args = append(args, "-e")
-	args = append(args, fmt.Sprintf("HOST_IP=%s", s.hostIP))
-	if s.dns != "" {
-		args = append(args, "--dns")
-		args = append(args, s.dns)
+	err = s.CheckImagePolicy(env, appCfg.Version(), image.ID)
+	if err != nil {
+		return err
 	}
-	args = append(args, "-e")
-	args = append(args, fmt.Sprintf("GALAXY_APP=%s", appCfg.Name))
-	args = append(args, "-e")
-	args = append(args, fmt.Sprintf("GALAXY_VERSION=%s", strconv.FormatInt(appCfg.ID(), 10)))
 
-	instanceId, err := s.NextInstanceSlot(appCfg.Name, strconv.FormatInt(appCfg.ID(), 10))
+	envVars, err := s.oneOffEnv(env, appCfg)
 	if err != nil {
 		return err
 	}
-	args = append(args, "-e")
-	args = append(args, fmt.Sprintf("GALAXY_INSTANCE=%s", strconv.FormatInt(int64(instanceId), 10)))
+	envVars = append(envVars, fmt.Sprintf("HOST_IP=%s", s.hostIP))
 
 	publicDns, err := EC2PublicHostname()
 	if err != nil {
 		log.Warnf("Unable to determine public hostname. Not on AWS? %s", err)
 		publicDns = "127.0.0.1"
 	}
+	envVars = append(envVars, fmt.Sprintf("PUBLIC_HOSTNAME=%s", publicDns))
 
-	args = append(args, "-e")
-	args = append(args, fmt.Sprintf("PUBLIC_HOSTNAME=%s", publicDns))
+	mem, cpu, err := appLimits(appCfg, pool)
+	if err != nil {
+		return err
+	}
 
-	mem := appCfg.GetMemory(pool)
-	if mem != "" {
-		args = append(args, "-m")
-		args = append(args, mem)
+	container, err := s.ensureDockerClient().CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{
+			Image:        appCfg.Version(),
+			Env:          envVars,
+			Memory:       mem,
+			CPUShares:    cpu,
+			Tty:          true,
+			OpenStdin:    true,
+			StdinOnce:    true,
+			AttachStdin:  true,
+			AttachStdout: true,
+			AttachStderr: true,
+			Cmd:          []string{"/bin/bash"},
+		},
+	})
+	if err != nil {
+		return err
 	}
 
-	cpu := appCfg.GetCPUShares(pool)
-	if cpu != "" {
-		args = append(args, "-c")
-		args = append(args, cpu)
+	defer s.ensureDockerClient().RemoveContainer(docker.RemoveContainerOptions{
+		ID: container.ID,
+	})
+
+	// pass keystrokes, including ^C, straight through to the container's
+	// terminal
+	stdinFd := os.Stdin.Fd()
+	if term.IsTerminal(stdinFd) {
+		state, err := term.SetRawTerminal(stdinFd)
+		if err != nil {
+			return err
+		}
+		defer term.RestoreTerminal(stdinFd, state)
 	}
 
-	args = append(args, []string{"-t", appCfg.Version(), "/bin/bash"}...)
-	// shell out to docker run to get signal forwarded and terminal setup correctly
-	//cmd := exec.Command("docker", "run", "-rm", "-i", "-t", appCfg.Version(), "/bin/bash")
-	cmd := exec.Command("docker", args...)
+	attached := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ensureDockerClient().AttachToContainer(docker.AttachToContainerOptions{
+			Container:    container.ID,
+			InputStream:  os.Stdin,
+			OutputStream: os.Stdout,
+			ErrorStream:  os.Stderr,
+			Stream:       true,
+			Stdin:        true,
+			Stdout:       true,
+			Stderr:       true,
+			RawTerminal:  true,
+			Success:      attached,
+		})
+	}()
+
+	select {
+	case <-attached:
+		attached <- struct{}{}
+	case err := <-done:
+		return fmt.Errorf("unable to attach to container: %s", err)
+	}
 
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Start()
+	config := &docker.HostConfig{}
+	if s.dns != "" {
+		config.DNS = []string{s.dns}
+	}
+	err = s.ensureDockerClient().StartContainer(container.ID, config)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	err = cmd.Wait()
+	stopResizing := s.resizeWithTerminal(container.ID, os.Stdout.Fd())
+	defer stopResizing()
+
+	status, err := s.ensureDockerClient().WaitContainer(container.ID)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Command finished with error: %v\n", err)
+		return err
 	}
+	<-done
+	if status != 0 {
+		fmt.Fprintf(os.Stderr, "Command finished with error: exit status %d\r\n", status)
+	}
+	return nil
+}
 
-	return err
+// resizeWithTerminal sizes id's TTY to match the terminal fd, now and
+// whenever the terminal is resized until the returned func is called.
+func (s *ServiceRuntime) resizeWithTerminal(id string, fd uintptr) func() {
+	if !term.IsTerminal(fd) {
+		return func() {}
+	}
+
+	resize := func() {
+		ws, err := term.GetWinsize(fd)
+		if err != nil {
+			return
+		}
+		err = s.ensureDockerClient().ResizeContainerTTY(id, int(ws.Height), int(ws.Width))
+		if err != nil {
+			log.Debugf("Unable to resize %s: %s", id[0:12], err)
+		}
+	}
+	resize()
+
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	go func() {
+		for range winch {
+			resize()
+		}
+	}()
+	return func() {
+		signal.Stop(winch)
+		close(winch)
+	}
 }
 
 func (s *ServiceRuntime) Start(env, pool string, appCfg *config.AppConfig) (*docker.Container, error) {
@@ -585,19 +895,22 @@ func (s *ServiceRuntime) Start(env, pool string, appCfg *config.AppConfig) (*doc
 	if err != nil {
 		return nil, err
 	}
+	if image == nil {
+		return nil, fmt.Errorf("unable to pull %s: not found", img)
+	}
 
-	// setup env vars from etcd
-	var envVars []string
-	envVars = append(envVars, "ENV"+"="+env)
+	err = s.CheckImagePolicy(env, img, image.ID)
+	if err != nil {
+		return nil, err
+	}
 
-	for key, value := range appCfg.Env() {
-		if key == "ENV" {
-			continue
-		}
-		envVars = append(envVars, strings.ToUpper(key)+"="+s.replaceVarEnv(value, s.hostIP))
+	// setup env vars from etcd
+	envVars, err := s.containerEnv(env, pool, appCfg)
+	if err != nil {
+		return nil, err
 	}
 
-	instanceId, err := s.NextInstanceSlot(appCfg.Name, strconv.FormatInt(appCfg.ID(), 10))
+	instanceId, err := s.NextInstanceSlot(appCfg)
 	if err != nil {
 		return nil, err
 	}
@@ -606,6 +919,9 @@ func (s *ServiceRuntime) Start(env, pool string, appCfg *config.AppConfig) (*doc
 	envVars = append(envVars, fmt.Sprintf("GALAXY_APP=%s", appCfg.Name))
 	envVars = append(envVars, fmt.Sprintf("GALAXY_VERSION=%s", strconv.FormatInt(appCfg.ID(), 10)))
 	envVars = append(envVars, fmt.Sprintf("GALAXY_INSTANCE=%s", strconv.FormatInt(int64(instanceId), 10)))
+	if appCfg.DeployID() != "" {
+		envVars = append(envVars, "GALAXY_DEPLOY="+appCfg.DeployID())
+	}
 
 	publicDns, err := EC2PublicHostname()
 	if err != nil {
@@ -621,18 +937,23 @@ func (s *ServiceRuntime) Start(env, pool string, appCfg *config.AppConfig) (*doc
 		return nil, err
 	}
 
-	// Existing container is running or stopped.  If the image has changed, stop
-	// and re-create it.
-	if container != nil && container.Image != image.ID {
+	// Existing container is running or stopped.  If the image or its rendered
+	// env has changed, stop and re-create it.
+	if container != nil && (container.Image != image.ID || !hasEnv(container, envVars)) {
 		if container.State.Running {
 			log.Printf("Stopping %s version %s running as %s", appCfg.Name, appCfg.Version(), container.ID[0:12])
-			err := s.ensureDockerClient().StopContainer(container.ID, 10)
+			s.progress("stop", appCfg.Name, appCfg.Version(), container.ID,
+				fmt.Sprintf("stopping %s running as %s", appCfg.Version(), container.ID[0:12]))
+			signal, timeout := stopSettings(s.EnvFor(container), DefaultStopTimeout)
+			err := s.gracefulStop(container.ID, signal, timeout)
 			if err != nil {
 				return nil, err
 			}
 		}
 
 		log.Printf("Removing %s version %s running as %s", appCfg.Name, appCfg.Version(), container.ID[0:12])
+		s.progress("remove", appCfg.Name, appCfg.Version(), container.ID,
+			fmt.Sprintf("removing %s running as %s", appCfg.Version(), container.ID[0:12]))
 		err = s.ensureDockerClient().RemoveContainer(docker.RemoveContainerOptions{
 			ID: container.ID,
 		})
@@ -649,23 +970,32 @@ func (s *ServiceRuntime) Start(env, pool string, appCfg *config.AppConfig) (*doc
 			Env:   envVars,
 		}
 
-		mem := appCfg.GetMemory(pool)
-		if mem != "" {
-			m, err := utils.ParseMemory(mem)
-			if err != nil {
-				return nil, err
-			}
-			config.Memory = m
+		mem, cpu, err := appLimits(appCfg, pool)
+		if err != nil {
+			return nil, err
 		}
+		config.Memory = mem
+		config.CPUShares = cpu
 
-		cpu := appCfg.GetCPUShares(pool)
-		if cpu != "" {
-			if c, err := strconv.Atoi(cpu); err == nil {
-				config.CPUShares = int64(c)
-			}
+		err = s.checkMemory(appCfg, pool)
+		if err != nil {
+			return nil, err
+		}
+
+		// override the image's CMD and ENTRYPOINT so one image can run
+		// different processes
+		config.Cmd, err = commandOverride(appCfg.Env(), "GALAXY_CMD")
+		if err != nil {
+			return nil, err
+		}
+		config.Entrypoint, err = commandOverride(appCfg.Env(), "GALAXY_ENTRYPOINT")
+		if err != nil {
+			return nil, err
 		}
 
 		log.Printf("Creating %s version %s", appCfg.Name, appCfg.Version())
+		s.progress("create", appCfg.Name, appCfg.Version(), "",
+			fmt.Sprintf("creating %s", appCfg.Version()))
 		container, err = s.ensureDockerClient().CreateContainer(docker.CreateContainerOptions{
 			Name:   containerName,
 			Config: config,
@@ -676,15 +1006,78 @@ func (s *ServiceRuntime) Start(env, pool string, appCfg *config.AppConfig) (*doc
 	}
 
 	log.Printf("Starting %s version %s running as %s", appCfg.Name, appCfg.Version(), container.ID[0:12])
+	s.progress("start", appCfg.Name, appCfg.Version(), container.ID,
+		fmt.Sprintf("starting %s as %s", appCfg.Version(), container.ID[0:12]))
 
+	// GALAXY_NETWORK is a docker network mode: bridge (the default), host,
+	// none, container:<name> or the name of a network
+	network := appCfg.Env()["GALAXY_NETWORK"]
 	config := &docker.HostConfig{
-		PublishAllPorts: true,
+		PublishAllPorts: publishesPorts(network),
+		NetworkMode:     network,
 	}
 
-	if s.dns != "" {
+	// let docker restart crashed containers rather than waiting for the
+	// next time commander checks on them
+	restart, retries, err := utils.ParseRestartPolicy(appCfg.Env()["GALAXY_RESTART"])
+	if err != nil {
+		return container, err
+	}
+	config.RestartPolicy = docker.RestartPolicy{Name: restart, MaximumRetryCount: retries}
+
+	// send logs somewhere other than the host's disk, e.g. syslog
+	logCfg, err := appLogConfig(appCfg.Env())
+	if err != nil {
+		return container, err
+	}
+
+	err = s.checkFeatures(network, logCfg)
+	if err != nil {
+		return container, err
+	}
+
+	extra := make(map[string]interface{})
+	if logCfg != nil {
+		extra["LogConfig"] = logCfg
+	}
+
+	sec, err := appSecurityConfig(appCfg.Env())
+	if err != nil {
+		return container, err
+	}
+
+	err = s.checkPrivileged(env, appCfg, sec)
+	if err != nil {
+		return container, err
+	}
+
+	err = s.applySecurity(sec, config, extra)
+	if err != nil {
+		return container, err
+	}
+
+	// the host's or other container's resolv.conf is used when sharing
+	// their network
+	if s.dns != "" && config.PublishAllPorts {
 		config.DNS = []string{s.dns}
 	}
-	err = s.ensureDockerClient().StartContainer(container.ID, config)
+
+	if config.PublishAllPorts {
+		var replaced []*docker.Container
+		config.PortBindings, config.PublishAllPorts, replaced, err = s.portBindings(env, appCfg, image)
+		if err != nil {
+			return container, err
+		}
+
+		// with no host ports left an old version has to give up one of
+		// its own before this one can be published on it
+		_, err = s.stopContainers(replaced)
+		if err != nil {
+			return container, err
+		}
+	}
+
+	err = s.startContainer(container.ID, config, extra)
 
 	if err != nil {
 		return container, err
@@ -695,10 +1088,21 @@ func (s *ServiceRuntime) Start(env, pool string, appCfg *config.AppConfig) (*doc
 
 		startedContainer, err = s.ensureDockerClient().InspectContainer(container.ID)
 		if !startedContainer.State.Running {
-			return nil, errors.New("Container stopped unexpectedly")
+			return nil, ErrContainerStopped
 		}
 		time.Sleep(1 * time.Second)
 	}
+
+	if err == nil {
+		err = s.startSidecars(appCfg, startedContainer)
+		if err != nil {
+			log.Errorf("ERROR: Unable to start sidecars for %s: %s", appCfg.Name, err)
+			s.stopContainer(startedContainer)
+			return nil, err
+		}
+		s.progress("started", appCfg.Name, appCfg.Version(), container.ID,
+			fmt.Sprintf("started %s as %s", appCfg.Version(), container.ID[0:12]))
+	}
 	return startedContainer, err
 
 }
@@ -718,7 +1122,7 @@ func (s *ServiceRuntime) StartIfNotRunning(env, pool string, appCfg *config.AppC
 	var running *docker.Container
 	for _, container := range containers {
 		cenv := s.EnvFor(container)
-		if cenv["GALAXY_APP"] == appCfg.Name &&
+		if sameApp(cenv, appCfg) &&
 			cenv["GALAXY_VERSION"] == strconv.FormatInt(appCfg.ID(), 10) &&
 			image.ID == container.Image {
 			running = container
@@ -730,6 +1134,19 @@ func (s *ServiceRuntime) StartIfNotRunning(env, pool string, appCfg *config.AppC
 		return false, running, nil
 	}
 
+	labels, err := utils.ParseLabels(s.HostLabels)
+	if err != nil {
+		return false, nil, err
+	}
+	satisfied, err := utils.MatchConstraints(appCfg.Env()["GALAXY_CONSTRAINTS"], labels)
+	if err != nil {
+		return false, nil, err
+	}
+	if !satisfied {
+		log.Printf("Not starting %s, this host doesn't satisfy its constraints %s", appCfg.Name, appCfg.Env()["GALAXY_CONSTRAINTS"])
+		return false, nil, nil
+	}
+
 	err = s.ensureDockerClient().RemoveContainer(docker.RemoveContainerOptions{
 		ID: appCfg.ContainerName(),
 	})
@@ -738,6 +1155,11 @@ func (s *ServiceRuntime) StartIfNotRunning(env, pool string, appCfg *config.AppC
 		return false, nil, err
 	}
 
+	err = s.WaitForDepends(env, appCfg)
+	if err != nil {
+		return false, nil, err
+	}
+
 	container, err := s.Start(env, pool, appCfg)
 	return true, container, err
 }
@@ -759,56 +1181,117 @@ func (s *ServiceRuntime) PullImage(version, id string) (*docker.Image, error) {
 	pullOpts := docker.PullImageOptions{
 		Repository:   repository,
 		Tag:          tag,
-		OutputStream: log.DefaultLogger}
-
-	dockerAuth := docker.AuthConfiguration{}
-	if registry != "" && s.authConfig == nil {
+		OutputStream: s.PullOutput}
+	if pullOpts.OutputStream == nil {
+		pullOpts.OutputStream = ioutil.Discard
+	}
 
+	if registry != "" {
 		pullOpts.Repository = registry + "/" + repository
 		pullOpts.Registry = registry
-		pullOpts.Tag = tag
+	}
 
-		homeDir := utils.HomeDir()
-		if homeDir == "" {
-			return nil, errors.New("ERROR: Unable to determine current home dir. Set $HOME")
-		}
+	// pinned images are pulled by digest so a tag moved to another image
+	// can't change what runs
+	if utils.IsImageDigest(tag) {
+		pullOpts.Repository += "@" + tag
+		pullOpts.Tag = ""
+	}
 
-		// use ~/.dockercfg
-		authConfig, err := auth.LoadConfig(homeDir)
-		if err != nil {
-			panic(err)
-		}
+	log.Printf("Pulling %s\n", version)
+	s.progress("pull", "", version, "", "pulling "+version)
+	start := time.Now()
 
-		pullOpts.Registry = registry
-		authCreds := authConfig.ResolveAuthConfig(registry)
+	if s.pullFromMirror(version, pullOpts) {
+		log.Printf("Pulled %s from its mirror in %s\n", version, time.Since(start))
+		s.progress("pulled", "", version, "",
+			fmt.Sprintf("pulled %s from its mirror in %s", version, time.Since(start)))
+		return s.InspectImage(version)
+	}
 
-		dockerAuth.Username = authCreds.Username
-		dockerAuth.Password = authCreds.Password
-		dockerAuth.Email = authCreds.Email
+	// Docker Hub users look like registries
+	if !isRegistryHost(registry) {
+		registry = ""
+	}
+	dockerAuth, err := s.registryAuth(registry)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find a login for %s: %s", version, err)
 	}
 
-	retries := 0
-	for {
-		retries += 1
-		err = s.ensureDockerClient().PullImage(pullOpts, dockerAuth)
-		if err != nil {
+	backoff := pullBackoff
+	for attempt := 1; ; attempt++ {
+		err = s.pullImage(pullOpts, dockerAuth)
+		if err == nil {
+			break
+		}
 
-			// Don't retry 404, they'll never succeed
-			if err.Error() == "HTTP code: 404" {
-				return image, nil
-			}
+		// Don't retry 404, they'll never succeed
+		if err.Error() == "HTTP code: 404" {
+			return image, nil
+		}
 
-			if retries > 3 {
-				return image, err
-			}
-			log.Errorf("ERROR: error pulling image %s. Attempt %d: %s", version, retries, err)
-			continue
+		if attempt == pullAttempts {
+			return image, err
 		}
-		break
+		log.Errorf("ERROR: error pulling image %s. Attempt %d: %s. Retrying in %s", version, attempt, err, backoff)
+		s.progress("pull.retry", "", version, "",
+			fmt.Sprintf("attempt %d to pull %s failed: %s, retrying in %s", attempt, version, err, backoff))
+		time.Sleep(backoff)
+		backoff *= 2
 	}
+	log.Printf("Pulled %s in %s\n", version, time.Since(start))
+	s.progress("pulled", "", version, "",
+		fmt.Sprintf("pulled %s in %s", version, time.Since(start)))
 
 	return s.InspectImage(version)
+}
+
+// pullImage pulls an image, giving up after PullTimeout.
+func (s *ServiceRuntime) pullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	pull := func() error {
+		return s.ensureDockerClient().PullImage(opts, auth)
+	}
+	if s.PullTimeout <= 0 {
+		return pull()
+	}
+	return s.waitPull(opts.Repository+":"+opts.Tag, pull)
+}
+
+// imagePull is a pull running in the background.  err is set once done is
+// closed.
+type imagePull struct {
+	done chan struct{}
+	err  error
+}
 
+// waitPull waits up to PullTimeout for the pull of image.  Docker can't
+// cancel a pull, so one that timed out keeps going and is waited on again
+// by the next pull of the same image, rather than starting another.
+func (s *ServiceRuntime) waitPull(image string, pull func() error) error {
+	s.pullMu.Lock()
+	p, ok := s.pulls[image]
+	if !ok {
+		if s.pulls == nil {
+			s.pulls = make(map[string]*imagePull)
+		}
+		p = &imagePull{done: make(chan struct{})}
+		s.pulls[image] = p
+		go func() {
+			p.err = pull()
+			s.pullMu.Lock()
+			delete(s.pulls, image)
+			s.pullMu.Unlock()
+			close(p.done)
+		}()
+	}
+	s.pullMu.Unlock()
+
+	select {
+	case <-p.done:
+		return p.err
+	case <-time.After(s.PullTimeout):
+		return fmt.Errorf("timed out after %s", s.PullTimeout)
+	}
 }
 
 func (s *ServiceRuntime) RegisterAll(env, pool, hostIP string) ([]*registry.ServiceRegistration, error) {
@@ -842,19 +1325,22 @@ func (s *ServiceRuntime) UnRegisterAll(env, pool, hostIP string) ([]*docker.Cont
 
 	removed := []*docker.Container{}
 
+	// keep going so one failure doesn't leave the rest registered
+	var lastErr error
 	for _, container := range containers {
 		name := s.EnvFor(container)["GALAXY_APP"]
 		_, err = s.serviceRegistry.UnRegisterService(env, pool, hostIP, container)
 		if err != nil {
 			log.Printf("ERROR: Could not unregister %s: %s\n", name, err)
-			return removed, err
+			lastErr = err
+			continue
 		}
 
 		removed = append(removed, container)
 		log.Printf("Unregistered %s as %s", container.ID[0:12], name)
 	}
 
-	return removed, nil
+	return removed, lastErr
 }
 
 func (s *ServiceRuntime) RegisterEvents(env, pool, hostIP string, listener chan ContainerEvent) error {
@@ -893,6 +1379,11 @@ func (s *ServiceRuntime) RegisterEvents(env, pool, hostIP string, listener chan
 					container, err := s.InspectContainer(e.ID)
 					if err != nil {
 						log.Printf("ERROR: Error inspecting container: %s", err)
+						// a container removed right after it died can't be
+						// inspected, but its registration still needs to go
+						if e.Status != "start" {
+							listener <- ContainerEvent{Status: e.Status}
+						}
 						continue
 					}
 
@@ -941,7 +1432,27 @@ func (s *ServiceRuntime) EnvFor(container *docker.Container) map[string]string {
 	return env
 }
 
+// ManagedContainers returns the running instances of galaxy apps.  One-off
+// containers aren't included, so they're never registered, counted as an
+// instance or stopped by a deploy.
 func (s *ServiceRuntime) ManagedContainers() ([]*docker.Container, error) {
+	containers, err := s.allContainers()
+	if err != nil {
+		return containers, err
+	}
+
+	apps := []*docker.Container{}
+	for _, container := range containers {
+		if !isOneOff(s.EnvFor(container)) {
+			apps = append(apps, container)
+		}
+	}
+	return apps, nil
+}
+
+// allContainers returns the running containers of galaxy apps, one-off ones
+// included.
+func (s *ServiceRuntime) allContainers() ([]*docker.Container, error) {
 	apps := []*docker.Container{}
 	containers, err := s.ensureDockerClient().ListContainers(docker.ListContainersOptions{
 		All: false,
@@ -964,45 +1475,48 @@ func (s *ServiceRuntime) ManagedContainers() ([]*docker.Container, error) {
 	return apps, nil
 }
 
-func (s *ServiceRuntime) instanceIds(app, versionId string) ([]int, error) {
+// sameApp returns true if a container with env runs appCfg's app, of any
+// version, and is the same blue/green color.
+func sameApp(env map[string]string, appCfg *config.AppConfig) bool {
+	return env["GALAXY_APP"] == appCfg.Name && env["GALAXY_COLOR"] == appCfg.Env()["GALAXY_COLOR"]
+}
+
+// instanceIds returns the instance numbers of the running containers for
+// appCfg's version.
+func (s *ServiceRuntime) instanceIds(appCfg *config.AppConfig) ([]int, error) {
 	containers, err := s.ManagedContainers()
 	if err != nil {
 		return []int{}, err
 	}
 
+	versionId := strconv.FormatInt(appCfg.ID(), 10)
 	instances := []int{}
 	for _, c := range containers {
-		ga := s.EnvFor(c)["GALAXY_APP"]
-
-		if ga != app {
+		env := s.EnvFor(c)
+		if !sameApp(env, appCfg) || env["GALAXY_VERSION"] != versionId {
 			continue
 		}
 
-		gi := s.EnvFor(c)["GALAXY_INSTANCE"]
-		gv := s.EnvFor(c)["GALAXY_VERSION"]
+		gi := env["GALAXY_INSTANCE"]
 		if gi != "" {
 			i, err := strconv.ParseInt(gi, 10, 64)
 			if err != nil {
 				log.Warnf("WARN: Invalid number %s for %s. Ignoring.", gi, c.ID[:12])
 				continue
 			}
-
-			if versionId != "" && gv != versionId {
-				continue
-			}
 			instances = append(instances, int(i))
 		}
 	}
 	return instances, nil
 }
 
-func (s *ServiceRuntime) InstanceCount(app, versionId string) (int, error) {
-	instances, err := s.instanceIds(app, versionId)
+func (s *ServiceRuntime) InstanceCount(appCfg *config.AppConfig) (int, error) {
+	instances, err := s.instanceIds(appCfg)
 	return len(instances), err
 }
 
-func (s *ServiceRuntime) NextInstanceSlot(app, versionId string) (int, error) {
-	instances, err := s.instanceIds(app, versionId)
+func (s *ServiceRuntime) NextInstanceSlot(appCfg *config.AppConfig) (int, error) {
+	instances, err := s.instanceIds(appCfg)
 	if err != nil {
 		return 0, err
 	}
@@ -1010,7 +1524,32 @@ func (s *ServiceRuntime) NextInstanceSlot(app, versionId string) (int, error) {
 	return utils.NextSlot(instances), nil
 }
 
-func (s ServiceRuntime) replaceVarEnv(in, hostIp string) string {
+// hasEnv returns true if container was created with every variable in
+// envVars.
+func hasEnv(container *docker.Container, envVars []string) bool {
+	for _, v := range envVars {
+		if !utils.StringInSlice(v, container.Config.Env) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *ServiceRuntime) replaceVarEnv(in, hostIp string) string {
 	out := strings.Replace(in, "$HOST_IP", hostIp, -1)
 	return strings.Replace(out, "$DOCKER_IP", s.dockerIP, -1)
 }
+
+// commandOverride returns the arguments in env[name], or nil to use the
+// image's default if it's unset.
+func commandOverride(env map[string]string, name string) ([]string, error) {
+	if strings.TrimSpace(env[name]) == "" {
+		return nil, nil
+	}
+
+	args, err := utils.SplitCommand(env[name])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", name, err)
+	}
+	return args, nil
+}
@@ -0,0 +1,186 @@
+package runtime
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/litl/galaxy/config"
+)
+
+func testContainer(id, image string, env ...string) *docker.Container {
+	return &docker.Container{
+		ID:     id + strings.Repeat("0", 64-len(id)),
+		Image:  image,
+		Config: &docker.Config{Env: env},
+	}
+}
+
+func TestOldVersions(t *testing.T) {
+	appCfg := config.NewAppConfig("web", "web:v2")
+	appCfg.SetVersionID("image2")
+	current := "GALAXY_VERSION=" + strconv.FormatInt(appCfg.ID(), 10)
+
+	containers := []*docker.Container{
+		testContainer("a", "image1", "GALAXY_APP=web", "GALAXY_VERSION=1"),
+		testContainer("b", "image2", "GALAXY_APP=web", current),
+		testContainer("c", "image1", "GALAXY_APP=api", "GALAXY_VERSION=1"),
+		testContainer("d", "image1", "GALAXY_APP=web", "GALAXY_VERSION=1"),
+		testContainer("e", "missing", "GALAXY_APP=web", "GALAXY_VERSION=1"),
+		testContainer("f", "image2", "GALAXY_APP=web", current, "GALAXY_COLOR=green"),
+		testContainer("g", "image2", "GALAXY_APP=web", "GALAXY_VERSION=1"),
+	}
+	inspect := func(id string) (*docker.Image, error) {
+		if id == "missing" {
+			return nil, docker.ErrNoSuchImage
+		}
+		return &docker.Image{ID: id}, nil
+	}
+
+	s := &ServiceRuntime{}
+	old := s.oldVersions(containers, appCfg, -1, inspect)
+	ids := []string{}
+	for _, container := range old {
+		ids = append(ids, container.ID[0:1])
+	}
+	if strings.Join(ids, ",") != "a,d,g" {
+		t.Fatalf("expected a,d,g to be old versions. Got %s", strings.Join(ids, ","))
+	}
+
+	old = s.oldVersions(containers, appCfg, 1, inspect)
+	if len(old) != 1 || old[0] != containers[0] {
+		t.Fatalf("expected only the first old version with a limit of 1. Got %d", len(old))
+	}
+}
+
+func TestNewContainers(t *testing.T) {
+	containers := []*docker.Container{
+		testContainer("a", "image1", "GALAXY_APP=web"),
+		testContainer("b", "image1", "GALAXY_APP=web"),
+		testContainer("c", "image1", "GALAXY_APP=api"),
+		testContainer("d", "image2", "GALAXY_APP=web"),
+	}
+	known := map[string]bool{containers[0].ID: true, containers[1].ID: true}
+
+	s := &ServiceRuntime{}
+	started := s.newContainers(containers, "web", known)
+	if len(started) != 1 || started[0] != containers[3] {
+		t.Fatalf("expected only d to be new. Got %v", started)
+	}
+
+	known[containers[3].ID] = true
+	if started := s.newContainers(containers, "web", known); len(started) != 0 {
+		t.Fatalf("expected no new containers. Got %v", started)
+	}
+}
+
+func TestStopParallel(t *testing.T) {
+	containers := []*docker.Container{}
+	for i := 0; i < 3*MaxParallelStops; i++ {
+		containers = append(containers, testContainer(fmt.Sprintf("%02d", i), "image"))
+	}
+
+	var mu sync.Mutex
+	running, most, calls := 0, 0, 0
+	stopped, err := stopParallel(containers, func(container *docker.Container) error {
+		mu.Lock()
+		running++
+		calls++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if container == containers[1] {
+			return fmt.Errorf("no such container")
+		}
+		return nil
+	})
+
+	if calls != len(containers) {
+		t.Fatalf("expected %d stops. Got %d", len(containers), calls)
+	}
+	if most < 2 || most > MaxParallelStops {
+		t.Fatalf("expected 2 to %d stops at once. Got %d", MaxParallelStops, most)
+	}
+	if len(stopped) != len(containers)-1 {
+		t.Fatalf("expected %d stopped. Got %v", len(containers)-1, stopped)
+	}
+	for _, id := range stopped {
+		if id == containers[1].ID[0:12] {
+			t.Fatalf("expected %s to not be reported stopped", id)
+		}
+	}
+	if err == nil {
+		t.Fatal("expected the failed stop to be returned")
+	}
+	expected := fmt.Sprintf("unable to stop 1 of %d containers: %s: no such container",
+		len(containers), containers[1].ID[0:12])
+	if err.Error() != expected {
+		t.Fatalf("expected %q. Got %q", expected, err)
+	}
+
+	stopped, err = stopParallel(containers[:2], func(*docker.Container) error { return nil })
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(stopped) != 2 || stopped[0] != containers[0].ID[0:12] || stopped[1] != containers[1].ID[0:12] {
+		t.Fatalf("expected both to be stopped in order. Got %v", stopped)
+	}
+}
+
+func TestWaitPull(t *testing.T) {
+	s := &ServiceRuntime{PullTimeout: 10 * time.Millisecond}
+
+	var mu sync.Mutex
+	pulls := 0
+	release := make(chan struct{})
+	pull := func() error {
+		mu.Lock()
+		pulls++
+		mu.Unlock()
+		<-release
+		return fmt.Errorf("HTTP code: 500")
+	}
+
+	for i := 0; i < 3; i++ {
+		err := s.waitPull("web:v1", pull)
+		if err == nil || !strings.HasPrefix(err.Error(), "timed out") {
+			t.Fatalf("expected the pull to time out. Got %v", err)
+		}
+	}
+	mu.Lock()
+	if pulls != 1 {
+		t.Fatalf("expected retries to wait for the timed out pull. Got %d pulls", pulls)
+	}
+	mu.Unlock()
+
+	// the running pull's result goes to whoever is waiting for it
+	s.PullTimeout = 10 * time.Second
+	done := make(chan error)
+	go func() { done <- s.waitPull("web:v1", pull) }()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	if err := <-done; err == nil || err.Error() != "HTTP code: 500" {
+		t.Fatalf("expected the pull's error. Got %v", err)
+	}
+
+	// and once it's done the next one starts a new pull
+	if err := s.waitPull("web:v1", pull); err == nil || err.Error() != "HTTP code: 500" {
+		t.Fatalf("expected the new pull's error. Got %v", err)
+	}
+	mu.Lock()
+	if pulls != 2 {
+		t.Fatalf("expected a second pull. Got %d pulls", pulls)
+	}
+	mu.Unlock()
+}
@@ -0,0 +1,134 @@
+package runtime
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/utils"
+)
+
+// securityConfig is what an app's containers are allowed to do and use.
+type securityConfig struct {
+	Privileged bool
+	ReadOnly   bool
+	CapAdd     []string
+	CapDrop    []string
+	Ulimits    []utils.Ulimit
+}
+
+// appSecurityConfig returns the security options in an app's env:
+// GALAXY_PRIVILEGED and GALAXY_READ_ONLY, true or false,
+// GALAXY_CAP_ADD and GALAXY_CAP_DROP, comma separated capabilities like
+// NET_ADMIN, and GALAXY_ULIMITS, e.g. nofile=1024:65536.
+func appSecurityConfig(env map[string]string) (*securityConfig, error) {
+	sec := &securityConfig{
+		CapAdd:  splitList(env["GALAXY_CAP_ADD"]),
+		CapDrop: splitList(env["GALAXY_CAP_DROP"]),
+	}
+
+	var err error
+	for name, value := range map[string]*bool{
+		"GALAXY_PRIVILEGED": &sec.Privileged,
+		"GALAXY_READ_ONLY":  &sec.ReadOnly,
+	} {
+		if env[name] == "" {
+			continue
+		}
+		*value, err = strconv.ParseBool(env[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %s", name, env[name])
+		}
+	}
+
+	sec.Ulimits, err = utils.ParseUlimits(env["GALAXY_ULIMITS"])
+	if err != nil {
+		return nil, err
+	}
+	return sec, nil
+}
+
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// privilegedCaps are the capabilities that give a container as good as
+// root on the host, so adding them needs the same policy as privileged.
+var privilegedCaps = []string{
+	"ALL",
+	"SYS_ADMIN",
+	"SYS_MODULE",
+	"SYS_RAWIO",
+	"SYS_PTRACE",
+	"SYS_BOOT",
+	"DAC_READ_SEARCH",
+	"NET_ADMIN",
+	"BPF",
+}
+
+// privilegedReason returns why sec makes a container privileged, or "".
+func privilegedReason(sec *securityConfig) string {
+	if sec.Privileged {
+		return "privileged containers"
+	}
+	for _, c := range sec.CapAdd {
+		c = strings.TrimPrefix(strings.ToUpper(c), "CAP_")
+		if utils.StringInSlice(c, privilegedCaps) {
+			return "containers with " + c
+		}
+	}
+	return ""
+}
+
+// checkPrivileged returns an error if the app wants privileged containers,
+// or to add a capability that's as good as it, and env's policy doesn't
+// list it as allowed to run them.
+func (s *ServiceRuntime) checkPrivileged(env string, appCfg *config.AppConfig, sec *securityConfig) error {
+	reason := privilegedReason(sec)
+	if reason == "" {
+		return nil
+	}
+	if s.serviceRegistry == nil {
+		return fmt.Errorf("%s can't run %s without a registry to check the policy", appCfg.Name, reason)
+	}
+
+	policy, err := s.serviceRegistry.GetImagePolicy(env)
+	if err != nil {
+		return fmt.Errorf("unable to read the policy for %s: %s", env, err)
+	}
+	if !utils.StringInSlice(appCfg.Name, policy.Privileged) {
+		return fmt.Errorf("%s isn't allowed to run %s in %s", appCfg.Name, reason, env)
+	}
+	return nil
+}
+
+// applySecurity sets sec on hostConfig, and adds the fields the docker
+// client doesn't know about to extra.
+func (s *ServiceRuntime) applySecurity(sec *securityConfig, hostConfig *docker.HostConfig, extra map[string]interface{}) error {
+	hostConfig.Privileged = sec.Privileged
+	hostConfig.CapAdd = sec.CapAdd
+	hostConfig.CapDrop = sec.CapDrop
+
+	if len(sec.Ulimits) == 0 && !sec.ReadOnly {
+		return nil
+	}
+	if !s.supportsAPI(ulimitAPIVersion) {
+		return fmt.Errorf("docker API %s doesn't support ulimits or read only containers, it needs %s", s.apiVersionString(), ulimitAPIVersion)
+	}
+	if len(sec.Ulimits) > 0 {
+		extra["Ulimits"] = sec.Ulimits
+	}
+	if sec.ReadOnly {
+		extra["ReadonlyRootfs"] = true
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package runtime
+
+import (
+	"fmt"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/utils"
+)
+
+// appLimits returns the memory and CPU shares for the app container once
+// its sidecars' share has been taken out of the pool's limits.
+func appLimits(appCfg *config.AppConfig, pool string) (int64, int64, error) {
+	mem, err := utils.ParseMemory(appCfg.GetMemory(pool))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	cpu, err := utils.ParseCPUShares(appCfg.GetCPUShares(pool))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, sidecar := range appCfg.Sidecars() {
+		if sidecar.Memory != "" && mem != 0 {
+			m, err := utils.ParseMemory(sidecar.Memory)
+			if err != nil {
+				return 0, 0, err
+			}
+			mem -= m
+			if mem <= 0 {
+				return 0, 0, fmt.Errorf("sidecars of %s use more than the %s memory limit", appCfg.Name, appCfg.GetMemory(pool))
+			}
+		}
+
+		if sidecar.CPUShares != "" && cpu != 0 {
+			c, err := utils.ParseCPUShares(sidecar.CPUShares)
+			if err != nil {
+				return 0, 0, err
+			}
+			cpu -= c
+			if cpu <= 0 {
+				return 0, 0, fmt.Errorf("sidecars of %s use more than the %s CPU shares", appCfg.Name, appCfg.GetCPUShares(pool))
+			}
+		}
+	}
+	return mem, cpu, nil
+}
+
+func sidecarName(container *docker.Container, sidecar config.SidecarConfig) string {
+	return strings.TrimPrefix(container.Name, "/") + "." + sidecar.Name
+}
+
+// sidecarContainers returns all sidecar containers, running or not, for app.
+func (s *ServiceRuntime) sidecarContainers(app string) ([]*docker.Container, error) {
+	sidecars := []*docker.Container{}
+	containers, err := s.ensureDockerClient().ListContainers(docker.ListContainersOptions{
+		All: true,
+	})
+	if err != nil {
+		return sidecars, err
+	}
+
+	for _, c := range containers {
+		container, err := s.ensureDockerClient().InspectContainer(c.ID)
+		if err != nil {
+			log.Printf("ERROR: Unable to inspect container: %s\n", c.ID)
+			continue
+		}
+		if s.EnvFor(container)["GALAXY_SIDECAR_APP"] == app {
+			sidecars = append(sidecars, container)
+		}
+	}
+	return sidecars, nil
+}
+
+func (s *ServiceRuntime) removeSidecar(container *docker.Container) error {
+	if container.State.Running {
+		err := s.stopContainer(container)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.ensureDockerClient().RemoveContainer(docker.RemoveContainerOptions{
+		ID:    container.ID,
+		Force: true,
+	})
+}
+
+// startSidecars ensures each sidecar configured for appCfg is running
+// alongside container in its network namespace.
+func (s *ServiceRuntime) startSidecars(appCfg *config.AppConfig, container *docker.Container) error {
+
+	// sidecars see the app's environment but must not look like an app
+	// instance or they would be counted and registered.
+	envVars := []string{}
+	for k, v := range s.EnvFor(container) {
+		if strings.HasPrefix(k, "GALAXY_") {
+			continue
+		}
+		envVars = append(envVars, k+"="+v)
+	}
+
+	for _, sidecar := range appCfg.Sidecars() {
+		name := sidecarName(container, sidecar)
+
+		existing, err := s.ensureDockerClient().InspectContainer(name)
+		_, ok := err.(*docker.NoSuchContainer)
+		if err != nil && !ok {
+			return err
+		}
+
+		if existing != nil {
+			if existing.State.Running &&
+				existing.Config.Image == sidecar.Image &&
+				s.EnvFor(existing)["GALAXY_SIDECAR_OF"] == container.ID {
+				continue
+			}
+
+			log.Printf("Removing %s sidecar %s", appCfg.Name, name)
+			err = s.removeSidecar(existing)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = s.InspectImage(sidecar.Image)
+		if err == docker.ErrNoSuchImage {
+			_, err = s.PullImage(sidecar.Image, "")
+		}
+		if err != nil {
+			return err
+		}
+
+		sidecarEnv := append([]string{}, envVars...)
+		for k, v := range sidecar.Env {
+			sidecarEnv = append(sidecarEnv, strings.ToUpper(k)+"="+s.replaceVarEnv(v, s.hostIP))
+		}
+		sidecarEnv = append(sidecarEnv, fmt.Sprintf("GALAXY_SIDECAR=%s", sidecar.Name))
+		sidecarEnv = append(sidecarEnv, fmt.Sprintf("GALAXY_SIDECAR_APP=%s", appCfg.Name))
+		sidecarEnv = append(sidecarEnv, fmt.Sprintf("GALAXY_SIDECAR_OF=%s", container.ID))
+
+		config := &docker.Config{
+			Image: sidecar.Image,
+			Env:   sidecarEnv,
+			Cmd:   sidecar.Cmd,
+		}
+
+		if sidecar.Memory != "" {
+			m, err := utils.ParseMemory(sidecar.Memory)
+			if err != nil {
+				return err
+			}
+			config.Memory = m
+		}
+
+		c, err := utils.ParseCPUShares(sidecar.CPUShares)
+		if err != nil {
+			return err
+		}
+		config.CPUShares = c
+
+		log.Printf("Creating %s sidecar %s", appCfg.Name, name)
+		created, err := s.ensureDockerClient().CreateContainer(docker.CreateContainerOptions{
+			Name:   name,
+			Config: config,
+		})
+		if err != nil {
+			return err
+		}
+
+		err = s.ensureDockerClient().StartContainer(created.ID, &docker.HostConfig{
+			NetworkMode: "container:" + container.ID,
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Started %s sidecar %s as %s", appCfg.Name, sidecar.Name, created.ID[0:12])
+	}
+	return nil
+}
+
+// stopSidecars stops and removes the sidecars attached to container.
+func (s *ServiceRuntime) stopSidecars(container *docker.Container) error {
+	app := s.EnvFor(container)["GALAXY_APP"]
+	if app == "" {
+		return nil
+	}
+
+	sidecars, err := s.sidecarContainers(app)
+	if err != nil {
+		return err
+	}
+
+	for _, sidecar := range sidecars {
+		if s.EnvFor(sidecar)["GALAXY_SIDECAR_OF"] != container.ID {
+			continue
+		}
+
+		err := s.removeSidecar(sidecar)
+		if err != nil {
+			log.Errorf("ERROR: Unable to remove sidecar %s: %s", sidecar.ID[0:12], err)
+		}
+	}
+	return nil
+}
+
+// ReconcileSidecars starts any missing sidecars for the running containers of
+// appCfg and removes sidecars that are no longer configured or whose app
+// container has gone away.
+func (s *ServiceRuntime) ReconcileSidecars(appCfg *config.AppConfig) error {
+	containers, err := s.ManagedContainers()
+	if err != nil {
+		return err
+	}
+
+	running := map[string]bool{}
+	for _, container := range containers {
+		if s.EnvFor(container)["GALAXY_APP"] != appCfg.Name {
+			continue
+		}
+
+		running[container.ID] = true
+		err := s.startSidecars(appCfg, container)
+		if err != nil {
+			log.Errorf("ERROR: Unable to start sidecars for %s: %s", container.ID[0:12], err)
+		}
+	}
+
+	configured := []string{}
+	for _, sidecar := range appCfg.Sidecars() {
+		configured = append(configured, sidecar.Name)
+	}
+
+	sidecars, err := s.sidecarContainers(appCfg.Name)
+	if err != nil {
+		return err
+	}
+
+	for _, sidecar := range sidecars {
+		env := s.EnvFor(sidecar)
+		if running[env["GALAXY_SIDECAR_OF"]] && utils.StringInSlice(env["GALAXY_SIDECAR"], configured) {
+			continue
+		}
+
+		log.Printf("Removing %s sidecar %s", appCfg.Name, strings.TrimPrefix(sidecar.Name, "/"))
+		err := s.removeSidecar(sidecar)
+		if err != nil {
+			log.Errorf("ERROR: Unable to remove sidecar %s: %s", sidecar.ID[0:12], err)
+		}
+	}
+	return nil
+}
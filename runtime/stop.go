@@ -0,0 +1,58 @@
+package runtime
+
+import (
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/litl/galaxy/log"
+	"github.com/litl/galaxy/utils"
+)
+
+// DefaultStopTimeout is how long a container has to exit after being
+// signalled before it's killed, unless its GALAXY_STOP_TIMEOUT says
+// otherwise.
+const DefaultStopTimeout = 10 * time.Second
+
+// stopSettings returns the signal and timeout to stop a container with env,
+// from its GALAXY_STOP_SIGNAL and GALAXY_STOP_TIMEOUT.  Invalid values fall
+// back to SIGTERM and timeout.
+func stopSettings(env map[string]string, timeout time.Duration) (docker.Signal, time.Duration) {
+	signal, err := utils.ParseStopSignal(env["GALAXY_STOP_SIGNAL"])
+	if err != nil {
+		log.Warnf("WARN: Invalid GALAXY_STOP_SIGNAL %s. Using SIGTERM.", env["GALAXY_STOP_SIGNAL"])
+		signal = int(docker.SIGTERM)
+	}
+
+	if value := env["GALAXY_STOP_TIMEOUT"]; value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			log.Warnf("WARN: Invalid GALAXY_STOP_TIMEOUT %s. Using %s.", value, timeout)
+		} else {
+			timeout = d
+		}
+	}
+	return docker.Signal(signal), timeout
+}
+
+// gracefulStop sends the container with id signal and kills it if it
+// hasn't exited within timeout.
+func (s *ServiceRuntime) gracefulStop(id string, signal docker.Signal, timeout time.Duration) error {
+	// docker stop sends SIGTERM itself
+	if signal == docker.SIGTERM {
+		return s.ensureDockerClient().StopContainer(id, uint(timeout/time.Second))
+	}
+
+	err := s.ensureDockerClient().KillContainer(docker.KillContainerOptions{ID: id, Signal: signal})
+	if err != nil {
+		return err
+	}
+
+	err = withTimeout(timeout, func() error {
+		_, err := s.ensureDockerClient().WaitContainer(id)
+		return err
+	})
+	if err != errTimeout {
+		return err
+	}
+	return s.ensureDockerClient().KillContainer(docker.KillContainerOptions{ID: id})
+}
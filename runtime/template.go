@@ -0,0 +1,202 @@
+package runtime
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/registry"
+)
+
+// envRenderer expands the templates in an app's config values, e.g.
+// postgres://{{addr "pgbouncer"}}/mydb, when its containers are created.
+// Registrations are only listed if a value asks for them.
+type envRenderer struct {
+	s    *ServiceRuntime
+	env  string
+	pool string
+	app  string
+
+	registrations []registry.ServiceRegistration
+	listed        bool
+}
+
+// addrs returns the host:port of each of app's registrations, this host's
+// first, or an error if it isn't registered.
+func (r *envRenderer) addrs(app string) ([]string, error) {
+	if !r.listed {
+		if r.s.serviceRegistry == nil {
+			return nil, fmt.Errorf("no registry to look up %s in", app)
+		}
+		registrations, err := r.s.serviceRegistry.ListRegistrations(r.env)
+		if err != nil {
+			return nil, err
+		}
+		r.registrations = registrations
+		r.listed = true
+	}
+
+	local, remote := []string{}, []string{}
+	for _, reg := range r.registrations {
+		if reg.Name != app || reg.IsDraining() || reg.ExternalIP == "" || reg.ExternalPort == "" {
+			continue
+		}
+		addr := reg.ExternalIP + ":" + reg.ExternalPort
+		if reg.ExternalIP == r.s.hostIP {
+			local = append(local, addr)
+		} else {
+			remote = append(remote, addr)
+		}
+	}
+	if len(local)+len(remote) == 0 {
+		return nil, fmt.Errorf("%s isn't registered in %s", app, r.env)
+	}
+
+	// the same order on every host that isn't running app
+	sort.Strings(local)
+	sort.Strings(remote)
+	return append(local, remote...), nil
+}
+
+func (r *envRenderer) render(key, value string) (string, error) {
+	if !strings.Contains(value, "{{") {
+		return value, nil
+	}
+
+	tmpl, err := template.New(key).Funcs(template.FuncMap{
+		"env":  func() string { return r.env },
+		"pool": func() string { return r.pool },
+		"app":  func() string { return r.app },
+		"host": func() string { return r.s.hostIP },
+		"addr": func(app string) (string, error) {
+			addrs, err := r.addrs(app)
+			if err != nil {
+				return "", err
+			}
+			return addrs[0], nil
+		},
+		"addrs": func(app string) (string, error) {
+			addrs, err := r.addrs(app)
+			return strings.Join(addrs, ","), err
+		},
+	}).Parse(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid template in %s: %s", key, err)
+	}
+
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to render %s: %s", key, err)
+	}
+	return out.String(), nil
+}
+
+// containerEnv returns appCfg's config as environment variables for a
+// container in env and pool, with $HOST_IP and $DOCKER_IP replaced and its
+// templates rendered.
+func (s *ServiceRuntime) containerEnv(env, pool string, appCfg *config.AppConfig) ([]string, error) {
+	r := &envRenderer{s: s, env: env, pool: pool, app: appCfg.Name}
+
+	envVars := []string{"ENV=" + env}
+	for key, value := range appCfg.Env() {
+		if key == "ENV" {
+			continue
+		}
+		value, err := r.render(key, value)
+		if err != nil {
+			return nil, err
+		}
+		envVars = append(envVars, strings.ToUpper(key)+"="+s.replaceVarEnv(value, s.hostIP))
+	}
+
+	addrs, err := s.dependAddrs(env, appCfg)
+	if err != nil {
+		return nil, err
+	}
+	return append(envVars, addrs...), nil
+}
+
+// dependAddrs returns an <APP>_ADDR variable with the host's shuttle
+// address for each of appCfg's dependencies with a GALAXY_PORT, and an
+// <APP>_ADDR_<port> for each GALAXY_PORT_<port>.  Dependencies galaxy
+// doesn't run get the addresses they're registered at as external
+// services instead, comma separated.
+func (s *ServiceRuntime) dependAddrs(env string, appCfg *config.AppConfig) ([]string, error) {
+	if s.ConfigStore == nil {
+		return nil, nil
+	}
+
+	var registrations []registry.ServiceRegistration
+	listed := false
+
+	envVars := []string{}
+	for _, dep := range appCfg.Depends() {
+		prefix := strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(dep)) + "_ADDR"
+
+		exists, err := s.ConfigStore.AppExists(dep, env)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			if s.serviceRegistry == nil || appCfg.Env()[prefix] != "" {
+				continue
+			}
+			if !listed {
+				registrations, err = s.serviceRegistry.ListRegistrations(env)
+				if err != nil {
+					return nil, err
+				}
+				listed = true
+			}
+			if addrs := externalAddrs(dep, registrations); len(addrs) > 0 {
+				envVars = append(envVars, prefix+"="+strings.Join(addrs, ","))
+			}
+			continue
+		}
+
+		depCfg, err := s.ConfigStore.GetApp(dep, env)
+		if err != nil {
+			return nil, err
+		}
+
+		for k, port := range depCfg.Env() {
+			var name string
+			switch {
+			case k == "GALAXY_PORT":
+				name = prefix
+			case strings.HasPrefix(k, "GALAXY_PORT_"):
+				name = prefix + "_" + strings.TrimPrefix(k, "GALAXY_PORT_")
+			}
+
+			// the app's own config wins
+			if name == "" || port == "" || appCfg.Env()[name] != "" {
+				continue
+			}
+			envVars = append(envVars, name+"="+s.hostIP+":"+port)
+		}
+	}
+	sort.Strings(envVars)
+	return envVars, nil
+}
+
+// externalAddrs returns the sorted host:port addresses name is registered
+// at by hand in registrations.
+func externalAddrs(name string, registrations []registry.ServiceRegistration) []string {
+	seen := make(map[string]bool)
+	addrs := []string{}
+	for _, reg := range registrations {
+		addr := net.JoinHostPort(reg.ExternalIP, reg.ExternalPort)
+		if !reg.External || reg.Name != name || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
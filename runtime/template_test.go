@@ -0,0 +1,73 @@
+package runtime
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/litl/galaxy/config"
+	"github.com/litl/galaxy/registry"
+)
+
+func TestDependAddrs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "galaxy-runtime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configStore := config.NewStore(config.DefaultTTL)
+	configStore.Connect("file://" + filepath.Join(dir, "galaxy.json"))
+	serviceRegistry := registry.NewServiceRegistry(registry.DefaultTTL)
+	serviceRegistry.Connect("file://" + filepath.Join(dir, "registry.json"))
+
+	if _, err := configStore.CreateApp("web-api", "dev"); err != nil {
+		t.Fatal(err)
+	}
+	web, err := configStore.GetApp("web-api", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	web.EnvSet("GALAXY_PORT", "8000")
+	web.EnvSet("GALAXY_PORT_ADMIN", "8001")
+	if _, err := configStore.UpdateApp(web, "dev"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, addr := range []string{"10.0.0.2:5432", "10.0.0.1:5432"} {
+		if _, err := serviceRegistry.RegisterExternal("dev", "web", "db", addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := serviceRegistry.RegisterExternal("dev", "web", "cache", "10.0.0.3:6379"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serviceRegistry.RegisterExternal("prod", "web", "queue", "10.0.0.4:5672"); err != nil {
+		t.Fatal(err)
+	}
+
+	appCfg := config.NewAppConfig("worker", "worker:v1")
+	appCfg.EnvSet("GALAXY_DEPENDS", "web-api,db,cache,queue")
+	appCfg.EnvSet("CACHE_ADDR", "localhost:6379")
+
+	s := &ServiceRuntime{
+		ConfigStore:     configStore,
+		serviceRegistry: serviceRegistry,
+		hostIP:          "10.0.0.9",
+	}
+	envVars, err := s.dependAddrs("dev", appCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"DB_ADDR=10.0.0.1:5432,10.0.0.2:5432",
+		"WEB_API_ADDR=10.0.0.9:8000",
+		"WEB_API_ADDR_ADMIN=10.0.0.9:8001",
+	}
+	if strings.Join(envVars, " ") != strings.Join(expected, " ") {
+		t.Fatalf("expected %v. Got %v", expected, envVars)
+	}
+}
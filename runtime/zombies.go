@@ -0,0 +1,280 @@
+package runtime
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/litl/galaxy/log"
+)
+
+// MaxStopAttempts is how many times stopping a container can fail before
+// it's blacklisted and left alone.
+const MaxStopAttempts = 3
+
+var errTimeout = errors.New("timed out")
+
+// Zombie is a container that couldn't be stopped, killed or removed.
+type Zombie struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Attempts int       `json:"attempts"`
+	Since    time.Time `json:"since"`
+	Error    string    `json:"error"`
+	// Blacklisted zombies aren't tried again until they're cleared
+	Blacklisted bool `json:"blacklisted"`
+}
+
+// loadZombies returns the zombies by container ID, from BlacklistFile if
+// it's set so they're remembered across restarts.  s.zombieMu must be
+// held.
+func (s *ServiceRuntime) loadZombies() (map[string]*Zombie, error) {
+	if s.BlacklistFile == "" {
+		if s.zombies == nil {
+			s.zombies = make(map[string]*Zombie)
+		}
+		return s.zombies, nil
+	}
+
+	zombies := make(map[string]*Zombie)
+	data, err := ioutil.ReadFile(s.BlacklistFile)
+	if os.IsNotExist(err) {
+		return zombies, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &zombies)
+	if err != nil {
+		return nil, err
+	}
+	return zombies, nil
+}
+
+// saveZombies writes zombies to BlacklistFile, if it's set.  s.zombieMu
+// must be held.
+func (s *ServiceRuntime) saveZombies(zombies map[string]*Zombie) error {
+	if s.BlacklistFile == "" {
+		s.zombies = zombies
+		return nil
+	}
+
+	data, err := json.MarshalIndent(zombies, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(s.BlacklistFile), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.BlacklistFile), filepath.Base(s.BlacklistFile)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(append(data, '\n'))
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.BlacklistFile)
+}
+
+// blacklisted returns true if id shouldn't be stopped again.
+func (s *ServiceRuntime) blacklisted(id string) bool {
+	s.zombieMu.Lock()
+	defer s.zombieMu.Unlock()
+
+	zombies, err := s.loadZombies()
+	if err != nil {
+		log.Errorf("ERROR: Unable to read the container blacklist: %s", err)
+		return false
+	}
+	return zombies[id] != nil && zombies[id].Blacklisted
+}
+
+// stopFailed records a failed attempt to stop container and returns true
+// once it's used up its attempts and is blacklisted.
+func (s *ServiceRuntime) stopFailed(container *docker.Container, stopErr error) bool {
+	s.zombieMu.Lock()
+	defer s.zombieMu.Unlock()
+
+	zombies, err := s.loadZombies()
+	if err != nil {
+		log.Errorf("ERROR: Unable to read the container blacklist: %s", err)
+		return false
+	}
+
+	zombie := zombies[container.ID]
+	if zombie == nil {
+		zombie = &Zombie{
+			ID:    container.ID,
+			Name:  strings.TrimPrefix(container.Name, "/"),
+			Since: time.Now(),
+		}
+		zombies[container.ID] = zombie
+	}
+	zombie.Attempts += 1
+	zombie.Error = stopErr.Error()
+	zombie.Blacklisted = zombie.Attempts >= MaxStopAttempts
+
+	err = s.saveZombies(zombies)
+	if err != nil {
+		log.Errorf("ERROR: Unable to save the container blacklist: %s", err)
+	}
+	return zombie.Blacklisted
+}
+
+// stopped forgets any failed attempts to stop id.
+func (s *ServiceRuntime) stopped(id string) {
+	s.zombieMu.Lock()
+	defer s.zombieMu.Unlock()
+
+	zombies, err := s.loadZombies()
+	if err != nil || zombies[id] == nil {
+		return
+	}
+
+	delete(zombies, id)
+	err = s.saveZombies(zombies)
+	if err != nil {
+		log.Errorf("ERROR: Unable to save the container blacklist: %s", err)
+	}
+}
+
+// Zombies returns the containers that have failed to stop, oldest first.
+func (s *ServiceRuntime) Zombies() ([]Zombie, error) {
+	s.zombieMu.Lock()
+	defer s.zombieMu.Unlock()
+
+	zombies, err := s.loadZombies()
+	if err != nil {
+		return nil, err
+	}
+
+	list := []Zombie{}
+	for _, z := range zombies {
+		list = append(list, *z)
+	}
+	sort.Sort(zombiesBySince(list))
+	return list, nil
+}
+
+// ClearZombies forgets the zombies whose ID starts with id, or all of them
+// if id is "", so they're tried again.  It returns how many were cleared.
+func (s *ServiceRuntime) ClearZombies(id string) (int, error) {
+	s.zombieMu.Lock()
+	defer s.zombieMu.Unlock()
+
+	zombies, err := s.loadZombies()
+	if err != nil {
+		return 0, err
+	}
+
+	cleared := 0
+	for zid := range zombies {
+		if strings.HasPrefix(zid, id) {
+			delete(zombies, zid)
+			cleared += 1
+		}
+	}
+	if cleared == 0 {
+		return 0, nil
+	}
+	return cleared, s.saveZombies(zombies)
+}
+
+type zombiesBySince []Zombie
+
+func (z zombiesBySince) Len() int           { return len(z) }
+func (z zombiesBySince) Swap(i, j int)      { z[i], z[j] = z[j], z[i] }
+func (z zombiesBySince) Less(i, j int) bool { return z[i].Since.Before(z[j].Since) }
+
+// withTimeout returns f's error, or errTimeout if it takes longer than
+// timeout.  f keeps running in the background.
+func withTimeout(timeout time.Duration, f func() error) error {
+	c := make(chan error, 1)
+	go func() { c <- f() }()
+	select {
+	case err := <-c:
+		return err
+	case <-time.After(timeout):
+		return errTimeout
+	}
+}
+
+// forceStop stops container, escalating to killing it and then removing it
+// if docker doesn't respond.
+func (s *ServiceRuntime) forceStop(container *docker.Container) error {
+	name := strings.TrimPrefix(container.Name, "/")
+
+	signal, timeout := stopSettings(s.EnvFor(container), DefaultStopTimeout)
+	return escalateStop(name, container.ID,
+		func() error {
+			return withTimeout(timeout+10*time.Second, func() error {
+				return s.gracefulStop(container.ID, signal, timeout)
+			})
+		},
+		func() error {
+			return withTimeout(10*time.Second, func() error {
+				return s.ensureDockerClient().KillContainer(docker.KillContainerOptions{ID: container.ID})
+			})
+		},
+		func() error {
+			return withTimeout(10*time.Second, func() error {
+				return s.ensureDockerClient().RemoveContainer(docker.RemoveContainerOptions{
+					ID:    container.ID,
+					Force: true,
+				})
+			})
+		})
+}
+
+// escalateStop calls stop, then kill if it fails, then remove if that
+// fails too.  A container that already exited or is gone is stopped.
+func escalateStop(name, id string, stop, kill, remove func() error) error {
+	err := stop()
+	if err == nil || alreadyStopped(err) {
+		return nil
+	}
+	log.Warnf("WARN: Unable to stop %s container %s: %s. Killing it.", name, id[0:12], err)
+
+	err = kill()
+	if err == nil || alreadyStopped(err) {
+		return nil
+	}
+	log.Warnf("WARN: Unable to kill %s container %s: %s. Removing it.", name, id[0:12], err)
+
+	err = remove()
+	if alreadyStopped(err) {
+		return nil
+	}
+	return err
+}
+
+// alreadyStopped returns true for errors that mean there's nothing left to
+// stop: the container isn't running or doesn't exist.  Signalling one that
+// exited is an error from docker rather than a ContainerNotRunning.
+func alreadyStopped(err error) bool {
+	switch e := err.(type) {
+	case *docker.ContainerNotRunning, *docker.NoSuchContainer:
+		return true
+	case *docker.Error:
+		return strings.Contains(e.Message, "is not running")
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package runtime
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestEscalateStop(t *testing.T) {
+	id := strings.Repeat("a", 64)
+	gone := &docker.NoSuchContainer{ID: id}
+	exited := &docker.ContainerNotRunning{ID: id}
+	failed := fmt.Errorf("connection reset by peer")
+
+	for _, test := range []struct {
+		name           string
+		stop, kill, rm error
+		calls          string
+		err            error
+	}{
+		{"stopped", nil, nil, nil, "stop", nil},
+		{"already exited", exited, nil, nil, "stop", nil},
+		{"already gone", gone, nil, nil, "stop", nil},
+		{"signalled after exiting", &docker.Error{Status: 409, Message: "Container " + id + " is not running"}, nil, nil, "stop", nil},
+		{"stop timed out", errTimeout, nil, nil, "stop,kill", nil},
+		{"stop failed", failed, nil, nil, "stop,kill", nil},
+		{"gone before the kill", errTimeout, gone, nil, "stop,kill", nil},
+		{"kill timed out", errTimeout, errTimeout, nil, "stop,kill,remove", nil},
+		{"gone before the remove", errTimeout, errTimeout, gone, "stop,kill,remove", nil},
+		{"zombie", errTimeout, errTimeout, errTimeout, "stop,kill,remove", errTimeout},
+	} {
+		calls := []string{}
+		step := func(name string, err error) func() error {
+			return func() error {
+				calls = append(calls, name)
+				return err
+			}
+		}
+
+		err := escalateStop("web", id, step("stop", test.stop), step("kill", test.kill), step("remove", test.rm))
+		if err != test.err {
+			t.Fatalf("%s: expected %v. Got %v", test.name, test.err, err)
+		}
+		if strings.Join(calls, ",") != test.calls {
+			t.Fatalf("%s: expected %s. Got %s", test.name, test.calls, strings.Join(calls, ","))
+		}
+	}
+}
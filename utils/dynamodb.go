@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/goamz/goamz/aws"
+)
+
+// DynamoDB is a minimal client for the DynamoDB JSON API.  Requests and
+// responses are passed as generic maps so callers can use condition and
+// update expressions directly.
+type DynamoDB struct {
+	Endpoint string
+	Region   aws.Region
+	Auth     aws.Auth
+	Client   *http.Client
+}
+
+// DynamoDBError is an error response from DynamoDB, e.g. a Code of
+// ConditionalCheckFailedException when a conditional write was rejected.
+type DynamoDBError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *DynamoDBError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// IsDynamoDBError returns true if err is a DynamoDB error response with
+// the given code.
+func IsDynamoDBError(err error, code string) bool {
+	derr, ok := err.(*DynamoDBError)
+	return ok && derr.Code == code
+}
+
+// NewDynamoDB parses a URL of the form dynamodb://region/table.  Use
+// ?endpoint=http://host:port to talk to DynamoDB Local.  Credentials are
+// taken from the environment or the instance role.
+func NewDynamoDB(dynamoURL string) (*DynamoDB, string, error) {
+	u, err := url.Parse(dynamoURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	region, ok := aws.Regions[u.Host]
+	if !ok {
+		return nil, "", fmt.Errorf("region %s not found", u.Host)
+	}
+
+	table := strings.Trim(u.Path, "/")
+	if table == "" {
+		return nil, "", fmt.Errorf("no table name in %s", dynamoURL)
+	}
+
+	auth, err := aws.GetAuth("", "", "", time.Now())
+	if err != nil {
+		return nil, "", err
+	}
+
+	endpoint := region.DynamoDBEndpoint
+	if e := u.Query().Get("endpoint"); e != "" {
+		endpoint = e
+	}
+
+	return &DynamoDB{
+		Endpoint: endpoint,
+		Region:   region,
+		Auth:     auth,
+		Client:   &http.Client{Timeout: 10 * time.Second},
+	}, table, nil
+}
+
+// Do calls action with the JSON encoded req and decodes the reply into
+// resp, which may be nil.
+func (d *DynamoDB) Do(action string, req interface{}, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	hreq, err := http.NewRequest("POST", d.Endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	hreq.Header.Set("X-Amz-Target", "DynamoDB_20120810."+action)
+	// Token refreshes expiring instance role credentials
+	if token := d.Auth.Token(); token != "" {
+		hreq.Header.Set("X-Amz-Security-Token", token)
+	}
+	aws.NewV4Signer(d.Auth, "dynamodb", d.Region).Sign(hreq)
+
+	hresp, err := d.Client.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer hresp.Body.Close()
+
+	data, err := ioutil.ReadAll(hresp.Body)
+	if err != nil {
+		return err
+	}
+
+	if hresp.StatusCode != http.StatusOK {
+		derr := &DynamoDBError{StatusCode: hresp.StatusCode}
+		var reply struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &reply) == nil {
+			// __type is namespaced, e.g. com.amazonaws.dynamodb.v20120810#ResourceNotFoundException
+			derr.Code = reply.Type[strings.LastIndex(reply.Type, "#")+1:]
+			derr.Message = reply.Message
+		} else {
+			derr.Code = hresp.Status
+			derr.Message = string(data)
+		}
+		return derr
+	}
+
+	if resp == nil {
+		return nil
+	}
+	return json.Unmarshal(data, resp)
+}
+
+// DynamoItem is an item or key in DynamoDB's attribute value encoding.
+type DynamoItem map[string]map[string]string
+
+// DynamoS encodes a string attribute value.
+func DynamoS(s string) map[string]string {
+	return map[string]string{"S": s}
+}
+
+// DynamoN encodes a number attribute value.
+func DynamoN(n int64) map[string]string {
+	return map[string]string{"N": fmt.Sprintf("%d", n)}
+}
@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goamz/goamz/aws"
+)
+
+func TestDynamoDBDo(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if target := r.Header.Get("X-Amz-Target"); target != "DynamoDB_20120810.GetItem" {
+			t.Errorf("X-Amz-Target = %q", target)
+		}
+		if r.Header.Get("Authorization") == "" {
+			t.Error("request was not signed")
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException","message":"The conditional request failed"}`))
+	}))
+	defer server.Close()
+
+	db := &DynamoDB{
+		Endpoint: server.URL,
+		Region:   aws.USEast,
+		Auth:     aws.Auth{AccessKey: "access", SecretKey: "secret"},
+		Client:   http.DefaultClient,
+	}
+
+	err := db.Do("GetItem", map[string]interface{}{"TableName": "galaxy"}, nil)
+	if !IsDynamoDBError(err, "ConditionalCheckFailedException") {
+		t.Fatalf("expected ConditionalCheckFailedException, got %v", err)
+	}
+}
@@ -0,0 +1,482 @@
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// number of published messages retained per channel so slow
+	// subscribers can catch up after the file changes
+	fileStoreMessageHistory = 100
+
+	fileStorePollInterval = time.Second
+)
+
+// FileStore is a JSON file backed store that provides the subset of redis
+// hashes, expiration and pub/sub semantics used by the galaxy backends. It's
+// intended for single host and development setups. Multiple processes can
+// share the same file; writes are serialized with an flock on a lock file
+// next to the data file.
+type FileStore struct {
+	Path string
+	mu   sync.Mutex
+	// stop is closed by Close to end subscriptions
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+type fileStoreData struct {
+	Hashes   map[string]map[string]string `json:"hashes"`
+	Expires  map[string]int64             `json:"expires"`
+	Messages map[string][]FileMessage     `json:"messages"`
+	Seq      int64                        `json:"seq"`
+}
+
+type FileMessage struct {
+	Seq   int64  `json:"seq"`
+	Value string `json:"value"`
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{
+		Path: path,
+		stop: make(chan struct{}),
+	}
+}
+
+// Close ends the store's subscriptions, closing their channels.
+func (f *FileStore) Close() {
+	f.closeOnce.Do(func() { close(f.stop) })
+}
+
+func (f *FileStore) lock() (*os.File, error) {
+	f.mu.Lock()
+
+	err := os.MkdirAll(filepath.Dir(f.Path), 0755)
+	if err != nil {
+		f.mu.Unlock()
+		return nil, err
+	}
+
+	lf, err := os.OpenFile(f.Path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		f.mu.Unlock()
+		return nil, err
+	}
+
+	err = syscall.Flock(int(lf.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		lf.Close()
+		f.mu.Unlock()
+		return nil, err
+	}
+	return lf, nil
+}
+
+func (f *FileStore) unlock(lf *os.File) {
+	syscall.Flock(int(lf.Fd()), syscall.LOCK_UN)
+	lf.Close()
+	f.mu.Unlock()
+}
+
+func (f *FileStore) load() (*fileStoreData, error) {
+	data := &fileStoreData{}
+
+	b, err := ioutil.ReadFile(f.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if len(b) > 0 {
+		err = json.Unmarshal(b, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if data.Hashes == nil {
+		data.Hashes = make(map[string]map[string]string)
+	}
+	if data.Expires == nil {
+		data.Expires = make(map[string]int64)
+	}
+	if data.Messages == nil {
+		data.Messages = make(map[string][]FileMessage)
+	}
+
+	now := time.Now().Unix()
+	for k, expires := range data.Expires {
+		if expires <= now {
+			delete(data.Hashes, k)
+			delete(data.Expires, k)
+		}
+	}
+	return data, nil
+}
+
+func (f *FileStore) save(data *fileStoreData) error {
+	b, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temp file and rename so readers never see a partial file
+	tmp := f.Path + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.Path)
+}
+
+// view runs fn with a consistent snapshot of the store
+func (f *FileStore) view(fn func(data *fileStoreData) error) error {
+	lf, err := f.lock()
+	if err != nil {
+		return err
+	}
+	defer f.unlock(lf)
+
+	data, err := f.load()
+	if err != nil {
+		return err
+	}
+	return fn(data)
+}
+
+// update runs fn with the current contents of the store and writes the
+// result back if fn returns without error
+func (f *FileStore) update(fn func(data *fileStoreData) error) error {
+	lf, err := f.lock()
+	if err != nil {
+		return err
+	}
+	defer f.unlock(lf)
+
+	data, err := f.load()
+	if err != nil {
+		return err
+	}
+
+	err = fn(data)
+	if err != nil {
+		return err
+	}
+	return f.save(data)
+}
+
+// GlobToRegexp converts a redis style glob pattern to an anchored regexp
+func GlobToRegexp(pattern string) (*regexp.Regexp, error) {
+	expr := "^"
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			expr += ".*"
+		case '?':
+			expr += "."
+		default:
+			expr += regexp.QuoteMeta(string(c))
+		}
+	}
+	return regexp.Compile(expr + "$")
+}
+
+func (f *FileStore) Keys(pattern string) ([]string, error) {
+	re, err := GlobToRegexp(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	err = f.view(func(data *fileStoreData) error {
+		for k := range data.Hashes {
+			if re.MatchString(k) {
+				keys = append(keys, k)
+			}
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (f *FileStore) Delete(key string) (int, error) {
+	deleted := 0
+	err := f.update(func(data *fileStoreData) error {
+		if _, ok := data.Hashes[key]; ok {
+			deleted = 1
+		}
+		delete(data.Hashes, key)
+		delete(data.Expires, key)
+		return nil
+	})
+	return deleted, err
+}
+
+func (f *FileStore) Expire(key string, ttl uint64) (int, error) {
+	set := 0
+	err := f.update(func(data *fileStoreData) error {
+		if _, ok := data.Hashes[key]; !ok {
+			return nil
+		}
+		data.Expires[key] = time.Now().Unix() + int64(ttl)
+		set = 1
+		return nil
+	})
+	return set, err
+}
+
+// Ttl returns the remaining seconds before key expires.  Like redis, -1 is
+// returned for keys without an expiration and -2 for missing keys.
+func (f *FileStore) Ttl(key string) (int, error) {
+	ttl := -2
+	err := f.view(func(data *fileStoreData) error {
+		if _, ok := data.Hashes[key]; !ok {
+			return nil
+		}
+
+		expires, ok := data.Expires[key]
+		if !ok {
+			ttl = -1
+			return nil
+		}
+		ttl = int(expires - time.Now().Unix())
+		return nil
+	})
+	return ttl, err
+}
+
+func (f *FileStore) Get(key, field string) (string, error) {
+	value := ""
+	err := f.view(func(data *fileStoreData) error {
+		value = data.Hashes[key][field]
+		return nil
+	})
+	return value, err
+}
+
+func (f *FileStore) GetAll(key string) (map[string]string, error) {
+	values := make(map[string]string)
+	err := f.view(func(data *fileStoreData) error {
+		for k, v := range data.Hashes[key] {
+			values[k] = v
+		}
+		return nil
+	})
+	return values, err
+}
+
+func (f *FileStore) Set(key, field, value string) (string, error) {
+	return f.SetMulti(key, map[string]string{field: value})
+}
+
+func (f *FileStore) SetMulti(key string, values map[string]string) (string, error) {
+	err := f.update(func(data *fileStoreData) error {
+		hash := data.Hashes[key]
+		if hash == nil {
+			hash = make(map[string]string)
+			data.Hashes[key] = hash
+		}
+		for k, v := range values {
+			hash[k] = v
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return "OK", nil
+}
+
+// SetMultiIf writes values, a map of key to hash fields, only if cond
+// returns true for the current contents of those keys.  The check and write
+// happen under the same lock.
+func (f *FileStore) SetMultiIf(values map[string]map[string]string, cond func(current map[string]map[string]string) bool) (bool, error) {
+	set := false
+	err := f.update(func(data *fileStoreData) error {
+		current := make(map[string]map[string]string)
+		for key := range values {
+			current[key] = data.Hashes[key]
+		}
+
+		if !cond(current) {
+			return nil
+		}
+
+		for key, fields := range values {
+			hash := data.Hashes[key]
+			if hash == nil {
+				hash = make(map[string]string)
+				data.Hashes[key] = hash
+			}
+			for k, v := range fields {
+				hash[k] = v
+			}
+		}
+		set = true
+		return nil
+	})
+	return set, err
+}
+
+// CompareAndSet sets field to value and key to expire after ttl seconds only
+// if field currently holds old.  A ttl of 0 removes the expiration.
+func (f *FileStore) CompareAndSet(key, field, old, value string, ttl uint64) (bool, error) {
+	set := false
+	err := f.update(func(data *fileStoreData) error {
+		hash := data.Hashes[key]
+		if hash[field] != old {
+			return nil
+		}
+
+		if hash == nil {
+			hash = make(map[string]string)
+			data.Hashes[key] = hash
+		}
+		hash[field] = value
+		if ttl > 0 {
+			data.Expires[key] = time.Now().Unix() + int64(ttl)
+		} else {
+			delete(data.Expires, key)
+		}
+		set = true
+		return nil
+	})
+	return set, err
+}
+
+func (f *FileStore) DeleteMulti(key string, fields ...string) (int, error) {
+	deleted := 0
+	err := f.update(func(data *fileStoreData) error {
+		hash := data.Hashes[key]
+		for _, field := range fields {
+			if _, ok := hash[field]; ok {
+				delete(hash, field)
+				deleted++
+			}
+		}
+		if hash != nil && len(hash) == 0 {
+			delete(data.Hashes, key)
+			delete(data.Expires, key)
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// Sets are stored as hashes where each member is a field
+
+func (f *FileStore) AddMember(key, value string) (int, error) {
+	added := 0
+	err := f.update(func(data *fileStoreData) error {
+		set := data.Hashes[key]
+		if set == nil {
+			set = make(map[string]string)
+			data.Hashes[key] = set
+		}
+		if _, ok := set[value]; !ok {
+			set[value] = "1"
+			added = 1
+		}
+		return nil
+	})
+	return added, err
+}
+
+func (f *FileStore) RemoveMember(key, value string) (int, error) {
+	removed, err := f.DeleteMulti(key, value)
+	return removed, err
+}
+
+func (f *FileStore) Members(key string) ([]string, error) {
+	members := []string{}
+	err := f.view(func(data *fileStoreData) error {
+		for k := range data.Hashes[key] {
+			members = append(members, k)
+		}
+		return nil
+	})
+	return members, err
+}
+
+// Publish appends a message to a channel.  Subscribers notice the change the
+// next time they check the file.
+func (f *FileStore) Publish(channel, value string) (int, error) {
+	err := f.update(func(data *fileStoreData) error {
+		data.Seq++
+		msgs := append(data.Messages[channel], FileMessage{
+			Seq:   data.Seq,
+			Value: value,
+		})
+		if len(msgs) > fileStoreMessageHistory {
+			msgs = msgs[len(msgs)-fileStoreMessageHistory:]
+		}
+		data.Messages[channel] = msgs
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// Subscribe watches the file for changes and sends any messages published
+// to channel after the subscription started, until the store is closed.
+func (f *FileStore) Subscribe(channel string, msgs chan string) error {
+	var lastSeq int64
+	err := f.view(func(data *fileStoreData) error {
+		lastSeq = data.Seq
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer close(msgs)
+
+		ticker := time.NewTicker(fileStorePollInterval)
+		defer ticker.Stop()
+
+		var lastMod time.Time
+		for {
+			select {
+			case <-f.stop:
+				return
+			case <-ticker.C:
+			}
+
+			fi, err := os.Stat(f.Path)
+			if err != nil || !fi.ModTime().After(lastMod) {
+				continue
+			}
+			lastMod = fi.ModTime()
+
+			pending := []string{}
+			f.view(func(data *fileStoreData) error {
+				for _, msg := range data.Messages[channel] {
+					if msg.Seq > lastSeq {
+						pending = append(pending, msg.Value)
+						lastSeq = msg.Seq
+					}
+				}
+				return nil
+			})
+
+			for _, msg := range pending {
+				select {
+				case msgs <- msg:
+				case <-f.stop:
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func newTestFileStore(t *testing.T) (*FileStore, func()) {
+	dir, err := ioutil.TempDir("", "galaxy-filestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewFileStore(filepath.Join(dir, "galaxy.json")), func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFileStoreSetGet(t *testing.T) {
+	f, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	if _, err := f.Set("dev/app/version", "version", "foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := f.Get("dev/app/version", "version"); v != "foo" || err != nil {
+		t.Fatalf("Get() = %q, %v, want %q, %v", v, err, "foo", nil)
+	}
+
+	// a second store sharing the file sees the same data
+	other := NewFileStore(f.Path)
+	if v, err := other.Get("dev/app/version", "version"); v != "foo" || err != nil {
+		t.Fatalf("Get() = %q, %v, want %q, %v", v, err, "foo", nil)
+	}
+}
+
+func TestFileStoreKeys(t *testing.T) {
+	f, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	for _, k := range []string{"dev/a/version", "dev/b/version", "dev/b/environment", "prod/a/version"} {
+		f.Set(k, "k", "v")
+	}
+
+	keys, err := f.Keys("dev/*/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+
+	if len(keys) != 2 || keys[0] != "dev/a/version" || keys[1] != "dev/b/version" {
+		t.Fatalf("Keys() = %v, want %v", keys, []string{"dev/a/version", "dev/b/version"})
+	}
+}
+
+func TestFileStoreMembers(t *testing.T) {
+	f, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	if added, _ := f.AddMember("dev/pools/web", "app"); added != 1 {
+		t.Fatalf("AddMember() = %d, want %d", added, 1)
+	}
+
+	if added, _ := f.AddMember("dev/pools/web", "app"); added != 0 {
+		t.Fatalf("AddMember() = %d, want %d", added, 0)
+	}
+
+	members, _ := f.Members("dev/pools/web")
+	if len(members) != 1 || members[0] != "app" {
+		t.Fatalf("Members() = %v, want %v", members, []string{"app"})
+	}
+
+	if removed, _ := f.RemoveMember("dev/pools/web", "app"); removed != 1 {
+		t.Fatalf("RemoveMember() = %d, want %d", removed, 1)
+	}
+}
+
+func TestFileStoreExpire(t *testing.T) {
+	f, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	if ttl, _ := f.Ttl("missing"); ttl != -2 {
+		t.Fatalf("Ttl() = %d, want %d", ttl, -2)
+	}
+
+	f.Set("key", "field", "value")
+	if ttl, _ := f.Ttl("key"); ttl != -1 {
+		t.Fatalf("Ttl() = %d, want %d", ttl, -1)
+	}
+
+	f.Expire("key", 60)
+	if ttl, _ := f.Ttl("key"); ttl <= 0 || ttl > 60 {
+		t.Fatalf("Ttl() = %d, want (0, 60]", ttl)
+	}
+
+	f.Expire("key", 0)
+	if v, _ := f.Get("key", "field"); v != "" {
+		t.Fatalf("Get() = %q, want expired", v)
+	}
+}
+
+func TestFileStoreCompareAndSetPersist(t *testing.T) {
+	f, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	if ok, err := f.CompareAndSet("key", "field", "", "v1", 60); !ok || err != nil {
+		t.Fatalf("CompareAndSet() = %v, %v", ok, err)
+	}
+	if ttl, _ := f.Ttl("key"); ttl <= 0 {
+		t.Fatalf("Ttl() = %d, want > 0", ttl)
+	}
+
+	// a ttl of 0 persists the key rather than expiring it
+	if ok, err := f.CompareAndSet("key", "field", "v1", "v2", 0); !ok || err != nil {
+		t.Fatalf("CompareAndSet() = %v, %v", ok, err)
+	}
+	if ttl, _ := f.Ttl("key"); ttl != -1 {
+		t.Fatalf("Ttl() = %d, want %d", ttl, -1)
+	}
+}
+
+func TestFileStoreSubscribe(t *testing.T) {
+	f, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	f.Publish("galaxy-dev", "before")
+
+	msgs := make(chan string, 10)
+	if err := f.Subscribe("galaxy-dev", msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Publish("galaxy-prod", "ignored")
+	f.Publish("galaxy-dev", "config")
+
+	select {
+	case msg := <-msgs:
+		if msg != "config" {
+			t.Fatalf("Subscribe() got %q, want %q", msg, "config")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Subscribe() timed out waiting for message")
+	}
+}
+
+func TestFileStoreClose(t *testing.T) {
+	f, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	msgs := make(chan string)
+	if err := f.Subscribe("galaxy-dev", msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing reads the message, so the subscription is blocked sending it
+	f.Publish("galaxy-dev", "config")
+	time.Sleep(2 * fileStorePollInterval)
+
+	f.Close()
+	f.Close()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-msgs:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Close() did not end the subscription")
+		}
+	}
+}
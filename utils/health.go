@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMinBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff = 30 * time.Second
+	// DefaultConnRetries is how many times a command waits for the backend
+	// to come back before failing
+	DefaultConnRetries = 3
+)
+
+// BackendStatus is a snapshot of a backend's connection health.
+type BackendStatus struct {
+	Healthy       bool      `json:"healthy"`
+	LastError     string    `json:"last_error,omitempty"`
+	LastErrorTime time.Time `json:"last_error_time,omitempty"`
+	LastOKTime    time.Time `json:"last_ok_time,omitempty"`
+	// Failures is the number of consecutive failed connection attempts
+	Failures   int `json:"failures"`
+	Reconnects int `json:"reconnects"`
+	// Pool is set for backends with a connection pool
+	Pool *PoolStats `json:"pool,omitempty"`
+}
+
+// BackendHealth records connection successes and failures and computes an
+// exponential backoff from the number of consecutive failures.  The zero
+// value is ready to use.
+type BackendHealth struct {
+	// MinBackoff and MaxBackoff bound the delay, doubling from MinBackoff
+	// with each consecutive failure
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	mu      sync.Mutex
+	status  BackendStatus
+	started bool
+}
+
+// OK records a successful round trip to the backend.
+func (h *BackendHealth) OK() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.started = true
+	h.status.Healthy = true
+	h.status.Failures = 0
+	h.status.LastOKTime = time.Now()
+}
+
+// Failed records a connection error.
+func (h *BackendHealth) Failed(err error) {
+	if err == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.started = true
+	h.status.Healthy = false
+	h.status.Failures += 1
+	h.status.LastError = err.Error()
+	h.status.LastErrorTime = time.Now()
+}
+
+// Reconnected counts a reconnect attempt.
+func (h *BackendHealth) Reconnected() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.status.Reconnects += 1
+}
+
+// Backoff returns how long to wait before the next connection attempt.
+func (h *BackendHealth) Backoff() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	min, max := h.MinBackoff, h.MaxBackoff
+	if min == 0 {
+		min = DefaultMinBackoff
+	}
+	if max == 0 {
+		max = DefaultMaxBackoff
+	}
+
+	delay := min
+	for i := 1; i < h.status.Failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// Status returns the current health.  A backend that hasn't been used yet
+// is reported as healthy.
+func (h *BackendHealth) Status() BackendStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	status := h.status
+	if !h.started {
+		status.Healthy = true
+	}
+	return status
+}
@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackendHealthBackoff(t *testing.T) {
+	h := &BackendHealth{
+		MinBackoff: time.Second,
+		MaxBackoff: 5 * time.Second,
+	}
+
+	if !h.Status().Healthy {
+		t.Fatal("unused backend should be healthy")
+	}
+
+	for _, want := range []time.Duration{1, 2, 4, 5, 5} {
+		h.Failed(errors.New("connection refused"))
+		if d := h.Backoff(); d != want*time.Second {
+			t.Errorf("after %d failures backoff = %s, want %s", h.Status().Failures, d, want*time.Second)
+		}
+	}
+
+	status := h.Status()
+	if status.Healthy || status.LastError != "connection refused" {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	h.OK()
+	if !h.Status().Healthy || h.Status().Failures != 0 {
+		t.Fatalf("expected healthy status after OK: %+v", h.Status())
+	}
+	if d := h.Backoff(); d != time.Second {
+		t.Errorf("backoff after OK = %s, want 1s", d)
+	}
+}
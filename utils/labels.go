@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseLabels parses a host's comma separated labels, e.g.
+// "ssd,gpu,az=us-east-1a", into their values.  Labels without a value,
+// like ssd, are "".
+func ParseLabels(labels string) (map[string]string, error) {
+	parsed := make(map[string]string)
+	for _, label := range strings.Split(labels, ",") {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			continue
+		}
+		parts := strings.SplitN(label, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if name == "" || strings.Contains(name, "!") {
+			return nil, fmt.Errorf("invalid label: %s", label)
+		}
+		value := ""
+		if len(parts) == 2 {
+			value = strings.TrimSpace(parts[1])
+		}
+		parsed[name] = value
+	}
+	return parsed, nil
+}
+
+// MatchConstraints returns true if labels satisfy every one of the comma
+// separated constraints: "ssd" needs the ssd label, "!gpu" needs the gpu
+// label to be missing, "az=us-east-1a" needs az to be us-east-1a and
+// "az!=us-east-1a" needs it to be something else or missing.
+func MatchConstraints(constraints string, labels map[string]string) (bool, error) {
+	for _, c := range strings.Split(constraints, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+
+		var name, value string
+		var ok bool
+		switch {
+		case strings.Contains(c, "!="):
+			parts := strings.SplitN(c, "!=", 2)
+			name, value = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+			actual, found := labels[name]
+			ok = !found || actual != value
+		case strings.Contains(c, "="):
+			parts := strings.SplitN(c, "=", 2)
+			name, value = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+			actual, found := labels[name]
+			ok = found && actual == value
+		case strings.HasPrefix(c, "!"):
+			name = strings.TrimSpace(c[1:])
+			_, found := labels[name]
+			ok = !found
+		default:
+			name = c
+			_, ok = labels[name]
+		}
+
+		if name == "" || strings.Contains(name, "!") {
+			return false, fmt.Errorf("invalid constraint: %s", c)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
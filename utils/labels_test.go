@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels("ssd, gpu,az=us-east-1a,")
+	if err != nil {
+		t.Fatalf("Expected labels. Got %s", err)
+	}
+	expected := map[string]string{"ssd": "", "gpu": "", "az": "us-east-1a"}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Fatalf("Expected %v. Got %v", expected, labels)
+	}
+
+	for _, label := range []string{"=x", "!gpu"} {
+		if _, err := ParseLabels(label); err == nil {
+			t.Fatalf("Expected error for %q", label)
+		}
+	}
+}
+
+func TestMatchConstraints(t *testing.T) {
+	labels := map[string]string{"ssd": "", "az": "us-east-1a"}
+
+	for _, tt := range []struct {
+		constraints string
+		match       bool
+	}{
+		{"", true},
+		{"ssd", true},
+		{"gpu", false},
+		{"!gpu", true},
+		{"!ssd", false},
+		{"az=us-east-1a", true},
+		{"az=us-east-1b", false},
+		{"az!=us-east-1b", true},
+		{"region!=us-east", true},
+		{"ssd,az=us-east-1a", true},
+		{"ssd,az=us-east-1b", false},
+	} {
+		match, err := MatchConstraints(tt.constraints, labels)
+		if err != nil {
+			t.Fatalf("Expected %t for %q. Got %s", tt.match, tt.constraints, err)
+		}
+		if match != tt.match {
+			t.Fatalf("Expected %t for %q. Got %t", tt.match, tt.constraints, match)
+		}
+	}
+
+	for _, c := range []string{"!", "=x", "!=x", "!!ssd"} {
+		if _, err := MatchConstraints(c, labels); err == nil {
+			t.Fatalf("Expected error for %q", c)
+		}
+	}
+}
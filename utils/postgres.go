@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PostgresDriver is the database/sql driver used for postgres:// URLs.
+var PostgresDriver = "postgres"
+
+// OpenPostgres opens a connection pool for a postgres:// URL.
+func OpenPostgres(dsn string) (*sql.DB, error) {
+	db, err := sql.Open(PostgresDriver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// ListenPostgres sends each payload NOTIFYed on channel to msgs.
+func ListenPostgres(dsn, channel string, msgs chan string) error {
+	listener := pq.NewListener(dsn, time.Second, time.Minute, nil)
+	if err := listener.Listen(channel); err != nil {
+		listener.Close()
+		return err
+	}
+
+	go func() {
+		for n := range listener.Notify {
+			// nil is sent after a reconnect.  Anything missed is picked
+			// up by the periodic config check.
+			if n == nil {
+				continue
+			}
+			msgs <- n.Extra
+		}
+	}()
+	return nil
+}
+
+// GlobToLike converts a redis style glob pattern to a LIKE pattern using \
+// as the escape character.
+func GlobToLike(pattern string) string {
+	like := ""
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			like += "%"
+		case '?':
+			like += "_"
+		case '%', '_', '\\':
+			like += `\` + string(c)
+		default:
+			like += string(c)
+		}
+	}
+	return like
+}
+
+// ExecAll runs each statement in order, stopping at the first error.
+func ExecAll(db *sql.DB, statements ...string) error {
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
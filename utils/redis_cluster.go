@@ -0,0 +1,484 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	clusterSlots = 16384
+	// redirects followed for a single command before giving up
+	maxRedirects = 5
+)
+
+// RedisCluster tracks which node of a Redis Cluster serves each hash slot.
+// Connections returned by DialTimeout route each command to the node owning
+// its key and follow MOVED and ASK redirects.
+type RedisCluster struct {
+	Addrs   []string
+	Options *RedisOptions
+
+	mu    sync.RWMutex
+	slots []string
+	dial  dialFunc
+}
+
+// NewRedisCluster parses a cluster URL of the form
+// redis+cluster://[:pass@]host1:6379,host2:6379.  The hosts are only used to
+// discover the rest of the cluster.  Use rediss+cluster for TLS.
+func NewRedisCluster(clusterURL string) (*RedisCluster, error) {
+	u, err := url.Parse(clusterURL)
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := ParseRedisOptions(u)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := []string{}
+	for _, addr := range strings.Split(u.Host, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "6379")
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no cluster addresses in %s", clusterURL)
+	}
+
+	return &RedisCluster{
+		Addrs:   addrs,
+		Options: opts,
+		slots:   make([]string, clusterSlots),
+	}, nil
+}
+
+func (c *RedisCluster) dialer() dialFunc {
+	if c.dial != nil {
+		return c.dial
+	}
+	if c.Options != nil {
+		return c.Options.DialTimeout
+	}
+	return redis.DialTimeout
+}
+
+// ClusterSlot returns the hash slot for key, honoring {hash tags}.
+func ClusterSlot(key string) int {
+	if start := strings.Index(key, "{"); start >= 0 {
+		if end := strings.Index(key[start+1:], "}"); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % clusterSlots
+}
+
+// crc16 is the CRC-16/XMODEM checksum used by Redis Cluster.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc = crc << 1
+			}
+		}
+	}
+	return crc
+}
+
+// Refresh reloads the slot map with CLUSTER SLOTS from the first node that
+// answers.
+func (c *RedisCluster) Refresh(timeout time.Duration) error {
+	c.mu.RLock()
+	candidates := append([]string{}, c.Addrs...)
+	candidates = append(candidates, c.mastersLocked()...)
+	c.mu.RUnlock()
+
+	var lastErr error
+	for _, addr := range candidates {
+		conn, err := c.dialer()("tcp", addr, timeout, timeout, timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		reply, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		slots := make([]string, clusterSlots)
+		for _, r := range reply {
+			entry, err := redis.Values(r, nil)
+			if err != nil || len(entry) < 3 {
+				continue
+			}
+
+			start, _ := redis.Int(entry[0], nil)
+			end, _ := redis.Int(entry[1], nil)
+			master, err := redis.Values(entry[2], nil)
+			if err != nil || len(master) < 2 {
+				continue
+			}
+
+			host, _ := redis.String(master[0], nil)
+			port, _ := redis.Int(master[1], nil)
+			if host == "" {
+				// the node answering doesn't know its own IP
+				host, _, _ = net.SplitHostPort(addr)
+			}
+
+			node := net.JoinHostPort(host, strconv.Itoa(port))
+			for slot := start; slot <= end && slot < clusterSlots; slot++ {
+				slots[slot] = node
+			}
+		}
+
+		c.mu.Lock()
+		c.slots = slots
+		c.mu.Unlock()
+		return nil
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no cluster nodes configured")
+	}
+	return fmt.Errorf("unable to load cluster slots: %s", lastErr)
+}
+
+func (c *RedisCluster) mastersLocked() []string {
+	masters := []string{}
+	for _, node := range c.slots {
+		if node != "" && !StringInSlice(node, masters) {
+			masters = append(masters, node)
+		}
+	}
+	return masters
+}
+
+// Masters returns the address of each node serving slots.
+func (c *RedisCluster) Masters() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.mastersLocked()
+}
+
+func (c *RedisCluster) nodeFor(key string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if node := c.slots[ClusterSlot(key)]; node != "" {
+		return node
+	}
+	masters := c.mastersLocked()
+	if len(masters) > 0 {
+		return masters[0]
+	}
+	return c.Addrs[0]
+}
+
+func (c *RedisCluster) setSlot(slot int, node string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if slot >= 0 && slot < clusterSlots {
+		c.slots[slot] = node
+	}
+}
+
+// DialTimeout returns a connection that spans the cluster.  Node
+// connections are opened lazily as commands are routed to them.
+func (c *RedisCluster) DialTimeout(connectTimeout, readTimeout, writeTimeout time.Duration) (redis.Conn, error) {
+	if len(c.Masters()) == 0 {
+		err := c.Refresh(connectTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &clusterConn{
+		cluster:        c,
+		conns:          make(map[string]redis.Conn),
+		connectTimeout: connectTimeout,
+		readTimeout:    readTimeout,
+		writeTimeout:   writeTimeout,
+	}, nil
+}
+
+type clusterConn struct {
+	cluster *RedisCluster
+	conns   map[string]redis.Conn
+	// nodes that replies are pending on, in the order they were sent
+	pending []string
+	err     error
+
+	connectTimeout time.Duration
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+}
+
+func (c *clusterConn) nodeConn(node string) (redis.Conn, error) {
+	if conn, ok := c.conns[node]; ok && conn.Err() == nil {
+		return conn, nil
+	}
+
+	conn, err := c.cluster.dialer()("tcp", node, c.connectTimeout, c.readTimeout, c.writeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c.conns[node] = conn
+	return conn, nil
+}
+
+// commandKey returns the key a command operates on, or "" if the command
+// can be sent to any node.
+func commandKey(cmd string, args []interface{}) string {
+	switch strings.ToUpper(cmd) {
+	case "", "PING", "ROLE", "PUBLISH", "SUBSCRIBE", "UNSUBSCRIBE", "PSUBSCRIBE",
+		"PUNSUBSCRIBE", "KEYS", "SCAN", "INFO", "SCRIPT", "CLUSTER":
+		return ""
+	case "EVAL", "EVALSHA":
+		if len(args) > 2 {
+			if n, err := redis.Int(args[1], nil); err == nil && n > 0 {
+				return fmt.Sprint(args[2])
+			}
+		}
+		return ""
+	}
+	if len(args) == 0 {
+		return ""
+	}
+	if b, ok := args[0].([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(args[0])
+}
+
+// parseRedirect splits a MOVED or ASK error into its slot and node.
+func parseRedirect(err error) (string, int, string) {
+	rerr, ok := err.(redis.Error)
+	if !ok {
+		return "", 0, ""
+	}
+
+	parts := strings.Fields(string(rerr))
+	if len(parts) != 3 || (parts[0] != "MOVED" && parts[0] != "ASK") {
+		return "", 0, ""
+	}
+	slot, _ := strconv.Atoi(parts[1])
+	return parts[0], slot, parts[2]
+}
+
+func (c *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "" {
+		// flush pending replies like redis.Conn does
+		if err := c.Flush(); err != nil {
+			return nil, err
+		}
+		var reply interface{}
+		var err error
+		for len(c.pending) > 0 {
+			reply, err = c.Receive()
+		}
+		return reply, err
+	}
+
+	switch strings.ToUpper(cmd) {
+	case "KEYS":
+		return c.doAll(cmd, args...)
+	case "SCAN":
+		return c.scan(args...)
+	}
+
+	key := commandKey(cmd, args)
+	node := c.cluster.nodeFor(key)
+	asking := false
+	refreshed := false
+
+	for i := 0; ; i++ {
+		conn, err := c.nodeConn(node)
+		if err != nil {
+			if refreshed {
+				return nil, err
+			}
+			// the node is gone, the slots have likely moved
+			refreshed = true
+			if rerr := c.cluster.Refresh(c.connectTimeout); rerr != nil {
+				return nil, err
+			}
+			node = c.cluster.nodeFor(key)
+			continue
+		}
+
+		if asking {
+			if _, err := conn.Do("ASKING"); err != nil {
+				return nil, err
+			}
+		}
+
+		reply, err := conn.Do(cmd, args...)
+		kind, slot, target := parseRedirect(err)
+		if kind == "" || i >= maxRedirects {
+			return reply, err
+		}
+
+		node = target
+		asking = kind == "ASK"
+		if kind == "MOVED" {
+			c.cluster.setSlot(slot, target)
+		}
+	}
+}
+
+// doAll runs cmd on every master and concatenates the replies.
+func (c *clusterConn) doAll(cmd string, args ...interface{}) (interface{}, error) {
+	replies := []interface{}{}
+	for _, node := range c.cluster.Masters() {
+		conn, err := c.nodeConn(node)
+		if err != nil {
+			return nil, err
+		}
+
+		reply, err := redis.Values(conn.Do(cmd, args...))
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, reply...)
+	}
+	return replies, nil
+}
+
+// scan runs SCAN across the masters one at a time.  The cursor returned to
+// the caller is "<master index>-<node cursor>" until the last master is
+// done, when it is "0" like a single node's.
+func (c *clusterConn) scan(args ...interface{}) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, errors.New("SCAN requires a cursor")
+	}
+
+	index, cursor := 0, "0"
+	if start := fmt.Sprint(args[0]); start != "0" {
+		parts := strings.SplitN(start, "-", 2)
+		n, err := strconv.Atoi(parts[0])
+		if len(parts) != 2 || err != nil {
+			return nil, fmt.Errorf("invalid cluster SCAN cursor %s", start)
+		}
+		index, cursor = n, parts[1]
+	}
+
+	masters := c.cluster.Masters()
+	if index >= len(masters) {
+		return []interface{}{[]byte("0"), []interface{}{}}, nil
+	}
+
+	conn, err := c.nodeConn(masters[index])
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := redis.Values(conn.Do("SCAN", append([]interface{}{cursor}, args[1:]...)...))
+	if err != nil {
+		return nil, err
+	}
+
+	var next string
+	var keys []interface{}
+	_, err = redis.Scan(reply, &next, &keys)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case next != "0":
+		next = fmt.Sprintf("%d-%s", index, next)
+	case index+1 < len(masters):
+		next = fmt.Sprintf("%d-0", index+1)
+	}
+	return []interface{}{[]byte(next), keys}, nil
+}
+
+func (c *clusterConn) Send(cmd string, args ...interface{}) error {
+	node := c.cluster.nodeFor(commandKey(cmd, args))
+	conn, err := c.nodeConn(node)
+	if err != nil {
+		c.err = err
+		return err
+	}
+
+	err = conn.Send(cmd, args...)
+	if err != nil {
+		c.err = err
+		return err
+	}
+	c.pending = append(c.pending, node)
+	return nil
+}
+
+func (c *clusterConn) Flush() error {
+	for _, conn := range c.conns {
+		if err := conn.Flush(); err != nil {
+			c.err = err
+			return err
+		}
+	}
+	return nil
+}
+
+// Receive reads the next pending reply.  With nothing pending, e.g. for
+// pub/sub, it reads from the node commands without a key are sent to.
+func (c *clusterConn) Receive() (interface{}, error) {
+	node := c.cluster.nodeFor("")
+	if len(c.pending) > 0 {
+		node, c.pending = c.pending[0], c.pending[1:]
+	}
+
+	conn, err := c.nodeConn(node)
+	if err != nil {
+		c.err = err
+		return nil, err
+	}
+
+	reply, err := conn.Receive()
+	if err != nil {
+		if _, ok := err.(redis.Error); !ok {
+			c.err = err
+		}
+	}
+	return reply, err
+}
+
+func (c *clusterConn) Err() error {
+	return c.err
+}
+
+func (c *clusterConn) Close() error {
+	var err error
+	for node, conn := range c.conns {
+		if cerr := conn.Close(); cerr != nil {
+			err = cerr
+		}
+		delete(c.conns, node)
+	}
+	if c.err == nil {
+		c.err = errors.New("redigo: closed")
+	}
+	return err
+}
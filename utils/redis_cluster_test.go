@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestClusterSlot(t *testing.T) {
+	for _, tt := range []struct {
+		key  string
+		slot int
+	}{
+		{"123456789", 12739},
+		{"foo", 12182},
+		{"{foo}.bar", 12182},
+		{"a{foo}", 12182},
+	} {
+		if got := ClusterSlot(tt.key); got != tt.slot {
+			t.Errorf("ClusterSlot(%q) = %d, want %d", tt.key, got, tt.slot)
+		}
+	}
+
+	// an empty hash tag uses the whole key
+	if ClusterSlot("{}foo") == ClusterSlot("foo") {
+		t.Errorf("ClusterSlot(%q) should not use an empty hash tag", "{}foo")
+	}
+}
+
+func newTestCluster(t *testing.T, handler func(addr, cmd string, args ...interface{}) (interface{}, error)) *RedisCluster {
+	c, err := NewRedisCluster("redis+cluster://10.0.0.1:6379")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.dial = func(network, addr string, ct, rt, wt time.Duration) (redis.Conn, error) {
+		return &sentinelTestConn{
+			addr: addr,
+			do: func(addr, cmd string, args ...interface{}) (interface{}, error) {
+				if cmd == "CLUSTER" {
+					// 0-8191 on node 1, 8192-16383 on node 2
+					return []interface{}{
+						[]interface{}{int64(0), int64(8191), []interface{}{[]byte("10.0.0.1"), int64(6379)}},
+						[]interface{}{int64(8192), int64(16383), []interface{}{[]byte("10.0.0.2"), int64(6379)}},
+					}, nil
+				}
+				return handler(addr, cmd, args...)
+			},
+		}, nil
+	}
+	return c
+}
+
+func TestRedisClusterRouting(t *testing.T) {
+	moved := false
+	c := newTestCluster(t, func(addr, cmd string, args ...interface{}) (interface{}, error) {
+		switch cmd {
+		case "HGET":
+			// "foo" is slot 12182 on node 2, until it moves to node 1
+			if moved && addr != "10.0.0.1:6379" {
+				return nil, redis.Error("MOVED 12182 10.0.0.1:6379")
+			}
+			return []byte(addr), nil
+		case "KEYS":
+			return []interface{}{[]byte("key@" + addr)}, nil
+		}
+		return nil, errors.New("unexpected " + cmd)
+	})
+
+	conn, err := c.DialTimeout(time.Second, time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	node, err := redis.String(conn.Do("HGET", "foo", "field"))
+	if err != nil || node != "10.0.0.2:6379" {
+		t.Fatalf("HGET foo = %s, %v, want %s, %v", node, err, "10.0.0.2:6379", nil)
+	}
+
+	moved = true
+	node, err = redis.String(conn.Do("HGET", "foo", "field"))
+	if err != nil || node != "10.0.0.1:6379" {
+		t.Fatalf("HGET foo after MOVED = %s, %v, want %s, %v", node, err, "10.0.0.1:6379", nil)
+	}
+
+	if c.nodeFor("foo") != "10.0.0.1:6379" {
+		t.Fatalf("nodeFor(foo) = %s, want %s", c.nodeFor("foo"), "10.0.0.1:6379")
+	}
+
+	keys, err := redis.Strings(conn.Do("KEYS", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "key@10.0.0.1:6379" || keys[1] != "key@10.0.0.2:6379" {
+		t.Fatalf("KEYS * = %v, want a key from each node", keys)
+	}
+}
+
+func TestRedisClusterAsk(t *testing.T) {
+	asked := map[string]bool{}
+	c := newTestCluster(t, func(addr, cmd string, args ...interface{}) (interface{}, error) {
+		switch cmd {
+		case "ASKING":
+			asked[addr] = true
+			return "OK", nil
+		case "SMEMBERS":
+			if addr == "10.0.0.2:6379" {
+				return nil, redis.Error("ASK 12182 10.0.0.3:6379")
+			}
+			if !asked[addr] {
+				return nil, errors.New("ASKING not sent")
+			}
+			return []interface{}{[]byte("app")}, nil
+		}
+		return nil, errors.New("unexpected " + cmd)
+	})
+
+	conn, err := c.DialTimeout(time.Second, time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	members, err := redis.Strings(conn.Do("SMEMBERS", "foo"))
+	if err != nil || len(members) != 1 {
+		t.Fatalf("SMEMBERS foo = %v, %v, want %v, %v", members, err, []string{"app"}, nil)
+	}
+
+	// ASK is a one-time redirect and doesn't update the slot map
+	if c.nodeFor("foo") != "10.0.0.2:6379" {
+		t.Fatalf("nodeFor(foo) = %s, want %s", c.nodeFor("foo"), "10.0.0.2:6379")
+	}
+}
@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	DefaultPoolMaxIdle     = 1
+	DefaultPoolIdleTimeout = 120 * time.Second
+)
+
+// PoolOptions size a backend's connection pool.  They are read from the
+// max_idle, max_active, idle_timeout and wait query parameters of a redis
+// URL.
+type PoolOptions struct {
+	MaxIdle int
+	// MaxActive limits the number of open connections.  Zero is unlimited.
+	MaxActive   int
+	IdleTimeout time.Duration
+	// Wait makes Get block until a connection is free when MaxActive is
+	// reached, rather than failing with redis.ErrPoolExhausted
+	Wait bool
+}
+
+func parsePoolOptions(q url.Values) (PoolOptions, error) {
+	opts := PoolOptions{}
+
+	for name, dest := range map[string]*int{
+		"max_idle":   &opts.MaxIdle,
+		"max_active": &opts.MaxActive,
+	} {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return opts, fmt.Errorf("invalid %s %s", name, v)
+			}
+			*dest = n
+		}
+	}
+
+	if v := q.Get("idle_timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid idle_timeout %s", v)
+		}
+		opts.IdleTimeout = d
+	}
+
+	opts.Wait = q.Get("wait") == "true"
+	return opts, nil
+}
+
+// Apply sets the sizing fields of pool, using the defaults for any that
+// are zero.
+func (o PoolOptions) Apply(pool *redis.Pool) {
+	pool.MaxIdle = o.MaxIdle
+	if pool.MaxIdle == 0 {
+		pool.MaxIdle = DefaultPoolMaxIdle
+	}
+	pool.IdleTimeout = o.IdleTimeout
+	if pool.IdleTimeout == 0 {
+		pool.IdleTimeout = DefaultPoolIdleTimeout
+	}
+	pool.MaxActive = o.MaxActive
+	pool.Wait = o.Wait
+}
+
+// PoolStats describe a connection pool's usage.
+type PoolStats struct {
+	// Active is the number of open connections, in use or idle
+	Active int `json:"active"`
+	InUse  int `json:"in_use"`
+	Idle   int `json:"idle"`
+	// WaitCount is the number of times a caller blocked because MaxActive
+	// connections were in use, for a total of WaitTime
+	WaitCount int64         `json:"wait_count"`
+	WaitTime  time.Duration `json:"wait_time"`
+	// Exhausted is the number of times a connection couldn't be had
+	// because MaxActive connections were in use and Wait was false
+	Exhausted int64 `json:"exhausted"`
+}
+
+// PoolMonitor counts the connections taken from a pool since redigo only
+// tracks the number that are open.
+type PoolMonitor struct {
+	mu        sync.Mutex
+	inUse     int
+	waitCount int64
+	waitTime  time.Duration
+	exhausted int64
+}
+
+// Get takes a connection from pool.  The connection must be closed to
+// return it to the pool.
+func (m *PoolMonitor) Get(pool *redis.Pool) redis.Conn {
+	m.mu.Lock()
+	waiting := pool.MaxActive > 0 && pool.Wait && m.inUse >= pool.MaxActive
+	m.mu.Unlock()
+
+	start := time.Now()
+	conn := pool.Get()
+	waited := time.Since(start)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if waiting {
+		m.waitCount += 1
+		m.waitTime += waited
+	}
+
+	if err := conn.Err(); err != nil {
+		if err == redis.ErrPoolExhausted {
+			m.exhausted += 1
+		}
+		return conn
+	}
+
+	m.inUse += 1
+	return &monitoredConn{Conn: conn, monitor: m}
+}
+
+// Stats returns the current usage of pool.
+func (m *PoolMonitor) Stats(pool *redis.Pool) PoolStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := PoolStats{
+		Active:    pool.ActiveCount(),
+		InUse:     m.inUse,
+		WaitCount: m.waitCount,
+		WaitTime:  m.waitTime,
+		Exhausted: m.exhausted,
+	}
+	// connections from a pool replaced by a reconnect are still counted
+	// as in use until they're closed
+	if stats.Idle = stats.Active - stats.InUse; stats.Idle < 0 {
+		stats.Idle = 0
+	}
+	return stats
+}
+
+func (m *PoolMonitor) release() {
+	m.mu.Lock()
+	m.inUse -= 1
+	m.mu.Unlock()
+}
+
+type monitoredConn struct {
+	redis.Conn
+	monitor *PoolMonitor
+	once    sync.Once
+}
+
+func (c *monitoredConn) Close() error {
+	c.once.Do(c.monitor.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestPoolMonitor(t *testing.T) {
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return &sentinelTestConn{
+				do: func(addr, cmd string, args ...interface{}) (interface{}, error) {
+					return "PONG", nil
+				},
+			}, nil
+		},
+	}
+	PoolOptions{MaxActive: 2}.Apply(pool)
+
+	if pool.MaxIdle != DefaultPoolMaxIdle || pool.IdleTimeout != DefaultPoolIdleTimeout {
+		t.Fatalf("defaults not applied: MaxIdle=%d IdleTimeout=%s", pool.MaxIdle, pool.IdleTimeout)
+	}
+
+	m := &PoolMonitor{}
+	c1 := m.Get(pool)
+	c2 := m.Get(pool)
+	if err := m.Get(pool).Err(); err != redis.ErrPoolExhausted {
+		t.Fatalf("expected ErrPoolExhausted, got %v", err)
+	}
+
+	stats := m.Stats(pool)
+	if stats.Active != 2 || stats.InUse != 2 || stats.Idle != 0 || stats.Exhausted != 1 {
+		t.Fatalf("unexpected stats with 2 connections in use: %+v", stats)
+	}
+
+	c1.Close()
+	c1.Close()
+	stats = m.Stats(pool)
+	if stats.InUse != 1 || stats.Idle != 1 {
+		t.Fatalf("unexpected stats after close: %+v", stats)
+	}
+	c2.Close()
+
+	pool.Wait = true
+	c1, c2 = m.Get(pool), m.Get(pool)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c1.Close()
+	}()
+	m.Get(pool).Close()
+	c2.Close()
+
+	stats = m.Stats(pool)
+	if stats.WaitCount != 1 || stats.WaitTime <= 0 {
+		t.Fatalf("expected one wait: %+v", stats)
+	}
+}
@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"github.com/garyburd/redigo/redis"
+)
+
+// DefaultScanCount is the COUNT hint sent with each SCAN when none is
+// configured.
+const DefaultScanCount = 1000
+
+// ScanKeys returns the keys matching pattern using SCAN so the server is
+// not blocked the way KEYS blocks it.  count is the page size hint for each
+// SCAN; zero uses DefaultScanCount.  SCAN may return a key more than once,
+// but each key appears in the result only once.
+func ScanKeys(conn redis.Conn, pattern string, count int) ([]string, error) {
+	if count <= 0 {
+		count = DefaultScanCount
+	}
+
+	seen := make(map[string]bool)
+	keys := []string{}
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", count))
+		if err != nil {
+			return nil, err
+		}
+
+		var page []string
+		_, err = redis.Scan(reply, &cursor, &page)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range page {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+
+		if cursor == "0" {
+			return keys, nil
+		}
+	}
+}
+
+// PipelineSize is the most commands sent in a single pipeline before
+// reading the replies, so large listings don't buffer unbounded replies.
+const PipelineSize = 1000
+
+// pipeline sends the n commands built by command in batches of
+// PipelineSize and passes each reply to recv.  redis.Error replies are
+// passed to recv rather than aborting the batch.  Commands redirected with
+// MOVED or ASK, e.g. during a resharding, are sent again with Do once the
+// batch's replies have all been read so the cluster connection can follow
+// the redirect without reading another command's reply.
+func pipeline(conn redis.Conn, n int, command func(i int) (string, []interface{}),
+	recv func(i int, reply interface{}, err error) error) error {
+
+	for start := 0; start < n; start += PipelineSize {
+		end := start + PipelineSize
+		if end > n {
+			end = n
+		}
+
+		for i := start; i < end; i++ {
+			cmd, args := command(i)
+			if err := conn.Send(cmd, args...); err != nil {
+				return err
+			}
+		}
+
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+
+		redirected := []int{}
+		for i := start; i < end; i++ {
+			reply, err := conn.Receive()
+			if err != nil {
+				if _, ok := err.(redis.Error); !ok {
+					return err
+				}
+			}
+			if kind, _, _ := parseRedirect(err); kind != "" {
+				redirected = append(redirected, i)
+				continue
+			}
+			if err := recv(i, reply, err); err != nil {
+				return err
+			}
+		}
+
+		for _, i := range redirected {
+			cmd, args := command(i)
+			reply, err := conn.Do(cmd, args...)
+			if err != nil {
+				if _, ok := err.(redis.Error); !ok {
+					return err
+				}
+			}
+			if err := recv(i, reply, err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// HGetMulti pipelines an HGET of field for each key and returns the values
+// in the same order.  Missing keys or fields are returned as "".
+func HGetMulti(conn redis.Conn, keys []string, field string) ([]string, error) {
+	values := make([]string, len(keys))
+	err := pipeline(conn, len(keys),
+		func(i int) (string, []interface{}) {
+			return "HGET", []interface{}{keys[i], field}
+		},
+		func(i int, reply interface{}, err error) error {
+			if err != nil || reply == nil {
+				return nil
+			}
+			values[i], err = redis.String(reply, nil)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// HGetAllMulti pipelines an HGETALL for each key and returns the hashes in
+// the same order.  Missing keys are returned as empty maps.
+func HGetAllMulti(conn redis.Conn, keys []string) ([]map[string]string, error) {
+	values := make([]map[string]string, len(keys))
+	err := pipeline(conn, len(keys),
+		func(i int) (string, []interface{}) {
+			return "HGETALL", []interface{}{keys[i]}
+		},
+		func(i int, reply interface{}, err error) error {
+			if err != nil {
+				return err
+			}
+
+			values[i] = make(map[string]string)
+			if reply == nil {
+				return nil
+			}
+			fields, err := redis.Strings(reply, nil)
+			if err != nil {
+				return err
+			}
+
+			for j := 0; j+1 < len(fields); j += 2 {
+				values[i][fields[j]] = fields[j+1]
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
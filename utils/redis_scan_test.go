@@ -0,0 +1,207 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestScanKeys(t *testing.T) {
+	pages := map[string][]interface{}{
+		"0": {[]byte("7"), []interface{}{[]byte("a"), []byte("b")}},
+		// SCAN can return a key again
+		"7": {[]byte("0"), []interface{}{[]byte("b"), []byte("c")}},
+	}
+
+	counts := []string{}
+	conn := &sentinelTestConn{
+		do: func(addr, cmd string, args ...interface{}) (interface{}, error) {
+			if cmd != "SCAN" || len(args) != 5 {
+				return nil, errors.New("unexpected " + cmd)
+			}
+			counts = append(counts, fmt.Sprint(args[4]))
+			return pages[args[0].(string)], nil
+		},
+	}
+
+	keys, err := ScanKeys(conn, "dev/*", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 3 || keys[0] != "a" || keys[1] != "b" || keys[2] != "c" {
+		t.Fatalf("ScanKeys() = %v, want %v", keys, []string{"a", "b", "c"})
+	}
+
+	if len(counts) != 2 || counts[0] != fmt.Sprint(DefaultScanCount) {
+		t.Fatalf("SCAN COUNT = %v, want %d twice", counts, DefaultScanCount)
+	}
+}
+
+func TestRedisClusterScan(t *testing.T) {
+	c := newTestCluster(t, func(addr, cmd string, args ...interface{}) (interface{}, error) {
+		if cmd != "SCAN" {
+			return nil, errors.New("unexpected " + cmd)
+		}
+
+		// each node returns its keys over two pages
+		switch fmt.Sprint(args[0]) {
+		case "0":
+			return []interface{}{[]byte("3"), []interface{}{[]byte("first@" + addr)}}, nil
+		case "3":
+			return []interface{}{[]byte("0"), []interface{}{[]byte("second@" + addr)}}, nil
+		}
+		return nil, errors.New("bad cursor " + fmt.Sprint(args[0]))
+	})
+
+	conn, err := c.DialTimeout(time.Second, time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	keys, err := ScanKeys(conn, "*", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(keys)
+	want := []string{"first@10.0.0.1:6379", "first@10.0.0.2:6379", "second@10.0.0.1:6379", "second@10.0.0.2:6379"}
+	if len(keys) != len(want) {
+		t.Fatalf("ScanKeys() = %v, want %v", keys, want)
+	}
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Fatalf("ScanKeys() = %v, want %v", keys, want)
+		}
+	}
+
+	if _, err := redis.Values(conn.Do("SCAN", "bogus")); err == nil {
+		t.Fatal("SCAN with a bad cursor should fail")
+	}
+}
+
+// pipelineTestConn answers pipelined commands with reply and counts the
+// round trips made.
+type pipelineTestConn struct {
+	sentinelTestConn
+	queued  []string
+	flushes int
+	reply   func(cmd string) (interface{}, error)
+}
+
+func (c *pipelineTestConn) Send(cmd string, args ...interface{}) error {
+	c.queued = append(c.queued, fmt.Sprint(args[0]))
+	return nil
+}
+
+func (c *pipelineTestConn) Flush() error {
+	c.flushes += 1
+	return nil
+}
+
+func (c *pipelineTestConn) Receive() (interface{}, error) {
+	key := c.queued[0]
+	c.queued = c.queued[1:]
+	return c.reply(key)
+}
+
+func TestHGetMulti(t *testing.T) {
+	conn := &pipelineTestConn{
+		reply: func(key string) (interface{}, error) {
+			switch key {
+			case "missing":
+				return nil, nil
+			case "wrongtype":
+				return nil, redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+			}
+			return []byte("value of " + key), nil
+		},
+	}
+
+	keys := []string{"missing", "wrongtype"}
+	for i := 0; i < PipelineSize; i++ {
+		keys = append(keys, fmt.Sprint(i))
+	}
+
+	values, err := HGetMulti(conn, keys, "location")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(values) != len(keys) {
+		t.Fatalf("HGetMulti() returned %d values, want %d", len(values), len(keys))
+	}
+	if values[0] != "" || values[1] != "" || values[2] != "value of 0" {
+		t.Fatalf("HGetMulti() = %v..., want [ \"\" \"\" \"value of 0\"...]", values[:3])
+	}
+
+	// one round trip per PipelineSize keys
+	if conn.flushes != 2 {
+		t.Fatalf("HGetMulti() flushed %d times, want %d", conn.flushes, 2)
+	}
+}
+
+func TestHGetMultiRedirect(t *testing.T) {
+	conn := &pipelineTestConn{
+		reply: func(key string) (interface{}, error) {
+			switch key {
+			case "moved":
+				return nil, redis.Error("MOVED 3999 10.0.0.2:6379")
+			case "asked":
+				return nil, redis.Error("ASK 3999 10.0.0.2:6379")
+			}
+			return []byte("value of " + key), nil
+		},
+	}
+
+	retried := []string{}
+	conn.do = func(addr, cmd string, args ...interface{}) (interface{}, error) {
+		// a retry in the middle of the batch would read another key's reply
+		if len(conn.queued) != 0 {
+			t.Fatalf("%s %v retried with %d replies pending", cmd, args, len(conn.queued))
+		}
+		key := fmt.Sprint(args[0])
+		retried = append(retried, key)
+		return []byte("redirected " + key), nil
+	}
+
+	values, err := HGetMulti(conn, []string{"a", "moved", "b", "asked", "c"}, "location")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"value of a", "redirected moved", "value of b", "redirected asked", "value of c"}
+	for i := range want {
+		if values[i] != want[i] {
+			t.Fatalf("HGetMulti() = %v, want %v", values, want)
+		}
+	}
+	if len(retried) != 2 || retried[0] != "moved" || retried[1] != "asked" {
+		t.Fatalf("retried %v, want [moved asked]", retried)
+	}
+}
+
+func TestHGetAllMulti(t *testing.T) {
+	conn := &pipelineTestConn{
+		reply: func(key string) (interface{}, error) {
+			if key == "empty" {
+				return []interface{}{}, nil
+			}
+			return []interface{}{[]byte("k"), []byte(key)}, nil
+		},
+	}
+
+	values, err := HGetAllMulti(conn, []string{"a", "empty"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(values) != 2 || values[0]["k"] != "a" || len(values[1]) != 0 {
+		t.Fatalf("HGetAllMulti() = %v, want %v", values, []map[string]string{{"k": "a"}, {}})
+	}
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	for _, tt := range []struct {
+		spec  string
+		t     string
+		match bool
+	}{
+		{"* * * * *", "2015-03-04 05:06", true},
+		{"*/15 * * * *", "2015-03-04 05:30", true},
+		{"*/15 * * * *", "2015-03-04 05:31", false},
+		{"5/10 * * * *", "2015-03-04 05:25", true},
+		{"0 9-17 * * 1-5", "2015-03-04 12:00", true},
+		{"0 9-17 * * 1-5", "2015-03-07 12:00", false},
+		{"0 0 1,15 * *", "2015-03-15 00:00", true},
+		{"0 0 * * 7", "2015-03-08 00:00", true},
+		{"0 0 13 * 5", "2015-03-13 00:00", true},
+		{"0 0 13 * 5", "2015-03-20 00:00", true},
+		{"0 0 13 * 5", "2015-03-19 00:00", false},
+		{"@daily", "2015-03-04 00:00", true},
+		{"@hourly", "2015-03-04 05:01", false},
+	} {
+		s, err := ParseSchedule(tt.spec)
+		if err != nil {
+			t.Fatalf("ParseSchedule(%q): %s", tt.spec, err)
+		}
+		if match := s.Matches(at(tt.t)); match != tt.match {
+			t.Errorf("%q.Matches(%s) = %v, want %v", tt.spec, tt.t, match, tt.match)
+		}
+	}
+
+	s, _ := ParseSchedule("30 2 * * *")
+	if next := s.Next(at("2015-03-04 05:06")); !next.Equal(at("2015-03-05 02:30")) {
+		t.Errorf("Next() = %s, want 2015-03-05 02:30", next)
+	}
+	s, _ = ParseSchedule("0 0 30 2 *")
+	if next := s.Next(at("2015-03-04 05:06")); !next.IsZero() {
+		t.Errorf("Next() = %s, want never", next)
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+}
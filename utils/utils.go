@@ -5,6 +5,7 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 	"github.com/codegangsta/cli"
 
 	"os"
@@ -54,6 +55,9 @@ func HumanDuration(d time.Duration) string {
 	return fmt.Sprintf("%f years", d.Hours()/24/365)
 }
 
+// SplitDockerImage splits an image name into its registry, repository and
+// tag.  The tag of an image pinned to a digest, e.g. ubuntu@sha256:..., is
+// the digest.
 func SplitDockerImage(img string) (string, string, string) {
 	index := 0
 	repository := img
@@ -65,16 +69,34 @@ func SplitDockerImage(img string) (string, string, string) {
 		repository = img[index:]
 	}
 
-	if strings.Contains(img, ":") {
-		separator := strings.Index(img, ":")
-		repository = img[index:separator]
-		index = separator + 1
-		tag = img[index:]
+	if separator := strings.Index(repository, "@"); separator >= 0 {
+		return registry, repository[:separator], repository[separator+1:]
+	}
+
+	if strings.Contains(repository, ":") {
+		separator := strings.Index(repository, ":")
+		tag = repository[separator+1:]
+		repository = repository[:separator]
 	}
 
 	return registry, repository, tag
 }
 
+// IsImageDigest returns true if tag, from SplitDockerImage, is a content
+// digest like sha256:<hex> rather than a tag.
+func IsImageDigest(tag string) bool {
+	parts := strings.SplitN(tag, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return false
+	}
+	for _, c := range parts[1] {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
 func StringInSlice(a string, list []string) bool {
 	for _, b := range list {
 		if b == a {
@@ -127,6 +149,22 @@ func GalaxyRedisHost(c *cli.Context) string {
 	return strings.TrimSpace(GetEnv("GALAXY_REGISTRY_URL", ""))
 }
 
+func GalaxyRegistryMirror(c *cli.Context) string {
+	if c.GlobalString("registry-mirror") != "" {
+		return strings.TrimSpace(c.GlobalString("registry-mirror"))
+	}
+
+	return strings.TrimSpace(GetEnv("GALAXY_REGISTRY_MIRROR_URL", ""))
+}
+
+func GalaxyRegistryReplica(c *cli.Context) string {
+	if c.GlobalString("registry-replica") != "" {
+		return strings.TrimSpace(c.GlobalString("registry-replica"))
+	}
+
+	return strings.TrimSpace(GetEnv("GALAXY_REGISTRY_REPLICA_URL", ""))
+}
+
 // NextSlot finds the first available index in an array of integers
 func NextSlot(used []int) int {
 	free := 0
@@ -140,7 +178,10 @@ RESTART:
 	return free
 }
 
+// ParseMemory parses a memory limit in bytes with an optional b, k, m or g
+// unit, e.g. "512m" or "2G".  "" is 0, no limit.
 func ParseMemory(mem string) (int64, error) {
+	mem = strings.ToLower(strings.TrimSpace(mem))
 	if mem == "" {
 		return 0, nil
 	}
@@ -171,3 +212,191 @@ func ParseMemory(mem string) (int64, error) {
 	}
 	return i * multiplier, nil
 }
+
+// ParseCPUShares parses a relative CPU weight.  "" is 0, no limit.
+func ParseCPUShares(cpu string) (int64, error) {
+	cpu = strings.TrimSpace(cpu)
+	if cpu == "" {
+		return 0, nil
+	}
+
+	i, err := strconv.ParseInt(cpu, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if i <= 0 {
+		return 0, fmt.Errorf("CPU shares must be positive: %s", cpu)
+	}
+	return i, nil
+}
+
+// ParseRestartPolicy parses a docker restart policy, "no", "always",
+// "on-failure" or "on-failure:<max retries>", into its name and maximum
+// retry count.  "" is "no".
+func ParseRestartPolicy(policy string) (string, int, error) {
+	policy = strings.ToLower(strings.TrimSpace(policy))
+	parts := strings.SplitN(policy, ":", 2)
+	switch parts[0] {
+	case "", "no":
+		if len(parts) == 1 {
+			return "no", 0, nil
+		}
+	case "always":
+		if len(parts) == 1 {
+			return "always", 0, nil
+		}
+	case "on-failure":
+		if len(parts) == 1 {
+			return "on-failure", 0, nil
+		}
+		retries, err := strconv.Atoi(parts[1])
+		if err != nil || retries < 0 {
+			return "", 0, fmt.Errorf("invalid restart retry count: %s", parts[1])
+		}
+		return "on-failure", retries, nil
+	}
+	return "", 0, fmt.Errorf("invalid restart policy: %s", policy)
+}
+
+// stopSignals are the signals apps commonly shut down on.
+var stopSignals = map[string]int{
+	"HUP":  1,
+	"INT":  2,
+	"QUIT": 3,
+	"KILL": 9,
+	"USR1": 10,
+	"USR2": 12,
+	"TERM": 15,
+}
+
+// ParseStopSignal parses the signal sent to stop a container, a name like
+// "SIGINT" or "INT" or a number, into its number.  "" is SIGTERM.
+func ParseStopSignal(signal string) (int, error) {
+	signal = strings.ToUpper(strings.TrimSpace(signal))
+	if signal == "" {
+		return stopSignals["TERM"], nil
+	}
+	if n, ok := stopSignals[strings.TrimPrefix(signal, "SIG")]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(signal)
+	if err != nil || n <= 0 || n > 64 {
+		return 0, fmt.Errorf("invalid stop signal: %s", signal)
+	}
+	return n, nil
+}
+
+// Ulimit is a resource limit set on a container's processes.
+type Ulimit struct {
+	Name string `json:"Name"`
+	Soft int64  `json:"Soft"`
+	Hard int64  `json:"Hard"`
+}
+
+// ParseUlimits parses comma separated ulimits, e.g.
+// "nofile=1024:65536,nproc=4096", where the hard limit is the soft limit
+// if it's left out.
+func ParseUlimits(ulimits string) ([]Ulimit, error) {
+	limits := []Ulimit{}
+	for _, ulimit := range strings.Split(ulimits, ",") {
+		if strings.TrimSpace(ulimit) == "" {
+			continue
+		}
+		parts := strings.SplitN(ulimit, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" {
+			return nil, fmt.Errorf("invalid ulimit: %s", ulimit)
+		}
+
+		values := strings.SplitN(strings.TrimSpace(parts[1]), ":", 2)
+		soft, err := strconv.ParseInt(values[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ulimit: %s", ulimit)
+		}
+		hard := soft
+		if len(values) == 2 {
+			hard, err = strconv.ParseInt(values[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ulimit: %s", ulimit)
+			}
+		}
+		if soft > hard {
+			return nil, fmt.Errorf("ulimit soft limit is above the hard limit: %s", ulimit)
+		}
+		limits = append(limits, Ulimit{Name: name, Soft: soft, Hard: hard})
+	}
+	return limits, nil
+}
+
+// ParseLogOptions parses comma separated docker log driver options, e.g.
+// "max-size=10m,max-file=3".
+func ParseLogOptions(opts string) (map[string]string, error) {
+	options := make(map[string]string)
+	for _, opt := range strings.Split(opts, ",") {
+		if strings.TrimSpace(opt) == "" {
+			continue
+		}
+		parts := strings.SplitN(opt, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" {
+			return nil, fmt.Errorf("invalid log option: %s", opt)
+		}
+		options[key] = strings.TrimSpace(parts[1])
+	}
+	return options, nil
+}
+
+// SplitCommand splits a command line into its arguments the way a shell
+// would, without expanding anything.  Arguments are separated by
+// whitespace, single quotes keep everything up to the next one, and double
+// quotes keep everything but backslash escaped quotes and backslashes.
+func SplitCommand(cmd string) ([]string, error) {
+	args := []string{}
+	var arg []rune
+	inArg := false
+	var quote rune
+	escaped := false
+
+	for _, r := range cmd {
+		switch {
+		case escaped:
+			if quote == '"' && r != '"' && r != '\\' {
+				arg = append(arg, '\\')
+			}
+			arg = append(arg, r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				arg = append(arg, r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, string(arg))
+				arg = arg[:0]
+				inArg = false
+			}
+		default:
+			arg = append(arg, r)
+			inArg = true
+		}
+	}
+
+	if escaped {
+		return nil, fmt.Errorf("unfinished escape in %s", cmd)
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %s", cmd)
+	}
+	if inArg {
+		args = append(args, string(arg))
+	}
+	return args, nil
+}
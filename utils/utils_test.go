@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -76,6 +77,27 @@ func TestSplitDockerImageWithRepositoryAndTag(t *testing.T) {
 	}
 }
 
+func TestSplitDockerImageWithDigest(t *testing.T) {
+	digest := "sha256:2a3b8c5e0f1d4c6b7a8e9f0d1c2b3a4e5f6d7c8b9a0e1f2d3c4b5a6e7f8d9c0b"
+	registry, repository, tag := SplitDockerImage("custom.registry/ubuntu@" + digest)
+
+	if registry != "custom.registry" {
+		t.Fatalf("Expected custom.registry. Got %s", registry)
+	}
+	if repository != "ubuntu" {
+		t.Fatalf("Expected ubuntu. Got %s", repository)
+	}
+	if tag != digest {
+		t.Fatalf("Expected %s. Got %s", digest, tag)
+	}
+	if !IsImageDigest(tag) {
+		t.Fatalf("Expected %s to be a digest", tag)
+	}
+	if IsImageDigest("12.04") {
+		t.Fatal("Expected 12.04 to be a tag")
+	}
+}
+
 func TestNextSlotEmpty(t *testing.T) {
 	if NextSlot([]int{}) != 0 {
 		t.Fatal("Expected 0")
@@ -167,3 +189,170 @@ func TestParseMemGigSuffix(t *testing.T) {
 		t.Fatal("Expected 4294967296")
 	}
 }
+
+func TestParseMemUpperCase(t *testing.T) {
+	i, err := ParseMemory("2GB")
+	if err != nil {
+		t.Fatalf("Expected 2147483648. Got %s", err)
+	}
+	if i != 2147483648 {
+		t.Fatal("Expected 2147483648")
+	}
+}
+
+func TestParseCPUShares(t *testing.T) {
+	i, err := ParseCPUShares("512")
+	if err != nil {
+		t.Fatalf("Expected 512. Got %s", err)
+	}
+	if i != 512 {
+		t.Fatal("Expected 512")
+	}
+
+	i, err = ParseCPUShares("")
+	if err != nil || i != 0 {
+		t.Fatalf("Expected 0. Got %d, %s", i, err)
+	}
+
+	for _, cpu := range []string{"abc", "0", "-1"} {
+		if _, err := ParseCPUShares(cpu); err == nil {
+			t.Fatalf("Expected error for %q", cpu)
+		}
+	}
+}
+
+func TestParseRestartPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		policy  string
+		name    string
+		retries int
+	}{
+		{"", "no", 0},
+		{"no", "no", 0},
+		{"always", "always", 0},
+		{"on-failure", "on-failure", 0},
+		{"On-Failure:5", "on-failure", 5},
+	} {
+		name, retries, err := ParseRestartPolicy(tt.policy)
+		if err != nil {
+			t.Fatalf("Expected %s:%d for %q. Got %s", tt.name, tt.retries, tt.policy, err)
+		}
+		if name != tt.name || retries != tt.retries {
+			t.Fatalf("Expected %s:%d for %q. Got %s:%d", tt.name, tt.retries, tt.policy, name, retries)
+		}
+	}
+
+	for _, policy := range []string{"sometimes", "always:3", "on-failure:x", "on-failure:-1"} {
+		if _, _, err := ParseRestartPolicy(policy); err == nil {
+			t.Fatalf("Expected error for %q", policy)
+		}
+	}
+}
+
+func TestParseStopSignal(t *testing.T) {
+	for _, tt := range []struct {
+		signal string
+		n      int
+	}{
+		{"", 15},
+		{"SIGINT", 2},
+		{"quit", 3},
+		{" SIGUSR1", 10},
+		{"28", 28},
+	} {
+		n, err := ParseStopSignal(tt.signal)
+		if err != nil || n != tt.n {
+			t.Fatalf("Expected %d for %q. Got %d, %v", tt.n, tt.signal, n, err)
+		}
+	}
+
+	for _, signal := range []string{"SIGFOO", "0", "-1", "65"} {
+		if _, err := ParseStopSignal(signal); err == nil {
+			t.Fatalf("Expected error for %q", signal)
+		}
+	}
+}
+
+func TestParseUlimits(t *testing.T) {
+	ulimits, err := ParseUlimits("nofile=1024:65536, nproc=4096,")
+	if err != nil {
+		t.Fatalf("Expected ulimits. Got %s", err)
+	}
+	expected := []Ulimit{
+		{Name: "nofile", Soft: 1024, Hard: 65536},
+		{Name: "nproc", Soft: 4096, Hard: 4096},
+	}
+	if !reflect.DeepEqual(ulimits, expected) {
+		t.Fatalf("Expected %v. Got %v", expected, ulimits)
+	}
+
+	for _, ulimit := range []string{"nofile", "=10", "nofile=x", "nofile=10:y", "nofile=10:5"} {
+		if _, err := ParseUlimits(ulimit); err == nil {
+			t.Fatalf("Expected error for %q", ulimit)
+		}
+	}
+}
+
+func TestParseLogOptions(t *testing.T) {
+	opts, err := ParseLogOptions("max-size=10m, max-file=3,")
+	if err != nil {
+		t.Fatalf("Expected options. Got %s", err)
+	}
+	expected := map[string]string{"max-size": "10m", "max-file": "3"}
+	if !reflect.DeepEqual(opts, expected) {
+		t.Fatalf("Expected %v. Got %v", expected, opts)
+	}
+
+	opts, err = ParseLogOptions("")
+	if err != nil || len(opts) != 0 {
+		t.Fatalf("Expected no options. Got %v, %v", opts, err)
+	}
+
+	for _, opt := range []string{"max-size", "=10m"} {
+		if _, err := ParseLogOptions(opt); err == nil {
+			t.Fatalf("Expected error for %q", opt)
+		}
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	for _, tt := range []struct {
+		cmd  string
+		args []string
+	}{
+		{"", []string{}},
+		{"  bin/worker  -q high ", []string{"bin/worker", "-q", "high"}},
+		{`sh -c 'exec bin/web --port $PORT'`, []string{"sh", "-c", "exec bin/web --port $PORT"}},
+		{`echo "say \"hi\"" a\ b`, []string{"echo", `say "hi"`, "a b"}},
+		{`echo "a\b" '' x""y`, []string{"echo", `a\b`, "", "xy"}},
+	} {
+		args, err := SplitCommand(tt.cmd)
+		if err != nil {
+			t.Fatalf("Expected %q for %q. Got %s", tt.args, tt.cmd, err)
+		}
+		if !reflect.DeepEqual(args, tt.args) {
+			t.Fatalf("Expected %q for %q. Got %q", tt.args, tt.cmd, args)
+		}
+	}
+
+	for _, cmd := range []string{`echo 'a`, `echo "a`, `echo a\`} {
+		if _, err := SplitCommand(cmd); err == nil {
+			t.Fatalf("Expected error for %q", cmd)
+		}
+	}
+}
+
+func TestGlobToLike(t *testing.T) {
+	for _, tt := range []struct {
+		glob, like string
+	}{
+		{"dev/*", "dev/%"},
+		{"dev/web?/*", "dev/web_/%"},
+		{"dev/my_app/100%", `dev/my\_app/100\%`},
+		{`a\b`, `a\\b`},
+	} {
+		if like := GlobToLike(tt.glob); like != tt.like {
+			t.Errorf("GlobToLike(%q) = %q, want %q", tt.glob, like, tt.like)
+		}
+	}
+}
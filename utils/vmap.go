@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"fmt"
 	"strconv"
 	"strings"
 )
@@ -80,6 +81,29 @@ func (v *VersionedMap) Get(key string) string {
 	return maxEntry.value
 }
 
+// GetAt returns the value key had at version, ignoring anything set after
+// it.
+func (v *VersionedMap) GetAt(key string, version int64) string {
+	maxEntry := mapEntry{}
+	for _, entry := range v.values[key] {
+		if entry.version > version {
+			continue
+		}
+		if entry.version > maxEntry.version {
+			maxEntry = entry
+		}
+		if entry.version == maxEntry.version && entry.value > maxEntry.value {
+			maxEntry = entry
+		}
+	}
+	return maxEntry.value
+}
+
+// Version returns the version key was last set at, or 0 if it never was.
+func (v *VersionedMap) Version(key string) int64 {
+	return v.currentVersion(key)
+}
+
 func (v *VersionedMap) Keys() []string {
 	keys := []string{}
 	for k := range v.values {
@@ -125,10 +149,14 @@ func (v *VersionedMap) MarshalMap() map[string]string {
 func (v *VersionedMap) UnmarshalMap(serialized map[string]string) error {
 
 	for key, val := range serialized {
+		// key:op:version
 		parts := strings.Split(key, ":")
+		if len(parts) != 3 {
+			return fmt.Errorf("invalid versioned map key %q", key)
+		}
 		version, err := strconv.ParseInt(parts[2], 10, 64)
 		if err != nil {
-			return err
+			return fmt.Errorf("invalid versioned map key %q", key)
 		}
 		if parts[1] == "s" {
 			v.SetVersion(parts[0], val, version)
@@ -139,6 +167,20 @@ func (v *VersionedMap) UnmarshalMap(serialized map[string]string) error {
 	return nil
 }
 
+// SerializedVersion returns the latest version in a map produced by
+// MarshalMap without unmarshaling it.
+func SerializedVersion(serialized map[string]string) int64 {
+	latest := int64(0)
+	for key := range serialized {
+		sep := strings.LastIndex(key, ":")
+		version, err := strconv.ParseInt(key[sep+1:], 10, 64)
+		if err == nil && version > latest {
+			latest = version
+		}
+	}
+	return latest
+}
+
 // MarshalExpiredMap returns historical entries that have been
 // superseded by newer values
 func (v *VersionedMap) MarshalExpiredMap(age int64) map[string]string {
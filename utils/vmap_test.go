@@ -132,6 +132,12 @@ func TestUnmarshalMap(t *testing.T) {
 		t.Fail()
 	}
 
+	for _, key := range []string{"k1", "k1:s", "k1:s:one"} {
+		err := NewVersionedMap().UnmarshalMap(map[string]string{key: "v1"})
+		if err == nil {
+			t.Fatalf("expected an error unmarshaling %q", key)
+		}
+	}
 }
 
 func TestLatestversion(t *testing.T) {
@@ -206,3 +212,16 @@ func TestMarshalExpiredWithAge(t *testing.T) {
 		t.Fatalf("Expected value not found. Got %#v", old)
 	}
 }
+
+func TestGetAt(t *testing.T) {
+	vmap := NewVersionedMap()
+	vmap.SetVersion("k1", "v1", 1)
+	vmap.SetVersion("k1", "v2", 3)
+	vmap.UnSetVersion("k1", 5)
+
+	for version, want := range map[int64]string{0: "", 1: "v1", 2: "v1", 3: "v2", 4: "v2", 5: ""} {
+		if got := vmap.GetAt("k1", version); got != want {
+			t.Fatalf("GetAt(k1, %d) = %q, want %q", version, got, want)
+		}
+	}
+}